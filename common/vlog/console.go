@@ -0,0 +1,111 @@
+package vlog
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// consoleEncoder writes human readable lines:
+//   2017-03-01T10:00:00+08:00 INFO message key=value name="with space"
+type consoleEncoder struct {
+	bytes []byte
+}
+
+// NewConsoleEncoder returns an encoder of human readable lines.
+func NewConsoleEncoder() zap.Encoder {
+	return &consoleEncoder{}
+}
+
+func (enc *consoleEncoder) addKey(key string) {
+	if len(enc.bytes) > 0 {
+		enc.bytes = append(enc.bytes, ' ')
+	}
+	enc.bytes = append(enc.bytes, key...)
+	enc.bytes = append(enc.bytes, '=')
+}
+
+func (enc *consoleEncoder) AddString(key, value string) {
+	enc.addKey(key)
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		enc.bytes = strconv.AppendQuote(enc.bytes, value)
+		return
+	}
+	enc.bytes = append(enc.bytes, value...)
+}
+
+func (enc *consoleEncoder) AddBool(key string, value bool) {
+	enc.addKey(key)
+	enc.bytes = strconv.AppendBool(enc.bytes, value)
+}
+
+func (enc *consoleEncoder) AddInt(key string, value int) {
+	enc.AddInt64(key, int64(value))
+}
+
+func (enc *consoleEncoder) AddInt64(key string, value int64) {
+	enc.addKey(key)
+	enc.bytes = strconv.AppendInt(enc.bytes, value, 10)
+}
+
+func (enc *consoleEncoder) AddUint(key string, value uint) {
+	enc.AddUint64(key, uint64(value))
+}
+
+func (enc *consoleEncoder) AddUint64(key string, value uint64) {
+	enc.addKey(key)
+	enc.bytes = strconv.AppendUint(enc.bytes, value, 10)
+}
+
+func (enc *consoleEncoder) AddFloat64(key string, value float64) {
+	enc.addKey(key)
+	enc.bytes = strconv.AppendFloat(enc.bytes, value, 'g', -1, 64)
+}
+
+func (enc *consoleEncoder) AddMarshaler(key string, marshaler zap.LogMarshaler) error {
+	nested := &consoleEncoder{}
+	err := marshaler.MarshalLog(nested)
+	enc.addKey(key)
+	enc.bytes = append(enc.bytes, '{')
+	enc.bytes = append(enc.bytes, nested.bytes...)
+	enc.bytes = append(enc.bytes, '}')
+	return err
+}
+
+func (enc *consoleEncoder) AddObject(key string, value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	enc.addKey(key)
+	enc.bytes = append(enc.bytes, b...)
+	return nil
+}
+
+func (enc *consoleEncoder) Clone() zap.Encoder {
+	clone := &consoleEncoder{bytes: make([]byte, len(enc.bytes))}
+	copy(clone.bytes, enc.bytes)
+	return clone
+}
+
+func (enc *consoleEncoder) Free() {}
+
+func (enc *consoleEncoder) WriteEntry(w io.Writer, msg string, lvl zap.Level, t time.Time) error {
+	line := make([]byte, 0, 64+len(msg)+len(enc.bytes))
+	line = t.AppendFormat(line, time.RFC3339)
+	line = append(line, ' ')
+	line = append(line, strings.ToUpper(lvl.String())...)
+	line = append(line, ' ')
+	line = append(line, msg...)
+	if len(enc.bytes) > 0 {
+		line = append(line, ' ')
+		line = append(line, enc.bytes...)
+	}
+	line = append(line, '\n')
+	_, err := w.Write(line)
+	return err
+}
@@ -1,6 +1,8 @@
 package vlog
 
 import (
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"strings"
@@ -10,49 +12,157 @@ import (
 
 var Logger zap.Logger
 
+// encoding and output of Logger, shared by the loggers of Named
+var (
+	encoding string
+	output   zap.WriteSyncer
+)
+
+// Options configure the logger
+type Options struct {
+	// Level can be "debug", "info", "warn", "error" or "fatal"
+	Level string
+	// Encoding can be "json" or "console"
+	Encoding string
+	// Outputs are "stdout", "stderr" or file paths, the logs are written to
+	// all of them
+	Outputs []string
+}
+
+// Init logs in JSON to stdout when debugging, to the lp file otherwise.
 func Init(lp string, lv string, isDebug bool) {
-	var level zap.Level
+	opts := Options{
+		Level:    lv,
+		Encoding: "json",
+		Outputs:  []string{lp},
+	}
+	if isDebug {
+		opts.Outputs = []string{"stdout"}
+	}
+
+	if err := InitWithOptions(opts); err != nil {
+		log.Panic(err)
+	}
+}
+
+// InitWithOptions sets Logger up from the options.
+func InitWithOptions(opts Options) error {
+	out, err := openOutputs(opts.Outputs)
+	if err != nil {
+		return err
+	}
+	logger, err := newLogger(opts.Encoding, parseLevel(opts.Level), out)
+	if err != nil {
+		return err
+	}
+	Logger = logger
+	encoding = opts.Encoding
+	output = out
+	return nil
+}
+
+// New returns a logger configured by the options.
+func New(opts Options) (zap.Logger, error) {
+	out, err := openOutputs(opts.Outputs)
+	if err != nil {
+		return nil, err
+	}
+	return newLogger(opts.Encoding, parseLevel(opts.Level), out)
+}
+
+// Named returns a logger writing like Logger, to the same outputs, but at
+// its own level, its logs have a "plugin" field set to name. The level of
+// Logger is left unchanged.
+func Named(name string, level string) (zap.Logger, error) {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	out := output
+	if out == nil {
+		out = zap.AddSync(os.Stdout)
+	}
+	logger, err := newLogger(encoding, lvl, out)
+	if err != nil {
+		return nil, err
+	}
+	return logger.With(zap.String("plugin", name)), nil
+}
+
+func newLogger(encoding string, lvl zap.Level, out zap.WriteSyncer) (zap.Logger, error) {
+	var enc zap.Encoder
+	switch strings.ToLower(encoding) {
+	case "", "json":
+		enc = zap.NewJSONEncoder(
+			zap.RFC3339Formatter("@timestamp"), // human-readable timestamps
+			zap.MessageKey("@message"),         // customize the message key
+			zap.LevelString("@level"),          // stringify the log level
+		)
+	case "console":
+		enc = NewConsoleEncoder()
+	default:
+		return nil, fmt.Errorf("invalid log encoding %s, can be: \"json\", \"console\"", encoding)
+	}
+
+	return zap.New(
+		enc,
+		zap.Output(out),
+		zap.AddCaller(),
+		lvl,
+	), nil
+}
+
+// ParseLevel returns the level named lv, it fails on the unknown names.
+func ParseLevel(lv string) (zap.Level, error) {
+	switch strings.ToLower(lv) {
+	case "debug", "info", "warn", "error", "fatal":
+		return parseLevel(lv), nil
+	default:
+		return 0, fmt.Errorf("invalid log level %q, can be: \"debug\", \"info\", \"warn\", \"error\", \"fatal\"", lv)
+	}
+}
 
+func parseLevel(lv string) zap.Level {
 	switch strings.ToLower(lv) {
 	case "debug":
-		level = zap.DebugLevel
+		return zap.DebugLevel
 	case "info":
-		level = zap.InfoLevel
+		return zap.InfoLevel
 	case "warn":
-		level = zap.WarnLevel
+		return zap.WarnLevel
 	case "error":
-		level = zap.ErrorLevel
+		return zap.ErrorLevel
 	case "fatal":
-		level = zap.FatalLevel
+		return zap.FatalLevel
 	default:
-		level = zap.DebugLevel
+		return zap.DebugLevel
 	}
+}
 
-	if isDebug {
-		Logger = zap.New(
-			zap.NewJSONEncoder(
-				zap.RFC3339Formatter("@timestamp"), // human-readable timestamps
-				zap.MessageKey("@message"),         // customize the message key
-				zap.LevelString("@level"),          // stringify the log level
-			),
-			zap.AddCaller(),
-			level,
-		)
-	} else {
-		f, err := os.OpenFile(lp, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
-		if err != nil {
-			log.Panic(err)
+// openOutputs returns a writer to all the outputs, stdout when there's none.
+func openOutputs(outputs []string) (zap.WriteSyncer, error) {
+	if len(outputs) == 0 {
+		return os.Stdout, nil
+	}
+
+	var writers []io.Writer
+	for _, o := range outputs {
+		switch o {
+		case "stdout":
+			writers = append(writers, os.Stdout)
+		case "stderr":
+			writers = append(writers, os.Stderr)
+		default:
+			f, err := os.OpenFile(o, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
+			if err != nil {
+				return nil, err
+			}
+			writers = append(writers, f)
 		}
+	}
 
-		Logger = zap.New(
-			zap.NewJSONEncoder(
-				zap.RFC3339Formatter("@timestamp"), // human-readable timestamps
-				zap.MessageKey("@message"),         // customize the message key
-				zap.LevelString("@level"),          // stringify the log level
-			),
-			zap.Output(f),
-			zap.AddCaller(),
-			level,
-		)
+	if len(writers) == 1 {
+		return zap.AddSync(writers[0]), nil
 	}
+	return zap.AddSync(io.MultiWriter(writers...)), nil
 }
@@ -0,0 +1,154 @@
+package vlog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uber-go/zap"
+)
+
+// logFile returns a log file path in a temporary directory.
+func logFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "vlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "vgo.log"), func() { os.RemoveAll(dir) }
+}
+
+// lines returns the lines logged to the file.
+func lines(t *testing.T, path string) []string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+func TestJSONEncoding(t *testing.T) {
+	path, clean := logFile(t)
+	defer clean()
+
+	if err := InitWithOptions(Options{Level: "info", Encoding: "json", Outputs: []string{path}}); err != nil {
+		t.Fatal(err)
+	}
+	Logger.Debug("not logged")
+	Logger.Info("write failed", zap.String("output", "influxdb"), zap.Int("count", 3))
+
+	logged := lines(t, path)
+	if len(logged) != 1 {
+		t.Fatalf("got %d lines, want the info one, %v", len(logged), logged)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(logged[0]), &entry); err != nil {
+		t.Fatalf("line isn't JSON, %s", err)
+	}
+	// the caller prefixes the message
+	if msg, _ := entry["@message"].(string); !strings.HasPrefix(msg, "vlog_test.go:") || !strings.HasSuffix(msg, ": write failed") {
+		t.Errorf("@message is %v", entry["@message"])
+	}
+	for k, want := range map[string]interface{}{
+		"@level": "info",
+		"output": "influxdb",
+		"count":  3.0,
+	} {
+		if entry[k] != want {
+			t.Errorf("%s is %v, want %v", k, entry[k], want)
+		}
+	}
+	if _, ok := entry["@timestamp"]; !ok {
+		t.Errorf("@timestamp missing from %s", logged[0])
+	}
+}
+
+func TestConsoleEncoding(t *testing.T) {
+	path, clean := logFile(t)
+	defer clean()
+
+	logger, err := New(Options{Level: "debug", Encoding: "console", Outputs: []string{path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Warn("queue full", zap.String("name", "with space"), zap.Int("dropped", 2))
+
+	logged := lines(t, path)
+	if len(logged) != 1 {
+		t.Fatalf("got lines %v", logged)
+	}
+	for _, want := range []string{"WARN", "queue full", `name="with space"`, "dropped=2"} {
+		if !strings.Contains(logged[0], want) {
+			t.Errorf("%s missing from %s", want, logged[0])
+		}
+	}
+}
+
+func TestNamed(t *testing.T) {
+	path, clean := logFile(t)
+	defer clean()
+
+	if err := InitWithOptions(Options{Level: "error", Outputs: []string{path}}); err != nil {
+		t.Fatal(err)
+	}
+	logger, err := Named("influxdb", "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("point written")
+	Logger.Debug("not logged")
+
+	logged := lines(t, path)
+	if len(logged) != 1 || !strings.Contains(logged[0], `"plugin":"influxdb"`) {
+		t.Errorf("got lines %v, want the debug line of the plugin", logged)
+	}
+
+	if _, err := Named("influxdb", "verbose"); err == nil {
+		t.Error("invalid level accepted")
+	}
+}
+
+func TestNamedIndependent(t *testing.T) {
+	path, clean := logFile(t)
+	defer clean()
+
+	if err := InitWithOptions(Options{Level: "warn", Outputs: []string{path}}); err != nil {
+		t.Fatal(err)
+	}
+	kafka, err := Named("kafka", "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	influxdb, err := Named("influxdb", "error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the levels of the other loggers are left unchanged
+	kafka.Debug("kafka debug")
+	influxdb.Warn("influxdb warn")
+	influxdb.Error("influxdb error")
+	Logger.Info("info")
+	Logger.Warn("warn")
+
+	logged := lines(t, path)
+	want := []string{"kafka debug", "influxdb error", "warn"}
+	if len(logged) != len(want) {
+		t.Fatalf("got lines %v, want %v", logged, want)
+	}
+	for i, msg := range want {
+		if !strings.Contains(logged[i], msg) {
+			t.Errorf("got line %s, want %s", logged[i], msg)
+		}
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	if _, err := New(Options{Encoding: "xml"}); err == nil {
+		t.Error("invalid encoding accepted")
+	}
+	if _, err := New(Options{Outputs: []string{"/nonexistent/dir/vgo.log"}}); err == nil {
+		t.Error("unwritable output accepted")
+	}
+}
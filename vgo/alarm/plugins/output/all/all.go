@@ -1,6 +1,11 @@
 package all
 
 import (
+	_ "github.com/corego/vgo/vgo/alarm/plugins/output/exec"
+	_ "github.com/corego/vgo/vgo/alarm/plugins/output/loki"
 	_ "github.com/corego/vgo/vgo/alarm/plugins/output/mail"
+	_ "github.com/corego/vgo/vgo/alarm/plugins/output/msteams"
 	_ "github.com/corego/vgo/vgo/alarm/plugins/output/sms"
+	_ "github.com/corego/vgo/vgo/alarm/plugins/output/syslog"
+	_ "github.com/corego/vgo/vgo/alarm/plugins/output/telegram"
 )
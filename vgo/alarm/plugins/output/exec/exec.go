@@ -0,0 +1,154 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/corego/vgo/mecury/misc"
+	"github.com/corego/vgo/vgo/alarm/service"
+)
+
+// Exec runs a command for every alarm, like a local runbook. The alarm data
+// is given on the stdin and the arguments are templates of the alarm. The
+// output of the command is logged, a command failing or exiting with a non
+// zero status fails the write.
+type Exec struct {
+	// Command is the program and its arguments, the arguments are
+	// text/template templates given .Data, the alert data fields, .User,
+	// .Fingerprint and .JSON, the raw alarm data
+	Command []string
+	// Stdin writes the raw alarm data to the stdin of the command
+	Stdin bool
+	// Timeout kills the command running longer, the write still waits for
+	// the children of the command keeping its output open
+	Timeout misc.Duration
+	// MaxConcurrency is the number of commands running at once, the next
+	// alarms wait for one of them to end
+	MaxConcurrency int
+	// MaxOutputSize is the number of bytes of stdout and stderr logged
+	MaxOutputSize int
+
+	args []*template.Template
+	sem  chan struct{}
+}
+
+// alarmData is the data of the argument templates
+type alarmData struct {
+	Data        map[string]interface{}
+	User        string
+	Fingerprint string
+	JSON        string
+}
+
+func (e *Exec) Start() error {
+	if len(e.Command) == 0 || e.Command[0] == "" {
+		return fmt.Errorf("command is required")
+	}
+	if e.MaxConcurrency <= 0 {
+		return fmt.Errorf("invalid max_concurrency %d", e.MaxConcurrency)
+	}
+
+	e.args = make([]*template.Template, 0, len(e.Command)-1)
+	for _, arg := range e.Command[1:] {
+		tmpl, err := template.New("arg").Parse(arg)
+		if err != nil {
+			return fmt.Errorf("invalid argument %s, %s", arg, err)
+		}
+		e.args = append(e.args, tmpl)
+	}
+	e.sem = make(chan struct{}, e.MaxConcurrency)
+	return nil
+}
+
+func (e *Exec) Close() error {
+	return nil
+}
+
+// Write runs the command for the alarm once one of the MaxConcurrency slots
+// is free.
+func (e *Exec) Write(a *service.Alarm) error {
+	args, err := e.render(a)
+	if err != nil {
+		return err
+	}
+
+	e.sem <- struct{}{}
+	defer func() { <-e.sem }()
+	return e.run(a, args)
+}
+
+// render executes the argument templates with the alarm.
+func (e *Exec) render(a *service.Alarm) ([]string, error) {
+	d := &alarmData{
+		User:        a.User,
+		Fingerprint: a.Fingerprint,
+		JSON:        string(a.Data),
+	}
+	// the data which isn't a JSON object is only given as .JSON
+	json.Unmarshal(a.Data, &d.Data)
+
+	args := make([]string, 0, len(e.args))
+	for _, tmpl := range e.args {
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, d); err != nil {
+			return nil, fmt.Errorf("argument template, %s", err)
+		}
+		args = append(args, b.String())
+	}
+	return args, nil
+}
+
+func (e *Exec) run(a *service.Alarm, args []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), e.Timeout.Duration)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, e.Command[0], args...)
+	if e.Stdin {
+		cmd.Stdin = bytes.NewReader(a.Data)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	if stdout.Len() > 0 {
+		log.Printf("exec %s alarm %s stdout: %s\n", e.Command[0], a.Fingerprint, e.cut(stdout.String()))
+	}
+	if stderr.Len() > 0 {
+		log.Printf("exec %s alarm %s stderr: %s\n", e.Command[0], a.Fingerprint, e.cut(stderr.String()))
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("command %s killed after %s", e.Command[0], e.Timeout.Duration)
+	}
+	if err != nil {
+		return fmt.Errorf("command %s failed after %s, %s", e.Command[0], time.Since(start), err)
+	}
+	return nil
+}
+
+// cut trims the output to MaxOutputSize bytes.
+func (e *Exec) cut(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) <= e.MaxOutputSize {
+		return s
+	}
+	return s[:e.MaxOutputSize] + "..."
+}
+
+func init() {
+	service.AddOutput("exec", &Exec{
+		Stdin:          true,
+		Timeout:        misc.Duration{Duration: 10 * time.Second},
+		MaxConcurrency: 4,
+		MaxOutputSize:  4096,
+	})
+}
@@ -0,0 +1,211 @@
+package exec
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/mecury/misc"
+	"github.com/corego/vgo/vgo/alarm/service"
+)
+
+var alarm = &service.Alarm{
+	Data:        []byte(`{"id":"cpu.idle","l":1,"h":"web01"}`),
+	User:        "ops@example.com",
+	Fingerprint: "fp1",
+}
+
+// stub writes the shell script to a temporary directory, the returned func
+// removes it.
+func stub(t *testing.T, script string) (string, string, func()) {
+	dir, err := ioutil.TempDir("", "vgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "stub.sh")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path, dir, func() { os.RemoveAll(dir) }
+}
+
+func newExec(t *testing.T, command ...string) *Exec {
+	e := &Exec{
+		Command:        command,
+		Stdin:          true,
+		Timeout:        misc.Duration{Duration: 5 * time.Second},
+		MaxConcurrency: 4,
+		MaxOutputSize:  4096,
+	}
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// captureLog returns the buffer the log is written to until the returned
+// func is called.
+func captureLog() (*syncBuffer, func()) {
+	b := &syncBuffer{}
+	log.SetOutput(b)
+	return b, func() { log.SetOutput(os.Stderr) }
+}
+
+type syncBuffer struct {
+	sync.Mutex
+	b bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.b.String()
+}
+
+func TestStdinAndArgs(t *testing.T) {
+	script, dir, clean := stub(t, `out=$1; shift; echo "$@" > "$out.args"; cat > "$out.stdin"`)
+	defer clean()
+	out := filepath.Join(dir, "alarm")
+	e := newExec(t, script, out, "{{.User}}", "{{.Fingerprint}}", "{{.Data.h}}", "level={{.Data.l}}")
+
+	if err := e.Write(alarm); err != nil {
+		t.Fatal(err)
+	}
+	args, _ := ioutil.ReadFile(out + ".args")
+	if want := "ops@example.com fp1 web01 level=1\n"; string(args) != want {
+		t.Errorf("got arguments %q, want %q", args, want)
+	}
+	stdin, _ := ioutil.ReadFile(out + ".stdin")
+	if string(stdin) != string(alarm.Data) {
+		t.Errorf("got stdin %q, want the alarm data", stdin)
+	}
+
+	// without stdin
+	e.Stdin = false
+	if err := e.Write(alarm); err != nil {
+		t.Fatal(err)
+	}
+	if stdin, _ := ioutil.ReadFile(out + ".stdin"); len(stdin) != 0 {
+		t.Errorf("got stdin %q, want none", stdin)
+	}
+}
+
+func TestOutputLogged(t *testing.T) {
+	script, _, clean := stub(t, `cat; echo "runbook failed" >&2`)
+	defer clean()
+	logged, restore := captureLog()
+	defer restore()
+
+	e := newExec(t, script)
+	if err := e.Write(alarm); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logged.String(), `alarm fp1 stdout: {"id":"cpu.idle","l":1,"h":"web01"}`) {
+		t.Errorf("stdout not logged, got log %q", logged.String())
+	}
+	if !strings.Contains(logged.String(), "alarm fp1 stderr: runbook failed") {
+		t.Errorf("stderr not logged, got log %q", logged.String())
+	}
+
+	// cut to the max output size
+	e.MaxOutputSize = 6
+	if err := e.Write(alarm); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logged.String(), `stdout: {"id":...`) {
+		t.Errorf("output not cut, got log %q", logged.String())
+	}
+}
+
+func TestNonZeroExit(t *testing.T) {
+	script, _, clean := stub(t, `echo "no runbook for $1" >&2; exit 3`)
+	defer clean()
+	logged, restore := captureLog()
+	defer restore()
+
+	e := newExec(t, script, "{{.Data.id}}")
+	err := e.Write(alarm)
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("got error %v, want the exit status", err)
+	}
+	if !strings.Contains(logged.String(), "no runbook for cpu.idle") {
+		t.Errorf("stderr not logged, got log %q", logged.String())
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	script, _, clean := stub(t, `exec sleep 5`)
+	defer clean()
+
+	e := newExec(t, script)
+	e.Timeout = misc.Duration{Duration: 100 * time.Millisecond}
+	start := time.Now()
+	err := e.Write(alarm)
+	if err == nil || !strings.Contains(err.Error(), "killed after 100ms") {
+		t.Errorf("got error %v, want the command killed", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("write took %s, the timeout is 100ms", elapsed)
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	// the stub counts the commands running in a directory
+	script, dir, clean := stub(t, `touch "$1/$$"; ls "$1" | wc -l >> "$1.max"; sleep 0.1; rm "$1/$$"`)
+	defer clean()
+	running := filepath.Join(dir, "running")
+	if err := os.Mkdir(running, 0755); err != nil {
+		t.Fatal(err)
+	}
+	e := newExec(t, script, running)
+	e.MaxConcurrency = 2
+	e.Start()
+
+	var wg sync.WaitGroup
+	for n := 0; n < 6; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := e.Write(alarm); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	counts, _ := ioutil.ReadFile(running + ".max")
+	lines := strings.Fields(string(counts))
+	if len(lines) != 6 {
+		t.Fatalf("got %d commands run, want 6", len(lines))
+	}
+	for _, n := range lines {
+		if n != "1" && n != "2" {
+			t.Errorf("%s commands running at once, want 2 at most", n)
+		}
+	}
+}
+
+func TestStartInvalid(t *testing.T) {
+	for _, e := range []*Exec{
+		{MaxConcurrency: 1},
+		{Command: []string{""}, MaxConcurrency: 1},
+		{Command: []string{"/bin/true"}},
+		{Command: []string{"/bin/true", "{{.User"}, MaxConcurrency: 1},
+	} {
+		if err := e.Start(); err == nil {
+			t.Errorf("invalid config %+v accepted", e)
+		}
+	}
+}
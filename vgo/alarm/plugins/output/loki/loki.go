@@ -0,0 +1,194 @@
+package loki
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/corego/vgo/mecury/misc"
+	"github.com/corego/vgo/vgo/alarm/service"
+	"github.com/golang/snappy"
+)
+
+const pushPath = "/loki/api/v1/push"
+
+// severities are the names of the alert levels
+var severities = []string{"warn", "critical"}
+
+// Loki pushes the alarms to loki as log lines, they're queued by the
+// service.Output wrapper.
+type Loki struct {
+	// URL of loki, like http://localhost:3100
+	URL string
+	// TenantID is sent as X-Scope-OrgID for a multi tenant loki
+	TenantID string `toml:"tenant_id"`
+	// Labels are added to the labels of every alarm
+	Labels map[string]string
+
+	SSLCA              string `toml:"ssl_ca"`
+	SSLCert            string `toml:"ssl_cert"`
+	SSLKey             string `toml:"ssl_key"`
+	InsecureSkipVerify bool
+
+	client *http.Client
+}
+
+// entry is a log line of a stream, the stream is the label set
+type entry struct {
+	labels string
+	ts     time.Time
+	line   string
+}
+
+// alertData holds the alarm data fields turned into labels
+type alertData struct {
+	ID       string `json:"id"`
+	GroupID  string `json:"gid"`
+	Level    int    `json:"l"`
+	HostName string `json:"h"`
+}
+
+func (l *Loki) Start() error {
+	if l.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+
+	tlsConfig, err := misc.GetTLSConfig(l.SSLCert, l.SSLKey, l.SSLCA, l.InsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+
+	l.client = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	return nil
+}
+
+func (l *Loki) Close() error {
+	return nil
+}
+
+// Write pushes the alarm as the line of its stream.
+func (l *Loki) Write(a *service.Alarm) error {
+	return l.push([]*entry{{
+		labels: formatLabels(l.labels(a)),
+		ts:     time.Now(),
+		line:   string(a.Data),
+	}})
+}
+
+// labels returns the labels of the alarm: the static labels, the alert id,
+// group, host and severity of the alarm data and the user.
+func (l *Loki) labels(a *service.Alarm) map[string]string {
+	labels := make(map[string]string, len(l.Labels)+5)
+	for k, v := range l.Labels {
+		labels[k] = v
+	}
+
+	var data alertData
+	if err := json.Unmarshal(a.Data, &data); err == nil {
+		setLabel(labels, "alert", data.ID)
+		setLabel(labels, "group", data.GroupID)
+		setLabel(labels, "host", data.HostName)
+		if data.Level >= 0 && data.Level < len(severities) {
+			labels["severity"] = severities[data.Level]
+		}
+	}
+	setLabel(labels, "user", a.User)
+
+	if len(labels) == 0 {
+		labels["job"] = "vgo"
+	}
+	return labels
+}
+
+func setLabel(labels map[string]string, k, v string) {
+	if v != "" {
+		labels[k] = v
+	}
+}
+
+// formatLabels writes the label set the loki way, sorted by name:
+// {alert="cpu.idle", host="web1"}
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+"="+strconv.Quote(labels[k]))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+func (l *Loki) push(batch []*entry) error {
+	body := snappy.Encode(nil, encodePushRequest(streams(batch)))
+
+	req, err := http.NewRequest("POST", strings.TrimRight(l.URL, "/")+pushPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	if l.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", l.TenantID)
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("status %d, %s", resp.StatusCode, string(b))
+	}
+	return nil
+}
+
+// stream is the entries of a label set
+type stream struct {
+	labels  string
+	entries []*entry
+}
+
+// streams groups the entries by label set. Loki rejects the entries older
+// than the last one of their stream, so the entries are sorted by time.
+func streams(batch []*entry) []*stream {
+	var list []*stream
+	byLabels := make(map[string]*stream)
+	for _, e := range batch {
+		s, ok := byLabels[e.labels]
+		if !ok {
+			s = &stream{labels: e.labels}
+			byLabels[e.labels] = s
+			list = append(list, s)
+		}
+		s.entries = append(s.entries, e)
+	}
+
+	for _, s := range list {
+		entries := s.entries
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].ts.Before(entries[j].ts)
+		})
+	}
+	return list
+}
+
+func init() {
+	service.AddOutput("loki", &Loki{})
+}
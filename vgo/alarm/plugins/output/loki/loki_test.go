@@ -0,0 +1,164 @@
+package loki
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/alarm/service"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+)
+
+func TestLabels(t *testing.T) {
+	l := &Loki{Labels: map[string]string{"env": "prod"}}
+	for _, tt := range []struct {
+		alarm *service.Alarm
+		want  string
+	}{
+		{
+			&service.Alarm{Data: []byte(`{"id":"cpu.idle","gid":"ops","l":1,"h":"web01","v":3.5}`), User: "alice"},
+			`{alert="cpu.idle", env="prod", group="ops", host="web01", severity="critical", user="alice"}`,
+		},
+		// unknown level, no user
+		{
+			&service.Alarm{Data: []byte(`{"id":"cpu.idle","l":7,"h":"web01"}`)},
+			`{alert="cpu.idle", env="prod", host="web01"}`,
+		},
+		// not JSON, the quotes are escaped
+		{
+			&service.Alarm{Data: []byte("disk full"), User: `bob "b"`},
+			`{env="prod", user="bob \"b\""}`,
+		},
+	} {
+		if got := formatLabels(l.labels(tt.alarm)); got != tt.want {
+			t.Errorf("%s, got labels %s, want %s", tt.alarm.Data, got, tt.want)
+		}
+	}
+
+	// at least a label is required
+	if got := formatLabels((&Loki{}).labels(&service.Alarm{Data: []byte("disk full")})); got != `{job="vgo"}` {
+		t.Errorf("got labels %s without labels", got)
+	}
+}
+
+func TestStreamsSorted(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	web01, web02 := `{host="web01"}`, `{host="web02"}`
+	batch := []*entry{
+		{labels: web01, ts: now.Add(2 * time.Second), line: "3"},
+		{labels: web02, ts: now, line: "a"},
+		{labels: web01, ts: now, line: "1"},
+		{labels: web01, ts: now.Add(time.Second), line: "2"},
+		// same timestamp, the order of the batch is kept
+		{labels: web01, ts: now.Add(time.Second), line: "2b"},
+	}
+
+	got := make(map[string][]string)
+	var order []string
+	for _, s := range streams(batch) {
+		order = append(order, s.labels)
+		for _, e := range s.entries {
+			got[s.labels] = append(got[s.labels], e.line)
+		}
+	}
+	if !reflect.DeepEqual(order, []string{web01, web02}) {
+		t.Errorf("got streams %v", order)
+	}
+	want := map[string][]string{web01: {"1", "2", "2b", "3"}, web02: {"a"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got entries %v, want %v", got, want)
+	}
+}
+
+// decodeFields decodes the length delimited fields of a protobuf message,
+// the varints are returned as their proto.Buffer encoding.
+func decodeFields(t *testing.T, msg []byte) map[uint64][][]byte {
+	fields := make(map[uint64][][]byte)
+	b := proto.NewBuffer(msg)
+	for len(b.Unread()) > 0 {
+		key, err := b.DecodeVarint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v []byte
+		switch key & 7 {
+		case proto.WireBytes:
+			v, err = b.DecodeRawBytes(true)
+		case proto.WireVarint:
+			var n uint64
+			n, err = b.DecodeVarint()
+			v = proto.EncodeVarint(n)
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields[key>>3] = append(fields[key>>3], v)
+	}
+	return fields
+}
+
+func TestPush(t *testing.T) {
+	var tenant, contentType string
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != pushPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		tenant, contentType = r.Header.Get("X-Scope-OrgID"), r.Header.Get("Content-Type")
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	l := &Loki{URL: ts.URL + "/", TenantID: "ops"}
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Unix(1500000000, 5)
+	err := l.push([]*entry{
+		{labels: `{host="web01"}`, ts: at.Add(time.Second), line: "second"},
+		{labels: `{host="web01"}`, ts: at, line: "first"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tenant != "ops" || contentType != "application/x-protobuf" {
+		t.Errorf("got tenant %q and content type %q", tenant, contentType)
+	}
+
+	msg, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams := decodeFields(t, msg)[1]
+	if len(streams) != 1 {
+		t.Fatalf("got %d streams, want 1", len(streams))
+	}
+	stream := decodeFields(t, streams[0])
+	if labels := string(stream[1][0]); labels != `{host="web01"}` {
+		t.Errorf("got stream labels %s", labels)
+	}
+	var lines []string
+	for i, e := range stream[2] {
+		entry := decodeFields(t, e)
+		lines = append(lines, string(entry[2][0]))
+		timestamp := decodeFields(t, entry[1][0])
+		want := at.Add(time.Duration(i) * time.Second)
+		if sec, _ := proto.NewBuffer(timestamp[1][0]).DecodeVarint(); int64(sec) != want.Unix() {
+			t.Errorf("entry %d, seconds %d, want %d", i, sec, want.Unix())
+		}
+		if nanos, _ := proto.NewBuffer(timestamp[2][0]).DecodeVarint(); int(nanos) != want.Nanosecond() {
+			t.Errorf("entry %d, nanos %d, want %d", i, nanos, want.Nanosecond())
+		}
+	}
+	if !reflect.DeepEqual(lines, []string{"first", "second"}) {
+		t.Errorf("got lines %v, want them sorted by time", lines)
+	}
+}
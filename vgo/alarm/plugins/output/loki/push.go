@@ -0,0 +1,53 @@
+package loki
+
+import (
+	"github.com/golang/protobuf/proto"
+)
+
+// The push request is encoded by hand, following the loki logproto
+// messages:
+//
+//   message PushRequest { repeated StreamAdapter streams = 1; }
+//   message StreamAdapter { string labels = 1; repeated EntryAdapter entries = 2; }
+//   message EntryAdapter { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+//   message Timestamp { int64 seconds = 1; int32 nanos = 2; }
+
+func encodePushRequest(streams []*stream) []byte {
+	b := proto.NewBuffer(nil)
+	for _, s := range streams {
+		encodeField(b, 1, encodeStream(s))
+	}
+	return b.Bytes()
+}
+
+func encodeStream(s *stream) []byte {
+	b := proto.NewBuffer(nil)
+	encodeField(b, 1, []byte(s.labels))
+	for _, e := range s.entries {
+		encodeField(b, 2, encodeEntry(e))
+	}
+	return b.Bytes()
+}
+
+func encodeEntry(e *entry) []byte {
+	ts := proto.NewBuffer(nil)
+	if sec := e.ts.Unix(); sec != 0 {
+		ts.EncodeVarint(1<<3 | proto.WireVarint)
+		ts.EncodeVarint(uint64(sec))
+	}
+	if nanos := e.ts.Nanosecond(); nanos != 0 {
+		ts.EncodeVarint(2<<3 | proto.WireVarint)
+		ts.EncodeVarint(uint64(nanos))
+	}
+
+	b := proto.NewBuffer(nil)
+	encodeField(b, 1, ts.Bytes())
+	encodeField(b, 2, []byte(e.line))
+	return b.Bytes()
+}
+
+// encodeField appends a length delimited field.
+func encodeField(b *proto.Buffer, field uint64, v []byte) {
+	b.EncodeVarint(field<<3 | proto.WireBytes)
+	b.EncodeRawBytes(v)
+}
@@ -1,30 +1,16 @@
 package mail
 
 import (
-	"fmt"
-	"time"
-
+	"github.com/corego/vgo/common/vlog"
 	"github.com/corego/vgo/vgo/alarm/service"
+	"github.com/uber-go/zap"
 )
 
+// Mail logs the alarms, they're queued by the service.Output wrapper.
 type Mail struct {
-	in chan *service.Alarm
 }
 
 func (c *Mail) Start() error {
-	c.in = make(chan *service.Alarm, 1000)
-	go func() {
-		for {
-			a := <-c.in
-
-			fmt.Println("Mail Output--------------------------", time.Now())
-
-			fmt.Println(a.User, ":", string(a.Data))
-
-			fmt.Println()
-			fmt.Println()
-		}
-	}()
 	return nil
 }
 
@@ -33,7 +19,11 @@ func (c *Mail) Close() error {
 }
 
 func (c *Mail) Write(a *service.Alarm) error {
-	c.in <- a
+	vlog.Logger.Info("Mail Output",
+		zap.String("user", a.User),
+		zap.String("fingerprint", a.Fingerprint),
+		zap.String("data", string(a.Data)),
+	)
 	return nil
 }
 
@@ -0,0 +1,338 @@
+package msteams
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/corego/vgo/mecury/misc"
+	"github.com/corego/vgo/vgo/alarm/service"
+)
+
+const (
+	// maxFactLen is the longest fact value, the longer ones are cut
+	maxFactLen = 1000
+	truncated  = "..."
+)
+
+// factNames are the names of the facts of the alert data fields
+var factNames = map[string]string{
+	"id":  "Alert",
+	"gid": "Group",
+	"h":   "Host",
+	"v":   "Value",
+	"l":   "Level",
+}
+
+// MSTeams posts the alarms to a Teams incoming webhook as cards, they're
+// queued by the service.Output wrapper.
+type MSTeams struct {
+	WebhookURL string `toml:"webhook_url"`
+	// CardType is "adaptive" or "message", the legacy MessageCard
+	CardType string
+	// Template is a text/template file rendering the whole payload, it gets
+	// the card data: .Title, .Level, .Color, .Facts (.Name and .Value),
+	// .User and .Data
+	Template string
+	// MaxPayloadSize is the largest payload posted, Teams rejects the
+	// payloads over about 28KB
+	MaxPayloadSize int
+	// MaxRetries is the number of retries of the posts failing with a 429
+	// or 5xx status
+	MaxRetries int
+	Timeout    misc.Duration
+	// HTTPProxy is the proxy of the webhook requests, HTTP_PROXY/HTTPS_PROXY are used when empty
+	HTTPProxy string `toml:"http_proxy"`
+	// SSLCert and SSLKey are the client certificate of the webhooks
+	// requiring mutual TLS
+	SSLCA              string `toml:"ssl_ca"`
+	SSLCert            string `toml:"ssl_cert"`
+	SSLKey             string `toml:"ssl_key"`
+	InsecureSkipVerify bool
+
+	client   *http.Client
+	template *template.Template
+}
+
+// card is the data of a card, given to the template
+type card struct {
+	Title string
+	Level string
+	// Color is the theme color of the level, without "#"
+	Color string
+	Facts []fact
+	User  string
+	Data  string
+}
+
+type fact struct {
+	Name  string
+	Value string
+}
+
+func (t *MSTeams) Start() error {
+	if t.WebhookURL == "" {
+		return fmt.Errorf("webhook_url is required")
+	}
+	switch t.CardType {
+	case "adaptive", "message":
+	default:
+		return fmt.Errorf("invalid card_type %s, can be: \"adaptive\", \"message\"", t.CardType)
+	}
+
+	if t.Template != "" {
+		tmpl, err := template.ParseFiles(t.Template)
+		if err != nil {
+			return fmt.Errorf("invalid template %s, %s", t.Template, err)
+		}
+		t.template = tmpl
+	}
+
+	tlsConfig, err := misc.GetTLSConfig(t.SSLCert, t.SSLKey, t.SSLCA, t.InsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+	tr := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+	if t.HTTPProxy != "" {
+		proxy, err := url.Parse(t.HTTPProxy)
+		if err != nil {
+			return fmt.Errorf("invalid http_proxy %s, %s", t.HTTPProxy, err)
+		}
+		tr.Proxy = http.ProxyURL(proxy)
+	}
+	t.client = &http.Client{
+		Timeout:   t.Timeout.Duration,
+		Transport: tr,
+	}
+	return nil
+}
+
+func (t *MSTeams) Close() error {
+	return nil
+}
+
+// Write posts the card of the alarm.
+func (t *MSTeams) Write(a *service.Alarm) error {
+	body, err := t.payload(newCard(a))
+	if err != nil {
+		return err
+	}
+	return t.post(body)
+}
+
+// post sends the payload, retrying with a growing delay on the 429 and 5xx
+// statuses and the network errors.
+func (t *MSTeams) post(body []byte) error {
+	var err error
+	for i := 0; i <= t.MaxRetries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * time.Second)
+		}
+
+		var retry bool
+		if retry, err = t.send(body); err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// send posts the payload once, it returns whether a failure is transient.
+func (t *MSTeams) send(body []byte) (bool, error) {
+	resp, err := t.client.Post(t.WebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	err = fmt.Errorf("status %d, %s", resp.StatusCode, string(b))
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+// payload renders the card, with the template if any. The facts of a card
+// over MaxPayloadSize are cut, then dropped from the last one.
+func (t *MSTeams) payload(c *card) ([]byte, error) {
+	for {
+		body, err := t.render(c)
+		if err != nil {
+			return nil, err
+		}
+		if len(body) <= t.MaxPayloadSize {
+			return body, nil
+		}
+		if !c.shrink() {
+			return nil, fmt.Errorf("payload of %d bytes over the %d bytes limit", len(body), t.MaxPayloadSize)
+		}
+	}
+}
+
+func (t *MSTeams) render(c *card) ([]byte, error) {
+	if t.template == nil {
+		if t.CardType == "message" {
+			return json.Marshal(messageCard(c))
+		}
+		return json.Marshal(adaptiveCard(c))
+	}
+
+	var b bytes.Buffer
+	if err := t.template.Execute(&b, c); err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(b.Bytes(), &v); err != nil {
+		return nil, fmt.Errorf("template %s doesn't render JSON, %s", t.Template, err)
+	}
+	return b.Bytes(), nil
+}
+
+// newCard builds the card of the alarm, with a fact per field of the alert
+// data, or the raw data when it isn't a JSON object.
+func newCard(a *service.Alarm) *card {
+	c := &card{
+		Title: "Alarm",
+		Level: "WARN",
+		Color: "FFA500",
+		User:  a.User,
+		Data:  string(a.Data),
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(a.Data, &fields); err != nil {
+		c.Facts = []fact{{Name: "Data", Value: truncate(string(a.Data), maxFactLen)}}
+		return c
+	}
+
+	if l, ok := fields["l"].(float64); ok && l == 1 {
+		c.Level = "CRITICAL"
+		c.Color = "D70000"
+	}
+	if id, ok := fields["id"].(string); ok && id != "" {
+		c.Title = "[" + c.Level + "] " + id
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name, ok := factNames[k]
+		if !ok {
+			name = k
+		}
+		value := fmt.Sprintf("%v", fields[k])
+		if k == "l" {
+			value = c.Level
+		}
+		c.Facts = append(c.Facts, fact{Name: name, Value: truncate(value, maxFactLen)})
+	}
+	if a.User != "" {
+		c.Facts = append(c.Facts, fact{Name: "User", Value: a.User})
+	}
+	return c
+}
+
+// shrink makes the card smaller: the raw data is dropped first, then the
+// last fact. It returns false when there's nothing left to remove.
+func (c *card) shrink() bool {
+	if c.Data != "" {
+		c.Data = ""
+		return true
+	}
+	if len(c.Facts) == 0 {
+		return false
+	}
+	c.Facts = c.Facts[:len(c.Facts)-1]
+	return true
+}
+
+// adaptiveCard returns the message carrying the card as an Adaptive Card.
+func adaptiveCard(c *card) interface{} {
+	color := "Warning"
+	if c.Level == "CRITICAL" {
+		color = "Attention"
+	}
+
+	facts := make([]map[string]string, 0, len(c.Facts))
+	for _, f := range c.Facts {
+		facts = append(facts, map[string]string{"title": f.Name, "value": f.Value})
+	}
+
+	return map[string]interface{}{
+		"type": "message",
+		"attachments": []interface{}{
+			map[string]interface{}{
+				"contentType": "application/vnd.microsoft.card.adaptive",
+				"content": map[string]interface{}{
+					"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+					"type":    "AdaptiveCard",
+					"version": "1.2",
+					"body": []interface{}{
+						map[string]interface{}{
+							"type":   "TextBlock",
+							"text":   c.Title,
+							"weight": "Bolder",
+							"size":   "Medium",
+							"color":  color,
+							"wrap":   true,
+						},
+						map[string]interface{}{
+							"type":  "FactSet",
+							"facts": facts,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// messageCard returns the card as a legacy MessageCard.
+func messageCard(c *card) interface{} {
+	facts := make([]map[string]string, 0, len(c.Facts))
+	for _, f := range c.Facts {
+		facts = append(facts, map[string]string{"name": f.Name, "value": f.Value})
+	}
+
+	return map[string]interface{}{
+		"@type":      "MessageCard",
+		"@context":   "https://schema.org/extensions",
+		"themeColor": c.Color,
+		"summary":    c.Title,
+		"title":      c.Title,
+		"sections": []interface{}{
+			map[string]interface{}{"facts": facts},
+		},
+	}
+}
+
+// truncate cuts s to max runes, ending with the truncated indicator.
+func truncate(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max-len(truncated)]) + truncated
+}
+
+func init() {
+	service.AddOutput("msteams", &MSTeams{
+		CardType:       "adaptive",
+		MaxPayloadSize: 28 * 1024,
+		MaxRetries:     3,
+		Timeout:        misc.Duration{Duration: 10 * time.Second},
+	})
+}
@@ -0,0 +1,181 @@
+package msteams
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/corego/vgo/vgo/alarm/service"
+)
+
+var sample = &service.Alarm{
+	Data: []byte(`{"id":"cpu.idle","gid":"ops","h":"web01","l":1,"v":3.5,"zone":"eu"}`),
+	User: "alice",
+}
+
+// equalJSON fails the test when the payload isn't the JSON want.
+func equalJSON(t *testing.T, payload []byte, want string) {
+	var got, w interface{}
+	if err := json.Unmarshal(payload, &got); err != nil {
+		t.Fatalf("invalid JSON payload %s, %s", payload, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, w) {
+		t.Errorf("got payload\n%s\nwant\n%s", payload, want)
+	}
+}
+
+func TestAdaptiveCard(t *testing.T) {
+	tm := &MSTeams{CardType: "adaptive", MaxPayloadSize: 28 * 1024}
+	payload, err := tm.payload(newCard(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	equalJSON(t, payload, `{
+		"type": "message",
+		"attachments": [{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content": {
+				"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+				"type": "AdaptiveCard",
+				"version": "1.2",
+				"body": [
+					{"type": "TextBlock", "text": "[CRITICAL] cpu.idle", "weight": "Bolder", "size": "Medium", "color": "Attention", "wrap": true},
+					{"type": "FactSet", "facts": [
+						{"title": "Group", "value": "ops"},
+						{"title": "Host", "value": "web01"},
+						{"title": "Alert", "value": "cpu.idle"},
+						{"title": "Level", "value": "CRITICAL"},
+						{"title": "Value", "value": "3.5"},
+						{"title": "zone", "value": "eu"},
+						{"title": "User", "value": "alice"}
+					]}
+				]
+			}
+		}]
+	}`)
+}
+
+func TestMessageCard(t *testing.T) {
+	tm := &MSTeams{CardType: "message", MaxPayloadSize: 28 * 1024}
+	payload, err := tm.payload(newCard(&service.Alarm{Data: []byte(`{"id":"disk.used","l":0}`)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	equalJSON(t, payload, `{
+		"@type": "MessageCard",
+		"@context": "https://schema.org/extensions",
+		"themeColor": "FFA500",
+		"summary": "[WARN] disk.used",
+		"title": "[WARN] disk.used",
+		"sections": [{"facts": [
+			{"name": "Alert", "value": "disk.used"},
+			{"name": "Level", "value": "WARN"}
+		]}]
+	}`)
+
+	// not JSON, the raw data is the only fact
+	payload, err = tm.payload(newCard(&service.Alarm{Data: []byte("disk full")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	equalJSON(t, payload, `{
+		"@type": "MessageCard",
+		"@context": "https://schema.org/extensions",
+		"themeColor": "FFA500",
+		"summary": "Alarm",
+		"title": "Alarm",
+		"sections": [{"facts": [{"name": "Data", "value": "disk full"}]}]
+	}`)
+}
+
+func TestPayloadSize(t *testing.T) {
+	long := strings.Repeat("é", 2000)
+	c := newCard(&service.Alarm{Data: []byte(`{"id":"cpu.idle","msg":"` + long + `"}`)})
+	if v := []rune(c.Facts[1].Value); len(v) != maxFactLen || string(v[maxFactLen-len(truncated):]) != truncated {
+		t.Errorf("fact of %d runes not truncated", len(v))
+	}
+
+	// the facts are dropped from the last one to fit
+	tm := &MSTeams{CardType: "adaptive", MaxPayloadSize: 1500}
+	payload, err := tm.payload(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payload) > tm.MaxPayloadSize || strings.Contains(string(payload), "msg") || !strings.Contains(string(payload), "cpu.idle") {
+		t.Errorf("got payload of %d bytes %s", len(payload), payload)
+	}
+
+	tm.MaxPayloadSize = 10
+	if _, err := tm.payload(newCard(sample)); err == nil {
+		t.Error("no error when the card can't fit")
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	f, err := ioutil.TempFile("", "msteams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"text": "{{.Title}} by {{.User}}", "color": "{{.Color}}"{{range .Facts}}, "{{.Name}}": "{{.Value}}"{{end}}}`)
+	f.Close()
+
+	tm := &MSTeams{WebhookURL: "http://localhost", CardType: "adaptive", Template: f.Name(), MaxPayloadSize: 28 * 1024}
+	if err := tm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := tm.payload(newCard(&service.Alarm{Data: []byte(`{"id":"cpu.idle","h":"web01"}`), User: "bob"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	equalJSON(t, payload, `{"text": "[WARN] cpu.idle by bob", "color": "FFA500", "Host": "web01", "Alert": "cpu.idle", "User": "bob"}`)
+
+	// the template must render JSON
+	ioutil.WriteFile(f.Name(), []byte(`{{.Title}}`), 0644)
+	if err := tm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tm.payload(newCard(sample)); err == nil {
+		t.Error("no error when the template doesn't render JSON")
+	}
+}
+
+func TestWriteRetry(t *testing.T) {
+	var mu sync.Mutex
+	var statuses []int
+	answers := []int{http.StatusServiceUnavailable, http.StatusOK, http.StatusBadRequest}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		status := answers[len(statuses)]
+		statuses = append(statuses, status)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	tm := &MSTeams{WebhookURL: ts.URL, CardType: "adaptive", MaxPayloadSize: 28 * 1024, MaxRetries: 3}
+	if err := tm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Write(sample); err != nil {
+		t.Fatal(err)
+	}
+	// a 4xx isn't retried
+	if err := tm.Write(sample); err == nil {
+		t.Error("no error on a 400 status")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(statuses, answers) {
+		t.Errorf("got statuses %v, want %v", statuses, answers)
+	}
+}
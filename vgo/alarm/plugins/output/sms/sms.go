@@ -7,24 +7,11 @@ import (
 	"github.com/corego/vgo/vgo/alarm/service"
 )
 
+// Sms prints the alarms, they're queued by the service.Output wrapper.
 type Sms struct {
-	in chan *service.Alarm
 }
 
 func (c *Sms) Start() error {
-	c.in = make(chan *service.Alarm, 1000)
-	go func() {
-		for {
-			a := <-c.in
-
-			fmt.Println("Sms Output--------------------------", time.Now())
-
-			fmt.Println(a.Data)
-
-			fmt.Println()
-			fmt.Println()
-		}
-	}()
 	return nil
 }
 
@@ -33,7 +20,12 @@ func (c *Sms) Close() error {
 }
 
 func (c *Sms) Write(a *service.Alarm) error {
-	c.in <- a
+	fmt.Println("Sms Output--------------------------", time.Now())
+
+	fmt.Println(a.Data)
+
+	fmt.Println()
+	fmt.Println()
 	return nil
 }
 
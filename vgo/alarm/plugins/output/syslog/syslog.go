@@ -0,0 +1,236 @@
+package syslog
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corego/vgo/mecury/misc"
+	"github.com/corego/vgo/vgo/alarm/service"
+)
+
+const (
+	// truncated ends the messages cut to the size limit
+	truncated = "..."
+
+	// syslog severities
+	sevCritical = 2
+	sevWarning  = 4
+	sevNotice   = 5
+)
+
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// severities maps the alert levels, warn and critical, to syslog severities
+var severities = []int{sevWarning, sevCritical}
+
+type Syslog struct {
+	// Address is host:port of the syslog server
+	Address string
+	// Network can be "udp", "tcp" or "tls"
+	Network string
+	// Format can be "rfc5424" or "rfc3164"
+	Format   string
+	Facility string
+	AppName  string
+	// MaxMessageSize is the size messages are truncated at, by default
+	// 2048 bytes over UDP and 8192 over TCP
+	MaxMessageSize int
+
+	SSLCA              string `toml:"ssl_ca"`
+	SSLCert            string `toml:"ssl_cert"`
+	SSLKey             string `toml:"ssl_key"`
+	InsecureSkipVerify bool
+
+	facility int
+	hostname string
+	tls      *tls.Config
+
+	sync.Mutex
+	conn net.Conn
+}
+
+func (s *Syslog) Start() error {
+	if s.Address == "" {
+		return fmt.Errorf("address is required")
+	}
+	switch s.Network {
+	case "udp", "tcp", "tls":
+	default:
+		return fmt.Errorf("invalid network %s", s.Network)
+	}
+	switch s.Format {
+	case "rfc5424", "rfc3164":
+	default:
+		return fmt.Errorf("invalid format %s", s.Format)
+	}
+
+	facility, ok := facilities[strings.ToLower(s.Facility)]
+	if !ok {
+		return fmt.Errorf("invalid facility %s", s.Facility)
+	}
+	s.facility = facility
+
+	if s.MaxMessageSize <= 0 {
+		s.MaxMessageSize = 8192
+		if s.Network == "udp" {
+			s.MaxMessageSize = 2048
+		}
+	}
+
+	s.hostname, _ = os.Hostname()
+	if s.hostname == "" {
+		s.hostname = "-"
+	}
+
+	if s.Network == "tls" {
+		t, err := misc.GetTLSConfig(s.SSLCert, s.SSLKey, s.SSLCA, s.InsecureSkipVerify)
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			t = &tls.Config{}
+		}
+		s.tls = t
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if err := s.connect(); err != nil {
+		// the next writes connect again
+		log.Printf("syslog connect to %s failed, err message is %v\n", s.Address, err)
+	}
+	return nil
+}
+
+func (s *Syslog) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+// Write sends the alarm, on a failure the connection is opened again and
+// the message sent once more.
+func (s *Syslog) Write(a *service.Alarm) error {
+	msg := s.frame(s.format(a, time.Now()))
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.conn != nil {
+		if _, err := s.conn.Write(msg); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	if err := s.connect(); err != nil {
+		return err
+	}
+	if _, err := s.conn.Write(msg); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *Syslog) connect() error {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if s.Network == "tls" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", s.Address, s.tls)
+	} else {
+		conn, err = net.DialTimeout(s.Network, s.Address, 10*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// format returns the syslog message of the alarm, truncated to
+// MaxMessageSize.
+func (s *Syslog) format(a *service.Alarm, now time.Time) string {
+	pri := s.facility*8 + severity(a.Data)
+
+	var msg string
+	if s.Format == "rfc3164" {
+		msg = fmt.Sprintf("<%d>%s %s %s[%d]: %s",
+			pri, now.Format(time.Stamp), s.hostname, s.AppName, os.Getpid(), a.Data)
+	} else {
+		msg = fmt.Sprintf("<%d>1 %s %s %s %d alarm [vgo@32473 fingerprint=\"%s\" user=\"%s\"] %s",
+			pri, now.Format(time.RFC3339Nano), s.hostname, s.AppName, os.Getpid(),
+			escapeParam(a.Fingerprint), escapeParam(a.User), a.Data)
+	}
+	return truncate(msg, s.MaxMessageSize)
+}
+
+// frame delimits the message: the datagram over UDP, the octet counting of
+// RFC 6587 over TCP.
+func (s *Syslog) frame(msg string) []byte {
+	if s.Network == "udp" {
+		return []byte(msg)
+	}
+	return []byte(strconv.Itoa(len(msg)) + " " + msg)
+}
+
+// severity maps the level of the alarm data to a syslog severity.
+func severity(data []byte) int {
+	var alert struct {
+		Level *int `json:"l"`
+	}
+	if err := json.Unmarshal(data, &alert); err != nil || alert.Level == nil {
+		return sevNotice
+	}
+	if *alert.Level < 0 || *alert.Level >= len(severities) {
+		return sevNotice
+	}
+	return severities[*alert.Level]
+}
+
+// truncate cuts the message to max bytes, ending with the truncated
+// indicator.
+func truncate(msg string, max int) string {
+	if len(msg) <= max {
+		return msg
+	}
+	if max <= len(truncated) {
+		return msg[:max]
+	}
+	return msg[:max-len(truncated)] + truncated
+}
+
+// escapeParam escapes a structured data param value as RFC 5424 requires.
+func escapeParam(v string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+	return r.Replace(v)
+}
+
+func init() {
+	service.AddOutput("syslog", &Syslog{
+		Network:  "udp",
+		Format:   "rfc5424",
+		Facility: "local0",
+		AppName:  "vgo",
+	})
+}
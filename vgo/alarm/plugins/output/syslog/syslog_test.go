@@ -0,0 +1,191 @@
+package syslog
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/alarm/service"
+)
+
+func TestSeverity(t *testing.T) {
+	for _, tt := range []struct {
+		data string
+		want int
+	}{
+		{`{"id":"cpu.idle","l":0}`, sevWarning},
+		{`{"id":"cpu.idle","l":1}`, sevCritical},
+		{`{"id":"cpu.idle","l":2}`, sevNotice},
+		{`{"id":"cpu.idle","l":-1}`, sevNotice},
+		{`{"id":"cpu.idle"}`, sevNotice},
+		{"disk full", sevNotice},
+	} {
+		if got := severity([]byte(tt.data)); got != tt.want {
+			t.Errorf("%s, got severity %d, want %d", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	now := time.Date(2017, 7, 14, 2, 40, 0, 500, time.UTC)
+	s := &Syslog{Format: "rfc5424", facility: facilities["local0"], hostname: "web01", AppName: "vgo", MaxMessageSize: 8192}
+	a := &service.Alarm{Data: []byte(`{"id":"cpu.idle","l":1}`), User: `bob "b"`, Fingerprint: `f]1`}
+
+	// local0 is 16, critical 2
+	want := fmt.Sprintf(`<130>1 2017-07-14T02:40:00.0000005Z web01 vgo %d alarm [vgo@32473 fingerprint="f\]1" user="bob \"b\""] {"id":"cpu.idle","l":1}`, os.Getpid())
+	if got := s.format(a, now); got != want {
+		t.Errorf("got rfc5424 message\n%s\nwant\n%s", got, want)
+	}
+
+	s.Format = "rfc3164"
+	want = fmt.Sprintf(`<130>Jul 14 02:40:00 web01 vgo[%d]: {"id":"cpu.idle","l":1}`, os.Getpid())
+	if got := s.format(a, now); got != want {
+		t.Errorf("got rfc3164 message\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, tt := range []struct {
+		msg  string
+		max  int
+		want string
+	}{
+		{"disk full", 9, "disk full"},
+		{"disk full", 20, "disk full"},
+		{"disk full", 8, "disk ..."},
+		{"disk full", 3, "dis"},
+	} {
+		if got := truncate(tt.msg, tt.max); got != tt.want {
+			t.Errorf("%q to %d, got %q, want %q", tt.msg, tt.max, got, tt.want)
+		}
+	}
+
+	s := &Syslog{Format: "rfc5424", hostname: "web01", AppName: "vgo", MaxMessageSize: 64}
+	got := s.format(&service.Alarm{Data: []byte(strings.Repeat("x", 100))}, time.Now())
+	if len(got) != 64 || !strings.HasSuffix(got, truncated) {
+		t.Errorf("got message of %d bytes %q, want it truncated to 64", len(got), got)
+	}
+}
+
+func TestFrame(t *testing.T) {
+	s := &Syslog{Network: "udp"}
+	if got := string(s.frame("<13>1 msg")); got != "<13>1 msg" {
+		t.Errorf("got udp frame %q", got)
+	}
+	s.Network = "tcp"
+	if got := string(s.frame("<13>1 msg")); got != "9 <13>1 msg" {
+		t.Errorf("got tcp frame %q", got)
+	}
+}
+
+// readFrame reads an octet counted message.
+func readFrame(r *bufio.Reader) (string, error) {
+	size, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(size, " "))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, n)
+	for read := 0; read < n; {
+		m, err := r.Read(msg[read:])
+		if err != nil {
+			return "", err
+		}
+		read += m
+	}
+	return string(msg), nil
+}
+
+func TestWriteTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the first connection is closed after a message, the output connects
+	// again
+	msgs := make(chan string, 10)
+	go func() {
+		for n := 0; ; n++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			for {
+				msg, err := readFrame(r)
+				if err != nil {
+					break
+				}
+				msgs <- msg
+				if n == 0 {
+					break
+				}
+			}
+			conn.Close()
+		}
+	}()
+
+	s := &Syslog{Address: l.Addr().String(), Network: "tcp", Format: "rfc5424", Facility: "local0", AppName: "vgo"}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	receive := func() string {
+		select {
+		case msg := <-msgs:
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not received")
+		}
+		return ""
+	}
+
+	if err := s.Write(&service.Alarm{Data: []byte(`{"l":0}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(); !strings.HasPrefix(msg, "<132>1 ") || !strings.HasSuffix(msg, `{"l":0}`) {
+		t.Errorf("got message %q", msg)
+	}
+
+	// the write on the closed connection may succeed, the messages are
+	// written until one reaches the new connection
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.Write(&service.Alarm{Data: []byte(`{"l":1}`)})
+		select {
+		case msg := <-msgs:
+			if !strings.HasPrefix(msg, "<130>1 ") {
+				t.Errorf("got message %q", msg)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no message received after the connection closed")
+		}
+	}
+}
+
+func TestStartInvalid(t *testing.T) {
+	for _, s := range []*Syslog{
+		{Network: "udp", Format: "rfc5424", Facility: "local0"},
+		{Address: "localhost:514", Network: "sctp", Format: "rfc5424", Facility: "local0"},
+		{Address: "localhost:514", Network: "udp", Format: "json", Facility: "local0"},
+		{Address: "localhost:514", Network: "udp", Format: "rfc5424", Facility: "local9"},
+	} {
+		if err := s.Start(); err == nil {
+			t.Errorf("invalid config %+v started", s)
+		}
+	}
+}
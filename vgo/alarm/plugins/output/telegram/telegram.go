@@ -0,0 +1,344 @@
+package telegram
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corego/vgo/mecury/misc"
+	"github.com/corego/vgo/vgo/alarm/service"
+)
+
+// apiURL is the sendMessage endpoint of the bot token
+var apiURL = "https://api.telegram.org/bot%s/sendMessage"
+
+const (
+	// maxMessageLen is the longest text accepted by sendMessage
+	maxMessageLen = 4096
+	// chatInterval is the minimal interval between two messages to the same chat
+	chatInterval = time.Second
+	// maxEntityLen is the longest HTML entity or tag a split mustn't cut
+	maxEntityLen = 10
+	// deliveryTTL is how long the chats which got an alarm are remembered,
+	// so a retry of the alarm skips them
+	deliveryTTL = 24 * time.Hour
+)
+
+// Telegram sends the alarms to the chats through the Bot API, they're
+// queued by the service.Output wrapper.
+type Telegram struct {
+	BotToken string
+	ChatIDs  []string `toml:"chat_ids"`
+	// ParseMode can be "Markdown", "HTML" or empty for plain text
+	ParseMode string
+	// HTTPProxy is the proxy of the api requests, HTTP_PROXY/HTTPS_PROXY are used when empty
+	HTTPProxy string `toml:"http_proxy"`
+	// SSLCA trusts the CA of a proxy inspecting TLS, SSLCert and SSLKey are
+	// the client certificate of the gateways requiring mutual TLS
+	SSLCA              string `toml:"ssl_ca"`
+	SSLCert            string `toml:"ssl_cert"`
+	SSLKey             string `toml:"ssl_key"`
+	InsecureSkipVerify bool
+
+	client *http.Client
+	chats  map[string]*chat
+
+	mu sync.Mutex
+	// delivered are the chats which got the alarms not yet delivered to
+	// every chat, by alarm
+	delivered map[string]*delivery
+}
+
+// chat serializes the messages to a chat, the Writes of the queue, of the
+// spool and of the routes keep chatInterval apart
+type chat struct {
+	sync.Mutex
+	// last is the time of the last message
+	last time.Time
+}
+
+// delivery is the chats which got an alarm
+type delivery struct {
+	chats map[string]bool
+	at    time.Time
+}
+
+type sendMessage struct {
+	ChatID    string `json:"chat_id"`
+	Text      string `json:"text"`
+	ParseMode string `json:"parse_mode,omitempty"`
+}
+
+type apiResponse struct {
+	Ok          bool   `json:"ok"`
+	ErrorCode   int    `json:"error_code"`
+	Description string `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+func (t *Telegram) Start() error {
+	tlsConfig, err := misc.GetTLSConfig(t.SSLCert, t.SSLKey, t.SSLCA, t.InsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+	tr := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+	if t.HTTPProxy != "" {
+		proxy, err := url.Parse(t.HTTPProxy)
+		if err != nil {
+			return fmt.Errorf("invalid http_proxy %s, %s", t.HTTPProxy, err)
+		}
+		tr.Proxy = http.ProxyURL(proxy)
+	}
+
+	t.client = &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: tr,
+	}
+	t.chats = make(map[string]*chat, len(t.ChatIDs))
+	for _, id := range t.ChatIDs {
+		t.chats[id] = &chat{}
+	}
+	t.delivered = make(map[string]*delivery)
+	return nil
+}
+
+func (t *Telegram) Close() error {
+	return nil
+}
+
+// Write sends the alarm to the chats at once, it fails when a chat didn't
+// get it. When the write is retried the alarm is only sent to the chats
+// which didn't get it.
+func (t *Telegram) Write(a *service.Alarm) error {
+	key := a.Fingerprint + "\x00" + string(a.Data)
+	done := t.deliveredTo(key)
+
+	parts := split(t.format(a), maxMessageLen, t.ParseMode)
+	errs := make(chan error, len(t.ChatIDs))
+	var wg sync.WaitGroup
+	for _, id := range t.ChatIDs {
+		if done[id] {
+			continue
+		}
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			for _, text := range parts {
+				if err := t.sendChat(id, text); err != nil {
+					errs <- fmt.Errorf("chat %s, %s", id, err)
+					return
+				}
+			}
+			t.setDelivered(key, id)
+		}(id)
+	}
+	wg.Wait()
+	close(errs)
+
+	var failed []string
+	for err := range errs {
+		failed = append(failed, err.Error())
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	t.mu.Lock()
+	delete(t.delivered, key)
+	t.mu.Unlock()
+	return nil
+}
+
+// deliveredTo returns the chats which already got the alarm, the alarms
+// older than deliveryTTL are forgotten.
+func (t *Telegram) deliveredTo(key string) map[string]bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, d := range t.delivered {
+		if time.Since(d.at) > deliveryTTL {
+			delete(t.delivered, k)
+		}
+	}
+
+	done := make(map[string]bool)
+	if d, ok := t.delivered[key]; ok {
+		for id := range d.chats {
+			done[id] = true
+		}
+	}
+	return done
+}
+
+func (t *Telegram) setDelivered(key, chatID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.delivered[key]
+	if !ok {
+		d = &delivery{chats: make(map[string]bool), at: time.Now()}
+		t.delivered[key] = d
+	}
+	d.chats[chatID] = true
+}
+
+// sendChat sends a message to the chat at most one per chatInterval, it's
+// sent again once when telegram rate limited it.
+func (t *Telegram) sendChat(chatID string, text string) error {
+	c := t.chats[chatID]
+	c.Lock()
+	defer c.Unlock()
+
+	if wait := chatInterval - time.Since(c.last); wait > 0 {
+		time.Sleep(wait)
+	}
+	defer func() {
+		c.last = time.Now()
+	}()
+
+	retryAfter, err := t.send(chatID, text)
+	if retryAfter > 0 {
+		time.Sleep(time.Duration(retryAfter) * time.Second)
+		_, err = t.send(chatID, text)
+	}
+	return err
+}
+
+// send posts one message, it returns the seconds to wait before retrying
+// when telegram rate limited the request.
+func (t *Telegram) send(chatID string, text string) (int, error) {
+	body, err := json.Marshal(&sendMessage{
+		ChatID:    chatID,
+		Text:      text,
+		ParseMode: t.ParseMode,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := t.client.Post(fmt.Sprintf(apiURL, t.BotToken), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	r := &apiResponse{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return 0, fmt.Errorf("status %d, %s", resp.StatusCode, string(b))
+	}
+	if !r.Ok {
+		return r.Parameters.RetryAfter, fmt.Errorf("error code %d, %s", r.ErrorCode, r.Description)
+	}
+	return 0, nil
+}
+
+// format renders the alarm as a message in the configured parse mode, falling
+// back to the raw data when it isn't an alert.
+func (t *Telegram) format(a *service.Alarm) string {
+	ad := &service.AlertData{}
+	if err := ad.UnmarshalJSON(a.Data); err != nil || ad.ID == "" {
+		return t.escape(string(a.Data))
+	}
+
+	level := "WARN"
+	if ad.Level == 1 {
+		level = "CRITICAL"
+	}
+
+	lines := []string{
+		t.bold("[" + level + "] " + ad.ID),
+		t.escape("Group: " + ad.GroupID),
+		t.escape("Host: " + ad.HostName),
+		t.escape(fmt.Sprintf("Value: %v", ad.Value)),
+	}
+	if a.User != "" {
+		lines = append(lines, t.escape("User: "+a.User))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (t *Telegram) bold(s string) string {
+	switch strings.ToLower(t.ParseMode) {
+	case "markdown":
+		return "*" + t.escape(s) + "*"
+	case "html":
+		return "<b>" + t.escape(s) + "</b>"
+	default:
+		return s
+	}
+}
+
+func (t *Telegram) escape(s string) string {
+	switch strings.ToLower(t.ParseMode) {
+	case "markdown":
+		return markdownEscaper.Replace(s)
+	case "html":
+		return html.EscapeString(s)
+	default:
+		return s
+	}
+}
+
+var markdownEscaper = strings.NewReplacer("_", "\\_", "*", "\\*", "[", "\\[", "`", "\\`")
+
+// split cuts text into parts of at most max runes, on a line break when
+// possible, and never through an entity of the parse mode.
+func split(text string, max int, parseMode string) []string {
+	var parts []string
+	runes := []rune(text)
+	for len(runes) > max {
+		n := max
+		for i := max - 1; i > 0; i-- {
+			if runes[i] == '\n' {
+				n = i + 1
+				break
+			}
+		}
+		if n == max {
+			n = entityStart(runes, n, parseMode)
+		}
+		parts = append(parts, string(runes[:n]))
+		runes = runes[n:]
+	}
+	return append(parts, string(runes))
+}
+
+// entityStart returns the start of the entity a cut at n goes through, or n
+// when it doesn't: an HTML entity or tag, a Markdown escape.
+func entityStart(runes []rune, n int, parseMode string) int {
+	switch strings.ToLower(parseMode) {
+	case "html":
+		for i := n - 1; i > 0 && n-i < maxEntityLen; i-- {
+			switch runes[i] {
+			case ';', '>':
+				return n
+			case '&', '<':
+				return i
+			}
+		}
+	case "markdown":
+		if n > 1 && runes[n-1] == '\\' {
+			return n - 1
+		}
+	}
+	return n
+}
+
+func init() {
+	service.AddOutput("telegram", &Telegram{})
+}
@@ -0,0 +1,136 @@
+package telegram
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/corego/vgo/vgo/alarm/service"
+)
+
+func TestHTTPProxy(t *testing.T) {
+	// the proxy refuses the tunnels, it only records them
+	var mu sync.Mutex
+	var tunnels []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tunnels = append(tunnels, r.Method+" "+r.Host)
+		mu.Unlock()
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer proxy.Close()
+
+	tg := &Telegram{BotToken: "token", ChatIDs: []string{"1"}, HTTPProxy: proxy.URL}
+	if err := tg.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tg.Write(&service.Alarm{Data: []byte("disk full")}); err == nil {
+		t.Error("write refused by the proxy succeeded")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(tunnels) != 1 || tunnels[0] != "CONNECT api.telegram.org:443" {
+		t.Errorf("got proxy requests %v, want the tunnel to api.telegram.org", tunnels)
+	}
+}
+
+// mockAPI is the Bot API, the messages to the chats of fail are refused
+type mockAPI struct {
+	*httptest.Server
+
+	sync.Mutex
+	fail     map[string]bool
+	messages map[string][]string
+}
+
+func newMockAPI() *mockAPI {
+	api := &mockAPI{fail: make(map[string]bool), messages: make(map[string][]string)}
+	api.Server = httptest.NewServer(api)
+	apiURL = api.URL + "/bot%s/sendMessage"
+	return api
+}
+
+func (api *mockAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m := &sendMessage{}
+	if err := json.NewDecoder(r.Body).Decode(m); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	api.Lock()
+	defer api.Unlock()
+	if api.fail[m.ChatID] {
+		w.Write([]byte(`{"ok":false,"error_code":403,"description":"Forbidden: bot was blocked by the user"}`))
+		return
+	}
+	api.messages[m.ChatID] = append(api.messages[m.ChatID], m.Text)
+	w.Write([]byte(`{"ok":true}`))
+}
+
+func (api *mockAPI) received(chatID string) int {
+	api.Lock()
+	defer api.Unlock()
+	return len(api.messages[chatID])
+}
+
+func TestRetrySkipsDeliveredChats(t *testing.T) {
+	defer func(u string) { apiURL = u }(apiURL)
+	api := newMockAPI()
+	defer api.Close()
+	api.fail["2"] = true
+
+	tg := &Telegram{BotToken: "token", ChatIDs: []string{"1", "2", "3"}}
+	if err := tg.Start(); err != nil {
+		t.Fatal(err)
+	}
+	a := &service.Alarm{Data: []byte("disk full"), Fingerprint: "disk"}
+	err := tg.Write(a)
+	if err == nil || !strings.Contains(err.Error(), "chat 2") || strings.Contains(err.Error(), "chat 1") {
+		t.Fatalf("got error %v, want chat 2 failed", err)
+	}
+
+	// the retry only goes to the chat which failed
+	api.Lock()
+	api.fail["2"] = false
+	api.Unlock()
+	if err := tg.Write(a); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]int{"1": 1, "2": 1, "3": 1} {
+		if n := api.received(id); n != want {
+			t.Errorf("chat %s got %d messages, want %d", id, n, want)
+		}
+	}
+
+	// delivered to every chat, the same alarm again is a new one
+	if err := tg.Write(a); err != nil {
+		t.Fatal(err)
+	}
+	if n := api.received("1"); n != 2 {
+		t.Errorf("chat 1 got %d messages, want 2", n)
+	}
+}
+
+func TestSplitEntities(t *testing.T) {
+	for _, tt := range []struct {
+		text      string
+		parseMode string
+		want      []string
+	}{
+		{"abc\ndefghijk", "", []string{"abc\n", "defghijk"}},
+		{"abcdefghijk", "", []string{"abcdefgh", "ijk"}},
+		// the cut goes before the entity or the tag it would go through
+		{"abcde&amp;fg", "HTML", []string{"abcde", "&amp;fg"}},
+		{"abcdef<b>x</b>", "HTML", []string{"abcdef", "<b>x</b>"}},
+		{"abcdefg\\_h", "Markdown", []string{"abcdefg", "\\_h"}},
+		{"abcdefg\\_h", "", []string{"abcdefg\\", "_h"}},
+	} {
+		got := split(tt.text, 8, tt.parseMode)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("split %q, got %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
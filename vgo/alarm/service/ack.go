@@ -0,0 +1,231 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ackGCInterval is the interval the resolved alarms and expired acks are
+// removed at
+const ackGCInterval = time.Minute
+
+var acks *acker
+
+// ActiveAlarm is an alarm which fired within the resolve timeout, identified
+// by its fingerprint. The fingerprint must not depend on the value of the
+// alarm, see the fingerprint_fields of dedup, or every alarm is a new one.
+type ActiveAlarm struct {
+	Fingerprint string                 `json:"fingerprint"`
+	Data        map[string]interface{} `json:"data"`
+	FirstSeen   time.Time              `json:"first_seen"`
+	LastSeen    time.Time              `json:"last_seen"`
+	Count       int                    `json:"count"`
+	Ack         *Ack                   `json:"ack,omitempty"`
+}
+
+// Ack stops the notifications of an alarm until it resolves, or until
+// ExpiresAt when set. The acked alarms are still logged.
+type Ack struct {
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+func (a *Ack) expired(now time.Time) bool {
+	return !a.ExpiresAt.IsZero() && !now.Before(a.ExpiresAt)
+}
+
+// acker tracks the active alarms and their acks. An alarm which doesn't
+// fire again within resolveTimeout is resolved, it's forgotten with its ack.
+type acker struct {
+	sync.Mutex
+	resolveTimeout time.Duration
+
+	alarms map[string]*ActiveAlarm
+}
+
+func newAcker(resolveTimeout time.Duration) *acker {
+	a := &acker{
+		resolveTimeout: resolveTimeout,
+		alarms:         make(map[string]*ActiveAlarm),
+	}
+	go a.gc()
+	return a
+}
+
+// fire records the alarm as active and reports whether it's acked.
+func (a *acker) fire(fp string, data []byte) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	now := time.Now()
+	alarm, ok := a.alarms[fp]
+	// resolved but not forgotten yet by gc, it fires again as a new alarm
+	if ok && now.Sub(alarm.LastSeen) >= a.resolveTimeout {
+		if alarm.Ack != nil {
+			log.Printf("alarm %s resolved, ack cleared\n", fp)
+		}
+		ok = false
+	}
+	if !ok {
+		alarm = &ActiveAlarm{
+			Fingerprint: fp,
+			FirstSeen:   now,
+		}
+		a.alarms[fp] = alarm
+	}
+	// the data which isn't a JSON object is listed without data
+	var obj map[string]interface{}
+	if err := json.Unmarshal(data, &obj); err == nil {
+		alarm.Data = obj
+	}
+	alarm.LastSeen = now
+	alarm.Count++
+
+	if alarm.Ack != nil && alarm.Ack.expired(now) {
+		log.Printf("alarm %s ack expired\n", fp)
+		alarm.Ack = nil
+	}
+	return alarm.Ack != nil
+}
+
+// Ack acknowledges the active alarm, it returns an error when there is no
+// such alarm.
+func (a *acker) Ack(fp string, ack *Ack) error {
+	a.Lock()
+	defer a.Unlock()
+
+	alarm, ok := a.alarms[fp]
+	if !ok {
+		return errors.New("no active alarm found")
+	}
+	alarm.Ack = ack
+	return nil
+}
+
+// Unack removes the ack of the alarm, it returns false when the alarm isn't
+// acked.
+func (a *acker) Unack(fp string) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	alarm, ok := a.alarms[fp]
+	if !ok || alarm.Ack == nil {
+		return false
+	}
+	alarm.Ack = nil
+	return true
+}
+
+// List returns copies of the active alarms, the latest first.
+func (a *acker) List() []*ActiveAlarm {
+	a.Lock()
+	list := make([]*ActiveAlarm, 0, len(a.alarms))
+	for _, alarm := range a.alarms {
+		c := *alarm
+		list = append(list, &c)
+	}
+	a.Unlock()
+
+	sort.Sort(byLastSeen(list))
+	return list
+}
+
+// gc forgets the resolved alarms and removes the expired acks.
+func (a *acker) gc() {
+	ticker := time.NewTicker(ackGCInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		a.sweep(now)
+	}
+}
+
+func (a *acker) sweep(now time.Time) {
+	a.Lock()
+	defer a.Unlock()
+
+	for fp, alarm := range a.alarms {
+		if now.Sub(alarm.LastSeen) >= a.resolveTimeout {
+			if alarm.Ack != nil {
+				log.Printf("alarm %s resolved, ack cleared\n", fp)
+			}
+			delete(a.alarms, fp)
+			continue
+		}
+		if alarm.Ack != nil && alarm.Ack.expired(now) {
+			log.Printf("alarm %s ack expired\n", fp)
+			alarm.Ack = nil
+		}
+	}
+}
+
+type byLastSeen []*ActiveAlarm
+
+func (b byLastSeen) Len() int           { return len(b) }
+func (b byLastSeen) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byLastSeen) Less(i, j int) bool { return b[i].LastSeen.After(b[j].LastSeen) }
+
+// ackRequest is the body of an ack, which lasts until the alarm resolves or
+// for the duration ("1h") when set.
+type ackRequest struct {
+	Fingerprint string `json:"fingerprint"`
+	Note        string `json:"note"`
+	Duration    string `json:"duration"`
+}
+
+func alarmsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, acks.List())
+}
+
+func acksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		req := &ackRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ack := &Ack{
+			Note:      req.Note,
+			CreatedAt: time.Now(),
+		}
+		if req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ack.ExpiresAt = ack.CreatedAt.Add(d)
+		}
+
+		if err := acks.Ack(req.Fingerprint, ack); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Printf("alarm %s acked, note %q\n", req.Fingerprint, ack.Note)
+		writeJSON(w, http.StatusCreated, ack)
+
+	case "DELETE":
+		fp := r.URL.Query().Get("fingerprint")
+		if !acks.Unack(fp) {
+			http.Error(w, "no ack found", http.StatusNotFound)
+			return
+		}
+		log.Printf("alarm %s unacked\n", fp)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
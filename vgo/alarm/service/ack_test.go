@@ -0,0 +1,212 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+)
+
+var web01 = []byte(`{"id":"cpu","gid":"ops","l":0,"h":"web01"}`)
+
+func TestAckUnack(t *testing.T) {
+	a := newAcker(time.Hour)
+	if err := a.Ack("fp1", &Ack{}); err == nil {
+		t.Error("alarm not fired acked")
+	}
+
+	if a.fire("fp1", web01) {
+		t.Fatal("alarm acked before the ack")
+	}
+	if err := a.Ack("fp1", &Ack{Note: "on it", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if !a.fire("fp1", web01) {
+		t.Error("acked alarm not reported acked")
+	}
+	// another alarm isn't acked
+	if a.fire("fp2", web01) {
+		t.Error("alarm fp2 acked by the ack of fp1")
+	}
+
+	if !a.Unack("fp1") {
+		t.Fatal("ack not removed")
+	}
+	if a.Unack("fp1") {
+		t.Error("ack removed twice")
+	}
+	if a.fire("fp1", web01) {
+		t.Error("alarm acked after the unack")
+	}
+
+	list := a.List()
+	if len(list) != 2 || list[0].Fingerprint != "fp1" || list[0].Count != 3 || list[0].Data["h"] != "web01" {
+		t.Errorf("got active alarms %+v, want fp1 fired 3 times first", list)
+	}
+}
+
+func TestAckExpiry(t *testing.T) {
+	a := newAcker(time.Hour)
+	a.fire("fp1", web01)
+	now := time.Now()
+	a.Ack("fp1", &Ack{CreatedAt: now, ExpiresAt: now.Add(20 * time.Millisecond)})
+	if !a.fire("fp1", web01) {
+		t.Fatal("alarm not acked before the ack expires")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if a.fire("fp1", web01) {
+		t.Error("alarm acked after the ack expired")
+	}
+	if list := a.List(); list[0].Ack != nil {
+		t.Errorf("got expired ack %+v", list[0].Ack)
+	}
+
+	// gc removes the expired acks of the alarms not firing
+	a.fire("fp2", web01)
+	a.Ack("fp2", &Ack{CreatedAt: now, ExpiresAt: now.Add(time.Minute)})
+	a.sweep(now.Add(time.Minute))
+	if list := a.List(); len(list) != 2 || list[0].Ack != nil || list[1].Ack != nil {
+		t.Errorf("got acks after the expiry, alarms %+v", list)
+	}
+}
+
+func TestAckResolve(t *testing.T) {
+	a := newAcker(20 * time.Millisecond)
+	a.fire("fp1", web01)
+	a.Ack("fp1", &Ack{CreatedAt: time.Now()})
+	time.Sleep(30 * time.Millisecond)
+
+	// resolved, firing again it's a new alarm without the ack
+	if a.fire("fp1", web01) {
+		t.Error("ack kept after the alarm resolved")
+	}
+	if list := a.List(); len(list) != 1 || list[0].Count != 1 {
+		t.Errorf("got active alarms %+v, want fp1 fired once", list)
+	}
+
+	a.Ack("fp1", &Ack{CreatedAt: time.Now()})
+	a.sweep(time.Now().Add(20 * time.Millisecond))
+	if list := a.List(); len(list) != 0 {
+		t.Errorf("got active alarms %+v after they resolved", list)
+	}
+}
+
+// startProcess sets the alerts, the sms output and the ack store process
+// uses, the cpu alert of the ops group fires at each alarm.
+func startProcess(t *testing.T) (*mockOutput, func()) {
+	oldGs, oldConf, oldDedup, oldAcks := gs, Conf, dedup, acks
+
+	now := time.Now()
+	gs = &Groups{RWMutex: &sync.RWMutex{}, groups: map[string]*Group{
+		"ops": {
+			ID: "ops",
+			Alerts: map[string]*Alert{"cpu": {
+				Count:       []int32{1, 1},
+				NowCount:    []int32{0, 0},
+				AlarmOutput: []string{"sms", "sms"},
+				Duration:    []time.Duration{time.Hour, time.Hour},
+				LastTime:    []time.Time{now, now},
+			}},
+			Users: map[string]*User{"ops": user},
+		},
+	}}
+	sms := &mockOutput{}
+	o := &Output{Name: "sms", Output: sms, QueueSize: 10}
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	Conf = &Config{Outputs: map[string]*Output{"sms": o}, Routes: map[string]*Route{}}
+	dedup = newDeduper(0, nil)
+	acks = newAcker(time.Hour)
+
+	return sms, func() {
+		gs, Conf, dedup, acks = oldGs, oldConf, oldDedup, oldAcks
+	}
+}
+
+func TestAckSuppression(t *testing.T) {
+	sms, stop := startProcess(t)
+	defer stop()
+	fp := dedup.fingerprint(web01)
+
+	process(&nats.Msg{Data: web01})
+	waitFor(t, time.Second, func() bool { return sms.written() == 1 })
+
+	if err := acks.Ack(fp, &Ack{CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	process(&nats.Msg{Data: web01})
+	time.Sleep(20 * time.Millisecond)
+	if n := sms.written(); n != 1 {
+		t.Errorf("%d alarms sent, want the acked one not sent", n)
+	}
+	// still tracked while acked
+	if list := acks.List(); len(list) != 1 || list[0].Count != 2 {
+		t.Errorf("got active alarms %+v, want it fired twice", list)
+	}
+
+	acks.Unack(fp)
+	process(&nats.Msg{Data: web01})
+	waitFor(t, time.Second, func() bool { return sms.written() == 2 })
+}
+
+func TestAcksHandler(t *testing.T) {
+	old := acks
+	acks = newAcker(time.Hour)
+	defer func() { acks = old }()
+	acks.fire("fp1", web01)
+
+	w := httptest.NewRecorder()
+	acksHandler(w, httptest.NewRequest("POST", "/acks", strings.NewReader(`{"fingerprint":"fp1","note":"on it","duration":"1h"}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("ack status %d, %s", w.Code, w.Body)
+	}
+	ack := &Ack{}
+	if err := json.Unmarshal(w.Body.Bytes(), ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack.Note != "on it" || ack.ExpiresAt.Sub(ack.CreatedAt) != time.Hour {
+		t.Errorf("bad ack created %+v", ack)
+	}
+
+	for _, tt := range []struct {
+		body string
+		code int
+	}{
+		{`{"fingerprint":"fp2"}`, http.StatusNotFound},
+		{`{"fingerprint":"fp1","duration":"later"}`, http.StatusBadRequest},
+		{`{"fingerprint":`, http.StatusBadRequest},
+	} {
+		w = httptest.NewRecorder()
+		acksHandler(w, httptest.NewRequest("POST", "/acks", strings.NewReader(tt.body)))
+		if w.Code != tt.code {
+			t.Errorf("ack %s, status %d, want %d", tt.body, w.Code, tt.code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	alarmsHandler(w, httptest.NewRequest("GET", "/alarms", nil))
+	var list []*ActiveAlarm
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Fingerprint != "fp1" || list[0].Ack == nil || list[0].Ack.Note != "on it" {
+		t.Errorf("got alarms %+v", list)
+	}
+
+	w = httptest.NewRecorder()
+	acksHandler(w, httptest.NewRequest("DELETE", "/acks?fingerprint=fp1", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("unack status %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	acksHandler(w, httptest.NewRequest("DELETE", "/acks?fingerprint=fp1", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("second unack status %d", w.Code)
+	}
+}
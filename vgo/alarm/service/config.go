@@ -1,9 +1,12 @@
 package service
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
+	"time"
 
+	"github.com/corego/vgo/mecury/misc"
 	"github.com/influxdata/toml"
 	"github.com/influxdata/toml/ast"
 )
@@ -11,10 +14,15 @@ import (
 var Conf *Config
 
 type Config struct {
-	Common *CommonConfig
-	Nats   *NatsConfig
+	Common  *CommonConfig
+	Nats    *NatsConfig
+	Dedup   *DedupConfig
+	Control *ControlConfig
 
 	Outputs map[string]*Output
+	// Routes send the alarms to several outputs, they're named by the
+	// alerts like the outputs
+	Routes map[string]*Route
 }
 
 type CommonConfig struct {
@@ -22,6 +30,11 @@ type CommonConfig struct {
 	IsDebug  bool
 	LogLevel string
 	LogPath  string
+	// LogEncoding can be "json" or "console"
+	LogEncoding string
+	// LogOutputs are "stdout", "stderr" or file paths, by default stdout
+	// when debugging and LogPath otherwise
+	LogOutputs []string
 }
 
 type NatsConfig struct {
@@ -29,11 +42,30 @@ type NatsConfig struct {
 	Topic string
 }
 
+// DedupConfig drops the alarms already sent within the window, alarms are
+// identified by FingerprintFields of their JSON data, id, gid, l and h by
+// default, or by the whole data when empty
+type DedupConfig struct {
+	Window            misc.Duration
+	FingerprintFields []string
+}
+
+// ControlConfig is the HTTP control endpoint, disabled when Addr is empty.
+// An alarm not fired again within ResolveTimeout is resolved, its ack is
+// cleared
+type ControlConfig struct {
+	Addr           string
+	ResolveTimeout misc.Duration
+}
+
 func LoadConfig() {
 	Conf = &Config{
 		Common:  &CommonConfig{},
 		Nats:    &NatsConfig{},
+		Dedup:   &DedupConfig{FingerprintFields: defaultFingerprintFields},
+		Control: &ControlConfig{ResolveTimeout: misc.Duration{Duration: 10 * time.Minute}},
 		Outputs: make(map[string]*Output),
+		Routes:  make(map[string]*Route),
 	}
 
 	contents, err := ioutil.ReadFile("alarm.toml")
@@ -50,10 +82,16 @@ func LoadConfig() {
 
 	parseNats(tbl)
 
+	parseDedup(tbl)
+
+	parseControl(tbl)
+
 	parseOutputs(tbl)
 	for _, v := range Conf.Outputs {
 		log.Println("config output ---- ", v.Name, ":", v.Output)
 	}
+
+	parseRoutes(tbl)
 }
 
 func parseCommon(tbl *ast.Table) {
@@ -82,6 +120,32 @@ func parseNats(tbl *ast.Table) {
 	}
 }
 
+func parseDedup(tbl *ast.Table) {
+	if val, ok := tbl.Fields["dedup"]; ok {
+		subTbl, ok := val.(*ast.Table)
+		if !ok {
+			log.Fatalln("[FATAL] : ", subTbl)
+		}
+		err := toml.UnmarshalTable(subTbl, Conf.Dedup)
+		if err != nil {
+			log.Fatalln("[FATAL] parseDedup: ", err, subTbl)
+		}
+	}
+}
+
+func parseControl(tbl *ast.Table) {
+	if val, ok := tbl.Fields["control"]; ok {
+		subTbl, ok := val.(*ast.Table)
+		if !ok {
+			log.Fatalln("[FATAL] : ", subTbl)
+		}
+		err := toml.UnmarshalTable(subTbl, Conf.Control)
+		if err != nil {
+			log.Fatalln("[FATAL] parseControl: ", err, subTbl)
+		}
+	}
+}
+
 func parseOutputs(tbl *ast.Table) {
 	if val, ok := tbl.Fields["outputs"]; ok {
 		subTbl, _ := val.(*ast.Table)
@@ -100,6 +164,37 @@ func parseOutputs(tbl *ast.Table) {
 	}
 }
 
+func parseRoutes(tbl *ast.Table) {
+	if val, ok := tbl.Fields["routes"]; ok {
+		subTbl, _ := val.(*ast.Table)
+		for name, rt := range subTbl.Fields {
+			iTbl, ok := rt.(*ast.Table)
+			if !ok {
+				log.Fatalln("[FATAL] routes parse error: ", rt)
+			}
+			Conf.AddRoute(name, iTbl)
+		}
+	}
+}
+
+// AddRoute adds the route, its outputs must be parsed already.
+func (c *Config) AddRoute(name string, iTbl *ast.Table) {
+	route := &Route{
+		Name:      name,
+		Timeout:   misc.Duration{Duration: 10 * time.Second},
+		QueueSize: 1000,
+	}
+	err := toml.UnmarshalTable(iTbl, route)
+	if err != nil {
+		log.Fatalln("[FATAL] unmarshal route: ", err)
+	}
+
+	if err := route.init(c.Outputs); err != nil {
+		log.Fatalln("[FATAL] build route: ", err)
+	}
+	c.Routes[name] = route
+}
+
 func (c *Config) AddOutput(name string, iTbl *ast.Table) {
 	output, ok := Outputs[name]
 	if !ok {
@@ -120,10 +215,98 @@ func (c *Config) AddOutput(name string, iTbl *ast.Table) {
 	c.Outputs[name] = outC
 }
 
+// buildOutput parses the queue and spool options from the ast.Table and
+// removes them, the rest of the table belongs to the plugin.
 func buildOutput(name string, tbl *ast.Table) (*Output, error) {
 	oc := &Output{
-		Name: name,
+		Name:               name,
+		QueueSize:          1000,
+		SpoolMaxAge:        24 * time.Hour,
+		SpoolRetryInterval: 30 * time.Second,
+	}
+
+	if i, ok, err := tableInt(tbl, "queue_size"); err != nil {
+		return nil, fmt.Errorf("%s: invalid queue_size, %s", name, err)
+	} else if ok {
+		if i < 0 {
+			return nil, fmt.Errorf("%s: invalid queue_size %d", name, i)
+		}
+		oc.QueueSize = int(i)
+	}
+
+	if policy, ok := tableString(tbl, "queue_policy"); ok {
+		switch policy {
+		case "drop":
+		case "block":
+			oc.Block = true
+		default:
+			return nil, fmt.Errorf("%s: invalid queue_policy %s, can be: \"drop\", \"block\"", name, policy)
+		}
+	}
+
+	if s, ok := tableString(tbl, "spool_file"); ok {
+		oc.SpoolFile = s
+	}
+
+	if d, ok, err := tableDuration(tbl, "spool_max_age"); err != nil {
+		return nil, fmt.Errorf("%s: invalid spool_max_age, %s", name, err)
+	} else if ok {
+		oc.SpoolMaxAge = d
+	}
+
+	if d, ok, err := tableDuration(tbl, "spool_retry_interval"); err != nil {
+		return nil, fmt.Errorf("%s: invalid spool_retry_interval, %s", name, err)
+	} else if ok {
+		if d <= 0 {
+			return nil, fmt.Errorf("%s: spool_retry_interval must be positive", name)
+		}
+		oc.SpoolRetryInterval = d
 	}
 
 	return oc, nil
 }
+
+// tableInt reads and removes an integer option from the output table, so
+// that it isn't unmarshaled into the plugin.
+func tableInt(tbl *ast.Table, key string) (int64, bool, error) {
+	node, ok := tbl.Fields[key]
+	if !ok {
+		return 0, false, nil
+	}
+	delete(tbl.Fields, key)
+
+	if kv, ok := node.(*ast.KeyValue); ok {
+		if integer, ok := kv.Value.(*ast.Integer); ok {
+			i, err := integer.Int()
+			return i, err == nil, err
+		}
+	}
+	return 0, false, fmt.Errorf("%s must be an integer", key)
+}
+
+// tableString reads and removes a string option from the output table.
+func tableString(tbl *ast.Table, key string) (string, bool) {
+	node, ok := tbl.Fields[key]
+	if !ok {
+		return "", false
+	}
+	delete(tbl.Fields, key)
+
+	if kv, ok := node.(*ast.KeyValue); ok {
+		if str, ok := kv.Value.(*ast.String); ok {
+			return str.Value, true
+		}
+	}
+	return "", true
+}
+
+// tableDuration reads and removes a duration option like "10s" from the
+// output table.
+func tableDuration(tbl *ast.Table, key string) (time.Duration, bool, error) {
+	s, ok := tableString(tbl, key)
+	if !ok {
+		return 0, false, nil
+	}
+	d, err := time.ParseDuration(s)
+	return d, err == nil, err
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var dedup *deduper
+
+// defaultFingerprintFields identify an alert by its id, group, level and
+// host: the hash of the whole data would include the value "v", which
+// changes with every alarm.
+var defaultFingerprintFields = []string{"id", "gid", "l", "h"}
+
+// deduper drops the alarms whose fingerprint was already sent within the
+// window. Without fingerprint fields the fingerprint is the hash of the
+// whole alarm data.
+type deduper struct {
+	sync.Mutex
+	window time.Duration
+	fields []string
+
+	sent map[string]time.Time
+}
+
+func newDeduper(window time.Duration, fields []string) *deduper {
+	d := &deduper{
+		window: window,
+		fields: fields,
+		sent:   make(map[string]time.Time),
+	}
+	if window > 0 {
+		go d.gc()
+	}
+	return d
+}
+
+// fingerprint returns the dedup key of the alarm data: the hash of the
+// fingerprint fields when the data is a JSON object holding all of them,
+// else the hash of the whole data.
+func (d *deduper) fingerprint(data []byte) string {
+	if len(d.fields) > 0 {
+		if key, ok := fieldsKey(data, d.fields); ok {
+			return hash([]byte(key))
+		}
+	}
+	return hash(data)
+}
+
+// fieldsKey joins the values of the fields, a field can be nested with dots:
+// "tags.host".
+func fieldsKey(data []byte, fields []string) (string, bool) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return "", false
+	}
+
+	parts := make([]string, 0, len(fields))
+	for _, f := range fields {
+		v, ok := lookup(obj, strings.Split(f, "."))
+		if !ok {
+			return "", false
+		}
+		parts = append(parts, fmt.Sprintf("%s=%v", f, v))
+	}
+	return strings.Join(parts, "\x00"), true
+}
+
+func lookup(obj map[string]interface{}, path []string) (interface{}, bool) {
+	v, ok := obj[path[0]]
+	if !ok {
+		return nil, false
+	}
+	if len(path) == 1 {
+		return v, true
+	}
+	sub, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	return lookup(sub, path[1:])
+}
+
+func hash(b []byte) string {
+	sum := sha1.Sum(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// duplicate reports whether the fingerprint was sent within the window, and
+// records it as sent otherwise.
+func (d *deduper) duplicate(fp string) bool {
+	if d.window <= 0 {
+		return false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+	if last, ok := d.sent[fp]; ok && now.Sub(last) < d.window {
+		return true
+	}
+	d.sent[fp] = now
+	return false
+}
+
+// gc forgets the fingerprints older than the window.
+func (d *deduper) gc() {
+	ticker := time.NewTicker(d.window)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		d.Lock()
+		for fp, last := range d.sent {
+			if now.Sub(last) >= d.window {
+				delete(d.sent, fp)
+			}
+		}
+		d.Unlock()
+	}
+}
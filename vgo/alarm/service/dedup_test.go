@@ -0,0 +1,100 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/influxdata/toml"
+)
+
+func TestFingerprintFields(t *testing.T) {
+	d := newDeduper(0, defaultFingerprintFields)
+
+	// the value doesn't change the fingerprint, the fields do
+	fp := d.fingerprint([]byte(`{"id":"cpu","gid":"ops","l":0,"h":"web01","v":91.5}`))
+	if got := d.fingerprint([]byte(`{"id":"cpu","gid":"ops","l":0,"h":"web01","v":97.2}`)); got != fp {
+		t.Error("the value changed the fingerprint")
+	}
+	if got := d.fingerprint([]byte(`{"id":"cpu","gid":"ops","l":0,"h":"web02","v":91.5}`)); got == fp {
+		t.Error("another host has the same fingerprint")
+	}
+
+	// nested fields
+	d = newDeduper(0, []string{"id", "tags.host"})
+	fp = d.fingerprint([]byte(`{"id":"cpu","tags":{"host":"web01"},"v":1}`))
+	if got := d.fingerprint([]byte(`{"id":"cpu","tags":{"host":"web01"},"v":2}`)); got != fp {
+		t.Error("the value changed the fingerprint of the nested fields")
+	}
+	if got := d.fingerprint([]byte(`{"id":"cpu","tags":{"host":"web02"},"v":1}`)); got == fp {
+		t.Error("another nested host has the same fingerprint")
+	}
+}
+
+func TestFingerprintFallback(t *testing.T) {
+	d := newDeduper(0, defaultFingerprintFields)
+	for _, data := range []string{
+		// a fingerprint field is missing
+		`{"id":"cpu","gid":"ops","l":0,"v":91.5}`,
+		// not a JSON object
+		`cpu ops web01 91.5`,
+	} {
+		if got, want := d.fingerprint([]byte(data)), hash([]byte(data)); got != want {
+			t.Errorf("%s, got fingerprint %s, want the hash of the data %s", data, got, want)
+		}
+	}
+
+	// without fields the whole data is hashed, the value included
+	d = newDeduper(0, nil)
+	if d.fingerprint(web01) != hash(web01) {
+		t.Error("the fingerprint without fields isn't the hash of the data")
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	d := newDeduper(50*time.Millisecond, defaultFingerprintFields)
+	fp := d.fingerprint(web01)
+	if d.duplicate(fp) {
+		t.Fatal("first alarm is a duplicate")
+	}
+	if !d.duplicate(fp) {
+		t.Error("alarm sent again within the window isn't a duplicate")
+	}
+	if d.duplicate(d.fingerprint([]byte(`{"id":"cpu","gid":"ops","l":0,"h":"web02"}`))) {
+		t.Error("alarm of another host is a duplicate")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if d.duplicate(fp) {
+		t.Error("alarm sent again after the window is a duplicate")
+	}
+
+	// no window, no dedup
+	d = newDeduper(0, defaultFingerprintFields)
+	if d.duplicate(fp) || d.duplicate(fp) {
+		t.Error("alarm deduplicated without window")
+	}
+}
+
+func TestDedupConfig(t *testing.T) {
+	old := Conf
+	defer func() { Conf = old }()
+
+	for _, tt := range []struct {
+		conf   string
+		fields []string
+	}{
+		{"[dedup]\nwindow = \"5m\"", defaultFingerprintFields},
+		{"[dedup]\nfingerprint_fields = [\"id\", \"h\"]", []string{"id", "h"}},
+	} {
+		Conf = &Config{Dedup: &DedupConfig{FingerprintFields: defaultFingerprintFields}}
+		tbl, err := toml.Parse([]byte(tt.conf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parseDedup(tbl)
+		if got := Conf.Dedup.FingerprintFields; !reflect.DeepEqual(got, tt.fields) {
+			t.Errorf("%s, got fingerprint fields %v, want %v", tt.conf, got, tt.fields)
+		}
+	}
+}
@@ -1,28 +1,148 @@
 package service
 
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
 type Outputer interface {
 	// Connect to the Output
 	Start() error
 	// Close any connections to the Output
 	Close() error
 
-	// Write takes in group of points to be written to the Output
+	// Write takes in group of points to be written to the Output. It returns
+	// once the alarm is delivered, with the error of a failed delivery: the
+	// spool and the route failover rely on it, the queueing is done by
+	// Output. It's called by the queue, the spool and the routes at once
 	Write(*Alarm) error
 }
 
+// Output queues the alarms of an output plugin, so a slow output never
+// blocks the dispatcher and the other outputs: with the drop policy the
+// alarms over QueueSize are dropped and counted, with the block policy the
+// dispatcher waits for room in the queue.
 type Output struct {
 	Name string
 
 	Output Outputer
+
+	// QueueSize is the number of alarms waiting to be written
+	QueueSize int
+	// Block waits for room in a full queue instead of dropping the alarm
+	Block bool
+
+	// SpoolFile keeps the alarms the output failed to write, they're
+	// retried every SpoolRetryInterval until written or older than
+	// SpoolMaxAge. No spool when empty
+	SpoolFile          string
+	SpoolMaxAge        time.Duration
+	SpoolRetryInterval time.Duration
+
+	queue   chan *Alarm
+	dropped int64
+	spool   *spool
 }
 
 type Alarm struct {
 	Data []byte
 	User string
+	// Fingerprint identifies the alert, the same alert always has the same one
+	Fingerprint string
+}
+
+// Start starts the output plugin and the writes of the queued alarms.
+func (o *Output) Start() error {
+	o.queue = make(chan *Alarm, o.QueueSize)
+	if err := o.Output.Start(); err != nil {
+		return err
+	}
+
+	if o.SpoolFile != "" {
+		o.spool = newSpool(o.SpoolFile, o.SpoolMaxAge)
+		go o.retryLoop()
+	}
+
+	go func() {
+		for a := range o.queue {
+			o.write(a)
+		}
+	}()
+	return nil
+}
+
+// write writes the alarm, spooling it on failure.
+func (o *Output) write(a *Alarm) {
+	err := o.Output.Write(a)
+	if err == nil {
+		return
+	}
+	log.Printf("output %s write failed, err message is %v\n", o.Name, err)
+
+	if o.spool == nil {
+		return
+	}
+	if err := o.spool.append(a); err != nil {
+		log.Printf("output %s spool failed, alarm %s lost, err message is %v\n", o.Name, a.Fingerprint, err)
+	}
+}
+
+// writeTimeout writes the alarm at once, bypassing the queue and the spool,
+// and fails when the write doesn't return within timeout. The late write
+// isn't aborted, it may still deliver the alarm.
+func (o *Output) writeTimeout(a *Alarm, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- o.Output.Write(a)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no answer within %s", timeout)
+	}
+}
+
+// retryLoop replays the spool at start, for the alarms spooled before a
+// restart, then every SpoolRetryInterval.
+func (o *Output) retryLoop() {
+	ticker := time.NewTicker(o.SpoolRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		n, err := o.spool.replay(o.Output.Write)
+		if err != nil {
+			log.Printf("output %s spool replay failed, err message is %v\n", o.Name, err)
+		}
+		if n > 0 {
+			log.Printf("output %s wrote %d spooled alarms\n", o.Name, n)
+		}
+		<-ticker.C
+	}
 }
 
+// Write queues the alarm, when the queue is full it's dropped unless the
+// output blocks.
 func (o *Output) Write(alarm *Alarm) {
-	o.Output.Write(alarm)
+	if o.Block {
+		o.queue <- alarm
+		return
+	}
+
+	select {
+	case o.queue <- alarm:
+	default:
+		n := atomic.AddInt64(&o.dropped, 1)
+		log.Printf("output %s queue is full, alarm %s dropped, %d dropped so far\n", o.Name, alarm.Fingerprint, n)
+	}
+}
+
+// Dropped returns the number of alarms dropped by the full queue.
+func (o *Output) Dropped() int64 {
+	return atomic.LoadInt64(&o.dropped)
 }
 
 var Outputs = map[string]Outputer{}
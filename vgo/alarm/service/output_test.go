@@ -0,0 +1,125 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockOutput records the alarms written, each write waits for release
+// when it's set.
+type mockOutput struct {
+	release chan struct{}
+
+	sync.Mutex
+	alarms []*Alarm
+}
+
+func (o *mockOutput) Start() error { return nil }
+func (o *mockOutput) Close() error { return nil }
+
+func (o *mockOutput) Write(a *Alarm) error {
+	if o.release != nil {
+		<-o.release
+	}
+	o.Lock()
+	o.alarms = append(o.alarms, a)
+	o.Unlock()
+	return nil
+}
+
+func (o *mockOutput) written() int {
+	o.Lock()
+	defer o.Unlock()
+	return len(o.alarms)
+}
+
+// waitFor polls cond until it's true or the timeout elapsed.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met within %s", timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSlowOutputDoesntBlock(t *testing.T) {
+	slowPlugin := &mockOutput{release: make(chan struct{})}
+	defer close(slowPlugin.release)
+	fastPlugin := &mockOutput{}
+
+	slow := &Output{Name: "slow", Output: slowPlugin, QueueSize: 2}
+	fast := &Output{Name: "fast", Output: fastPlugin, QueueSize: 2}
+	for _, o := range []*Output{slow, fast} {
+		if err := o.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the dispatcher writes every alarm to both outputs
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			a := &Alarm{Fingerprint: fmt.Sprint(i)}
+			slow.Write(a)
+			fast.Write(a)
+			// let the fast output keep up
+			waitFor(t, time.Second, func() bool { return fastPlugin.written() == i+1 })
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("dispatcher blocked by the slow output")
+	}
+	if n := fastPlugin.written(); n != 10 {
+		t.Errorf("fast output wrote %d alarms, want 10", n)
+	}
+	// the slow output holds one alarm in its write and two in its queue,
+	// one more is dropped if its write started after the third alarm
+	if n := slow.Dropped(); n != 7 && n != 8 {
+		t.Errorf("slow output dropped %d alarms, want 7 or 8", n)
+	}
+	if n := fast.Dropped(); n != 0 {
+		t.Errorf("fast output dropped %d alarms", n)
+	}
+}
+
+func TestBlockPolicy(t *testing.T) {
+	plugin := &mockOutput{release: make(chan struct{})}
+	o := &Output{Name: "block", Output: plugin, QueueSize: 1, Block: true}
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			o.Write(&Alarm{Fingerprint: fmt.Sprint(i)})
+		}
+		close(done)
+	}()
+
+	// one alarm in the write, one in the queue, the third waits
+	select {
+	case <-done:
+		t.Fatal("write to the full queue didn't block")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(plugin.release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("write still blocked once the output caught up")
+	}
+	waitFor(t, time.Second, func() bool { return plugin.written() == 3 })
+	if n := o.Dropped(); n != 0 {
+		t.Errorf("%d alarms dropped with the block policy", n)
+	}
+}
@@ -37,14 +37,31 @@ func process(m *nats.Msg) {
 
 	if alert.NowCount[a.Level]+1 >= alert.Count[a.Level] {
 		log.Println(alert.Count[a.Level])
-		output := Conf.Outputs[alert.AlarmOutput[a.Level]]
-		// 报警
-		for _, u := range group.Users {
-			data := &Alarm{
-				Data: m.Data,
-				User: u.Info[alert.AlarmOutput[a.Level]],
+		name := alert.AlarmOutput[a.Level]
+		output := Conf.Outputs[name]
+		route := Conf.Routes[name]
+		fp := dedup.fingerprint(m.Data)
+		acked := acks.fire(fp, m.Data)
+		if silences.silenced(m.Data) {
+			log.Printf("alarm %s silenced, dropped\n", fp)
+		} else if acked {
+			log.Printf("alarm %s acknowledged, not sent: %s\n", fp, m.Data)
+		} else if dedup.duplicate(fp) {
+			log.Printf("alarm %s already sent, dropped\n", fp)
+		} else {
+			// 报警
+			for _, u := range group.Users {
+				if route != nil {
+					route.Write(m.Data, u, fp)
+					continue
+				}
+				data := &Alarm{
+					Data:        m.Data,
+					User:        u.Info[name],
+					Fingerprint: fp,
+				}
+				output.Write(data)
 			}
-			output.Write(data)
 		}
 		//清空当前count
 		alert.NowCount[a.Level] = 0
@@ -36,6 +36,10 @@ func easyjson_5c87105d_decode_github_com_corego_vgo_vgo_alarm_service_AlertData(
 			out.GroupID = string(in.String())
 		case "v":
 			out.Value = float64(in.Float64())
+		case "l":
+			out.Level = int(in.Int())
+		case "h":
+			out.HostName = string(in.String())
 		default:
 			in.SkipRecursive()
 		}
@@ -65,6 +69,18 @@ func easyjson_5c87105d_encode_github_com_corego_vgo_vgo_alarm_service_AlertData(
 	first = false
 	out.RawString("\"v\":")
 	out.Float64(float64(in.Value))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"l\":")
+	out.Int(int(in.Level))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"h\":")
+	out.String(string(in.HostName))
 	out.RawByte('}')
 }
 func (v AlertData) MarshalJSON() ([]byte, error) {
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/corego/vgo/mecury/misc"
+)
+
+const (
+	// broadcast writes the alarms to all the outputs of the route
+	broadcast = "broadcast"
+	// failover writes the alarms to the first output, then to the next one
+	// only when the previous write failed
+	failover = "failover"
+)
+
+// Route sends the alarms to several outputs, it's named by the alerts like
+// an output. In broadcast mode the alarms are queued to every output. In
+// failover mode they're written to the outputs in order, the next output is
+// only tried when the write fails or doesn't return within Timeout, e.g.
+// PagerDuty then SMS. The failover writes bypass the queues of the outputs
+// and have their own queue, so they never block the dispatcher.
+type Route struct {
+	Name string
+	// Mode is "broadcast" or "failover"
+	Mode string
+	// Outputs are the names of the outputs, in the failover order
+	Outputs []string
+	// Timeout of a write in failover mode
+	Timeout misc.Duration
+	// QueueSize is the number of alarms waiting for the failover writes
+	QueueSize int
+
+	outputs []*Output
+	queue   chan *routeAlarm
+	dropped int64
+}
+
+// routeAlarm is an alarm of a user waiting for the failover writes, the
+// alarm of each output is addressed to the user info of the output.
+type routeAlarm struct {
+	data        []byte
+	user        *User
+	fingerprint string
+}
+
+// init checks the route and resolves its outputs.
+func (r *Route) init(outputs map[string]*Output) error {
+	switch r.Mode {
+	case "":
+		r.Mode = broadcast
+	case broadcast, failover:
+	default:
+		return fmt.Errorf("route %s: invalid mode %s, can be: \"%s\", \"%s\"", r.Name, r.Mode, broadcast, failover)
+	}
+
+	if len(r.Outputs) == 0 {
+		return fmt.Errorf("route %s: no outputs", r.Name)
+	}
+	if _, ok := outputs[r.Name]; ok {
+		return fmt.Errorf("route %s: an output has the same name", r.Name)
+	}
+	for _, name := range r.Outputs {
+		o, ok := outputs[name]
+		if !ok {
+			return fmt.Errorf("route %s: unknown output %s", r.Name, name)
+		}
+		r.outputs = append(r.outputs, o)
+	}
+
+	if r.Timeout.Duration <= 0 {
+		return fmt.Errorf("route %s: timeout must be positive", r.Name)
+	}
+	if r.QueueSize < 0 {
+		return fmt.Errorf("route %s: invalid queue_size %d", r.Name, r.QueueSize)
+	}
+	return nil
+}
+
+// Start starts the failover writes of the queued alarms.
+func (r *Route) Start() {
+	if r.Mode != failover {
+		return
+	}
+
+	r.queue = make(chan *routeAlarm, r.QueueSize)
+	go func() {
+		for a := range r.queue {
+			r.failover(a)
+		}
+	}()
+}
+
+// Write sends the alarm of the user to the outputs of the route. In
+// failover mode the alarm is dropped when the queue of the route is full.
+func (r *Route) Write(data []byte, user *User, fingerprint string) {
+	if r.Mode == broadcast {
+		for _, o := range r.outputs {
+			o.Write(&Alarm{
+				Data:        data,
+				User:        user.Info[o.Name],
+				Fingerprint: fingerprint,
+			})
+		}
+		return
+	}
+
+	select {
+	case r.queue <- &routeAlarm{data: data, user: user, fingerprint: fingerprint}:
+	default:
+		n := atomic.AddInt64(&r.dropped, 1)
+		log.Printf("route %s queue is full, alarm %s dropped, %d dropped so far\n", r.Name, fingerprint, n)
+	}
+}
+
+// failover writes the alarm to the outputs in order until a write succeeds.
+// When they all fail the alarm is spooled by the first output having a
+// spool, to be retried later.
+func (r *Route) failover(ra *routeAlarm) {
+	for _, o := range r.outputs {
+		a := &Alarm{
+			Data:        ra.data,
+			User:        ra.user.Info[o.Name],
+			Fingerprint: ra.fingerprint,
+		}
+		err := o.writeTimeout(a, r.Timeout.Duration)
+		if err == nil {
+			return
+		}
+		log.Printf("route %s output %s write failed, err message is %v\n", r.Name, o.Name, err)
+	}
+
+	for _, o := range r.outputs {
+		if o.spool == nil {
+			continue
+		}
+		a := &Alarm{
+			Data:        ra.data,
+			User:        ra.user.Info[o.Name],
+			Fingerprint: ra.fingerprint,
+		}
+		if err := o.spool.append(a); err != nil {
+			log.Printf("route %s spool of %s failed, err message is %v\n", r.Name, o.Name, err)
+			continue
+		}
+		return
+	}
+	log.Printf("route %s all the outputs failed, alarm %s lost\n", r.Name, ra.fingerprint)
+}
+
+// Dropped returns the number of alarms dropped by the full queue.
+func (r *Route) Dropped() int64 {
+	return atomic.LoadInt64(&r.dropped)
+}
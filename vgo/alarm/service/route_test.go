@@ -0,0 +1,202 @@
+package service
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/mecury/misc"
+)
+
+// newRoute returns the started route of the outputs, the outputs are
+// started too.
+func newRoute(t *testing.T, mode string, outputs ...*Output) *Route {
+	byName := make(map[string]*Output)
+	r := &Route{Name: "route", Mode: mode, Timeout: misc.Duration{Duration: 100 * time.Millisecond}, QueueSize: 10}
+	for _, o := range outputs {
+		byName[o.Name] = o
+		r.Outputs = append(r.Outputs, o.Name)
+		if o.QueueSize == 0 {
+			o.QueueSize = 10
+		}
+		if err := o.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.init(byName); err != nil {
+		t.Fatal(err)
+	}
+	r.Start()
+	return r
+}
+
+// user has an address on each output, named after it.
+var user = &User{Name: "ops", Info: map[string]string{
+	"pagerduty": "ops-service",
+	"sms":       "+33600000000",
+	"email":     "ops@example.com",
+}}
+
+func TestBroadcast(t *testing.T) {
+	pagerduty := &flakyOutput{}
+	pagerduty.setFail(true)
+	sms, email := &mockOutput{}, &mockOutput{}
+	r := newRoute(t, broadcast,
+		&Output{Name: "pagerduty", Output: pagerduty},
+		&Output{Name: "sms", Output: sms},
+		&Output{Name: "email", Output: email},
+	)
+
+	r.Write([]byte("disk full"), user, "fp1")
+
+	// every output gets the alarm, whatever the others do
+	waitFor(t, time.Second, func() bool { return sms.written() == 1 && email.written() == 1 })
+	for name, o := range map[string]*mockOutput{"sms": sms, "email": email} {
+		a := o.alarms[0]
+		if string(a.Data) != "disk full" || a.Fingerprint != "fp1" || a.User != user.Info[name] {
+			t.Errorf("%s got alarm %+v", name, a)
+		}
+	}
+	if n := pagerduty.written(); n != 0 {
+		t.Errorf("failing output wrote %d alarms", n)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	pagerduty, sms := &flakyOutput{}, &mockOutput{}
+	r := newRoute(t, failover,
+		&Output{Name: "pagerduty", Output: pagerduty},
+		&Output{Name: "sms", Output: sms},
+	)
+
+	// the first output succeeds, the next one isn't tried
+	r.Write([]byte("disk full"), user, "fp1")
+	waitFor(t, time.Second, func() bool { return pagerduty.written() == 1 })
+	if a := pagerduty.alarms[0]; a.User != "ops-service" || a.Fingerprint != "fp1" {
+		t.Errorf("pagerduty got alarm %+v", a)
+	}
+
+	// it fails, the alarm goes to the next one
+	pagerduty.setFail(true)
+	r.Write([]byte("disk full"), user, "fp2")
+	waitFor(t, time.Second, func() bool { return sms.written() == 1 })
+	if a := sms.alarms[0]; a.User != "+33600000000" || a.Fingerprint != "fp2" {
+		t.Errorf("sms got alarm %+v", a)
+	}
+
+	// back, the first output is tried first again
+	pagerduty.setFail(false)
+	r.Write([]byte("disk full"), user, "fp3")
+	waitFor(t, time.Second, func() bool { return pagerduty.written() == 2 })
+	time.Sleep(50 * time.Millisecond)
+	if n := sms.written(); n != 1 {
+		t.Errorf("sms wrote %d alarms, want only the one pagerduty failed", n)
+	}
+}
+
+func TestFailoverMidChain(t *testing.T) {
+	pagerduty, sms := &flakyOutput{}, &flakyOutput{}
+	email := &mockOutput{}
+	pagerduty.setFail(true)
+	sms.setFail(true)
+	r := newRoute(t, failover,
+		&Output{Name: "pagerduty", Output: pagerduty},
+		&Output{Name: "sms", Output: sms},
+		&Output{Name: "email", Output: email},
+	)
+
+	r.Write([]byte("disk full"), user, "fp1")
+	waitFor(t, time.Second, func() bool { return email.written() == 1 })
+	if a := email.alarms[0]; a.User != "ops@example.com" {
+		t.Errorf("email got alarm %+v", a)
+	}
+
+	// the second output recovers, the chain stops at it
+	sms.setFail(false)
+	r.Write([]byte("disk full"), user, "fp2")
+	waitFor(t, time.Second, func() bool { return sms.written() == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if n := email.written(); n != 1 {
+		t.Errorf("email wrote %d alarms, want 1", n)
+	}
+}
+
+func TestFailoverTimeout(t *testing.T) {
+	// the hung output never answers in time
+	hung := &mockOutput{release: make(chan struct{})}
+	defer close(hung.release)
+	sms := &mockOutput{}
+	r := newRoute(t, failover,
+		&Output{Name: "pagerduty", Output: hung},
+		&Output{Name: "sms", Output: sms},
+	)
+
+	start := time.Now()
+	r.Write([]byte("disk full"), user, "fp1")
+	waitFor(t, time.Second, func() bool { return sms.written() == 1 })
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("next output tried after %s, before the 100ms timeout", elapsed)
+	}
+}
+
+func TestFailoverSpooled(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "sms.spool")
+
+	pagerduty, sms := &flakyOutput{}, &flakyOutput{}
+	pagerduty.setFail(true)
+	sms.setFail(true)
+	smsOutput := &Output{Name: "sms", Output: sms}
+	r := newRoute(t, failover, &Output{Name: "pagerduty", Output: pagerduty}, smsOutput)
+	// the first output having a spool keeps the alarm
+	smsOutput.spool = newSpool(path, time.Hour)
+
+	r.Write([]byte("disk full"), user, "fp1")
+	var entries []*spoolEntry
+	waitFor(t, time.Second, func() bool {
+		entries, _ = readSpool(path)
+		return len(entries) == 1
+	})
+	if e := entries[0]; string(e.Data) != "disk full" || e.User != "+33600000000" || e.Fingerprint != "fp1" {
+		t.Errorf("got spooled entry %+v", e)
+	}
+}
+
+func TestRouteQueueFull(t *testing.T) {
+	hung := &mockOutput{release: make(chan struct{})}
+	defer close(hung.release)
+	r := newRoute(t, failover, &Output{Name: "pagerduty", Output: hung})
+
+	// one alarm in the failover writes, ten in the queue
+	for i := 0; i < 15; i++ {
+		r.Write([]byte("disk full"), user, fmt.Sprint(i))
+	}
+	if n := r.Dropped(); n != 4 && n != 5 {
+		t.Errorf("%d alarms dropped, want 4 or 5", n)
+	}
+}
+
+func TestRouteInvalid(t *testing.T) {
+	outputs := map[string]*Output{"sms": {Name: "sms"}}
+	timeout := misc.Duration{Duration: time.Second}
+	for _, r := range []*Route{
+		{Name: "r", Mode: "random", Outputs: []string{"sms"}, Timeout: timeout},
+		{Name: "r", Timeout: timeout},
+		{Name: "r", Outputs: []string{"sms", "pagerduty"}, Timeout: timeout},
+		{Name: "sms", Outputs: []string{"sms"}, Timeout: timeout},
+		{Name: "r", Outputs: []string{"sms"}},
+		{Name: "r", Outputs: []string{"sms"}, Timeout: timeout, QueueSize: -1},
+	} {
+		if err := r.init(outputs); err == nil {
+			t.Errorf("invalid route %+v accepted", r)
+		}
+	}
+
+	// broadcast by default
+	r := &Route{Name: "r", Outputs: []string{"sms"}, Timeout: timeout}
+	if err := r.init(outputs); err != nil || r.Mode != broadcast {
+		t.Errorf("got mode %q and error %v, want broadcast", r.Mode, err)
+	}
+}
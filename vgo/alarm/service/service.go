@@ -2,6 +2,7 @@ package service
 
 import (
 	"fmt"
+	"log"
 
 	"github.com/corego/vgo/common/vlog"
 	"github.com/uber-go/zap"
@@ -19,19 +20,45 @@ func NewService() *Service {
 func (a *Service) Start() {
 	LoadConfig()
 	// init log logger
-	vlog.Init(Conf.Common.LogPath, Conf.Common.LogLevel, Conf.Common.IsDebug)
+	outputs := Conf.Common.LogOutputs
+	if len(outputs) == 0 {
+		outputs = []string{Conf.Common.LogPath}
+		if Conf.Common.IsDebug {
+			outputs = []string{"stdout"}
+		}
+	}
+	err := vlog.InitWithOptions(vlog.Options{
+		Level:    Conf.Common.LogLevel,
+		Encoding: Conf.Common.LogEncoding,
+		Outputs:  outputs,
+	})
+	if err != nil {
+		log.Fatalln("[FATAL] init logger: ", err)
+	}
 	vLogger = vlog.Logger
 
 	vLogger.Info(fmt.Sprintf("config: %v", Conf))
 
-	// init input
-	input := &input{}
-	input.Start()
+	dedup = newDeduper(Conf.Dedup.Window.Duration, Conf.Dedup.FingerprintFields)
+	acks = newAcker(Conf.Control.ResolveTimeout.Duration)
+
+	if Conf.Control.Addr != "" {
+		startControl(Conf.Control.Addr)
+	}
 
-	// init output
+	// init output, before the input: the first alarms go to their queues
 	for _, o := range Conf.Outputs {
-		o.Output.Start()
+		if err := o.Start(); err != nil {
+			vLogger.Fatal("output start", zap.String("name", o.Name), zap.Error(err))
+		}
+	}
+	for _, r := range Conf.Routes {
+		r.Start()
 	}
 
+	// init input
+	input := &input{}
+	input.Start()
+
 	startManager()
 }
@@ -0,0 +1,233 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corego/vgo/mecury/misc"
+)
+
+// silenceGCInterval is the interval the expired silences are removed at
+const silenceGCInterval = time.Minute
+
+var silences = newSilencer()
+
+// Silence drops the alarms matching all its matchers between StartsAt and
+// EndsAt. A matcher is a field of the alarm data, nested with dots, and the
+// value it must have: {"h": "web01", "gid": "scc@Google"}.
+type Silence struct {
+	ID       string            `json:"id"`
+	Matchers map[string]string `json:"matchers"`
+	StartsAt time.Time         `json:"starts_at"`
+	EndsAt   time.Time         `json:"ends_at"`
+	Comment  string            `json:"comment,omitempty"`
+}
+
+func (s *Silence) active(now time.Time) bool {
+	return !now.Before(s.StartsAt) && now.Before(s.EndsAt)
+}
+
+// match reports whether the alarm data has all the matchers values.
+func (s *Silence) match(obj map[string]interface{}) bool {
+	for k, want := range s.Matchers {
+		v, ok := lookup(obj, strings.Split(k, "."))
+		if !ok || fmt.Sprint(v) != want {
+			return false
+		}
+	}
+	return true
+}
+
+type silencer struct {
+	sync.RWMutex
+	silences map[string]*Silence
+}
+
+func newSilencer() *silencer {
+	return &silencer{
+		silences: make(map[string]*Silence),
+	}
+}
+
+// Add registers the silence, the ID is generated when empty.
+func (sr *silencer) Add(s *Silence) error {
+	if len(s.Matchers) == 0 {
+		return errors.New("silence without matchers")
+	}
+	if !s.EndsAt.After(s.StartsAt) {
+		return errors.New("silence ends before it starts")
+	}
+	if s.ID == "" {
+		s.ID = misc.RandomString(16)
+	}
+
+	sr.Lock()
+	sr.silences[s.ID] = s
+	sr.Unlock()
+	return nil
+}
+
+// Remove removes the silence, it returns false when there is no such silence.
+func (sr *silencer) Remove(id string) bool {
+	sr.Lock()
+	defer sr.Unlock()
+
+	_, ok := sr.silences[id]
+	delete(sr.silences, id)
+	return ok
+}
+
+// List returns the silences sorted by start time.
+func (sr *silencer) List() []*Silence {
+	sr.RLock()
+	list := make([]*Silence, 0, len(sr.silences))
+	for _, s := range sr.silences {
+		list = append(list, s)
+	}
+	sr.RUnlock()
+
+	sort.Sort(byStart(list))
+	return list
+}
+
+// silenced reports whether an active silence matches the alarm data, the
+// data which isn't a JSON object can't be silenced.
+func (sr *silencer) silenced(data []byte) bool {
+	sr.RLock()
+	defer sr.RUnlock()
+
+	if len(sr.silences) == 0 {
+		return false
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return false
+	}
+
+	now := time.Now()
+	for _, s := range sr.silences {
+		if s.active(now) && s.match(obj) {
+			return true
+		}
+	}
+	return false
+}
+
+// gc removes the expired silences.
+func (sr *silencer) gc() {
+	ticker := time.NewTicker(silenceGCInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		sr.Lock()
+		for id, s := range sr.silences {
+			if !now.Before(s.EndsAt) {
+				delete(sr.silences, id)
+			}
+		}
+		sr.Unlock()
+	}
+}
+
+type byStart []*Silence
+
+func (b byStart) Len() int           { return len(b) }
+func (b byStart) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byStart) Less(i, j int) bool { return b[i].StartsAt.Before(b[j].StartsAt) }
+
+// silenceRequest is the body of a silence creation, the silence either has
+// an end time or lasts a duration ("2h") from its start, which defaults to now.
+type silenceRequest struct {
+	Matchers map[string]string `json:"matchers"`
+	StartsAt time.Time         `json:"starts_at"`
+	EndsAt   time.Time         `json:"ends_at"`
+	Duration string            `json:"duration"`
+	Comment  string            `json:"comment"`
+}
+
+// startControl serves the control endpoint:
+//   GET    /silences                  list the silences
+//   POST   /silences                  add a silence
+//   DELETE /silences?id=<id>          remove a silence
+//   GET    /alarms                    list the active alarms and their acks
+//   POST   /acks                      ack an active alarm
+//   DELETE /acks?fingerprint=<fp>     remove the ack of an alarm
+func startControl(addr string) {
+	go silences.gc()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/silences", silencesHandler)
+	mux.HandleFunc("/alarms", alarmsHandler)
+	mux.HandleFunc("/acks", acksHandler)
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatal("[FATAL] control listen: ", err)
+		}
+	}()
+}
+
+func silencesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, silences.List())
+
+	case "POST":
+		req := &silenceRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s := &Silence{
+			Matchers: req.Matchers,
+			StartsAt: req.StartsAt,
+			EndsAt:   req.EndsAt,
+			Comment:  req.Comment,
+		}
+		if s.StartsAt.IsZero() {
+			s.StartsAt = time.Now()
+		}
+		if req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s.EndsAt = s.StartsAt.Add(d)
+		}
+
+		if err := silences.Add(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("silence %s added, matchers %v until %v\n", s.ID, s.Matchers, s.EndsAt)
+		writeJSON(w, http.StatusCreated, s)
+
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		if !silences.Remove(id) {
+			http.Error(w, "no silence found", http.StatusNotFound)
+			return
+		}
+		log.Printf("silence %s removed\n", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
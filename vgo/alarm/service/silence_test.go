@@ -0,0 +1,163 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSilenceMatch(t *testing.T) {
+	s := &Silence{Matchers: map[string]string{"h": "web01", "labels.env": "prod", "l": "1"}}
+
+	for _, tt := range []struct {
+		data  string
+		match bool
+	}{
+		{`{"h":"web01","l":1,"labels":{"env":"prod"}}`, true},
+		{`{"h":"web01","l":1,"labels":{"env":"prod"},"v":3.5}`, true},
+		{`{"h":"web02","l":1,"labels":{"env":"prod"}}`, false},
+		{`{"h":"web01","l":2,"labels":{"env":"prod"}}`, false},
+		{`{"h":"web01","l":1,"labels":{"env":"dev"}}`, false},
+		{`{"h":"web01","l":1}`, false},
+		{`{"h":"web01","l":1,"labels":"prod"}`, false},
+	} {
+		var obj map[string]interface{}
+		if err := json.Unmarshal([]byte(tt.data), &obj); err != nil {
+			t.Fatal(err)
+		}
+		if got := s.match(obj); got != tt.match {
+			t.Errorf("%s, match %v, want %v", tt.data, got, tt.match)
+		}
+	}
+}
+
+func TestSilenceActive(t *testing.T) {
+	now := time.Now()
+	s := &Silence{StartsAt: now, EndsAt: now.Add(time.Hour)}
+	for _, tt := range []struct {
+		at     time.Time
+		active bool
+	}{
+		{now.Add(-time.Second), false},
+		{now, true},
+		{now.Add(30 * time.Minute), true},
+		{now.Add(time.Hour), false},
+	} {
+		if got := s.active(tt.at); got != tt.active {
+			t.Errorf("at %s, active %v, want %v", tt.at.Sub(now), got, tt.active)
+		}
+	}
+}
+
+func TestSilenced(t *testing.T) {
+	now := time.Now()
+	sr := newSilencer()
+	web01 := []byte(`{"h":"web01","gid":"ops"}`)
+	web02 := []byte(`{"h":"web02","gid":"ops"}`)
+
+	if sr.silenced(web01) {
+		t.Fatal("alarm silenced without silence")
+	}
+
+	// two overlapping silences of web01, the group one still silences it
+	// once the host one is removed
+	host := &Silence{Matchers: map[string]string{"h": "web01"}, StartsAt: now.Add(-time.Hour), EndsAt: now.Add(time.Hour)}
+	group := &Silence{Matchers: map[string]string{"gid": "ops"}, StartsAt: now.Add(-time.Minute), EndsAt: now.Add(2 * time.Hour)}
+	// not started yet
+	future := &Silence{Matchers: map[string]string{"h": "web02"}, StartsAt: now.Add(time.Hour), EndsAt: now.Add(2 * time.Hour)}
+	for _, s := range []*Silence{host, future} {
+		if err := sr.Add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !sr.silenced(web01) {
+		t.Error("web01 not silenced")
+	}
+	if sr.silenced(web02) {
+		t.Error("web02 silenced before the silence starts")
+	}
+	if sr.silenced([]byte("disk full")) {
+		t.Error("non JSON alarm silenced")
+	}
+
+	if err := sr.Add(group); err != nil {
+		t.Fatal(err)
+	}
+	if !sr.silenced(web02) {
+		t.Error("web02 not silenced by the group silence")
+	}
+	if !sr.Remove(host.ID) {
+		t.Fatal("silence not removed")
+	}
+	if !sr.silenced(web01) {
+		t.Error("web01 not silenced by the overlapping group silence")
+	}
+	if !sr.Remove(group.ID) {
+		t.Fatal("silence not removed")
+	}
+	if sr.silenced(web01) || sr.silenced(web02) {
+		t.Error("alarms silenced after the silences are removed")
+	}
+	if sr.Remove(group.ID) {
+		t.Error("silence removed twice")
+	}
+}
+
+func TestSilenceAddInvalid(t *testing.T) {
+	now := time.Now()
+	sr := newSilencer()
+	if err := sr.Add(&Silence{StartsAt: now, EndsAt: now.Add(time.Hour)}); err == nil {
+		t.Error("silence without matchers added")
+	}
+	if err := sr.Add(&Silence{Matchers: map[string]string{"h": "a"}, StartsAt: now, EndsAt: now}); err == nil {
+		t.Error("silence ending when it starts added")
+	}
+}
+
+func TestSilencesHandler(t *testing.T) {
+	silences = newSilencer()
+	defer func() { silences = newSilencer() }()
+
+	w := httptest.NewRecorder()
+	silencesHandler(w, httptest.NewRequest("POST", "/silences", strings.NewReader(`{"matchers":{"h":"web01"},"duration":"2h","comment":"upgrade"}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create status %d, %s", w.Code, w.Body)
+	}
+	created := &Silence{}
+	if err := json.Unmarshal(w.Body.Bytes(), created); err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == "" || created.EndsAt.Sub(created.StartsAt) != 2*time.Hour {
+		t.Errorf("bad silence created %+v", created)
+	}
+
+	w = httptest.NewRecorder()
+	silencesHandler(w, httptest.NewRequest("POST", "/silences", strings.NewReader(`{"matchers":{"h":"web01"},"duration":"later"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid duration status %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	silencesHandler(w, httptest.NewRequest("GET", "/silences", nil))
+	var list []*Silence
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != created.ID {
+		t.Errorf("got silences %+v", list)
+	}
+
+	w = httptest.NewRecorder()
+	silencesHandler(w, httptest.NewRequest("DELETE", "/silences?id="+created.ID, nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("delete status %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	silencesHandler(w, httptest.NewRequest("DELETE", "/silences?id="+created.ID, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("second delete status %d", w.Code)
+	}
+}
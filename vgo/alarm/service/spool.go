@@ -0,0 +1,136 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// spool keeps on disk the alarms an output failed to write, until they're
+// written or too old. The file holds one JSON entry per line:
+//
+//   {"time":"2017-03-01T10:00:00Z","data":"<base64>","user":"...","fingerprint":"..."}
+//
+// where time is the first failure of the alarm. A replay moves the file
+// aside to <file>.replay, so the alarms failing meanwhile are appended to a
+// new file; a replay interrupted by a restart is finished by the next one.
+type spool struct {
+	sync.Mutex
+	path   string
+	maxAge time.Duration
+}
+
+type spoolEntry struct {
+	Time        time.Time `json:"time"`
+	Data        []byte    `json:"data"`
+	User        string    `json:"user"`
+	Fingerprint string    `json:"fingerprint"`
+}
+
+func newSpool(path string, maxAge time.Duration) *spool {
+	return &spool{
+		path:   path,
+		maxAge: maxAge,
+	}
+}
+
+// append adds the alarm to the spool file.
+func (s *spool) append(a *Alarm) error {
+	return s.appendEntries([]*spoolEntry{{
+		Time:        time.Now(),
+		Data:        a.Data,
+		User:        a.User,
+		Fingerprint: a.Fingerprint,
+	}})
+}
+
+func (s *spool) appendEntries(entries []*spoolEntry) error {
+	s.Lock()
+	defer s.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// replay writes the spooled alarms, the ones still failing are spooled
+// again and the ones older than maxAge are dropped. It returns the number
+// of alarms written.
+func (s *spool) replay(write func(*Alarm) error) (int, error) {
+	replayPath := s.path + ".replay"
+
+	s.Lock()
+	if _, err := os.Stat(replayPath); os.IsNotExist(err) {
+		if err := os.Rename(s.path, replayPath); err != nil {
+			s.Unlock()
+			if os.IsNotExist(err) {
+				return 0, nil
+			}
+			return 0, err
+		}
+	}
+	s.Unlock()
+
+	entries, err := readSpool(replayPath)
+	if err != nil {
+		return 0, err
+	}
+
+	written := 0
+	var failed []*spoolEntry
+	for _, e := range entries {
+		if time.Since(e.Time) > s.maxAge {
+			log.Printf("spooled alarm %s older than %v, dropped\n", e.Fingerprint, s.maxAge)
+			continue
+		}
+		a := &Alarm{Data: e.Data, User: e.User, Fingerprint: e.Fingerprint}
+		if err := write(a); err != nil {
+			failed = append(failed, e)
+			continue
+		}
+		written++
+	}
+
+	if len(failed) > 0 {
+		if err := s.appendEntries(failed); err != nil {
+			// keep the replay file, the next replay tries again
+			return written, err
+		}
+	}
+	return written, os.Remove(replayPath)
+}
+
+func readSpool(path string) ([]*spoolEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*spoolEntry
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		e := &spoolEntry{}
+		if err := dec.Decode(e); err != nil {
+			// a line cut by a crash ends the spool
+			log.Printf("spool %s corrupted entry, the rest is dropped: %v\n", path, err)
+			break
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyOutput fails the writes while fail is set.
+type flakyOutput struct {
+	mockOutput
+	mu   sync.Mutex
+	fail bool
+}
+
+func (o *flakyOutput) Write(a *Alarm) error {
+	o.mu.Lock()
+	fail := o.fail
+	o.mu.Unlock()
+	if fail {
+		return errors.New("output down")
+	}
+	return o.mockOutput.Write(a)
+}
+
+func (o *flakyOutput) setFail(fail bool) {
+	o.mu.Lock()
+	o.fail = fail
+	o.mu.Unlock()
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestSpoolRecover(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	plugin := &flakyOutput{fail: true}
+	o := &Output{
+		Name:               "flaky",
+		Output:             plugin,
+		QueueSize:          10,
+		SpoolFile:          filepath.Join(dir, "flaky.spool"),
+		SpoolMaxAge:        time.Hour,
+		SpoolRetryInterval: 20 * time.Millisecond,
+	}
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	o.Write(&Alarm{Data: []byte(`{"h":"web01"}`), User: "alice", Fingerprint: "1"})
+	o.Write(&Alarm{Data: []byte(`{"h":"web02"}`), User: "bob", Fingerprint: "2"})
+	waitFor(t, time.Second, func() bool {
+		entries, _ := readSpool(o.SpoolFile)
+		return len(entries) == 2
+	})
+	if plugin.written() != 0 {
+		t.Fatal("alarm written by the failing output")
+	}
+
+	plugin.setFail(false)
+	waitFor(t, time.Second, func() bool { return plugin.written() == 2 })
+
+	plugin.Lock()
+	defer plugin.Unlock()
+	for i, a := range plugin.alarms {
+		if a.Fingerprint != []string{"1", "2"}[i] || a.User != []string{"alice", "bob"}[i] {
+			t.Errorf("replayed alarm %d, %+v", i, a)
+		}
+	}
+	if string(plugin.alarms[0].Data) != `{"h":"web01"}` {
+		t.Errorf("replayed data %s", plugin.alarms[0].Data)
+	}
+}
+
+func TestSpoolReplayAtStart(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "restart.spool")
+
+	// spooled before the restart, the last line was cut by a crash
+	s := newSpool(path, time.Hour)
+	for _, fp := range []string{"1", "2"} {
+		if err := s.append(&Alarm{Data: []byte("disk full"), Fingerprint: fp}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.appendEntries([]*spoolEntry{{Time: time.Now().Add(-2 * time.Hour), Fingerprint: "old"}}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2017-03-01T10:00:00Z","da`)
+	f.Close()
+
+	plugin := &flakyOutput{}
+	o := &Output{Name: "restart", Output: plugin, QueueSize: 10, SpoolFile: path, SpoolMaxAge: time.Hour, SpoolRetryInterval: time.Hour}
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the alarm older than the max age is dropped
+	waitFor(t, time.Second, func() bool { return plugin.written() == 2 })
+	waitFor(t, time.Second, func() bool {
+		_, err1 := os.Stat(path)
+		_, err2 := os.Stat(path + ".replay")
+		return os.IsNotExist(err1) && os.IsNotExist(err2)
+	})
+}
+
+func TestSpoolReplayFailing(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	s := newSpool(filepath.Join(dir, "failing.spool"), time.Hour)
+
+	for _, fp := range []string{"1", "2", "3"} {
+		if err := s.append(&Alarm{Fingerprint: fp}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the second alarm still fails, it's spooled again
+	n, err := s.replay(func(a *Alarm) error {
+		if a.Fingerprint == "2" {
+			return errors.New("output down")
+		}
+		// appended while the replay runs
+		return s.append(&Alarm{Fingerprint: "new" + a.Fingerprint})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("%d alarms written, want 2", n)
+	}
+
+	entries, err := readSpool(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fps []string
+	for _, e := range entries {
+		fps = append(fps, e.Fingerprint)
+	}
+	if len(fps) != 3 || fps[0] != "new1" || fps[1] != "new3" || fps[2] != "2" {
+		t.Errorf("got spool %v, want [new1 new3 2]", fps)
+	}
+}
@@ -24,6 +24,9 @@ import (
 	_ "github.com/corego/vgo/vgo/stream/plugins/input/all"
 	_ "github.com/corego/vgo/vgo/stream/plugins/metric_output/all"
 	_ "github.com/corego/vgo/vgo/stream/plugins/output/all"
+	_ "github.com/corego/vgo/vgo/stream/plugins/parser/all"
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/all"
+	_ "github.com/corego/vgo/vgo/stream/plugins/serializer/all"
 	"github.com/corego/vgo/vgo/stream/service"
 	"github.com/spf13/cobra"
 )
@@ -72,9 +75,21 @@ func start(cmd *cobra.Command, args []string) {
 	go s.Start(shutdown)
 	// waiting stop signal
 	chSig := make(chan os.Signal)
-	signal.Notify(chSig, syscall.SIGINT, syscall.SIGTERM)
-	fmt.Println("service received Signal: ", <-chSig)
+	signal.Notify(chSig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range chSig {
+		// SIGHUP reloads the plugins config
+		if sig == syscall.SIGHUP {
+			if err := s.Reload(); err != nil {
+				fmt.Println("service reload failed: ", err)
+			}
+			continue
+		}
+		fmt.Println("service received Signal: ", sig)
+		break
+	}
 
 	fmt.Println("service is going to stop")
-	s.Close()
+	if err := s.Close(); err != nil {
+		fmt.Println(err)
+	}
 }
@@ -67,6 +67,8 @@ func RandomString(n int) string {
 // GetTLSConfig gets a tls.Config object from the given certs, key, and CA files.
 // you must give the full path to the files.
 // If all files are blank and InsecureSkipVerify=false, returns a nil pointer.
+// The client certificate and key are presented for the mutual TLS, they must
+// be given together.
 func GetTLSConfig(
 	SSLCert, SSLKey, SSLCA string,
 	InsecureSkipVerify bool,
@@ -74,6 +76,9 @@ func GetTLSConfig(
 	if SSLCert == "" && SSLKey == "" && SSLCA == "" && !InsecureSkipVerify {
 		return nil, nil
 	}
+	if (SSLCert == "") != (SSLKey == "") {
+		return nil, errors.New("TLS client certificate and key must be set together")
+	}
 
 	t := &tls.Config{
 		InsecureSkipVerify: InsecureSkipVerify,
@@ -1,5 +1,14 @@
 package all
 
 import (
+	_ "github.com/corego/vgo/vgo/stream/plugins/input/amqp_consumer"
+	_ "github.com/corego/vgo/vgo/stream/plugins/input/influxdb_listener"
+	_ "github.com/corego/vgo/vgo/stream/plugins/input/influxdb_query"
+	_ "github.com/corego/vgo/vgo/stream/plugins/input/kafka_consumer"
+	_ "github.com/corego/vgo/vgo/stream/plugins/input/mqtt_consumer"
 	_ "github.com/corego/vgo/vgo/stream/plugins/input/nats"
+	_ "github.com/corego/vgo/vgo/stream/plugins/input/prometheus"
+	_ "github.com/corego/vgo/vgo/stream/plugins/input/snmp"
+	_ "github.com/corego/vgo/vgo/stream/plugins/input/statsd"
+	_ "github.com/corego/vgo/vgo/stream/plugins/input/tail"
 )
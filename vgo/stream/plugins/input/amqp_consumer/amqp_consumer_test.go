@@ -0,0 +1,113 @@
+package amqp_consumer
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/plugins/parser/influx"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/corego/vgo/vgo/stream/service/servicetest"
+	"github.com/streadway/amqp"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+// acknowledger records the acks and rejects of the deliveries
+type acknowledger struct {
+	sync.Mutex
+	acks    []uint64
+	rejects []uint64
+	requeue []bool
+}
+
+func (a *acknowledger) Ack(tag uint64, multiple bool) error {
+	a.Lock()
+	defer a.Unlock()
+	a.acks = append(a.acks, tag)
+	return nil
+}
+
+func (a *acknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	return a.Reject(tag, requeue)
+}
+
+func (a *acknowledger) Reject(tag uint64, requeue bool) error {
+	a.Lock()
+	defer a.Unlock()
+	a.rejects = append(a.rejects, tag)
+	a.requeue = append(a.requeue, requeue)
+	return nil
+}
+
+func newConsumer(policy string) *AMQPConsumer {
+	a := &AMQPConsumer{Queue: "vgo", ParseErrorPolicy: policy}
+	a.SetParser(&influx.InfluxParser{})
+	return a
+}
+
+func TestAckAfterEnqueue(t *testing.T) {
+	r := &servicetest.Recorder{}
+	stop := servicetest.StartPipeline(r)
+	defer stop()
+	ack := &acknowledger{}
+	a := newConsumer("dead_letter")
+
+	a.onDelivery(amqp.Delivery{
+		Acknowledger: ack,
+		DeliveryTag:  1,
+		Body:         []byte("cpu,host=a usage=10 1500000000000000000\ncpu,host=b usage=20 1500000000000000000\n"),
+	})
+	if len(ack.acks) != 1 || ack.acks[0] != 1 || len(ack.rejects) != 0 {
+		t.Fatalf("got acks %v and rejects %v, want the delivery acked", ack.acks, ack.rejects)
+	}
+
+	// acked once in the ring, the metrics reach the outputs
+	got := r.Wait(2)
+	if len(got) != 2 {
+		t.Fatalf("%d metrics written, want 2", len(got))
+	}
+	if got[0].Name != "cpu" || got[0].Tags["host"] != "a" || got[1].Tags["host"] != "b" {
+		t.Errorf("got metrics %v", got)
+	}
+
+	// an empty message is acked too
+	a.onDelivery(amqp.Delivery{Acknowledger: ack, DeliveryTag: 2})
+	if len(ack.acks) != 2 || ack.acks[1] != 2 {
+		t.Errorf("got acks %v, want the empty delivery acked", ack.acks)
+	}
+}
+
+func TestParseErrorPolicy(t *testing.T) {
+	r := &servicetest.Recorder{}
+	stop := servicetest.StartPipeline(r)
+	defer stop()
+
+	for _, tt := range []struct {
+		policy  string
+		requeue bool
+	}{
+		{"requeue", true},
+		{"dead_letter", false},
+	} {
+		ack := &acknowledger{}
+		a := newConsumer(tt.policy)
+		a.onDelivery(amqp.Delivery{Acknowledger: ack, DeliveryTag: 7, Body: []byte("cpu,host=a usage=\n")})
+
+		if len(ack.acks) != 0 {
+			t.Errorf("%s: delivery failing to parse acked", tt.policy)
+		}
+		if len(ack.rejects) != 1 || ack.rejects[0] != 7 || ack.requeue[0] != tt.requeue {
+			t.Errorf("%s: got rejects %v requeue %v, want 7 requeue %v", tt.policy, ack.rejects, ack.requeue, tt.requeue)
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if got := r.Received(); len(got) != 0 {
+		t.Errorf("got metrics %v of the rejected deliveries", got)
+	}
+}
@@ -0,0 +1,280 @@
+package influxdb_listener
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	mmisc "github.com/corego/vgo/mecury/misc"
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+// InfluxDBListener accepts the writes of the InfluxDB HTTP API, so vgo can
+// stand in for an InfluxDB server. The points are published as they are,
+// with their measurement, tags, fields and times, and every metric output
+// writes them on its own: with several influxdb outputs the writes are
+// replicated to several clusters, and a cluster being down only fills the
+// retry buffer of its output, the writes are still accepted.
+//
+// The points skip the facts and the processors. The db and rp of a write
+// are the DatabaseTag and RetentionPolicyTag tags of its points, for the
+// database_tag and retention_policy_tag of the influxdb outputs.
+type InfluxDBListener struct {
+	ServiceAddress string
+	ReadTimeout    misc.Duration
+	WriteTimeout   misc.Duration
+	// MaxBodySize is the largest body of a write in bytes, the larger ones
+	// are refused with a 413
+	MaxBodySize int64
+	// PreservePrecision gives the points without a time the time of the
+	// request truncated to the precision of the write, as InfluxDB does, so
+	// the replicated points are the ones the source would have stored.
+	// Otherwise they get the time of the request in nanoseconds
+	PreservePrecision bool
+	// DatabaseTag and RetentionPolicyTag are the tags set to the db and rp
+	// parameters of the write, not set when empty
+	DatabaseTag        string
+	RetentionPolicyTag string
+
+	SSLCert string `toml:"ssl_cert"`
+	SSLKey  string `toml:"ssl_key"`
+
+	StopC  chan bool
+	WriteC chan service.Metrics
+
+	stop chan bool
+	// closed is closed once the listener is closed
+	closed   chan bool
+	listener net.Listener
+}
+
+var sampleConfig = `
+  ## Address of the InfluxDB HTTP API: POST /write and GET /ping
+  service_address = ":8186"
+  # read_timeout = "10s"
+  # write_timeout = "10s"
+  ## Largest body of a write, in bytes
+  # max_body_size = 33554432
+  ## Points without a time get the time of the request truncated to the
+  ## precision of the write, like InfluxDB does, instead of nanoseconds.
+  # preserve_precision = false
+  ## Tags of the points set to the db and rp of the write, the influxdb
+  ## outputs with the same database_tag and retention_policy_tag write them
+  ## to it. The points skip the facts and the processors.
+  # database_tag = "database"
+  # retention_policy_tag = "retention_policy"
+
+  ## Serve HTTPS
+  # ssl_cert = "/etc/vgo/cert.pem"
+  # ssl_key = "/etc/vgo/key.pem"
+`
+
+// precisions maps the precision of the write to the one of the parser.
+var precisions = map[string]string{
+	"":   "n",
+	"n":  "n",
+	"ns": "n",
+	"u":  "u",
+	"us": "u",
+	"ms": "ms",
+	"s":  "s",
+	"m":  "m",
+	"h":  "h",
+}
+
+// Init init influxdb_listener
+func (l *InfluxDBListener) Init(stopC chan bool, writeC chan service.Metrics) {
+	l.StopC = stopC
+	l.WriteC = writeC
+	l.stop = make(chan bool)
+	l.closed = make(chan bool)
+}
+
+// Start start influxdb_listener
+func (l *InfluxDBListener) Start() {
+	log.Println("influxdb_listener Start")
+	defer close(l.closed)
+
+	listener, err := net.Listen("tcp", l.ServiceAddress)
+	if err != nil {
+		log.Fatal("[FATAL] influxdb_listener listen failed, err message is ", err)
+	}
+	if l.SSLCert != "" {
+		cert, err := tls.LoadX509KeyPair(l.SSLCert, l.SSLKey)
+		if err != nil {
+			log.Fatal("[FATAL] influxdb_listener ssl config error: ", err)
+		}
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+	l.listener = listener
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/write", l.serveWrite)
+	mux.HandleFunc("/ping", l.servePing)
+	server := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  l.ReadTimeout.Duration,
+		WriteTimeout: l.WriteTimeout.Duration,
+	}
+
+	go func() {
+		err := server.Serve(listener)
+		select {
+		case <-l.stop:
+		case <-l.StopC:
+		default:
+			log.Fatal("[FATAL] influxdb_listener serve failed, err message is ", err)
+		}
+	}()
+
+	select {
+	case <-l.stop:
+	case <-l.StopC:
+	}
+	l.listener.Close()
+}
+
+// Stop stops listening, it returns once the address is released.
+func (l *InfluxDBListener) Stop() {
+	close(l.stop)
+	<-l.closed
+}
+
+func (l *InfluxDBListener) servePing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Influxdb-Version", "1.0.0")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveWrite publishes the points of the body and answers 204 like
+// InfluxDB. A body with invalid lines is answered 400, its valid points
+// are published anyway, as InfluxDB writes them.
+func (l *InfluxDBListener) serveWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	precision, ok := precisions[r.URL.Query().Get("precision")]
+	if !ok {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("invalid precision %s", r.URL.Query().Get("precision")))
+		return
+	}
+
+	body, err := l.readBody(r)
+	if err != nil {
+		if err == errBodyTooLarge {
+			httpError(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// the parser truncates the default time to the precision, so the points
+	// without a time get the zero time, which no timestamp gives, and then
+	// the time of the request
+	points, parseErr := mmisc.ParsePointsWithPrecision(body, time.Time{}, precision)
+	now := time.Now().UTC()
+	if l.PreservePrecision {
+		now = now.Truncate(time.Duration(mmisc.GetPrecisionMultiplier(precision)))
+	}
+
+	if len(points) > 0 {
+		target := l.targetTags(r)
+		metrics := make([]*service.MetricData, 0, len(points))
+		for _, pt := range points {
+			tags := pt.Tags()
+			if tags == nil && len(target) > 0 {
+				tags = make(map[string]string, len(target))
+			}
+			for k, v := range target {
+				tags[k] = v
+			}
+			t := pt.Time()
+			if t.IsZero() {
+				t = now
+			}
+			metrics = append(metrics, &service.MetricData{
+				Name:   pt.Name(),
+				Tags:   tags,
+				Fields: pt.Fields(),
+				Time:   t,
+			})
+		}
+		service.InputStats("influxdb_listener").Gathered(len(metrics))
+		service.Publish(service.Metrics{Data: metrics, Verbatim: true})
+	}
+
+	if parseErr != nil {
+		service.VLogger.Debug("influxdb_listener invalid lines", zap.Error(parseErr))
+		httpError(w, http.StatusBadRequest, parseErr.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// targetTags returns the DatabaseTag and RetentionPolicyTag tags of the
+// db and rp parameters of the write.
+func (l *InfluxDBListener) targetTags(r *http.Request) map[string]string {
+	tags := make(map[string]string, 2)
+	if db := r.URL.Query().Get("db"); l.DatabaseTag != "" && db != "" {
+		tags[l.DatabaseTag] = db
+	}
+	if rp := r.URL.Query().Get("rp"); l.RetentionPolicyTag != "" && rp != "" {
+		tags[l.RetentionPolicyTag] = rp
+	}
+	return tags
+}
+
+var errBodyTooLarge = fmt.Errorf("body too large")
+
+// readBody reads the body, gunzipped when its encoding is gzip, up to
+// MaxBodySize bytes.
+func (l *InfluxDBListener) readBody(r *http.Request) ([]byte, error) {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		body = zr
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(body, l.MaxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > l.MaxBodySize {
+		return nil, errBodyTooLarge
+	}
+	return b, nil
+}
+
+// httpError answers the error in the JSON of InfluxDB.
+func httpError(w http.ResponseWriter, code int, msg string) {
+	b, _ := json.Marshal(map[string]string{"error": msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Influxdb-Error", msg)
+	w.WriteHeader(code)
+	w.Write(append(b, '\n'))
+}
+
+func init() {
+	service.AddInput("influxdb_listener", &InfluxDBListener{
+		ServiceAddress: ":8186",
+		ReadTimeout:    misc.Duration{Duration: 10 * time.Second},
+		WriteTimeout:   misc.Duration{Duration: 10 * time.Second},
+		MaxBodySize:    32 * 1024 * 1024,
+	})
+}
@@ -0,0 +1,220 @@
+package influxdb_listener
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/plugins/metric_output/influxdb"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/corego/vgo/vgo/stream/service/servicetest"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+// target is an InfluxDB cluster recording the lines written to it, it
+// fails the writes when down.
+type target struct {
+	*httptest.Server
+
+	sync.Mutex
+	down  bool
+	dbs   []string
+	lines []string
+}
+
+func newTarget(down bool) *target {
+	t := &target{down: down}
+	t.Server = httptest.NewServer(t)
+	return t
+}
+
+func (t *target) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/query":
+		w.Write([]byte(`{"results":[{}]}`))
+	case "/write":
+		if t.down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		t.Lock()
+		t.dbs = append(t.dbs, r.URL.Query().Get("db"))
+		t.lines = append(t.lines, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+		t.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// received returns the lines written, sorted.
+func (t *target) received() []string {
+	t.Lock()
+	defer t.Unlock()
+	lines := append([]string(nil), t.lines...)
+	sort.Strings(lines)
+	return lines
+}
+
+// replica returns the influxdb output of the target, it writes the points
+// to the database of their write.
+func replica(tg *target) *influxdb.InfluxDB {
+	return &influxdb.InfluxDB{
+		URLs:        []string{tg.URL},
+		Database:    "replica",
+		DatabaseTag: "database",
+		Timeout:     misc.Duration{Duration: 5 * time.Second},
+		// the tag only routes the points
+		ExcludeDatabaseTag: true,
+	}
+}
+
+func newListener() (*InfluxDBListener, *httptest.Server) {
+	l := &InfluxDBListener{MaxBodySize: 1024 * 1024, DatabaseTag: "database"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/write", l.serveWrite)
+	mux.HandleFunc("/ping", l.servePing)
+	return l, httptest.NewServer(mux)
+}
+
+func post(t *testing.T, url, body string) *http.Response {
+	resp, err := http.Post(url, "", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// waitLines waits for the target to have n lines.
+func waitLines(t *testing.T, tg *target, n int) []string {
+	deadline := time.Now().Add(2 * time.Second)
+	for len(tg.received()) < n && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return tg.received()
+}
+
+func TestReplicate(t *testing.T) {
+	a, b := newTarget(false), newTarget(false)
+	defer a.Close()
+	defer b.Close()
+	defer servicetest.StartPipeline(replica(a), replica(b))()
+	_, listener := newListener()
+	defer listener.Close()
+
+	lines := []string{
+		`cpu,host=server01,region=us\ west count=3i,idle=98.5,state="ok",up=true 1500000000000000123`,
+		`disk,path=/var/log used_percent=71.25 1500000000500000000`,
+		`escaped\,measure\ ment,tag\=key=tag\,value field\ key="quoted \"value\"" 1500000001000000000`,
+	}
+	resp := post(t, listener.URL+"/write?db=telegraf", strings.Join(lines, "\n"))
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d, want 204", resp.StatusCode)
+	}
+
+	// the lines are in the order of the encoder, sorted tags and fields
+	want := append([]string(nil), lines...)
+	sort.Strings(want)
+	for name, tg := range map[string]*target{"a": a, "b": b} {
+		got := waitLines(t, tg, len(lines))
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("target %s got lines\n%s\nwant\n%s", name, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+		// the database of the write
+		for _, db := range tg.dbs {
+			if db != "telegraf" {
+				t.Errorf("target %s written to database %s, want telegraf", name, db)
+			}
+		}
+	}
+}
+
+func TestTargetDown(t *testing.T) {
+	down, up := newTarget(true), newTarget(false)
+	defer down.Close()
+	defer up.Close()
+	defer servicetest.StartPipeline(replica(down), replica(up))()
+	_, listener := newListener()
+	defer listener.Close()
+
+	// the ingest doesn't fail with a target down
+	for n := 0; n < 3; n++ {
+		resp := post(t, listener.URL+"/write?db=telegraf", "cpu,host=server01 idle=98.5 150000000000000000"+string('0'+byte(n)))
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("got status %d with a target down, want 204", resp.StatusCode)
+		}
+	}
+	if got := waitLines(t, up, 3); len(got) != 3 {
+		t.Errorf("target up got lines %v, want 3", got)
+	}
+	if got := down.received(); len(got) != 0 {
+		t.Errorf("target down got lines %v", got)
+	}
+}
+
+func TestPreservePrecision(t *testing.T) {
+	for _, preserve := range []bool{false, true} {
+		l := &InfluxDBListener{MaxBodySize: 1024, PreservePrecision: preserve}
+		r := &servicetest.Recorder{}
+		stop := servicetest.StartPipeline(r)
+
+		req := httptest.NewRequest("POST", "/write?db=telegraf&precision=s", strings.NewReader("cpu idle=1\ncpu idle=2 1500000000"))
+		w := httptest.NewRecorder()
+		l.serveWrite(w, req)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("got status %d, want 204", w.Code)
+		}
+
+		r.Wait(2)
+		stop()
+		metrics := r.Received()
+		if len(metrics) != 2 {
+			t.Fatalf("got %d metrics, want 2", len(metrics))
+		}
+		times := []time.Time{metrics[0].Time, metrics[1].Time}
+		// the timestamps are in the precision of the write
+		if !times[1].Equal(time.Unix(1500000000, 0)) {
+			t.Errorf("got time %s, want 1500000000s", times[1])
+		}
+		if truncated := times[0].Nanosecond() == 0; truncated != preserve {
+			t.Errorf("preserve precision %v, got time %s of the point without time", preserve, times[0].Format(time.RFC3339Nano))
+		}
+	}
+}
+
+func TestWriteInvalid(t *testing.T) {
+	l := &InfluxDBListener{MaxBodySize: 16}
+	for _, tt := range []struct {
+		method string
+		url    string
+		body   string
+		code   int
+	}{
+		{"GET", "/write", "", http.StatusMethodNotAllowed},
+		{"POST", "/write?precision=d", "cpu idle=1", http.StatusBadRequest},
+		{"POST", "/write", "cpu idle=1 idle=2 idle=3 idle=4", http.StatusRequestEntityTooLarge},
+	} {
+		req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		l.serveWrite(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s %s, got status %d, want %d", tt.method, tt.url, w.Code, tt.code)
+		}
+		if w.Header().Get("X-Influxdb-Error") == "" {
+			t.Errorf("%s %s, no error header", tt.method, tt.url)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package influxdb_query
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// fluxTable is the header of a table of an annotated CSV answer
+type fluxTable struct {
+	types    []string
+	group    []string
+	defaults []string
+	columns  []string
+}
+
+// parseFlux converts the rows of an annotated CSV answer into metrics. The
+// _field and _value columns give a field, the group key columns not
+// starting with _ are the tags and the other columns not starting with _
+// are fields, as left by a pivot. The rows of the same measurement, tags
+// and time make one metric.
+func parseFlux(r io.Reader) ([]*service.MetricData, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	var metrics []*service.MetricData
+	index := make(map[string]*service.MetricData)
+	var key bytes.Buffer
+
+	table := &fluxTable{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return metrics, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch record[0] {
+		case "#datatype":
+			table = &fluxTable{types: record}
+			continue
+		case "#group":
+			table.group = record
+			continue
+		case "#default":
+			table.defaults = record
+			continue
+		}
+		if table.columns == nil {
+			table.columns = record
+			continue
+		}
+		// a query failing after the answer started ends with an error table
+		if len(record) > 1 && len(table.columns) > 1 && table.columns[1] == "error" {
+			return nil, errors.New(record[1])
+		}
+
+		m, err := table.row(record)
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			continue
+		}
+
+		seriesKey(&key, m)
+		if same, ok := index[key.String()]; ok {
+			for k, v := range m.Fields {
+				same.Fields[k] = v
+			}
+			continue
+		}
+		index[key.String()] = m
+		metrics = append(metrics, m)
+	}
+}
+
+// row converts a row, it returns nil for a row without field.
+func (t *fluxTable) row(record []string) (*service.MetricData, error) {
+	if len(record) != len(t.columns) {
+		return nil, fmt.Errorf("row of %d values for %d columns", len(record), len(t.columns))
+	}
+
+	m := &service.MetricData{
+		Tags:   make(map[string]string),
+		Fields: make(map[string]interface{}),
+	}
+	var field string
+	var value interface{}
+	for i, column := range t.columns {
+		cell := record[i]
+		if cell == "" && i < len(t.defaults) {
+			cell = t.defaults[i]
+		}
+
+		switch column {
+		case "", "result", "table", "_start", "_stop":
+			continue
+		case "_measurement":
+			m.Name = cell
+			continue
+		case "_field":
+			field = cell
+			continue
+		}
+		if cell == "" {
+			continue
+		}
+
+		v, err := t.value(i, cell)
+		if err != nil {
+			return nil, fmt.Errorf("column %s, %s", column, err)
+		}
+		switch {
+		case column == "_time":
+			tm, ok := v.(time.Time)
+			if !ok {
+				return nil, fmt.Errorf("invalid _time %s", cell)
+			}
+			m.Time = tm
+		case column == "_value":
+			value = v
+		case strings.HasPrefix(column, "_"):
+		case i < len(t.group) && t.group[i] == "true":
+			m.Tags[column] = cell
+		default:
+			m.Fields[column] = v
+		}
+	}
+
+	if field != "" && value != nil {
+		m.Fields[field] = value
+	}
+	if m.Name == "" || len(m.Fields) == 0 || m.Time.IsZero() {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// value converts the cell by the datatype of its column.
+func (t *fluxTable) value(i int, cell string) (interface{}, error) {
+	typ := "string"
+	if i < len(t.types) {
+		typ = t.types[i]
+	}
+
+	switch typ {
+	case "long":
+		return strconv.ParseInt(cell, 10, 64)
+	case "unsignedLong":
+		return strconv.ParseUint(cell, 10, 64)
+	case "double":
+		return strconv.ParseFloat(cell, 64)
+	case "boolean":
+		return strconv.ParseBool(cell)
+	case "dateTime:RFC3339", "dateTime:RFC3339Nano":
+		return time.Parse(time.RFC3339Nano, cell)
+	default:
+		return cell, nil
+	}
+}
+
+// seriesKey writes the key of the measurement, tags and time of the metric.
+func seriesKey(b *bytes.Buffer, m *service.MetricData) {
+	b.Reset()
+	m.WriteSeriesKey(b)
+	b.WriteByte(0)
+	b.WriteString(strconv.FormatInt(m.Time.UnixNano(), 10))
+}
@@ -0,0 +1,378 @@
+package influxdb_query
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+// InfluxDBQuery runs queries on an InfluxDB at every interval and publishes
+// the points of their results, to write rollups to another database. Every
+// query reads from its watermark, the time of the last point it read, so a
+// run only reads the new points.
+type InfluxDBQuery struct {
+	URL string `toml:"url"`
+	// Database is the database of the InfluxQL queries
+	Database        string
+	RetentionPolicy string
+	Username        string
+	Password        string
+	// Token authenticates to InfluxDB 2, Organization is the organization
+	// of the Flux queries
+	Token        string
+	Organization string
+
+	Queries []*Query
+
+	Interval misc.Duration
+	Timeout  misc.Duration
+	// Since is how far back the queries read on their first run
+	Since misc.Duration
+	// WatermarkFile keeps the watermarks of the queries across restarts,
+	// the queries read from Since ago at startup without it
+	WatermarkFile string
+
+	SSLCA              string `toml:"ssl_ca"`
+	SSLCert            string `toml:"ssl_cert"`
+	SSLKey             string `toml:"ssl_key"`
+	InsecureSkipVerify bool
+
+	StopC  chan bool
+	WriteC chan service.Metrics
+
+	client *http.Client
+	stop   chan bool
+
+	sync.Mutex
+	// watermarks are the times of the last points read, by query name
+	watermarks map[string]time.Time
+}
+
+// Query is a query run at every interval
+type Query struct {
+	// Name identifies the query in the watermark file
+	Name string
+	// Query is InfluxQL or Flux, $since is replaced by the watermark in
+	// RFC3339: WHERE time > '$since' or range(start: $since)
+	Query string
+	// Language is "influxql" or "flux"
+	Language string
+	// Measurement renames the measurements of the result, left as they
+	// are when empty
+	Measurement string
+}
+
+var sampleConfig = `
+  url = "http://localhost:8086"
+  ## Database of the InfluxQL queries
+  database = "telegraf"
+  # retention_policy = ""
+  # username = ""
+  # password = ""
+  ## InfluxDB 2 token, and organization of the Flux queries
+  # token = ""
+  # organization = ""
+  interval = "1m"
+  # timeout = "30s"
+  ## How far back the queries read on their first run
+  # since = "1h"
+  ## Keep the times of the last points read across restarts
+  # watermark_file = "./influxdb_query.watermark.json"
+
+  ## Optional SSL Config
+  # ssl_ca = "/etc/vgo/ca.pem"
+  # ssl_cert = "/etc/vgo/cert.pem"
+  # ssl_key = "/etc/vgo/key.pem"
+  # insecure_skip_verify = false
+
+  ## $since is replaced by the time of the last point read by the query, in
+  ## RFC3339. The last interval of a GROUP BY time() may still be incomplete,
+  ## end the query an interval before now()
+  [[inputs.influxdb_query.queries]]
+    name = "cpu_5m"
+    language = "influxql"
+    query = "SELECT mean(usage_idle) AS usage_idle FROM cpu WHERE time > '$since' AND time < now() - 5m GROUP BY time(5m), host"
+    measurement = "cpu_5m"
+`
+
+// Init init influxdb_query
+func (q *InfluxDBQuery) Init(stopC chan bool, writeC chan service.Metrics) {
+	q.StopC = stopC
+	q.WriteC = writeC
+	q.stop = make(chan bool)
+}
+
+// Start start influxdb_query
+func (q *InfluxDBQuery) Start() {
+	log.Println("influxdb_query Start")
+	if err := q.check(); err != nil {
+		log.Fatal("[FATAL] influxdb_query ", err)
+	}
+
+	tlsConfig, err := misc.GetTLSConfig(q.SSLCert, q.SSLKey, q.SSLCA, q.InsecureSkipVerify)
+	if err != nil {
+		log.Fatal("[FATAL] influxdb_query ssl config error: ", err)
+	}
+	q.client = &http.Client{
+		Timeout: q.Timeout.Duration,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+
+	q.watermarks, err = loadWatermarks(q.WatermarkFile)
+	if err != nil {
+		log.Fatal("[FATAL] influxdb_query watermark file: ", err)
+	}
+
+	ticker := service.CollectionTicker(q.Interval.Duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			q.gather()
+		case <-q.stop:
+			return
+		case <-q.StopC:
+			return
+		}
+	}
+}
+
+// Stop stops querying
+func (q *InfluxDBQuery) Stop() {
+	close(q.stop)
+}
+
+func (q *InfluxDBQuery) check() error {
+	if q.URL == "" {
+		return errors.New("url is required")
+	}
+	if len(q.Queries) == 0 {
+		return errors.New("queries are required")
+	}
+
+	names := make(map[string]bool, len(q.Queries))
+	for i, query := range q.Queries {
+		if query.Name == "" {
+			query.Name = fmt.Sprintf("query%d", i)
+		}
+		if names[query.Name] {
+			return fmt.Errorf("several queries are named %s", query.Name)
+		}
+		names[query.Name] = true
+
+		if query.Query == "" {
+			return fmt.Errorf("query %s is empty", query.Name)
+		}
+		switch query.Language {
+		case "":
+			query.Language = "influxql"
+		case "influxql":
+		case "flux":
+			if q.Organization == "" {
+				return fmt.Errorf("query %s, organization is required by flux", query.Name)
+			}
+		default:
+			return fmt.Errorf("query %s, invalid language %s, can be: \"influxql\", \"flux\"", query.Name, query.Language)
+		}
+	}
+	return nil
+}
+
+// gather runs the queries one after another and publishes their points,
+// a query failing is logged and runs again from the same watermark.
+func (q *InfluxDBQuery) gather() {
+	var metrics []*service.MetricData
+	advanced := false
+	for _, query := range q.Queries {
+		since := q.watermark(query.Name)
+		points, err := q.run(query, since)
+		if err != nil {
+			service.VLogger.Error("influxdb_query", zap.String("query", query.Name), zap.Error(err))
+			continue
+		}
+		if len(points) == 0 {
+			continue
+		}
+
+		last := since
+		for _, m := range points {
+			if m.Time.After(last) {
+				last = m.Time
+			}
+			if query.Measurement != "" {
+				m.Name = query.Measurement
+			}
+		}
+		metrics = append(metrics, points...)
+		if last.After(since) {
+			q.Lock()
+			q.watermarks[query.Name] = last
+			q.Unlock()
+			advanced = true
+		}
+	}
+
+	if advanced && q.WatermarkFile != "" {
+		if err := q.saveWatermarks(); err != nil {
+			service.VLogger.Error("influxdb_query save watermark file", zap.String("file", q.WatermarkFile), zap.Error(err))
+		}
+	}
+
+	if len(metrics) == 0 {
+		return
+	}
+	service.InputStats("influxdb_query").Gathered(len(metrics))
+	service.Publish(service.Metrics{Data: metrics, Interval: int(q.Interval.Duration / time.Second)})
+}
+
+// watermark returns the time the query reads from, Since ago on its first
+// run.
+func (q *InfluxDBQuery) watermark(name string) time.Time {
+	q.Lock()
+	defer q.Unlock()
+	if t, ok := q.watermarks[name]; ok {
+		return t
+	}
+	return time.Now().Add(-q.Since.Duration)
+}
+
+// run runs the query from since and returns its points.
+func (q *InfluxDBQuery) run(query *Query, since time.Time) ([]*service.MetricData, error) {
+	text := strings.Replace(query.Query, "$since", since.UTC().Format(time.RFC3339Nano), -1)
+
+	var req *http.Request
+	var err error
+	if query.Language == "flux" {
+		req, err = q.fluxRequest(text)
+	} else {
+		req, err = q.influxQLRequest(text)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if q.Token != "" {
+		req.Header.Set("Authorization", "Token "+q.Token)
+	} else if q.Username != "" {
+		req.SetBasicAuth(q.Username, q.Password)
+	}
+
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("status %d, %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+
+	if query.Language == "flux" {
+		return parseFlux(resp.Body)
+	}
+	return parseInfluxQL(resp.Body)
+}
+
+func (q *InfluxDBQuery) influxQLRequest(text string) (*http.Request, error) {
+	params := url.Values{}
+	params.Set("q", text)
+	params.Set("db", q.Database)
+	if q.RetentionPolicy != "" {
+		params.Set("rp", q.RetentionPolicy)
+	}
+	params.Set("epoch", "ns")
+
+	req, err := http.NewRequest("POST", strings.TrimRight(q.URL, "/")+"/query", strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+func (q *InfluxDBQuery) fluxRequest(text string) (*http.Request, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"query": text,
+		"type":  "flux",
+		"dialect": map[string]interface{}{
+			"header":      true,
+			"annotations": []string{"datatype", "group", "default"},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	u := strings.TrimRight(q.URL, "/") + "/api/v2/query?org=" + url.QueryEscape(q.Organization)
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/csv")
+	return req, nil
+}
+
+// loadWatermarks reads the watermark file, a JSON object of the query
+// names to their watermark. A missing file has no watermark.
+func loadWatermarks(path string) (map[string]time.Time, error) {
+	watermarks := make(map[string]time.Time)
+	if path == "" {
+		return watermarks, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return watermarks, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &watermarks); err != nil {
+		return nil, fmt.Errorf("%s, %s", path, err)
+	}
+	return watermarks, nil
+}
+
+// saveWatermarks writes the watermark file through a temporary file, so a
+// crash doesn't leave it truncated.
+func (q *InfluxDBQuery) saveWatermarks() error {
+	q.Lock()
+	b, err := json.Marshal(q.watermarks)
+	q.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := q.WatermarkFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.WatermarkFile)
+}
+
+func init() {
+	service.AddInput("influxdb_query", &InfluxDBQuery{
+		Interval: misc.Duration{Duration: time.Minute},
+		Timeout:  misc.Duration{Duration: 30 * time.Second},
+		Since:    misc.Duration{Duration: time.Hour},
+	})
+}
@@ -0,0 +1,288 @@
+package influxdb_query
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+const influxQLAnswer = `{"results":[{"statement_id":0,"series":[
+{"name":"cpu","tags":{"host":"a","region":""},"columns":["time","usage_idle","count"],"values":[
+  [1500000000000000000,90.5,3],
+  [1500000300000000000,null,null],
+  [1500000600000000000,91,null]]},
+{"name":"cpu","tags":{"host":"b","region":"eu"},"columns":["time","usage_idle","count"],"values":[
+  [1500000000000000000,1e2,4]]}
+]}]}`
+
+// metricString formats the metric with its sorted tags and fields and the
+// types of the fields.
+func metricString(m *service.MetricData) string {
+	return fmt.Sprintf("%s %v %v %d", m.Name, m.Tags, typed(m.Fields), m.Time.Unix())
+}
+
+func typed(fields map[string]interface{}) map[string]string {
+	t := make(map[string]string, len(fields))
+	for k, v := range fields {
+		t[k] = fmt.Sprintf("%T(%v)", v, v)
+	}
+	return t
+}
+
+func metricStrings(metrics []*service.MetricData) []string {
+	var l []string
+	for _, m := range metrics {
+		l = append(l, metricString(m))
+	}
+	return l
+}
+
+func TestParseInfluxQL(t *testing.T) {
+	metrics, err := parseInfluxQL(strings.NewReader(influxQLAnswer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rows of null values are left out, the empty tags too
+	want := []string{
+		"cpu map[host:a] map[count:int64(3) usage_idle:float64(90.5)] 1500000000",
+		"cpu map[host:a] map[usage_idle:int64(91)] 1500000600",
+		"cpu map[host:b region:eu] map[count:int64(4) usage_idle:float64(100)] 1500000000",
+	}
+	if got := metricStrings(metrics); !reflect.DeepEqual(got, want) {
+		t.Errorf("got metrics\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestParseInfluxQLEmptyAndErrors(t *testing.T) {
+	for _, answer := range []string{
+		`{"results":[{"statement_id":0}]}`,
+		`{"results":[]}`,
+	} {
+		metrics, err := parseInfluxQL(strings.NewReader(answer))
+		if err != nil || len(metrics) != 0 {
+			t.Errorf("%s, got %d metrics and error %v, want none", answer, len(metrics), err)
+		}
+	}
+
+	for _, answer := range []string{
+		`{"error":"error parsing query: found EOF"}`,
+		`{"results":[{"statement_id":0,"error":"database not found: telegraf"}]}`,
+		`{"results":[{"series":[{"name":"cpu","columns":["usage_idle"],"values":[[1]]}]}]}`,
+		`{"results":[{"series":[{"name":"cpu","columns":["time","usage_idle"],"values":[["2017-07-14T02:40:00Z",1]]}]}]}`,
+		`{"results":[{"series":[{"name":"cpu","columns":["time","usage_idle"],"values":[[1]]}]}]}`,
+		`<html>`,
+	} {
+		if _, err := parseInfluxQL(strings.NewReader(answer)); err == nil {
+			t.Errorf("%s parsed", answer)
+		}
+	}
+}
+
+const fluxAnswer = `#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,double,string,string,string
+#group,false,false,true,true,false,false,true,true,true
+#default,_result,,,,,,,,
+,result,table,_start,_stop,_time,_value,_field,_measurement,host
+,,0,2017-07-14T00:00:00Z,2017-07-14T03:00:00Z,2017-07-14T02:40:00Z,90.5,usage_idle,cpu,a
+,,0,2017-07-14T00:00:00Z,2017-07-14T03:00:00Z,2017-07-14T02:45:00Z,91,usage_idle,cpu,a
+,,1,2017-07-14T00:00:00Z,2017-07-14T03:00:00Z,2017-07-14T02:40:00Z,5,usage_user,cpu,a
+,,1,2017-07-14T00:00:00Z,2017-07-14T03:00:00Z,2017-07-14T02:40:00Z,,usage_user,cpu,b
+
+#datatype,string,long,dateTime:RFC3339,string,string,long,boolean
+#group,false,false,false,true,true,false,false
+#default,_result,,,,,,
+,result,table,_time,_measurement,host,count,up
+,,2,2017-07-14T02:40:00Z,net,b,42,true
+`
+
+func TestParseFlux(t *testing.T) {
+	metrics, err := parseFlux(strings.NewReader(fluxAnswer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the fields of the same series and time make one metric, the rows
+	// without value are left out and the pivoted columns are fields
+	want := []string{
+		"cpu map[host:a] map[usage_idle:float64(90.5) usage_user:float64(5)] 1500000000",
+		"cpu map[host:a] map[usage_idle:float64(91)] 1500000300",
+		"net map[host:b] map[count:int64(42) up:bool(true)] 1500000000",
+	}
+	if got := metricStrings(metrics); !reflect.DeepEqual(got, want) {
+		t.Errorf("got metrics\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestParseFluxErrors(t *testing.T) {
+	metrics, err := parseFlux(strings.NewReader(""))
+	if err != nil || len(metrics) != 0 {
+		t.Errorf("empty answer, got %d metrics and error %v", len(metrics), err)
+	}
+
+	for _, answer := range []string{
+		// the query failed after the answer started
+		"#datatype,string,string\n#group,true,true\n#default,,\n,error,reference\n,query terminated: out of memory,897\n",
+		"#datatype,string,long,dateTime:RFC3339,double,string,string\n#group,false,false,false,false,true,true\n#default,_result,,,,,\n,result,table,_time,_value,_field,_measurement\n,,0,yesterday,1,usage_idle,cpu\n",
+		"#datatype,string,long,dateTime:RFC3339,double,string,string\n#group,false,false,false,false,true,true\n#default,_result,,,,,\n,result,table,_time,_value,_field,_measurement\n,,0,2017-07-14T02:40:00Z,high,usage_idle,cpu\n",
+		",result,table,_time\n,,0\n",
+	} {
+		if _, err := parseFlux(strings.NewReader(answer)); err == nil {
+			t.Errorf("%q parsed", answer)
+		}
+	}
+}
+
+func newQuery(t *testing.T, url string) *InfluxDBQuery {
+	q := &InfluxDBQuery{
+		URL:          url,
+		Database:     "telegraf",
+		Organization: "ops",
+		Queries: []*Query{
+			{Name: "cpu", Query: "SELECT usage_idle FROM cpu WHERE time > '$since'"},
+			{Name: "cpu_flux", Query: `from(bucket: "telegraf") |> range(start: $since)`, Language: "flux"},
+		},
+		Timeout: misc.Duration{Duration: 5 * time.Second},
+	}
+	if err := q.check(); err != nil {
+		t.Fatal(err)
+	}
+	q.client = &http.Client{Timeout: q.Timeout.Duration}
+	q.watermarks = make(map[string]time.Time)
+	return q
+}
+
+func TestRun(t *testing.T) {
+	var queries []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, _ := r.BasicAuth(); user != "vgo" || password != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/query":
+			if r.FormValue("db") != "telegraf" || r.FormValue("epoch") != "ns" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			queries = append(queries, r.FormValue("q"))
+			w.Write([]byte(influxQLAnswer))
+		case "/api/v2/query":
+			b, _ := ioutil.ReadAll(r.Body)
+			queries = append(queries, string(b))
+			if r.URL.Query().Get("org") != "ops" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(fluxAnswer))
+		}
+	}))
+	defer ts.Close()
+
+	q := newQuery(t, ts.URL)
+	q.Username, q.Password = "vgo", "s3cret"
+	since := time.Date(2017, 7, 14, 0, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+	for i, query := range q.Queries {
+		metrics, err := q.run(query, since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metrics) != 3 {
+			t.Errorf("%s, got %d metrics, want 3", query.Name, len(metrics))
+		}
+		// the watermark is in UTC
+		if !strings.Contains(queries[i], "2017-07-13T22:00:00Z") {
+			t.Errorf("%s, got query %s, want $since replaced", query.Name, queries[i])
+		}
+	}
+}
+
+func TestRunFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"timeout"}`))
+	}))
+	q := newQuery(t, ts.URL)
+	if _, err := q.run(q.Queries[0], time.Now()); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("got error %v, want the status and the answer", err)
+	}
+
+	ts.Close()
+	if _, err := q.run(q.Queries[0], time.Now()); err == nil {
+		t.Error("query without server succeeded")
+	}
+}
+
+func TestWatermarks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "watermark.json")
+
+	// a missing file has no watermark, the first run reads from since ago
+	q := newQuery(t, "http://localhost:8086")
+	q.Since = misc.Duration{Duration: time.Hour}
+	q.WatermarkFile = path
+	if q.watermarks, err = loadWatermarks(path); err != nil {
+		t.Fatal(err)
+	}
+	if since := time.Since(q.watermark("cpu")); since < time.Hour || since > time.Hour+time.Minute {
+		t.Errorf("got watermark %s ago, want 1h", since)
+	}
+
+	last := time.Unix(1500000600, 0)
+	q.watermarks["cpu"] = last
+	if err := q.saveWatermarks(); err != nil {
+		t.Fatal(err)
+	}
+	watermarks, err := loadWatermarks(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !watermarks["cpu"].Equal(last) || len(watermarks) != 1 {
+		t.Errorf("got watermarks %v, want cpu at %s", watermarks, last)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadWatermarks(path); err == nil {
+		t.Error("invalid watermark file loaded")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for _, q := range []*InfluxDBQuery{
+		{Queries: []*Query{{Query: "SELECT * FROM cpu"}}},
+		{URL: "http://localhost:8086"},
+		{URL: "http://localhost:8086", Queries: []*Query{{Name: "cpu"}}},
+		{URL: "http://localhost:8086", Queries: []*Query{{Query: "SELECT * FROM cpu", Language: "sql"}}},
+		{URL: "http://localhost:8086", Queries: []*Query{{Query: "from(bucket: \"telegraf\")", Language: "flux"}}},
+		{URL: "http://localhost:8086", Queries: []*Query{
+			{Name: "cpu", Query: "SELECT * FROM cpu"},
+			{Name: "cpu", Query: "SELECT * FROM mem"},
+		}},
+	} {
+		if err := q.check(); err == nil {
+			t.Errorf("invalid config %+v accepted", q)
+		}
+	}
+
+	// the queries are named by their index, InfluxQL by default
+	q := &InfluxDBQuery{URL: "http://localhost:8086", Queries: []*Query{{Query: "SELECT * FROM cpu"}}}
+	if err := q.check(); err != nil {
+		t.Fatal(err)
+	}
+	if q.Queries[0].Name != "query0" || q.Queries[0].Language != "influxql" {
+		t.Errorf("got query %+v", q.Queries[0])
+	}
+}
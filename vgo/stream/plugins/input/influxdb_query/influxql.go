@@ -0,0 +1,127 @@
+package influxdb_query
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// influxQLResponse is the answer of /query
+type influxQLResponse struct {
+	Results []struct {
+		Series []struct {
+			Name    string            `json:"name"`
+			Tags    map[string]string `json:"tags"`
+			Columns []string          `json:"columns"`
+			Values  [][]interface{}   `json:"values"`
+		} `json:"series"`
+		Error string `json:"error"`
+	} `json:"results"`
+	Error string `json:"error"`
+}
+
+// parseInfluxQL converts the rows of the series of an answer with epoch=ns
+// times into metrics, a row per metric with its non null columns as
+// fields. The numbers without decimal point are integers.
+func parseInfluxQL(r io.Reader) ([]*service.MetricData, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var resp influxQLResponse
+	if err := dec.Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+
+	var metrics []*service.MetricData
+	for _, result := range resp.Results {
+		if result.Error != "" {
+			return nil, errors.New(result.Error)
+		}
+		for _, series := range result.Series {
+			timeCol := -1
+			for i, c := range series.Columns {
+				if c == "time" {
+					timeCol = i
+				}
+			}
+			if timeCol < 0 {
+				return nil, fmt.Errorf("series %s without time column", series.Name)
+			}
+
+			for _, row := range series.Values {
+				m, err := influxQLRow(series.Name, series.Tags, series.Columns, timeCol, row)
+				if err != nil {
+					return nil, err
+				}
+				if m != nil {
+					metrics = append(metrics, m)
+				}
+			}
+		}
+	}
+	return metrics, nil
+}
+
+// influxQLRow converts a row, it returns nil for a row of null values.
+func influxQLRow(name string, tags map[string]string, columns []string, timeCol int, row []interface{}) (*service.MetricData, error) {
+	if len(row) != len(columns) {
+		return nil, fmt.Errorf("series %s, row of %d values for %d columns", name, len(row), len(columns))
+	}
+
+	ts, ok := row[timeCol].(json.Number)
+	if !ok {
+		return nil, fmt.Errorf("series %s, invalid time %v, epoch=ns expected", name, row[timeCol])
+	}
+	ns, err := ts.Int64()
+	if err != nil {
+		return nil, fmt.Errorf("series %s, invalid time %v", name, ts)
+	}
+
+	fields := make(map[string]interface{}, len(columns)-1)
+	for i, v := range row {
+		if i == timeCol || v == nil {
+			continue
+		}
+		if n, ok := v.(json.Number); ok {
+			if v, err = number(n); err != nil {
+				return nil, fmt.Errorf("series %s, column %s, %s", name, columns[i], err)
+			}
+		}
+		fields[columns[i]] = v
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	t := make(map[string]string, len(tags))
+	for k, v := range tags {
+		// the series grouped by a tag missing from some points have it empty
+		if v != "" {
+			t[k] = v
+		}
+	}
+	return &service.MetricData{
+		Name:   name,
+		Tags:   t,
+		Fields: fields,
+		Time:   time.Unix(0, ns),
+	}, nil
+}
+
+// number returns an int64 for the numbers without decimal point or
+// exponent, a float64 for the others.
+func number(n json.Number) (interface{}, error) {
+	if !strings.ContainsAny(n.String(), ".eE") {
+		if i, err := n.Int64(); err == nil {
+			return i, nil
+		}
+	}
+	return n.Float64()
+}
@@ -0,0 +1,263 @@
+package kafka_consumer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+// KafkaConsumer consumes the metrics of topics in a consumer group. The
+// offset of a message is committed once its metrics are in the pipeline, so
+// the messages in flight when vgo stops or the partitions are rebalanced
+// are consumed again.
+type KafkaConsumer struct {
+	Brokers       []string
+	Topics        []string
+	ConsumerGroup string
+	// Offset is where a group without committed offsets starts, "oldest"
+	// or "newest"
+	Offset string
+	// Version is the Kafka version of the brokers, 0.10.2 at least
+	Version string
+	// MaxMessageLen skips the larger messages, 0 means no limit
+	MaxMessageLen int
+	// MaxUndeliveredMessages is the number of messages of a partition
+	// fetched before their metrics are in the pipeline
+	MaxUndeliveredMessages int
+	ReconnectDelay         misc.Duration
+
+	// SASLUsername and SASLPassword authenticate with SASL/PLAIN
+	SASLUsername string `toml:"sasl_username"`
+	SASLPassword string `toml:"sasl_password"`
+
+	EnableTLS          bool   `toml:"enable_tls"`
+	SSLCA              string `toml:"ssl_ca"`
+	SSLCert            string `toml:"ssl_cert"`
+	SSLKey             string `toml:"ssl_key"`
+	InsecureSkipVerify bool
+
+	StopC  chan bool
+	WriteC chan service.Metrics
+
+	parser service.Parser
+	stop   chan bool
+}
+
+var sampleConfig = `
+  brokers = ["localhost:9092"]
+  topics = ["vgo"]
+  consumer_group = "vgo_metrics_consumers"
+  ## Where a group without committed offsets starts: "oldest" or "newest"
+  # offset = "oldest"
+  ## Kafka version of the brokers, 0.10.2 at least
+  # version = "1.0.0"
+  ## Messages larger than this are skipped, 0 means no limit
+  # max_message_len = 1000000
+  ## Messages of a partition fetched before their metrics are in the pipeline
+  # max_undelivered_messages = 256
+  # reconnect_delay = "5s"
+
+  ## SASL/PLAIN authentication
+  # sasl_username = "kafka"
+  # sasl_password = "secret"
+
+  ## Optional SSL Config
+  # enable_tls = false
+  # ssl_ca = "/etc/vgo/ca.pem"
+  # ssl_cert = "/etc/vgo/cert.pem"
+  # ssl_key = "/etc/vgo/key.pem"
+  # insecure_skip_verify = false
+
+  ## Data format of the messages: "influx", "json"
+  # data_format = "influx"
+  ## Unit of the json timestamps: "1s", "1ms", "1us" or "1ns"
+  # json_timestamp_units = "1s"
+  ## The json object and array fields are dropped, kept for the processors
+  ## such as flatten, or flattened into disk.used like fields: "drop",
+  ## "keep" or "flatten"
+  # json_nested = "drop"
+`
+
+func (k *KafkaConsumer) SetParser(parser service.Parser) {
+	k.parser = parser
+}
+
+// Init init kafka_consumer
+func (k *KafkaConsumer) Init(stopC chan bool, writeC chan service.Metrics) {
+	k.StopC = stopC
+	k.WriteC = writeC
+	k.stop = make(chan bool)
+}
+
+// Start start kafka_consumer, the group is joined again after every
+// rebalance and created again when it fails.
+func (k *KafkaConsumer) Start() {
+	log.Println("kafka_consumer Start")
+	config, err := k.config()
+	if err != nil {
+		log.Fatal("[FATAL] kafka_consumer config error: ", err)
+	}
+
+	// cancelling ctx ends the consume loop
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-k.StopC:
+		case <-k.stop:
+		}
+		cancel()
+	}()
+
+	for {
+		group, err := sarama.NewConsumerGroup(k.Brokers, k.ConsumerGroup, config)
+		if err != nil {
+			service.VLogger.Error("kafka_consumer connect", zap.Object("brokers", k.Brokers), zap.Error(err))
+		} else {
+			k.consume(ctx, group)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(k.ReconnectDelay.Duration):
+		}
+	}
+}
+
+// Stop stops consuming, the offsets of the messages not in the pipeline
+// aren't committed so they're consumed again.
+func (k *KafkaConsumer) Stop() {
+	close(k.stop)
+}
+
+func (k *KafkaConsumer) config() (*sarama.Config, error) {
+	if len(k.Brokers) == 0 || len(k.Topics) == 0 || k.ConsumerGroup == "" {
+		return nil, fmt.Errorf("brokers, topics and consumer_group are required")
+	}
+
+	config := sarama.NewConfig()
+	version, err := sarama.ParseKafkaVersion(k.Version)
+	if err != nil {
+		return nil, err
+	}
+	config.Version = version
+
+	switch k.Offset {
+	case "oldest":
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	case "newest":
+		config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	default:
+		return nil, fmt.Errorf("invalid offset %s, can be: \"oldest\", \"newest\"", k.Offset)
+	}
+	config.Consumer.Return.Errors = true
+	if k.MaxUndeliveredMessages > 0 {
+		config.ChannelBufferSize = k.MaxUndeliveredMessages
+	}
+
+	if k.EnableTLS {
+		tlsConfig, err := misc.GetTLSConfig(k.SSLCert, k.SSLKey, k.SSLCA, k.InsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	if k.SASLUsername != "" {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		config.Net.SASL.User = k.SASLUsername
+		config.Net.SASL.Password = k.SASLPassword
+	}
+
+	return config, config.Validate()
+}
+
+// consume joins the group again after every rebalance, until ctx is done
+// or the group fails.
+func (k *KafkaConsumer) consume(ctx context.Context, group sarama.ConsumerGroup) {
+	defer group.Close()
+	go func() {
+		for err := range group.Errors() {
+			service.VLogger.Error("kafka_consumer", zap.Error(err))
+		}
+	}()
+
+	for ctx.Err() == nil {
+		if err := group.Consume(ctx, k.Topics, k); err != nil {
+			service.VLogger.Error("kafka_consumer consume", zap.Object("topics", k.Topics), zap.Error(err))
+			return
+		}
+	}
+}
+
+// Setup is called when the partitions are assigned, after a rebalance.
+func (k *KafkaConsumer) Setup(session sarama.ConsumerGroupSession) error {
+	log.Println("kafka_consumer claims ", session.Claims())
+	return nil
+}
+
+// Cleanup is called when the partitions are revoked, the offsets marked
+// are committed.
+func (k *KafkaConsumer) Cleanup(session sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim handles the messages of a partition until it's revoked.
+func (k *KafkaConsumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		k.onMessage(msg)
+		// the offset is committed, asynchronously, once the metrics are in
+		// the pipeline
+		session.MarkMessage(msg, "")
+	}
+	return nil
+}
+
+// onMessage publishes the metrics of the message. The messages too large or
+// failing to parse are skipped, consuming them again would fail the same.
+func (k *KafkaConsumer) onMessage(msg *sarama.ConsumerMessage) {
+	if k.MaxMessageLen > 0 && len(msg.Value) > k.MaxMessageLen {
+		service.VLogger.Error("kafka_consumer message too large, skipped",
+			zap.String("topic", msg.Topic),
+			zap.Int("partition", int(msg.Partition)),
+			zap.Int64("offset", msg.Offset),
+			zap.Int("len", len(msg.Value)),
+		)
+		return
+	}
+
+	metrics, err := k.parser.Parse(msg.Value)
+	if err != nil {
+		service.VLogger.Error("kafka_consumer parse, message skipped",
+			zap.String("topic", msg.Topic),
+			zap.Int("partition", int(msg.Partition)),
+			zap.Int64("offset", msg.Offset),
+			zap.Error(err),
+		)
+		return
+	}
+
+	if len(metrics) > 0 {
+		service.InputStats("kafka_consumer").Gathered(len(metrics))
+		service.Publish(service.Metrics{Data: metrics})
+	}
+}
+
+func init() {
+	service.AddInput("kafka_consumer", &KafkaConsumer{
+		Offset:                 "oldest",
+		Version:                "1.0.0",
+		MaxMessageLen:          1000000,
+		MaxUndeliveredMessages: 256,
+		ReconnectDelay:         misc.Duration{Duration: 5 * time.Second},
+	})
+}
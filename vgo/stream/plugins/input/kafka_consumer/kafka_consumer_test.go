@@ -0,0 +1,164 @@
+package kafka_consumer
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/corego/vgo/vgo/stream/plugins/parser/influx"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/corego/vgo/vgo/stream/service/servicetest"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+// session records the offsets marked by the consumer
+type session struct {
+	sync.Mutex
+	marked []int64
+}
+
+func (s *session) Claims() map[string][]int32                                        { return nil }
+func (s *session) MemberID() string                                                  { return "vgo" }
+func (s *session) GenerationID() int32                                               { return 1 }
+func (s *session) MarkOffset(topic string, partition int32, offset int64, _ string)  {}
+func (s *session) Commit()                                                           {}
+func (s *session) ResetOffset(topic string, partition int32, offset int64, _ string) {}
+func (s *session) Context() context.Context                                          { return context.Background() }
+
+func (s *session) MarkMessage(msg *sarama.ConsumerMessage, _ string) {
+	s.Lock()
+	defer s.Unlock()
+	s.marked = append(s.marked, msg.Offset)
+}
+
+// claim is a partition claim of the messages, closed like a claim revoked
+type claim struct {
+	messages chan *sarama.ConsumerMessage
+}
+
+func newClaim(values ...string) *claim {
+	c := &claim{messages: make(chan *sarama.ConsumerMessage, len(values))}
+	for n, v := range values {
+		c.messages <- &sarama.ConsumerMessage{Topic: "vgo", Partition: 0, Offset: int64(n), Value: []byte(v)}
+	}
+	close(c.messages)
+	return c
+}
+
+func (c *claim) Topic() string                            { return "vgo" }
+func (c *claim) Partition() int32                         { return 0 }
+func (c *claim) InitialOffset() int64                     { return 0 }
+func (c *claim) HighWaterMarkOffset() int64               { return int64(len(c.messages)) }
+func (c *claim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+func newConsumer() *KafkaConsumer {
+	k := &KafkaConsumer{MaxMessageLen: 100}
+	k.SetParser(&influx.InfluxParser{})
+	return k
+}
+
+func TestCommitAfterEnqueue(t *testing.T) {
+	r := &servicetest.Recorder{}
+	stop := servicetest.StartPipeline(r)
+	defer stop()
+	k := newConsumer()
+	s := &session{}
+
+	err := k.ConsumeClaim(s, newClaim(
+		"cpu,host=a usage=10 1500000000000000000\ncpu,host=b usage=20 1500000000000000000\n",
+		"mem,host=a used=1i 1500000000000000000\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every message marked in order, once its metrics are published
+	if want := []int64{0, 1}; !reflect.DeepEqual(s.marked, want) {
+		t.Errorf("got offsets marked %v, want %v", s.marked, want)
+	}
+	if got := r.Wait(3); len(got) != 3 {
+		t.Errorf("got %d metrics in the pipeline, want 3", len(got))
+	}
+}
+
+func TestSkippedMessages(t *testing.T) {
+	r := &servicetest.Recorder{}
+	stop := servicetest.StartPipeline(r)
+	defer stop()
+	k := newConsumer()
+	s := &session{}
+
+	err := k.ConsumeClaim(s, newClaim(
+		"cpu,host=a usage=\n",
+		"cpu,host=a "+strings.Repeat("x", 100)+"=1i 1500000000000000000\n",
+		"cpu,host=b usage=20 1500000000000000000\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the messages failing to parse or too large would fail the same again,
+	// they're committed so they don't block the partition
+	if want := []int64{0, 1, 2}; !reflect.DeepEqual(s.marked, want) {
+		t.Errorf("got offsets marked %v, want %v", s.marked, want)
+	}
+	r.Wait(1)
+	time.Sleep(20 * time.Millisecond)
+	got := r.Received()
+	if len(got) != 1 || got[0].Tags["host"] != "b" {
+		t.Errorf("got metrics %v, want only the valid message", got)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	valid := func() *KafkaConsumer {
+		return &KafkaConsumer{
+			Brokers:       []string{"localhost:9092"},
+			Topics:        []string{"vgo"},
+			ConsumerGroup: "vgo",
+			Offset:        "newest",
+			Version:       "1.0.0",
+		}
+	}
+
+	k := valid()
+	k.SASLUsername, k.SASLPassword = "kafka", "secret"
+	k.MaxUndeliveredMessages = 16
+	config, err := k.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Consumer.Offsets.Initial != sarama.OffsetNewest {
+		t.Errorf("got initial offset %d, want the newest", config.Consumer.Offsets.Initial)
+	}
+	if !config.Net.SASL.Enable || config.Net.SASL.User != "kafka" || config.Net.SASL.Password != "secret" {
+		t.Errorf("got SASL config %+v", config.Net.SASL)
+	}
+	if config.ChannelBufferSize != 16 {
+		t.Errorf("got %d messages in flight, want 16", config.ChannelBufferSize)
+	}
+	if config.Net.TLS.Enable {
+		t.Error("TLS enabled without enable_tls")
+	}
+
+	for _, invalid := range []func(*KafkaConsumer){
+		func(k *KafkaConsumer) { k.Brokers = nil },
+		func(k *KafkaConsumer) { k.Topics = nil },
+		func(k *KafkaConsumer) { k.ConsumerGroup = "" },
+		func(k *KafkaConsumer) { k.Offset = "latest" },
+		func(k *KafkaConsumer) { k.EnableTLS, k.SSLCert = true, "/etc/vgo/cert.pem" },
+	} {
+		k := valid()
+		invalid(k)
+		if _, err := k.config(); err == nil {
+			t.Errorf("invalid config %+v accepted", k)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package mqtt_consumer
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/uber-go/zap"
+)
+
+type MQTTConsumer struct {
+	Servers []string
+	Topics  []string
+	QoS     int `toml:"qos"`
+	// PersistentSession keeps the subscriptions and the QoS 1 and 2 messages
+	// on the broker while vgo is disconnected, a ClientID is required
+	PersistentSession bool
+	ClientID          string `toml:"client_id"`
+	Username          string
+	Password          string
+	ConnectionTimeout misc.Duration
+	// TopicTags extract tags from the topics of the messages
+	TopicTags []*TopicTag
+
+	SSLCA              string `toml:"ssl_ca"`
+	SSLCert            string `toml:"ssl_cert"`
+	SSLKey             string `toml:"ssl_key"`
+	InsecureSkipVerify bool
+
+	StopC  chan bool
+	WriteC chan service.Metrics
+
+	client paho.Client
+	parser service.Parser
+}
+
+// TopicTag maps the wildcards of Pattern, in order, to the Tags keys: with
+// pattern "sensors/+/+" and tags ["room", "sensor"], the topic
+// sensors/kitchen/t1 gives room=kitchen and sensor=t1.
+type TopicTag struct {
+	Pattern string
+	Tags    []string
+
+	levels []string
+}
+
+var sampleConfig = `
+  servers = ["tcp://localhost:1883"]
+  topics = ["sensors/#"]
+  ## QoS of the subscriptions: 0, 1 or 2
+  qos = 1
+  ## Keep the session on the broker, the QoS 1 and 2 messages published
+  ## while vgo is disconnected are delivered on reconnect. Needs a client_id.
+  # persistent_session = false
+  # client_id = "vgo"
+  # username = ""
+  # password = ""
+  # connection_timeout = "30s"
+
+  ## Tags taken from the topic levels matched by the wildcards, in order
+  # [[inputs.mqtt_consumer.topic_tags]]
+  #   pattern = "sensors/+/+"
+  #   tags = ["room", "sensor"]
+
+  ## Optional SSL Config
+  # ssl_ca = "/etc/vgo/ca.pem"
+  # ssl_cert = "/etc/vgo/cert.pem"
+  # ssl_key = "/etc/vgo/key.pem"
+  # insecure_skip_verify = false
+
+  ## Data format of the messages: "influx", "json"
+  # data_format = "influx"
+  ## Unit of the json timestamps: "1s", "1ms", "1us" or "1ns"
+  # json_timestamp_units = "1s"
+  ## The json object and array fields are dropped, kept for the processors
+  ## such as flatten, or flattened into disk.used like fields: "drop",
+  ## "keep" or "flatten"
+  # json_nested = "drop"
+`
+
+func (m *MQTTConsumer) SetParser(parser service.Parser) {
+	m.parser = parser
+}
+
+// Init init mqtt_consumer
+func (m *MQTTConsumer) Init(stopC chan bool, writeC chan service.Metrics) {
+	m.StopC = stopC
+	m.WriteC = writeC
+}
+
+// Start start mqtt_consumer
+func (m *MQTTConsumer) Start() {
+	log.Println("mqtt_consumer Start")
+	if err := m.Connect(); err != nil {
+		log.Fatal("[FATAL] mqtt_consumer connect failed, err message is ", err)
+	}
+}
+
+// Stop stops receiving the metrics
+func (m *MQTTConsumer) Stop() {
+	if m.client != nil {
+		m.client.Disconnect(200)
+	}
+}
+
+func (m *MQTTConsumer) Connect() error {
+	if len(m.Servers) == 0 || len(m.Topics) == 0 {
+		return fmt.Errorf("servers and topics are required")
+	}
+	if m.QoS < 0 || m.QoS > 2 {
+		return fmt.Errorf("invalid qos %d", m.QoS)
+	}
+	if m.PersistentSession && m.ClientID == "" {
+		return fmt.Errorf("persistent_session requires a client_id")
+	}
+	for _, tt := range m.TopicTags {
+		if err := tt.init(); err != nil {
+			return err
+		}
+	}
+
+	opts := paho.NewClientOptions()
+	for _, server := range m.Servers {
+		opts.AddBroker(server)
+	}
+	if m.ClientID == "" {
+		m.ClientID = "vgo-" + misc.RandomString(8)
+	}
+	opts.SetClientID(m.ClientID)
+	opts.SetUsername(m.Username)
+	opts.SetPassword(m.Password)
+	opts.SetCleanSession(!m.PersistentSession)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectTimeout(m.ConnectionTimeout.Duration)
+
+	tlsConfig, err := misc.GetTLSConfig(m.SSLCert, m.SSLKey, m.SSLCA, m.InsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	// the messages redelivered by the broker of a persistent session may
+	// arrive before the subscriptions are made again
+	opts.SetDefaultPublishHandler(m.onMessage)
+	opts.SetConnectionLostHandler(func(c paho.Client, err error) {
+		service.VLogger.Warn("mqtt_consumer connection lost", zap.Error(err))
+	})
+	// subscribe on every connection, a clean session loses its
+	// subscriptions on reconnect
+	opts.SetOnConnectHandler(func(c paho.Client) {
+		go m.subscribe(c)
+	})
+
+	m.client = paho.NewClient(opts)
+	token := m.client.Connect()
+	if !token.WaitTimeout(m.ConnectionTimeout.Duration) {
+		return fmt.Errorf("connect timeout")
+	}
+	return token.Error()
+}
+
+func (m *MQTTConsumer) subscribe(c paho.Client) {
+	filters := make(map[string]byte, len(m.Topics))
+	for _, topic := range m.Topics {
+		filters[topic] = byte(m.QoS)
+	}
+
+	token := c.SubscribeMultiple(filters, m.onMessage)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		service.VLogger.Error("mqtt_consumer subscribe", zap.Error(err))
+		return
+	}
+	log.Println("mqtt_consumer subscribe topics ", m.Topics)
+}
+
+func (m *MQTTConsumer) onMessage(c paho.Client, msg paho.Message) {
+	metrics, err := m.parser.Parse(msg.Payload())
+	if err != nil {
+		service.VLogger.Error("mqtt_consumer parse", zap.String("topic", msg.Topic()), zap.Error(err))
+		return
+	}
+	if len(metrics) == 0 {
+		return
+	}
+
+	tags := m.topicTags(msg.Topic())
+	for _, metric := range metrics {
+		if metric.Tags == nil {
+			metric.Tags = make(map[string]string, len(tags))
+		}
+		for k, v := range tags {
+			metric.Tags[k] = v
+		}
+	}
+
+	service.InputStats("mqtt_consumer").Gathered(len(metrics))
+	service.Publish(service.Metrics{Data: metrics})
+}
+
+// topicTags returns the tags of the first TopicTag matching the topic.
+func (m *MQTTConsumer) topicTags(topic string) map[string]string {
+	levels := strings.Split(topic, "/")
+	for _, tt := range m.TopicTags {
+		if tags, ok := tt.match(levels); ok {
+			return tags
+		}
+	}
+	return nil
+}
+
+func (tt *TopicTag) init() error {
+	tt.levels = strings.Split(tt.Pattern, "/")
+
+	wildcards := 0
+	for i, level := range tt.levels {
+		switch level {
+		case "+":
+			wildcards++
+		case "#":
+			if i != len(tt.levels)-1 {
+				return fmt.Errorf("topic_tags pattern %s, # must be the last level", tt.Pattern)
+			}
+			wildcards++
+		}
+	}
+	if wildcards != len(tt.Tags) {
+		return fmt.Errorf("topic_tags pattern %s has %d wildcards for %d tags", tt.Pattern, wildcards, len(tt.Tags))
+	}
+	return nil
+}
+
+// match returns the tags of the topic levels, a # wildcard takes all the
+// remaining levels.
+func (tt *TopicTag) match(levels []string) (map[string]string, bool) {
+	tags := make(map[string]string, len(tt.Tags))
+	n := 0
+	for i, level := range tt.levels {
+		if level == "#" {
+			if i >= len(levels) {
+				return nil, false
+			}
+			tags[tt.Tags[n]] = strings.Join(levels[i:], "/")
+			return tags, true
+		}
+		if i >= len(levels) {
+			return nil, false
+		}
+		switch level {
+		case "+":
+			tags[tt.Tags[n]] = levels[i]
+			n++
+		case levels[i]:
+		default:
+			return nil, false
+		}
+	}
+	if len(levels) != len(tt.levels) {
+		return nil, false
+	}
+	return tags, true
+}
+
+func init() {
+	service.AddInput("mqtt_consumer", &MQTTConsumer{
+		QoS:               1,
+		ConnectionTimeout: misc.Duration{Duration: 30 * time.Second},
+	})
+}
@@ -0,0 +1,67 @@
+package mqtt_consumer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTopicTags(t *testing.T) {
+	m := &MQTTConsumer{TopicTags: []*TopicTag{
+		{Pattern: "sensors/+/+", Tags: []string{"room", "sensor"}},
+		{Pattern: "plants/+/power/#", Tags: []string{"plant", "meter"}},
+		{Pattern: "+/status", Tags: []string{"device"}},
+	}}
+	for _, tt := range m.TopicTags {
+		if err := tt.init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		topic string
+		want  map[string]string
+	}{
+		{"sensors/kitchen/t1", map[string]string{"room": "kitchen", "sensor": "t1"}},
+		{"plants/lyon/power/a/b", map[string]string{"plant": "lyon", "meter": "a/b"}},
+		{"plants/lyon/power/a", map[string]string{"plant": "lyon", "meter": "a"}},
+		{"gateway/status", map[string]string{"device": "gateway"}},
+		// the level count must match, # needs a level
+		{"sensors/kitchen", nil},
+		{"sensors/kitchen/t1/raw", nil},
+		{"plants/lyon/power", nil},
+		{"plants/lyon/water/a", nil},
+		{"other", nil},
+	} {
+		if got := m.topicTags(tt.topic); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s, got tags %v, want %v", tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestTopicTagsFirstMatch(t *testing.T) {
+	m := &MQTTConsumer{TopicTags: []*TopicTag{
+		{Pattern: "sensors/+/t1", Tags: []string{"room"}},
+		{Pattern: "sensors/+/+", Tags: []string{"room", "sensor"}},
+	}}
+	for _, tt := range m.TopicTags {
+		if err := tt.init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]string{"room": "kitchen"}
+	if got := m.topicTags("sensors/kitchen/t1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got tags %v, want %v", got, want)
+	}
+}
+
+func TestTopicTagInvalid(t *testing.T) {
+	for _, tt := range []*TopicTag{
+		{Pattern: "sensors/+/+", Tags: []string{"room"}},
+		{Pattern: "sensors/#/raw", Tags: []string{"sensor"}},
+		{Pattern: "sensors/+", Tags: []string{"room", "sensor"}},
+	} {
+		if err := tt.init(); err == nil {
+			t.Errorf("pattern %s with tags %v accepted", tt.Pattern, tt.Tags)
+		}
+	}
+}
@@ -27,6 +27,13 @@ func (n *Nats) Start() {
 	n.Connect()
 }
 
+// Stop stops receiving the metrics
+func (n *Nats) Stop() {
+	if n.conn != nil {
+		n.conn.Close()
+	}
+}
+
 // Close close nats
 func (n *Nats) Close() error {
 	close(n.StopC)
@@ -62,6 +69,7 @@ func dealMetricMsg(m *nats.Msg) {
 	if err := data.UnmarshalJSON(m.Data); err != nil {
 		log.Println("nats UnmarshalJSON failed, err message is ", err)
 	} else {
+		service.InputStats("nats").Gathered(len(data.Data))
 		service.Publish(data)
 		// log.Println("Nats get msg")
 	}
@@ -0,0 +1,292 @@
+package prometheus
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/uber-go/zap"
+)
+
+const (
+	acceptText     = "text/plain;version=0.0.4;q=1,*/*;q=0.1"
+	acceptProtobuf = "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3,*/*;q=0.1"
+)
+
+// Prometheus scrapes the prometheus endpoints at every interval. Every
+// sample is a metric named after its family with a "value" field and the
+// labels as tags; the histograms give the _bucket (tagged le), _sum and
+// _count metrics, the summaries the quantiles (tagged quantile), _sum and
+// _count metrics.
+type Prometheus struct {
+	URLs     []string `toml:"urls"`
+	Interval misc.Duration
+	Timeout  misc.Duration
+	// Protobuf asks the endpoints for the protobuf format, they answer
+	// the text format when they don't support it
+	Protobuf bool
+	// BearerToken or the content of BearerTokenFile is sent in the
+	// Authorization header
+	BearerToken     string
+	BearerTokenFile string
+
+	SSLCA              string `toml:"ssl_ca"`
+	SSLCert            string `toml:"ssl_cert"`
+	SSLKey             string `toml:"ssl_key"`
+	InsecureSkipVerify bool
+
+	StopC  chan bool
+	WriteC chan service.Metrics
+
+	client *http.Client
+	stop   chan bool
+}
+
+var sampleConfig = `
+  urls = ["http://localhost:9100/metrics"]
+  interval = "10s"
+  timeout = "5s"
+  ## Ask for the protobuf exposition format
+  # protobuf = false
+
+  ## Bearer token of the secured endpoints
+  # bearer_token = ""
+  # bearer_token_file = "/var/run/secrets/token"
+
+  ## Optional SSL Config
+  # ssl_ca = "/etc/vgo/ca.pem"
+  # ssl_cert = "/etc/vgo/cert.pem"
+  # ssl_key = "/etc/vgo/key.pem"
+  # insecure_skip_verify = false
+`
+
+// Init init prometheus
+func (p *Prometheus) Init(stopC chan bool, writeC chan service.Metrics) {
+	p.StopC = stopC
+	p.WriteC = writeC
+	p.stop = make(chan bool)
+}
+
+// Start start prometheus
+func (p *Prometheus) Start() {
+	log.Println("prometheus Start")
+	if len(p.URLs) == 0 {
+		log.Fatal("[FATAL] prometheus urls are required")
+	}
+
+	tlsConfig, err := misc.GetTLSConfig(p.SSLCert, p.SSLKey, p.SSLCA, p.InsecureSkipVerify)
+	if err != nil {
+		log.Fatal("[FATAL] prometheus ssl config error: ", err)
+	}
+	p.client = &http.Client{
+		Timeout: p.Timeout.Duration,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+
+	ticker := service.CollectionTicker(p.Interval.Duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.gather()
+		case <-p.stop:
+			return
+		case <-p.StopC:
+			return
+		}
+	}
+}
+
+// Stop stops scraping
+func (p *Prometheus) Stop() {
+	close(p.stop)
+}
+
+// gather scrapes the urls concurrently and publishes all their metrics.
+func (p *Prometheus) gather() {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		metrics []*service.MetricData
+	)
+	for _, u := range p.URLs {
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+			m, err := p.scrape(u)
+			if err != nil {
+				service.VLogger.Error("prometheus scrape", zap.String("url", u), zap.Error(err))
+				return
+			}
+			mu.Lock()
+			metrics = append(metrics, m...)
+			mu.Unlock()
+		}(u)
+	}
+	wg.Wait()
+
+	if len(metrics) == 0 {
+		return
+	}
+	service.InputStats("prometheus").Gathered(len(metrics))
+	service.Publish(service.Metrics{Data: metrics, Interval: int(p.Interval.Duration / time.Second)})
+}
+
+func (p *Prometheus) scrape(u string) ([]*service.MetricData, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.Protobuf {
+		req.Header.Set("Accept", acceptProtobuf)
+	} else {
+		req.Header.Set("Accept", acceptText)
+	}
+
+	token, err := p.token()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	metrics, err := parse(resp.Body, expfmt.ResponseFormat(resp.Header), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range metrics {
+		m.Tags["url"] = u
+	}
+	return metrics, nil
+}
+
+func (p *Prometheus) token() (string, error) {
+	if p.BearerTokenFile == "" {
+		return p.BearerToken, nil
+	}
+	b, err := ioutil.ReadFile(p.BearerTokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// parse decodes the exposition format and converts the samples into
+// metrics, the samples without timestamp are at now.
+func parse(r io.Reader, format expfmt.Format, now time.Time) ([]*service.MetricData, error) {
+	dec := expfmt.NewDecoder(r, format)
+
+	var metrics []*service.MetricData
+	for {
+		var mf dto.MetricFamily
+		if err := dec.Decode(&mf); err != nil {
+			if err == io.EOF {
+				return metrics, nil
+			}
+			return nil, err
+		}
+		metrics = append(metrics, convert(&mf, now)...)
+	}
+}
+
+func convert(mf *dto.MetricFamily, now time.Time) []*service.MetricData {
+	name := mf.GetName()
+
+	var metrics []*service.MetricData
+	for _, m := range mf.Metric {
+		t := now
+		if m.TimestampMs != nil {
+			t = time.Unix(0, m.GetTimestampMs()*int64(time.Millisecond))
+		}
+		// the NaN and infinite samples can't be written by the outputs,
+		// they're skipped like the NaN quantiles of an empty summary
+		add := func(suffix string, value float64, extra ...string) {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				return
+			}
+			tags := labels(m)
+			for i := 0; i+1 < len(extra); i += 2 {
+				tags[extra[i]] = extra[i+1]
+			}
+			metrics = append(metrics, &service.MetricData{
+				Name:   name + suffix,
+				Tags:   tags,
+				Fields: map[string]interface{}{"value": value},
+				Time:   t,
+			})
+		}
+
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			add("", m.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			add("", m.GetGauge().GetValue())
+		case dto.MetricType_UNTYPED:
+			add("", m.GetUntyped().GetValue())
+		case dto.MetricType_HISTOGRAM:
+			h := m.GetHistogram()
+			for _, b := range h.Bucket {
+				add("_bucket", float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+			}
+			add("_sum", h.GetSampleSum())
+			add("_count", float64(h.GetSampleCount()))
+		case dto.MetricType_SUMMARY:
+			s := m.GetSummary()
+			for _, q := range s.Quantile {
+				add("", q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+			}
+			add("_sum", s.GetSampleSum())
+			add("_count", float64(s.GetSampleCount()))
+		}
+	}
+	return metrics
+}
+
+func labels(m *dto.Metric) map[string]string {
+	tags := make(map[string]string, len(m.Label)+1)
+	for _, l := range m.Label {
+		tags[l.GetName()] = l.GetValue()
+	}
+	return tags
+}
+
+// formatFloat formats the bounds the prometheus way: +Inf, 0.5
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func init() {
+	service.AddInput("prometheus", &Prometheus{
+		Interval: misc.Duration{Duration: 10 * time.Second},
+		Timeout:  misc.Duration{Duration: 5 * time.Second},
+	})
+}
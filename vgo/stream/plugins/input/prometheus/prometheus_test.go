@@ -0,0 +1,110 @@
+package prometheus
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/prometheus/common/expfmt"
+)
+
+const exposition = `# HELP http_requests_total The total number of HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027
+http_requests_total{method="post",code="400"} 3 1500000000000
+# TYPE temperature gauge
+temperature{room="kitchen"} 21.5
+temperature{room="cellar"} NaN
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0.1"} 20
+request_duration_seconds_bucket{le="0.5"} 25
+request_duration_seconds_bucket{le="+Inf"} 26
+request_duration_seconds_sum 4.2
+request_duration_seconds_count 26
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 0.05
+rpc_duration_seconds{quantile="0.99"} NaN
+rpc_duration_seconds_sum 17.5
+rpc_duration_seconds_count 300
+version 3
+`
+
+// format formats the metric as name{tags} value time, with sorted tags.
+func format(m *service.MetricData) string {
+	var tags []string
+	for k, v := range m.Tags {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return fmt.Sprintf("%s{%s} %v %d", m.Name, strings.Join(tags, ","), m.Fields["value"], m.Time.Unix())
+}
+
+func TestParse(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	metrics, err := parse(strings.NewReader(exposition), expfmt.FmtText, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, m := range metrics {
+		got = append(got, format(m))
+	}
+	// the families come in any order, the NaN samples are skipped
+	sort.Strings(got)
+	want := []string{
+		"http_requests_total{code=200,method=post} 1027 1600000000",
+		"http_requests_total{code=400,method=post} 3 1500000000",
+		"request_duration_seconds_bucket{le=+Inf} 26 1600000000",
+		"request_duration_seconds_bucket{le=0.1} 20 1600000000",
+		"request_duration_seconds_bucket{le=0.5} 25 1600000000",
+		"request_duration_seconds_count{} 26 1600000000",
+		"request_duration_seconds_sum{} 4.2 1600000000",
+		"rpc_duration_seconds_count{} 300 1600000000",
+		"rpc_duration_seconds_sum{} 17.5 1600000000",
+		"rpc_duration_seconds{quantile=0.5} 0.05 1600000000",
+		"temperature{room=kitchen} 21.5 1600000000",
+		"version{} 3 1600000000",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got metrics\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	if _, err := parse(strings.NewReader("# TYPE x counter\nx{a=\"b} 1\n"), expfmt.FmtText, time.Now()); err == nil {
+		t.Error("invalid exposition parsed")
+	}
+}
+
+func TestScrape(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		w.Write([]byte("# TYPE up gauge\nup 1\n"))
+	}))
+	defer ts.Close()
+
+	p := &Prometheus{BearerToken: "secret", client: http.DefaultClient}
+	metrics, err := p.scrape(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 1 || metrics[0].Name != "up" || metrics[0].Tags["url"] != ts.URL {
+		t.Errorf("got metrics %v", metrics)
+	}
+
+	p.BearerToken = "wrong"
+	if _, err := p.scrape(ts.URL); err == nil {
+		t.Error("no error from the unauthorized scrape")
+	}
+}
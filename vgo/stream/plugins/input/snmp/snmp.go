@@ -0,0 +1,494 @@
+package snmp
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/gosnmp/gosnmp"
+	"github.com/uber-go/zap"
+)
+
+// Snmp polls the agents for the scalar fields and the tables at every
+// interval. The agents are polled concurrently, an unreachable one only
+// logs an error.
+type Snmp struct {
+	// Agents are host:port, the port defaults to 161
+	Agents   []string
+	Interval misc.Duration
+	// Timeout is the timeout of a request to an agent
+	Timeout misc.Duration
+	Retries int
+	// Version is 1, 2 (v2c) or 3
+	Version   int
+	Community string
+
+	// SNMPv3 security
+	SecName string
+	// SecLevel can be "noAuthNoPriv", "authNoPriv" or "authPriv"
+	SecLevel string
+	// AuthProtocol can be "MD5" or "SHA"
+	AuthProtocol string
+	AuthPassword string
+	// PrivProtocol can be "DES" or "AES"
+	PrivProtocol string
+	PrivPassword string
+
+	// Name is the measurement of the scalar fields
+	Name   string
+	Fields []*Field
+	Tables []*Table
+	// Translations name the OIDs without a configured name: a field or
+	// column OID, or one of its parents followed by the rest of the OID
+	Translations map[string]string
+
+	StopC  chan bool
+	WriteC chan service.Metrics
+
+	stop chan bool
+}
+
+// Field is a scalar OID, or a column OID of a table.
+type Field struct {
+	Name string
+	Oid  string
+	// IsTag makes the value a tag instead of a field
+	IsTag bool
+}
+
+// Table walks its column OIDs, every row is a metric tagged with the row
+// index.
+type Table struct {
+	Name   string
+	Fields []*Field
+}
+
+var sampleConfig = `
+  agents = ["127.0.0.1:161"]
+  interval = "60s"
+  ## Timeout of each request to an agent
+  timeout = "5s"
+  retries = 3
+  ## SNMP version: 1, 2 (v2c) or 3
+  version = 2
+  community = "public"
+
+  ## SNMPv3
+  # sec_name = "vgo"
+  ## "noAuthNoPriv", "authNoPriv" or "authPriv"
+  # sec_level = "authNoPriv"
+  ## "MD5" or "SHA"
+  # auth_protocol = "SHA"
+  # auth_password = ""
+  ## "DES" or "AES"
+  # priv_protocol = "AES"
+  # priv_password = ""
+
+  ## Measurement of the scalar fields
+  name = "snmp"
+  [[inputs.snmp.fields]]
+    name = "sysName"
+    oid = ".1.3.6.1.2.1.1.5.0"
+    is_tag = true
+  [[inputs.snmp.fields]]
+    oid = ".1.3.6.1.2.1.1.3.0"
+
+  ## Every row of a table is a metric tagged with its index
+  [[inputs.snmp.tables]]
+    name = "interface"
+    [[inputs.snmp.tables.fields]]
+      name = "ifDescr"
+      oid = ".1.3.6.1.2.1.2.2.1.2"
+      is_tag = true
+    [[inputs.snmp.tables.fields]]
+      name = "ifInOctets"
+      oid = ".1.3.6.1.2.1.2.2.1.10"
+
+  ## Names of the OIDs without a name
+  [inputs.snmp.translations]
+    ".1.3.6.1.2.1.1.3.0" = "sysUpTime"
+`
+
+// Init init snmp
+func (s *Snmp) Init(stopC chan bool, writeC chan service.Metrics) {
+	s.StopC = stopC
+	s.WriteC = writeC
+	s.stop = make(chan bool)
+}
+
+// Start start snmp
+func (s *Snmp) Start() {
+	log.Println("snmp Start")
+	if err := s.check(); err != nil {
+		log.Fatal("[FATAL] snmp config error: ", err)
+	}
+
+	ticker := service.CollectionTicker(s.Interval.Duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.gather()
+		case <-s.stop:
+			return
+		case <-s.StopC:
+			return
+		}
+	}
+}
+
+// Stop stops polling the agents
+func (s *Snmp) Stop() {
+	close(s.stop)
+}
+
+func (s *Snmp) check() error {
+	if len(s.Agents) == 0 {
+		return fmt.Errorf("agents are required")
+	}
+	if s.Interval.Duration <= 0 {
+		return fmt.Errorf("invalid interval %v", s.Interval.Duration)
+	}
+	switch s.Version {
+	case 1, 2:
+	case 3:
+		if _, err := s.msgFlags(); err != nil {
+			return err
+		}
+		if _, err := s.authProtocol(); err != nil {
+			return err
+		}
+		if _, err := s.privProtocol(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid version %d", s.Version)
+	}
+
+	for _, f := range s.Fields {
+		if f.Oid == "" {
+			return fmt.Errorf("field %s without oid", f.Name)
+		}
+	}
+	for _, t := range s.Tables {
+		if t.Name == "" || len(t.Fields) == 0 {
+			return fmt.Errorf("table %s without name or fields", t.Name)
+		}
+		for _, f := range t.Fields {
+			if f.Oid == "" {
+				return fmt.Errorf("table %s field %s without oid", t.Name, f.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// gather polls every agent concurrently and publishes all their metrics.
+func (s *Snmp) gather() {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		metrics []*service.MetricData
+	)
+	for _, agent := range s.Agents {
+		wg.Add(1)
+		go func(agent string) {
+			defer wg.Done()
+			m, err := s.gatherAgent(agent)
+			if err != nil {
+				service.VLogger.Error("snmp agent", zap.String("agent", agent), zap.Error(err))
+			}
+			mu.Lock()
+			metrics = append(metrics, m...)
+			mu.Unlock()
+		}(agent)
+	}
+	wg.Wait()
+
+	if len(metrics) == 0 {
+		return
+	}
+	service.InputStats("snmp").Gathered(len(metrics))
+	service.Publish(service.Metrics{Data: metrics, Interval: int(s.Interval.Duration / time.Second)})
+}
+
+// gatherAgent returns the metrics of the agent, the ones gathered before an
+// error are returned with it.
+func (s *Snmp) gatherAgent(agent string) ([]*service.MetricData, error) {
+	conn, err := s.connect(agent)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Conn.Close()
+
+	now := time.Now()
+	host := conn.Target
+	var metrics []*service.MetricData
+
+	if len(s.Fields) > 0 {
+		m, err := s.gatherFields(conn, host, now)
+		if err != nil {
+			return metrics, err
+		}
+		metrics = append(metrics, m)
+	}
+
+	for _, t := range s.Tables {
+		m, err := s.gatherTable(conn, t, host, now)
+		if err != nil {
+			return metrics, fmt.Errorf("table %s, %s", t.Name, err)
+		}
+		metrics = append(metrics, m...)
+	}
+	return metrics, nil
+}
+
+func (s *Snmp) gatherFields(conn *gosnmp.GoSNMP, host string, now time.Time) (*service.MetricData, error) {
+	m := &service.MetricData{
+		Name:   s.Name,
+		Tags:   map[string]string{"agent_host": host},
+		Fields: make(map[string]interface{}),
+		Time:   now,
+	}
+
+	byOid := make(map[string]*Field, len(s.Fields))
+	oids := make([]string, 0, len(s.Fields))
+	for _, f := range s.Fields {
+		oid := normalizeOid(f.Oid)
+		byOid[oid] = f
+		oids = append(oids, oid)
+	}
+
+	// a Get can't ask for more than MaxOids OIDs
+	for len(oids) > 0 {
+		n := len(oids)
+		if n > conn.MaxOids {
+			n = conn.MaxOids
+		}
+		packet, err := conn.Get(oids[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, pdu := range packet.Variables {
+			f, ok := byOid[pdu.Name]
+			if !ok {
+				continue
+			}
+			value, ok := convert(pdu)
+			if !ok {
+				continue
+			}
+			s.set(m, f.IsTag, s.fieldName(f.Name, pdu.Name), value)
+		}
+		oids = oids[n:]
+	}
+	return m, nil
+}
+
+func (s *Snmp) gatherTable(conn *gosnmp.GoSNMP, t *Table, host string, now time.Time) ([]*service.MetricData, error) {
+	var rows []*service.MetricData
+	byIndex := make(map[string]*service.MetricData)
+
+	for _, f := range t.Fields {
+		oid := normalizeOid(f.Oid)
+		pdus, err := s.walk(conn, oid)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pdu := range pdus {
+			index := strings.TrimPrefix(pdu.Name, oid+".")
+			value, ok := convert(pdu)
+			if !ok {
+				continue
+			}
+
+			m, ok := byIndex[index]
+			if !ok {
+				m = &service.MetricData{
+					Name:   t.Name,
+					Tags:   map[string]string{"agent_host": host, "index": index},
+					Fields: make(map[string]interface{}),
+					Time:   now,
+				}
+				byIndex[index] = m
+				rows = append(rows, m)
+			}
+			s.set(m, f.IsTag, s.fieldName(f.Name, oid), value)
+		}
+	}
+	return rows, nil
+}
+
+func (s *Snmp) walk(conn *gosnmp.GoSNMP, oid string) ([]gosnmp.SnmpPDU, error) {
+	if conn.Version == gosnmp.Version1 {
+		return conn.WalkAll(oid)
+	}
+	return conn.BulkWalkAll(oid)
+}
+
+func (s *Snmp) set(m *service.MetricData, isTag bool, name string, value interface{}) {
+	if isTag {
+		m.Tags[name] = fmt.Sprint(value)
+		return
+	}
+	m.Fields[name] = value
+}
+
+// fieldName returns the configured name, else the translation of the OID or
+// of its longest translated parent, else the OID.
+func (s *Snmp) fieldName(name, oid string) string {
+	if name != "" {
+		return name
+	}
+	for prefix := oid; prefix != ""; {
+		if tr, ok := s.Translations[prefix]; ok {
+			return tr + strings.TrimPrefix(oid, prefix)
+		}
+		i := strings.LastIndex(prefix, ".")
+		if i < 0 {
+			break
+		}
+		prefix = prefix[:i]
+	}
+	return oid
+}
+
+// normalizeOid adds the leading dot the agents answer with.
+func normalizeOid(oid string) string {
+	if !strings.HasPrefix(oid, ".") {
+		return "." + oid
+	}
+	return oid
+}
+
+func (s *Snmp) connect(agent string) (*gosnmp.GoSNMP, error) {
+	host, portS, err := net.SplitHostPort(agent)
+	if err != nil {
+		host, portS = agent, "161"
+	}
+	port, err := strconv.ParseUint(portS, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", portS)
+	}
+
+	conn := &gosnmp.GoSNMP{
+		Target:    host,
+		Port:      uint16(port),
+		Community: s.Community,
+		Timeout:   s.Timeout.Duration,
+		Retries:   s.Retries,
+		MaxOids:   gosnmp.MaxOids,
+	}
+
+	switch s.Version {
+	case 1:
+		conn.Version = gosnmp.Version1
+	case 3:
+		conn.Version = gosnmp.Version3
+		conn.SecurityModel = gosnmp.UserSecurityModel
+		conn.MsgFlags, _ = s.msgFlags()
+		auth, _ := s.authProtocol()
+		priv, _ := s.privProtocol()
+		conn.SecurityParameters = &gosnmp.UsmSecurityParameters{
+			UserName:                 s.SecName,
+			AuthenticationProtocol:   auth,
+			AuthenticationPassphrase: s.AuthPassword,
+			PrivacyProtocol:          priv,
+			PrivacyPassphrase:        s.PrivPassword,
+		}
+	default:
+		conn.Version = gosnmp.Version2c
+	}
+
+	if err := conn.Connect(); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (s *Snmp) msgFlags() (gosnmp.SnmpV3MsgFlags, error) {
+	switch strings.ToLower(s.SecLevel) {
+	case "", "noauthnopriv":
+		return gosnmp.NoAuthNoPriv, nil
+	case "authnopriv":
+		return gosnmp.AuthNoPriv, nil
+	case "authpriv":
+		return gosnmp.AuthPriv, nil
+	default:
+		return 0, fmt.Errorf("invalid sec_level %s", s.SecLevel)
+	}
+}
+
+func (s *Snmp) authProtocol() (gosnmp.SnmpV3AuthProtocol, error) {
+	switch strings.ToUpper(s.AuthProtocol) {
+	case "":
+		return gosnmp.NoAuth, nil
+	case "MD5":
+		return gosnmp.MD5, nil
+	case "SHA":
+		return gosnmp.SHA, nil
+	default:
+		return 0, fmt.Errorf("invalid auth_protocol %s", s.AuthProtocol)
+	}
+}
+
+func (s *Snmp) privProtocol() (gosnmp.SnmpV3PrivProtocol, error) {
+	switch strings.ToUpper(s.PrivProtocol) {
+	case "":
+		return gosnmp.NoPriv, nil
+	case "DES":
+		return gosnmp.DES, nil
+	case "AES":
+		return gosnmp.AES, nil
+	default:
+		return 0, fmt.Errorf("invalid priv_protocol %s", s.PrivProtocol)
+	}
+}
+
+// convert returns the value of the PDU as a field value, false for the
+// missing objects.
+func convert(pdu gosnmp.SnmpPDU) (interface{}, bool) {
+	switch pdu.Type {
+	case gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView, gosnmp.Null:
+		return nil, false
+	case gosnmp.OctetString:
+		if b, ok := pdu.Value.([]byte); ok {
+			return string(b), true
+		}
+	case gosnmp.Integer:
+		return gosnmp.ToBigInt(pdu.Value).Int64(), true
+	case gosnmp.Counter32, gosnmp.Gauge32, gosnmp.TimeTicks, gosnmp.Counter64, gosnmp.Uinteger32:
+		return gosnmp.ToBigInt(pdu.Value).Uint64(), true
+	case gosnmp.OpaqueFloat:
+		if f, ok := pdu.Value.(float32); ok {
+			return float64(f), true
+		}
+	case gosnmp.OpaqueDouble:
+		if f, ok := pdu.Value.(float64); ok {
+			return f, true
+		}
+	}
+	if pdu.Value == nil {
+		return nil, false
+	}
+	return fmt.Sprint(pdu.Value), true
+}
+
+func init() {
+	service.AddInput("snmp", &Snmp{
+		Interval:  misc.Duration{Duration: time.Minute},
+		Timeout:   misc.Duration{Duration: 5 * time.Second},
+		Retries:   3,
+		Version:   2,
+		Community: "public",
+		Name:      "snmp",
+	})
+}
@@ -0,0 +1,236 @@
+package snmp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/gosnmp/gosnmp"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+// responder is a mock SNMP v2c agent answering the Get and GetBulk requests
+// from its objects.
+type responder struct {
+	conn    *net.UDPConn
+	objects map[string]gosnmp.SnmpPDU
+	oids    []string
+}
+
+func newResponder(t *testing.T, pdus ...gosnmp.SnmpPDU) *responder {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &responder{conn: conn, objects: make(map[string]gosnmp.SnmpPDU)}
+	for _, pdu := range pdus {
+		r.objects[pdu.Name] = pdu
+		r.oids = append(r.oids, pdu.Name)
+	}
+	sort.Slice(r.oids, func(i, j int) bool { return oidLess(r.oids[i], r.oids[j]) })
+	go r.serve()
+	return r
+}
+
+func (r *responder) addr() string {
+	return r.conn.LocalAddr().String()
+}
+
+func (r *responder) close() {
+	r.conn.Close()
+}
+
+// oidLess compares the OIDs number by number.
+func oidLess(a, b string) bool {
+	as, bs := strings.Split(strings.Trim(a, "."), "."), strings.Split(strings.Trim(b, "."), ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.Atoi(as[i])
+		y, _ := strconv.Atoi(bs[i])
+		if x != y {
+			return x < y
+		}
+	}
+	return len(as) < len(bs)
+}
+
+func (r *responder) serve() {
+	decoder := &gosnmp.GoSNMP{Version: gosnmp.Version2c, Community: "public"}
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req, err := decoder.SnmpDecodePacket(buf[:n])
+		if err != nil || req.Community != "public" {
+			continue
+		}
+
+		resp := &gosnmp.SnmpPacket{
+			Version:   req.Version,
+			Community: req.Community,
+			PDUType:   gosnmp.GetResponse,
+			RequestID: req.RequestID,
+		}
+		// the decoder loses the max repetitions of the GetBulk requests
+		reps := int(req.MaxRepetitions)
+		if reps == 0 {
+			reps = 3
+		}
+		for _, v := range req.Variables {
+			switch req.PDUType {
+			case gosnmp.GetRequest:
+				pdu, ok := r.objects[v.Name]
+				if !ok {
+					pdu = gosnmp.SnmpPDU{Name: v.Name, Type: gosnmp.NoSuchObject}
+				}
+				resp.Variables = append(resp.Variables, pdu)
+			case gosnmp.GetBulkRequest:
+				resp.Variables = append(resp.Variables, r.next(v.Name, reps)...)
+			}
+		}
+		b, err := resp.MarshalMsg()
+		if err != nil {
+			continue
+		}
+		r.conn.WriteToUDP(b, addr)
+	}
+}
+
+// next returns the n objects following the OID, ending with the end of the
+// MIB view.
+func (r *responder) next(oid string, n int) []gosnmp.SnmpPDU {
+	var pdus []gosnmp.SnmpPDU
+	i := sort.Search(len(r.oids), func(i int) bool { return oidLess(oid, r.oids[i]) })
+	for ; i < len(r.oids) && len(pdus) < n; i++ {
+		pdus = append(pdus, r.objects[r.oids[i]])
+	}
+	if len(pdus) < n {
+		pdus = append(pdus, gosnmp.SnmpPDU{Name: oid, Type: gosnmp.EndOfMibView})
+	}
+	return pdus
+}
+
+func newSnmp(agents ...string) *Snmp {
+	return &Snmp{
+		Agents:    agents,
+		Interval:  misc.Duration{Duration: time.Minute},
+		Timeout:   misc.Duration{Duration: 200 * time.Millisecond},
+		Version:   2,
+		Community: "public",
+		Name:      "snmp",
+		Fields: []*Field{
+			{Name: "sysName", Oid: ".1.3.6.1.2.1.1.5.0", IsTag: true},
+			{Oid: "1.3.6.1.2.1.1.3.0"},
+			{Name: "missing", Oid: ".1.3.6.1.2.1.1.9.0"},
+		},
+		Tables: []*Table{{
+			Name: "interface",
+			Fields: []*Field{
+				{Name: "ifDescr", Oid: ".1.3.6.1.2.1.2.2.1.2", IsTag: true},
+				{Oid: ".1.3.6.1.2.1.2.2.1.10"},
+			},
+		}},
+		Translations: map[string]string{
+			".1.3.6.1.2.1.1.3":      "sysUpTime",
+			".1.3.6.1.2.1.2.2.1.10": "ifInOctets",
+		},
+	}
+}
+
+var agentObjects = []gosnmp.SnmpPDU{
+	{Name: ".1.3.6.1.2.1.1.3.0", Type: gosnmp.TimeTicks, Value: uint32(12345)},
+	{Name: ".1.3.6.1.2.1.1.5.0", Type: gosnmp.OctetString, Value: []byte("switch01")},
+	{Name: ".1.3.6.1.2.1.2.2.1.2.1", Type: gosnmp.OctetString, Value: []byte("eth0")},
+	{Name: ".1.3.6.1.2.1.2.2.1.2.2", Type: gosnmp.OctetString, Value: []byte("eth1")},
+	{Name: ".1.3.6.1.2.1.2.2.1.10.1", Type: gosnmp.Counter32, Value: uint32(100)},
+	{Name: ".1.3.6.1.2.1.2.2.1.10.2", Type: gosnmp.Counter32, Value: uint32(200)},
+	// the next column, not part of the table
+	{Name: ".1.3.6.1.2.1.2.2.1.11.1", Type: gosnmp.Counter32, Value: uint32(1)},
+}
+
+func TestGatherAgent(t *testing.T) {
+	r := newResponder(t, agentObjects...)
+	defer r.close()
+
+	s := newSnmp(r.addr())
+	if err := s.check(); err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := s.gatherAgent(r.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, m := range metrics {
+		got = append(got, fmt.Sprint(m.Name, " ", m.Tags, " ", m.Fields))
+	}
+	want := []string{
+		"snmp map[agent_host:127.0.0.1 sysName:switch01] map[sysUpTime.0:12345]",
+		"interface map[agent_host:127.0.0.1 ifDescr:eth0 index:1] map[ifInOctets:100]",
+		"interface map[agent_host:127.0.0.1 ifDescr:eth1 index:2] map[ifInOctets:200]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got metrics\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestUnreachableAgent(t *testing.T) {
+	// nothing answers on the port of the closed responder
+	r := newResponder(t)
+	r.close()
+
+	s := newSnmp(r.addr())
+	start := time.Now()
+	if _, err := s.gatherAgent(r.addr()); err == nil {
+		t.Error("no error from the unreachable agent")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("unreachable agent blocked for %s", elapsed)
+	}
+}
+
+func TestFieldName(t *testing.T) {
+	s := newSnmp()
+	for _, tt := range []struct {
+		name, oid, want string
+	}{
+		{"uptime", ".1.3.6.1.2.1.1.3.0", "uptime"},
+		{"", ".1.3.6.1.2.1.1.3.0", "sysUpTime.0"},
+		{"", ".1.3.6.1.2.1.2.2.1.10", "ifInOctets"},
+		{"", ".1.3.6.1.2.1.2.2.1.10.7", "ifInOctets.7"},
+		{"", ".1.3.6.1.4.1.9", ".1.3.6.1.4.1.9"},
+	} {
+		if got := s.fieldName(tt.name, tt.oid); got != tt.want {
+			t.Errorf("%q %s, got %s, want %s", tt.name, tt.oid, got, tt.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for _, s := range []*Snmp{
+		{Interval: misc.Duration{Duration: time.Minute}, Version: 2},
+		{Agents: []string{"a"}, Interval: misc.Duration{Duration: time.Minute}, Version: 4},
+		{Agents: []string{"a"}, Interval: misc.Duration{Duration: time.Minute}, Version: 3, SecLevel: "secret"},
+		{Agents: []string{"a"}, Interval: misc.Duration{Duration: time.Minute}, Version: 3, AuthProtocol: "SHA512"},
+		{Agents: []string{"a"}, Interval: misc.Duration{Duration: time.Minute}, Version: 2, Fields: []*Field{{Name: "x"}}},
+		{Agents: []string{"a"}, Interval: misc.Duration{Duration: time.Minute}, Version: 2, Tables: []*Table{{Name: "t"}}},
+	} {
+		if err := s.check(); err == nil {
+			t.Errorf("config %+v accepted", s)
+		}
+	}
+}
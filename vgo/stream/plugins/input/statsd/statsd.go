@@ -0,0 +1,542 @@
+package statsd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+// udpMaxPacketSize is the largest UDP payload
+const udpMaxPacketSize = 64 * 1024
+
+// Statsd receives the StatsD metrics and aggregates them over the
+// interval. Every bucket gives a metric of its name tagged with its type:
+// the counters and gauges have a "value" field, the sets the number of
+// distinct values, the timers and histograms the count, lower, upper,
+// mean, stddev, sum and <p>_percentile fields.
+type Statsd struct {
+	// Protocol is "udp" or "tcp"
+	Protocol       string
+	ServiceAddress string
+	Interval       misc.Duration
+	// Percentiles of the timers, e.g. 90.0 gives the 90_percentile field
+	Percentiles []float64
+	// PercentileLimit is the number of values of a timer kept to compute
+	// its percentiles, sampled over it
+	PercentileLimit int
+	// Delete* forget the metrics of the type after every flush, otherwise
+	// their last value is sent again until vgo restarts: the counters send
+	// zero, the sets and timings the fields of their last interval
+	DeleteCounters bool
+	DeleteGauges   bool
+	DeleteSets     bool
+	DeleteTimings  bool
+	// DataDogExtensions parses the DogStatsD tags: "|#env:prod,region"
+	DataDogExtensions bool `toml:"datadog_extensions"`
+	// AllowedPendingMessages is the number of lines waiting for the
+	// parser, the lines over it are dropped
+	AllowedPendingMessages int
+	MaxTCPConnections      int `toml:"max_tcp_connections"`
+
+	StopC  chan bool
+	WriteC chan service.Metrics
+
+	stop chan bool
+	// closed is closed once the listener is closed
+	closed   chan bool
+	lines    chan string
+	listener net.Listener
+	conn     *net.UDPConn
+
+	sync.Mutex
+	counters map[string]*counter
+	gauges   map[string]*gauge
+	sets     map[string]*set
+	timings  map[string]*timing
+}
+
+// bucket is the name and tags of an aggregated metric
+type bucket struct {
+	name string
+	tags map[string]string
+}
+
+type counter struct {
+	bucket
+	value float64
+}
+
+type gauge struct {
+	bucket
+	value float64
+}
+
+type set struct {
+	bucket
+	values map[string]struct{}
+	// last is the number of values of the last interval having some
+	last int64
+}
+
+type timing struct {
+	bucket
+	count    float64
+	sum      float64
+	sumSq    float64
+	min, max float64
+	// samples are a sample of at most PercentileLimit values
+	samples []float64
+	seen    int
+	// last are the fields of the last interval having values
+	last map[string]interface{}
+}
+
+var sampleConfig = `
+  ## "udp" or "tcp"
+  protocol = "udp"
+  service_address = ":8125"
+  ## The metrics are aggregated over the interval
+  interval = "10s"
+  ## Percentiles of the timers
+  percentiles = [90.0]
+  # percentile_limit = 1000
+  ## Forget the metrics after every flush, else their last value is sent
+  ## again at every interval
+  delete_counters = true
+  delete_gauges = true
+  delete_sets = true
+  delete_timings = true
+  ## Parse the DogStatsD tags: "|#env:prod,region"
+  # datadog_extensions = false
+  # allowed_pending_messages = 10000
+  # max_tcp_connections = 250
+`
+
+// Init init statsd
+func (s *Statsd) Init(stopC chan bool, writeC chan service.Metrics) {
+	s.StopC = stopC
+	s.WriteC = writeC
+	s.stop = make(chan bool)
+	s.closed = make(chan bool)
+}
+
+// Start start statsd
+func (s *Statsd) Start() {
+	log.Println("statsd Start")
+	defer close(s.closed)
+	s.reset(true)
+	s.lines = make(chan string, s.AllowedPendingMessages)
+
+	var err error
+	switch s.Protocol {
+	case "udp":
+		err = s.listenUDP()
+	case "tcp":
+		err = s.listenTCP()
+	default:
+		err = fmt.Errorf("invalid protocol %s", s.Protocol)
+	}
+	if err != nil {
+		log.Fatal("[FATAL] statsd listen failed, err message is ", err)
+	}
+	go s.parseLoop()
+
+	ticker := service.CollectionTicker(s.Interval.Duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			s.close()
+			return
+		case <-s.StopC:
+			s.close()
+			return
+		}
+	}
+}
+
+// Stop stops listening, it returns once the address is released.
+func (s *Statsd) Stop() {
+	close(s.stop)
+	<-s.closed
+}
+
+func (s *Statsd) close() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func (s *Statsd) listenUDP() error {
+	addr, err := net.ResolveUDPAddr("udp", s.ServiceAddress)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	log.Println("statsd listening on udp ", conn.LocalAddr())
+
+	go func() {
+		buf := make([]byte, udpMaxPacketSize)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				// closed on stop
+				return
+			}
+			for _, line := range strings.Split(string(buf[:n]), "\n") {
+				s.enqueue(line)
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *Statsd) listenTCP() error {
+	l, err := net.Listen("tcp", s.ServiceAddress)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	log.Println("statsd listening on tcp ", l.Addr())
+
+	// the connections over MaxTCPConnections are refused
+	slots := make(chan struct{}, s.MaxTCPConnections)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				// closed on stop
+				return
+			}
+			select {
+			case slots <- struct{}{}:
+			default:
+				service.VLogger.Warn("statsd too many tcp connections, refused", zap.String("remote", conn.RemoteAddr().String()))
+				conn.Close()
+				continue
+			}
+
+			go func() {
+				defer func() {
+					conn.Close()
+					<-slots
+				}()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					s.enqueue(scanner.Text())
+				}
+			}()
+		}
+	}()
+	return nil
+}
+
+// enqueue hands the line to the parser, it's dropped when the parser lags.
+func (s *Statsd) enqueue(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	select {
+	case s.lines <- line:
+	default:
+		service.VLogger.Warn("statsd too many pending lines, dropped", zap.Int("allowed_pending_messages", s.AllowedPendingMessages))
+	}
+}
+
+func (s *Statsd) parseLoop() {
+	for {
+		select {
+		case line := <-s.lines:
+			if err := s.parseLine(line); err != nil {
+				service.VLogger.Debug("statsd invalid line", zap.String("line", line), zap.Error(err))
+			}
+		case <-s.stop:
+			return
+		case <-s.StopC:
+			return
+		}
+	}
+}
+
+// parseLine aggregates a line: <bucket>:<value>|<type>[|@<rate>][|#<tags>]
+func (s *Statsd) parseLine(line string) error {
+	colon := strings.IndexByte(line, ':')
+	if colon <= 0 {
+		return errors.New("no bucket")
+	}
+	name := line[:colon]
+	parts := strings.Split(line[colon+1:], "|")
+	if len(parts) < 2 {
+		return errors.New("no type")
+	}
+	value, typ := parts[0], parts[1]
+
+	rate := 1.0
+	tags := make(map[string]string)
+	for _, p := range parts[2:] {
+		switch {
+		case strings.HasPrefix(p, "@"):
+			r, err := strconv.ParseFloat(p[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return fmt.Errorf("invalid sample rate %s", p)
+			}
+			rate = r
+		case strings.HasPrefix(p, "#") && s.DataDogExtensions:
+			parseTags(p[1:], tags)
+		}
+	}
+
+	b := bucket{name: name, tags: tags}
+	key := (&service.MetricData{Name: name, Tags: tags}).SeriesKey()
+
+	s.Lock()
+	defer s.Unlock()
+
+	switch typ {
+	case "c":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		c, ok := s.counters[key]
+		if !ok {
+			c = &counter{bucket: b}
+			s.counters[key] = c
+		}
+		c.value += v / rate
+	case "g":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		g, ok := s.gauges[key]
+		if !ok {
+			g = &gauge{bucket: b}
+			s.gauges[key] = g
+		}
+		// a signed value changes the gauge
+		if value[0] == '+' || value[0] == '-' {
+			g.value += v
+		} else {
+			g.value = v
+		}
+	case "s":
+		st, ok := s.sets[key]
+		if !ok {
+			st = &set{bucket: b, values: make(map[string]struct{})}
+			s.sets[key] = st
+		}
+		st.values[value] = struct{}{}
+	case "ms", "h":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		t, ok := s.timings[key]
+		if !ok {
+			t = &timing{bucket: b, min: v, max: v}
+			s.timings[key] = t
+		}
+		t.add(v, rate, s.PercentileLimit)
+	default:
+		return fmt.Errorf("invalid type %s", typ)
+	}
+	return nil
+}
+
+// parseTags parses the DogStatsD tags, a tag without value is "true".
+func parseTags(s string, tags map[string]string) {
+	for _, tag := range strings.Split(s, ",") {
+		if tag == "" {
+			continue
+		}
+		if i := strings.IndexByte(tag, ':'); i > 0 {
+			tags[tag[:i]] = tag[i+1:]
+		} else {
+			tags[tag] = "true"
+		}
+	}
+}
+
+// add records a value, a sampled value counts for 1/rate values.
+func (t *timing) add(v, rate float64, limit int) {
+	n := 1 / rate
+	t.count += n
+	t.sum += v * n
+	t.sumSq += v * v * n
+	t.min = math.Min(t.min, v)
+	t.max = math.Max(t.max, v)
+
+	// reservoir sampling keeps a uniform sample of the values
+	t.seen++
+	if len(t.samples) < limit {
+		t.samples = append(t.samples, v)
+	} else if i := rand.Intn(t.seen); i < limit {
+		t.samples[i] = v
+	}
+}
+
+// clear starts a new interval, the last fields are kept.
+func (t *timing) clear() {
+	t.count, t.sum, t.sumSq = 0, 0, 0
+	t.min, t.max = math.Inf(1), math.Inf(-1)
+	t.samples = t.samples[:0]
+	t.seen = 0
+}
+
+// fields returns the statistics of the timing.
+func (t *timing) fields(percentiles []float64) map[string]interface{} {
+	mean := t.sum / t.count
+	variance := t.sumSq/t.count - mean*mean
+	fields := map[string]interface{}{
+		"count":  t.count,
+		"lower":  t.min,
+		"upper":  t.max,
+		"mean":   mean,
+		"stddev": math.Sqrt(math.Max(variance, 0)),
+		"sum":    t.sum,
+	}
+
+	sorted := make([]float64, len(t.samples))
+	copy(sorted, t.samples)
+	sort.Float64s(sorted)
+	for _, p := range percentiles {
+		name := strconv.FormatFloat(p, 'f', -1, 64) + "_percentile"
+		fields[name] = percentile(sorted, p)
+	}
+	return fields
+}
+
+// percentile returns the nearest rank percentile of the sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// flush publishes the aggregated metrics.
+func (s *Statsd) flush() {
+	now := time.Now()
+
+	s.Lock()
+	var metrics []*service.MetricData
+	add := func(b bucket, typ string, fields map[string]interface{}) {
+		tags := make(map[string]string, len(b.tags)+1)
+		for k, v := range b.tags {
+			tags[k] = v
+		}
+		tags["metric_type"] = typ
+		// the fields kept for the next intervals are modified in place by
+		// the processors, every metric gets its own copy
+		copied := make(map[string]interface{}, len(fields))
+		for k, v := range fields {
+			copied[k] = v
+		}
+		metrics = append(metrics, &service.MetricData{Name: b.name, Tags: tags, Fields: copied, Time: now})
+	}
+	for _, c := range s.counters {
+		add(c.bucket, "counter", map[string]interface{}{"value": c.value})
+	}
+	for _, g := range s.gauges {
+		add(g.bucket, "gauge", map[string]interface{}{"value": g.value})
+	}
+	for _, st := range s.sets {
+		if len(st.values) > 0 {
+			st.last = int64(len(st.values))
+		}
+		add(st.bucket, "set", map[string]interface{}{"value": st.last})
+	}
+	for _, t := range s.timings {
+		if t.count > 0 {
+			t.last = t.fields(s.Percentiles)
+		}
+		add(t.bucket, "timing", t.last)
+	}
+	s.reset(false)
+	s.Unlock()
+
+	if len(metrics) == 0 {
+		return
+	}
+	service.InputStats("statsd").Gathered(len(metrics))
+	service.Publish(service.Metrics{Data: metrics, Interval: int(s.Interval.Duration / time.Second)})
+}
+
+// reset forgets the metrics of the types to delete after a flush, all of
+// them when all is set. The counters kept start over from zero, the sets
+// and timings kept start a new interval and send their last fields again
+// until they get new values.
+func (s *Statsd) reset(all bool) {
+	if all || s.DeleteCounters {
+		s.counters = make(map[string]*counter)
+	} else {
+		for _, c := range s.counters {
+			c.value = 0
+		}
+	}
+	if all || s.DeleteGauges {
+		s.gauges = make(map[string]*gauge)
+	}
+	if all || s.DeleteSets {
+		s.sets = make(map[string]*set)
+	} else {
+		for _, st := range s.sets {
+			st.values = make(map[string]struct{})
+		}
+	}
+	if all || s.DeleteTimings {
+		s.timings = make(map[string]*timing)
+	} else {
+		for _, t := range s.timings {
+			t.clear()
+		}
+	}
+}
+
+func init() {
+	service.AddInput("statsd", &Statsd{
+		Protocol:               "udp",
+		ServiceAddress:         ":8125",
+		Interval:               misc.Duration{Duration: 10 * time.Second},
+		Percentiles:            []float64{90},
+		PercentileLimit:        1000,
+		DeleteCounters:         true,
+		DeleteGauges:           true,
+		DeleteSets:             true,
+		DeleteTimings:          true,
+		AllowedPendingMessages: 10000,
+		MaxTCPConnections:      250,
+	})
+}
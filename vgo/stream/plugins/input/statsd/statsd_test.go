@@ -0,0 +1,329 @@
+package statsd
+
+import (
+	"io/ioutil"
+	"math"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/corego/vgo/vgo/stream/service/servicetest"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+func newStatsd() *Statsd {
+	s := &Statsd{Percentiles: []float64{50, 90, 99.9}, PercentileLimit: 1000}
+	s.reset(true)
+	return s
+}
+
+// parse aggregates the lines, they must be valid.
+func parse(t *testing.T, s *Statsd, lines ...string) {
+	for _, line := range lines {
+		if err := s.parseLine(line); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+	}
+}
+
+// flushed flushes the statsd and returns its metrics by name and type.
+func flushed(t *testing.T, s *Statsd, r *servicetest.Recorder) map[string]*service.MetricData {
+	s.flush()
+	metrics := make(map[string]*service.MetricData)
+	deadline := time.Now().Add(time.Second)
+	for {
+		for _, m := range r.Take() {
+			metrics[m.Name+" "+m.Tags["metric_type"]] = m
+		}
+		if len(metrics) > 0 || time.Now().After(deadline) {
+			return metrics
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func field(t *testing.T, metrics map[string]*service.MetricData, key, name string) interface{} {
+	m, ok := metrics[key]
+	if !ok {
+		t.Fatalf("no metric %s in %v", key, metrics)
+	}
+	return m.Fields[name]
+}
+
+func TestCounter(t *testing.T) {
+	r := &servicetest.Recorder{}
+	stop := servicetest.StartPipeline(r)
+	defer stop()
+	s := newStatsd()
+
+	// a sampled value counts for 1/rate values
+	parse(t, s, "requests:1|c", "requests:2|c", "requests:1|c|@0.25")
+	if v := field(t, flushed(t, s, r), "requests counter", "value"); v != 7.0 {
+		t.Errorf("got counter %v, want 7", v)
+	}
+
+	// kept, it starts over from zero
+	if v := field(t, flushed(t, s, r), "requests counter", "value"); v != 0.0 {
+		t.Errorf("got counter %v after the flush, want 0", v)
+	}
+
+	s.DeleteCounters = true
+	parse(t, s, "requests:3|c")
+	flushed(t, s, r)
+	if m := flushed(t, s, r); len(m) != 0 {
+		t.Errorf("got metrics %v, want the counter deleted", m)
+	}
+}
+
+func TestGauge(t *testing.T) {
+	r := &servicetest.Recorder{}
+	stop := servicetest.StartPipeline(r)
+	defer stop()
+	s := newStatsd()
+
+	// a signed value changes the gauge
+	parse(t, s, "load:10|g", "load:+5|g", "load:-3|g")
+	if v := field(t, flushed(t, s, r), "load gauge", "value"); v != 12.0 {
+		t.Errorf("got gauge %v, want 12", v)
+	}
+	// kept, its last value is sent again
+	if v := field(t, flushed(t, s, r), "load gauge", "value"); v != 12.0 {
+		t.Errorf("got gauge %v after the flush, want 12", v)
+	}
+	parse(t, s, "load:4|g")
+	if v := field(t, flushed(t, s, r), "load gauge", "value"); v != 4.0 {
+		t.Errorf("got gauge %v, want 4", v)
+	}
+
+	s.DeleteGauges = true
+	flushed(t, s, r)
+	if m := flushed(t, s, r); len(m) != 0 {
+		t.Errorf("got metrics %v, want the gauge deleted", m)
+	}
+}
+
+func TestSet(t *testing.T) {
+	r := &servicetest.Recorder{}
+	stop := servicetest.StartPipeline(r)
+	defer stop()
+	s := newStatsd()
+
+	parse(t, s, "users:alice|s", "users:bob|s", "users:alice|s")
+	if v := field(t, flushed(t, s, r), "users set", "value"); v != int64(2) {
+		t.Errorf("got set %v, want 2", v)
+	}
+	// kept without values, the last count is sent again
+	if v := field(t, flushed(t, s, r), "users set", "value"); v != int64(2) {
+		t.Errorf("got set %v after the flush, want 2", v)
+	}
+	parse(t, s, "users:carol|s")
+	if v := field(t, flushed(t, s, r), "users set", "value"); v != int64(1) {
+		t.Errorf("got set %v, want 1", v)
+	}
+}
+
+func TestTiming(t *testing.T) {
+	r := &servicetest.Recorder{}
+	stop := servicetest.StartPipeline(r)
+	defer stop()
+
+	for _, typ := range []string{"ms", "h"} {
+		s := newStatsd()
+		// 100 to 1, not in order
+		for v := 100; v > 0; v-- {
+			parse(t, s, "latency:"+strconv.Itoa(v)+"|"+typ)
+		}
+
+		metrics := flushed(t, s, r)
+		for name, want := range map[string]float64{
+			"count":           100,
+			"lower":           1,
+			"upper":           100,
+			"mean":            50.5,
+			"sum":             5050,
+			"stddev":          math.Sqrt(9999.0 / 12),
+			"50_percentile":   50,
+			"90_percentile":   90,
+			"99.9_percentile": 100,
+		} {
+			got, ok := field(t, metrics, "latency timing", name).(float64)
+			if !ok || math.Abs(got-want) > 1e-9 {
+				t.Errorf("%s: got %s %v, want %v", typ, name, got, want)
+			}
+		}
+
+		// a processor rescales the fields in place, the fields sent again
+		// aren't affected
+		metrics["latency timing"].Fields["count"] = 0.1
+
+		// kept without values, the last fields are sent again
+		if v := field(t, flushed(t, s, r), "latency timing", "count"); v != 100.0 {
+			t.Errorf("%s: got count %v after the flush, want 100", typ, v)
+		}
+	}
+}
+
+func TestTimingSampled(t *testing.T) {
+	s := newStatsd()
+	s.PercentileLimit = 10
+	parse(t, s, "latency:10|ms|@0.1", "latency:30|ms|@0.1")
+	for v := 0; v < 100; v++ {
+		parse(t, s, "latency:20|ms")
+	}
+
+	tm := s.timings["latency"]
+	fields := tm.fields(s.Percentiles)
+	// each sampled value counts for ten
+	if fields["count"] != 120.0 || fields["sum"] != 2400.0 || fields["mean"] != 20.0 {
+		t.Errorf("got fields %v, want count 120, sum 2400 and mean 20", fields)
+	}
+	if fields["lower"] != 10.0 || fields["upper"] != 30.0 {
+		t.Errorf("got lower %v and upper %v, want 10 and 30", fields["lower"], fields["upper"])
+	}
+	if len(tm.samples) != 10 {
+		t.Errorf("%d values kept for the percentiles, want the limit 10", len(tm.samples))
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for _, tt := range []struct {
+		p    float64
+		want float64
+	}{
+		{0, 1},
+		{10, 1},
+		{11, 2},
+		{50, 5},
+		{90, 9},
+		{95, 10},
+		{100, 10},
+	} {
+		if got := percentile(sorted, tt.p); got != tt.want {
+			t.Errorf("percentile %v, got %v, want %v", tt.p, got, tt.want)
+		}
+	}
+
+	if got := percentile(nil, 90); got != 0 {
+		t.Errorf("percentile of no values, got %v, want 0", got)
+	}
+	if got := percentile([]float64{42}, 90); got != 42 {
+		t.Errorf("percentile of one value, got %v, want 42", got)
+	}
+
+	// the values are sorted before
+	values := []float64{5, 3, 9, 1, 7}
+	tm := &timing{min: values[0], max: values[0]}
+	for _, v := range values {
+		tm.add(v, 1, 100)
+	}
+	if got := tm.fields([]float64{60})["60_percentile"]; got != 5.0 {
+		t.Errorf("60th percentile of %v, got %v, want 5", values, got)
+	}
+}
+
+func TestDataDogTags(t *testing.T) {
+	r := &servicetest.Recorder{}
+	stop := servicetest.StartPipeline(r)
+	defer stop()
+	s := newStatsd()
+
+	// ignored without the extensions
+	parse(t, s, "requests:1|c|#env:prod,canary")
+	m := flushed(t, s, r)["requests counter"]
+	if m == nil || len(m.Tags) != 1 {
+		t.Fatalf("got metric %v, want only the metric_type tag", m)
+	}
+
+	s.DataDogExtensions = true
+	s.DeleteCounters = true
+	parse(t, s, "requests:1|c|@0.5|#env:prod,canary", "requests:1|c|#env:dev")
+	var prod, dev *service.MetricData
+	s.flush()
+	deadline := time.Now().Add(time.Second)
+	for (prod == nil || dev == nil) && time.Now().Before(deadline) {
+		for _, m := range r.Take() {
+			switch m.Tags["env"] {
+			case "prod":
+				prod = m
+			case "dev":
+				dev = m
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if prod == nil || dev == nil {
+		t.Fatal("no metric of each tag set")
+	}
+	if prod.Tags["canary"] != "true" || prod.Fields["value"] != 2.0 {
+		t.Errorf("got prod metric %v", prod)
+	}
+	if dev.Fields["value"] != 1.0 {
+		t.Errorf("got dev metric %v", dev)
+	}
+}
+
+func TestInvalidLines(t *testing.T) {
+	s := newStatsd()
+	for _, line := range []string{
+		"requests",
+		":1|c",
+		"requests:1",
+		"requests:x|c",
+		"requests:1|q",
+		"requests:1|c|@0",
+		"requests:1|c|@2",
+		"load:x|g",
+		"latency:x|ms",
+	} {
+		if err := s.parseLine(line); err == nil {
+			t.Errorf("invalid line %q accepted", line)
+		}
+	}
+	if len(s.counters)+len(s.gauges)+len(s.timings) != 0 {
+		t.Error("invalid lines aggregated")
+	}
+}
+
+func TestMultiMetricPacket(t *testing.T) {
+	s := newStatsd()
+	s.ServiceAddress = "127.0.0.1:0"
+	s.AllowedPendingMessages = 10
+	s.lines = make(chan string, s.AllowedPendingMessages)
+	if err := s.listenUDP(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	conn, err := net.Dial("udp", s.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("requests:1|c\nload:3|g\n\nlatency:20|ms\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for len(got) < 3 {
+		select {
+		case line := <-s.lines:
+			got = append(got, line)
+		case <-time.After(time.Second):
+			t.Fatalf("got lines %v, want 3", got)
+		}
+	}
+	want := []string{"requests:1|c", "load:3|g", "latency:20|ms"}
+	for n := range want {
+		if got[n] != want[n] {
+			t.Errorf("got lines %v, want %v", got, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package tail
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// grokPatterns are the %{NAME} usable in the patterns
+var grokPatterns = map[string]string{
+	"INT":               `[+-]?\d+`,
+	"NUMBER":            `[+-]?(?:\d+(?:\.\d*)?|\.\d+)(?:[eE][+-]?\d+)?`,
+	"WORD":              `\w+`,
+	"NOTSPACE":          `\S+`,
+	"SPACE":             `\s*`,
+	"DATA":              `.*?`,
+	"GREEDYDATA":        `.*`,
+	"QUOTEDSTRING":      `"(?:[^"\\]|\\.)*"`,
+	"IP":                `(?:\d{1,3}\.){3}\d{1,3}`,
+	"HOSTNAME":          `[0-9A-Za-z][0-9A-Za-z\-\.]*`,
+	"USER":              `[a-zA-Z0-9._-]+`,
+	"URIPATH":           `/[^\s?#]*`,
+	"LOGLEVEL":          `(?i:trace|debug|info|notice|warn(?:ing)?|error|crit(?:ical)?|fatal|panic)`,
+	"TIMESTAMP_ISO8601": `\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:\.\d+)?(?:Z|[+-]\d{2}:?\d{2})?`,
+	"HTTPDATE":          `\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}`,
+}
+
+// grokRe matches %{NAME}, %{NAME:capture} and %{NAME:capture:type}
+var grokRe = regexp.MustCompile(`%\{(\w+)(?::(\w+))?(?::(\w+))?\}`)
+
+const (
+	typeAuto   = ""
+	typeTag    = "tag"
+	typeInt    = "int"
+	typeFloat  = "float"
+	typeString = "string"
+)
+
+type pattern struct {
+	re *regexp.Regexp
+	// types of the captures, the captures without a type are auto typed
+	types map[string]string
+}
+
+// parser extracts a metric from a line with the first matching pattern.
+// The named captures are fields, or tags when listed in tags or typed tag.
+type parser struct {
+	name       string
+	patterns   []*pattern
+	tags       map[string]bool
+	timeField  string
+	timeFormat string
+}
+
+func newParser(name string, patterns, tags []string, timeField, timeFormat string) (*parser, error) {
+	p := &parser{
+		name:       name,
+		tags:       make(map[string]bool, len(tags)),
+		timeField:  timeField,
+		timeFormat: timeFormat,
+	}
+	for _, t := range tags {
+		p.tags[t] = true
+	}
+	for _, s := range patterns {
+		pat, err := compilePattern(s)
+		if err != nil {
+			return nil, err
+		}
+		p.patterns = append(p.patterns, pat)
+	}
+	return p, nil
+}
+
+// compilePattern expands the grok patterns of s and compiles it.
+func compilePattern(s string) (*pattern, error) {
+	pat := &pattern{types: make(map[string]string)}
+
+	var err error
+	expanded := grokRe.ReplaceAllStringFunc(s, func(m string) string {
+		sub := grokRe.FindStringSubmatch(m)
+		re, ok := grokPatterns[sub[1]]
+		if !ok {
+			err = fmt.Errorf("unknown pattern %s", sub[1])
+			return m
+		}
+		if sub[2] == "" {
+			return "(?:" + re + ")"
+		}
+		switch sub[3] {
+		case typeAuto, typeTag, typeInt, typeFloat, typeString:
+		default:
+			err = fmt.Errorf("invalid type %s of %s", sub[3], sub[2])
+			return m
+		}
+		pat.types[sub[2]] = sub[3]
+		return "(?P<" + sub[2] + ">" + re + ")"
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if pat.re, err = regexp.Compile(expanded); err != nil {
+		return nil, err
+	}
+	return pat, nil
+}
+
+// parse returns the metric of the line, false if no pattern matches it or
+// it captures no field.
+func (p *parser) parse(line string) (*service.MetricData, bool) {
+	for _, pat := range p.patterns {
+		match := pat.re.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		m := &service.MetricData{
+			Name:   p.name,
+			Tags:   make(map[string]string),
+			Fields: make(map[string]interface{}),
+			Time:   time.Now(),
+		}
+		for i, name := range pat.re.SubexpNames() {
+			if name == "" || i >= len(match) {
+				continue
+			}
+			v := match[i]
+			if name == p.timeField {
+				if t, err := time.Parse(p.timeFormat, v); err == nil {
+					m.Time = t
+				}
+				continue
+			}
+
+			typ := pat.types[name]
+			if typ == typeTag || p.tags[name] {
+				m.Tags[name] = v
+				continue
+			}
+			if f, ok := convert(v, typ); ok {
+				m.Fields[name] = f
+			}
+		}
+
+		if len(m.Fields) == 0 {
+			return nil, false
+		}
+		return m, true
+	}
+	return nil, false
+}
+
+// convert types the captured value, the auto type gives an int, a float
+// or a string.
+func convert(v, typ string) (interface{}, bool) {
+	switch typ {
+	case typeInt:
+		i, err := strconv.ParseInt(v, 10, 64)
+		return i, err == nil
+	case typeFloat:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	case typeString:
+		return v, true
+	}
+
+	if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return i, true
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		return f, true
+	}
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return nil, false
+	}
+	return v, true
+}
@@ -0,0 +1,97 @@
+package tail
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	p, err := newParser("nginx", []string{
+		`^%{IP:client:tag} "%{WORD:method} %{URIPATH:url}" %{INT:status:string} %{NUMBER:latency:float} %{INT:bytes} \[%{TIMESTAMP_ISO8601:time}\]$`,
+		`^%{LOGLEVEL:level} %{GREEDYDATA:msg}$`,
+	}, []string{"method"}, "time", time.RFC3339)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		line   string
+		tags   map[string]string
+		fields map[string]interface{}
+		time   time.Time
+	}{
+		{
+			`10.0.0.1 "GET /index.html" 200 12 512 [2017-07-14T02:40:00Z]`,
+			map[string]string{"client": "10.0.0.1", "method": "GET"},
+			map[string]interface{}{"url": "/index.html", "status": "200", "latency": 12.0, "bytes": int64(512)},
+			time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC),
+		},
+		// the second pattern, the auto type gives a string
+		{
+			`error disk full`,
+			map[string]string{},
+			map[string]interface{}{"level": "error", "msg": "disk full"},
+			time.Time{},
+		},
+	} {
+		m, ok := p.parse(tt.line)
+		if !ok {
+			t.Errorf("%s not parsed", tt.line)
+			continue
+		}
+		if m.Name != "nginx" || !reflect.DeepEqual(m.Tags, tt.tags) || !reflect.DeepEqual(m.Fields, tt.fields) {
+			t.Errorf("%s, got %s %v %v, want %v %v", tt.line, m.Name, m.Tags, m.Fields, tt.tags, tt.fields)
+		}
+		if !tt.time.IsZero() && !m.Time.Equal(tt.time) {
+			t.Errorf("%s, got time %s, want %s", tt.line, m.Time, tt.time)
+		}
+	}
+
+	for _, line := range []string{
+		"",
+		`10.0.0.1 "GET /index.html" 200 fast 512 [2017-07-14T02:40:00Z]`,
+		"disk full",
+	} {
+		if m, ok := p.parse(line); ok {
+			t.Errorf("%q parsed to %v", line, m)
+		}
+	}
+}
+
+func TestParseRegex(t *testing.T) {
+	// plain named captures, auto typed
+	p, err := newParser("app", []string{`took (?P<ms>\d+)ms ratio=(?P<ratio>[\d.]+) user=(?P<user>\w+)`}, []string{"user"}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := p.parse("request took 35ms ratio=0.5 user=alice")
+	if !ok {
+		t.Fatal("line not parsed")
+	}
+	want := map[string]interface{}{"ms": int64(35), "ratio": 0.5}
+	if !reflect.DeepEqual(m.Fields, want) || !reflect.DeepEqual(m.Tags, map[string]string{"user": "alice"}) {
+		t.Errorf("got %v %v, want %v", m.Tags, m.Fields, want)
+	}
+
+	// only tags are captured
+	p, err = newParser("app", []string{`user=%{WORD:user:tag}`}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := p.parse("user=alice"); ok {
+		t.Errorf("metric without field parsed, %v", m)
+	}
+}
+
+func TestCompilePatternInvalid(t *testing.T) {
+	for _, s := range []string{
+		`%{NOPE:x}`,
+		`%{INT:x:bool}`,
+		`(?P<x>\d+`,
+	} {
+		if _, err := compilePattern(s); err == nil {
+			t.Errorf("invalid pattern %s compiled", s)
+		}
+	}
+}
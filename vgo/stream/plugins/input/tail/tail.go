@@ -0,0 +1,383 @@
+package tail
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/corego/vgo/mecury/misc/globpath"
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+// Tail follows the files and extracts a metric from every new line. The
+// files are polled every watch_interval: a file renamed and recreated by a
+// rotation is read to its end then reopened, a truncated file is read again
+// from its start.
+type Tail struct {
+	// Files are paths or globs, "/var/log/**.log" matches in the sub
+	// directories
+	Files []string
+	// FromBeginning reads the files found at startup from their start
+	// instead of their end, the files found later are always read from
+	// their start
+	FromBeginning bool
+	WatchInterval misc.Duration
+	// OffsetsFile keeps the offsets read in the files, so a restart
+	// carries on where it stopped
+	OffsetsFile string
+
+	Name string
+	// Patterns are regular expressions, with grok patterns such as
+	// %{NUMBER:latency:float}, the first one matching a line extracts the
+	// metric from its named captures
+	Patterns []string
+	// Tags are the captures used as tags
+	Tags []string
+	// TimestampField is the capture giving the time of the metric, parsed
+	// with the Go layout TimestampFormat
+	TimestampField  string
+	TimestampFormat string
+
+	StopC  chan bool
+	WriteC chan service.Metrics
+
+	globs   []*globpath.GlobPath
+	parser  *parser
+	files   map[string]*tailedFile
+	offsets map[string]*offset
+	started bool
+	stop    chan bool
+}
+
+// offset is the offset read in a file, with the device and inode of the
+// file: a file replaced by another one while the offset was saved isn't
+// read from the offset of the replaced one
+type offset struct {
+	Offset int64  `json:"offset"`
+	Device uint64 `json:"device"`
+	Inode  uint64 `json:"inode"`
+}
+
+func newOffset(info os.FileInfo, n int64) *offset {
+	device, inode := fileID(info)
+	return &offset{Offset: n, Device: device, Inode: inode}
+}
+
+// of reports whether the offset is the one of the file, not replaced nor
+// truncated since. The offsets saved without device and inode are only
+// checked against the size.
+func (o *offset) of(info os.FileInfo) bool {
+	if o.Device != 0 || o.Inode != 0 {
+		if device, inode := fileID(info); device != o.Device || inode != o.Inode {
+			return false
+		}
+	}
+	return o.Offset <= info.Size()
+}
+
+type tailedFile struct {
+	f    *os.File
+	info os.FileInfo
+	// offset is the position read up to, partial the bytes read after the
+	// last line break
+	offset  int64
+	partial []byte
+}
+
+var sampleConfig = `
+  files = ["/var/log/nginx/access.log"]
+  from_beginning = false
+  watch_interval = "1s"
+  ## Keeps the offsets read across restarts
+  # offsets_file = "/var/lib/vgo/tail.offsets"
+
+  name = "nginx"
+  patterns = ['%{IP:client:tag} .* "%{WORD:method:tag} %{URIPATH:url:tag}[^"]*" %{INT:status:tag} %{INT:bytes}']
+  # tags = []
+  # timestamp_field = "time"
+  # timestamp_format = "2006-01-02T15:04:05Z07:00"
+`
+
+// Init init tail
+func (t *Tail) Init(stopC chan bool, writeC chan service.Metrics) {
+	t.StopC = stopC
+	t.WriteC = writeC
+	t.stop = make(chan bool)
+}
+
+// Start start tail
+func (t *Tail) Start() {
+	log.Println("tail Start")
+	if len(t.Files) == 0 || len(t.Patterns) == 0 {
+		log.Fatal("[FATAL] tail files and patterns are required")
+	}
+
+	for _, f := range t.Files {
+		g, err := globpath.Compile(f)
+		if err != nil {
+			log.Fatal("[FATAL] tail invalid glob ", f, ": ", err)
+		}
+		t.globs = append(t.globs, g)
+	}
+
+	p, err := newParser(t.Name, t.Patterns, t.Tags, t.TimestampField, t.TimestampFormat)
+	if err != nil {
+		log.Fatal("[FATAL] tail invalid pattern: ", err)
+	}
+	t.parser = p
+	t.files = make(map[string]*tailedFile)
+	t.offsets = t.loadOffsets()
+
+	ticker := time.NewTicker(t.WatchInterval.Duration)
+	defer ticker.Stop()
+
+	t.poll()
+	for {
+		select {
+		case <-ticker.C:
+			t.poll()
+		case <-t.stop:
+			t.close()
+			return
+		case <-t.StopC:
+			t.close()
+			return
+		}
+	}
+}
+
+// Stop stops following the files
+func (t *Tail) Stop() {
+	close(t.stop)
+}
+
+// poll reads the new lines of the matching files and publishes their
+// metrics.
+func (t *Tail) poll() {
+	matched := make(map[string]bool)
+	for _, g := range t.globs {
+		for path, info := range g.Match() {
+			if info != nil && info.Mode().IsRegular() {
+				matched[path] = true
+			}
+		}
+	}
+
+	var metrics []*service.MetricData
+	for path, tf := range t.files {
+		if matched[path] {
+			continue
+		}
+		// removed, or renamed without being recreated
+		metrics = append(metrics, t.read(path, tf)...)
+		tf.f.Close()
+		delete(t.files, path)
+	}
+
+	for path := range matched {
+		tf, ok := t.files[path]
+		if !ok {
+			var err error
+			if tf, err = t.open(path); err != nil {
+				service.VLogger.Error("tail open", zap.String("path", path), zap.Error(err))
+				continue
+			}
+			t.files[path] = tf
+		} else {
+			metrics = append(metrics, t.rotate(path, tf)...)
+			tf = t.files[path]
+		}
+		metrics = append(metrics, t.read(path, tf)...)
+	}
+	t.started = true
+	t.saveOffsets()
+
+	if len(metrics) == 0 {
+		return
+	}
+	service.InputStats("tail").Gathered(len(metrics))
+	service.Publish(service.Metrics{Data: metrics, Interval: int(t.WatchInterval.Duration / time.Second)})
+}
+
+// open opens the file at the saved offset, else at its start or end.
+func (t *Tail) open(path string) (*tailedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	var start int64
+	if saved, ok := t.offsets[path]; ok {
+		// a file replaced or truncated since is read from its start
+		if saved.of(info) {
+			start = saved.Offset
+		}
+	} else if !t.FromBeginning && !t.started {
+		start = info.Size()
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &tailedFile{f: f, info: info, offset: start}, nil
+}
+
+// rotate reopens the file replaced at path and rewinds the truncated file,
+// it returns the metrics of the last lines of the replaced file.
+func (t *Tail) rotate(path string, tf *tailedFile) []*service.MetricData {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+
+	if !os.SameFile(tf.info, info) {
+		metrics := t.read(path, tf)
+		tf.f.Close()
+		delete(t.offsets, path)
+
+		f, err := os.Open(path)
+		if err != nil {
+			delete(t.files, path)
+			service.VLogger.Error("tail reopen", zap.String("path", path), zap.Error(err))
+			return metrics
+		}
+		t.files[path] = &tailedFile{f: f, info: info}
+		return metrics
+	}
+
+	if info.Size() < tf.offset {
+		if _, err := tf.f.Seek(0, io.SeekStart); err != nil {
+			service.VLogger.Error("tail rewind", zap.String("path", path), zap.Error(err))
+			return nil
+		}
+		tf.offset = 0
+		tf.partial = nil
+	}
+	tf.info = info
+	return nil
+}
+
+// read parses the lines written since the last read, the last line is
+// kept until its line break is written.
+func (t *Tail) read(path string, tf *tailedFile) []*service.MetricData {
+	var metrics []*service.MetricData
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := tf.f.Read(buf)
+		if n > 0 {
+			tf.offset += int64(n)
+			data := append(tf.partial, buf[:n]...)
+			for {
+				i := bytes.IndexByte(data, '\n')
+				if i < 0 {
+					break
+				}
+				line := string(bytes.TrimRight(data[:i], "\r"))
+				data = data[i+1:]
+				if m, ok := t.parser.parse(line); ok {
+					m.Tags["path"] = path
+					metrics = append(metrics, m)
+				}
+			}
+			tf.partial = append([]byte(nil), data...)
+		}
+		if err != nil {
+			if err != io.EOF {
+				service.VLogger.Error("tail read", zap.String("path", path), zap.Error(err))
+			}
+			break
+		}
+	}
+	t.offsets[path] = newOffset(tf.info, tf.offset-int64(len(tf.partial)))
+	return metrics
+}
+
+// close saves the offsets before closing the files, saveOffsets keeps the
+// offsets of the followed files only.
+func (t *Tail) close() {
+	t.saveOffsets()
+	for path, tf := range t.files {
+		tf.f.Close()
+		delete(t.files, path)
+	}
+}
+
+// loadOffsets reads the offsets file, the offsets of the previous versions
+// are plain numbers.
+func (t *Tail) loadOffsets() map[string]*offset {
+	offsets := make(map[string]*offset)
+	if t.OffsetsFile == "" {
+		return offsets
+	}
+	b, err := ioutil.ReadFile(t.OffsetsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			service.VLogger.Error("tail offsets", zap.String("file", t.OffsetsFile), zap.Error(err))
+		}
+		return offsets
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		service.VLogger.Error("tail offsets", zap.String("file", t.OffsetsFile), zap.Error(err))
+		return offsets
+	}
+	for path, v := range raw {
+		o := &offset{}
+		if err := json.Unmarshal(v, &o.Offset); err != nil {
+			if err := json.Unmarshal(v, o); err != nil {
+				service.VLogger.Error("tail offsets", zap.String("file", t.OffsetsFile), zap.String("path", path), zap.Error(err))
+				continue
+			}
+		}
+		offsets[path] = o
+	}
+	return offsets
+}
+
+// saveOffsets writes the offsets of the followed files, through a
+// temporary file so a crash never leaves a half written one.
+func (t *Tail) saveOffsets() {
+	if t.OffsetsFile == "" {
+		return
+	}
+	offsets := make(map[string]*offset, len(t.files))
+	for path := range t.files {
+		if o, ok := t.offsets[path]; ok {
+			offsets[path] = o
+		}
+	}
+	b, err := json.Marshal(offsets)
+	if err != nil {
+		return
+	}
+
+	tmp := filepath.Join(filepath.Dir(t.OffsetsFile), "."+filepath.Base(t.OffsetsFile)+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		service.VLogger.Error("tail offsets", zap.String("file", t.OffsetsFile), zap.Error(err))
+		return
+	}
+	if err := os.Rename(tmp, t.OffsetsFile); err != nil {
+		service.VLogger.Error("tail offsets", zap.String("file", t.OffsetsFile), zap.Error(err))
+	}
+}
+
+func init() {
+	service.AddInput("tail", &Tail{
+		WatchInterval:   misc.Duration{Duration: time.Second},
+		Name:            "tail",
+		TimestampFormat: time.RFC3339,
+	})
+}
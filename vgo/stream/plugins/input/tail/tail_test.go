@@ -0,0 +1,233 @@
+package tail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// newTail returns the tail started without its poll loop, extracting
+// n=%{INT:n} from the lines.
+func newTail(t *testing.T, offsetsFile string) *Tail {
+	tl := &Tail{Name: "log", Patterns: []string{`n=%{INT:n}`}, OffsetsFile: offsetsFile}
+	p, err := newParser(tl.Name, tl.Patterns, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.parser = p
+	tl.files = make(map[string]*tailedFile)
+	tl.offsets = tl.loadOffsets()
+	return tl
+}
+
+// follow reads the new lines of path as poll does, it returns the
+// extracted n values.
+func follow(t *testing.T, tl *Tail, path string) []int64 {
+	var metrics []*service.MetricData
+	tf, ok := tl.files[path]
+	if !ok {
+		var err error
+		if tf, err = tl.open(path); err != nil {
+			t.Fatal(err)
+		}
+		tl.files[path] = tf
+	} else {
+		metrics = append(metrics, tl.rotate(path, tf)...)
+		tf = tl.files[path]
+	}
+	metrics = append(metrics, tl.read(path, tf)...)
+	tl.started = true
+	tl.saveOffsets()
+
+	var ns []int64
+	for _, m := range metrics {
+		if m.Tags["path"] != path {
+			t.Errorf("got path tag %s, want %s", m.Tags["path"], path)
+		}
+		ns = append(ns, m.Fields["n"].(int64))
+	}
+	return ns
+}
+
+func appendFile(t *testing.T, path, data string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFromBeginning(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "n=1\nn=2\n")
+
+	tl := newTail(t, "")
+	if got := follow(t, tl, path); got != nil {
+		t.Errorf("got %v, the existing lines are read", got)
+	}
+	appendFile(t, path, "n=3\n")
+	if got := follow(t, tl, path); !reflect.DeepEqual(got, []int64{3}) {
+		t.Errorf("got %v, want [3]", got)
+	}
+
+	tl = newTail(t, "")
+	tl.FromBeginning = true
+	if got := follow(t, tl, path); !reflect.DeepEqual(got, []int64{1, 2, 3}) {
+		t.Errorf("from beginning, got %v, want [1 2 3]", got)
+	}
+}
+
+func TestPartialLine(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "")
+
+	tl := newTail(t, "")
+	follow(t, tl, path)
+	appendFile(t, path, "n=1\nn=2")
+	if got := follow(t, tl, path); !reflect.DeepEqual(got, []int64{1}) {
+		t.Errorf("got %v, the unfinished line is parsed", got)
+	}
+	appendFile(t, path, "5\r\n")
+	if got := follow(t, tl, path); !reflect.DeepEqual(got, []int64{25}) {
+		t.Errorf("got %v, want [25]", got)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "")
+
+	tl := newTail(t, "")
+	follow(t, tl, path)
+	appendFile(t, path, "n=1\n")
+	if got := follow(t, tl, path); !reflect.DeepEqual(got, []int64{1}) {
+		t.Fatalf("got %v, want [1]", got)
+	}
+
+	// renamed, the lines written before the rotation are read then the new
+	// file from its start
+	appendFile(t, path, "n=2\n")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path+".1", "n=3\n")
+	appendFile(t, path, "n=4\n")
+	if got := follow(t, tl, path); !reflect.DeepEqual(got, []int64{2, 3, 4}) {
+		t.Errorf("after rename, got %v, want [2 3 4]", got)
+	}
+	appendFile(t, path, "n=5\n")
+	if got := follow(t, tl, path); !reflect.DeepEqual(got, []int64{5}) {
+		t.Errorf("got %v, want [5]", got)
+	}
+
+	// truncated, read again from the start
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "n=6\n")
+	if got := follow(t, tl, path); !reflect.DeepEqual(got, []int64{6}) {
+		t.Errorf("after truncate, got %v, want [6]", got)
+	}
+	appendFile(t, path, "n=7\n")
+	if got := follow(t, tl, path); !reflect.DeepEqual(got, []int64{7}) {
+		t.Errorf("got %v, want [7]", got)
+	}
+}
+
+func TestOffsets(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "app.log")
+	offsets := filepath.Join(dir, "tail.offsets")
+	appendFile(t, path, "n=1\n")
+
+	tl := newTail(t, offsets)
+	tl.FromBeginning = true
+	if got := follow(t, tl, path); !reflect.DeepEqual(got, []int64{1}) {
+		t.Fatalf("got %v, want [1]", got)
+	}
+	appendFile(t, path, "n=2\nn=")
+	follow(t, tl, path)
+	tl.close()
+
+	// restarted, the lines read aren't read again, the unfinished one is
+	appendFile(t, path, "3\nn=4\n")
+	tl = newTail(t, offsets)
+	tl.FromBeginning = true
+	if got := follow(t, tl, path); !reflect.DeepEqual(got, []int64{3, 4}) {
+		t.Errorf("after restart, got %v, want [3 4]", got)
+	}
+	tl.close()
+
+	// replaced by a smaller file, the saved offset is ignored
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "n=5\n")
+	tl = newTail(t, offsets)
+	if got := follow(t, tl, path); !reflect.DeepEqual(got, []int64{5}) {
+		t.Errorf("after replace, got %v, want [5]", got)
+	}
+}
+
+func TestReplacedOffsets(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "app.log")
+	offsets := filepath.Join(dir, "tail.offsets")
+	appendFile(t, path, "n=1\n")
+
+	tl := newTail(t, offsets)
+	tl.FromBeginning = true
+	follow(t, tl, path)
+	tl.close()
+
+	// replaced by a bigger file, renamed over the old one for the inode to
+	// differ, the saved offset is ignored
+	next := filepath.Join(dir, "app.log.next")
+	appendFile(t, next, "n=2\nn=3\n")
+	if err := os.Rename(next, path); err != nil {
+		t.Fatal(err)
+	}
+	tl = newTail(t, offsets)
+	if got := follow(t, tl, path); !reflect.DeepEqual(got, []int64{2, 3}) {
+		t.Errorf("after replace, got %v, want [2 3]", got)
+	}
+	tl.close()
+
+	// the offsets saved without device and inode are still used
+	if err := ioutil.WriteFile(offsets, []byte(`{"`+path+`": 4}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "n=4\n")
+	tl = newTail(t, offsets)
+	if got := follow(t, tl, path); !reflect.DeepEqual(got, []int64{3, 4}) {
+		t.Errorf("with an old offset, got %v, want [3 4]", got)
+	}
+}
@@ -0,0 +1,324 @@
+package alarm_bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+// AlarmBridge raises alarms when the metrics cross the thresholds of its
+// rules. An alarm is raised once the threshold has been crossed for the
+// whole For duration, then the rule is armed again only when the value
+// crosses back the clear threshold, so a value hovering around the
+// threshold doesn't raise an alarm at every metric.
+type AlarmBridge struct {
+	Rules []*Rule
+	// Annotations writes the fired alarms as events to the metric outputs
+	// supporting them, to overlay the alarms on the graphs
+	Annotations bool
+	// SeriesTTL forgets the state of the series without metric for that
+	// long, such as the ones of a removed host
+	SeriesTTL misc.Duration
+
+	// series are the states of the series crossing or having crossed a
+	// threshold, by rule and series key
+	mu     sync.Mutex
+	series map[string]*state
+	// swept is when the expired series were last evicted
+	swept time.Time
+}
+
+// Rule is a threshold checked on the matching fields.
+type Rule struct {
+	// Name is the group of the alarms raised by the rule
+	Name string
+	// Metrics are the names of the checked metrics, globs are supported,
+	// empty checks all of them
+	Metrics []string
+	// Fields are the names of the checked fields, globs are supported
+	Fields []string
+	// Operator is ">", ">=", "<", "<=", "==" or "!="
+	Operator  string
+	Threshold float64
+	// ClearThreshold is the threshold the value must cross back to clear
+	// the alarm, the threshold itself when not set
+	ClearThreshold *float64
+	// For is how long the threshold must be crossed before the alarm is
+	// raised, the brief spikes don't raise any
+	For misc.Duration
+	// Level is "warn" or "critical"
+	Level string
+	// User receives the alarms
+	User string
+	// Outputs are the alarm outputs of the alarms, all when empty
+	Outputs []string
+
+	metrics service.Filter
+	fields  service.Filter
+	compare func(v, threshold float64) bool
+}
+
+// state is the state of a series checked by a rule
+type state struct {
+	// since is when the threshold was first crossed
+	since  time.Time
+	firing bool
+	// seen is when the last metric of the series was checked
+	seen time.Time
+}
+
+// alertData is the data of the raised alarms, the alert data of the alarm
+// service
+type alertData struct {
+	ID       string  `json:"id"`
+	GroupID  string  `json:"gid"`
+	Value    float64 `json:"v"`
+	Level    int     `json:"l"`
+	HostName string  `json:"h"`
+}
+
+var operators = map[string]func(v, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+	"==": func(v, t float64) bool { return v == t },
+	"!=": func(v, t float64) bool { return v != t },
+}
+
+var sampleConfig = `
+  ## Write the fired alarms as events, e.g. InfluxDB annotations
+  # annotations = false
+  ## Forget the series without metric for that long, e.g. a removed host
+  # series_ttl = "1h"
+
+  [[metric_outputs.alarm_bridge.rules]]
+    name = "cpu"
+    metrics = ["cpu"]
+    fields = ["usage_*"]
+    ## ">", ">=", "<", "<=", "==" or "!="
+    operator = ">"
+    ## thresholds are floats: write 90.0, not 90
+    threshold = 90.0
+    ## the alarm is cleared when the value crosses back this threshold
+    # clear_threshold = 80.0
+    ## how long the threshold must be crossed before the alarm is raised
+    # for = "1m"
+    ## "warn" or "critical"
+    level = "warn"
+    # user = "ops"
+    ## alarm outputs of the alarms, all of them when empty
+    # outputs = ["mail"]
+`
+
+func (a *AlarmBridge) Connect() error {
+	for _, r := range a.Rules {
+		if err := r.init(); err != nil {
+			return fmt.Errorf("rule %s, %s", r.Name, err)
+		}
+	}
+	if a.SeriesTTL.Duration <= 0 {
+		a.SeriesTTL.Duration = time.Hour
+	}
+	a.series = make(map[string]*state)
+	a.swept = time.Now()
+	return nil
+}
+
+func (r *Rule) init() error {
+	if len(r.Fields) == 0 {
+		return fmt.Errorf("fields are required")
+	}
+	compare, ok := operators[r.Operator]
+	if !ok {
+		return fmt.Errorf("invalid operator %s", r.Operator)
+	}
+	r.compare = compare
+
+	switch r.Level {
+	case "":
+		r.Level = "warn"
+	case "warn", "critical":
+	default:
+		return fmt.Errorf("invalid level %s, can be: \"warn\", \"critical\"", r.Level)
+	}
+
+	var err error
+	if r.metrics, err = service.CompileFilter(r.Metrics); err != nil {
+		return err
+	}
+	r.fields, err = service.CompileFilter(r.Fields)
+	return err
+}
+
+func (a *AlarmBridge) Close() error {
+	return nil
+}
+
+// Write checks the metrics against the rules and writes the raised alarms.
+func (a *AlarmBridge) Write(metrics service.Metrics) error {
+	var alarms []*service.Alarm
+	var outputs [][]string
+	var events []*service.Event
+
+	a.mu.Lock()
+	a.evict(time.Now())
+	for _, m := range metrics.Data {
+		for i, r := range a.Rules {
+			if r.metrics != nil && !r.metrics.Match(m.Name) {
+				continue
+			}
+			for field, v := range m.Fields {
+				if !r.fields.Match(field) {
+					continue
+				}
+				value, ok := service.ToFloat(v)
+				if !ok {
+					continue
+				}
+				if alarm := a.check(i, r, m, field, value); alarm != nil {
+					alarms = append(alarms, alarm)
+					outputs = append(outputs, r.Outputs)
+					if a.Annotations {
+						events = append(events, event(r, m, field, value))
+					}
+				}
+			}
+		}
+	}
+	a.mu.Unlock()
+
+	for i, alarm := range alarms {
+		if missing := service.WriteAlarm(outputs[i], alarm); len(missing) > 0 {
+			service.VLogger.Warn("alarm bridge, alarm outputs not configured", zap.String("outputs", strings.Join(missing, ",")))
+		}
+	}
+	for _, e := range events {
+		service.WriteEvent(e)
+	}
+	return nil
+}
+
+// event returns the annotation of the alarm fired by the rule, tagged with
+// the tags of the metric, the rule and the level.
+func event(r *Rule, m *service.MetricData, field string, value float64) *service.Event {
+	tags := make(map[string]string, len(m.Tags)+2)
+	for k, v := range m.Tags {
+		tags[k] = v
+	}
+	tags["alarm"] = r.Name
+	tags["level"] = r.Level
+
+	text := fmt.Sprintf("%s.%s %s %v, value %v", m.Name, field, r.Operator, r.Threshold, value)
+	if r.For.Duration > 0 {
+		text += fmt.Sprintf(" for %s", r.For.Duration)
+	}
+	return &service.Event{
+		Title: fmt.Sprintf("[%s] %s.%s", strings.ToUpper(r.Level), m.Name, field),
+		Text:  text,
+		Tags:  tags,
+		Time:  m.Time,
+	}
+}
+
+// evict forgets the series not seen within the TTL, at most once per TTL.
+// The caller holds the lock.
+func (a *AlarmBridge) evict(now time.Time) {
+	if now.Sub(a.swept) < a.SeriesTTL.Duration {
+		return
+	}
+	for key, s := range a.series {
+		if now.Sub(s.seen) >= a.SeriesTTL.Duration {
+			delete(a.series, key)
+		}
+	}
+	a.swept = now
+}
+
+// check updates the state of the series and returns the alarm to raise, if
+// any.
+func (a *AlarmBridge) check(i int, r *Rule, m *service.MetricData, field string, value float64) *service.Alarm {
+	key := seriesKey(i, m, field)
+	s := a.series[key]
+
+	t := m.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	if s != nil {
+		s.seen = time.Now()
+	}
+	if s != nil && s.firing {
+		clear := r.Threshold
+		if r.ClearThreshold != nil {
+			clear = *r.ClearThreshold
+		}
+		if !r.compare(value, clear) {
+			delete(a.series, key)
+		}
+		return nil
+	}
+
+	if !r.compare(value, r.Threshold) {
+		delete(a.series, key)
+		return nil
+	}
+	if s == nil {
+		s = &state{since: t, seen: time.Now()}
+		a.series[key] = s
+	}
+	if t.Sub(s.since) < r.For.Duration {
+		return nil
+	}
+	s.firing = true
+
+	data, err := json.Marshal(&alertData{
+		ID:       m.Name + "." + field,
+		GroupID:  r.Name,
+		Value:    value,
+		Level:    level(r.Level),
+		HostName: m.Tags["host"],
+	})
+	if err != nil {
+		service.VLogger.Error("alarm bridge", zap.Error(err))
+		return nil
+	}
+	return &service.Alarm{Data: data, User: r.User}
+}
+
+func level(l string) int {
+	if l == "critical" {
+		return 1
+	}
+	return 0
+}
+
+// seriesKey identifies the field of a series checked by the i-th rule.
+func seriesKey(i int, m *service.MetricData, field string) string {
+	return strconv.Itoa(i) + "\x00" + field + "\x00" + m.SeriesKey()
+}
+
+func (a *AlarmBridge) Init(stop chan bool) {
+	if err := a.Connect(); err != nil {
+		service.VLogger.Fatal("alarm bridge Connect failed", zap.Error(err))
+	}
+}
+
+func (a *AlarmBridge) Start() {
+}
+
+func (a *AlarmBridge) Compute(metrics service.Metrics) error {
+	return a.Write(metrics)
+}
+
+func init() {
+	service.AddMetricOutput("alarm_bridge", &AlarmBridge{})
+}
@@ -0,0 +1,270 @@
+package alarm_bridge
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/plugins/metric_output/influxdb"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+// mockOutput is an alarm output recording the alarms
+type mockOutput struct {
+	sync.Mutex
+	alarms []*service.Alarm
+}
+
+func (o *mockOutput) Start() error { return nil }
+func (o *mockOutput) Close() error { return nil }
+func (o *mockOutput) Write(a *service.Alarm) error {
+	o.Lock()
+	o.alarms = append(o.alarms, a)
+	o.Unlock()
+	return nil
+}
+
+func (o *mockOutput) written() []string {
+	o.Lock()
+	defer o.Unlock()
+	var data []string
+	for _, a := range o.alarms {
+		data = append(data, string(a.Data)+" "+a.User)
+	}
+	return data
+}
+
+// withOutput makes the mock the only alarm output of the config.
+func withOutput(name string) (*mockOutput, func()) {
+	o := &mockOutput{}
+	conf := service.Conf
+	service.Conf = &service.Config{Outputs: map[string]*service.Output{name: {Name: name, Output: o}}}
+	return o, func() { service.Conf = conf }
+}
+
+func TestSingleAlarm(t *testing.T) {
+	o, restore := withOutput("mock")
+	defer restore()
+
+	clear := 80.0
+	a := &AlarmBridge{Rules: []*Rule{{
+		Name:           "cpu",
+		Metrics:        []string{"cpu"},
+		Fields:         []string{"usage_*"},
+		Operator:       ">",
+		Threshold:      90,
+		ClearThreshold: &clear,
+		For:            misc.Duration{Duration: 30 * time.Second},
+		Level:          "critical",
+		User:           "ops",
+	}}}
+	if err := a.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(1500000000, 0)
+	write := func(offset time.Duration, usage float64) {
+		err := a.Write(service.Metrics{Data: []*service.MetricData{{
+			Name:   "cpu",
+			Tags:   map[string]string{"host": "web01"},
+			Fields: map[string]interface{}{"usage_user": usage, "idle": 0.0},
+			Time:   start.Add(offset),
+		}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, p := range []struct {
+		offset time.Duration
+		usage  float64
+	}{
+		// a brief spike
+		{0, 95},
+		{10 * time.Second, 50},
+		// over the threshold for 30s, the alarm fires
+		{20 * time.Second, 95},
+		{40 * time.Second, 96},
+		{50 * time.Second, 97},
+		// still firing, under the threshold but over the clear one
+		{60 * time.Second, 99},
+		{70 * time.Second, 85},
+		{80 * time.Second, 95},
+	} {
+		write(p.offset, p.usage)
+	}
+	want := []string{`{"id":"cpu.usage_user","gid":"cpu","v":97,"l":1,"h":"web01"} ops`}
+	if got := o.written(); len(got) != 1 || got[0] != want[0] {
+		t.Fatalf("got alarms %v, want %v", got, want)
+	}
+
+	// cleared, then crossed again for 30s
+	write(90*time.Second, 70)
+	write(100*time.Second, 95)
+	if n := len(o.written()); n != 1 {
+		t.Fatalf("%d alarms before the for duration", n)
+	}
+	write(130*time.Second, 91)
+	if n := len(o.written()); n != 2 {
+		t.Errorf("%d alarms, the cleared rule isn't armed again", n)
+	}
+}
+
+func TestSeriesChecked(t *testing.T) {
+	o, restore := withOutput("mock")
+	defer restore()
+
+	a := &AlarmBridge{Rules: []*Rule{{Name: "disk", Fields: []string{"used"}, Operator: ">=", Threshold: 90}}}
+	if err := a.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	metric := func(name, host string, used interface{}) *service.MetricData {
+		return &service.MetricData{Name: name, Tags: map[string]string{"host": host}, Fields: map[string]interface{}{"used": used}}
+	}
+	a.Write(service.Metrics{Data: []*service.MetricData{
+		metric("disk", "web01", int64(90)),
+		metric("disk", "web02", 95.0),
+		metric("disk", "web03", 89.0),
+		// not a number
+		metric("disk", "web04", "full"),
+		metric("disk", "web01", int64(99)),
+	}})
+
+	want := []string{
+		`{"id":"disk.used","gid":"disk","v":90,"l":0,"h":"web01"} `,
+		`{"id":"disk.used","gid":"disk","v":95,"l":0,"h":"web02"} `,
+	}
+	got := o.written()
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got alarms %v, want %v", got, want)
+	}
+}
+
+func TestSeriesEvicted(t *testing.T) {
+	_, restore := withOutput("mock")
+	defer restore()
+
+	a := &AlarmBridge{
+		Rules:     []*Rule{{Name: "disk", Fields: []string{"used"}, Operator: ">=", Threshold: 90, For: misc.Duration{Duration: time.Hour}}},
+		SeriesTTL: misc.Duration{Duration: 50 * time.Millisecond},
+	}
+	if err := a.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	write := func(hosts ...string) {
+		m := service.Metrics{}
+		for _, host := range hosts {
+			m.Data = append(m.Data, &service.MetricData{Name: "disk", Tags: map[string]string{"host": host}, Fields: map[string]interface{}{"used": 95.0}})
+		}
+		a.Write(m)
+	}
+	count := func() int {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return len(a.series)
+	}
+
+	write("web01", "web02")
+	if n := count(); n != 2 {
+		t.Fatalf("got %d series, want 2", n)
+	}
+
+	// web01 keeps sending, web02 is gone
+	time.Sleep(30 * time.Millisecond)
+	write("web01")
+	time.Sleep(30 * time.Millisecond)
+	write("web01")
+	if n := count(); n != 1 {
+		t.Errorf("got %d series after the ttl, want 1", n)
+	}
+}
+
+func TestAnnotation(t *testing.T) {
+	var mu sync.Mutex
+	var lines []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/write"):
+			body, _ := ioutil.ReadAll(r.Body)
+			mu.Lock()
+			lines = append(lines, strings.TrimSpace(string(body)))
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		case strings.HasSuffix(r.URL.Path, "/query"):
+			w.Write([]byte(`{"results":[{}]}`))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer ts.Close()
+
+	i := &influxdb.InfluxDB{
+		URLs:             []string{ts.URL},
+		Database:         "test",
+		Timeout:          misc.Duration{Duration: 5 * time.Second},
+		EventMeasurement: "annotations",
+	}
+	if err := i.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	o, restore := withOutput("mock")
+	defer restore()
+	service.Conf.MetricOutputs = []*service.MetricOutputConfig{{Name: "influxdb", MetricOutput: i}}
+
+	a := &AlarmBridge{
+		Annotations: true,
+		Rules: []*Rule{{
+			Name:      "cpu",
+			Fields:    []string{"usage"},
+			Operator:  ">",
+			Threshold: 90,
+			For:       misc.Duration{Duration: time.Minute},
+			Level:     "critical",
+		}},
+	}
+	if err := a.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1500000000, 0)
+	for n, usage := range []float64{95, 96, 97} {
+		a.Write(service.Metrics{Data: []*service.MetricData{{
+			Name:   "cpu",
+			Tags:   map[string]string{"host": "web01"},
+			Fields: map[string]interface{}{"usage": usage},
+			Time:   start.Add(time.Duration(n) * 30 * time.Second),
+		}}})
+	}
+
+	if n := len(o.written()); n != 1 {
+		t.Fatalf("%d alarms, want 1", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := `annotations,alarm=cpu,host=web01,level=critical text="cpu.usage > 90, value 97 for 1m0s",title="[CRITICAL] cpu.usage" 1500000060000000000`
+	if len(lines) != 1 || lines[0] != want {
+		t.Errorf("got annotations %q, want %q", lines, want)
+	}
+}
+
+func TestRuleInvalid(t *testing.T) {
+	for _, r := range []*Rule{
+		{Operator: ">"},
+		{Fields: []string{"used"}, Operator: "=>"},
+		{Fields: []string{"used"}, Operator: ">", Level: "info"},
+		{Fields: []string{"used["}, Operator: ">"},
+	} {
+		if err := r.init(); err == nil {
+			t.Errorf("invalid rule %+v accepted", r)
+		}
+	}
+}
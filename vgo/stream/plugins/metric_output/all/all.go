@@ -1,5 +1,19 @@
 package all
 
 import (
+	_ "github.com/corego/vgo/vgo/stream/plugins/metric_output/alarm_bridge"
+	_ "github.com/corego/vgo/vgo/stream/plugins/metric_output/amqp"
+	_ "github.com/corego/vgo/vgo/stream/plugins/metric_output/azure_monitor"
+	_ "github.com/corego/vgo/vgo/stream/plugins/metric_output/cloudwatch"
+	_ "github.com/corego/vgo/vgo/stream/plugins/metric_output/console"
+	_ "github.com/corego/vgo/vgo/stream/plugins/metric_output/gnocchi"
+	_ "github.com/corego/vgo/vgo/stream/plugins/metric_output/http"
 	_ "github.com/corego/vgo/vgo/stream/plugins/metric_output/influxdb"
+	_ "github.com/corego/vgo/vgo/stream/plugins/metric_output/mqtt"
+	_ "github.com/corego/vgo/vgo/stream/plugins/metric_output/otlp"
+	_ "github.com/corego/vgo/vgo/stream/plugins/metric_output/pulsar"
+	_ "github.com/corego/vgo/vgo/stream/plugins/metric_output/splunk"
+	_ "github.com/corego/vgo/vgo/stream/plugins/metric_output/stackdriver"
+	_ "github.com/corego/vgo/vgo/stream/plugins/metric_output/unixsocket"
+	_ "github.com/corego/vgo/vgo/stream/plugins/metric_output/victoriametrics"
 )
@@ -0,0 +1,477 @@
+package amqp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/streadway/amqp"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+// hostSerializer serializes the metrics as their host tags.
+type hostSerializer struct{}
+
+func (hostSerializer) Serialize(m *service.MetricData) ([]byte, error) {
+	return []byte(m.Tags["host"]), nil
+}
+
+func (hostSerializer) SerializeBatch(metrics service.Metrics) ([]byte, error) {
+	var hosts []string
+	for _, m := range metrics.Data {
+		hosts = append(hosts, m.Tags["host"])
+	}
+	return []byte(strings.Join(hosts, ",")), nil
+}
+
+// the answers of the broker to a published message
+const (
+	ack = iota
+	nack
+	// drop closes the connection without confirming
+	drop
+)
+
+// published is a message received by the broker, on its conn-th
+// connection
+type published struct {
+	conn         int
+	key          string
+	body         string
+	deliveryMode uint8
+	expiration   string
+}
+
+// broker is a fake AMQP 0-9-1 broker: it opens the connections and the
+// channels, declares the exchanges and records the published messages. In
+// confirm mode answer gives the answer to the n-th message of a
+// connection.
+type broker struct {
+	net.Listener
+	answer func(conn, n int) int
+
+	sync.Mutex
+	conns     int
+	open      []net.Conn
+	published []published
+}
+
+func newBroker(t *testing.T, answer func(conn, n int) int) *broker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &broker{Listener: l, answer: answer}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b.Lock()
+			b.conns++
+			n := b.conns
+			b.open = append(b.open, conn)
+			b.Unlock()
+			go b.serve(n, conn)
+		}
+	}()
+	return b
+}
+
+func (b *broker) url() string {
+	return "amqp://guest:guest@" + b.Addr().String() + "/"
+}
+
+// disconnect closes the open connections.
+func (b *broker) disconnect() {
+	b.Lock()
+	defer b.Unlock()
+	for _, conn := range b.open {
+		conn.Close()
+	}
+	b.open = nil
+}
+
+// wait waits until the broker received n messages.
+func (b *broker) wait(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(b.received()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages received, want %d", len(b.received()), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (b *broker) received() []published {
+	b.Lock()
+	defer b.Unlock()
+	return append([]published(nil), b.published...)
+}
+
+func shortstr(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func longstr(s string) []byte {
+	l := make([]byte, 4)
+	binary.BigEndian.PutUint32(l, uint32(len(s)))
+	return append(l, s...)
+}
+
+func method(class, id uint16, args ...[]byte) []byte {
+	m := make([]byte, 4)
+	binary.BigEndian.PutUint16(m, class)
+	binary.BigEndian.PutUint16(m[2:], id)
+	for _, a := range args {
+		m = append(m, a...)
+	}
+	return m
+}
+
+func writeFrame(w io.Writer, typ byte, channel uint16, payload []byte) error {
+	h := make([]byte, 7)
+	h[0] = typ
+	binary.BigEndian.PutUint16(h[1:], channel)
+	binary.BigEndian.PutUint32(h[3:], uint32(len(payload)))
+	_, err := w.Write(append(append(h, payload...), 0xCE))
+	return err
+}
+
+func readFrame(r io.Reader) (byte, uint16, []byte, error) {
+	h := make([]byte, 7)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return 0, 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(h[3:])+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	return h[0], binary.BigEndian.Uint16(h[1:]), payload[:len(payload)-1], nil
+}
+
+// readShortstr returns the short string at the start of b and the rest.
+func readShortstr(b []byte) (string, []byte) {
+	n := int(b[0])
+	return string(b[1 : 1+n]), b[1+n:]
+}
+
+func (b *broker) serve(n int, conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:4]) != "AMQP" {
+		return
+	}
+
+	send := func(channel uint16, payload []byte) {
+		writeFrame(conn, 1, channel, payload)
+	}
+	// connection.start, version 0-9, no server properties
+	send(0, method(10, 10, []byte{0, 9}, longstr(""), longstr("PLAIN"), longstr("en_US")))
+
+	var (
+		confirming bool
+		tag        int
+		msg        published
+		size       uint64
+	)
+	for {
+		typ, channel, payload, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case 1:
+			class, id := binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:])
+			args := payload[4:]
+			switch {
+			case class == 10 && id == 11: // connection.start-ok
+				send(0, method(10, 30, []byte{0, 0}, []byte{0, 2, 0, 0}, []byte{0, 0}))
+			case class == 10 && id == 40: // connection.open
+				send(0, method(10, 41, shortstr("")))
+			case class == 10 && id == 50: // connection.close
+				send(0, method(10, 51))
+				return
+			case class == 20 && id == 10: // channel.open
+				send(channel, method(20, 11, longstr("")))
+			case class == 20 && id == 40: // channel.close
+				send(channel, method(20, 41))
+			case class == 40 && id == 10: // exchange.declare
+				send(channel, method(40, 11))
+			case class == 85 && id == 10: // confirm.select
+				confirming = true
+				send(channel, method(85, 11))
+			case class == 60 && id == 40: // basic.publish
+				_, rest := readShortstr(args[2:])
+				key, _ := readShortstr(rest)
+				msg = published{conn: n, key: key}
+			}
+		case 2:
+			size = binary.BigEndian.Uint64(payload[4:])
+			flags := binary.BigEndian.Uint16(payload[12:])
+			props := payload[14:]
+			if flags&(1<<15) != 0 { // content-type
+				_, props = readShortstr(props)
+			}
+			if flags&(1<<12) != 0 { // delivery-mode
+				msg.deliveryMode = props[0]
+				props = props[1:]
+			}
+			if flags&(1<<8) != 0 { // expiration
+				msg.expiration, _ = readShortstr(props)
+			}
+		case 3:
+			msg.body += string(payload)
+			if uint64(len(msg.body)) < size {
+				continue
+			}
+			b.Lock()
+			b.published = append(b.published, msg)
+			b.Unlock()
+
+			if !confirming {
+				continue
+			}
+			tag++
+			t := make([]byte, 8)
+			binary.BigEndian.PutUint64(t, uint64(tag))
+			switch b.answer(n, tag) {
+			case ack:
+				send(channel, method(60, 80, t, []byte{0}))
+			case nack:
+				send(channel, method(60, 120, t, []byte{0}))
+			case drop:
+				return
+			}
+		}
+	}
+}
+
+func metrics(hosts ...string) service.Metrics {
+	m := service.Metrics{}
+	for _, h := range hosts {
+		m.Data = append(m.Data, &service.MetricData{Name: "cpu", Tags: map[string]string{"host": h}})
+	}
+	return m
+}
+
+func newAMQP(t *testing.T, url string, confirms bool) *AMQP {
+	a := &AMQP{
+		URL:             url,
+		Exchange:        "vgo",
+		ExchangeType:    "topic",
+		ExchangeDeclare: true,
+		RoutingKey:      "{{.Tags.host}}.{{.Name}}",
+		DeliveryMode:    "persistent",
+		Confirms:        confirms,
+		Timeout:         misc.Duration{Duration: time.Second},
+	}
+	a.SetSerializer(hostSerializer{})
+	if err := a.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestRoutingKey(t *testing.T) {
+	metric := &service.MetricData{Name: "cpu", Tags: map[string]string{"host": "web01"}}
+	for _, tt := range []struct {
+		key, want string
+	}{
+		{"{{.Tags.host}}.{{.Name}}", "web01.cpu"},
+		{"metrics", "metrics"},
+		// a missing tag is empty
+		{"{{.Tags.site}}.{{.Name}}", ".cpu"},
+	} {
+		tmpl, err := parseRoutingKey(tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := routingKeyOf(tmpl, metric); err != nil || got != tt.want {
+			t.Errorf("%s, got routing key %q %v, want %q", tt.key, got, err, tt.want)
+		}
+	}
+	if _, err := parseRoutingKey("{{.Name"); err == nil {
+		t.Error("invalid routing key parsed")
+	}
+}
+
+func TestMessages(t *testing.T) {
+	tmpl, _ := parseRoutingKey("{{.Name}}")
+	m := metrics("a", "b", "c", "d")
+	m.Data[1].Name = "mem"
+	m.Data[2].TTL = time.Minute
+
+	for _, tt := range []struct {
+		batch bool
+		want  []message
+	}{
+		{false, []message{{"cpu", []byte("a"), 0}, {"mem", []byte("b"), 0}, {"cpu", []byte("c"), time.Minute}, {"cpu", []byte("d"), 0}}},
+		// by routing key and TTL
+		{true, []message{{"cpu", []byte("a,d"), 0}, {"mem", []byte("b"), 0}, {"cpu", []byte("c"), time.Minute}}},
+	} {
+		a := &AMQP{Batch: tt.batch, routingKey: tmpl, serializer: hostSerializer{}}
+		msgs, err := a.messages(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []message
+		for _, msg := range msgs {
+			got = append(got, *msg)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("batch %v, got messages %v, want %v", tt.batch, got, tt.want)
+		}
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	for ttl, want := range map[time.Duration]string{
+		0:                       "",
+		-time.Second:            "",
+		time.Microsecond:        "1",
+		time.Second:             "1000",
+		1500 * time.Microsecond: "2",
+	} {
+		if got := expiration(ttl); got != want {
+			t.Errorf("ttl %s, got expiration %q, want %q", ttl, got, want)
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	b := newBroker(t, func(conn, n int) int { return ack })
+	defer b.Close()
+	a := newAMQP(t, b.url(), true)
+	defer a.Close()
+
+	m := metrics("web01", "web02")
+	m.Data[1].TTL = time.Second
+	if err := a.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	want := []published{
+		{conn: 1, key: "web01.cpu", body: "web01", deliveryMode: 2},
+		{conn: 1, key: "web02.cpu", body: "web02", deliveryMode: 2, expiration: "1000"},
+	}
+	if got := b.received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got messages %+v, want %+v", got, want)
+	}
+}
+
+// bodies returns the bodies of the messages of each connection.
+func bodies(msgs []published) map[int][]string {
+	got := make(map[int][]string)
+	for _, m := range msgs {
+		got[m.conn] = append(got[m.conn], m.body)
+	}
+	return got
+}
+
+func TestRepublishNacked(t *testing.T) {
+	// the second message of the first connection is nacked
+	b := newBroker(t, func(conn, n int) int {
+		if conn == 1 && n == 2 {
+			return nack
+		}
+		return ack
+	})
+	defer b.Close()
+	a := newAMQP(t, b.url(), true)
+	defer a.Close()
+
+	if err := a.Write(metrics("a", "b", "c")); err != nil {
+		t.Fatal(err)
+	}
+	// only the nacked message is published again, after a reconnect
+	want := map[int][]string{1: {"a", "b", "c"}, 2: {"b"}}
+	if got := bodies(b.received()); !reflect.DeepEqual(got, want) {
+		t.Errorf("got messages %v, want %v", got, want)
+	}
+}
+
+func TestRepublishUnconfirmed(t *testing.T) {
+	// the first connection is lost before confirming the second message
+	b := newBroker(t, func(conn, n int) int {
+		if conn == 1 && n == 2 {
+			return drop
+		}
+		return ack
+	})
+	defer b.Close()
+	a := newAMQP(t, b.url(), true)
+	defer a.Close()
+
+	if err := a.Write(metrics("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	// the confirm of b can't come anymore, it's published again
+	want := map[int][]string{1: {"a", "b"}, 2: {"b"}}
+	if got := bodies(b.received()); !reflect.DeepEqual(got, want) {
+		t.Errorf("got messages %v, want %v", got, want)
+	}
+
+	if err := a.Write(metrics("c")); err != nil {
+		t.Fatal(err)
+	}
+	if got := bodies(b.received()); !reflect.DeepEqual(got[2], []string{"b", "c"}) {
+		t.Errorf("got messages %v after the reconnect", got)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	b := newBroker(t, func(conn, n int) int { return ack })
+	defer b.Close()
+	a := newAMQP(t, b.url(), false)
+	defer a.Close()
+
+	if err := a.Write(metrics("a")); err != nil {
+		t.Fatal(err)
+	}
+	b.wait(t, 1)
+	// the broker closes the connection, the next write opens another one
+	a.Lock()
+	closed := a.conn.NotifyClose(make(chan *amqp.Error, 1))
+	a.Unlock()
+	b.disconnect()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection loss not noticed")
+	}
+	if err := a.Write(metrics("b")); err != nil {
+		t.Fatal(err)
+	}
+	b.wait(t, 2)
+	want := map[int][]string{1: {"a"}, 2: {"b"}}
+	if got := bodies(b.received()); !reflect.DeepEqual(got, want) {
+		t.Errorf("got messages %v, want %v", got, want)
+	}
+}
+
+func TestConnectInvalid(t *testing.T) {
+	for _, a := range []*AMQP{
+		{DeliveryMode: "persistent", RoutingKey: "metrics"},
+		{URL: "amqp://localhost/", DeliveryMode: "fast", RoutingKey: "metrics"},
+		{URL: "amqp://localhost/", DeliveryMode: "persistent", RoutingKey: "{{.Name"},
+	} {
+		if err := a.Connect(); err == nil {
+			t.Errorf("invalid config %+v connected", a)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package azure_monitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+const (
+	// logsPath is the Data Collector API endpoint receiving the records
+	logsPath   = "/api/logs"
+	apiVersion = "2016-04-01"
+	// maxPostSize is the Data Collector limit of the size of a post
+	maxPostSize = 30 * 1024 * 1024
+	// maxDimensions is the limit of dimensions of the Azure Monitor metrics
+	maxDimensions = 10
+)
+
+// logTypeRe is the format of the custom log names, Azure appends _CL
+var logTypeRe = regexp.MustCompile(`^[A-Za-z0-9_]{1,100}$`)
+
+// AzureMonitor writes the metrics to an Azure Monitor Log Analytics
+// workspace through the HTTP Data Collector API, signed with the shared key
+// of the workspace. Every numeric field is a record of the LogType custom
+// log, with the tags of its metric as dimensions.
+type AzureMonitor struct {
+	WorkspaceID string `toml:"workspace_id"`
+	// SharedKey is the primary or secondary key of the workspace, base64
+	SharedKey string
+	// LogType is the custom log of the records, Vgo_CL with "Vgo"
+	LogType string
+	// URL replaces https://<workspace id>.ods.opinsights.azure.com, for
+	// the national clouds
+	URL string
+	// AzureResourceID associates the records with an Azure resource
+	AzureResourceID string `toml:"azure_resource_id"`
+	// MaxDimensions is the number of tags kept as dimensions, in the order
+	// of their names
+	MaxDimensions int
+	// MaxPostSize is the size of the body of a post at most
+	MaxPostSize int
+	// MaxRetries is the number of retries of a post answered 429 or 503
+	MaxRetries int
+	Timeout    misc.Duration
+
+	key    []byte
+	url    string
+	client *http.Client
+}
+
+// record is a row of the custom log
+type record struct {
+	Time       string            `json:"Time"`
+	Namespace  string            `json:"Namespace"`
+	Name       string            `json:"Name"`
+	Value      float64           `json:"Value"`
+	Dimensions map[string]string `json:"Dimensions,omitempty"`
+}
+
+var sampleConfig = `
+  ## Log Analytics workspace id and its primary or secondary shared key
+  workspace_id = "00000000-0000-0000-0000-000000000000"
+  shared_key = ""
+  ## Custom log of the records, stored as <log_type>_CL
+  # log_type = "Vgo"
+  ## Data Collector API url, by default
+  ## https://<workspace_id>.ods.opinsights.azure.com, for the national clouds
+  # url = "https://<workspace_id>.ods.opinsights.azure.us"
+  ## Azure resource the records belong to
+  # azure_resource_id = ""
+
+  ## Tags kept as dimensions, in the order of their names, at most 10
+  # max_dimensions = 10
+  ## Size of a post at most, the metrics of a write are sent in several posts
+  # max_post_size = 31457280
+  ## Retries of a post throttled (429) or refused (503), after the
+  ## Retry-After of the answer
+  # max_retries = 3
+  # timeout = "10s"
+`
+
+func (a *AzureMonitor) Connect() error {
+	if a.WorkspaceID == "" || a.SharedKey == "" {
+		return errors.New("workspace_id and shared_key are required")
+	}
+	key, err := base64.StdEncoding.DecodeString(a.SharedKey)
+	if err != nil {
+		return fmt.Errorf("invalid shared_key, %s", err)
+	}
+	a.key = key
+	if !logTypeRe.MatchString(a.LogType) {
+		return fmt.Errorf("invalid log_type %q, letters, digits and _ only", a.LogType)
+	}
+	if a.MaxDimensions <= 0 || a.MaxDimensions > maxDimensions {
+		a.MaxDimensions = maxDimensions
+	}
+	if a.MaxPostSize <= 0 || a.MaxPostSize > maxPostSize {
+		a.MaxPostSize = maxPostSize
+	}
+
+	a.url = a.URL
+	if a.url == "" {
+		a.url = "https://" + a.WorkspaceID + ".ods.opinsights.azure.com"
+	}
+	a.url = strings.TrimRight(a.url, "/") + logsPath + "?api-version=" + apiVersion
+
+	a.client = &http.Client{
+		Timeout: a.Timeout.Duration,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+		},
+	}
+	return nil
+}
+
+func (a *AzureMonitor) Close() error {
+	return nil
+}
+
+func (a *AzureMonitor) Write(metrics service.Metrics) error {
+	return a.WriteContext(context.Background(), metrics)
+}
+
+// WriteContext posts the records in JSON arrays of MaxPostSize bytes at
+// most, aborted when ctx is done.
+func (a *AzureMonitor) WriteContext(ctx context.Context, metrics service.Metrics) error {
+	var err error
+	var body bytes.Buffer
+	for _, metric := range metrics.Data {
+		for _, r := range a.buildRecords(metric) {
+			b, e := json.Marshal(r)
+			if e != nil {
+				return e
+			}
+			// [ , and ]
+			if body.Len() > 0 && body.Len()+len(b)+2 > a.MaxPostSize {
+				if e := a.flush(ctx, &body); e != nil {
+					err = e
+				}
+			}
+			if body.Len() == 0 {
+				body.WriteByte('[')
+			} else {
+				body.WriteByte(',')
+			}
+			body.Write(b)
+		}
+	}
+	if body.Len() > 0 {
+		if e := a.flush(ctx, &body); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (a *AzureMonitor) flush(ctx context.Context, body *bytes.Buffer) error {
+	body.WriteByte(']')
+	err := a.post(ctx, body.Bytes())
+	body.Reset()
+	if err != nil {
+		service.VLogger.Error("Azure Monitor Write", zap.Error(err))
+	}
+	return err
+}
+
+// buildRecords makes one record for each numeric field of the metric, the
+// non numeric fields are dropped.
+func (a *AzureMonitor) buildRecords(metric *service.MetricData) []*record {
+	dimensions := a.buildDimensions(metric)
+	timestamp := metric.Time.UTC().Format(time.RFC3339Nano)
+
+	records := make([]*record, 0, len(metric.Fields))
+	for k, v := range metric.Fields {
+		value, ok := service.ValueToFloat(v)
+		if !ok {
+			service.VLogger.Debug("Azure Monitor non numeric field dropped",
+				zap.String("metric", metric.Name),
+				zap.String("field", k),
+			)
+			continue
+		}
+		records = append(records, &record{
+			Time:       timestamp,
+			Namespace:  metric.Name,
+			Name:       k,
+			Value:      value,
+			Dimensions: dimensions,
+		})
+	}
+	return records
+}
+
+// buildDimensions keeps the first MaxDimensions tags by name, so the same
+// tags always give the same dimensions.
+func (a *AzureMonitor) buildDimensions(metric *service.MetricData) map[string]string {
+	if len(metric.Tags) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(metric.Tags))
+	for k := range metric.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if len(keys) > a.MaxDimensions {
+		service.VLogger.Warn("Azure Monitor too many dimensions, truncated",
+			zap.String("metric", metric.Name),
+			zap.Int("dimensions", len(keys)),
+			zap.Int("max", a.MaxDimensions),
+		)
+		keys = keys[:a.MaxDimensions]
+	}
+
+	dimensions := make(map[string]string, len(keys))
+	for _, k := range keys {
+		dimensions[k] = metric.Tags[k]
+	}
+	return dimensions
+}
+
+// post sends the records, retrying after the Retry-After of the answer
+// while the workspace throttles the posts with 429, or answers 503.
+func (a *AzureMonitor) post(ctx context.Context, body []byte) error {
+	backoff := time.Second
+	for retry := 0; ; retry++ {
+		req, err := http.NewRequest("POST", a.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		// the date is signed, it is renewed with every try
+		date := time.Now().UTC().Format(http.TimeFormat)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Log-Type", a.LogType)
+		req.Header.Set("x-ms-date", date)
+		req.Header.Set("time-generated-field", "Time")
+		req.Header.Set("Authorization", signature(a.WorkspaceID, a.key, date, len(body)))
+		if a.AzureResourceID != "" {
+			req.Header.Set("x-ms-AzureResourceId", a.AzureResourceID)
+		}
+
+		resp, err := a.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return nil
+		case (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) && retry < a.MaxRetries:
+			wait := retryAfter(resp.Header.Get("Retry-After"), backoff)
+			service.VLogger.Warn("Azure Monitor throttled, retrying",
+				zap.Int("status", resp.StatusCode),
+				zap.Int("retry", retry+1),
+				zap.Duration("wait", wait),
+			)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff *= 2
+		default:
+			return fmt.Errorf("status %d, %s", resp.StatusCode, string(b))
+		}
+	}
+}
+
+// retryAfter returns the wait of a Retry-After header, in seconds or an
+// HTTP date, or backoff without a valid one.
+func retryAfter(header string, backoff time.Duration) time.Duration {
+	if header == "" {
+		return backoff
+	}
+	if s, err := strconv.Atoi(header); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		if d := t.Sub(time.Now()); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return backoff
+}
+
+func (a *AzureMonitor) Init(stop chan bool) {
+	if err := a.Connect(); err != nil {
+		log.Fatal("Azure Monitor Connect failed, err message is ", err)
+	}
+}
+
+func (a *AzureMonitor) Start() {
+
+}
+
+// ComputeContext writes the metrics, aborted when ctx is done.
+func (a *AzureMonitor) ComputeContext(ctx context.Context, metrics service.Metrics) error {
+	return a.WriteContext(ctx, metrics)
+}
+
+func (a *AzureMonitor) Compute(metrics service.Metrics) error {
+	return a.Write(metrics)
+}
+
+func init() {
+	service.AddMetricOutput("azure_monitor", &AzureMonitor{
+		LogType:       "Vgo",
+		MaxDimensions: maxDimensions,
+		MaxPostSize:   maxPostSize,
+		MaxRetries:    3,
+		Timeout:       misc.Duration{Duration: 10 * time.Second},
+	})
+}
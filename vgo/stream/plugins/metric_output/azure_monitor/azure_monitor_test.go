@@ -0,0 +1,301 @@
+package azure_monitor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+const (
+	workspaceID = "b5b4d8e3-5f6a-4d2e-9c1b-0a2f3e4d5c6b"
+	// sharedKey is "workspace-shared-key" in base64
+	sharedKey = "d29ya3NwYWNlLXNoYXJlZC1rZXk="
+)
+
+func TestSignature(t *testing.T) {
+	key, _ := base64.StdEncoding.DecodeString(sharedKey)
+	// computed apart from the output, on the string to sign of the Data
+	// Collector API documentation
+	want := "SharedKey " + workspaceID + ":k01naDSc1rdn8V2Zwdh/0y3hiFlOSBq1fv+CXiMNefk="
+	if got := signature(workspaceID, key, "Mon, 04 Apr 2016 08:00:00 GMT", 1024); got != want {
+		t.Errorf("got signature %s, want %s", got, want)
+	}
+
+	// the length, the date and the key are signed
+	for _, other := range []string{
+		signature(workspaceID, key, "Mon, 04 Apr 2016 08:00:00 GMT", 1025),
+		signature(workspaceID, key, "Mon, 04 Apr 2016 08:00:01 GMT", 1024),
+		signature(workspaceID, []byte("other key"), "Mon, 04 Apr 2016 08:00:00 GMT", 1024),
+	} {
+		if other == want {
+			t.Errorf("got the same signature %s", other)
+		}
+	}
+}
+
+// mockCollector is the Data Collector API, it checks the signature of the
+// posts like Azure and answers the next statuses, 200 once they're used.
+type mockCollector struct {
+	*httptest.Server
+	retryAfter string
+
+	sync.Mutex
+	statuses []int
+	posts    int
+	largest  int
+	records  []record
+	headers  []http.Header
+}
+
+func newMockCollector() *mockCollector {
+	c := &mockCollector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		c.Lock()
+		defer c.Unlock()
+		c.posts++
+		if len(body) > c.largest {
+			c.largest = len(body)
+		}
+		c.headers = append(c.headers, r.Header)
+
+		if r.URL.Path != logsPath || r.URL.Query().Get("api-version") != apiVersion {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// the signature of the length and the date of the post
+		toSign := "POST\n" + strconv.Itoa(len(body)) + "\napplication/json\nx-ms-date:" + r.Header.Get("x-ms-date") + "\n" + logsPath
+		key, _ := base64.StdEncoding.DecodeString(sharedKey)
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(toSign))
+		if r.Header.Get("Authorization") != "SharedKey "+workspaceID+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if len(c.statuses) > 0 {
+			status := c.statuses[0]
+			c.statuses = c.statuses[1:]
+			if status != http.StatusOK {
+				w.Header().Set("Retry-After", c.retryAfter)
+				w.WriteHeader(status)
+				return
+			}
+		}
+		var records []record
+		if err := json.Unmarshal(body, &records); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c.records = append(c.records, records...)
+	}))
+	return c
+}
+
+// counts returns the number of posts and records received.
+func (c *mockCollector) counts() (posts, records int) {
+	c.Lock()
+	defer c.Unlock()
+	return c.posts, len(c.records)
+}
+
+func newAzureMonitor(t *testing.T, url string) *AzureMonitor {
+	a := &AzureMonitor{
+		WorkspaceID:   workspaceID,
+		SharedKey:     sharedKey,
+		LogType:       "Vgo",
+		URL:           url,
+		MaxDimensions: maxDimensions,
+		MaxPostSize:   maxPostSize,
+		MaxRetries:    3,
+		Timeout:       misc.Duration{Duration: 5 * time.Second},
+	}
+	if err := a.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func cpu(host string) *service.MetricData {
+	return &service.MetricData{
+		Name:   "cpu",
+		Tags:   map[string]string{"host": host},
+		Fields: map[string]interface{}{"usage": 12.5, "cores": int64(4), "state": "ok"},
+		Time:   time.Unix(1500000000, 0),
+	}
+}
+
+func TestWriteSigned(t *testing.T) {
+	c := newMockCollector()
+	defer c.Close()
+	a := newAzureMonitor(t, c.URL)
+	a.AzureResourceID = "/subscriptions/1/resourceGroups/vgo"
+
+	if err := a.Write(service.Metrics{Data: []*service.MetricData{cpu("a")}}); err != nil {
+		t.Fatal(err)
+	}
+	// a record per numeric field
+	c.Lock()
+	defer c.Unlock()
+	if len(c.records) != 2 {
+		t.Fatalf("got records %v, want the 2 numeric fields", c.records)
+	}
+	for _, r := range c.records {
+		if r.Namespace != "cpu" || r.Time != "2017-07-14T02:40:00Z" || r.Dimensions["host"] != "a" {
+			t.Errorf("got record %+v", r)
+		}
+	}
+	h := c.headers[0]
+	if h.Get("Log-Type") != "Vgo" || h.Get("time-generated-field") != "Time" || h.Get("x-ms-AzureResourceId") != a.AzureResourceID {
+		t.Errorf("got headers %v", h)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	c := newMockCollector()
+	defer c.Close()
+	a := newAzureMonitor(t, c.URL)
+	a.key = []byte("other key")
+	if err := a.Write(service.Metrics{Data: []*service.MetricData{cpu("a")}}); err == nil {
+		t.Error("post with the wrong key accepted")
+	}
+}
+
+func TestPostSize(t *testing.T) {
+	c := newMockCollector()
+	defer c.Close()
+	a := newAzureMonitor(t, c.URL)
+
+	var metrics service.Metrics
+	for i := 0; i < 20; i++ {
+		metrics.Data = append(metrics.Data, cpu(strconv.Itoa(i)))
+	}
+	size, _ := json.Marshal(a.buildRecords(cpu("10")))
+	// several records per post, not all of them
+	a.MaxPostSize = 3 * len(size)
+	if err := a.Write(metrics); err != nil {
+		t.Fatal(err)
+	}
+	c.Lock()
+	defer c.Unlock()
+	if len(c.records) != 40 {
+		t.Errorf("got %d records, want 40", len(c.records))
+	}
+	if c.posts < 2 || c.largest > a.MaxPostSize {
+		t.Errorf("got %d posts of %d bytes at most, want them split by %d bytes", c.posts, c.largest, a.MaxPostSize)
+	}
+}
+
+func TestDimensionsTruncated(t *testing.T) {
+	a := &AzureMonitor{MaxDimensions: 3}
+	m := &service.MetricData{Name: "cpu", Tags: map[string]string{"e": "5", "b": "2", "d": "4", "a": "1", "c": "3"}}
+	// the first tags by name, the same ones every time
+	dimensions := a.buildDimensions(m)
+	if len(dimensions) != 3 || dimensions["a"] != "1" || dimensions["b"] != "2" || dimensions["c"] != "3" {
+		t.Errorf("got dimensions %v, want a, b and c", dimensions)
+	}
+	if dimensions := a.buildDimensions(&service.MetricData{Name: "cpu"}); dimensions != nil {
+		t.Errorf("got dimensions %v without tags", dimensions)
+	}
+}
+
+func TestThrottledRetried(t *testing.T) {
+	c := newMockCollector()
+	defer c.Close()
+	c.retryAfter = "0"
+	c.statuses = []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}
+	a := newAzureMonitor(t, c.URL)
+
+	// the date is signed again with every try
+	if err := a.Write(service.Metrics{Data: []*service.MetricData{cpu("a")}}); err != nil {
+		t.Fatal(err)
+	}
+	if posts, records := c.counts(); posts != 3 || records != 2 {
+		t.Errorf("got %d posts and %d records, want 3 and 2", posts, records)
+	}
+
+	// until the retries are exhausted
+	c.Lock()
+	c.statuses = []int{429, 429, 429, 429}
+	c.Unlock()
+	if err := a.Write(service.Metrics{Data: []*service.MetricData{cpu("a")}}); err == nil {
+		t.Error("post throttled every time succeeded")
+	}
+	if posts, _ := c.counts(); posts != 7 {
+		t.Errorf("got %d posts, want the post and 3 retries", posts-3)
+	}
+
+	// the other errors aren't retried
+	c.Lock()
+	c.statuses = []int{http.StatusBadRequest}
+	c.Unlock()
+	if err := a.Write(service.Metrics{Data: []*service.MetricData{cpu("a")}}); err == nil {
+		t.Error("post refused succeeded")
+	}
+	if posts, _ := c.counts(); posts != 8 {
+		t.Errorf("got %d posts, want 1", posts-7)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	backoff := 2 * time.Second
+	for _, tt := range []struct {
+		header string
+		wait   time.Duration
+	}{
+		{"", backoff},
+		{"5", 5 * time.Second},
+		{"0", 0},
+		{"-1", backoff},
+		{"soon", backoff},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0},
+	} {
+		if wait := retryAfter(tt.header, backoff); wait != tt.wait {
+			t.Errorf("Retry-After %q, got %s, want %s", tt.header, wait, tt.wait)
+		}
+	}
+
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if wait := retryAfter(date, backoff); wait <= 58*time.Second || wait > time.Minute {
+		t.Errorf("Retry-After %q, got %s, want a minute", date, wait)
+	}
+}
+
+func TestConnectInvalid(t *testing.T) {
+	for _, a := range []*AzureMonitor{
+		{SharedKey: sharedKey, LogType: "Vgo"},
+		{WorkspaceID: workspaceID, LogType: "Vgo"},
+		{WorkspaceID: workspaceID, SharedKey: "not base64!", LogType: "Vgo"},
+		{WorkspaceID: workspaceID, SharedKey: sharedKey, LogType: "vgo-metrics"},
+		{WorkspaceID: workspaceID, SharedKey: sharedKey},
+	} {
+		if err := a.Connect(); err == nil {
+			t.Errorf("invalid config %+v accepted", a)
+		}
+	}
+
+	// the endpoint of the workspace by default
+	a := &AzureMonitor{WorkspaceID: workspaceID, SharedKey: sharedKey, LogType: "Vgo"}
+	if err := a.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://" + workspaceID + ".ods.opinsights.azure.com/api/logs?api-version=2016-04-01"; a.url != want {
+		t.Errorf("got url %s, want %s", a.url, want)
+	}
+}
@@ -0,0 +1,22 @@
+package azure_monitor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+)
+
+// signature returns the Authorization header of a post of length bytes to
+// the Data Collector API, sent with the x-ms-date header date:
+//
+//	SharedKey <workspace id>:<base64 HMAC-SHA256 of the string to sign>
+//
+// The HMAC is keyed by the base64 decoded shared key of the workspace.
+func signature(workspaceID string, key []byte, date string, length int) string {
+	toSign := "POST\n" + strconv.Itoa(length) + "\napplication/json\n" + "x-ms-date:" + date + "\n" + logsPath
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(toSign))
+	return "SharedKey " + workspaceID + ":" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,224 @@
+package cloudwatch
+
+import (
+	"log"
+	"math"
+	"sort"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+const (
+	// maxDatumsPerCall is the PutMetricData limit of datums per request
+	maxDatumsPerCall = 20
+	// maxDimensions is the CloudWatch limit of dimensions per datum
+	maxDimensions = 10
+	// warnSample logs one invalid value out of warnSample
+	warnSample = 100
+)
+
+type CloudWatch struct {
+	Region    string
+	AccessKey string
+	SecretKey string
+	Token     string
+	Namespace string
+	// HighResolutionMetrics stores the metrics with a 1 second resolution
+	HighResolutionMetrics bool
+	// DropNonNumeric drops the bool fields instead of sending them as 0 or 1,
+	// the string fields are always dropped
+	DropNonNumeric bool
+
+	svc *cloudwatch.CloudWatch
+	// invalid counts the NaN and infinite values skipped
+	invalid uint64
+}
+
+var sampleConfig = `
+  ## Amazon Region
+  region = "us-east-1"
+
+  ## Amazon Credentials, if not set the default AWS credential chain is used
+  ## (environment, shared credentials file, EC2 instance role)
+  # access_key = ""
+  # secret_key = ""
+  # token = ""
+
+  ## Namespace for the CloudWatch MetricDatums
+  namespace = "vgo/stream"
+
+  ## Store the metrics with a 1 second storage resolution
+  # high_resolution_metrics = false
+
+  ## Drop the bool fields instead of sending them as 0 or 1,
+  ## CloudWatch only stores numbers so string fields are always dropped
+  # drop_non_numeric = false
+`
+
+func (c *CloudWatch) Connect() error {
+	config := &aws.Config{
+		Region: aws.String(c.Region),
+	}
+	// without static keys the default credential chain is used
+	if c.AccessKey != "" || c.SecretKey != "" {
+		config.Credentials = credentials.NewStaticCredentials(c.AccessKey, c.SecretKey, c.Token)
+	}
+
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return err
+	}
+	c.svc = cloudwatch.New(sess)
+	return nil
+}
+
+func (c *CloudWatch) Close() error {
+	return nil
+}
+
+// Write publishes every numeric field as a datum, at most maxDatumsPerCall
+// datums per PutMetricData request.
+func (c *CloudWatch) Write(metrics service.Metrics) error {
+	var datums []*cloudwatch.MetricDatum
+	for _, metric := range metrics.Data {
+		datums = append(datums, c.buildMetricDatums(metric)...)
+	}
+
+	var err error
+	for len(datums) > 0 {
+		n := len(datums)
+		if n > maxDatumsPerCall {
+			n = maxDatumsPerCall
+		}
+		if e := c.writeToCloudWatch(datums[:n]); e != nil {
+			service.VLogger.Error("CloudWatch Write", zap.Error(e))
+			err = e
+		}
+		datums = datums[n:]
+	}
+
+	return err
+}
+
+func (c *CloudWatch) writeToCloudWatch(datums []*cloudwatch.MetricDatum) error {
+	params := &cloudwatch.PutMetricDataInput{
+		MetricData: datums,
+		Namespace:  aws.String(c.Namespace),
+	}
+	_, err := c.svc.PutMetricData(params)
+	return err
+}
+
+// buildMetricDatums makes one datum for each numeric field of the metric,
+// named <metric>_<field>, with the metric's tags as dimensions.
+func (c *CloudWatch) buildMetricDatums(metric *service.MetricData) []*cloudwatch.MetricDatum {
+	dimensions := c.buildDimensions(metric)
+
+	datums := make([]*cloudwatch.MetricDatum, 0, len(metric.Fields))
+	for k, v := range metric.Fields {
+		value, ok := c.convert(v)
+		if !ok {
+			service.VLogger.Debug("CloudWatch non numeric field dropped",
+				zap.String("metric", metric.Name),
+				zap.String("field", k),
+			)
+			continue
+		}
+		// CloudWatch rejects the whole request of a NaN or infinite value
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			c.skip(metric, k, value)
+			continue
+		}
+
+		datum := &cloudwatch.MetricDatum{
+			MetricName: aws.String(metric.Name + "_" + k),
+			Dimensions: dimensions,
+			Timestamp:  aws.Time(metric.Time),
+			Value:      aws.Float64(value),
+		}
+		if c.HighResolutionMetrics {
+			datum.StorageResolution = aws.Int64(1)
+		}
+		datums = append(datums, datum)
+	}
+
+	return datums
+}
+
+// skip counts the skipped value and logs a sample of them.
+func (c *CloudWatch) skip(metric *service.MetricData, field string, value float64) {
+	n := atomic.AddUint64(&c.invalid, 1)
+	if n%warnSample != 1 {
+		return
+	}
+	service.VLogger.Warn("CloudWatch invalid value skipped",
+		zap.String("metric", metric.Name),
+		zap.String("field", field),
+		zap.Float64("value", value),
+		zap.Int64("skipped", int64(n)),
+	)
+}
+
+// Invalid returns the number of NaN and infinite values skipped.
+func (c *CloudWatch) Invalid() uint64 {
+	return atomic.LoadUint64(&c.invalid)
+}
+
+// buildDimensions makes the dimensions from the metric tags, sorted by key
+// so the same tags always give the same dimensions.
+func (c *CloudWatch) buildDimensions(metric *service.MetricData) []*cloudwatch.Dimension {
+	keys := make([]string, 0, len(metric.Tags))
+	for k := range metric.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if len(keys) > maxDimensions {
+		service.VLogger.Warn("CloudWatch too many dimensions, truncated",
+			zap.String("metric", metric.Name),
+			zap.Int("dimensions", len(keys)),
+			zap.Int("max", maxDimensions),
+		)
+		keys = keys[:maxDimensions]
+	}
+
+	dimensions := make([]*cloudwatch.Dimension, 0, len(keys))
+	for _, k := range keys {
+		dimensions = append(dimensions, &cloudwatch.Dimension{
+			Name:  aws.String(k),
+			Value: aws.String(metric.Tags[k]),
+		})
+	}
+	return dimensions
+}
+
+func (c *CloudWatch) convert(v interface{}) (float64, bool) {
+	if _, ok := v.(bool); ok && c.DropNonNumeric {
+		return 0, false
+	}
+	return service.ValueToFloat(v)
+}
+
+func (c *CloudWatch) Init(stop chan bool) {
+	if err := c.Connect(); err != nil {
+		log.Fatal("CloudWatch Connect failed, err message is ", err)
+	}
+}
+
+func (c *CloudWatch) Start() {
+
+}
+
+func (c *CloudWatch) Compute(metrics service.Metrics) error {
+	return c.Write(metrics)
+}
+
+func init() {
+	service.AddMetricOutput("cloudwatch", &CloudWatch{Namespace: "vgo/stream", Region: "us-east-1"})
+}
@@ -0,0 +1,95 @@
+package cloudwatch
+
+import (
+	"io/ioutil"
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+// datums returns the values of the datums of the metric by name.
+func datums(c *CloudWatch, metric *service.MetricData) map[string]float64 {
+	values := make(map[string]float64)
+	for _, d := range c.buildMetricDatums(metric) {
+		values[*d.MetricName] = *d.Value
+	}
+	return values
+}
+
+func TestMixedFieldTypes(t *testing.T) {
+	metric := &service.MetricData{
+		Name:   "app",
+		Tags:   map[string]string{"host": "a"},
+		Fields: map[string]interface{}{"latency": 1.5, "requests": int64(10), "healthy": true, "version": "1.2"},
+		Time:   time.Unix(1, 0),
+	}
+
+	// the bools are sent as 0 or 1, the strings are dropped
+	got := datums(&CloudWatch{}, metric)
+	want := map[string]float64{"app_latency": 1.5, "app_requests": 10, "app_healthy": 1}
+	if len(got) != len(want) {
+		t.Errorf("got datums %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("datum %s %v, want %v", k, got[k], v)
+		}
+	}
+
+	got = datums(&CloudWatch{DropNonNumeric: true}, metric)
+	if _, ok := got["app_healthy"]; ok || len(got) != 2 {
+		t.Errorf("drop_non_numeric, got datums %v", got)
+	}
+}
+
+func TestInvalidValues(t *testing.T) {
+	metric := &service.MetricData{
+		Name:   "app",
+		Fields: map[string]interface{}{"latency": 1.5, "nan": math.NaN(), "inf": math.Inf(1), "ninf": float32(math.Inf(-1))},
+		Time:   time.Unix(1, 0),
+	}
+
+	c := &CloudWatch{}
+	got := datums(c, metric)
+	if len(got) != 1 || got["app_latency"] != 1.5 {
+		t.Errorf("got datums %v, want app_latency only", got)
+	}
+	if n := c.Invalid(); n != 3 {
+		t.Errorf("got %d invalid values, want 3", n)
+	}
+}
+
+func TestDimensions(t *testing.T) {
+	tags := make(map[string]string)
+	for _, k := range []string{"l", "k", "j", "i", "h", "g", "f", "e", "d", "c", "b", "a"} {
+		tags[k] = k + "v"
+	}
+	c := &CloudWatch{HighResolutionMetrics: true}
+	ds := c.buildMetricDatums(&service.MetricData{Name: "m", Tags: tags, Fields: map[string]interface{}{"v": 1.0}})
+	if len(ds) != 1 {
+		t.Fatalf("got %d datums", len(ds))
+	}
+	if *ds[0].StorageResolution != 1 {
+		t.Error("high resolution not set")
+	}
+
+	// truncated to the first tags in key order
+	var names []string
+	for _, d := range ds[0].Dimensions {
+		names = append(names, *d.Name)
+		if *d.Value != *d.Name+"v" {
+			t.Errorf("dimension %s value %s", *d.Name, *d.Value)
+		}
+	}
+	if len(names) != maxDimensions || !sort.StringsAreSorted(names) || names[0] != "a" {
+		t.Errorf("got dimensions %v", names)
+	}
+}
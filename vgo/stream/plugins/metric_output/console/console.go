@@ -0,0 +1,201 @@
+package console
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+const (
+	colorReset  = "\x1b[0m"
+	colorName   = "\x1b[1;36m"
+	colorTag    = "\x1b[33m"
+	colorField  = "\x1b[32m"
+	colorFaint  = "\x1b[2m"
+	timeLayout  = time.RFC3339
+	tableIndent = "    "
+)
+
+// stdout is shared by all the console outputs and their workers, so a batch
+// is always printed in one piece.
+var stdout sync.Mutex
+
+type Console struct {
+	// Format can be "table", "line" or "json"
+	Format string
+	// Colors prints names, tags and fields with ANSI colors
+	Colors bool
+}
+
+var sampleConfig = `
+  ## Print format, can be: "table", "line", "json"
+  format = "line"
+  ## Print with ANSI colors
+  # colors = false
+`
+
+func (c *Console) Connect() error {
+	switch c.Format {
+	case "table", "line", "json":
+		return nil
+	default:
+		return fmt.Errorf("invalid format %s", c.Format)
+	}
+}
+
+func (c *Console) Close() error {
+	return nil
+}
+
+// Write renders the metrics and prints them to stdout.
+func (c *Console) Write(metrics service.Metrics) {
+	var b bytes.Buffer
+	for _, metric := range metrics.Data {
+		switch c.Format {
+		case "table":
+			c.table(&b, metric)
+		case "json":
+			c.json(&b, metric)
+		default:
+			c.line(&b, metric)
+		}
+	}
+
+	stdout.Lock()
+	defer stdout.Unlock()
+	if _, err := os.Stdout.Write(b.Bytes()); err != nil {
+		service.VLogger.Error("Console Write", zap.Error(err))
+	}
+}
+
+// line prints one metric per line:
+//   2016-12-01T10:00:00Z cpu host=a,cpu=cpu0 idle=98.5 user=1.5
+func (c *Console) line(b *bytes.Buffer, metric *service.MetricData) {
+	b.WriteString(c.color(colorFaint, metric.Time.Format(timeLayout)))
+	b.WriteByte(' ')
+	b.WriteString(c.color(colorName, metric.Name))
+
+	for i, k := range sortedTags(metric.Tags) {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(c.color(colorTag, k+"="+metric.Tags[k]))
+	}
+
+	for i, k := range sortedFields(metric.Fields) {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(c.color(colorField, fmt.Sprintf("%s=%v", k, metric.Fields[k])))
+	}
+	b.WriteByte('\n')
+}
+
+// table prints the metric name and time, then a tag or a field per line with
+// the values aligned.
+func (c *Console) table(b *bytes.Buffer, metric *service.MetricData) {
+	b.WriteString(c.color(colorName, metric.Name))
+	b.WriteByte(' ')
+	b.WriteString(c.color(colorFaint, metric.Time.Format(timeLayout)))
+	b.WriteByte('\n')
+
+	tags := sortedTags(metric.Tags)
+	fields := sortedFields(metric.Fields)
+
+	width := 0
+	for _, k := range tags {
+		width = max(width, len(k))
+	}
+	for _, k := range fields {
+		width = max(width, len(k))
+	}
+
+	for _, k := range tags {
+		fmt.Fprintf(b, "%s%s %-*s  %s\n", tableIndent, c.color(colorFaint, "tag  "),
+			width, k, c.color(colorTag, metric.Tags[k]))
+	}
+	for _, k := range fields {
+		fmt.Fprintf(b, "%s%s %-*s  %s\n", tableIndent, c.color(colorFaint, "field"),
+			width, k, c.color(colorField, fmt.Sprint(metric.Fields[k])))
+	}
+}
+
+// json prints the metric as an indented JSON object, colors don't apply.
+func (c *Console) json(b *bytes.Buffer, metric *service.MetricData) {
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"name":      metric.Name,
+		"tags":      metric.Tags,
+		"fields":    metric.Fields,
+		"timestamp": metric.Time.Format(timeLayout),
+	}, "", "  ")
+	if err != nil {
+		service.VLogger.Error("Console Write", zap.String("metric", metric.Name), zap.Error(err))
+		return
+	}
+	b.Write(data)
+	b.WriteByte('\n')
+}
+
+func (c *Console) color(code, s string) string {
+	if !c.Colors {
+		return s
+	}
+	return code + s + colorReset
+}
+
+func sortedTags(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedFields(fields map[string]interface{}) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (c *Console) Init(stop chan bool) {
+	if err := c.Connect(); err != nil {
+		log.Fatal("Console Connect failed, err message is ", err)
+	}
+}
+
+func (c *Console) Start() {
+
+}
+
+// Compute prints the metrics, it never fails.
+func (c *Console) Compute(metrics service.Metrics) error {
+	c.Write(metrics)
+	return nil
+}
+
+func init() {
+	service.AddMetricOutput("console", &Console{Format: "line"})
+}
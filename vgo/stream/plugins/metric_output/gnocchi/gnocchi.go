@@ -0,0 +1,354 @@
+package gnocchi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+// batchPath receives the measures of several metrics of several resources,
+// the metrics missing are created with their archive policy
+const batchPath = "/v1/batch/resources/metrics/measures?create_metrics=true"
+
+// Gnocchi writes the metrics to OpenStack Gnocchi. The metrics of a series
+// belong to the resource named by the ResourceTag tag, every field is the
+// Gnocchi metric <metric>.<field> of its resource. The resources missing
+// are created, with the Attributes tags as attributes.
+type Gnocchi struct {
+	// URL of the Gnocchi API, like http://gnocchi.example.com:8041
+	URL string
+	// AuthURL of Keystone, like http://keystone.example.com:5000
+	AuthURL           string
+	Username          string
+	Password          string
+	UserDomainName    string
+	ProjectName       string
+	ProjectDomainName string
+	// ResourceType of the resources created
+	ResourceType string
+	// ResourceTag is the tag whose value is the id of the resource
+	ResourceTag string
+	// Attributes are the tags set as attributes of the resources created,
+	// they must be attributes of the ResourceType
+	Attributes []string
+	// ArchivePolicy of the metrics created, the one of the archive policy
+	// rules of Gnocchi if not set
+	ArchivePolicy string
+	Timeout       misc.Duration
+
+	SSLCA              string `toml:"ssl_ca"`
+	SSLCert            string `toml:"ssl_cert"`
+	SSLKey             string `toml:"ssl_key"`
+	InsecureSkipVerify bool
+
+	client *http.Client
+	auth   *keystone
+}
+
+// measure is a value of a Gnocchi metric
+type measure struct {
+	Timestamp string  `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+// metricMeasures are the measures of a metric of the batch
+type metricMeasures struct {
+	ArchivePolicyName string     `json:"archive_policy_name,omitempty"`
+	Measures          []*measure `json:"measures"`
+}
+
+// batch are the measures by metric name by resource id, the body of the
+// batch request
+type batch map[string]map[string]*metricMeasures
+
+var sampleConfig = `
+  ## Gnocchi API
+  url = "http://localhost:8041"
+  ## Keystone v3 password authentication, the token is renewed when it
+  ## expires
+  auth_url = "http://localhost:5000"
+  username = "vgo"
+  password = ""
+  # user_domain_name = "Default"
+  # project_name = "service"
+  # project_domain_name = "Default"
+
+  ## Type of the resources created
+  # resource_type = "generic"
+  ## Tag holding the resource id, the metrics without it are dropped
+  # resource_tag = "host"
+  ## Tags set as attributes of the resources created, they must be
+  ## attributes of the resource type
+  # attributes = []
+  ## Archive policy of the metrics created, by default the one of the
+  ## archive policy rules of Gnocchi
+  # archive_policy = "low"
+  # timeout = "5s"
+
+  ## Optional SSL Config
+  # ssl_ca = "/etc/vgo/ca.pem"
+  # ssl_cert = "/etc/vgo/cert.pem"
+  # ssl_key = "/etc/vgo/key.pem"
+  # insecure_skip_verify = false
+`
+
+func (g *Gnocchi) Connect() error {
+	if g.URL == "" || g.AuthURL == "" {
+		return errors.New("url and auth_url are required")
+	}
+	if g.Username == "" {
+		return errors.New("username is required")
+	}
+
+	tlsConfig, err := misc.GetTLSConfig(g.SSLCert, g.SSLKey, g.SSLCA, g.InsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+	g.client = &http.Client{
+		Timeout: g.Timeout.Duration,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	g.auth = &keystone{
+		authURL:       g.AuthURL,
+		username:      g.Username,
+		password:      g.Password,
+		userDomain:    g.UserDomainName,
+		project:       g.ProjectName,
+		projectDomain: g.ProjectDomainName,
+		client:        g.client,
+	}
+
+	// fail early on bad credentials
+	_, err = g.auth.Token(context.Background())
+	return err
+}
+
+func (g *Gnocchi) Close() error {
+	return nil
+}
+
+func (g *Gnocchi) Write(metrics service.Metrics) error {
+	return g.WriteContext(context.Background(), metrics)
+}
+
+// WriteContext posts the measures in one batch request. When Gnocchi
+// answers that resources are missing, they are created and the batch is
+// posted again.
+func (g *Gnocchi) WriteContext(ctx context.Context, metrics service.Metrics) error {
+	b, attrs := g.buildBatch(metrics.Data)
+	if len(b) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	status, resp, err := g.do(ctx, "POST", batchPath, body)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusBadRequest {
+		missing := unknownResources(resp)
+		if len(missing) == 0 {
+			return fmt.Errorf("batch status %d, %s", status, string(resp))
+		}
+		for _, id := range missing {
+			if err := g.createResource(ctx, id, attrs[id]); err != nil {
+				return err
+			}
+		}
+		if status, resp, err = g.do(ctx, "POST", batchPath, body); err != nil {
+			return err
+		}
+	}
+	if status != http.StatusAccepted {
+		return fmt.Errorf("batch status %d, %s", status, string(resp))
+	}
+	return nil
+}
+
+// buildBatch groups the numeric fields by resource then by metric, it
+// returns the attributes of the resources too. The metrics without the
+// ResourceTag are dropped.
+func (g *Gnocchi) buildBatch(metrics []*service.MetricData) (batch, map[string]map[string]string) {
+	b := make(batch)
+	attrs := make(map[string]map[string]string)
+	for _, metric := range metrics {
+		id := metric.Tags[g.ResourceTag]
+		if id == "" {
+			service.VLogger.Debug("Gnocchi metric without resource tag dropped",
+				zap.String("metric", metric.Name),
+				zap.String("tag", g.ResourceTag),
+			)
+			continue
+		}
+
+		resource, ok := b[id]
+		if !ok {
+			resource = make(map[string]*metricMeasures)
+			b[id] = resource
+			attrs[id] = g.attributes(metric)
+		}
+
+		timestamp := metric.Time.UTC().Format(time.RFC3339Nano)
+		for k, v := range metric.Fields {
+			value, ok := service.ValueToFloat(v)
+			if !ok {
+				continue
+			}
+			name := metric.Name + "." + k
+			mm, ok := resource[name]
+			if !ok {
+				mm = &metricMeasures{ArchivePolicyName: g.ArchivePolicy}
+				resource[name] = mm
+			}
+			mm.Measures = append(mm.Measures, &measure{Timestamp: timestamp, Value: value})
+		}
+		if len(resource) == 0 {
+			delete(b, id)
+		}
+	}
+	return b, attrs
+}
+
+func (g *Gnocchi) attributes(metric *service.MetricData) map[string]string {
+	attrs := make(map[string]string, len(g.Attributes))
+	for _, k := range g.Attributes {
+		if v, ok := metric.Tags[k]; ok {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+// createResource creates the resource, a resource created meanwhile is fine.
+func (g *Gnocchi) createResource(ctx context.Context, id string, attrs map[string]string) error {
+	resource := make(map[string]string, len(attrs)+1)
+	for k, v := range attrs {
+		resource[k] = v
+	}
+	resource["id"] = id
+	body, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+
+	status, resp, err := g.do(ctx, "POST", "/v1/resource/"+g.ResourceType, body)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusCreated && status != http.StatusConflict {
+		return fmt.Errorf("create resource %s status %d, %s", id, status, string(resp))
+	}
+	log.Printf("Gnocchi resource %s created\n", id)
+	return nil
+}
+
+// do sends the request with the Keystone token. A request refused with 401
+// is sent once more with a new token, for the tokens revoked before their
+// expiry.
+func (g *Gnocchi) do(ctx context.Context, method, path string, body []byte) (int, []byte, error) {
+	for retry := 0; ; retry++ {
+		token, err := g.auth.Token(ctx)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		req, err := http.NewRequest(method, strings.TrimRight(g.URL, "/")+path, bytes.NewReader(body))
+		if err != nil {
+			return 0, nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-Token", token)
+
+		resp, err := g.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return 0, nil, err
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && retry == 0 {
+			g.auth.Invalidate(token)
+			continue
+		}
+		return resp.StatusCode, b, nil
+	}
+}
+
+// unknownResources returns the ids of the resources missing of the 400
+// answer of a batch:
+// {"description": {"cause": "Unknown resources", "detail": [{"resource_id": ...}]}}
+func unknownResources(body []byte) []string {
+	var r struct {
+		Description struct {
+			Cause  string `json:"cause"`
+			Detail []struct {
+				ResourceID         string `json:"resource_id"`
+				OriginalResourceID string `json:"original_resource_id"`
+			} `json:"detail"`
+		} `json:"description"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil || r.Description.Cause != "Unknown resources" {
+		return nil
+	}
+
+	ids := make([]string, 0, len(r.Description.Detail))
+	for _, d := range r.Description.Detail {
+		// the resource ids which aren't UUIDs are converted by Gnocchi, the
+		// original one is the tag value
+		if d.OriginalResourceID != "" {
+			ids = append(ids, d.OriginalResourceID)
+		} else {
+			ids = append(ids, d.ResourceID)
+		}
+	}
+	return ids
+}
+
+func (g *Gnocchi) Init(stop chan bool) {
+	if err := g.Connect(); err != nil {
+		log.Fatal("Gnocchi Connect failed, err message is ", err)
+	}
+}
+
+func (g *Gnocchi) Start() {
+
+}
+
+// ComputeContext writes the metrics, aborted when ctx is done.
+func (g *Gnocchi) ComputeContext(ctx context.Context, metrics service.Metrics) error {
+	return g.WriteContext(ctx, metrics)
+}
+
+func (g *Gnocchi) Compute(metrics service.Metrics) error {
+	return g.Write(metrics)
+}
+
+func init() {
+	service.AddMetricOutput("gnocchi", &Gnocchi{
+		UserDomainName:    "Default",
+		ProjectDomainName: "Default",
+		ResourceType:      "generic",
+		ResourceTag:       "host",
+		Timeout:           misc.Duration{Duration: 5 * time.Second},
+	})
+}
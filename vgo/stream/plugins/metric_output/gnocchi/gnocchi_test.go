@@ -0,0 +1,292 @@
+package gnocchi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+// mockServer is Keystone and Gnocchi. Its tokens last lifetime, the
+// revoked ones are refused, and the batches of unknown resources are
+// refused until the resources are created.
+type mockServer struct {
+	*httptest.Server
+	lifetime time.Duration
+
+	sync.Mutex
+	tokens    int
+	revoked   map[string]bool
+	resources map[string]map[string]string
+	batches   []batch
+}
+
+func newMockServer(lifetime time.Duration) *mockServer {
+	s := &mockServer{
+		lifetime:  lifetime,
+		revoked:   make(map[string]bool),
+		resources: make(map[string]map[string]string),
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+func (s *mockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if r.URL.Path == "/v3/auth/tokens" {
+		var ar authRequest
+		json.NewDecoder(r.Body).Decode(&ar)
+		if ar.Auth.Identity.Password.User.Password != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		s.tokens++
+		w.Header().Set("X-Subject-Token", fmt.Sprint("token", s.tokens))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token":{"expires_at":%q}}`, time.Now().Add(s.lifetime).UTC().Format(time.RFC3339Nano))
+		return
+	}
+
+	token := r.Header.Get("X-Auth-Token")
+	if token == "" || s.revoked[token] {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v1/batch/resources/metrics/measures":
+		var b batch
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var unknown []string
+		for id := range b {
+			if _, ok := s.resources[id]; !ok {
+				unknown = append(unknown, fmt.Sprintf(`{"resource_id":"uuid-%s","original_resource_id":%q}`, id, id))
+			}
+		}
+		if len(unknown) > 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"description":{"cause":"Unknown resources","detail":[%s]}}`, strings.Join(unknown, ","))
+			return
+		}
+		s.batches = append(s.batches, b)
+		w.WriteHeader(http.StatusAccepted)
+	case "/v1/resource/generic":
+		var resource map[string]string
+		json.NewDecoder(r.Body).Decode(&resource)
+		s.resources[resource["id"]] = resource
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *mockServer) revoke(token string) {
+	s.Lock()
+	s.revoked[token] = true
+	s.Unlock()
+}
+
+func (s *mockServer) issued() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.tokens
+}
+
+func newGnocchi(t *testing.T, s *mockServer) *Gnocchi {
+	g := &Gnocchi{
+		URL:           s.URL,
+		AuthURL:       s.URL,
+		Username:      "vgo",
+		Password:      "s3cret",
+		ResourceType:  "generic",
+		ResourceTag:   "host",
+		Attributes:    []string{"region"},
+		ArchivePolicy: "low",
+		Timeout:       misc.Duration{Duration: 5 * time.Second},
+	}
+	if err := g.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+var testMetrics = service.Metrics{Data: []*service.MetricData{
+	{
+		Name:   "cpu",
+		Tags:   map[string]string{"host": "server01", "region": "eu"},
+		Fields: map[string]interface{}{"idle": 98.5, "count": int64(3), "state": "ok", "up": true},
+		Time:   time.Unix(1500000000, 0),
+	},
+	{
+		Name:   "cpu",
+		Tags:   map[string]string{"host": "server01", "region": "eu"},
+		Fields: map[string]interface{}{"idle": 97.5},
+		Time:   time.Unix(1500000010, 0),
+	},
+	{
+		Name:   "mem",
+		Tags:   map[string]string{"host": "server02"},
+		Fields: map[string]interface{}{"used": uint64(2)},
+		Time:   time.Unix(1500000000, 500),
+	},
+	// no resource
+	{
+		Name:   "disk",
+		Tags:   map[string]string{},
+		Fields: map[string]interface{}{"used": 1.0},
+		Time:   time.Unix(1500000000, 0),
+	},
+}}
+
+func TestBuildBatch(t *testing.T) {
+	g := &Gnocchi{ResourceTag: "host", Attributes: []string{"region"}, ArchivePolicy: "low"}
+	b, attrs := g.buildBatch(testMetrics.Data)
+
+	m := func(values ...interface{}) *metricMeasures {
+		mm := &metricMeasures{ArchivePolicyName: "low"}
+		for n := 0; n < len(values); n += 2 {
+			mm.Measures = append(mm.Measures, &measure{Timestamp: values[n].(string), Value: values[n+1].(float64)})
+		}
+		return mm
+	}
+	want := batch{
+		"server01": {
+			"cpu.idle":  m("2017-07-14T02:40:00Z", 98.5, "2017-07-14T02:40:10Z", 97.5),
+			"cpu.count": m("2017-07-14T02:40:00Z", 3.0),
+			"cpu.up":    m("2017-07-14T02:40:00Z", 1.0),
+		},
+		"server02": {
+			"mem.used": m("2017-07-14T02:40:00.0000005Z", 2.0),
+		},
+	}
+	if !reflect.DeepEqual(b, want) {
+		got, _ := json.Marshal(b)
+		expected, _ := json.Marshal(want)
+		t.Errorf("got batch\n%s\nwant\n%s", got, expected)
+	}
+	if want := map[string]map[string]string{"server01": {"region": "eu"}, "server02": {}}; !reflect.DeepEqual(attrs, want) {
+		t.Errorf("got attributes %v, want %v", attrs, want)
+	}
+}
+
+func TestWriteCreatesResources(t *testing.T) {
+	s := newMockServer(time.Hour)
+	defer s.Close()
+	g := newGnocchi(t, s)
+
+	if err := g.Write(testMetrics); err != nil {
+		t.Fatal(err)
+	}
+	// the batch refused for the missing resources is posted again once
+	// they're created
+	if len(s.batches) != 1 || len(s.batches[0]) != 2 {
+		t.Fatalf("got batches %v, want one of the two resources", s.batches)
+	}
+	want := map[string]map[string]string{
+		"server01": {"id": "server01", "region": "eu"},
+		"server02": {"id": "server02"},
+	}
+	if !reflect.DeepEqual(s.resources, want) {
+		t.Errorf("got resources %v, want %v", s.resources, want)
+	}
+
+	if err := g.Write(testMetrics); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.batches) != 2 || len(s.resources) != 2 {
+		t.Errorf("got %d batches and %d resources, want the resources created once", len(s.batches), len(s.resources))
+	}
+}
+
+func TestTokenReused(t *testing.T) {
+	s := newMockServer(time.Hour)
+	defer s.Close()
+	g := newGnocchi(t, s)
+
+	for n := 0; n < 3; n++ {
+		if err := g.Write(testMetrics); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.issued(); n != 1 {
+		t.Errorf("%d tokens issued, want the one of Connect", n)
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	// the tokens expire within the renewal margin
+	s := newMockServer(tokenMargin / 2)
+	defer s.Close()
+	g := newGnocchi(t, s)
+
+	for n := 0; n < 3; n++ {
+		if err := g.Write(testMetrics); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Connect, then one per request: the first write posts the batch
+	// refused, the two resources and the batch again, the next ones the
+	// batch alone
+	if n := s.issued(); n != 1+4+1+1 {
+		t.Errorf("%d tokens issued, want one per request", n)
+	}
+}
+
+func TestTokenRevoked(t *testing.T) {
+	s := newMockServer(time.Hour)
+	defer s.Close()
+	g := newGnocchi(t, s)
+	if err := g.Write(testMetrics); err != nil {
+		t.Fatal(err)
+	}
+
+	// revoked before its expiry, refused once then renewed
+	s.revoke("token1")
+	if err := g.Write(testMetrics); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.issued(); n != 2 {
+		t.Errorf("%d tokens issued, want 2", n)
+	}
+	if len(s.batches) != 2 {
+		t.Errorf("got %d batches, want 2", len(s.batches))
+	}
+}
+
+func TestConnectInvalid(t *testing.T) {
+	s := newMockServer(time.Hour)
+	defer s.Close()
+
+	g := &Gnocchi{URL: s.URL, AuthURL: s.URL, Username: "vgo", Password: "wrong"}
+	if err := g.Connect(); err == nil {
+		t.Error("connected with bad credentials")
+	}
+	for _, g := range []*Gnocchi{
+		{AuthURL: s.URL, Username: "vgo"},
+		{URL: s.URL, Username: "vgo"},
+		{URL: s.URL, AuthURL: s.URL},
+	} {
+		if err := g.Connect(); err == nil {
+			t.Errorf("invalid config %+v accepted", g)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package gnocchi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenMargin renews the token this long before it expires, so a request
+// doesn't start with a token expiring on the way
+const tokenMargin = time.Minute
+
+// keystone gets the tokens of the Gnocchi requests from the Keystone v3
+// password authentication, and keeps the token until it expires.
+type keystone struct {
+	authURL       string
+	username      string
+	password      string
+	userDomain    string
+	project       string
+	projectDomain string
+	client        *http.Client
+
+	sync.Mutex
+	token   string
+	expires time.Time
+}
+
+type authRequest struct {
+	Auth struct {
+		Identity struct {
+			Methods  []string `json:"methods"`
+			Password struct {
+				User struct {
+					Name     string `json:"name"`
+					Password string `json:"password"`
+					Domain   domain `json:"domain"`
+				} `json:"user"`
+			} `json:"password"`
+		} `json:"identity"`
+		Scope *scope `json:"scope,omitempty"`
+	} `json:"auth"`
+}
+
+type domain struct {
+	Name string `json:"name"`
+}
+
+type scope struct {
+	Project struct {
+		Name   string `json:"name"`
+		Domain domain `json:"domain"`
+	} `json:"project"`
+}
+
+type authResponse struct {
+	Token struct {
+		ExpiresAt time.Time `json:"expires_at"`
+	} `json:"token"`
+}
+
+// Token returns the current token, authenticating again when it expires.
+func (k *keystone) Token(ctx context.Context) (string, error) {
+	k.Lock()
+	defer k.Unlock()
+	if k.token != "" && time.Now().Add(tokenMargin).Before(k.expires) {
+		return k.token, nil
+	}
+
+	token, expires, err := k.authenticate(ctx)
+	if err != nil {
+		return "", err
+	}
+	k.token, k.expires = token, expires
+	return token, nil
+}
+
+// Invalidate forgets the token refused by Gnocchi, the next Token call
+// authenticates again.
+func (k *keystone) Invalidate(token string) {
+	k.Lock()
+	defer k.Unlock()
+	if k.token == token {
+		k.token = ""
+	}
+}
+
+func (k *keystone) authenticate(ctx context.Context) (string, time.Time, error) {
+	var ar authRequest
+	ar.Auth.Identity.Methods = []string{"password"}
+	user := &ar.Auth.Identity.Password.User
+	user.Name = k.username
+	user.Password = k.password
+	user.Domain.Name = k.userDomain
+	if k.project != "" {
+		ar.Auth.Scope = &scope{}
+		ar.Auth.Scope.Project.Name = k.project
+		ar.Auth.Scope.Project.Domain.Name = k.projectDomain
+	}
+
+	body, err := json.Marshal(&ar)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req, err := http.NewRequest("POST", strings.TrimRight(k.authURL, "/")+"/v3/auth/tokens", bytes.NewReader(body))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := k.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", time.Time{}, fmt.Errorf("keystone status %d, %s", resp.StatusCode, string(b))
+	}
+
+	token := resp.Header.Get("X-Subject-Token")
+	if token == "" {
+		return "", time.Time{}, fmt.Errorf("keystone response without X-Subject-Token")
+	}
+	var r authResponse
+	if err := json.Unmarshal(b, &r); err != nil {
+		return "", time.Time{}, fmt.Errorf("keystone response, %s", err)
+	}
+	return token, r.Token.ExpiresAt, nil
+}
@@ -0,0 +1,214 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// HTTP posts the metrics serialized in the data_format of the output to
+// an HTTP endpoint, such as the bulk endpoints taking ndjson bodies.
+type HTTP struct {
+	URL string
+	// Method is "POST" or "PUT"
+	Method string
+	// ContentType is the Content-Type header of the bodies
+	ContentType string
+	// ContentEncoding is "gzip" to compress the bodies, or empty
+	ContentEncoding string
+	Headers         map[string]string
+	Username        string
+	Password        string
+	// BatchSize is the number of metrics of a request, all the metrics of
+	// a write when zero
+	BatchSize int
+	Timeout   misc.Duration
+
+	SSLCA              string `toml:"ssl_ca"`
+	SSLCert            string `toml:"ssl_cert"`
+	SSLKey             string `toml:"ssl_key"`
+	InsecureSkipVerify bool
+
+	serializer service.Serializer
+	client     *http.Client
+}
+
+var sampleConfig = `
+  url = "http://localhost:8080/bulk"
+  ## "POST" or "PUT"
+  # method = "POST"
+  ## Data format of the bodies: "influx", "json", "ndjson"
+  # data_format = "ndjson"
+  ## Unit of the json and ndjson timestamps: "1s", "1ms", "1us" or "1ns"
+  # json_timestamp_units = "1s"
+  # content_type = "application/x-ndjson"
+  ## "gzip" compresses the bodies
+  # content_encoding = ""
+  ## Basic auth credentials
+  # username = ""
+  # password = ""
+  ## Number of metrics of a request, all the metrics of a write if 0
+  # batch_size = 0
+  # timeout = "5s"
+
+  ## Optional SSL Config
+  # ssl_ca = "/etc/vgo/ca.pem"
+  # ssl_cert = "/etc/vgo/cert.pem"
+  # ssl_key = "/etc/vgo/key.pem"
+  ## Use SSL but skip chain & host verification
+  # insecure_skip_verify = false
+
+  ## Additional headers of the requests
+  # [metric_outputs.http.headers]
+  #   Authorization = "Bearer xxx"
+`
+
+func (h *HTTP) SetSerializer(serializer service.Serializer) {
+	h.serializer = serializer
+}
+
+func (h *HTTP) Connect() error {
+	if h.URL == "" {
+		return errors.New("url is required")
+	}
+	h.Method = strings.ToUpper(h.Method)
+	switch h.Method {
+	case "POST", "PUT":
+	default:
+		return fmt.Errorf("invalid method %s, can be: \"POST\", \"PUT\"", h.Method)
+	}
+	switch h.ContentEncoding {
+	case "", "gzip":
+	default:
+		return fmt.Errorf("invalid content_encoding %s, can be: \"gzip\"", h.ContentEncoding)
+	}
+
+	tlsConfig, err := misc.GetTLSConfig(h.SSLCert, h.SSLKey, h.SSLCA, h.InsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+	h.client = &http.Client{
+		Timeout: h.Timeout.Duration,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	return nil
+}
+
+func (h *HTTP) Close() error {
+	return nil
+}
+
+// Write sends the metrics, BatchSize metrics per request.
+func (h *HTTP) Write(metrics service.Metrics) error {
+	return h.WriteContext(context.Background(), metrics)
+}
+
+// WriteContext is Write aborted when ctx is done. A failed request fails
+// the write, the metrics of the requests sent before it are written again
+// by the retry.
+func (h *HTTP) WriteContext(ctx context.Context, metrics service.Metrics) error {
+	data := metrics.Data
+	for len(data) > 0 {
+		n := len(data)
+		if h.BatchSize > 0 && n > h.BatchSize {
+			n = h.BatchSize
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		body, err := h.serializer.SerializeBatch(service.Metrics{Data: data[:n]})
+		if err != nil {
+			return err
+		}
+		if err := h.send(ctx, body); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// send posts the body, any 2xx status is a success.
+func (h *HTTP) send(ctx context.Context, body []byte) error {
+	if h.ContentEncoding == "gzip" {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	req, err := http.NewRequest(h.Method, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", h.ContentType)
+	if h.ContentEncoding != "" {
+		req.Header.Set("Content-Encoding", h.ContentEncoding)
+	}
+	if h.Username != "" || h.Password != "" {
+		req.SetBasicAuth(h.Username, h.Password)
+	}
+	for k, v := range h.Headers {
+		if strings.ToLower(k) == "host" {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+
+	resp, err := h.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d, %s", resp.StatusCode, string(b))
+	}
+	return nil
+}
+
+func (h *HTTP) Init(stop chan bool) {
+	if err := h.Connect(); err != nil {
+		log.Fatal("HTTP Connect failed, err message is ", err)
+	}
+}
+
+func (h *HTTP) Start() {
+
+}
+
+// ComputeContext writes the metrics, aborted when ctx is done.
+func (h *HTTP) ComputeContext(ctx context.Context, metrics service.Metrics) error {
+	return h.WriteContext(ctx, metrics)
+}
+
+func (h *HTTP) Compute(metrics service.Metrics) error {
+	return h.Write(metrics)
+}
+
+func init() {
+	service.AddMetricOutput("http", &HTTP{
+		Method:      "POST",
+		ContentType: "text/plain; charset=utf-8",
+		Timeout:     misc.Duration{Duration: 5 * time.Second},
+	})
+}
@@ -0,0 +1,151 @@
+package http
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/corego/vgo/vgo/stream/plugins/serializer/ndjson"
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// sink records the lines of the bodies it receives by request.
+type sink struct {
+	sync.Mutex
+	status   int
+	headers  []http.Header
+	requests [][]map[string]interface{}
+}
+
+func (s *sink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	s.headers = append(s.headers, r.Header)
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body = zr
+	}
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		var m map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lines = append(lines, m)
+	}
+	s.requests = append(s.requests, lines)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newHTTP(t *testing.T, url string) *HTTP {
+	serializer, err := service.NewSerializer("ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &HTTP{
+		URL:         url,
+		Method:      "POST",
+		ContentType: "application/x-ndjson",
+		Headers:     map[string]string{"X-Source": "vgo"},
+	}
+	h.SetSerializer(serializer)
+	if err := h.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func testMetrics(n int) service.Metrics {
+	m := service.Metrics{}
+	for i := 0; i < n; i++ {
+		m.Data = append(m.Data, &service.MetricData{
+			Name:   "cpu",
+			Tags:   map[string]string{"host": "a\"b"},
+			Fields: map[string]interface{}{"usage": float64(i)},
+			Time:   time.Unix(1480000000, 0),
+		})
+	}
+	return m
+}
+
+func TestWriteNDJSON(t *testing.T) {
+	s := &sink{}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	h := newHTTP(t, ts.URL)
+	h.BatchSize = 2
+	if err := h.Write(testMetrics(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.requests) != 2 || len(s.requests[0]) != 2 || len(s.requests[1]) != 1 {
+		t.Fatalf("got requests %v, want 2 then 1 metrics", s.requests)
+	}
+	m := s.requests[1][0]
+	if m["name"] != "cpu" || m["fields"].(map[string]interface{})["usage"] != float64(2) || m["tags"].(map[string]interface{})["host"] != "a\"b" {
+		t.Errorf("got metric %v", m)
+	}
+	if ct := s.headers[0].Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("got Content-Type %s", ct)
+	}
+	if src := s.headers[0].Get("X-Source"); src != "vgo" {
+		t.Errorf("got X-Source %s", src)
+	}
+}
+
+func TestWriteGzip(t *testing.T) {
+	s := &sink{}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	h := newHTTP(t, ts.URL)
+	h.ContentEncoding = "gzip"
+	if err := h.Write(testMetrics(2)); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.requests) != 1 || len(s.requests[0]) != 2 {
+		t.Errorf("got requests %v, want 2 metrics", s.requests)
+	}
+}
+
+func TestWriteStatus(t *testing.T) {
+	s := &sink{status: http.StatusBadGateway}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	h := newHTTP(t, ts.URL)
+	if err := h.Write(testMetrics(1)); err == nil {
+		t.Error("write answered 502 succeeded")
+	}
+}
+
+func TestConnect(t *testing.T) {
+	for _, h := range []*HTTP{
+		{},
+		{URL: "http://localhost", Method: "GET"},
+		{URL: "http://localhost", Method: "POST", ContentEncoding: "deflate"},
+	} {
+		if err := h.Connect(); err == nil {
+			t.Errorf("%+v connected", h)
+		}
+	}
+}
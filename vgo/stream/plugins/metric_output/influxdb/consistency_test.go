@@ -0,0 +1,53 @@
+package influxdb
+
+import (
+	"testing"
+)
+
+func TestNormalizeConsistency(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"any", "any"},
+		{"one", "one"},
+		{"QUORUM", "quorum"},
+		{" All ", "all"},
+	} {
+		got, err := normalizeConsistency(tt.in)
+		if err != nil {
+			t.Errorf("%q, %s", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q, got %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"quorom", "two", "any,one"} {
+		if _, err := normalizeConsistency(in); err == nil {
+			t.Errorf("write consistency %q accepted", in)
+		}
+	}
+}
+
+func TestWriteConsistency(t *testing.T) {
+	s := newMockServer()
+	defer s.Close()
+
+	i := newInfluxDB(s.URL)
+	i.WriteConsistency = "Quorum"
+	connect(t, i)
+	if err := i.Write(testMetrics); err != nil {
+		t.Fatal(err)
+	}
+	if writes := s.received(); len(writes) != 1 || writes[0].consistency != "quorum" {
+		t.Errorf("got writes %v, want the quorum consistency", writes)
+	}
+
+	i = newInfluxDB(s.URL)
+	i.WriteConsistency = "quorom"
+	if err := i.Connect(); err == nil {
+		t.Error("connected with an invalid write consistency")
+	}
+}
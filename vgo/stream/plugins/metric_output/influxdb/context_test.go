@@ -0,0 +1,51 @@
+package influxdb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteContextCancelled(t *testing.T) {
+	// the writes of the hung server never get an answer
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/write") {
+			<-release
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer hung.Close()
+	defer close(release)
+	s := newMockServer()
+	defer s.Close()
+
+	i := newInfluxDB(hung.URL, s.URL)
+	// the hung server is tried first
+	i.Weights = []float64{1e9, 1}
+	i.Timeout.Duration = time.Minute
+	connect(t, i)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	err := i.WriteContext(ctx, testMetrics)
+	if err == nil {
+		t.Fatal("no error when the context is cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("write aborted after %s", elapsed)
+	}
+	// the server isn't at fault, the write isn't tried on the other one
+	if writes := s.received(); len(writes) != 0 {
+		t.Errorf("got writes %v after the cancellation", writes)
+	}
+
+	// cancelled before the write
+	if err := i.WriteContext(ctx, testMetrics); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,104 @@
+package influxdb
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// convertField converts a field value to the type pinned for the field,
+// one of "int", "float", "string" or "bool".
+func convertField(v interface{}, typ string) (interface{}, error) {
+	switch typ {
+	case "int":
+		return toInt(v)
+	case "float":
+		return toFloat(v)
+	case "string":
+		return toString(v), nil
+	case "bool":
+		return toBool(v)
+	default:
+		return nil, fmt.Errorf("unknown type %s", typ)
+	}
+}
+
+func validConversion(typ string) bool {
+	switch typ {
+	case "int", "float", "string", "bool":
+		return true
+	}
+	return false
+}
+
+func toInt(v interface{}) (int64, error) {
+	switch t := v.(type) {
+	case int:
+		return int64(t), nil
+	case int32:
+		return int64(t), nil
+	case int64:
+		return t, nil
+	case uint32:
+		return int64(t), nil
+	case uint64:
+		return int64(t), nil
+	case float32:
+		return int64(t), nil
+	case float64:
+		return int64(t), nil
+	case bool:
+		if t {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		if i, err := strconv.ParseInt(t, 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return 0, err
+		}
+		return int64(f), nil
+	default:
+		return 0, fmt.Errorf("can't convert %T to int", v)
+	}
+}
+
+func toFloat(v interface{}) (float64, error) {
+	if f, ok := service.ValueToFloat(v); ok {
+		return f, nil
+	}
+	if s, ok := v.(string); ok {
+		return strconv.ParseFloat(s, 64)
+	}
+	return 0, fmt.Errorf("can't convert %T to float", v)
+}
+
+func toString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func toBool(v interface{}) (bool, error) {
+	switch t := v.(type) {
+	case bool:
+		return t, nil
+	case string:
+		return strconv.ParseBool(t)
+	default:
+		f, err := toFloat(v)
+		if err != nil {
+			return false, fmt.Errorf("can't convert %T to bool", v)
+		}
+		return f != 0, nil
+	}
+}
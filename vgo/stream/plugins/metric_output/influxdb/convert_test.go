@@ -0,0 +1,108 @@
+package influxdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+func TestConvertField(t *testing.T) {
+	for _, tt := range []struct {
+		v    interface{}
+		typ  string
+		want interface{}
+	}{
+		{3, "int", int64(3)},
+		{int32(3), "int", int64(3)},
+		{uint64(3), "int", int64(3)},
+		{3.9, "int", int64(3)},
+		{true, "int", int64(1)},
+		{"42", "int", int64(42)},
+		{"4.2", "int", int64(4)},
+
+		{3, "float", 3.0},
+		{int64(3), "float", 3.0},
+		{float32(1.5), "float", 1.5},
+		{false, "float", 0.0},
+		{"1.5", "float", 1.5},
+
+		{"ok", "string", "ok"},
+		{1.5, "string", "1.5"},
+		{int64(3), "string", "3"},
+		{true, "string", "true"},
+
+		{true, "bool", true},
+		{"false", "bool", false},
+		{int64(0), "bool", false},
+		{2.5, "bool", true},
+	} {
+		got, err := convertField(tt.v, tt.typ)
+		if err != nil {
+			t.Errorf("%v (%T) to %s, %s", tt.v, tt.v, tt.typ, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%v (%T) to %s, got %v (%T), want %v (%T)", tt.v, tt.v, tt.typ, got, got, tt.want, tt.want)
+		}
+	}
+}
+
+func TestConvertFieldFailure(t *testing.T) {
+	for _, tt := range []struct {
+		v   interface{}
+		typ string
+	}{
+		{"abc", "int"},
+		{"abc", "float"},
+		{"maybe", "bool"},
+		{[]int{1}, "int"},
+		{[]int{1}, "float"},
+		{[]int{1}, "bool"},
+		{1, "complex"},
+	} {
+		if got, err := convertField(tt.v, tt.typ); err == nil {
+			t.Errorf("%v (%T) to %s converted to %v", tt.v, tt.v, tt.typ, got)
+		}
+	}
+}
+
+func TestTypeConversions(t *testing.T) {
+	s := newMockServer()
+	defer s.Close()
+
+	i := newInfluxDB(s.URL)
+	i.TypeConversions = map[string]string{"usage": "float", "status": "string", "count": "int"}
+	connect(t, i)
+
+	metric := &service.MetricData{
+		Name:   "cpu",
+		Tags:   map[string]string{"host": "a"},
+		Fields: map[string]interface{}{"usage": int64(3), "status": 200, "count": "many", "idle": 1.5},
+		Time:   time.Unix(1, 0),
+	}
+	if err := i.Write(service.Metrics{Data: []*service.MetricData{metric}}); err != nil {
+		t.Fatal(err)
+	}
+
+	writes := s.received()
+	if len(writes) != 1 || len(writes[0].lines) != 1 {
+		t.Fatalf("got writes %v", writes)
+	}
+	// count can't be converted and is dropped, the other fields are written
+	want := `cpu,host=a idle=1.5,status="200",usage=3 1000000000`
+	if writes[0].lines[0] != want {
+		t.Errorf("got %s, want %s", writes[0].lines[0], want)
+	}
+	if _, ok := metric.Fields["count"]; !ok || metric.Fields["usage"] != int64(3) {
+		t.Errorf("shared metric modified, %v", metric.Fields)
+	}
+}
+
+func TestTypeConversionsInvalid(t *testing.T) {
+	i := newInfluxDB("http://localhost:8086")
+	i.TypeConversions = map[string]string{"usage": "double"}
+	if err := i.Connect(); err == nil {
+		t.Error("invalid type conversion accepted")
+	}
+}
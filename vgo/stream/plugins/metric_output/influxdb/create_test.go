@@ -0,0 +1,83 @@
+package influxdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+var testMetrics = service.Metrics{Data: []*service.MetricData{
+	{Name: "cpu", Tags: map[string]string{"host": "a"}, Fields: map[string]interface{}{"value": 1.0}, Time: time.Unix(1, 0)},
+}}
+
+func TestDatabaseCreation(t *testing.T) {
+	for _, tt := range []struct {
+		skip       bool
+		denyCreate bool
+		queries    int
+	}{
+		{false, false, 1},
+		// the creation fails, the database may exist already
+		{false, true, 1},
+		{true, false, 0},
+		{true, true, 0},
+	} {
+		s := newMockServer()
+		s.denyCreate = tt.denyCreate
+
+		i := newInfluxDB(s.URL)
+		i.SkipDatabaseCreation = tt.skip
+		connect(t, i)
+
+		queries := s.queried()
+		if len(queries) != tt.queries {
+			t.Errorf("skip %v, got queries %v", tt.skip, queries)
+		}
+		if len(queries) > 0 && queries[0] != `CREATE DATABASE "test"` {
+			t.Errorf("skip %v, got query %s", tt.skip, queries[0])
+		}
+
+		// the connection is kept whether the creation succeeded or not
+		if len(i.conns) != 1 {
+			t.Fatalf("skip %v, deny %v, %d connections", tt.skip, tt.denyCreate, len(i.conns))
+		}
+		if err := i.Write(testMetrics); err != nil {
+			t.Errorf("skip %v, deny %v, %s", tt.skip, tt.denyCreate, err)
+		}
+		if len(s.received()) != 1 {
+			t.Errorf("skip %v, deny %v, write not received", tt.skip, tt.denyCreate)
+		}
+		s.Close()
+	}
+}
+
+func TestDatabaseNotFound(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		s := newMockServer()
+		i := newInfluxDB(s.URL)
+		i.SkipDatabaseCreation = skip
+		connect(t, i)
+
+		s.setWriteAnswer(404, `{"error":"database not found: \"test\""}`)
+		if err := i.Write(testMetrics); err == nil {
+			t.Errorf("skip %v, write to a missing database succeeded", skip)
+		}
+
+		// the database is created again, unless skipped
+		creates := 0
+		for _, q := range s.queried() {
+			if q == `CREATE DATABASE "test"` {
+				creates++
+			}
+		}
+		want := 2
+		if skip {
+			want = 0
+		}
+		if creates != want {
+			t.Errorf("skip %v, %d creations, want %d", skip, creates, want)
+		}
+		s.Close()
+	}
+}
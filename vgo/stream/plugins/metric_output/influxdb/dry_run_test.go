@@ -0,0 +1,61 @@
+package influxdb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+func TestDryRun(t *testing.T) {
+	s := newMockServer()
+	defer s.Close()
+	s.databases = []string{"test"}
+
+	i := newInfluxDB(s.URL)
+	i.SetDryRun(true)
+	i.StartupTest = true
+	i.Init(make(chan bool, 1))
+
+	mc := &service.MetricOutputConfig{Name: "influxdb", MetricOutput: i, DryRun: true, MetricBufferLimit: 100}
+	stop := make(chan bool)
+	mc.Start(stop)
+	defer close(stop)
+	mc.Compute(service.Metrics{Data: testMetrics.Data})
+
+	if writes := s.received(); len(writes) != 0 {
+		t.Errorf("got writes %v in dry run", writes)
+	}
+	checked := false
+	for _, q := range s.queried() {
+		if strings.HasPrefix(q, "CREATE") {
+			t.Errorf("query %s in dry run", q)
+		}
+		checked = checked || q == "SHOW DATABASES"
+	}
+	if !checked {
+		t.Error("database existence not checked")
+	}
+	if !mc.Healthy() {
+		t.Error("output unhealthy, the database exists")
+	}
+}
+
+func TestCheckDestination(t *testing.T) {
+	s := newMockServer()
+	defer s.Close()
+
+	i := newInfluxDB(s.URL)
+	i.SetDryRun(true)
+	connect(t, i)
+	if err := i.CheckDestination(); err == nil {
+		t.Error("no error when the database doesn't exist")
+	}
+
+	s.Lock()
+	s.databases = []string{"_internal", "test"}
+	s.Unlock()
+	if err := i.CheckDestination(); err != nil {
+		t.Error(err)
+	}
+}
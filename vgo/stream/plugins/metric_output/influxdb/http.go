@@ -0,0 +1,229 @@
+package influxdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// httpClient is an InfluxDB HTTP client like the one of client.NewHTTPClient,
+// which doesn't allow to configure the transport of its http.Client.
+type httpClient struct {
+	url       url.URL
+	basePath  string
+	username  string
+	password  string
+	token     string
+	useragent string
+	client    *http.Client
+}
+
+// newHTTPClient returns the client of the server, basePath is the prefix of
+// the paths of a server behind a reverse proxy, like "/influx".
+func newHTTPClient(conf client.HTTPConfig, basePath string, tr *http.Transport) (*httpClient, error) {
+	if conf.UserAgent == "" {
+		conf.UserAgent = "InfluxDBClient"
+	}
+
+	u, err := url.Parse(conf.Addr)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Unsupported protocol scheme: %s, your address"+
+			" must start with http:// or https://", u.Scheme)
+	}
+
+	return &httpClient{
+		url:       *u,
+		basePath:  "/" + strings.Trim(basePath, "/"),
+		username:  conf.Username,
+		password:  conf.Password,
+		useragent: conf.UserAgent,
+		client: &http.Client{
+			Timeout:   conf.Timeout,
+			Transport: tr,
+		},
+	}, nil
+}
+
+// newTransport returns the transport of the HTTP clients, going through
+// HTTPProxy when set, or else the proxy of the HTTP_PROXY/HTTPS_PROXY
+// environment variables. All the urls share the transport, so its idle
+// connections are reused across writes.
+func (i *InfluxDB) newTransport() (*http.Transport, error) {
+	tlsConfig, err := misc.GetTLSConfig(i.SSLCert, i.SSLKey, i.SSLCA, i.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConns:        i.MaxIdleConns,
+		MaxIdleConnsPerHost: i.MaxIdleConns,
+		IdleConnTimeout:     i.IdleConnTimeout.Duration,
+		DisableKeepAlives:   i.DisableKeepAlive,
+	}
+
+	if i.HTTPProxy != "" {
+		proxy, err := url.Parse(i.HTTPProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http_proxy %s, %s", i.HTTPProxy, err)
+		}
+		tr.Proxy = http.ProxyURL(proxy)
+	}
+
+	return tr, nil
+}
+
+func (c *httpClient) newRequest(method, path string, body []byte) (*http.Request, error) {
+	u := c.url
+	u.Path = strings.TrimRight(c.basePath, "/") + "/" + path
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "")
+	req.Header.Set("User-Agent", c.useragent)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Token "+c.token)
+	} else if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	return req, nil
+}
+
+func (c *httpClient) Ping(timeout time.Duration) (time.Duration, string, error) {
+	now := time.Now()
+	req, err := c.newRequest("GET", "ping", nil)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if timeout > 0 {
+		params := req.URL.Query()
+		params.Set("wait_for_leader", fmt.Sprintf("%.0fs", timeout.Seconds()))
+		req.URL.RawQuery = params.Encode()
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		return 0, "", errors.New(string(body))
+	}
+
+	return time.Since(now), resp.Header.Get("X-Influxdb-Version"), nil
+}
+
+func (c *httpClient) Write(bp client.BatchPoints) error {
+	return c.WriteContext(context.Background(), bp)
+}
+
+// WriteContext writes the batch, the request is aborted when ctx is done.
+func (c *httpClient) WriteContext(ctx context.Context, bp client.BatchPoints) error {
+	// the batches need a Go duration unit, the server knows "u", not "us"
+	precision := bp.Precision()
+	if precision == "us" {
+		precision = "u"
+	}
+
+	var b bytes.Buffer
+	for _, p := range bp.Points() {
+		b.WriteString(p.PrecisionString(precision))
+		b.WriteByte('\n')
+	}
+
+	req, err := c.newRequest("POST", "write", b.Bytes())
+	if err != nil {
+		return err
+	}
+
+	params := req.URL.Query()
+	params.Set("db", bp.Database())
+	params.Set("rp", bp.RetentionPolicy())
+	params.Set("precision", precision)
+	params.Set("consistency", bp.WriteConsistency())
+	req.URL.RawQuery = params.Encode()
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return errors.New(string(body))
+	}
+	return nil
+}
+
+func (c *httpClient) Query(q client.Query) (*client.Response, error) {
+	req, err := c.newRequest("GET", "query", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	params := req.URL.Query()
+	params.Set("q", q.Command)
+	params.Set("db", q.Database)
+	if q.Precision != "" {
+		params.Set("epoch", q.Precision)
+	}
+	req.URL.RawQuery = params.Encode()
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var response client.Response
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	decErr := dec.Decode(&response)
+
+	// ignore this error if we got an invalid status code
+	if decErr != nil && decErr.Error() == "EOF" && resp.StatusCode != http.StatusOK {
+		decErr = nil
+	}
+	// If we got a valid decode error, send that back
+	if decErr != nil {
+		return nil, decErr
+	}
+	// If we don't have an error in our json response, and didn't get statusOK
+	// then send back an error
+	if resp.StatusCode != http.StatusOK && response.Error() == nil {
+		return &response, fmt.Errorf("received status code %d from server",
+			resp.StatusCode)
+	}
+	return &response, nil
+}
+
+func (c *httpClient) Close() error {
+	return nil
+}
@@ -0,0 +1,183 @@
+package influxdb
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+func TestHTTPProxy(t *testing.T) {
+	s := newMockServer()
+	defer s.Close()
+
+	// the proxy forwards the requests to the mock server, whatever their host
+	var mu sync.Mutex
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		proxied = append(proxied, r.Method+" "+r.URL.String())
+		mu.Unlock()
+		s.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	i := newInfluxDB("http://influxdb.invalid:8086")
+	i.HTTPProxy = proxy.URL
+	connect(t, i)
+
+	err := i.Write(service.Metrics{Data: []*service.MetricData{
+		{Name: "cpu", Fields: map[string]interface{}{"value": 1.0}, Time: time.Unix(1, 0)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(proxied) != 2 {
+		t.Fatalf("got proxied requests %v, want the database creation and the write", proxied)
+	}
+	for _, want := range []string{"GET http://influxdb.invalid:8086/query", "POST http://influxdb.invalid:8086/write"} {
+		found := false
+		for _, r := range proxied {
+			if strings.HasPrefix(r, want) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s didn't go through the proxy, got %v", want, proxied)
+		}
+	}
+	if len(s.received()) != 1 {
+		t.Error("write not received")
+	}
+}
+
+func TestHTTPProxyInvalid(t *testing.T) {
+	i := newInfluxDB("http://localhost:8086")
+	i.HTTPProxy = "http://proxy:port"
+	if err := i.Connect(); err == nil {
+		t.Error("invalid http_proxy accepted")
+	}
+}
+
+// countConns returns the mock server counting the connections it accepts.
+func countConns(conns *int32) *mockServer {
+	s := &mockServer{writeStatus: http.StatusNoContent}
+	s.Server = httptest.NewUnstartedServer(s)
+	s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	s.Start()
+	return s
+}
+
+func TestKeepAlive(t *testing.T) {
+	for _, tt := range []struct {
+		disable bool
+		conns   int32
+	}{
+		// a single connection for the database creation and the writes
+		{false, 1},
+		{true, 6},
+	} {
+		var conns int32
+		s := countConns(&conns)
+
+		i := newInfluxDB(s.URL)
+		i.DisableKeepAlive = tt.disable
+		connect(t, i)
+		for n := 0; n < 5; n++ {
+			err := i.Write(service.Metrics{Data: []*service.MetricData{
+				{Name: "cpu", Fields: map[string]interface{}{"value": float64(n)}, Time: time.Unix(1, 0)},
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.Close()
+
+		if n := atomic.LoadInt32(&conns); n != tt.conns {
+			t.Errorf("disable_keep_alive %v, %d connections opened, want %d", tt.disable, n, tt.conns)
+		}
+	}
+}
+
+func TestBasePathURL(t *testing.T) {
+	for _, tt := range []struct {
+		url      string
+		basePath string
+		want     string
+	}{
+		{"http://localhost:8086", "", "http://localhost:8086/write"},
+		{"http://localhost:8086", "/influx", "http://localhost:8086/influx/write"},
+		{"http://localhost:8086", "influx/", "http://localhost:8086/influx/write"},
+		{"http://localhost:8086/", "/db/influx/", "http://localhost:8086/db/influx/write"},
+	} {
+		c, err := newHTTPClient(client.HTTPConfig{Addr: tt.url}, tt.basePath, &http.Transport{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := c.newRequest("POST", "write", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := req.URL.String(); got != tt.want {
+			t.Errorf("%s base path %q, got %s, want %s", tt.url, tt.basePath, got, tt.want)
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	s := newMockServer()
+	defer s.Close()
+	i := newInfluxDB(s.URL)
+	i.BasePath = "/influx"
+	connect(t, i)
+
+	err := i.Write(service.Metrics{Data: []*service.MetricData{
+		{Name: "cpu", Fields: map[string]interface{}{"value": 1.0}, Time: time.Unix(1, 0)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Lock()
+	defer s.Unlock()
+	if want := []string{"/influx/query", "/influx/write"}; strings.Join(s.paths, " ") != strings.Join(want, " ") {
+		t.Errorf("got requests to %v, want %v", s.paths, want)
+	}
+}
+
+func TestBasePathUDP(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the UDP urls ignore the base path
+	i := newInfluxDB("udp://" + conn.LocalAddr().String())
+	i.BasePath = "/influx"
+	connect(t, i)
+	defer i.Close()
+
+	err = i.Write(service.Metrics{Data: []*service.MetricData{
+		{Name: "cpu", Fields: map[string]interface{}{"value": 1.0}, Time: time.Unix(1, 0)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readDatagrams(t, conn); len(got) != 1 || got[0] != "cpu value=1 1000000000\n" {
+		t.Errorf("got datagrams %q", got)
+	}
+}
@@ -1,11 +1,12 @@
 package influxdb
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"math/rand"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 
@@ -28,10 +29,89 @@ type InfluxDB struct {
 	WriteConsistency string
 	Timeout          misc.Duration
 	UDPPayload       int `toml:"udp_payload"`
-	// Precision is only here for legacy support. It will be ignored.
-	Precision string
+	// DatabaseTag and RetentionPolicyTag name the tags giving the database
+	// and the retention policy of a metric, the configured ones are used
+	// when it doesn't have them. Exclude* remove the tags from the points
+	DatabaseTag               string
+	RetentionPolicyTag        string
+	ExcludeDatabaseTag        bool
+	ExcludeRetentionPolicyTag bool
+	// UsernameFile and PasswordFile read the credentials from files, such
+	// as the mounted secrets, instead of the config. They win over the
+	// inline values
+	UsernameFile string
+	PasswordFile string
+	// Token authenticates with an "Authorization: Token" header instead of
+	// the username and password, for the v1 API of InfluxDB 2.x
+	Token     string
+	TokenFile string
+	// Weights are the weights of the urls, in the same order. A server is
+	// chosen first in proportion to its weight and its recent writes,
+	// without weights the servers are chosen evenly
+	Weights []float64
+	// HTTPProxy is the proxy of the HTTP urls, HTTP_PROXY/HTTPS_PROXY are used when empty
+	HTTPProxy string `toml:"http_proxy"`
+	// BasePath prefixes the paths of the HTTP requests, for the servers
+	// behind a reverse proxy under a path like "/influx"
+	BasePath string
+	// MaxIdleConns is the number of idle HTTP connections kept for reuse
+	MaxIdleConns int
+	// IdleConnTimeout closes the idle HTTP connections after this duration
+	IdleConnTimeout misc.Duration
+	// DisableKeepAlive opens a new HTTP connection for every write
+	DisableKeepAlive bool
+	// SSLCert and SSLKey are the client certificate of the servers
+	// requiring mutual TLS
+	SSLCA              string `toml:"ssl_ca"`
+	SSLCert            string `toml:"ssl_cert"`
+	SSLKey             string `toml:"ssl_key"`
+	InsecureSkipVerify bool
+	// TypeConversions pins the type of fields: "int", "float", "string" or "bool"
+	TypeConversions map[string]string
+	// SkipDatabaseCreation doesn't create the database, for the users
+	// without the CREATE privilege
+	SkipDatabaseCreation bool
+	// StartupTest writes a heartbeat point during Init, so a misconfiguration
+	// stops the plugin at once instead of failing the first flush
+	StartupTest bool
+	// HeartbeatMeasurement is the measurement of the startup test point
+	HeartbeatMeasurement string
+	// EventMeasurement is the measurement of the events, such as the fired
+	// alarms, written as annotations
+	EventMeasurement string
+	// TagInclude keeps only the matching tags, TagExclude removes the
+	// matching tags, globs are supported. Include runs first
+	TagInclude []string
+	TagExclude []string
+	// SlowWriteThreshold logs the writes to a server taking longer, with
+	// the url, the points and the size, at most once per
+	// SlowWriteLogInterval. Zero disables it
+	SlowWriteThreshold   misc.Duration
+	SlowWriteLogInterval misc.Duration
 
-	conns []client.Client
+	conns      []*conn
+	username   string
+	password   string
+	token      string
+	precision  string
+	dryRun     bool
+	tagInclude service.Filter
+	tagExclude service.Filter
+	// slow is shared by the clones, so the workers log together
+	slow *slowWrites
+	// log is the influxdb logger, at the influxdb level of the log_levels
+	log zap.Logger
+	// stats are the counters of the output instance
+	stats *service.PluginStats
+}
+
+// conn is a client of one of the urls
+type conn struct {
+	client.Client
+	url    string
+	udp    bool
+	weight float64
+	stats  *serverStats
 }
 
 var sampleConfig = `
@@ -40,25 +120,103 @@ var sampleConfig = `
   ## this means that only ONE of the urls will be written to each interval.
   # urls = ["udp://localhost:8089"] # UDP endpoint example
   urls = ["http://localhost:8086"] # required
+  ## Weights of the urls, in the same order. The servers are chosen in
+  ## proportion to their weight and their recent write latency and success,
+  ## the others are tried when the chosen one fails. Without weights the
+  ## servers are chosen evenly.
+  # weights = [3.0, 1.0]
   ## The target database for metrics (telegraf will create it if not exists).
   database = "telegraf" # required
 
+  ## Don't create the database, for users without the CREATE privilege.
+  # skip_database_creation = false
+
   ## Retention policy to write to. Empty string writes to the default rp.
   retention_policy = ""
-  ## Write consistency (clusters only), can be: "any", "one", "quorom", "all"
+  ## Write consistency (clusters only), can be: "any", "one", "quorum", "all"
   write_consistency = "any"
 
+  ## Tags giving the database and the retention policy of a metric, such as
+  ## the ones of the influxdb_listener writes, the metrics without them go
+  ## to database and retention_policy. The missing databases are created
+  ## unless skip_database_creation.
+  # database_tag = ""
+  # exclude_database_tag = false
+  # retention_policy_tag = ""
+  # exclude_retention_policy_tag = false
+
   ## Write timeout (for the InfluxDB client), formatted as a string.
   ## If not provided, will default to 5s. 0s means no timeout (not recommended).
   timeout = "5s"
   # username = "telegraf"
   # password = "metricsmetricsmetricsmetrics"
+  ## Read the credentials from files instead, the trailing newlines are
+  ## trimmed. The files win over the inline values.
+  # username_file = "/run/secrets/influxdb_username"
+  # password_file = "/run/secrets/influxdb_password"
+  ## Token of the v1 API of InfluxDB 2.x, used instead of the username and
+  ## password.
+  # token = "${INFLUX_TOKEN}"
+  # token_file = "/run/secrets/influxdb_token"
+  ## The credentials and the files may reference the environment variables
+  ## as ${NAME}.
   ## Set the user agent for HTTP POSTs (can be useful for log differentiation)
   # user_agent = "telegraf"
   ## Set UDP payload size, defaults to InfluxDB UDP Client default (512 bytes)
   # udp_payload = 512
+  ## HTTP proxy of the HTTP urls, if not provided the HTTP_PROXY and
+  ## HTTPS_PROXY environment variables are used.
+  # http_proxy = "http://proxy.example.com:3128"
+  ## Prefix of the HTTP paths, the writes go to <url>/influx/write and the
+  ## queries to <url>/influx/query. The UDP urls ignore it.
+  # base_path = "/influx"
+  ## Idle HTTP connections kept alive for the next writes, which saves the
+  ## TCP and TLS handshakes on frequent flushes.
+  # max_idle_conns = 10
+  # idle_conn_timeout = "90s"
+  # disable_keep_alive = false
+
+  ## Pin the type of fields, so a field changing type doesn't fail the batch.
+  ## The values which can't be converted drop the field.
+  # [metric_outputs.influxdb.type_conversions]
+  #   usage = "float"
+  #   status = "string"
+
+  ## Write a heartbeat point at startup, the plugin is stopped when it
+  ## can't be written so a broken config or missing permissions show at once.
+  # startup_test = false
+  # heartbeat_measurement = "vgo_heartbeat"
+
+  ## Precision of the written times: "ns", "us", "ms", "s", "m" or "h".
+  ## The points of a series collapsing to the same time are merged, the
+  ## fields of the last metric win, so a coarse precision may lose points.
+  # precision = "ns"
+
+  ## Keep a single metric of the points of the same series and time of a
+  ## write, "first" or "last", InfluxDB would overwrite the others anyway.
+  # dedup_points = ""
+
+  ## Log the metrics instead of writing them, the servers are pinged and
+  ## the database checked but never created.
+  # dry_run = false
+
+  ## Measurement of the events, such as the alarms fired by alarm_bridge,
+  ## one point per event with the "title" and "text" fields and the event
+  ## tags, for the Grafana annotations:
+  ##   SELECT title, text FROM annotations WHERE $timeFilter
+  # event_measurement = "annotations"
+
+  ## Keep only the matching tags, then remove the matching ones
+  # tag_include = []
+  # tag_exclude = ["request_id"]
 
-  ## Optional SSL Config
+  ## Log the writes to a server slower than this, with the url, the number
+  ## of points and the payload size, at most once per slow_write_log_interval.
+  # slow_write_threshold = "0s"
+  # slow_write_log_interval = "1m"
+
+  ## Optional SSL Config, the client certificate and key are presented to
+  ## the servers requiring mutual TLS
   # ssl_ca = "/etc/telegraf/ca.pem"
   # ssl_cert = "/etc/telegraf/cert.pem"
   # ssl_key = "/etc/telegraf/key.pem"
@@ -67,19 +225,68 @@ var sampleConfig = `
 `
 
 func (i *InfluxDB) Connect() error {
+	i.log = service.PluginLogger("influxdb")
+
+	consistency, err := normalizeConsistency(i.WriteConsistency)
+	if err != nil {
+		return err
+	}
+	i.WriteConsistency = consistency
+
+	for field, typ := range i.TypeConversions {
+		if !validConversion(typ) {
+			return fmt.Errorf("invalid type conversion %s for field %s", typ, field)
+		}
+	}
+
+	if err := i.readSecrets(); err != nil {
+		return err
+	}
+
+	if i.tagInclude, err = service.CompileFilter(i.TagInclude); err != nil {
+		return fmt.Errorf("invalid tag_include, %s", err)
+	}
+	if i.tagExclude, err = service.CompileFilter(i.TagExclude); err != nil {
+		return fmt.Errorf("invalid tag_exclude, %s", err)
+	}
+	if i.slow == nil {
+		i.slow = &slowWrites{}
+	}
+
 	var urls []string
 	for _, u := range i.URLs {
 		urls = append(urls, u)
 	}
 
+	if len(i.Weights) > 0 && len(i.Weights) != len(i.URLs) {
+		return fmt.Errorf("%d weights for %d urls", len(i.Weights), len(i.URLs))
+	}
+	weights := make([]float64, 0, len(urls)+1)
+	for n := range urls {
+		w := 1.0
+		if len(i.Weights) > 0 {
+			w = i.Weights[n]
+		}
+		if w <= 0 {
+			return fmt.Errorf("invalid weight %v of %s, must be positive", w, urls[n])
+		}
+		weights = append(weights, w)
+	}
+
 	// Backward-compatability with single Influx URL config files
 	// This could eventually be removed in favor of specifying the urls as a list
 	if i.URL != "" {
 		urls = append(urls, i.URL)
+		weights = append(weights, 1)
+	}
+
+	tr, err := i.newTransport()
+	if err != nil {
+		return err
 	}
 
-	var conns []client.Client
-	for _, u := range urls {
+	var conns []*conn
+	for n, u := range urls {
 		switch {
 		case strings.HasPrefix(u, "udp"):
 			parsed_url, err := url.Parse(u)
@@ -97,27 +304,34 @@ func (i *InfluxDB) Connect() error {
 			if err != nil {
 				return err
 			}
-			conns = append(conns, c)
+			conns = append(conns, &conn{Client: c, url: u, udp: true, weight: weights[n], stats: newServerStats()})
 		default:
 			// If URL doesn't start with "udp", assume HTTP client
-			c, err := client.NewHTTPClient(client.HTTPConfig{
+			c, err := newHTTPClient(client.HTTPConfig{
 				Addr:      u,
-				Username:  i.Username,
-				Password:  i.Password,
+				Username:  i.username,
+				Password:  i.password,
 				UserAgent: i.UserAgent,
 				Timeout:   i.Timeout.Duration,
-			})
+			}, i.BasePath, tr)
 			if err != nil {
 				return err
 			}
+			c.token = i.token
 
-			err = createDatabase(c, i.Database)
-			if err != nil {
-				log.Println("Database creation failed: " + err.Error())
-				continue
+			// the connection is kept when the creation fails, the database
+			// may exist already and the user lack the CREATE privilege
+			if !i.SkipDatabaseCreation && !i.dryRun {
+				if err := createDatabase(c, i.Database); err != nil {
+					service.VLogger.Warn("InfluxDB database creation failed",
+						zap.String("url", u),
+						zap.String("database", i.Database),
+						zap.Error(err),
+					)
+				}
 			}
 
-			conns = append(conns, c)
+			conns = append(conns, &conn{Client: c, url: u, weight: weights[n], stats: newServerStats()})
 		}
 	}
 
@@ -150,43 +364,158 @@ func (i *InfluxDB) Close() error {
 // Choose a random server in the cluster to write to until a successful write
 // occurs, logging each unsuccessful. If all servers fail, return error.
 func (i *InfluxDB) Write(metrics service.Metrics) error {
+	return i.WriteContext(context.Background(), metrics)
+}
+
+// WriteContext is Write aborted when ctx is done, the HTTP request in
+// flight is cancelled and the other servers aren't tried. The metrics are
+// written in a batch per database and retention policy.
+func (i *InfluxDB) WriteContext(ctx context.Context, metrics service.Metrics) error {
 	if len(i.conns) == 0 {
 		err := i.Connect()
 		if err != nil {
 			return err
 		}
 	}
-	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-		Database:         i.Database,
-		RetentionPolicy:  i.RetentionPolicy,
-		WriteConsistency: i.WriteConsistency,
-	})
+	batches, err := i.batchPoints(metrics)
 	if err != nil {
 		return err
 	}
 
+	// the metrics of the batches written aren't retried
+	var failed []*service.MetricData
+	for n, b := range batches {
+		if e := i.writeBatch(ctx, b.BatchPoints); e != nil {
+			err = e
+			failed = append(failed, b.metrics...)
+			if ctx.Err() != nil {
+				for _, left := range batches[n+1:] {
+					failed = append(failed, left.metrics...)
+				}
+				break
+			}
+		}
+	}
+	if err == nil || len(failed) == len(metrics.Data) {
+		return err
+	}
+	return &service.PartialWriteError{Err: err, Metrics: failed}
+}
+
+// batch is the points of a database and retention policy, and their metrics
+type batch struct {
+	client.BatchPoints
+	metrics []*service.MetricData
+}
+
+// batchPoints returns the points of the metrics in a batch per database and
+// retention policy, in the order of their first metric.
+func (i *InfluxDB) batchPoints(metrics service.Metrics) ([]*batch, error) {
+	var batches []*batch
+	byTarget := make(map[string]*batch)
+
+	// a bad point is skipped, it mustn't prevent the others from being written
+	skipped := 0
 	for _, metric := range metrics.Data {
-		pt, err := client.NewPoint(metric.Name, metric.Tags, metric.Fields, metric.Time)
+		pt, err := client.NewPoint(metric.Name, i.filterTags(metric.Tags), i.convertFields(metric), metric.Time)
 		if err != nil {
-			service.VLogger.Error("InfluxDB Write", zap.Error(err))
-			return err
+			service.VLogger.Error("InfluxDB Write, point skipped", zap.String("name", metric.Name), zap.Error(err))
+			skipped++
+			continue
 		}
-		service.VLogger.Debug("InfluxDB Write", zap.Object("@metric", metric))
-		bp.AddPoint(pt)
-		log.Println(metric)
+		i.log.Debug("InfluxDB Write", zap.Object("@metric", metric))
+
+		db, rp := i.target(metric)
+		b, ok := byTarget[db+"\x00"+rp]
+		if !ok {
+			bp, err := i.newBatchPoints(db, rp)
+			if err != nil {
+				return nil, err
+			}
+			b = &batch{BatchPoints: bp}
+			byTarget[db+"\x00"+rp] = b
+			batches = append(batches, b)
+		}
+		b.AddPoint(pt)
+		b.metrics = append(b.metrics, metric)
+	}
+	if skipped > 0 {
+		i.dropped(skipped)
+		if len(batches) == 0 {
+			return nil, fmt.Errorf("no valid point to write, %d points skipped", skipped)
+		}
+		service.VLogger.Warn("InfluxDB Write, bad points skipped", zap.Int("skipped", skipped))
 	}
+	return batches, nil
+}
+
+// target returns the database and retention policy of the metric: the
+// values of its DatabaseTag and RetentionPolicyTag, or else the configured
+// ones.
+func (i *InfluxDB) target(metric *service.MetricData) (string, string) {
+	db, rp := i.Database, i.RetentionPolicy
+	if v := metric.Tags[i.DatabaseTag]; i.DatabaseTag != "" && v != "" {
+		db = v
+	}
+	if v := metric.Tags[i.RetentionPolicyTag]; i.RetentionPolicyTag != "" && v != "" {
+		rp = v
+	}
+	return db, rp
+}
 
+// writeBatch writes the batch to the servers in turn until one of them
+// accepts it.
+func (i *InfluxDB) writeBatch(ctx context.Context, bp client.BatchPoints) error {
 	// This will get set to nil if a successful write occurs
-	err = errors.New("Could not write to any InfluxDB server in cluster")
+	err := errors.New("Could not write to any InfluxDB server in cluster")
 
-	p := rand.Perm(len(i.conns))
-	for _, n := range p {
-		if e := i.conns[n].Write(bp); e != nil {
+	for _, n := range i.order() {
+		if e := ctx.Err(); e != nil {
+			return e
+		}
+
+		c := i.conns[n]
+		var e error
+		start := time.Now()
+		if c.udp {
+			e = i.writeUDP(c, bp)
+		} else if hc, ok := c.Client.(*httpClient); ok {
+			e = hc.WriteContext(ctx, bp)
+		} else {
+			e = c.Write(bp)
+		}
+		elapsed := time.Since(start)
+		// logged before the cancellation check, a write cancelled by the
+		// write timeout is the slowest of all
+		if i.SlowWriteThreshold.Duration > 0 && elapsed >= i.SlowWriteThreshold.Duration {
+			i.slow.log(c.url, bp, elapsed, e, i.SlowWriteLogInterval.Duration)
+		}
+		if ctx.Err() != nil {
+			// the server isn't at fault
+			return ctx.Err()
+		}
+		if e != nil {
+			// the accepted points are written, retrying the batch on this
+			// server or another one would write them twice
+			if reason, dropped, ok := partialWrite(e); ok {
+				c.stats.record(true, elapsed)
+				i.dropped(dropped)
+				service.VLogger.Warn("InfluxDB partial write, rejected points dropped",
+					zap.String("url", c.url),
+					zap.Int("dropped", dropped),
+					zap.String("reason", reason),
+				)
+				err = nil
+				break
+			}
+		}
+		c.stats.record(e == nil, elapsed)
+		if e != nil {
 			service.VLogger.Error("InfluxDB Write", zap.Error(e))
 			// If the database was not found, try to recreate it
-			if strings.Contains(e.Error(), "database not found") {
-				if errc := createDatabase(i.conns[n], i.Database); errc != nil {
-					service.VLogger.Error("ERROR: Database "+i.Database+" not found and failed to recreate\n", zap.Error(errc))
+			if strings.Contains(e.Error(), "database not found") && !i.SkipDatabaseCreation {
+				if errc := createDatabase(c, bp.Database()); errc != nil {
+					service.VLogger.Error("ERROR: Database "+bp.Database()+" not found and failed to recreate\n", zap.Error(errc))
 				}
 			}
 		} else {
@@ -198,16 +527,300 @@ func (i *InfluxDB) Write(metrics service.Metrics) error {
 	return err
 }
 
+// WriteEvent writes the event as a point of EventMeasurement with the
+// title and text fields.
+func (i *InfluxDB) WriteEvent(e *service.Event) error {
+	t := e.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return i.Write(service.Metrics{
+		Data: []*service.MetricData{
+			{
+				Name:   i.EventMeasurement,
+				Tags:   e.Tags,
+				Fields: map[string]interface{}{"title": e.Title, "text": e.Text},
+				Time:   t,
+			},
+		},
+	})
+}
+
+// filterTags applies TagInclude then TagExclude, and removes the excluded
+// database and retention policy tags. The metrics are shared by the
+// outputs, the filtered tags are a new map.
+func (i *InfluxDB) filterTags(tags map[string]string) map[string]string {
+	if i.tagInclude == nil && i.tagExclude == nil && !i.ExcludeDatabaseTag && !i.ExcludeRetentionPolicyTag {
+		return tags
+	}
+
+	filtered := make(map[string]string, len(tags))
+	for k, v := range tags {
+		if i.tagInclude != nil && !i.tagInclude.Match(k) {
+			continue
+		}
+		if i.tagExclude != nil && i.tagExclude.Match(k) {
+			continue
+		}
+		if (i.ExcludeDatabaseTag && k == i.DatabaseTag) || (i.ExcludeRetentionPolicyTag && k == i.RetentionPolicyTag) {
+			continue
+		}
+		filtered[k] = v
+	}
+	return filtered
+}
+
+// normalizeConsistency checks the write consistency and returns it lower
+// cased, empty leaves the server default.
+func normalizeConsistency(consistency string) (string, error) {
+	c := strings.ToLower(strings.TrimSpace(consistency))
+	switch c {
+	case "", "any", "one", "quorum", "all":
+		return c, nil
+	default:
+		return "", fmt.Errorf("invalid write_consistency %q, can be: \"any\", \"one\", \"quorum\", \"all\"", consistency)
+	}
+}
+
+// SetPrecision sets the precision of the batches, the times are already
+// truncated by the output wrapper.
+func (i *InfluxDB) SetPrecision(precision time.Duration) {
+	switch precision {
+	case time.Microsecond:
+		i.precision = "us"
+	case time.Millisecond:
+		i.precision = "ms"
+	case time.Second:
+		i.precision = "s"
+	case time.Minute:
+		i.precision = "m"
+	case time.Hour:
+		i.precision = "h"
+	default:
+		i.precision = "ns"
+	}
+}
+
+// SetStats implements service.StatsSetter.
+func (i *InfluxDB) SetStats(stats *service.PluginStats) {
+	i.stats = stats
+}
+
+// dropped counts the points dropped by the output.
+func (i *InfluxDB) dropped(n int) {
+	if i.stats != nil {
+		i.stats.Dropped(n)
+	}
+}
+
+// SetDryRun sets the dry run mode, the database isn't created then.
+func (i *InfluxDB) SetDryRun(dryRun bool) {
+	i.dryRun = dryRun
+}
+
+// CheckDestination pings the HTTP servers and checks the database exists,
+// the UDP servers can't be checked.
+func (i *InfluxDB) CheckDestination() error {
+	if len(i.conns) == 0 {
+		if err := i.Connect(); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range i.conns {
+		if c.udp {
+			service.VLogger.Info("InfluxDB dry run, UDP server not checked", zap.String("url", c.url))
+			continue
+		}
+		if _, _, err := c.Ping(i.Timeout.Duration); err != nil {
+			return fmt.Errorf("%s: %s", c.url, err)
+		}
+		ok, err := databaseExists(c, i.Database)
+		if err != nil {
+			return fmt.Errorf("%s: %s", c.url, err)
+		}
+		if !ok {
+			return fmt.Errorf("%s: database %s not found", c.url, i.Database)
+		}
+		service.VLogger.Info("InfluxDB dry run, server ready", zap.String("url", c.url), zap.String("database", i.Database))
+	}
+	return nil
+}
+
+func databaseExists(c client.Client, database string) (bool, error) {
+	resp, err := c.Query(client.Query{Command: "SHOW DATABASES"})
+	if err != nil {
+		return false, err
+	}
+	if err := resp.Error(); err != nil {
+		return false, err
+	}
+	for _, r := range resp.Results {
+		for _, row := range r.Series {
+			for _, v := range row.Values {
+				if len(v) > 0 && v[0] == database {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+func (i *InfluxDB) newBatchPoints(database, retentionPolicy string) (client.BatchPoints, error) {
+	return client.NewBatchPoints(client.BatchPointsConfig{
+		Precision:        i.precision,
+		Database:         database,
+		RetentionPolicy:  retentionPolicy,
+		WriteConsistency: i.WriteConsistency,
+	})
+}
+
+// writeUDP writes the points in datagrams smaller than UDPPayload. A point is
+// never split across datagrams, the points larger than the payload are
+// dropped since the OS would truncate them.
+func (i *InfluxDB) writeUDP(c *conn, bp client.BatchPoints) error {
+	var chunk client.BatchPoints
+	var size int
+	var err error
+
+	for _, pt := range bp.Points() {
+		n := len(pt.String()) + 1
+		if n >= i.UDPPayload {
+			service.VLogger.Warn("InfluxDB point larger than the UDP payload, dropped",
+				zap.String("metric", pt.Name()),
+				zap.Int("size", n),
+				zap.Int("udp_payload", i.UDPPayload),
+			)
+			continue
+		}
+
+		if chunk != nil && size+n >= i.UDPPayload {
+			if e := c.Write(chunk); e != nil && err == nil {
+				err = e
+			}
+			chunk = nil
+		}
+
+		if chunk == nil {
+			var e error
+			if chunk, e = i.newBatchPoints(bp.Database(), bp.RetentionPolicy()); e != nil {
+				return e
+			}
+			size = 0
+		}
+		chunk.AddPoint(pt)
+		size += n
+	}
+
+	if chunk != nil {
+		if e := c.Write(chunk); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// convertFields returns the fields of the metric with the types pinned by
+// TypeConversions, the fields which can't be converted are dropped. The
+// metric itself is never modified since it's shared with the other outputs.
+func (i *InfluxDB) convertFields(metric *service.MetricData) map[string]interface{} {
+	if len(i.TypeConversions) == 0 {
+		return metric.Fields
+	}
+
+	fields := make(map[string]interface{}, len(metric.Fields))
+	for k, v := range metric.Fields {
+		typ, ok := i.TypeConversions[k]
+		if !ok {
+			fields[k] = v
+			continue
+		}
+
+		cv, err := convertField(v, typ)
+		if err != nil {
+			i.log.Debug("InfluxDB field dropped",
+				zap.String("metric", metric.Name),
+				zap.String("field", k),
+				zap.Error(err),
+			)
+			continue
+		}
+		fields[k] = cv
+	}
+	return fields
+}
+
 func (i *InfluxDB) Init(stop chan bool) {
 	if err := i.Connect(); err != nil {
-		log.Fatal("InfluxDB Connect failed, err message is ", err)
+		service.VLogger.Fatal("InfluxDB Connect failed", zap.Error(err))
+	}
+
+	if i.dryRun {
+		if err := i.CheckDestination(); err != nil {
+			service.VLogger.Error("InfluxDB dry run, destination check failed", zap.Error(err))
+		}
+		return
+	}
+	if !i.StartupTest {
+		return
+	}
+	if err := i.startupTest(); err != nil {
+		service.VLogger.Error("InfluxDB startup test failed", zap.String("database", i.Database), zap.Error(err))
+		select {
+		case stop <- true:
+		default:
+		}
 	}
 }
 
+// startupTest writes a single heartbeat point to the configured database and
+// logs the round trip of the write.
+func (i *InfluxDB) startupTest() error {
+	if len(i.conns) == 0 {
+		return errors.New("no InfluxDB server available")
+	}
+
+	hostname, _ := os.Hostname()
+	start := time.Now()
+	err := i.Write(service.Metrics{
+		Data: []*service.MetricData{
+			{
+				Name:   i.HeartbeatMeasurement,
+				Tags:   map[string]string{"host": hostname},
+				Fields: map[string]interface{}{"value": 1},
+				Time:   start,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	service.VLogger.Info("InfluxDB startup test succeeded",
+		zap.String("database", i.Database),
+		zap.Duration("latency", time.Since(start)),
+	)
+	return nil
+}
+
 func (i *InfluxDB) Start() {
 
 }
 
+// Clone returns a copy of the output without connections, so every worker
+// writes on its own connections.
+func (i *InfluxDB) Clone() service.MetricOutputer {
+	c := *i
+	c.conns = nil
+	return &c
+}
+
+// ComputeContext writes the metrics, aborted when ctx is done.
+func (i *InfluxDB) ComputeContext(ctx context.Context, metrics service.Metrics) error {
+	return i.WriteContext(ctx, metrics)
+}
+
 func (i *InfluxDB) Compute(metrics service.Metrics) error {
 	// log.Println("influxDB data is", metrics)
 	return i.Write(metrics)
@@ -215,5 +828,12 @@ func (i *InfluxDB) Compute(metrics service.Metrics) error {
 }
 
 func init() {
-	service.AddMetricOutput("influxdb", &InfluxDB{Timeout: misc.Duration{time.Second * 5}})
+	service.AddMetricOutput("influxdb", &InfluxDB{
+		Timeout:              misc.Duration{time.Second * 5},
+		HeartbeatMeasurement: "vgo_heartbeat",
+		EventMeasurement:     "annotations",
+		MaxIdleConns:         10,
+		IdleConnTimeout:      misc.Duration{Duration: 90 * time.Second},
+		SlowWriteLogInterval: misc.Duration{Duration: time.Minute},
+	})
 }
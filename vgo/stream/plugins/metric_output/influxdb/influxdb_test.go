@@ -0,0 +1,222 @@
+package influxdb
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+// write is a write request received by the mock server
+type write struct {
+	db, rp      string
+	precision   string
+	consistency string
+	lines       []string
+}
+
+// mockServer is an InfluxDB answering the pings, the queries and the
+// writes, writeStatus and writeBody are the answer of the writes. The
+// CREATE queries fail with denyCreate, the writes to failDB fail.
+type mockServer struct {
+	*httptest.Server
+
+	sync.Mutex
+	writeStatus int
+	writeBody   string
+	denyCreate  bool
+	failDB      string
+	paths       []string
+	queries     []string
+	writes      []write
+	databases   []string
+}
+
+func newMockServer() *mockServer {
+	s := &mockServer{writeStatus: http.StatusNoContent}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+func (s *mockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	s.paths = append(s.paths, r.URL.Path)
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/ping"):
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(r.URL.Path, "/query"):
+		q := r.URL.Query().Get("q")
+		s.queries = append(s.queries, q)
+		if s.denyCreate && strings.HasPrefix(q, "CREATE") {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error":"requires admin privilege"}`))
+			return
+		}
+		if q == "SHOW DATABASES" {
+			var values []string
+			for _, db := range s.databases {
+				values = append(values, `["`+db+`"]`)
+			}
+			w.Write([]byte(`{"results":[{"series":[{"name":"databases","columns":["name"],"values":[` + strings.Join(values, ",") + `]}]}]}`))
+			return
+		}
+		w.Write([]byte(`{"results":[{}]}`))
+	case strings.HasSuffix(r.URL.Path, "/write"):
+		body, _ := ioutil.ReadAll(r.Body)
+		params := r.URL.Query()
+		s.writes = append(s.writes, write{
+			db:          params.Get("db"),
+			rp:          params.Get("rp"),
+			precision:   params.Get("precision"),
+			consistency: params.Get("consistency"),
+			lines:       strings.Split(strings.TrimSpace(string(body)), "\n"),
+		})
+		if params.Get("db") == s.failDB {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"timeout"}`))
+			return
+		}
+		w.WriteHeader(s.writeStatus)
+		w.Write([]byte(s.writeBody))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *mockServer) setWriteAnswer(status int, body string) {
+	s.Lock()
+	s.writeStatus, s.writeBody = status, body
+	s.Unlock()
+}
+
+// queried returns the queries received.
+func (s *mockServer) queried() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+// received returns the writes received.
+func (s *mockServer) received() []write {
+	s.Lock()
+	defer s.Unlock()
+	return append([]write(nil), s.writes...)
+}
+
+// newInfluxDB returns the output with the defaults of init writing to the
+// urls.
+func newInfluxDB(urls ...string) *InfluxDB {
+	return &InfluxDB{
+		URLs:                 urls,
+		Database:             "test",
+		Timeout:              misc.Duration{Duration: 5 * time.Second},
+		HeartbeatMeasurement: "vgo_heartbeat",
+		EventMeasurement:     "annotations",
+		MaxIdleConns:         10,
+		IdleConnTimeout:      misc.Duration{Duration: 90 * time.Second},
+		SlowWriteLogInterval: misc.Duration{Duration: time.Minute},
+	}
+}
+
+// connect connects the output, it fails the test on error.
+func connect(t *testing.T, i *InfluxDB) *InfluxDB {
+	if err := i.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+func TestMixedFieldTypes(t *testing.T) {
+	s := newMockServer()
+	defer s.Close()
+	i := connect(t, newInfluxDB(s.URL))
+
+	err := i.Write(service.Metrics{Data: []*service.MetricData{{
+		Name:   "app",
+		Fields: map[string]interface{}{"latency": 1.5, "requests": int64(10), "healthy": true, "version": "1.2"},
+		Time:   time.Unix(1, 0),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `app healthy=true,latency=1.5,requests=10i,version="1.2" 1000000000`
+	if writes := s.received(); len(writes) != 1 || writes[0].lines[0] != want {
+		t.Errorf("got writes %v, want %s", writes, want)
+	}
+}
+
+func TestBadPointsSkipped(t *testing.T) {
+	s := newMockServer()
+	defer s.Close()
+	i := connect(t, newInfluxDB(s.URL))
+
+	good := func(host string) *service.MetricData {
+		return &service.MetricData{
+			Name:   "cpu",
+			Tags:   map[string]string{"host": host},
+			Fields: map[string]interface{}{"value": 1.0},
+			Time:   time.Unix(1, 0),
+		}
+	}
+	// a point needs a field
+	bad := &service.MetricData{Name: "cpu", Fields: map[string]interface{}{}, Time: time.Unix(1, 0)}
+
+	err := i.Write(service.Metrics{Data: []*service.MetricData{good("a"), bad, good("b"), bad}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"cpu,host=a value=1 1000000000", "cpu,host=b value=1 1000000000"}
+	if writes := s.received(); len(writes) != 1 || !reflect.DeepEqual(writes[0].lines, want) {
+		t.Errorf("got writes %v, want %v", writes, want)
+	}
+
+	// nothing to write
+	if err := i.Write(service.Metrics{Data: []*service.MetricData{bad}}); err == nil {
+		t.Error("no error when every point is bad")
+	}
+	if n := len(s.received()); n != 1 {
+		t.Errorf("%d writes, the batch of bad points was sent", n)
+	}
+}
+
+func TestWriteEvent(t *testing.T) {
+	s := newMockServer()
+	defer s.Close()
+	i := connect(t, newInfluxDB(s.URL))
+
+	before := time.Now()
+	err := i.WriteEvent(&service.Event{Title: "deploy", Text: `api "v2"`, Tags: map[string]string{"app": "api"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes := s.received()
+	if len(writes) != 1 || len(writes[0].lines) != 1 {
+		t.Fatalf("got writes %v", writes)
+	}
+	line := writes[0].lines[0]
+	prefix := `annotations,app=api text="api \"v2\"",title="deploy" `
+	if !strings.HasPrefix(line, prefix) {
+		t.Fatalf("got %s, want the prefix %s", line, prefix)
+	}
+	// without a time, the event is written now
+	ts, err := strconv.ParseInt(strings.TrimPrefix(line, prefix), 10, 64)
+	if err != nil || time.Unix(0, ts).Before(before) {
+		t.Errorf("got event time %s, want now", strings.TrimPrefix(line, prefix))
+	}
+}
@@ -0,0 +1,183 @@
+package influxdb
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// pki is a CA and the server and client certificates it signed, written
+// as PEM files to dir.
+type pki struct {
+	dir    string
+	pool   *x509.CertPool
+	server tls.Certificate
+}
+
+func newPKI(t *testing.T) *pki {
+	dir, err := ioutil.TempDir("", "vgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &pki{dir: dir, pool: x509.NewCertPool()}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "vgo test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	p.pool.AddCert(ca)
+	p.write(t, "ca.pem", "CERTIFICATE", caDER)
+
+	sign := func(serial int64, usage x509.ExtKeyUsage) ([]byte, []byte) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "vgo"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der, keyDER
+	}
+
+	der, keyDER := sign(2, x509.ExtKeyUsageServerAuth)
+	p.server, err = tls.X509KeyPair(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, keyDER = sign(3, x509.ExtKeyUsageClientAuth)
+	p.write(t, "cert.pem", "CERTIFICATE", der)
+	p.write(t, "key.pem", "EC PRIVATE KEY", keyDER)
+	return p
+}
+
+func (p *pki) write(t *testing.T, name, typ string, der []byte) {
+	b := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := ioutil.WriteFile(filepath.Join(p.dir, name), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (p *pki) path(name string) string {
+	return filepath.Join(p.dir, name)
+}
+
+func (p *pki) clean() {
+	os.RemoveAll(p.dir)
+}
+
+// mtlsServer is the mock server requiring a client certificate of the CA.
+func (p *pki) mtlsServer() *mockServer {
+	s := &mockServer{writeStatus: http.StatusNoContent}
+	s.Server = httptest.NewUnstartedServer(s)
+	s.TLS = &tls.Config{
+		Certificates: []tls.Certificate{p.server},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    p.pool,
+	}
+	// the handshake failures of the clients without certificate aren't
+	// logged
+	s.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	s.StartTLS()
+	return s
+}
+
+func TestMutualTLS(t *testing.T) {
+	p := newPKI(t)
+	defer p.clean()
+	s := p.mtlsServer()
+	defer s.Close()
+
+	metrics := service.Metrics{Data: []*service.MetricData{
+		{Name: "cpu", Fields: map[string]interface{}{"value": 1.0}, Time: time.Unix(1, 0)},
+	}}
+
+	i := newInfluxDB(s.URL)
+	i.SSLCA, i.SSLCert, i.SSLKey = p.path("ca.pem"), p.path("cert.pem"), p.path("key.pem")
+	connect(t, i)
+	if err := i.Write(metrics); err != nil {
+		t.Fatalf("write with the client certificate failed, %s", err)
+	}
+	if len(s.received()) != 1 {
+		t.Error("write not received")
+	}
+
+	// the server trusted, but no certificate to present
+	i = newInfluxDB(s.URL)
+	i.SSLCA = p.path("ca.pem")
+	connect(t, i)
+	if err := i.Write(metrics); err == nil {
+		t.Error("write without client certificate accepted")
+	}
+	if len(s.received()) != 1 {
+		t.Error("write without client certificate received")
+	}
+}
+
+func TestClientCertInvalid(t *testing.T) {
+	p := newPKI(t)
+	defer p.clean()
+
+	for _, files := range [][3]string{
+		// the certificate without its key and the opposite
+		{p.path("ca.pem"), p.path("cert.pem"), ""},
+		{p.path("ca.pem"), "", p.path("key.pem")},
+		{p.path("ca.pem"), p.path("cert.pem"), p.path("missing.pem")},
+		// the key of another certificate
+		{p.path("ca.pem"), p.path("ca.pem"), p.path("key.pem")},
+		{p.path("missing.pem"), "", ""},
+	} {
+		i := newInfluxDB("https://localhost:8086")
+		i.SSLCA, i.SSLCert, i.SSLKey = files[0], files[1], files[2]
+		if err := i.Connect(); err == nil {
+			t.Errorf("ssl_ca %s ssl_cert %s ssl_key %s accepted", files[0], files[1], files[2])
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package influxdb
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// droppedRe matches the number of points rejected by a partial write
+var droppedRe = regexp.MustCompile(`dropped=(\d+)`)
+
+// partialWrite parses the "partial write" errors, such as a field type
+// conflict or points beyond the retention policy:
+//
+//   {"error":"partial write: field type conflict: ... dropped=2"}
+//
+// The server wrote the other points of the batch, so it must not be written
+// again. It returns the reason and the number of points rejected, 0 when
+// the server doesn't tell, and false for the other errors.
+func partialWrite(err error) (string, int, bool) {
+	msg := err.Error()
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal([]byte(msg), &body) == nil && body.Error != "" {
+		msg = body.Error
+	}
+	if !strings.Contains(msg, "partial write") {
+		return "", 0, false
+	}
+
+	var dropped int
+	if m := droppedRe.FindStringSubmatch(msg); m != nil {
+		dropped, _ = strconv.Atoi(m[1])
+	}
+	return strings.TrimSpace(msg), dropped, true
+}
@@ -0,0 +1,114 @@
+package influxdb
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+const partialBody = `{"error":"partial write: field type conflict: input field \"value\" on measurement \"cpu\" is type string, already exists as type float dropped=2"}`
+
+func TestPartialWriteParse(t *testing.T) {
+	for _, tt := range []struct {
+		err     string
+		reason  string
+		dropped int
+		partial bool
+	}{
+		{partialBody, `partial write: field type conflict: input field "value" on measurement "cpu" is type string, already exists as type float dropped=2`, 2, true},
+		// the body isn't always JSON
+		{"partial write: points beyond retention policy dropped=10\n", "partial write: points beyond retention policy dropped=10", 10, true},
+		{`{"error":"partial write: max-values-per-tag limit exceeded"}`, "partial write: max-values-per-tag limit exceeded", 0, true},
+		{`{"error":"database not found: \"test\""}`, "", 0, false},
+		{"Could not write to any InfluxDB server in cluster", "", 0, false},
+	} {
+		reason, dropped, ok := partialWrite(errors.New(tt.err))
+		if reason != tt.reason || dropped != tt.dropped || ok != tt.partial {
+			t.Errorf("%s, got %q %d %v, want %q %d %v", tt.err, reason, dropped, ok, tt.reason, tt.dropped, tt.partial)
+		}
+	}
+}
+
+func partialMetrics() service.Metrics {
+	return service.Metrics{Data: []*service.MetricData{
+		{Name: "cpu", Tags: map[string]string{"host": "a"}, Fields: map[string]interface{}{"value": 1.0}, Time: time.Unix(1, 0)},
+		{Name: "cpu", Tags: map[string]string{"host": "b"}, Fields: map[string]interface{}{"value": "high"}, Time: time.Unix(1, 0)},
+		{Name: "cpu", Tags: map[string]string{"host": "c"}, Fields: map[string]interface{}{"value": "low"}, Time: time.Unix(1, 0)},
+	}}
+}
+
+func TestPartialWriteNotRetried(t *testing.T) {
+	s1, s2 := newMockServer(), newMockServer()
+	defer s1.Close()
+	defer s2.Close()
+	s1.setWriteAnswer(http.StatusBadRequest, partialBody)
+	s2.setWriteAnswer(http.StatusBadRequest, partialBody)
+	i := connect(t, newInfluxDB(s1.URL, s2.URL))
+
+	// the accepted point is written, the batch isn't sent again to the
+	// server nor the other one
+	if err := i.Write(partialMetrics()); err != nil {
+		t.Fatalf("partial write returned %s, want the rejected points dropped", err)
+	}
+	writes := append(s1.received(), s2.received()...)
+	if len(writes) != 1 || len(writes[0].lines) != 3 {
+		t.Errorf("got %d writes, want the batch written once", len(writes))
+	}
+}
+
+func TestWriteErrorRetried(t *testing.T) {
+	s1, s2 := newMockServer(), newMockServer()
+	defer s1.Close()
+	defer s2.Close()
+	s1.setWriteAnswer(http.StatusBadRequest, `{"error":"unable to parse 'cpu value=': missing field value"}`)
+	s2.setWriteAnswer(http.StatusBadRequest, `{"error":"unable to parse 'cpu value=': missing field value"}`)
+	i := connect(t, newInfluxDB(s1.URL, s2.URL))
+
+	// the other errors still fail the write, every server is tried
+	if err := i.Write(partialMetrics()); err == nil {
+		t.Error("write refused by all the servers succeeded")
+	}
+	if n := len(s1.received()) + len(s2.received()); n != 2 {
+		t.Errorf("got %d writes, want one per server", n)
+	}
+}
+
+func TestFailedBatchRetriedAlone(t *testing.T) {
+	s := newMockServer()
+	defer s.Close()
+	s.failDB = "telegraf"
+	i := newInfluxDB(s.URL)
+	i.DatabaseTag = "db"
+	connect(t, i)
+
+	metrics := partialMetrics()
+	metrics.Data[0].Fields["value"] = 2.0
+	metrics.Data[1].Tags = map[string]string{"host": "b", "db": "telegraf"}
+	metrics.Data[1].Fields["value"] = 3.0
+	metrics.Data[2].Fields["value"] = 4.0
+
+	// the batch of the other database is written, only the failed one is
+	// retried
+	err := i.Write(metrics)
+	pe, ok := err.(*service.PartialWriteError)
+	if !ok {
+		t.Fatalf("got error %v, want a partial write", err)
+	}
+	if len(pe.Metrics) != 1 || pe.Metrics[0] != metrics.Data[1] {
+		t.Errorf("got metrics %v to retry, want the telegraf one", pe.Metrics)
+	}
+
+	// every batch failed
+	s.Lock()
+	s.failDB = "test"
+	s.Unlock()
+	metrics.Data[1].Tags["db"] = "test"
+	if err := i.Write(metrics); err == nil {
+		t.Error("failed write succeeded")
+	} else if _, ok := err.(*service.PartialWriteError); ok {
+		t.Errorf("got partial write %v, want the whole write failed", err)
+	}
+}
@@ -0,0 +1,107 @@
+package influxdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+func TestPrecision(t *testing.T) {
+	s := newMockServer()
+	defer s.Close()
+
+	for _, tt := range []struct {
+		precision time.Duration
+		param     string
+		time      string
+	}{
+		{time.Nanosecond, "ns", "1500000000123456789"},
+		{time.Microsecond, "u", "1500000000123456"},
+		{time.Millisecond, "ms", "1500000000123"},
+		{time.Second, "s", "1500000000"},
+	} {
+		i := newInfluxDB(s.URL)
+		i.SetPrecision(tt.precision)
+		connect(t, i)
+
+		// the output wrapper truncates the times
+		err := i.Write(service.Metrics{Data: []*service.MetricData{{
+			Name:   "cpu",
+			Fields: map[string]interface{}{"value": 1.0},
+			Time:   time.Unix(1500000000, 123456789).Truncate(tt.precision),
+		}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writes := s.received()
+		w := writes[len(writes)-1]
+		if want := "cpu value=1 " + tt.time; w.precision != tt.param || w.lines[0] != want {
+			t.Errorf("precision %s, got %s %v, want %s %s", tt.precision, w.precision, w.lines, tt.param, want)
+		}
+	}
+}
+
+// precisionMetrics returns the metrics of 100 series written every 10s
+// for an hour, their times have a random jitter under the second.
+func precisionMetrics(precision time.Duration) []*service.MetricData {
+	r := rand.New(rand.NewSource(1))
+	start := time.Unix(1500000000, 0)
+	var metrics []*service.MetricData
+	for n := 0; n < 360; n++ {
+		for s := 0; s < 100; s++ {
+			at := start.Add(time.Duration(n)*10*time.Second + time.Duration(r.Int63n(int64(time.Second))))
+			metrics = append(metrics, &service.MetricData{
+				Name:   "cpu",
+				Tags:   map[string]string{"host": fmt.Sprintf("server%03d", s)},
+				Fields: map[string]interface{}{"usage": float64(r.Intn(100))},
+				Time:   at.Truncate(precision),
+			})
+		}
+	}
+	return metrics
+}
+
+// benchmarkPrecision encodes and compresses the line protocol of the
+// points, it logs the sizes: the second precision saves about a fifth of
+// the raw payload and more than half once compressed, the times of the
+// points written together being the same.
+func benchmarkPrecision(b *testing.B, precision time.Duration) {
+	i := newInfluxDB("http://localhost:8086")
+	i.SetPrecision(precision)
+	i.log = service.PluginLogger("influxdb")
+	metrics := service.Metrics{Data: precisionMetrics(precision)}
+
+	var raw, compressed int
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		batches, err := i.batchPoints(metrics)
+		if err != nil {
+			b.Fatal(err)
+		}
+		bp := batches[0]
+		unit := bp.Precision()
+		if unit == "us" {
+			unit = "u"
+		}
+
+		var lines, gz bytes.Buffer
+		zw := gzip.NewWriter(&gz)
+		for _, p := range bp.Points() {
+			lines.WriteString(p.PrecisionString(unit))
+			lines.WriteByte('\n')
+		}
+		zw.Write(lines.Bytes())
+		zw.Close()
+		raw, compressed = lines.Len(), gz.Len()
+	}
+	b.StopTimer()
+	b.Logf("%d points, %d bytes, %d bytes compressed", len(metrics.Data), raw, compressed)
+}
+
+func BenchmarkPrecisionNanosecond(b *testing.B) { benchmarkPrecision(b, time.Nanosecond) }
+func BenchmarkPrecisionSecond(b *testing.B)     { benchmarkPrecision(b, time.Second) }
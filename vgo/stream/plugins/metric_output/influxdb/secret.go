@@ -0,0 +1,60 @@
+package influxdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+// envVar matches the ${NAME} references to the environment variables. The
+// bare $NAME form isn't expanded, a password may contain a '$'
+var envVar = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// expandEnv replaces the ${NAME} references with the environment variables,
+// the unset ones are replaced with an empty string.
+func expandEnv(s string) string {
+	return envVar.ReplaceAllStringFunc(s, func(ref string) string {
+		return os.Getenv(ref[2 : len(ref)-1])
+	})
+}
+
+// readSecret returns the secret option, read from file when set or else
+// from the inline value. The trailing newlines of the file are trimmed.
+func readSecret(option, inline, file string) (string, error) {
+	inline, file = expandEnv(inline), expandEnv(file)
+	if file == "" {
+		return inline, nil
+	}
+
+	if inline != "" {
+		service.VLogger.Warn("InfluxDB secret set both inline and from file, the file is used",
+			zap.String("option", option),
+			zap.String("file", file),
+		)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("read %s_file, %s", option, err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// readSecrets reads the credentials, which are kept apart from the options
+// so the files are read again on every Connect.
+func (i *InfluxDB) readSecrets() error {
+	var err error
+	if i.username, err = readSecret("username", i.Username, i.UsernameFile); err != nil {
+		return err
+	}
+	if i.password, err = readSecret("password", i.Password, i.PasswordFile); err != nil {
+		return err
+	}
+	i.token, err = readSecret("token", i.Token, i.TokenFile)
+	return err
+}
@@ -0,0 +1,153 @@
+package influxdb
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// secretFile writes the secret to a file of dir and returns its path.
+func secretFile(t *testing.T, dir, name, secret string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(secret), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "influxdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("VGO_TEST_SECRET", "from-env")
+	os.Setenv("VGO_TEST_SECRET_DIR", dir)
+	defer os.Unsetenv("VGO_TEST_SECRET")
+	defer os.Unsetenv("VGO_TEST_SECRET_DIR")
+
+	for _, tt := range []struct {
+		name   string
+		inline string
+		file   string
+		want   string
+	}{
+		{"inline", "inline", "", "inline"},
+		{"file", "", secretFile(t, dir, "file", "secret"), "secret"},
+		// only the trailing newlines are trimmed
+		{"newlines", "", secretFile(t, dir, "newlines", " secret \r\n\n"), " secret "},
+		{"file wins", "inline", secretFile(t, dir, "wins", "secret\n"), "secret"},
+		{"env", "${VGO_TEST_SECRET}", "", "from-env"},
+		{"env in text", "pre-${VGO_TEST_SECRET}-post", "", "pre-from-env-post"},
+		{"env unset", "${VGO_TEST_UNSET}", "", ""},
+		// the bare form is kept, a password may contain a '$'
+		{"bare dollar", "pa$VGO_TEST_SECRET", "", "pa$VGO_TEST_SECRET"},
+		{"env file", "", "${VGO_TEST_SECRET_DIR}/file", "secret"},
+		{"env inline with file", "${VGO_TEST_SECRET}", secretFile(t, dir, "env", "secret"), "secret"},
+	} {
+		got, err := readSecret("password", tt.inline, tt.file)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got secret %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := readSecret("password", "inline", filepath.Join(dir, "missing")); err == nil {
+		t.Error("no error when the file is missing")
+	}
+}
+
+// authServer records the Authorization header of the writes.
+type authServer struct {
+	*httptest.Server
+
+	sync.Mutex
+	auth []string
+}
+
+func newAuthServer() *authServer {
+	s := &authServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/write" {
+			s.Lock()
+			s.auth = append(s.auth, r.Header.Get("Authorization"))
+			s.Unlock()
+		}
+		if r.URL.Path == "/query" {
+			w.Write([]byte(`{"results":[{}]}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return s
+}
+
+func (s *authServer) last() string {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.auth) == 0 {
+		return ""
+	}
+	return s.auth[len(s.auth)-1]
+}
+
+func TestCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "influxdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := newAuthServer()
+	defer s.Close()
+
+	basic := func(username, password string) string {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(username, password)
+		return req.Header.Get("Authorization")
+	}
+
+	i := newInfluxDB(s.URL)
+	i.Username = "inline"
+	i.Password = "inline"
+	i.UsernameFile = secretFile(t, dir, "username", "vgo\n")
+	i.PasswordFile = secretFile(t, dir, "password", "s3cret\n")
+	connect(t, i)
+	if err := i.Write(testMetrics); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.last(), basic("vgo", "s3cret"); got != want {
+		t.Errorf("got authorization %q, want %q", got, want)
+	}
+
+	// the files are read again on Connect, e.g. after a rotation
+	secretFile(t, dir, "password", "rotated\n")
+	connect(t, i)
+	if err := i.Write(testMetrics); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.last(), basic("vgo", "rotated"); got != want {
+		t.Errorf("got authorization %q, want %q", got, want)
+	}
+
+	// the token wins over the username and password
+	i.TokenFile = secretFile(t, dir, "token", "t0ken\n")
+	connect(t, i)
+	if err := i.Write(testMetrics); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.last(); got != "Token t0ken" {
+		t.Errorf("got authorization %q, want the token", got)
+	}
+
+	i.TokenFile = filepath.Join(dir, "missing")
+	if err := i.Connect(); err == nil {
+		t.Error("no error when the token file is missing")
+	}
+}
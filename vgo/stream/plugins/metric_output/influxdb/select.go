@@ -0,0 +1,109 @@
+package influxdb
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// ewmaAlpha is the weight of the last write in the averages
+	ewmaAlpha = 0.2
+	// minSuccess keeps a failing server in the rotation, it's chosen first
+	// now and then to notice it's back
+	minSuccess = 0.05
+	// minLatency is the lowest latency compared, the servers faster than
+	// it are as fast
+	minLatency = time.Millisecond
+)
+
+// serverStats are the moving averages of the writes of a server
+type serverStats struct {
+	sync.Mutex
+	// success is 1 for a server whose writes all succeed, 0 for a server
+	// whose writes all fail
+	success float64
+	latency float64
+}
+
+func newServerStats() *serverStats {
+	return &serverStats{success: 1}
+}
+
+// record adds the result of a write to the averages.
+func (s *serverStats) record(ok bool, latency time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	result := 0.0
+	if ok {
+		result = 1
+	}
+	s.success = ewmaAlpha*result + (1-ewmaAlpha)*s.success
+	if ok {
+		if s.latency == 0 {
+			s.latency = float64(latency)
+		} else {
+			s.latency = ewmaAlpha*float64(latency) + (1-ewmaAlpha)*s.latency
+		}
+	}
+}
+
+// averageLatency returns the average latency of the successful writes, 0
+// for a server without any.
+func (s *serverStats) averageLatency() float64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.latency
+}
+
+// score is higher for the servers writing successfully and fast. The
+// latency is relative to fastest, the latency of the fastest server, so it
+// never outweighs the failures whatever the network: a failing server
+// scores minSuccess at most, a server as fast as the fastest one 1 when its
+// writes succeed. The servers not written successfully yet are as fast as
+// the fastest one.
+func (s *serverStats) score(fastest float64) float64 {
+	s.Lock()
+	defer s.Unlock()
+
+	latency := math.Max(s.latency, fastest)
+	return math.Max(s.success, minSuccess) * fastest / latency
+}
+
+// order returns the order the servers are tried in. Without weights it's a
+// random permutation, with weights a weighted random one, the weight of a
+// server multiplied by its score so the servers which are fast and
+// succeed are chosen more often. All the servers are always in the order,
+// so they're all tried when the first ones fail.
+func (i *InfluxDB) order() []int {
+	if len(i.Weights) == 0 {
+		return rand.Perm(len(i.conns))
+	}
+
+	// weighted sampling without replacement: every server draws
+	// u^(1/w) and the highest draws go first
+	fastest := 0.0
+	for _, c := range i.conns {
+		if l := c.stats.averageLatency(); l > 0 && (fastest == 0 || l < fastest) {
+			fastest = l
+		}
+	}
+	fastest = math.Max(fastest, float64(minLatency))
+
+	keys := make([]float64, len(i.conns))
+	for n, c := range i.conns {
+		keys[n] = math.Pow(rand.Float64(), 1/(c.weight*c.stats.score(fastest)))
+	}
+
+	order := make([]int, len(i.conns))
+	for n := range order {
+		order[n] = n
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return keys[order[a]] > keys[order[b]]
+	})
+	return order
+}
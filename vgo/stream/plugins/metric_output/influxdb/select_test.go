@@ -0,0 +1,108 @@
+package influxdb
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// firstShares returns the share of the orders each server comes first in.
+func firstShares(t *testing.T, i *InfluxDB, trials int) []float64 {
+	shares := make([]float64, len(i.conns))
+	for n := 0; n < trials; n++ {
+		order := i.order()
+		seen := make(map[int]bool)
+		for _, s := range order {
+			seen[s] = true
+		}
+		if len(order) != len(i.conns) || len(seen) != len(i.conns) {
+			t.Fatalf("order %v doesn't have every server", order)
+		}
+		shares[order[0]]++
+	}
+	for n := range shares {
+		shares[n] /= float64(trials)
+	}
+	return shares
+}
+
+func weighted(weights ...float64) *InfluxDB {
+	i := &InfluxDB{Weights: weights}
+	for _, w := range weights {
+		i.conns = append(i.conns, &conn{weight: w, stats: newServerStats()})
+	}
+	return i
+}
+
+func TestWeightedOrder(t *testing.T) {
+	for _, tt := range []struct {
+		weights []float64
+		want    []float64
+	}{
+		{[]float64{3, 1}, []float64{0.75, 0.25}},
+		{[]float64{2, 1, 1}, []float64{0.5, 0.25, 0.25}},
+		{[]float64{1, 1, 1, 1}, []float64{0.25, 0.25, 0.25, 0.25}},
+	} {
+		got := firstShares(t, weighted(tt.weights...), 20000)
+		for n := range got {
+			if math.Abs(got[n]-tt.want[n]) > 0.02 {
+				t.Errorf("weights %v, got first shares %v, want %v", tt.weights, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestUnweightedOrder(t *testing.T) {
+	i := weighted(1, 1, 1)
+	i.Weights = nil
+	// without weights the scores are ignored
+	for n := 0; n < 10; n++ {
+		i.conns[0].stats.record(false, 0)
+	}
+	for n, share := range firstShares(t, i, 20000) {
+		if math.Abs(share-1.0/3) > 0.02 {
+			t.Errorf("server %d first in %.3f of the orders, want 1/3", n, share)
+		}
+	}
+}
+
+func TestHealthyServersFavored(t *testing.T) {
+	i := weighted(1, 1, 1)
+	// server 0 fails, server 1 is slow
+	for n := 0; n < 20; n++ {
+		i.conns[0].stats.record(false, 0)
+		i.conns[1].stats.record(true, 100*time.Millisecond)
+		i.conns[2].stats.record(true, 10*time.Millisecond)
+	}
+
+	shares := firstShares(t, i, 20000)
+	if shares[2] < 0.8 || shares[2] <= shares[1] || shares[2] <= shares[0] {
+		t.Errorf("got first shares %v, want the fast server favored", shares)
+	}
+	// the failing server is still tried now and then to notice it's back
+	if shares[0] == 0 {
+		t.Error("failing server never tried first")
+	}
+
+	// back, its average recovers
+	for n := 0; n < 20; n++ {
+		i.conns[0].stats.record(true, 10*time.Millisecond)
+	}
+	shares = firstShares(t, i, 20000)
+	if math.Abs(shares[0]-shares[2]) > 0.05 {
+		t.Errorf("got first shares %v, want the recovered server chosen as often as the fast one", shares)
+	}
+}
+
+func TestWeightsInvalid(t *testing.T) {
+	i := newInfluxDB("http://localhost:8086", "http://localhost:8087")
+	i.Weights = []float64{1}
+	if err := i.Connect(); err == nil {
+		t.Error("weights of another count than the urls accepted")
+	}
+	i.Weights = []float64{1, 0}
+	if err := i.Connect(); err == nil {
+		t.Error("zero weight accepted")
+	}
+}
@@ -0,0 +1,52 @@
+package influxdb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/uber-go/zap"
+)
+
+// slowWrites logs the writes slower than SlowWriteThreshold, at most one
+// per SlowWriteLogInterval so a slow cluster doesn't flood the logs. The
+// slow writes not logged are counted in the next log.
+type slowWrites struct {
+	sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+// log logs the write of bp to url which took d, unless a slow write was
+// logged less than interval ago.
+func (s *slowWrites) log(url string, bp client.BatchPoints, d time.Duration, err error, interval time.Duration) {
+	s.Lock()
+	if !s.last.IsZero() && time.Since(s.last) < interval {
+		s.suppressed++
+		s.Unlock()
+		return
+	}
+	s.last = time.Now()
+	suppressed := s.suppressed
+	s.suppressed = 0
+	s.Unlock()
+
+	// the size of the payload is only worth computing for the logged ones
+	size := 0
+	for _, pt := range bp.Points() {
+		size += len(pt.PrecisionString(bp.Precision())) + 1
+	}
+
+	fields := []zap.Field{
+		zap.String("url", url),
+		zap.Int("points", len(bp.Points())),
+		zap.Int("bytes", size),
+		zap.Duration("duration", d),
+		zap.Int("suppressed", suppressed),
+	}
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+	service.VLogger.Warn("InfluxDB slow write", fields...)
+}
@@ -0,0 +1,161 @@
+package influxdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+// logBuffer collects the log entries of the output.
+type logBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+// slowWrites returns the slow write entries logged.
+func (b *logBuffer) slowWrites(t *testing.T) []map[string]interface{} {
+	b.Lock()
+	defer b.Unlock()
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["msg"] == "InfluxDB slow write" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// captureLogs sends the logs to the returned buffer until the returned func
+// is called.
+func captureLogs() (*logBuffer, func()) {
+	b := &logBuffer{}
+	logger := service.VLogger
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(b)))
+	return b, func() { service.VLogger = logger }
+}
+
+// slowServer is an InfluxDB taking delay to answer the writes, the size
+// of the last write is stored in size.
+func slowServer(delay time.Duration, size *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/write") {
+			body, _ := ioutil.ReadAll(r.Body)
+			atomic.StoreInt64(size, int64(len(body)))
+			time.Sleep(delay)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+func TestSlowWriteLogged(t *testing.T) {
+	var size int64
+	slow := slowServer(50*time.Millisecond, &size)
+	defer slow.Close()
+	logs, restore := captureLogs()
+	defer restore()
+
+	i := newInfluxDB(slow.URL)
+	i.SlowWriteThreshold = misc.Duration{Duration: 20 * time.Millisecond}
+	connect(t, i)
+	if err := i.Write(partialMetrics()); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := logs.slowWrites(t)
+	if len(entries) != 1 {
+		t.Fatalf("got %d slow writes logged, want 1", len(entries))
+	}
+	e := entries[0]
+	if e["url"] != slow.URL || e["points"] != 3.0 || e["duration"].(float64) < float64(20*time.Millisecond) {
+		t.Errorf("got entry %v, want the url, the points and the duration", e)
+	}
+	// the size of the line protocol payload
+	if e["bytes"] != float64(atomic.LoadInt64(&size)) {
+		t.Errorf("got %v bytes, want %d", e["bytes"], atomic.LoadInt64(&size))
+	}
+}
+
+func TestFastWriteNotLogged(t *testing.T) {
+	var size int64
+	fast := slowServer(0, &size)
+	defer fast.Close()
+	logs, restore := captureLogs()
+	defer restore()
+
+	i := newInfluxDB(fast.URL)
+	i.SlowWriteThreshold = misc.Duration{Duration: time.Second}
+	connect(t, i)
+	if err := i.Write(partialMetrics()); err != nil {
+		t.Fatal(err)
+	}
+	if entries := logs.slowWrites(t); len(entries) != 0 {
+		t.Errorf("got slow writes %v logged for a fast write", entries)
+	}
+
+	// disabled without threshold
+	slow := slowServer(20*time.Millisecond, &size)
+	defer slow.Close()
+	i = connect(t, newInfluxDB(slow.URL))
+	if err := i.Write(partialMetrics()); err != nil {
+		t.Fatal(err)
+	}
+	if entries := logs.slowWrites(t); len(entries) != 0 {
+		t.Errorf("got slow writes %v logged without threshold", entries)
+	}
+}
+
+func TestSlowWriteSampled(t *testing.T) {
+	var size int64
+	slow := slowServer(20*time.Millisecond, &size)
+	defer slow.Close()
+	logs, restore := captureLogs()
+	defer restore()
+
+	i := newInfluxDB(slow.URL)
+	i.SlowWriteThreshold = misc.Duration{Duration: 10 * time.Millisecond}
+	connect(t, i)
+	for n := 0; n < 3; n++ {
+		if err := i.Write(partialMetrics()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries := logs.slowWrites(t); len(entries) != 1 {
+		t.Fatalf("got %d slow writes logged within the interval, want 1", len(entries))
+	}
+
+	// the next one logged counts the ones suppressed
+	i.slow.Lock()
+	i.slow.last = i.slow.last.Add(-time.Minute)
+	i.slow.Unlock()
+	if err := i.Write(partialMetrics()); err != nil {
+		t.Fatal(err)
+	}
+	entries := logs.slowWrites(t)
+	if len(entries) != 2 || entries[1]["suppressed"] != 2.0 {
+		t.Errorf("got slow writes %v, want the 2 suppressed counted", entries)
+	}
+}
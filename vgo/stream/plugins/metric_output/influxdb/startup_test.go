@@ -0,0 +1,44 @@
+package influxdb
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestStartupTest(t *testing.T) {
+	s := newMockServer()
+	defer s.Close()
+
+	i := newInfluxDB(s.URL)
+	i.StartupTest = true
+	stop := make(chan bool, 1)
+	i.Init(stop)
+
+	select {
+	case <-stop:
+		t.Fatal("plugin stopped after a successful startup test")
+	default:
+	}
+	writes := s.received()
+	if len(writes) != 1 || len(writes[0].lines) != 1 || !strings.HasPrefix(writes[0].lines[0], "vgo_heartbeat,host=") {
+		t.Errorf("got writes %v, want the heartbeat point", writes)
+	}
+}
+
+func TestStartupTestFailure(t *testing.T) {
+	s := newMockServer()
+	defer s.Close()
+	s.setWriteAnswer(http.StatusForbidden, `{"error":"not authorized"}`)
+
+	i := newInfluxDB(s.URL)
+	i.StartupTest = true
+	stop := make(chan bool, 1)
+	i.Init(stop)
+
+	select {
+	case <-stop:
+	default:
+		t.Error("plugin not stopped after a failed startup test")
+	}
+}
@@ -0,0 +1,54 @@
+package influxdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+func TestTagIncludeExclude(t *testing.T) {
+	for _, tt := range []struct {
+		include, exclude []string
+		want             string
+	}{
+		{nil, nil, "cpu,host=a,rack=r1,region=eu,request_id=42 value=1 1000000000"},
+		{[]string{"host", "r*"}, nil, "cpu,host=a,rack=r1,region=eu,request_id=42 value=1 1000000000"},
+		{nil, []string{"request_*"}, "cpu,host=a,rack=r1,region=eu value=1 1000000000"},
+		// include first, then exclude
+		{[]string{"r*"}, []string{"request_id"}, "cpu,rack=r1,region=eu value=1 1000000000"},
+		{[]string{"zone"}, nil, "cpu value=1 1000000000"},
+	} {
+		s := newMockServer()
+		i := newInfluxDB(s.URL)
+		i.TagInclude, i.TagExclude = tt.include, tt.exclude
+		connect(t, i)
+
+		metric := &service.MetricData{
+			Name:   "cpu",
+			Tags:   map[string]string{"host": "a", "region": "eu", "request_id": "42", "rack": "r1"},
+			Fields: map[string]interface{}{"value": 1.0},
+			Time:   time.Unix(1, 0),
+		}
+		if err := i.Write(service.Metrics{Data: []*service.MetricData{metric}}); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+
+		writes := s.received()
+		if len(writes) != 1 || writes[0].lines[0] != tt.want {
+			t.Errorf("include %v, exclude %v, got writes %v, want %s", tt.include, tt.exclude, writes, tt.want)
+		}
+		if len(metric.Tags) != 4 {
+			t.Errorf("include %v, exclude %v, shared metric tags modified, %v", tt.include, tt.exclude, metric.Tags)
+		}
+	}
+}
+
+func TestTagFilterInvalid(t *testing.T) {
+	i := newInfluxDB("http://localhost:8086")
+	i.TagExclude = []string{"[a"}
+	if err := i.Connect(); err == nil {
+		t.Error("invalid tag_exclude glob accepted")
+	}
+}
@@ -0,0 +1,129 @@
+package influxdb
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// readDatagrams reads the datagrams received by conn until none arrives
+// for a while.
+func readDatagrams(t *testing.T, conn *net.UDPConn) []string {
+	var datagrams []string
+	buf := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				return datagrams
+			}
+			t.Fatal(err)
+		}
+		datagrams = append(datagrams, string(buf[:n]))
+	}
+}
+
+func TestUDPPayloadSplit(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	i := newInfluxDB("udp://" + conn.LocalAddr().String())
+	i.UDPPayload = 200
+	connect(t, i)
+	defer i.Close()
+
+	metrics := service.Metrics{}
+	for n := 0; n < 50; n++ {
+		metrics.Data = append(metrics.Data, &service.MetricData{
+			Name:   "cpu",
+			Tags:   map[string]string{"host": fmt.Sprintf("server%02d", n)},
+			Fields: map[string]interface{}{"value": float64(n)},
+			Time:   time.Unix(1500000000, 0),
+		})
+	}
+	// larger than the payload, it's dropped rather than truncated
+	metrics.Data = append(metrics.Data, &service.MetricData{
+		Name:   "cpu",
+		Tags:   map[string]string{"host": strings.Repeat("x", 300)},
+		Fields: map[string]interface{}{"value": 1.0},
+		Time:   time.Unix(1500000000, 0),
+	})
+	if err := i.Write(metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	datagrams := readDatagrams(t, conn)
+	if len(datagrams) < 2 {
+		t.Fatalf("%d datagrams, the points aren't split", len(datagrams))
+	}
+	var lines []string
+	for _, d := range datagrams {
+		if len(d) > i.UDPPayload {
+			t.Errorf("datagram of %d bytes over the payload of %d", len(d), i.UDPPayload)
+		}
+		if !strings.HasSuffix(d, "\n") {
+			t.Errorf("datagram doesn't end a point, %q", d)
+		}
+		lines = append(lines, strings.Split(strings.TrimSuffix(d, "\n"), "\n")...)
+	}
+	if len(lines) != 50 {
+		t.Fatalf("got %d points, want 50", len(lines))
+	}
+	for n, line := range lines {
+		want := fmt.Sprintf("cpu,host=server%02d value=%d 1500000000000000000", n, n)
+		if line != want {
+			t.Errorf("point %d split or reordered, got %q, want %q", n, line, want)
+		}
+	}
+}
+
+// failingClient fails the first write of datagrams
+type failingClient struct {
+	client.Client
+	writes int
+}
+
+func (c *failingClient) Write(bp client.BatchPoints) error {
+	c.writes++
+	if c.writes == 1 {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestUDPWriteFailure(t *testing.T) {
+	i := newInfluxDB("udp://127.0.0.1:8089")
+	i.UDPPayload = 200
+	i.precision = "ns"
+
+	bp, err := i.newBatchPoints("test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 50; n++ {
+		pt, err := client.NewPoint("cpu", map[string]string{"host": fmt.Sprintf("server%02d", n)}, map[string]interface{}{"value": float64(n)}, time.Unix(1500000000, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bp.AddPoint(pt)
+	}
+
+	// the failed first datagram fails the write, so it's retried
+	c := &failingClient{}
+	if err := i.writeUDP(&conn{Client: c, udp: true}, bp); err == nil {
+		t.Error("failed datagram reported written")
+	}
+	if c.writes < 3 {
+		t.Errorf("got %d datagrams, want the others written", c.writes)
+	}
+}
@@ -0,0 +1,297 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/uber-go/zap"
+)
+
+type MQTT struct {
+	Servers []string
+	// Topic is a text/template of the metric: {{.Name}} and {{.Tags.host}}
+	Topic    string
+	QoS      int `toml:"qos"`
+	Retain   bool
+	Username string
+	Password string
+	ClientID string `toml:"client_id"`
+	// Batch publishes the metrics of a topic in one message
+	Batch bool
+	// MaxQueued is the number of messages kept while the broker is
+	// unreachable, the oldest ones are dropped over it
+	MaxQueued int
+	Timeout   misc.Duration
+
+	SSLCA              string `toml:"ssl_ca"`
+	SSLCert            string `toml:"ssl_cert"`
+	SSLKey             string `toml:"ssl_key"`
+	InsecureSkipVerify bool
+
+	client     paho.Client
+	topic      *template.Template
+	serializer service.Serializer
+
+	sync.Mutex
+	queue []*message
+}
+
+// message is a serialized payload waiting for its topic
+type message struct {
+	topic   string
+	payload []byte
+}
+
+var sampleConfig = `
+  servers = ["tcp://localhost:1883"]
+  ## Template of the topic, the metric name is {{.Name}} and a tag {{.Tags.host}}
+  topic = "vgo/{{.Tags.host}}/{{.Name}}"
+  ## QoS of the published messages: 0, 1 or 2
+  qos = 0
+  # retain = false
+  # username = ""
+  # password = ""
+  # client_id = "vgo"
+  ## Publish the metrics of a topic in one message instead of one per metric
+  # batch = false
+  ## Messages kept while the broker is unreachable
+  # max_queued = 10000
+  # timeout = "5s"
+
+  ## Optional SSL Config
+  # ssl_ca = "/etc/vgo/ca.pem"
+  # ssl_cert = "/etc/vgo/cert.pem"
+  # ssl_key = "/etc/vgo/key.pem"
+  ## Use SSL but skip chain & host verification
+  # insecure_skip_verify = false
+
+  ## Data format of the messages: "influx", "json", "ndjson"
+  # data_format = "influx"
+  ## Unit of the json and ndjson timestamps: "1s", "1ms", "1us" or "1ns"
+  # json_timestamp_units = "1s"
+`
+
+func (m *MQTT) SetSerializer(serializer service.Serializer) {
+	m.serializer = serializer
+}
+
+func (m *MQTT) Connect() error {
+	if len(m.Servers) == 0 {
+		return errors.New("servers are required")
+	}
+	if m.QoS < 0 || m.QoS > 2 {
+		return fmt.Errorf("invalid qos %d", m.QoS)
+	}
+
+	topic, err := parseTopic(m.Topic)
+	if err != nil {
+		return err
+	}
+	m.topic = topic
+
+	opts := paho.NewClientOptions()
+	for _, server := range m.Servers {
+		opts.AddBroker(server)
+	}
+	if m.ClientID == "" {
+		m.ClientID = "vgo-" + misc.RandomString(8)
+	}
+	opts.SetClientID(m.ClientID)
+	opts.SetUsername(m.Username)
+	opts.SetPassword(m.Password)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectTimeout(m.Timeout.Duration)
+
+	tlsConfig, err := misc.GetTLSConfig(m.SSLCert, m.SSLKey, m.SSLCA, m.InsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	opts.SetConnectionLostHandler(func(c paho.Client, err error) {
+		service.VLogger.Warn("MQTT connection lost", zap.Error(err))
+	})
+	opts.SetOnConnectHandler(func(c paho.Client) {
+		m.flushQueue()
+	})
+
+	m.client = paho.NewClient(opts)
+	token := m.client.Connect()
+	if !token.WaitTimeout(m.Timeout.Duration) {
+		return errors.New("connect timeout")
+	}
+	return token.Error()
+}
+
+func (m *MQTT) Close() error {
+	if m.client != nil {
+		m.client.Disconnect(uint(m.Timeout.Duration / time.Millisecond))
+	}
+	return nil
+}
+
+// parseTopic compiles the topic template, a missing tag is an empty string.
+func parseTopic(topic string) (*template.Template, error) {
+	if topic == "" {
+		return nil, errors.New("topic is required")
+	}
+	t, err := template.New("topic").Option("missingkey=zero").Parse(topic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid topic %s, %s", topic, err)
+	}
+	return t, nil
+}
+
+// topicOf renders the topic of the metric.
+func topicOf(t *template.Template, metric *service.MetricData) (string, error) {
+	var b bytes.Buffer
+	if err := t.Execute(&b, metric); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Write publishes the metrics, one message per metric or with Batch one
+// message per topic. While the broker is unreachable the messages are
+// queued and published on reconnect.
+func (m *MQTT) Write(metrics service.Metrics) error {
+	msgs, err := m.messages(metrics)
+	if err != nil {
+		return err
+	}
+
+	if !m.client.IsConnected() {
+		m.enqueue(msgs)
+		return nil
+	}
+
+	for i, msg := range msgs {
+		if err := m.publish(msg); err != nil {
+			if !m.client.IsConnected() {
+				m.enqueue(msgs[i:])
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MQTT) messages(metrics service.Metrics) ([]*message, error) {
+	var msgs []*message
+	if !m.Batch {
+		for _, metric := range metrics.Data {
+			topic, err := topicOf(m.topic, metric)
+			if err != nil {
+				return nil, err
+			}
+			payload, err := m.serializer.Serialize(metric)
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, &message{topic: topic, payload: payload})
+		}
+		return msgs, nil
+	}
+
+	// group by topic keeping the order of the first metric of each topic
+	var topics []string
+	batches := make(map[string]*service.Metrics)
+	for _, metric := range metrics.Data {
+		topic, err := topicOf(m.topic, metric)
+		if err != nil {
+			return nil, err
+		}
+		batch, ok := batches[topic]
+		if !ok {
+			batch = &service.Metrics{Interval: metrics.Interval}
+			batches[topic] = batch
+			topics = append(topics, topic)
+		}
+		batch.Data = append(batch.Data, metric)
+	}
+	for _, topic := range topics {
+		payload, err := m.serializer.SerializeBatch(*batches[topic])
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, &message{topic: topic, payload: payload})
+	}
+	return msgs, nil
+}
+
+func (m *MQTT) publish(msg *message) error {
+	token := m.client.Publish(msg.topic, byte(m.QoS), m.Retain, msg.payload)
+	if !token.WaitTimeout(m.Timeout.Duration) {
+		return fmt.Errorf("publish to %s timeout", msg.topic)
+	}
+	return token.Error()
+}
+
+// enqueue keeps the messages for the reconnect, dropping the oldest ones
+// over MaxQueued.
+func (m *MQTT) enqueue(msgs []*message) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.queue = append(m.queue, msgs...)
+	if over := len(m.queue) - m.MaxQueued; over > 0 {
+		service.VLogger.Warn("MQTT offline queue full, messages dropped", zap.Int("dropped", over))
+		m.queue = append(m.queue[:0], m.queue[over:]...)
+	}
+}
+
+// flushQueue publishes the messages queued while the broker was unreachable.
+func (m *MQTT) flushQueue() {
+	m.Lock()
+	queue := m.queue
+	m.queue = nil
+	m.Unlock()
+
+	if len(queue) == 0 {
+		return
+	}
+	service.VLogger.Info("MQTT reconnected, publishing the queued messages", zap.Int("messages", len(queue)))
+
+	// publish in the background, the client handlers mustn't block
+	go func() {
+		for i, msg := range queue {
+			if err := m.publish(msg); err != nil {
+				service.VLogger.Error("MQTT publish queued message", zap.Error(err))
+				m.enqueue(queue[i:])
+				return
+			}
+		}
+	}()
+}
+
+func (m *MQTT) Init(stop chan bool) {
+	if err := m.Connect(); err != nil {
+		log.Fatal("MQTT Connect failed, err message is ", err)
+	}
+}
+
+func (m *MQTT) Start() {
+
+}
+
+func (m *MQTT) Compute(metrics service.Metrics) error {
+	return m.Write(metrics)
+}
+
+func init() {
+	service.AddMetricOutput("mqtt", &MQTT{
+		MaxQueued: 10000,
+		Timeout:   misc.Duration{Duration: 5 * time.Second},
+	})
+}
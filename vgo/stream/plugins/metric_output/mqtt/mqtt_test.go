@@ -0,0 +1,116 @@
+package mqtt
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+// nameSerializer serializes the metrics as their host tags.
+type nameSerializer struct{}
+
+func (nameSerializer) Serialize(m *service.MetricData) ([]byte, error) {
+	return []byte(m.Tags["host"]), nil
+}
+
+func (nameSerializer) SerializeBatch(metrics service.Metrics) ([]byte, error) {
+	var hosts []string
+	for _, m := range metrics.Data {
+		hosts = append(hosts, m.Tags["host"])
+	}
+	return []byte(strings.Join(hosts, ",")), nil
+}
+
+func TestTopic(t *testing.T) {
+	metric := &service.MetricData{
+		Name: "cpu",
+		Tags: map[string]string{"host": "web01", "site": "paris"},
+	}
+	for _, tt := range []struct {
+		topic string
+		want  string
+	}{
+		{"vgo/{{.Tags.host}}/{{.Name}}", "vgo/web01/cpu"},
+		{"{{.Tags.site}}/{{.Tags.host}}/metrics", "paris/web01/metrics"},
+		{"vgo/metrics", "vgo/metrics"},
+		// a missing tag is empty
+		{"vgo/{{.Tags.rack}}/{{.Name}}", "vgo//cpu"},
+	} {
+		tmpl, err := parseTopic(tt.topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := topicOf(tmpl, metric)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s, got %s, want %s", tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestTopicInvalid(t *testing.T) {
+	for _, topic := range []string{"", "vgo/{{.Tags.host"} {
+		if _, err := parseTopic(topic); err == nil {
+			t.Errorf("topic %q accepted", topic)
+		}
+	}
+}
+
+func TestMessages(t *testing.T) {
+	topic, err := parseTopic("vgo/{{.Tags.site}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := service.Metrics{Data: []*service.MetricData{
+		{Name: "cpu", Tags: map[string]string{"host": "a", "site": "paris"}},
+		{Name: "cpu", Tags: map[string]string{"host": "b", "site": "london"}},
+		{Name: "cpu", Tags: map[string]string{"host": "c", "site": "paris"}},
+	}}
+
+	for _, tt := range []struct {
+		batch bool
+		want  []message
+	}{
+		{false, []message{{"vgo/paris", []byte("a")}, {"vgo/london", []byte("b")}, {"vgo/paris", []byte("c")}}},
+		// a message per topic in the order of their first metric
+		{true, []message{{"vgo/paris", []byte("a,c")}, {"vgo/london", []byte("b")}}},
+	} {
+		m := &MQTT{Batch: tt.batch, topic: topic, serializer: nameSerializer{}}
+		msgs, err := m.messages(metrics)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []message
+		for _, msg := range msgs {
+			got = append(got, *msg)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("batch %v, got %q, want %q", tt.batch, got, tt.want)
+		}
+	}
+}
+
+func TestEnqueue(t *testing.T) {
+	m := &MQTT{MaxQueued: 3}
+	m.enqueue([]*message{{topic: "1"}, {topic: "2"}})
+	m.enqueue([]*message{{topic: "3"}, {topic: "4"}, {topic: "5"}})
+
+	// the oldest messages are dropped over the cap
+	var topics []string
+	for _, msg := range m.queue {
+		topics = append(topics, msg.topic)
+	}
+	if !reflect.DeepEqual(topics, []string{"3", "4", "5"}) {
+		t.Errorf("got queue %v", topics)
+	}
+}
@@ -0,0 +1,137 @@
+package otlp
+
+import (
+	"math"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// The export request is encoded by hand, following the OTLP metrics
+// messages (opentelemetry/proto/collector/metrics/v1, metrics/v1, common/v1):
+//
+//   ExportMetricsServiceRequest { repeated ResourceMetrics resource_metrics = 1; }
+//   ResourceMetrics { Resource resource = 1; repeated ScopeMetrics scope_metrics = 2; }
+//   Resource { repeated KeyValue attributes = 1; }
+//   ScopeMetrics { InstrumentationScope scope = 1; repeated Metric metrics = 2; }
+//   InstrumentationScope { string name = 1; string version = 2; }
+//   Metric { string name = 1; Gauge gauge = 5; Sum sum = 7; }
+//   Gauge { repeated NumberDataPoint data_points = 1; }
+//   Sum { repeated NumberDataPoint data_points = 1;
+//         AggregationTemporality aggregation_temporality = 2; bool is_monotonic = 3; }
+//   NumberDataPoint { fixed64 time_unix_nano = 3; double as_double = 4;
+//                     sfixed64 as_int = 6; repeated KeyValue attributes = 7; }
+//   KeyValue { string key = 1; AnyValue value = 2; }
+//   AnyValue { string string_value = 1; }
+
+const (
+	scopeName = "vgo"
+	// temporalityCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE
+	temporalityCumulative = 2
+)
+
+// metric is an OTLP metric, a gauge or a monotonic cumulative sum
+type metric struct {
+	name   string
+	sum    bool
+	points []*point
+}
+
+// point is a NumberDataPoint, an int or a double
+type point struct {
+	attributes map[string]string
+	timeNano   uint64
+	isInt      bool
+	intValue   int64
+	value      float64
+}
+
+func encodeRequest(resource map[string]string, metrics []*metric) []byte {
+	b := proto.NewBuffer(nil)
+	encodeField(b, 1, encodeResourceMetrics(resource, metrics))
+	return b.Bytes()
+}
+
+func encodeResourceMetrics(resource map[string]string, metrics []*metric) []byte {
+	res := proto.NewBuffer(nil)
+	encodeAttributes(res, 1, resource)
+
+	scope := proto.NewBuffer(nil)
+	scope.EncodeVarint(1<<3 | proto.WireBytes)
+	scope.EncodeStringBytes(scopeName)
+
+	sm := proto.NewBuffer(nil)
+	encodeField(sm, 1, scope.Bytes())
+	for _, m := range metrics {
+		encodeField(sm, 2, encodeMetric(m))
+	}
+
+	b := proto.NewBuffer(nil)
+	encodeField(b, 1, res.Bytes())
+	encodeField(b, 2, sm.Bytes())
+	return b.Bytes()
+}
+
+func encodeMetric(m *metric) []byte {
+	data := proto.NewBuffer(nil)
+	for _, p := range m.points {
+		encodeField(data, 1, encodePoint(p))
+	}
+
+	b := proto.NewBuffer(nil)
+	b.EncodeVarint(1<<3 | proto.WireBytes)
+	b.EncodeStringBytes(m.name)
+	if m.sum {
+		data.EncodeVarint(2<<3 | proto.WireVarint)
+		data.EncodeVarint(temporalityCumulative)
+		data.EncodeVarint(3<<3 | proto.WireVarint)
+		data.EncodeVarint(1)
+		encodeField(b, 7, data.Bytes())
+	} else {
+		encodeField(b, 5, data.Bytes())
+	}
+	return b.Bytes()
+}
+
+func encodePoint(p *point) []byte {
+	b := proto.NewBuffer(nil)
+	b.EncodeVarint(3<<3 | proto.WireFixed64)
+	b.EncodeFixed64(p.timeNano)
+	if p.isInt {
+		b.EncodeVarint(6<<3 | proto.WireFixed64)
+		b.EncodeFixed64(uint64(p.intValue))
+	} else {
+		b.EncodeVarint(4<<3 | proto.WireFixed64)
+		b.EncodeFixed64(math.Float64bits(p.value))
+	}
+	encodeAttributes(b, 7, p.attributes)
+	return b.Bytes()
+}
+
+// encodeAttributes appends the attributes as string KeyValues, sorted by key.
+func encodeAttributes(b *proto.Buffer, field uint64, attributes map[string]string) {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		value := proto.NewBuffer(nil)
+		value.EncodeVarint(1<<3 | proto.WireBytes)
+		value.EncodeStringBytes(attributes[k])
+
+		kv := proto.NewBuffer(nil)
+		kv.EncodeVarint(1<<3 | proto.WireBytes)
+		kv.EncodeStringBytes(k)
+		encodeField(kv, 2, value.Bytes())
+
+		encodeField(b, field, kv.Bytes())
+	}
+}
+
+// encodeField appends a length delimited field.
+func encodeField(b *proto.Buffer, field uint64, v []byte) {
+	b.EncodeVarint(field<<3 | proto.WireBytes)
+	b.EncodeRawBytes(v)
+}
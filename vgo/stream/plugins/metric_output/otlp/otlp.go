@@ -0,0 +1,333 @@
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	exportMethod = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	httpPath     = "/v1/metrics"
+)
+
+// OTLP exports the metrics to an OpenTelemetry collector. Every numeric
+// field is an OTLP metric named <metric>.<field>, a gauge or with SumFields
+// a monotonic cumulative sum, whose data point has the tags as attributes.
+type OTLP struct {
+	// Endpoint is host:port with gRPC, the collector URL with HTTP
+	Endpoint string
+	// Protocol can be "grpc" or "http"
+	Protocol string
+	// Headers are sent with every export, for the authentication
+	Headers map[string]string
+	// Compression can be "gzip" or empty
+	Compression string
+	Timeout     misc.Duration
+	// ResourceAttributes describe vgo in the collector: service.name
+	ResourceAttributes map[string]string
+	// SumFields are the fields exported as monotonic sums, globs are supported
+	SumFields []string
+
+	SSLCA              string `toml:"ssl_ca"`
+	SSLCert            string `toml:"ssl_cert"`
+	SSLKey             string `toml:"ssl_key"`
+	InsecureSkipVerify bool
+	// Insecure connects to a gRPC collector without TLS
+	Insecure bool
+
+	conn      *grpc.ClientConn
+	client    *http.Client
+	sumFilter service.Filter
+}
+
+var sampleConfig = `
+  ## host:port with gRPC, the collector URL with HTTP
+  endpoint = "localhost:4317"
+  ## "grpc" or "http"
+  # protocol = "grpc"
+  ## "gzip" or ""
+  # compression = ""
+  # timeout = "10s"
+  ## Fields exported as monotonic sums, the others are gauges
+  # sum_fields = ["*_total"]
+  ## Connect to a gRPC collector without TLS
+  # insecure = false
+
+  ## Optional SSL Config
+  # ssl_ca = "/etc/vgo/ca.pem"
+  # ssl_cert = "/etc/vgo/cert.pem"
+  # ssl_key = "/etc/vgo/key.pem"
+  # insecure_skip_verify = false
+
+  ## Sent with every export
+  # [metric_outputs.otlp.headers]
+  #   authorization = "Bearer xxx"
+
+  # [metric_outputs.otlp.resource_attributes]
+  #   "service.name" = "vgo"
+`
+
+// rawCodec sends the hand encoded requests as is
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("raw codec can't marshal %T", v)
+	}
+	return *b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("raw codec can't unmarshal %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (rawCodec) String() string {
+	return "proto"
+}
+
+func (o *OTLP) Connect() error {
+	if o.Endpoint == "" {
+		return errors.New("endpoint is required")
+	}
+	if o.Compression != "" && o.Compression != "gzip" {
+		return fmt.Errorf("invalid compression %s", o.Compression)
+	}
+
+	if o.ResourceAttributes == nil {
+		o.ResourceAttributes = map[string]string{"service.name": "vgo"}
+	}
+
+	filter, err := service.CompileFilter(o.SumFields)
+	if err != nil {
+		return err
+	}
+	o.sumFilter = filter
+
+	tlsConfig, err := misc.GetTLSConfig(o.SSLCert, o.SSLKey, o.SSLCA, o.InsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+
+	switch o.Protocol {
+	case "http":
+		o.client = &http.Client{
+			Timeout: o.Timeout.Duration,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		}
+		return nil
+	case "grpc":
+		opts := []grpc.DialOption{grpc.WithCodec(rawCodec{})}
+		switch {
+		case o.Insecure:
+			opts = append(opts, grpc.WithInsecure())
+		case tlsConfig != nil:
+			opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+		default:
+			opts = append(opts, grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, "")))
+		}
+		if o.Compression == "gzip" {
+			opts = append(opts, grpc.WithCompressor(grpc.NewGZIPCompressor()))
+		}
+		conn, err := grpc.Dial(o.Endpoint, opts...)
+		if err != nil {
+			return err
+		}
+		o.conn = conn
+		return nil
+	default:
+		return fmt.Errorf("invalid protocol %s", o.Protocol)
+	}
+}
+
+func (o *OTLP) Close() error {
+	if o.conn != nil {
+		return o.conn.Close()
+	}
+	return nil
+}
+
+// Write exports the metrics in one request.
+func (o *OTLP) Write(metrics service.Metrics) error {
+	return o.WriteContext(context.Background(), metrics)
+}
+
+// WriteContext is Write aborted when ctx is done.
+func (o *OTLP) WriteContext(ctx context.Context, metrics service.Metrics) error {
+	converted := o.convert(metrics.Data)
+	if len(converted) == 0 {
+		return nil
+	}
+	req := encodeRequest(o.ResourceAttributes, converted)
+
+	if o.conn != nil {
+		return o.exportGRPC(ctx, req)
+	}
+	return o.exportHTTP(ctx, req)
+}
+
+func (o *OTLP) exportGRPC(ctx context.Context, req []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, o.Timeout.Duration)
+	defer cancel()
+	if len(o.Headers) > 0 {
+		ctx = metadata.NewContext(ctx, metadata.New(o.Headers))
+	}
+
+	var resp []byte
+	return grpc.Invoke(ctx, exportMethod, &req, &resp, o.conn)
+}
+
+func (o *OTLP) exportHTTP(ctx context.Context, req []byte) error {
+	body := req
+	if o.Compression == "gzip" {
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		if _, err := w.Write(req); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		body = b.Bytes()
+	}
+
+	url := strings.TrimRight(o.Endpoint, "/") + httpPath
+	r, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	if o.Compression == "gzip" {
+		r.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range o.Headers {
+		r.Header.Set(k, v)
+	}
+
+	resp, err := o.client.Do(r.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("status %d, %s", resp.StatusCode, string(b))
+	}
+	return nil
+}
+
+// convert maps every numeric field to a data point of the metric
+// <metric>.<field>, the non numeric fields are dropped.
+func (o *OTLP) convert(data []*service.MetricData) []*metric {
+	var list []*metric
+	byName := make(map[string]*metric)
+
+	for _, m := range data {
+		keys := make([]string, 0, len(m.Fields))
+		for k := range m.Fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			p, ok := newPoint(m.Fields[k])
+			if !ok {
+				service.VLogger.Debug("OTLP non numeric field dropped",
+					zap.String("metric", m.Name),
+					zap.String("field", k),
+				)
+				continue
+			}
+			p.attributes = m.Tags
+			p.timeNano = uint64(m.Time.UnixNano())
+
+			name := m.Name + "." + k
+			om, ok := byName[name]
+			if !ok {
+				om = &metric{
+					name: name,
+					sum:  o.sumFilter != nil && o.sumFilter.Match(k),
+				}
+				byName[name] = om
+				list = append(list, om)
+			}
+			om.points = append(om.points, p)
+		}
+	}
+	return list
+}
+
+func newPoint(v interface{}) (*point, bool) {
+	switch t := v.(type) {
+	case int:
+		return &point{isInt: true, intValue: int64(t)}, true
+	case int32:
+		return &point{isInt: true, intValue: int64(t)}, true
+	case int64:
+		return &point{isInt: true, intValue: t}, true
+	case uint64:
+		return &point{isInt: true, intValue: int64(t)}, true
+	case float32:
+		return &point{value: float64(t)}, true
+	case float64:
+		return &point{value: t}, true
+	case bool:
+		if t {
+			return &point{isInt: true, intValue: 1}, true
+		}
+		return &point{isInt: true}, true
+	default:
+		return nil, false
+	}
+}
+
+func (o *OTLP) Init(stop chan bool) {
+	if err := o.Connect(); err != nil {
+		log.Fatal("OTLP Connect failed, err message is ", err)
+	}
+}
+
+func (o *OTLP) Start() {
+
+}
+
+// ComputeContext writes the metrics, aborted when ctx is done.
+func (o *OTLP) ComputeContext(ctx context.Context, metrics service.Metrics) error {
+	return o.WriteContext(ctx, metrics)
+}
+
+func (o *OTLP) Compute(metrics service.Metrics) error {
+	return o.Write(metrics)
+}
+
+func init() {
+	service.AddMetricOutput("otlp", &OTLP{
+		Protocol: "grpc",
+		Timeout:  misc.Duration{Duration: 10 * time.Second},
+	})
+}
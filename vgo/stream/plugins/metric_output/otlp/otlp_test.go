@@ -0,0 +1,212 @@
+package otlp
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/golang/protobuf/proto"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+func newOTLP(t *testing.T, endpoint string) *OTLP {
+	o := &OTLP{Endpoint: endpoint, Protocol: "http", SumFields: []string{"*_total"}}
+	if err := o.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+var testData = []*service.MetricData{
+	{
+		Name:   "http",
+		Tags:   map[string]string{"host": "web01", "method": "GET"},
+		Fields: map[string]interface{}{"requests_total": int64(42), "latency": 0.25, "up": true, "state": "ok"},
+		Time:   time.Unix(1500000000, 5),
+	},
+	{
+		Name:   "http",
+		Tags:   map[string]string{"host": "web02"},
+		Fields: map[string]interface{}{"latency": float32(0.5)},
+		Time:   time.Unix(1500000001, 0),
+	},
+}
+
+func TestConvert(t *testing.T) {
+	o := newOTLP(t, "http://localhost:4318")
+	metrics := o.convert(testData)
+
+	web01 := map[string]string{"host": "web01", "method": "GET"}
+	web02 := map[string]string{"host": "web02"}
+	// a metric per field, the points of the field across the metrics, the
+	// string field is dropped
+	want := []*metric{
+		{name: "http.latency", points: []*point{
+			{attributes: web01, timeNano: 1500000000000000005, value: 0.25},
+			{attributes: web02, timeNano: 1500000001000000000, value: 0.5},
+		}},
+		{name: "http.requests_total", sum: true, points: []*point{
+			{attributes: web01, timeNano: 1500000000000000005, isInt: true, intValue: 42},
+		}},
+		{name: "http.up", points: []*point{
+			{attributes: web01, timeNano: 1500000000000000005, isInt: true, intValue: 1},
+		}},
+	}
+	if !reflect.DeepEqual(metrics, want) {
+		for i, m := range metrics {
+			t.Logf("metric %d %+v", i, *m)
+			for _, p := range m.points {
+				t.Logf("  %+v", *p)
+			}
+		}
+		t.Error("unexpected conversion")
+	}
+}
+
+// message is a decoded protobuf message, the values of its fields by number
+type message map[uint64][]interface{}
+
+// decode decodes the message, the length delimited fields are []byte, the
+// others uint64.
+func decode(t *testing.T, b []byte) message {
+	m := make(message)
+	buf := proto.NewBuffer(b)
+	for len(buf.Unread()) > 0 {
+		key, err := buf.DecodeVarint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v interface{}
+		switch key & 7 {
+		case proto.WireBytes:
+			v, err = buf.DecodeRawBytes(true)
+		case proto.WireVarint:
+			v, err = buf.DecodeVarint()
+		case proto.WireFixed64:
+			v, err = buf.DecodeFixed64()
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		m[key>>3] = append(m[key>>3], v)
+	}
+	return m
+}
+
+func (m message) msg(t *testing.T, field uint64, i int) message {
+	return decode(t, m[field][i].([]byte))
+}
+
+func (m message) str(field uint64) string {
+	return string(m[field][0].([]byte))
+}
+
+// attributes decodes the KeyValues of the field.
+func (m message) attributes(t *testing.T, field uint64) map[string]string {
+	attrs := make(map[string]string)
+	for i := range m[field] {
+		kv := m.msg(t, field, i)
+		attrs[kv.str(1)] = kv.msg(t, 2, 0).str(1)
+	}
+	return attrs
+}
+
+func TestExportHTTP(t *testing.T) {
+	var body []byte
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != httpPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		header = r.Header
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ = ioutil.ReadAll(gz)
+	}))
+	defer ts.Close()
+
+	o := &OTLP{
+		Endpoint:           ts.URL,
+		Protocol:           "http",
+		Compression:        "gzip",
+		Headers:            map[string]string{"Authorization": "Bearer secret"},
+		ResourceAttributes: map[string]string{"service.name": "vgo", "env": "prod"},
+		SumFields:          []string{"*_total"},
+	}
+	if err := o.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Write(service.Metrics{Data: testData[:1]}); err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Authorization") != "Bearer secret" || header.Get("Content-Type") != "application/x-protobuf" {
+		t.Errorf("got headers %v", header)
+	}
+
+	rm := decode(t, body).msg(t, 1, 0)
+	if attrs := rm.msg(t, 1, 0).attributes(t, 1); !reflect.DeepEqual(attrs, o.ResourceAttributes) {
+		t.Errorf("got resource attributes %v", attrs)
+	}
+	sm := rm.msg(t, 2, 0)
+	if scope := sm.msg(t, 1, 0).str(1); scope != "vgo" {
+		t.Errorf("got scope %s", scope)
+	}
+	if n := len(sm[2]); n != 3 {
+		t.Fatalf("got %d metrics, want 3", n)
+	}
+
+	latency := sm.msg(t, 2, 0)
+	if latency.str(1) != "http.latency" || latency[7] != nil {
+		t.Errorf("latency isn't a gauge, %v", latency)
+	}
+	p := latency.msg(t, 5, 0).msg(t, 1, 0)
+	if p[3][0].(uint64) != 1500000000000000005 {
+		t.Errorf("got time %v", p[3][0])
+	}
+	if v := math.Float64frombits(p[4][0].(uint64)); v != 0.25 {
+		t.Errorf("got value %v", v)
+	}
+	if attrs := p.attributes(t, 7); !reflect.DeepEqual(attrs, testData[0].Tags) {
+		t.Errorf("got attributes %v", attrs)
+	}
+
+	requests := sm.msg(t, 2, 1)
+	if requests.str(1) != "http.requests_total" || requests[5] != nil {
+		t.Fatalf("requests_total isn't a sum, %v", requests)
+	}
+	sum := requests.msg(t, 7, 0)
+	if sum[2][0].(uint64) != temporalityCumulative || sum[3][0].(uint64) != 1 {
+		t.Errorf("sum isn't cumulative and monotonic, %v", sum)
+	}
+	if v := int64(sum.msg(t, 1, 0)[6][0].(uint64)); v != 42 {
+		t.Errorf("got int value %d", v)
+	}
+}
+
+func TestConnectInvalid(t *testing.T) {
+	for _, o := range []*OTLP{
+		{Protocol: "http"},
+		{Endpoint: "localhost:4317", Protocol: "udp"},
+		{Endpoint: "localhost:4317", Protocol: "grpc", Compression: "zstd"},
+	} {
+		if err := o.Connect(); err == nil {
+			t.Errorf("config %+v accepted", o)
+		}
+	}
+}
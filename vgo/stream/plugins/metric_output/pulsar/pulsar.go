@@ -0,0 +1,370 @@
+package pulsar
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+	"golang.org/x/net/websocket"
+)
+
+// Pulsar produces the metrics to a topic through the websocket API of the
+// Pulsar brokers or proxy.
+type Pulsar struct {
+	// URL is the websocket service, ws:// or wss:// for TLS
+	URL string `toml:"url"`
+	// Topic is persistent://tenant/namespace/topic or
+	// non-persistent://tenant/namespace/topic, a short name is a persistent
+	// topic of public/default
+	Topic string
+	// RoutingTag is the tag whose value is the key of the messages, the
+	// messages of a key go to the same partition
+	RoutingTag string
+	// Token is the JWT of the token authentication
+	Token        string
+	ProducerName string
+
+	// Batching lets the broker side producer batch the messages
+	Batching                bool
+	BatchingMaxMessages     int
+	BatchingMaxPublishDelay misc.Duration
+
+	// MaxPendingMessages is the number of messages sent without their
+	// acknowledgement, the next ones wait for it
+	MaxPendingMessages int
+	// MaxRetries is the number of times the messages failing are sent
+	// again, waiting RetryInterval, before the write fails
+	MaxRetries    int
+	RetryInterval misc.Duration
+	Timeout       misc.Duration
+
+	SSLCA              string `toml:"ssl_ca"`
+	SSLCert            string `toml:"ssl_cert"`
+	SSLKey             string `toml:"ssl_key"`
+	InsecureSkipVerify bool
+
+	serializer service.Serializer
+	config     *websocket.Config
+
+	// the connection is reopened by the next write once closed
+	sync.Mutex
+	conn *websocket.Conn
+}
+
+// message is a message of the websocket producer API
+type message struct {
+	Payload []byte `json:"payload"`
+	Key     string `json:"key,omitempty"`
+	Context string `json:"context"`
+}
+
+// ack is the answer of the broker to a message, with the context of the
+// message
+type ack struct {
+	Result    string `json:"result"`
+	MessageID string `json:"messageId"`
+	ErrorMsg  string `json:"errorMsg"`
+	Context   string `json:"context"`
+}
+
+var sampleConfig = `
+  ## Websocket service of the brokers or proxy, wss:// for TLS
+  url = "ws://localhost:8080"
+  ## persistent://tenant/namespace/topic or non-persistent://tenant/namespace/topic,
+  ## a short name is a persistent topic of public/default
+  topic = "persistent://public/default/vgo"
+  ## Tag whose value is the key of the messages
+  # routing_tag = "host"
+  ## JWT of the token authentication
+  # token = ""
+  # producer_name = ""
+
+  ## Let the producer of the broker batch the messages
+  # batching = false
+  # batching_max_messages = 1000
+  # batching_max_publish_delay = "10ms"
+
+  ## Messages sent without their acknowledgement, the next ones wait for it
+  # max_pending_messages = 1000
+  ## Times the failed messages are sent again before the write fails
+  # max_retries = 3
+  # retry_interval = "1s"
+  # timeout = "10s"
+
+  ## Optional SSL Config, used by wss:// urls
+  # ssl_ca = "/etc/vgo/ca.pem"
+  # ssl_cert = "/etc/vgo/cert.pem"
+  # ssl_key = "/etc/vgo/key.pem"
+  # insecure_skip_verify = false
+
+  ## Data format of the messages: "influx", "json", "ndjson"
+  # data_format = "influx"
+  ## Unit of the json and ndjson timestamps: "1s", "1ms", "1us" or "1ns"
+  # json_timestamp_units = "1s"
+`
+
+func (p *Pulsar) SetSerializer(serializer service.Serializer) {
+	p.serializer = serializer
+}
+
+func (p *Pulsar) Connect() error {
+	if p.URL == "" {
+		return errors.New("url is required")
+	}
+	if p.MaxPendingMessages <= 0 {
+		return errors.New("max_pending_messages must be positive")
+	}
+	config, err := p.producerConfig()
+	if err != nil {
+		return err
+	}
+	p.config = config
+
+	p.Lock()
+	defer p.Unlock()
+	return p.connect()
+}
+
+// producerConfig builds the websocket config of the producer of the topic.
+func (p *Pulsar) producerConfig() (*websocket.Config, error) {
+	path, err := topicPath(p.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(strings.TrimRight(p.URL, "/") + "/ws/v2/producer/" + path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url %s, %s", p.URL, err)
+	}
+	q := url.Values{}
+	q.Set("sendTimeoutMillis", strconv.FormatInt(int64(p.Timeout.Duration/time.Millisecond), 10))
+	q.Set("maxPendingMessages", strconv.Itoa(p.MaxPendingMessages))
+	if p.ProducerName != "" {
+		q.Set("producerName", p.ProducerName)
+	}
+	if p.Batching {
+		q.Set("batchingEnabled", "true")
+		q.Set("batchingMaxMessages", strconv.Itoa(p.BatchingMaxMessages))
+		q.Set("batchingMaxPublishDelay", strconv.FormatInt(int64(p.BatchingMaxPublishDelay.Duration/time.Millisecond), 10))
+	}
+	u.RawQuery = q.Encode()
+
+	origin := "http://localhost/"
+	if u.Scheme == "wss" {
+		origin = "https://localhost/"
+	}
+	config, err := websocket.NewConfig(u.String(), origin)
+	if err != nil {
+		return nil, err
+	}
+	config.Dialer = &net.Dialer{Timeout: p.Timeout.Duration}
+	if p.Token != "" {
+		config.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+
+	tlsConfig, err := misc.GetTLSConfig(p.SSLCert, p.SSLKey, p.SSLCA, p.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	config.TlsConfig = tlsConfig
+	return config, nil
+}
+
+// topicPath returns the path of the topic in the websocket API:
+// persistent/tenant/namespace/topic.
+func topicPath(topic string) (string, error) {
+	if topic == "" {
+		return "", errors.New("topic is required")
+	}
+
+	domain, name := "persistent", topic
+	if i := strings.Index(topic, "://"); i >= 0 {
+		domain, name = topic[:i], topic[i+3:]
+	} else if !strings.Contains(topic, "/") {
+		name = "public/default/" + topic
+	}
+
+	if domain != "persistent" && domain != "non-persistent" {
+		return "", fmt.Errorf("invalid topic %s, can be: \"persistent://\", \"non-persistent://\"", topic)
+	}
+	if strings.Count(name, "/") != 2 {
+		return "", fmt.Errorf("invalid topic %s, must be tenant/namespace/topic", topic)
+	}
+	return domain + "/" + name, nil
+}
+
+// connect opens the producer connection, the caller holds the lock.
+func (p *Pulsar) connect() error {
+	conn, err := websocket.DialConfig(p.config)
+	if err != nil {
+		return err
+	}
+	p.conn = conn
+	return nil
+}
+
+// disconnect closes the connection, the next write opens it again. The
+// caller holds the lock.
+func (p *Pulsar) disconnect() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+func (p *Pulsar) Close() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.conn != nil {
+		err := p.conn.Close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+// keyOf returns the key of the message of the metric, empty when the
+// metric doesn't have the routing tag.
+func keyOf(metric *service.MetricData, tag string) string {
+	if tag == "" {
+		return ""
+	}
+	return metric.Tags[tag]
+}
+
+// Write sends one message per metric. The messages failing are sent again,
+// after a reconnect when the connection failed, up to MaxRetries times; a
+// message whose acknowledgement was lost may then be delivered twice.
+func (p *Pulsar) Write(metrics service.Metrics) error {
+	msgs := make([]*message, 0, len(metrics.Data))
+	for _, metric := range metrics.Data {
+		payload, err := p.serializer.Serialize(metric)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, &message{Payload: payload, Key: keyOf(metric, p.RoutingTag)})
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	var err error
+	for retry := 0; ; retry++ {
+		if p.conn == nil {
+			err = p.connect()
+		}
+		if p.conn != nil {
+			msgs, err = p.send(msgs)
+			if len(msgs) == 0 {
+				return nil
+			}
+		}
+
+		if retry == p.MaxRetries {
+			return fmt.Errorf("%d messages not sent, %v", len(msgs), err)
+		}
+		service.VLogger.Warn("Pulsar send failed, sending again",
+			zap.Int("messages", len(msgs)),
+			zap.Int("retry", retry+1),
+			zap.Error(err),
+		)
+		time.Sleep(p.RetryInterval.Duration)
+	}
+}
+
+// send sends the messages, waiting for the acknowledgements every
+// MaxPendingMessages messages. It returns the messages not acknowledged,
+// the connection is closed when it failed. The caller holds the lock.
+func (p *Pulsar) send(msgs []*message) ([]*message, error) {
+	var failed []*message
+	var err error
+	for start := 0; start < len(msgs); start += p.MaxPendingMessages {
+		end := start + p.MaxPendingMessages
+		if end > len(msgs) {
+			end = len(msgs)
+		}
+		window := msgs[start:end]
+
+		acked, werr := p.sendWindow(window)
+		for i, ok := range acked {
+			if !ok {
+				failed = append(failed, window[i])
+			}
+		}
+		if werr != nil {
+			err = werr
+		}
+		if p.conn == nil {
+			return append(failed, msgs[end:]...), err
+		}
+	}
+	return failed, err
+}
+
+// sendWindow sends the messages and reads their acknowledgements, which
+// may come in any order, and reports which ones are acknowledged.
+func (p *Pulsar) sendWindow(window []*message) ([]bool, error) {
+	acked := make([]bool, len(window))
+	p.conn.SetDeadline(time.Now().Add(p.Timeout.Duration))
+
+	for i, msg := range window {
+		msg.Context = strconv.Itoa(i)
+		if err := websocket.JSON.Send(p.conn, msg); err != nil {
+			p.disconnect()
+			return acked, err
+		}
+	}
+
+	var err error
+	for n := 0; n < len(window); n++ {
+		var a ack
+		if rerr := websocket.JSON.Receive(p.conn, &a); rerr != nil {
+			p.disconnect()
+			return acked, rerr
+		}
+		i, cerr := strconv.Atoi(a.Context)
+		if cerr != nil || i < 0 || i >= len(window) {
+			continue
+		}
+		if a.Result != "ok" {
+			err = fmt.Errorf("%s, %s", a.Result, a.ErrorMsg)
+			continue
+		}
+		acked[i] = true
+	}
+	return acked, err
+}
+
+func (p *Pulsar) Init(stop chan bool) {
+	if err := p.Connect(); err != nil {
+		log.Fatal("Pulsar Connect failed, err message is ", err)
+	}
+}
+
+func (p *Pulsar) Start() {
+
+}
+
+func (p *Pulsar) Compute(metrics service.Metrics) error {
+	return p.Write(metrics)
+}
+
+func init() {
+	service.AddMetricOutput("pulsar", &Pulsar{
+		BatchingMaxMessages:     1000,
+		BatchingMaxPublishDelay: misc.Duration{Duration: 10 * time.Millisecond},
+		MaxPendingMessages:      1000,
+		MaxRetries:              3,
+		RetryInterval:           misc.Duration{Duration: time.Second},
+		Timeout:                 misc.Duration{Duration: 10 * time.Second},
+	})
+}
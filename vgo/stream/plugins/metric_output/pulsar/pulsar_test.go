@@ -0,0 +1,330 @@
+package pulsar
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+	"golang.org/x/net/websocket"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+// hostSerializer serializes the metrics as their host tags.
+type hostSerializer struct{}
+
+func (hostSerializer) Serialize(m *service.MetricData) ([]byte, error) {
+	return []byte(m.Tags["host"]), nil
+}
+
+func (hostSerializer) SerializeBatch(metrics service.Metrics) ([]byte, error) {
+	return nil, nil
+}
+
+// mockBroker is the websocket producer API. The acks are sent ackDelay
+// after the messages, the next failNext ones with an error, and the
+// connection is closed once closeAfter messages are received.
+type mockBroker struct {
+	*httptest.Server
+	ackDelay time.Duration
+
+	sync.Mutex
+	failNext   int
+	closeAfter int
+	requests   []*http.Request
+	received   []message
+	acked      []message
+	pending    int
+	maxPending int
+}
+
+func newMockBroker() *mockBroker {
+	b := &mockBroker{ackDelay: time.Millisecond}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.Lock()
+		b.requests = append(b.requests, r)
+		b.Unlock()
+		websocket.Handler(b.serve).ServeHTTP(w, r)
+	}))
+	return b
+}
+
+func (b *mockBroker) serve(ws *websocket.Conn) {
+	acks := make(chan ack, 1000)
+	defer close(acks)
+	go func() {
+		for a := range acks {
+			time.Sleep(b.ackDelay)
+			b.Lock()
+			b.pending--
+			b.Unlock()
+			websocket.JSON.Send(ws, a)
+		}
+	}()
+
+	for {
+		var msg message
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return
+		}
+
+		b.Lock()
+		b.received = append(b.received, msg)
+		if b.closeAfter > 0 && len(b.received) == b.closeAfter {
+			b.closeAfter = 0
+			b.Unlock()
+			ws.Close()
+			return
+		}
+		b.pending++
+		if b.pending > b.maxPending {
+			b.maxPending = b.pending
+		}
+		a := ack{Result: "ok", MessageID: "1:1", Context: msg.Context}
+		if b.failNext > 0 {
+			b.failNext--
+			a = ack{Result: "send-error", ErrorMsg: "topic unavailable", Context: msg.Context}
+		} else {
+			b.acked = append(b.acked, msg)
+		}
+		b.Unlock()
+		acks <- a
+	}
+}
+
+// ackedPayloads returns the payloads acknowledged, sorted.
+func (b *mockBroker) ackedPayloads() []string {
+	b.Lock()
+	defer b.Unlock()
+	var l []string
+	for _, msg := range b.acked {
+		l = append(l, string(msg.Payload))
+	}
+	sort.Strings(l)
+	return l
+}
+
+func (b *mockBroker) counts() (requests, received int) {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.requests), len(b.received)
+}
+
+// pulsarConfig returns the output producing to the broker, not connected.
+func pulsarConfig(b *mockBroker) *Pulsar {
+	p := &Pulsar{
+		URL:                "ws" + strings.TrimPrefix(b.URL, "http"),
+		Topic:              "vgo",
+		RoutingTag:         "host",
+		MaxPendingMessages: 2,
+		MaxRetries:         3,
+		RetryInterval:      misc.Duration{Duration: time.Millisecond},
+		Timeout:            misc.Duration{Duration: 5 * time.Second},
+	}
+	p.SetSerializer(hostSerializer{})
+	return p
+}
+
+func newPulsar(t *testing.T, b *mockBroker) *Pulsar {
+	p := pulsarConfig(b)
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func hosts(names ...string) service.Metrics {
+	var m service.Metrics
+	for _, name := range names {
+		m.Data = append(m.Data, &service.MetricData{
+			Name:   "cpu",
+			Tags:   map[string]string{"host": name},
+			Fields: map[string]interface{}{"value": 1.0},
+			Time:   time.Unix(1, 0),
+		})
+	}
+	return m
+}
+
+func TestKeyOf(t *testing.T) {
+	m := &service.MetricData{Name: "cpu", Tags: map[string]string{"host": "web01", "region": ""}}
+	for _, tt := range []struct {
+		tag, key string
+	}{
+		{"host", "web01"},
+		{"region", ""},
+		{"dc", ""},
+		{"", ""},
+	} {
+		if key := keyOf(m, tt.tag); key != tt.key {
+			t.Errorf("routing tag %q, got key %q, want %q", tt.tag, key, tt.key)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	b := newMockBroker()
+	defer b.Close()
+	p := pulsarConfig(b)
+	p.Token = "s3cret"
+	p.Batching = true
+	p.BatchingMaxMessages = 100
+	p.BatchingMaxPublishDelay = misc.Duration{Duration: 5 * time.Millisecond}
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	metrics := hosts("a", "b", "c", "d", "e")
+	metrics.Data[4].Tags = map[string]string{}
+	if err := p.Write(metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	keys := make(map[string]string)
+	for _, msg := range b.received {
+		keys[string(msg.Payload)] = msg.Key
+	}
+	// the metric without the routing tag has no key
+	if want := map[string]string{"a": "a", "b": "b", "c": "c", "d": "d", "": ""}; len(b.received) != 5 || !reflect.DeepEqual(keys, want) {
+		t.Errorf("got messages %v, want the hosts as keys", keys)
+	}
+	// the next messages wait for the acks
+	if b.maxPending > 2 {
+		t.Errorf("got %d messages pending, want 2 at most", b.maxPending)
+	}
+
+	r := b.requests[0]
+	if r.URL.Path != "/ws/v2/producer/persistent/public/default/vgo" {
+		t.Errorf("got path %s", r.URL.Path)
+	}
+	want := url.Values{
+		"sendTimeoutMillis":       {"5000"},
+		"maxPendingMessages":      {"2"},
+		"batchingEnabled":         {"true"},
+		"batchingMaxMessages":     {"100"},
+		"batchingMaxPublishDelay": {"5"},
+	}
+	if q := r.URL.Query(); q.Encode() != want.Encode() {
+		t.Errorf("got query %s, want %s", q.Encode(), want.Encode())
+	}
+	if auth := r.Header.Get("Authorization"); auth != "Bearer s3cret" {
+		t.Errorf("got authorization %q", auth)
+	}
+}
+
+func TestRetryFailedMessages(t *testing.T) {
+	b := newMockBroker()
+	defer b.Close()
+	p := newPulsar(t, b)
+	defer p.Close()
+
+	// the messages refused are sent again, the acknowledged ones aren't
+	b.failNext = 2
+	if err := p.Write(hosts("a", "b", "c")); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.ackedPayloads(); strings.Join(got, ",") != "a,b,c" {
+		t.Errorf("got acked %v, want every message once", got)
+	}
+	if _, received := b.counts(); received != 5 {
+		t.Errorf("got %d messages, want the 2 refused sent again", received)
+	}
+}
+
+func TestRetryReconnect(t *testing.T) {
+	b := newMockBroker()
+	defer b.Close()
+	p := newPulsar(t, b)
+	defer p.Close()
+
+	// the connection breaks on the 3rd message, the unacknowledged ones are
+	// sent again on a new connection
+	b.closeAfter = 3
+	if err := p.Write(hosts("a", "b", "c", "d", "e")); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.ackedPayloads(); strings.Join(got, ",") != "a,b,c,d,e" {
+		t.Errorf("got acked %v, want every message once", got)
+	}
+	if requests, _ := b.counts(); requests != 2 {
+		t.Errorf("got %d connections, want 2", requests)
+	}
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	b := newMockBroker()
+	defer b.Close()
+	p := newPulsar(t, b)
+	defer p.Close()
+
+	b.failNext = 1000
+	err := p.Write(hosts("a", "b"))
+	if err == nil || !strings.Contains(err.Error(), "2 messages not sent") {
+		t.Errorf("got error %v, want the messages not sent", err)
+	}
+	// the first send and 3 retries
+	if _, received := b.counts(); received != 8 {
+		t.Errorf("got %d messages, want 8", received)
+	}
+
+	// the broker down, the connection fails every retry
+	b.Close()
+	p.Close()
+	if err := p.Write(hosts("a")); err == nil {
+		t.Error("write without broker succeeded")
+	}
+}
+
+func TestTopicPath(t *testing.T) {
+	for _, tt := range []struct {
+		topic, path string
+	}{
+		{"vgo", "persistent/public/default/vgo"},
+		{"ops/metrics/vgo", "persistent/ops/metrics/vgo"},
+		{"persistent://ops/metrics/vgo", "persistent/ops/metrics/vgo"},
+		{"non-persistent://ops/metrics/vgo", "non-persistent/ops/metrics/vgo"},
+		{"", ""},
+		{"ops/vgo", ""},
+		{"volatile://ops/metrics/vgo", ""},
+		{"persistent://vgo", ""},
+	} {
+		path, err := topicPath(tt.topic)
+		if path != tt.path || (err != nil) != (tt.path == "") {
+			t.Errorf("topic %q, got path %q and error %v, want %q", tt.topic, path, err, tt.path)
+		}
+	}
+}
+
+func TestConnectInvalid(t *testing.T) {
+	b := newMockBroker()
+	addr := "ws" + strings.TrimPrefix(b.URL, "http")
+	b.Close()
+
+	for _, p := range []*Pulsar{
+		{Topic: "vgo", MaxPendingMessages: 1},
+		{URL: addr, Topic: "vgo"},
+		{URL: addr, Topic: "a/b", MaxPendingMessages: 1},
+		{URL: addr, Topic: "vgo", MaxPendingMessages: 1, SSLCA: "/missing/ca.pem"},
+		// nothing listening
+		{URL: addr, Topic: "vgo", MaxPendingMessages: 1},
+	} {
+		if err := p.Connect(); err == nil {
+			t.Errorf("invalid config %+v accepted", p)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package splunk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+// collectorPath is the HEC endpoint receiving the events
+const collectorPath = "/services/collector"
+
+type Splunk struct {
+	// URL of the HTTP Event Collector, like https://splunk.example.com:8088
+	URL        string
+	Token      string
+	Index      string
+	Source     string
+	SourceType string
+	// SplunkMetricsMultiMetric packs all the fields of a metric in one event
+	SplunkMetricsMultiMetric bool
+	// BatchSize is the number of events of a request
+	BatchSize int
+	// MaxRetries is the number of retries of a request answered 503
+	MaxRetries int
+	Timeout    misc.Duration
+	// SSLCert and SSLKey are the client certificate of the collectors
+	// requiring mutual TLS
+	SSLCA              string `toml:"ssl_ca"`
+	SSLCert            string `toml:"ssl_cert"`
+	SSLKey             string `toml:"ssl_key"`
+	InsecureSkipVerify bool
+
+	client *http.Client
+}
+
+// event is a HEC event of a metrics index
+type event struct {
+	Time       float64                `json:"time"`
+	Event      string                 `json:"event"`
+	Host       string                 `json:"host,omitempty"`
+	Index      string                 `json:"index,omitempty"`
+	Source     string                 `json:"source,omitempty"`
+	SourceType string                 `json:"sourcetype,omitempty"`
+	Fields     map[string]interface{} `json:"fields"`
+}
+
+var sampleConfig = `
+  ## URL of the HTTP Event Collector
+  url = "https://localhost:8088"
+  ## HEC token
+  token = "00000000-0000-0000-0000-000000000000"
+  ## Metrics index, the default index of the token if not set
+  # index = "metrics"
+  # source = "vgo"
+  # source_type = "vgo"
+
+  ## Pack all the fields of a metric in one event (Splunk 8.0+)
+  # splunk_metrics_multi_metric = false
+
+  ## Number of events sent in one request
+  # batch_size = 100
+  ## Retries of a request while the collector answers 503 (server busy)
+  # max_retries = 3
+  # timeout = "5s"
+
+  ## Optional SSL Config, the client certificate and key are presented to
+  ## the collectors requiring mutual TLS
+  # ssl_ca = "/etc/vgo/ca.pem"
+  # ssl_cert = "/etc/vgo/cert.pem"
+  # ssl_key = "/etc/vgo/key.pem"
+  ## Use SSL but skip chain & host verification
+  # insecure_skip_verify = false
+`
+
+func (s *Splunk) Connect() error {
+	if s.URL == "" {
+		return errors.New("url is required")
+	}
+	if s.Token == "" {
+		return errors.New("token is required")
+	}
+	if s.BatchSize <= 0 {
+		s.BatchSize = 100
+	}
+
+	tlsConfig, err := misc.GetTLSConfig(s.SSLCert, s.SSLKey, s.SSLCA, s.InsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+	s.client = &http.Client{
+		Timeout: s.Timeout.Duration,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	return nil
+}
+
+func (s *Splunk) Close() error {
+	return nil
+}
+
+// Write sends the metrics as events, BatchSize events per request.
+func (s *Splunk) Write(metrics service.Metrics) error {
+	return s.WriteContext(context.Background(), metrics)
+}
+
+// WriteContext is Write aborted when ctx is done.
+func (s *Splunk) WriteContext(ctx context.Context, metrics service.Metrics) error {
+	var events []*event
+	for _, metric := range metrics.Data {
+		events = append(events, s.buildEvents(metric)...)
+	}
+
+	var err error
+	for len(events) > 0 {
+		n := len(events)
+		if n > s.BatchSize {
+			n = s.BatchSize
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if e := s.send(ctx, events[:n]); e != nil {
+			service.VLogger.Error("Splunk Write", zap.Error(e))
+			err = e
+		}
+		events = events[n:]
+	}
+	return err
+}
+
+// buildEvents makes the events of the metric: one event per field named
+// metric_name=<metric>.<field>, or with SplunkMetricsMultiMetric one event
+// holding every field as metric_name:<metric>.<field>. The tags are the
+// dimensions of the events, the non numeric fields are dropped.
+func (s *Splunk) buildEvents(metric *service.MetricData) []*event {
+	keys := make([]string, 0, len(metric.Fields))
+	for k := range metric.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var events []*event
+	var multi *event
+	for _, k := range keys {
+		value, ok := service.ValueToFloat(metric.Fields[k])
+		if !ok {
+			service.VLogger.Debug("Splunk non numeric field dropped",
+				zap.String("metric", metric.Name),
+				zap.String("field", k),
+			)
+			continue
+		}
+		name := metric.Name + "." + k
+
+		if s.SplunkMetricsMultiMetric {
+			if multi == nil {
+				multi = s.newEvent(metric)
+				events = append(events, multi)
+			}
+			multi.Fields["metric_name:"+name] = value
+			continue
+		}
+
+		e := s.newEvent(metric)
+		e.Fields["metric_name"] = name
+		e.Fields["_value"] = value
+		events = append(events, e)
+	}
+	return events
+}
+
+func (s *Splunk) newEvent(metric *service.MetricData) *event {
+	e := &event{
+		Time:       float64(metric.Time.UnixNano()) / float64(time.Second),
+		Event:      "metric",
+		Host:       metric.Tags["host"],
+		Index:      s.Index,
+		Source:     s.Source,
+		SourceType: s.SourceType,
+		Fields:     make(map[string]interface{}, len(metric.Tags)+2),
+	}
+	for k, v := range metric.Tags {
+		if k == "host" {
+			continue
+		}
+		e.Fields[k] = v
+	}
+	return e
+}
+
+// send posts the events, retrying while the collector answers 503.
+func (s *Splunk) send(ctx context.Context, events []*event) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	url := strings.TrimRight(s.URL, "/") + collectorPath
+	backoff := time.Second
+	for retry := 0; ; retry++ {
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body.Bytes()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Splunk "+s.Token)
+
+		resp, err := s.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return nil
+		case resp.StatusCode == http.StatusServiceUnavailable && retry < s.MaxRetries:
+			service.VLogger.Warn("Splunk collector busy, retrying",
+				zap.Int("retry", retry+1),
+				zap.Duration("backoff", backoff),
+			)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff *= 2
+		default:
+			return fmt.Errorf("status %d, %s", resp.StatusCode, string(b))
+		}
+	}
+}
+
+func (s *Splunk) Init(stop chan bool) {
+	if err := s.Connect(); err != nil {
+		log.Fatal("Splunk Connect failed, err message is ", err)
+	}
+}
+
+func (s *Splunk) Start() {
+
+}
+
+// ComputeContext writes the metrics, aborted when ctx is done.
+func (s *Splunk) ComputeContext(ctx context.Context, metrics service.Metrics) error {
+	return s.WriteContext(ctx, metrics)
+}
+
+func (s *Splunk) Compute(metrics service.Metrics) error {
+	return s.Write(metrics)
+}
+
+func init() {
+	service.AddMetricOutput("splunk", &Splunk{
+		BatchSize:  100,
+		MaxRetries: 3,
+		Timeout:    misc.Duration{Duration: 5 * time.Second},
+	})
+}
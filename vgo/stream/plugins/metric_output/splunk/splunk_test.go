@@ -0,0 +1,173 @@
+package splunk
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+// collector is a HEC answering busy to the first busy requests, it records
+// the events received by request.
+type collector struct {
+	sync.Mutex
+	busy     int
+	auth     []string
+	requests [][]map[string]interface{}
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.Lock()
+	defer c.Unlock()
+	if r.URL.Path != collectorPath {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	c.auth = append(c.auth, r.Header.Get("Authorization"))
+	if c.busy > 0 {
+		c.busy--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	var events []map[string]interface{}
+	body, _ := ioutil.ReadAll(r.Body)
+	dec := json.NewDecoder(bytes.NewReader(body))
+	for dec.More() {
+		var e map[string]interface{}
+		if err := dec.Decode(&e); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		events = append(events, e)
+	}
+	c.requests = append(c.requests, events)
+	w.Write([]byte(`{"text":"Success","code":0}`))
+}
+
+func newSplunk(t *testing.T, url string) *Splunk {
+	s := &Splunk{URL: url, Token: "secret", Index: "metrics", Source: "vgo", MaxRetries: 3}
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+var testMetric = &service.MetricData{
+	Name:   "cpu",
+	Tags:   map[string]string{"host": "web01", "cpu": "cpu0"},
+	Fields: map[string]interface{}{"idle": 90.5, "user": int64(7), "state": "ok"},
+	Time:   time.Unix(1500000000, 500000000),
+}
+
+// decode returns the JSON of s as decoded from the requests.
+func decode(t *testing.T, s string) map[string]interface{} {
+	var e map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &e); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestEvents(t *testing.T) {
+	c := &collector{}
+	ts := httptest.NewServer(c)
+	defer ts.Close()
+
+	s := newSplunk(t, ts.URL+"/")
+	if err := s.Write(service.Metrics{Data: []*service.MetricData{testMetric}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(c.requests))
+	}
+	if c.auth[0] != "Splunk secret" {
+		t.Errorf("got Authorization %q", c.auth[0])
+	}
+	// an event per numeric field, the string field is dropped
+	want := []map[string]interface{}{
+		decode(t, `{"time":1500000000.5,"event":"metric","host":"web01","index":"metrics","source":"vgo",
+			"fields":{"cpu":"cpu0","metric_name":"cpu.idle","_value":90.5}}`),
+		decode(t, `{"time":1500000000.5,"event":"metric","host":"web01","index":"metrics","source":"vgo",
+			"fields":{"cpu":"cpu0","metric_name":"cpu.user","_value":7}}`),
+	}
+	if !reflect.DeepEqual(c.requests[0], want) {
+		t.Errorf("got events %v, want %v", c.requests[0], want)
+	}
+}
+
+func TestMultiMetricEvents(t *testing.T) {
+	c := &collector{}
+	ts := httptest.NewServer(c)
+	defer ts.Close()
+
+	s := newSplunk(t, ts.URL)
+	s.SplunkMetricsMultiMetric = true
+	if err := s.Write(service.Metrics{Data: []*service.MetricData{testMetric}}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []map[string]interface{}{
+		decode(t, `{"time":1500000000.5,"event":"metric","host":"web01","index":"metrics","source":"vgo",
+			"fields":{"cpu":"cpu0","metric_name:cpu.idle":90.5,"metric_name:cpu.user":7}}`),
+	}
+	if len(c.requests) != 1 || !reflect.DeepEqual(c.requests[0], want) {
+		t.Errorf("got requests %v, want %v", c.requests, want)
+	}
+}
+
+func TestBatchAndRetry(t *testing.T) {
+	c := &collector{busy: 1}
+	ts := httptest.NewServer(c)
+	defer ts.Close()
+
+	s := newSplunk(t, ts.URL)
+	s.BatchSize = 3
+	s.SplunkMetricsMultiMetric = true
+	var metrics service.Metrics
+	for i := 0; i < 7; i++ {
+		metrics.Data = append(metrics.Data, testMetric)
+	}
+	if err := s.Write(metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	// the busy answer is retried, the 7 events are sent by batches of 3
+	var sizes []int
+	for _, events := range c.requests {
+		sizes = append(sizes, len(events))
+	}
+	if !reflect.DeepEqual(sizes, []int{3, 3, 1}) {
+		t.Errorf("got batches of %v events, want [3 3 1]", sizes)
+	}
+	if len(c.auth) != 4 {
+		t.Errorf("got %d requests, want 3 and a retry", len(c.auth))
+	}
+}
+
+func TestWriteFailure(t *testing.T) {
+	c := &collector{busy: 2}
+	ts := httptest.NewServer(c)
+	defer ts.Close()
+
+	s := newSplunk(t, ts.URL)
+	s.MaxRetries = 1
+	err := s.Write(service.Metrics{Data: []*service.MetricData{testMetric}})
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got error %v, want the 503 once the retries are exhausted", err)
+	}
+}
@@ -0,0 +1,278 @@
+package stackdriver
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// tokenMargin renews the token this long before it expires, so a
+	// request doesn't start with a token expiring on the way
+	tokenMargin = time.Minute
+	// monitoringScope is the OAuth scope of the timeSeries.create calls
+	monitoringScope = "https://www.googleapis.com/auth/monitoring.write"
+	// googleTokenURL is the token endpoint of the user credentials
+	googleTokenURL = "https://oauth2.googleapis.com/token"
+	// metadataHost answers the tokens of the service account of the
+	// instance on GCE and GKE, GCE_METADATA_HOST replaces it
+	metadataHost = "metadata.google.internal"
+)
+
+// credentialsFile is a service account key or the user credentials of
+// gcloud auth application-default login
+type credentialsFile struct {
+	Type string `json:"type"`
+
+	// service_account
+	ProjectID   string `json:"project_id"`
+	PrivateKey  string `json:"private_key"`
+	ClientEmail string `json:"client_email"`
+	TokenURI    string `json:"token_uri"`
+
+	// authorized_user
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// tokenResponse is the answer of the token endpoints and of the metadata
+// server
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// credentials gets the OAuth tokens of the requests from the Application
+// Default Credentials: the file of GOOGLE_APPLICATION_CREDENTIALS, or of
+// gcloud auth application-default login, or else the service account of
+// the instance given by the metadata server. It keeps the token until it
+// expires.
+type credentials struct {
+	file   *credentialsFile
+	key    *rsa.PrivateKey
+	client *http.Client
+
+	sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// findCredentials returns the credentials of path, or the default ones
+// when empty.
+func findCredentials(path string, client *http.Client) (*credentials, error) {
+	if path == "" {
+		path = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if path == "" {
+		if p := wellKnownFile(); p != "" {
+			if _, err := os.Stat(p); err == nil {
+				path = p
+			}
+		}
+	}
+	// without file, the metadata server of the instance
+	if path == "" {
+		return &credentials{client: client}, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &credentialsFile{}
+	if err := json.Unmarshal(b, f); err != nil {
+		return nil, fmt.Errorf("%s, %s", path, err)
+	}
+
+	c := &credentials{file: f, client: client}
+	switch f.Type {
+	case "service_account":
+		if f.ClientEmail == "" {
+			return nil, fmt.Errorf("%s, client_email missing", path)
+		}
+		if c.key, err = parseKey(f.PrivateKey); err != nil {
+			return nil, fmt.Errorf("%s, %s", path, err)
+		}
+		if f.TokenURI == "" {
+			f.TokenURI = googleTokenURL
+		}
+	case "authorized_user":
+		if f.RefreshToken == "" {
+			return nil, fmt.Errorf("%s, refresh_token missing", path)
+		}
+	default:
+		return nil, fmt.Errorf("%s, unsupported credentials type %q", path, f.Type)
+	}
+	return c, nil
+}
+
+// wellKnownFile is the file of gcloud auth application-default login.
+func wellKnownFile() string {
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return filepath.Join(dir, "application_default_credentials.json")
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		return filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+	}
+	return ""
+}
+
+// parseKey parses the PEM PKCS#8, or PKCS#1, RSA key of a service account.
+func parseKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("invalid private_key, PEM expected")
+	}
+	if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		key, ok := k.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("private_key isn't an RSA key")
+		}
+		return key, nil
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// ProjectID returns the project of the service account, "" for the
+// other credentials.
+func (c *credentials) ProjectID() string {
+	if c.file == nil {
+		return ""
+	}
+	return c.file.ProjectID
+}
+
+// Token returns the current token, getting a new one when it expires.
+func (c *credentials) Token(ctx context.Context) (string, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.token != "" && time.Now().Add(tokenMargin).Before(c.expires) {
+		return c.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	switch {
+	case c.file == nil:
+		req, err = c.metadataRequest()
+	case c.file.Type == "service_account":
+		req, err = c.jwtRequest()
+	default:
+		req, err = c.refreshRequest()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token status %d, %s", resp.StatusCode, string(b))
+	}
+
+	var r tokenResponse
+	if err := json.Unmarshal(b, &r); err != nil {
+		return "", fmt.Errorf("token response, %s", err)
+	}
+	if r.AccessToken == "" {
+		return "", errors.New("token response without access_token")
+	}
+	c.token = r.AccessToken
+	c.expires = time.Now().Add(time.Duration(r.ExpiresIn) * time.Second)
+	return c.token, nil
+}
+
+// Invalidate forgets the token refused by the API, the next Token call
+// gets a new one.
+func (c *credentials) Invalidate(token string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.token == token {
+		c.token = ""
+	}
+}
+
+func (c *credentials) metadataRequest() (*http.Request, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = metadataHost
+	}
+	req, err := http.NewRequest("GET", "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return req, nil
+}
+
+// jwtRequest exchanges a JWT signed by the key of the service account for
+// a token.
+func (c *credentials) jwtRequest() (*http.Request, error) {
+	now := time.Now()
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   c.file.ClientEmail,
+		"scope": monitoringScope,
+		"aud":   c.file.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", unsigned+"."+enc.EncodeToString(sig))
+	return formRequest(c.file.TokenURI, form)
+}
+
+// refreshRequest exchanges the refresh token of the user for a token.
+func (c *credentials) refreshRequest() (*http.Request, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("client_id", c.file.ClientID)
+	form.Set("client_secret", c.file.ClientSecret)
+	form.Set("refresh_token", c.file.RefreshToken)
+	return formRequest(googleTokenURL, form)
+}
+
+func formRequest(u string, form url.Values) (*http.Request, error) {
+	req, err := http.NewRequest("POST", u, bytes.NewReader([]byte(form.Encode())))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
@@ -0,0 +1,538 @@
+package stackdriver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+const (
+	// maxSeriesPerCall is the timeSeries.create limit of time series per
+	// request
+	maxSeriesPerCall = 200
+	// maxLabels is the Cloud Monitoring limit of labels per metric
+	maxLabels = 30
+	// maxLabelValue is the Cloud Monitoring limit of the size of a label
+	// value
+	maxLabelValue = 1024
+	// seriesMaxAge forgets the series not written for that long, Cloud
+	// Monitoring refuses the points older than 25 hours anyway
+	seriesMaxAge = 25 * time.Hour
+)
+
+// Stackdriver writes the metrics to Google Cloud Monitoring with the
+// timeSeries.create API. Every numeric field is the gauge of the custom
+// metric type <metric_type_prefix>/<metric>/<field>, with the tags of its
+// metric as labels.
+//
+// Cloud Monitoring takes a single point per time series in a request and
+// the points of a series in time order, so the points of a series are
+// written one per request, and the ones older than the last point written
+// are dropped.
+type Stackdriver struct {
+	// Project is the project of the metrics, by default the one of the
+	// service account
+	Project string
+	// CredentialsFile is a service account key or user credentials, by
+	// default the Application Default Credentials
+	CredentialsFile string
+	// MetricTypePrefix prefixes the metric types
+	MetricTypePrefix string
+	// ResourceType is the monitored resource of the metrics, with its
+	// ResourceLabels. The project_id label of the global resource is set
+	ResourceType   string
+	ResourceLabels map[string]string
+	// URL of the Cloud Monitoring API
+	URL     string
+	Timeout misc.Duration
+
+	project string
+	client  *http.Client
+	creds   *credentials
+
+	sync.Mutex
+	// last are the times of the last points written by series key
+	last   map[string]time.Time
+	lastGC time.Time
+}
+
+// timeSeries is a time series of the timeSeries.create request
+type timeSeries struct {
+	Metric     metricType `json:"metric"`
+	Resource   resource   `json:"resource"`
+	MetricKind string     `json:"metricKind"`
+	ValueType  string     `json:"valueType"`
+	Points     []*point   `json:"points"`
+}
+
+type metricType struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type resource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type point struct {
+	Interval struct {
+		EndTime string `json:"endTime"`
+	} `json:"interval"`
+	Value typedValue `json:"value"`
+}
+
+// typedValue has one of its values set, INT64 are decimal strings
+type typedValue struct {
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	Int64Value  string   `json:"int64Value,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+// series are the points of a time series waiting to be written, in time
+// order
+type series struct {
+	key    string
+	ts     *timeSeries
+	points []*point
+	times  []time.Time
+}
+
+var sampleConfig = `
+  ## Project of the metrics, by default the one of the service account
+  # project = "my-project"
+  ## Service account key or user credentials, by default the Application
+  ## Default Credentials: GOOGLE_APPLICATION_CREDENTIALS, the gcloud
+  ## application default login, then the service account of the instance
+  # credentials_file = "/etc/vgo/service-account.json"
+
+  ## Every numeric field is the metric type <prefix>/<metric>/<field>
+  # metric_type_prefix = "custom.googleapis.com"
+  ## Monitored resource of the metrics, the global one gets the project_id
+  # resource_type = "global"
+  # [metric_outputs.stackdriver.resource_labels]
+  #   instance_id = "1234"
+  #   zone = "us-central1-a"
+  # timeout = "10s"
+`
+
+func (s *Stackdriver) Connect() error {
+	if s.MetricTypePrefix == "" {
+		return errors.New("metric_type_prefix is required")
+	}
+	if s.ResourceType == "" {
+		return errors.New("resource_type is required")
+	}
+
+	s.client = &http.Client{
+		Timeout: s.Timeout.Duration,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+		},
+	}
+	creds, err := findCredentials(s.CredentialsFile, s.client)
+	if err != nil {
+		return err
+	}
+	s.creds = creds
+
+	s.project = s.Project
+	if s.project == "" {
+		s.project = creds.ProjectID()
+	}
+	if s.project == "" {
+		return errors.New("project is required without service account")
+	}
+	s.last = make(map[string]time.Time)
+
+	// fail early on bad credentials
+	_, err = s.creds.Token(context.Background())
+	return err
+}
+
+func (s *Stackdriver) Close() error {
+	return nil
+}
+
+func (s *Stackdriver) Write(metrics service.Metrics) error {
+	return s.WriteContext(context.Background(), metrics)
+}
+
+// WriteContext writes the points in rounds, a round writes the next point
+// of every series in requests of at most maxSeriesPerCall series. It stops
+// at the first failed request, the points written before are dropped from
+// the retry as older than the last points written.
+func (s *Stackdriver) WriteContext(ctx context.Context, metrics service.Metrics) error {
+	pending := s.buildSeries(metrics.Data)
+
+	for round := 0; len(pending) > 0; round++ {
+		var batch []*series
+		for _, sr := range pending {
+			if round < len(sr.points) {
+				batch = append(batch, sr)
+			}
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		for len(batch) > 0 {
+			n := len(batch)
+			if n > maxSeriesPerCall {
+				n = maxSeriesPerCall
+			}
+			if err := s.send(ctx, batch[:n], round); err != nil {
+				service.VLogger.Error("Stackdriver Write", zap.Error(err))
+				return err
+			}
+			batch = batch[n:]
+		}
+	}
+	return nil
+}
+
+// buildSeries groups the points by series in time order, the points not
+// after the last point written of their series are dropped.
+func (s *Stackdriver) buildSeries(metrics []*service.MetricData) []*series {
+	var list []*series
+	index := make(map[string]*series)
+	for _, metric := range metrics {
+		labels := s.buildLabels(metric)
+		for k, v := range metric.Fields {
+			p, valueType, ok := buildPoint(v)
+			if !ok {
+				service.VLogger.Debug("Stackdriver non numeric field dropped",
+					zap.String("metric", metric.Name),
+					zap.String("field", k),
+				)
+				continue
+			}
+			p.Interval.EndTime = metric.Time.UTC().Format(time.RFC3339Nano)
+
+			typ := s.MetricTypePrefix + "/" + sanitizeType(metric.Name) + "/" + sanitizeType(k)
+			key := seriesKey(typ, labels)
+			sr, ok := index[key]
+			if !ok {
+				sr = &series{
+					key: key,
+					ts: &timeSeries{
+						Metric:     metricType{Type: typ, Labels: labels},
+						Resource:   s.resource(),
+						MetricKind: "GAUGE",
+						ValueType:  valueType,
+					},
+				}
+				index[key] = sr
+				list = append(list, sr)
+			} else if valueType != sr.ts.ValueType && !coerce(p, sr.ts.ValueType) {
+				service.VLogger.Debug("Stackdriver field of another type dropped",
+					zap.String("type", typ),
+					zap.String("value_type", valueType),
+				)
+				continue
+			}
+			sr.points = append(sr.points, p)
+			sr.times = append(sr.times, metric.Time)
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for _, sr := range list {
+		sr.order(s.last[sr.key])
+	}
+	return list
+}
+
+// order sorts the points by time, and keeps the first point of every time
+// after last.
+func (sr *series) order(last time.Time) {
+	sort.Stable(sr)
+	points, times := sr.points[:0], sr.times[:0]
+	for i, p := range sr.points {
+		t := sr.times[i]
+		if !t.After(last) {
+			service.VLogger.Debug("Stackdriver point out of order dropped",
+				zap.String("type", sr.ts.Metric.Type),
+				zap.String("time", t.String()),
+			)
+			continue
+		}
+		points = append(points, p)
+		times = append(times, t)
+		last = t
+	}
+	sr.points, sr.times = points, times
+}
+
+func (sr *series) Len() int           { return len(sr.points) }
+func (sr *series) Less(i, j int) bool { return sr.times[i].Before(sr.times[j]) }
+func (sr *series) Swap(i, j int) {
+	sr.points[i], sr.points[j] = sr.points[j], sr.points[i]
+	sr.times[i], sr.times[j] = sr.times[j], sr.times[i]
+}
+
+// send writes the point of the round of every series, then records them as
+// the last points written.
+func (s *Stackdriver) send(ctx context.Context, batch []*series, round int) error {
+	req := struct {
+		TimeSeries []*timeSeries `json:"timeSeries"`
+	}{TimeSeries: make([]*timeSeries, 0, len(batch))}
+	for _, sr := range batch {
+		ts := *sr.ts
+		ts.Points = []*point{sr.points[round]}
+		req.TimeSeries = append(req.TimeSeries, &ts)
+	}
+	body, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+
+	status, resp, err := s.do(ctx, "/v3/projects/"+s.project+"/timeSeries", body)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("timeSeries.create status %d, %s", status, string(resp))
+	}
+
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	for _, sr := range batch {
+		s.last[sr.key] = sr.times[round]
+	}
+	if now.Sub(s.lastGC) > time.Hour {
+		for k, t := range s.last {
+			if now.Sub(t) > seriesMaxAge {
+				delete(s.last, k)
+			}
+		}
+		s.lastGC = now
+	}
+	return nil
+}
+
+// do posts the body with the OAuth token. A request refused with 401 is
+// sent once more with a new token, for the tokens revoked before their
+// expiry.
+func (s *Stackdriver) do(ctx context.Context, path string, body []byte) (int, []byte, error) {
+	for retry := 0; ; retry++ {
+		token, err := s.creds.Token(ctx)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		req, err := http.NewRequest("POST", strings.TrimRight(s.URL, "/")+path, bytes.NewReader(body))
+		if err != nil {
+			return 0, nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := s.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return 0, nil, err
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && retry == 0 {
+			s.creds.Invalidate(token)
+			continue
+		}
+		return resp.StatusCode, b, nil
+	}
+}
+
+func (s *Stackdriver) resource() resource {
+	r := resource{Type: s.ResourceType, Labels: make(map[string]string, len(s.ResourceLabels)+1)}
+	for k, v := range s.ResourceLabels {
+		r.Labels[k] = v
+	}
+	if s.ResourceType == "global" {
+		r.Labels["project_id"] = s.project
+	}
+	return r
+}
+
+// buildLabels makes the labels from the metric tags, the first maxLabels
+// by name so the same tags always give the same labels. The keys are
+// sanitized and the values truncated to the Cloud Monitoring limits.
+func (s *Stackdriver) buildLabels(metric *service.MetricData) map[string]string {
+	if len(metric.Tags) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(metric.Tags))
+	for k := range metric.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if len(keys) > maxLabels {
+		service.VLogger.Warn("Stackdriver too many labels, truncated",
+			zap.String("metric", metric.Name),
+			zap.Int("labels", len(keys)),
+			zap.Int("max", maxLabels),
+		)
+		keys = keys[:maxLabels]
+	}
+
+	labels := make(map[string]string, len(keys))
+	for _, k := range keys {
+		v := metric.Tags[k]
+		if len(v) > maxLabelValue {
+			v = v[:maxLabelValue]
+		}
+		labels[sanitizeLabel(k)] = v
+	}
+	return labels
+}
+
+// seriesKey identifies the time series of the metric type and labels.
+func seriesKey(typ string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	b.WriteString(typ)
+	for _, k := range keys {
+		b.WriteByte(0)
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(labels[k])
+	}
+	return b.String()
+}
+
+// sanitizeType replaces the characters a metric type can't have by _.
+func sanitizeType(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '/':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+// sanitizeLabel makes a label key of lower case letters, digits and _
+// starting with a letter, of 100 characters at most.
+func sanitizeLabel(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '_'
+		}
+	}, s)
+	if s == "" || s[0] < 'a' || s[0] > 'z' {
+		s = "l_" + s
+	}
+	if len(s) > 100 {
+		s = s[:100]
+	}
+	return s
+}
+
+// buildPoint returns the point of the value and its value type, INT64 for
+// the integers, DOUBLE for the floats, BOOL for the booleans. The other
+// values can't be written.
+func buildPoint(v interface{}) (*point, string, bool) {
+	p := &point{}
+	switch t := v.(type) {
+	case int:
+		p.Value.Int64Value = strconv.FormatInt(int64(t), 10)
+	case int32:
+		p.Value.Int64Value = strconv.FormatInt(int64(t), 10)
+	case int64:
+		p.Value.Int64Value = strconv.FormatInt(t, 10)
+	case uint64:
+		if t > 1<<63-1 {
+			f := float64(t)
+			p.Value.DoubleValue = &f
+			return p, "DOUBLE", true
+		}
+		p.Value.Int64Value = strconv.FormatUint(t, 10)
+	case float32:
+		f := float64(t)
+		p.Value.DoubleValue = &f
+		return p, "DOUBLE", true
+	case float64:
+		p.Value.DoubleValue = &t
+		return p, "DOUBLE", true
+	case bool:
+		p.Value.BoolValue = &t
+		return p, "BOOL", true
+	default:
+		return nil, "", false
+	}
+	return p, "INT64", true
+}
+
+// coerce converts the INT64 point to the DOUBLE value type, the value type
+// of a series can't change.
+func coerce(p *point, valueType string) bool {
+	if valueType != "DOUBLE" || p.Value.Int64Value == "" {
+		return false
+	}
+	f, err := strconv.ParseFloat(p.Value.Int64Value, 64)
+	if err != nil {
+		return false
+	}
+	p.Value.Int64Value = ""
+	p.Value.DoubleValue = &f
+	return true
+}
+
+func (s *Stackdriver) Init(stop chan bool) {
+	if err := s.Connect(); err != nil {
+		log.Fatal("Stackdriver Connect failed, err message is ", err)
+	}
+}
+
+func (s *Stackdriver) Start() {
+
+}
+
+// ComputeContext writes the metrics, aborted when ctx is done.
+func (s *Stackdriver) ComputeContext(ctx context.Context, metrics service.Metrics) error {
+	return s.WriteContext(ctx, metrics)
+}
+
+func (s *Stackdriver) Compute(metrics service.Metrics) error {
+	return s.Write(metrics)
+}
+
+func init() {
+	service.AddMetricOutput("stackdriver", &Stackdriver{
+		MetricTypePrefix: "custom.googleapis.com",
+		ResourceType:     "global",
+		URL:              "https://monitoring.googleapis.com",
+		Timeout:          misc.Duration{Duration: 10 * time.Second},
+	})
+}
@@ -0,0 +1,389 @@
+package stackdriver
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+// mockGoogle is the token endpoint of a service account and the Cloud
+// Monitoring API. The tokens are given for the JWT signed by key, the
+// timeSeries.create requests are refused with 401 while revoked is set.
+type mockGoogle struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	sync.Mutex
+	tokens   int
+	revoked  bool
+	requests []createRequest
+}
+
+type createRequest struct {
+	TimeSeries []*timeSeries `json:"timeSeries"`
+}
+
+func newMockGoogle(t *testing.T) *mockGoogle {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &mockGoogle{key: key}
+	g.Server = httptest.NewServer(g)
+	return g
+}
+
+func (g *mockGoogle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.Lock()
+	defer g.Unlock()
+	switch r.URL.Path {
+	case "/token":
+		if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || !g.verify(r.FormValue("assertion")) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		g.tokens++
+		g.revoked = false
+		fmt.Fprintf(w, `{"access_token":"token%d","expires_in":3600}`, g.tokens)
+	case "/v3/projects/vgo-project/timeSeries":
+		if g.revoked || r.Header.Get("Authorization") != fmt.Sprintf("Bearer token%d", g.tokens) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req createRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		g.requests = append(g.requests, req)
+		w.Write([]byte("{}"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// verify checks the JWT is signed by the key of the service account.
+func (g *mockGoogle) verify(jwt string) bool {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	return rsa.VerifyPKCS1v15(&g.key.PublicKey, crypto.SHA256, sum[:], sig) == nil
+}
+
+func (g *mockGoogle) created() []createRequest {
+	g.Lock()
+	defer g.Unlock()
+	return append([]createRequest(nil), g.requests...)
+}
+
+// serviceAccount writes the service account key file of the mock.
+func (g *mockGoogle) serviceAccount(t *testing.T, dir string) string {
+	der, err := x509.MarshalPKCS8PrivateKey(g.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"project_id":   "vgo-project",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email": "vgo@vgo-project.iam.gserviceaccount.com",
+		"token_uri":    g.URL + "/token",
+	})
+	path := filepath.Join(dir, "service-account.json")
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "vgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func newStackdriver(t *testing.T, g *mockGoogle, dir string) *Stackdriver {
+	s := &Stackdriver{
+		CredentialsFile:  g.serviceAccount(t, dir),
+		MetricTypePrefix: "custom.googleapis.com",
+		ResourceType:     "global",
+		URL:              g.URL,
+		Timeout:          misc.Duration{Duration: 5 * time.Second},
+	}
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestMetricTypeAndLabels(t *testing.T) {
+	s := &Stackdriver{MetricTypePrefix: "custom.googleapis.com", ResourceType: "global", project: "vgo-project", last: make(map[string]time.Time)}
+	m := &service.MetricData{
+		Name: "net.http",
+		Tags: map[string]string{
+			"Host-Name": "web01",
+			"9zone":     "eu",
+			"path":      strings.Repeat("a", 2000),
+		},
+		Fields: map[string]interface{}{"req/s": 1.5, "errors": int64(2), "up": true, "state": "ok"},
+		Time:   time.Unix(1500000000, 0),
+	}
+
+	list := s.buildSeries([]*service.MetricData{m})
+	types := make(map[string]string)
+	for _, sr := range list {
+		types[sr.ts.Metric.Type] = sr.ts.ValueType
+		if sr.ts.MetricKind != "GAUGE" || sr.ts.Resource.Labels["project_id"] != "vgo-project" {
+			t.Errorf("got series %+v", sr.ts)
+		}
+	}
+	// a type per numeric field
+	want := map[string]string{
+		"custom.googleapis.com/net_http/req/s":  "DOUBLE",
+		"custom.googleapis.com/net_http/errors": "INT64",
+		"custom.googleapis.com/net_http/up":     "BOOL",
+	}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("got types %v, want %v", types, want)
+	}
+
+	labels := list[0].ts.Metric.Labels
+	if len(labels) != 3 || labels["host_name"] != "web01" || labels["l_9zone"] != "eu" || len(labels["path"]) != maxLabelValue {
+		t.Errorf("got labels %v", labels)
+	}
+}
+
+func TestLabelsTruncated(t *testing.T) {
+	s := &Stackdriver{}
+	m := &service.MetricData{Name: "cpu", Tags: make(map[string]string)}
+	for i := 0; i < 40; i++ {
+		m.Tags[fmt.Sprintf("tag%02d", i)] = "v"
+	}
+	// the first labels by name
+	labels := s.buildLabels(m)
+	if len(labels) != maxLabels || labels["tag00"] != "v" || labels["tag29"] != "v" {
+		t.Errorf("got %d labels, want tag00 to tag29", len(labels))
+	}
+	if labels := s.buildLabels(&service.MetricData{Name: "cpu"}); labels != nil {
+		t.Errorf("got labels %v without tags", labels)
+	}
+}
+
+func TestBatching(t *testing.T) {
+	g := newMockGoogle(t)
+	defer g.Close()
+	dir, clean := tempDir(t)
+	defer clean()
+	s := newStackdriver(t, g, dir)
+
+	// 450 series, and 3 points of the same series
+	var metrics service.Metrics
+	for i := 0; i < 450; i++ {
+		metrics.Data = append(metrics.Data, &service.MetricData{
+			Name:   "cpu",
+			Tags:   map[string]string{"host": fmt.Sprintf("web%03d", i)},
+			Fields: map[string]interface{}{"usage": 1.0},
+			Time:   time.Unix(1500000000, 0),
+		})
+	}
+	for i := 2; i >= 0; i-- {
+		metrics.Data = append(metrics.Data, &service.MetricData{
+			Name:   "mem",
+			Fields: map[string]interface{}{"used": int64(i)},
+			Time:   time.Unix(1500000000+int64(i), 0),
+		})
+	}
+	if err := s.Write(metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	// 200 series per request at most, a point per series per request, in
+	// time order
+	var sizes []int
+	var mem []string
+	for _, req := range g.created() {
+		sizes = append(sizes, len(req.TimeSeries))
+		for _, ts := range req.TimeSeries {
+			if len(ts.Points) != 1 {
+				t.Errorf("got %d points in a series", len(ts.Points))
+			}
+			if ts.Metric.Type == "custom.googleapis.com/mem/used" {
+				mem = append(mem, ts.Points[0].Value.Int64Value)
+			}
+		}
+	}
+	if fmt.Sprint(sizes) != "[200 200 51 1 1]" {
+		t.Errorf("got requests of %v series", sizes)
+	}
+	if fmt.Sprint(mem) != "[0 1 2]" {
+		t.Errorf("got mem points %v, want them in time order", mem)
+	}
+}
+
+func TestPointsInOrder(t *testing.T) {
+	g := newMockGoogle(t)
+	defer g.Close()
+	dir, clean := tempDir(t)
+	defer clean()
+	s := newStackdriver(t, g, dir)
+
+	at := func(sec int64, v float64) *service.MetricData {
+		return &service.MetricData{Name: "cpu", Fields: map[string]interface{}{"usage": v}, Time: time.Unix(sec, 0)}
+	}
+	// the second point of the same time is dropped
+	if err := s.Write(service.Metrics{Data: []*service.MetricData{at(10, 1), at(10, 2), at(11, 3)}}); err != nil {
+		t.Fatal(err)
+	}
+	// the points not after the last point written are dropped
+	if err := s.Write(service.Metrics{Data: []*service.MetricData{at(9, 4), at(11, 5), at(12, 6)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var values []float64
+	for _, req := range g.created() {
+		values = append(values, *req.TimeSeries[0].Points[0].Value.DoubleValue)
+	}
+	if fmt.Sprint(values) != "[1 3 6]" {
+		t.Errorf("got points %v, want 1, 3 and 6", values)
+	}
+}
+
+func TestValueTypes(t *testing.T) {
+	s := &Stackdriver{MetricTypePrefix: "custom.googleapis.com", ResourceType: "global", last: make(map[string]time.Time)}
+	at := func(sec int64, v interface{}) *service.MetricData {
+		return &service.MetricData{Name: "cpu", Fields: map[string]interface{}{"usage": v}, Time: time.Unix(sec, 0)}
+	}
+	// the integers of a DOUBLE series are converted, the others dropped
+	list := s.buildSeries([]*service.MetricData{at(1, 1.5), at(2, int64(2)), at(3, "high"), at(4, true)})
+	if len(list) != 1 || list[0].ts.ValueType != "DOUBLE" || len(list[0].points) != 2 || *list[0].points[1].Value.DoubleValue != 2 {
+		t.Errorf("got series %+v", list[0])
+	}
+
+	list = s.buildSeries([]*service.MetricData{at(1, int64(1)), at(2, 2.5), at(3, uint64(1<<63))})
+	if len(list) != 1 || list[0].ts.ValueType != "INT64" || len(list[0].points) != 1 {
+		t.Errorf("got series %+v, want the floats of the INT64 series dropped", list[0])
+	}
+}
+
+func TestTokenRenewed(t *testing.T) {
+	g := newMockGoogle(t)
+	defer g.Close()
+	dir, clean := tempDir(t)
+	defer clean()
+	s := newStackdriver(t, g, dir)
+
+	m := service.Metrics{Data: []*service.MetricData{{Name: "cpu", Fields: map[string]interface{}{"usage": 1.0}, Time: time.Unix(1, 0)}}}
+	if err := s.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	// the token revoked, a new one is asked once
+	g.Lock()
+	g.revoked = true
+	g.Unlock()
+	m.Data[0].Time = time.Unix(2, 0)
+	if err := s.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	g.Lock()
+	defer g.Unlock()
+	if g.tokens != 2 || len(g.requests) != 2 {
+		t.Errorf("got %d tokens and %d requests, want 2 and 2", g.tokens, len(g.requests))
+	}
+}
+
+func TestMetadataCredentials(t *testing.T) {
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" || r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"access_token":"instance","expires_in":3600}`))
+	}))
+	defer metadata.Close()
+	os.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(metadata.URL, "http://"))
+	defer os.Unsetenv("GCE_METADATA_HOST")
+
+	c := &credentials{client: http.DefaultClient}
+	token, err := c.Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "instance" || c.ProjectID() != "" {
+		t.Errorf("got token %s and project %s", token, c.ProjectID())
+	}
+}
+
+func TestConnectInvalid(t *testing.T) {
+	g := newMockGoogle(t)
+	defer g.Close()
+	dir, clean := tempDir(t)
+	defer clean()
+	account := g.serviceAccount(t, dir)
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	for _, s := range []*Stackdriver{
+		{CredentialsFile: account, ResourceType: "global"},
+		{CredentialsFile: account, MetricTypePrefix: "custom.googleapis.com"},
+		{CredentialsFile: filepath.Join(dir, "missing.json"), MetricTypePrefix: "custom.googleapis.com", ResourceType: "global"},
+		{CredentialsFile: write("invalid.json", "{"), MetricTypePrefix: "custom.googleapis.com", ResourceType: "global"},
+		{CredentialsFile: write("type.json", `{"type":"external_account"}`), MetricTypePrefix: "custom.googleapis.com", ResourceType: "global"},
+		{CredentialsFile: write("key.json", `{"type":"service_account","client_email":"vgo","private_key":"none"}`), MetricTypePrefix: "custom.googleapis.com", ResourceType: "global"},
+		{CredentialsFile: write("user.json", `{"type":"authorized_user","client_id":"vgo"}`), MetricTypePrefix: "custom.googleapis.com", ResourceType: "global"},
+	} {
+		if err := s.Connect(); err == nil {
+			t.Errorf("invalid config %+v accepted", s)
+		}
+	}
+
+	// the token endpoint refuses the JWT of another key
+	other, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Lock()
+	g.key = other
+	g.Unlock()
+	s := &Stackdriver{CredentialsFile: account, MetricTypePrefix: "custom.googleapis.com", ResourceType: "global", URL: g.URL}
+	if err := s.Connect(); err == nil {
+		t.Error("credentials refused accepted")
+	}
+}
@@ -0,0 +1,192 @@
+package unixsocket
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+// UnixSocket writes the metrics to a unix socket, one line per metric, for
+// the local collectors reading from a socket.
+type UnixSocket struct {
+	// Address is unix:///path for a stream socket, unixgram:///path for
+	// a datagram socket, which gets a datagram per metric
+	Address string
+	// MaxQueued is the number of metrics kept while the socket is
+	// unreachable, the oldest ones are dropped over it
+	MaxQueued int
+	Timeout   misc.Duration
+
+	network    string
+	path       string
+	serializer service.Serializer
+	// stats are the counters of the output instance
+	stats *service.PluginStats
+
+	// the connection is reopened by the next write once closed
+	sync.Mutex
+	conn  net.Conn
+	queue [][]byte
+}
+
+var sampleConfig = `
+  ## unix:///path of a stream socket, or unixgram:///path of a datagram
+  ## socket which gets a datagram per metric
+  address = "unix:///var/run/collector.sock"
+  ## Metrics kept while the socket is unreachable
+  # max_queued = 10000
+  # timeout = "5s"
+
+  ## Data format of the lines: "influx", "json", "ndjson"
+  # data_format = "influx"
+  ## Unit of the json and ndjson timestamps: "1s", "1ms", "1us" or "1ns"
+  # json_timestamp_units = "1s"
+`
+
+func (u *UnixSocket) SetSerializer(serializer service.Serializer) {
+	u.serializer = serializer
+}
+
+// SetStats implements service.StatsSetter.
+func (u *UnixSocket) SetStats(stats *service.PluginStats) {
+	u.stats = stats
+}
+
+// Connect checks the address and connects, the socket may not be there
+// yet: the metrics are then queued until it is.
+func (u *UnixSocket) Connect() error {
+	network, path, err := parseAddress(u.Address)
+	if err != nil {
+		return err
+	}
+	u.network, u.path = network, path
+
+	u.Lock()
+	defer u.Unlock()
+	if err := u.connect(); err != nil {
+		service.VLogger.Warn("unix socket unreachable, metrics queued", zap.String("address", u.Address), zap.Error(err))
+	}
+	return nil
+}
+
+// parseAddress splits the address in its network and path.
+func parseAddress(address string) (string, string, error) {
+	i := strings.Index(address, "://")
+	if i < 0 {
+		return "", "", fmt.Errorf("invalid address %s, must be unix:///path or unixgram:///path", address)
+	}
+	network, path := address[:i], address[i+3:]
+	if network != "unix" && network != "unixgram" {
+		return "", "", fmt.Errorf("invalid address %s, can be: \"unix://\", \"unixgram://\"", address)
+	}
+	if path == "" {
+		return "", "", errors.New("address path is required")
+	}
+	return network, path, nil
+}
+
+// connect dials the socket, the caller holds the lock.
+func (u *UnixSocket) connect() error {
+	conn, err := net.DialTimeout(u.network, u.path, u.Timeout.Duration)
+	if err != nil {
+		return err
+	}
+	u.conn = conn
+	return nil
+}
+
+func (u *UnixSocket) Close() error {
+	u.Lock()
+	defer u.Unlock()
+	if u.conn != nil {
+		err := u.conn.Close()
+		u.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Write sends the queued lines then the metrics. While the socket is
+// unreachable the lines are queued, a line whose write failed midway is
+// sent again whole, so the peer may get a truncated line first.
+func (u *UnixSocket) Write(metrics service.Metrics) error {
+	lines := make([][]byte, 0, len(metrics.Data))
+	for _, metric := range metrics.Data {
+		line, err := u.serializer.Serialize(metric)
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 || line[len(line)-1] != '\n' {
+			line = append(line, '\n')
+		}
+		lines = append(lines, line)
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	u.queue = append(u.queue, lines...)
+	if u.conn == nil {
+		if err := u.connect(); err != nil {
+			u.trim()
+			return nil
+		}
+		service.VLogger.Info("unix socket connected", zap.String("address", u.Address), zap.Int("queued", len(u.queue)))
+	}
+
+	for len(u.queue) > 0 {
+		u.conn.SetWriteDeadline(time.Now().Add(u.Timeout.Duration))
+		if _, err := u.conn.Write(u.queue[0]); err != nil {
+			service.VLogger.Warn("unix socket write failed, metrics queued", zap.String("address", u.Address), zap.Error(err))
+			u.conn.Close()
+			u.conn = nil
+			u.trim()
+			return nil
+		}
+		u.queue[0] = nil
+		u.queue = u.queue[1:]
+	}
+	u.queue = nil
+	return nil
+}
+
+// trim drops the oldest queued lines over MaxQueued, once the socket is
+// unreachable. The caller holds the lock.
+func (u *UnixSocket) trim() {
+	if over := len(u.queue) - u.MaxQueued; over > 0 {
+		if u.stats != nil {
+			u.stats.Dropped(over)
+		}
+		service.VLogger.Warn("unix socket queue full, metrics dropped", zap.Int("dropped", over))
+		u.queue = append(u.queue[:0], u.queue[over:]...)
+	}
+}
+
+func (u *UnixSocket) Init(stop chan bool) {
+	if err := u.Connect(); err != nil {
+		log.Fatal("UnixSocket Connect failed, err message is ", err)
+	}
+}
+
+func (u *UnixSocket) Start() {
+
+}
+
+func (u *UnixSocket) Compute(metrics service.Metrics) error {
+	return u.Write(metrics)
+}
+
+func init() {
+	service.AddMetricOutput("unixsocket", &UnixSocket{
+		MaxQueued: 10000,
+		Timeout:   misc.Duration{Duration: 5 * time.Second},
+	})
+}
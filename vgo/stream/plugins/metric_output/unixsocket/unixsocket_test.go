@@ -0,0 +1,249 @@
+package unixsocket
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+// lineSerializer serializes the metrics as their name and host, the
+// metrics named "nl" with their own newline.
+type lineSerializer struct{}
+
+func (lineSerializer) Serialize(m *service.MetricData) ([]byte, error) {
+	line := m.Name + " host=" + m.Tags["host"]
+	if m.Name == "nl" {
+		line += "\n"
+	}
+	return []byte(line), nil
+}
+
+func (lineSerializer) SerializeBatch(metrics service.Metrics) ([]byte, error) {
+	return nil, nil
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "vgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func newUnixSocket(t *testing.T, address string) *UnixSocket {
+	u := &UnixSocket{Address: address, MaxQueued: 100, Timeout: misc.Duration{Duration: 5 * time.Second}}
+	u.SetSerializer(lineSerializer{})
+	if err := u.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func metrics(names ...string) service.Metrics {
+	var m service.Metrics
+	for i, name := range names {
+		m.Data = append(m.Data, &service.MetricData{
+			Name:   name,
+			Tags:   map[string]string{"host": string('a' + byte(i))},
+			Fields: map[string]interface{}{"value": 1.0},
+		})
+	}
+	return m
+}
+
+// collector accepts the connections of the stream socket, their lines
+// are sent to lines.
+type collector struct {
+	net.Listener
+	lines chan string
+
+	sync.Mutex
+	conns []net.Conn
+}
+
+func listen(t *testing.T, path string) *collector {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &collector{Listener: ln, lines: make(chan string, 100)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Lock()
+			c.conns = append(c.conns, conn)
+			c.Unlock()
+			go func() {
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					c.lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+	return c
+}
+
+// Close stops the collector, its connections included.
+func (c *collector) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	return c.Listener.Close()
+}
+
+// expect reads the lines from the channel.
+func expect(t *testing.T, lines chan string, want ...string) {
+	for _, w := range want {
+		select {
+		case line := <-lines:
+			if line != w {
+				t.Errorf("got line %q, want %q", line, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("line %q not received", w)
+		}
+	}
+	select {
+	case line := <-lines:
+		t.Errorf("got unexpected line %q", line)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestStream(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "collector.sock")
+	c := listen(t, path)
+	defer c.Close()
+
+	u := newUnixSocket(t, "unix://"+path)
+	defer u.Close()
+	// a newline per metric, not doubled when the serializer writes it
+	if err := u.Write(metrics("cpu", "nl", "mem")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c.lines, "cpu host=a", "nl host=b", "mem host=c")
+}
+
+func TestDatagram(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "collector.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	u := newUnixSocket(t, "unixgram://"+path)
+	defer u.Close()
+	if err := u.Write(metrics("cpu", "mem")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a datagram per metric
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1024)
+	for _, want := range []string{"cpu host=a\n", "mem host=b\n"} {
+		n, _, err := conn.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b[:n]) != want {
+			t.Errorf("got datagram %q, want %q", b[:n], want)
+		}
+	}
+}
+
+func TestQueuedUntilConnected(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "collector.sock")
+
+	// the socket isn't there yet, the oldest metrics over max_queued are
+	// dropped
+	u := newUnixSocket(t, "unix://"+path)
+	defer u.Close()
+	u.MaxQueued = 2
+	if err := u.Write(metrics("cpu", "mem", "disk")); err != nil {
+		t.Fatal(err)
+	}
+	if len(u.queue) != 2 {
+		t.Fatalf("got %d metrics queued, want 2", len(u.queue))
+	}
+
+	// the queued metrics are sent once connected, they're not dropped for
+	// the new ones
+	c := listen(t, path)
+	defer c.Close()
+	if err := u.Write(metrics("net")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c.lines, "mem host=b", "disk host=c", "net host=a")
+	if len(u.queue) != 0 {
+		t.Errorf("got %d metrics queued, want none", len(u.queue))
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "collector.sock")
+	c := listen(t, path)
+
+	u := newUnixSocket(t, "unix://"+path)
+	defer u.Close()
+	if err := u.Write(metrics("cpu")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c.lines, "cpu host=a")
+
+	// the collector restarts, the metrics written meanwhile are queued
+	c.Close()
+	if err := u.Write(metrics("mem")); err != nil {
+		t.Fatal(err)
+	}
+	if len(u.queue) != 1 || u.conn != nil {
+		t.Fatalf("got %d metrics queued, want the write to the closed socket queued", len(u.queue))
+	}
+
+	c = listen(t, path)
+	defer c.Close()
+	if err := u.Write(metrics("disk")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c.lines, "mem host=a", "disk host=a")
+}
+
+func TestConnectInvalid(t *testing.T) {
+	for _, address := range []string{
+		"/var/run/collector.sock",
+		"tcp://localhost:8094",
+		"unix://",
+	} {
+		u := &UnixSocket{Address: address}
+		if err := u.Connect(); err == nil {
+			t.Errorf("invalid address %s accepted", address)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package victoriametrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/plugins/serializer/influx"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+const (
+	// influxPath receives the InfluxDB line protocol
+	influxPath = "/write"
+	// importPath receives the native JSON lines of VictoriaMetrics
+	importPath = "/api/v1/import"
+)
+
+// VictoriaMetrics writes the metrics to VictoriaMetrics, in the InfluxDB
+// line protocol or in its native import format. VictoriaMetrics creates the
+// series on the fly, so unlike the InfluxDB output there is no database to
+// create.
+type VictoriaMetrics struct {
+	// URLs of the VictoriaMetrics servers, the writes fail over to the next
+	// one in turn
+	URLs []string `toml:"urls"`
+	// Format is "influx" for the /write endpoint or "import" for the native
+	// /api/v1/import endpoint
+	Format string
+	// Database is added by VictoriaMetrics as the "db" label of the influx
+	// format series
+	Database string
+	// Gzip compresses the requests
+	Gzip        bool
+	BearerToken string
+	Username    string
+	Password    string
+	Timeout     misc.Duration
+	SSLCA       string `toml:"ssl_ca"`
+	SSLCert     string `toml:"ssl_cert"`
+	SSLKey      string `toml:"ssl_key"`
+	// InsecureSkipVerify skips the chain and host verification
+	InsecureSkipVerify bool
+
+	serializer *influx.InfluxSerializer
+	client     *http.Client
+}
+
+// series is a line of the import format.
+type series struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []float64         `json:"values"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+var sampleConfig = `
+  ## VictoriaMetrics servers, a failed write is retried on the next one
+  urls = ["http://localhost:8428"]
+  ## "influx" writes the line protocol to /write, "import" writes the
+  ## native JSON lines to /api/v1/import
+  # format = "influx"
+  ## Added as the "db" label of the influx format series
+  # database = ""
+  ## Compress the requests
+  # gzip = false
+
+  ## Bearer token, or else the basic auth credentials
+  # bearer_token = ""
+  # username = ""
+  # password = ""
+  # timeout = "5s"
+
+  ## Optional SSL Config
+  # ssl_ca = "/etc/vgo/ca.pem"
+  # ssl_cert = "/etc/vgo/cert.pem"
+  # ssl_key = "/etc/vgo/key.pem"
+  ## Use SSL but skip chain & host verification
+  # insecure_skip_verify = false
+`
+
+func (v *VictoriaMetrics) Connect() error {
+	if len(v.URLs) == 0 {
+		return errors.New("urls are required")
+	}
+	for _, u := range v.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return fmt.Errorf("invalid url %s, %s", u, err)
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return fmt.Errorf("invalid url %s, the scheme must be http or https", u)
+		}
+	}
+	if v.Format != "influx" && v.Format != "import" {
+		return fmt.Errorf("invalid format %s, can be: \"influx\", \"import\"", v.Format)
+	}
+
+	tlsConfig, err := misc.GetTLSConfig(v.SSLCert, v.SSLKey, v.SSLCA, v.InsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+
+	v.serializer = &influx.InfluxSerializer{}
+	v.client = &http.Client{
+		Timeout: v.Timeout.Duration,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	rand.Seed(time.Now().UnixNano())
+	return nil
+}
+
+func (v *VictoriaMetrics) Close() error {
+	return nil
+}
+
+func (v *VictoriaMetrics) Write(metrics service.Metrics) error {
+	return v.WriteContext(context.Background(), metrics)
+}
+
+// WriteContext sends the metrics to one of the urls, starting with a random
+// one and trying the next ones until a write succeeds.
+func (v *VictoriaMetrics) WriteContext(ctx context.Context, metrics service.Metrics) error {
+	if len(metrics.Data) == 0 {
+		return nil
+	}
+
+	body, err := v.encode(metrics)
+	if err != nil {
+		return err
+	}
+
+	start := rand.Intn(len(v.URLs))
+	for n := range v.URLs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		u := v.URLs[(start+n)%len(v.URLs)]
+		if err = v.send(ctx, u, body); err == nil {
+			return nil
+		}
+		service.VLogger.Error("VictoriaMetrics Write",
+			zap.String("url", u),
+			zap.Error(err),
+		)
+	}
+	return errors.New("could not write to any VictoriaMetrics server")
+}
+
+// encode returns the body of the request, compressed with Gzip.
+func (v *VictoriaMetrics) encode(metrics service.Metrics) ([]byte, error) {
+	var b []byte
+	var err error
+	if v.Format == "import" {
+		b, err = encodeImport(metrics)
+	} else {
+		b, err = v.serializer.SerializeBatch(metrics)
+	}
+	if err != nil || !v.Gzip {
+		return b, err
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeImport encodes the metrics as the JSON lines of /api/v1/import, one
+// line per numeric field named <metric>_<field> like the series of the
+// influx format. The non numeric fields are dropped.
+func encodeImport(metrics service.Metrics) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, metric := range metrics.Data {
+		keys := make([]string, 0, len(metric.Fields))
+		for k := range metric.Fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			value, ok := service.ValueToFloat(metric.Fields[k])
+			if !ok {
+				continue
+			}
+			labels := make(map[string]string, len(metric.Tags)+1)
+			for tk, tv := range metric.Tags {
+				labels[tk] = tv
+			}
+			labels["__name__"] = metric.Name + "_" + k
+
+			s := &series{
+				Metric:     labels,
+				Values:     []float64{value},
+				Timestamps: []int64{metric.Time.UnixNano() / int64(time.Millisecond)},
+			}
+			if err := enc.Encode(s); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// send posts the body to the endpoint of the format on the url.
+func (v *VictoriaMetrics) send(ctx context.Context, u string, body []byte) error {
+	req, err := http.NewRequest("POST", v.endpoint(u), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if v.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if v.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+v.BearerToken)
+	} else if v.Username != "" {
+		req.SetBasicAuth(v.Username, v.Password)
+	}
+
+	resp, err := v.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %d, %s", resp.StatusCode, string(b))
+	}
+	return nil
+}
+
+// endpoint returns the write endpoint of the url for the format.
+func (v *VictoriaMetrics) endpoint(u string) string {
+	u = strings.TrimRight(u, "/")
+	if v.Format == "import" {
+		return u + importPath
+	}
+	if v.Database != "" {
+		return u + influxPath + "?db=" + url.QueryEscape(v.Database)
+	}
+	return u + influxPath
+}
+
+func (v *VictoriaMetrics) Init(stop chan bool) {
+	if err := v.Connect(); err != nil {
+		log.Fatal("VictoriaMetrics Connect failed, err message is ", err)
+	}
+}
+
+func (v *VictoriaMetrics) Start() {
+
+}
+
+// ComputeContext writes the metrics, aborted when ctx is done.
+func (v *VictoriaMetrics) ComputeContext(ctx context.Context, metrics service.Metrics) error {
+	return v.WriteContext(ctx, metrics)
+}
+
+func (v *VictoriaMetrics) Compute(metrics service.Metrics) error {
+	return v.Write(metrics)
+}
+
+func init() {
+	service.AddMetricOutput("victoriametrics", &VictoriaMetrics{
+		Format:  "influx",
+		Timeout: misc.Duration{Duration: 5 * time.Second},
+	})
+}
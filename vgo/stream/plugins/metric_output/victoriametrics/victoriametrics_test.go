@@ -0,0 +1,287 @@
+package victoriametrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+// request is a request received by the mock server
+type request struct {
+	path     string
+	query    string
+	encoding string
+	auth     string
+	body     string
+}
+
+// mockServer is a VictoriaMetrics answering status to every request.
+type mockServer struct {
+	*httptest.Server
+
+	sync.Mutex
+	status   int
+	requests []request
+}
+
+func newMockServer(status int) *mockServer {
+	s := &mockServer{status: status}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+func (s *mockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ = ioutil.ReadAll(zr)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.requests = append(s.requests, request{
+		path:     r.URL.Path,
+		query:    r.URL.RawQuery,
+		encoding: r.Header.Get("Content-Encoding"),
+		auth:     r.Header.Get("Authorization"),
+		body:     string(body),
+	})
+	w.WriteHeader(s.status)
+}
+
+func (s *mockServer) received() []request {
+	s.Lock()
+	defer s.Unlock()
+	return append([]request(nil), s.requests...)
+}
+
+func newVictoriaMetrics(t *testing.T, format string, urls ...string) *VictoriaMetrics {
+	v := &VictoriaMetrics{
+		URLs:    urls,
+		Format:  format,
+		Timeout: misc.Duration{Duration: 5 * time.Second},
+	}
+	if err := v.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+var testMetrics = service.Metrics{Data: []*service.MetricData{
+	{
+		Name:   "cpu",
+		Tags:   map[string]string{"host": "a"},
+		Fields: map[string]interface{}{"idle": 98.5, "count": int64(3), "state": "ok", "up": true},
+		Time:   time.Unix(1500000000, 0),
+	},
+	{
+		Name:   "mem",
+		Fields: map[string]interface{}{"used": int64(2)},
+		Time:   time.Unix(1500000001, 0),
+	},
+}}
+
+func TestEndpoint(t *testing.T) {
+	for _, tt := range []struct {
+		format   string
+		database string
+		url      string
+		want     string
+	}{
+		{"influx", "", "http://vm:8428", "http://vm:8428/write"},
+		{"influx", "", "http://vm:8428/", "http://vm:8428/write"},
+		{"influx", "metrics db", "http://vm:8428", "http://vm:8428/write?db=metrics+db"},
+		// the cluster urls have a path
+		{"influx", "", "http://vminsert:8480/insert/0/influx", "http://vminsert:8480/insert/0/influx/write"},
+		{"import", "", "http://vm:8428", "http://vm:8428/api/v1/import"},
+		// the database is a label of the influx format only
+		{"import", "metrics", "http://vm:8428/", "http://vm:8428/api/v1/import"},
+	} {
+		v := &VictoriaMetrics{Format: tt.format, Database: tt.database}
+		if got := v.endpoint(tt.url); got != tt.want {
+			t.Errorf("%s %q, got endpoint %s, want %s", tt.format, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestInfluxPayload(t *testing.T) {
+	s := newMockServer(http.StatusNoContent)
+	defer s.Close()
+	v := newVictoriaMetrics(t, "influx", s.URL)
+	v.Database = "vgo"
+
+	if err := v.Write(testMetrics); err != nil {
+		t.Fatal(err)
+	}
+	reqs := s.received()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d requests, want 1", len(reqs))
+	}
+	if reqs[0].path != "/write" || reqs[0].query != "db=vgo" {
+		t.Errorf("got request to %s?%s, want /write?db=vgo", reqs[0].path, reqs[0].query)
+	}
+	want := "cpu,host=a count=3i,idle=98.5,state=\"ok\",up=true 1500000000000000000\n" +
+		"mem used=2i 1500000001000000000\n"
+	if reqs[0].body != want {
+		t.Errorf("got body %q, want %q", reqs[0].body, want)
+	}
+}
+
+func TestImportPayload(t *testing.T) {
+	s := newMockServer(http.StatusNoContent)
+	defer s.Close()
+	v := newVictoriaMetrics(t, "import", s.URL)
+
+	if err := v.Write(testMetrics); err != nil {
+		t.Fatal(err)
+	}
+	reqs := s.received()
+	if len(reqs) != 1 || reqs[0].path != "/api/v1/import" {
+		t.Fatalf("got requests %v, want one to /api/v1/import", reqs)
+	}
+
+	var got []series
+	dec := json.NewDecoder(strings.NewReader(reqs[0].body))
+	for dec.More() {
+		var s series
+		if err := dec.Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, s)
+	}
+	// a line per numeric field in order, the string field dropped
+	want := []series{
+		{map[string]string{"__name__": "cpu_count", "host": "a"}, []float64{3}, []int64{1500000000000}},
+		{map[string]string{"__name__": "cpu_idle", "host": "a"}, []float64{98.5}, []int64{1500000000000}},
+		{map[string]string{"__name__": "cpu_up", "host": "a"}, []float64{1}, []int64{1500000000000}},
+		{map[string]string{"__name__": "mem_used"}, []float64{2}, []int64{1500000001000}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got series %v, want %v", got, want)
+	}
+	// the metric labels aren't changed
+	if _, ok := testMetrics.Data[0].Tags["__name__"]; ok {
+		t.Error("metric tags changed by the encoding")
+	}
+}
+
+func TestGzip(t *testing.T) {
+	s := newMockServer(http.StatusNoContent)
+	defer s.Close()
+	v := newVictoriaMetrics(t, "influx", s.URL)
+	v.Gzip = true
+
+	if err := v.Write(testMetrics); err != nil {
+		t.Fatal(err)
+	}
+	reqs := s.received()
+	if len(reqs) != 1 || reqs[0].encoding != "gzip" {
+		t.Fatalf("got requests %v, want one gzipped", reqs)
+	}
+	if !strings.HasPrefix(reqs[0].body, "cpu,host=a ") {
+		t.Errorf("got body %q once uncompressed", reqs[0].body)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	s := newMockServer(http.StatusNoContent)
+	defer s.Close()
+
+	v := newVictoriaMetrics(t, "influx", s.URL)
+	v.Username, v.Password = "vgo", "s3cret"
+	if err := v.Write(testMetrics); err != nil {
+		t.Fatal(err)
+	}
+	// the token wins over the basic auth
+	v.BearerToken = "t0ken"
+	if err := v.Write(testMetrics); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := s.received()
+	if len(reqs) != 2 {
+		t.Fatalf("got %d requests, want 2", len(reqs))
+	}
+	if want := "Basic dmdvOnMzY3JldA=="; reqs[0].auth != want {
+		t.Errorf("got authorization %q, want %q", reqs[0].auth, want)
+	}
+	if want := "Bearer t0ken"; reqs[1].auth != want {
+		t.Errorf("got authorization %q, want %q", reqs[1].auth, want)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	down := newMockServer(http.StatusServiceUnavailable)
+	defer down.Close()
+	up := newMockServer(http.StatusNoContent)
+	defer up.Close()
+	v := newVictoriaMetrics(t, "influx", down.URL, up.URL)
+
+	// whichever server is tried first, the write ends on the one up
+	for n := 0; n < 50; n++ {
+		if err := v.Write(testMetrics); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(up.received()); n != 50 {
+		t.Errorf("%d writes on the server up, want 50", n)
+	}
+	if n := len(down.received()); n == 0 || n == 50 {
+		t.Errorf("%d writes tried on the server down, want the start server random", n)
+	}
+
+	// the only server down
+	v = newVictoriaMetrics(t, "influx", down.URL)
+	if err := v.Write(testMetrics); err == nil {
+		t.Error("no error when every server is down")
+	}
+}
+
+func TestNoDatabaseCreated(t *testing.T) {
+	s := newMockServer(http.StatusNoContent)
+	defer s.Close()
+	v := newVictoriaMetrics(t, "influx", s.URL)
+	v.Database = "vgo"
+	v.Init(nil)
+
+	if err := v.Write(testMetrics); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range s.received() {
+		if r.path != "/write" {
+			t.Errorf("got request to %s, want only the writes", r.path)
+		}
+	}
+}
+
+func TestConnectInvalid(t *testing.T) {
+	for _, v := range []*VictoriaMetrics{
+		{Format: "influx"},
+		{URLs: []string{"udp://vm:8089"}, Format: "influx"},
+		{URLs: []string{"http://vm:8428"}, Format: "prometheus"},
+	} {
+		if err := v.Connect(); err == nil {
+			t.Errorf("invalid config %+v accepted", v)
+		}
+	}
+}
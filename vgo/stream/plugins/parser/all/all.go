@@ -0,0 +1,6 @@
+package all
+
+import (
+	_ "github.com/corego/vgo/vgo/stream/plugins/parser/influx"
+	_ "github.com/corego/vgo/vgo/stream/plugins/parser/json"
+)
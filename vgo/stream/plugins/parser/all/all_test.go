@@ -0,0 +1,110 @@
+package all
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/corego/vgo/vgo/stream/plugins/serializer/all"
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// the fields of every type, the data formats in floatNumbers change the
+// integers into floats
+var testMetrics = []*service.MetricData{
+	{
+		Name:   "cpu",
+		Tags:   map[string]string{"host": "server01", "region": "us west"},
+		Fields: map[string]interface{}{"idle": 98.5, "state": "ok", "up": true, "procs": int64(312)},
+		Time:   time.Unix(1500000000, 0),
+	},
+	{
+		Name:   "mem",
+		Tags:   map[string]string{"host": "server02"},
+		Fields: map[string]interface{}{"used": 1.5},
+		Time:   time.Unix(1500000001, 0),
+	},
+}
+
+// floatNumbers are the data formats whose numbers are all read as float64
+var floatNumbers = map[string]bool{"json": true}
+
+// expected returns the metrics the parser of the data format reads back.
+func expected(name string, metrics []*service.MetricData) []*service.MetricData {
+	if !floatNumbers[name] {
+		return metrics
+	}
+	want := make([]*service.MetricData, 0, len(metrics))
+	for _, m := range metrics {
+		fields := make(map[string]interface{}, len(m.Fields))
+		for k, v := range m.Fields {
+			if i, ok := v.(int64); ok {
+				v = float64(i)
+			}
+			fields[k] = v
+		}
+		want = append(want, &service.MetricData{Name: m.Name, Tags: m.Tags, Fields: fields, Time: m.Time})
+	}
+	return want
+}
+
+// TestRoundTrip checks every parser reads back the metrics written by the
+// serializer of its data format.
+func TestRoundTrip(t *testing.T) {
+	if len(service.Parsers) == 0 {
+		t.Fatal("no parser registered")
+	}
+	for name := range service.Parsers {
+		if _, ok := service.Serializers[name]; !ok {
+			t.Errorf("parser %s without serializer", name)
+			continue
+		}
+		parser, err := service.NewParser(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serializer, err := service.NewSerializer(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		batch, err := serializer.SerializeBatch(service.Metrics{Data: testMetrics})
+		if err != nil {
+			t.Fatalf("%s, %s", name, err)
+		}
+		metrics, err := parser.Parse(batch)
+		if err != nil {
+			t.Fatalf("%s, %s", name, err)
+		}
+		want := expected(name, testMetrics)
+		checkMetrics(t, name+" batch", metrics, want)
+
+		metrics = metrics[:0]
+		for _, m := range testMetrics {
+			b, err := serializer.Serialize(m)
+			if err != nil {
+				t.Fatalf("%s, %s", name, err)
+			}
+			parsed, err := parser.ParseLine(string(b))
+			if err != nil {
+				t.Fatalf("%s, %s", name, err)
+			}
+			metrics = append(metrics, parsed)
+		}
+		checkMetrics(t, name+" line", metrics, want)
+	}
+}
+
+func checkMetrics(t *testing.T, name string, got, want []*service.MetricData) {
+	if len(got) != len(want) {
+		t.Errorf("%s, got %d metrics, want %d", name, len(got), len(want))
+		return
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.Name != w.Name || !reflect.DeepEqual(g.Tags, w.Tags) ||
+			!reflect.DeepEqual(g.Fields, w.Fields) || !g.Time.Equal(w.Time) {
+			t.Errorf("%s, metric %d got %+v, want %+v", name, i, g, w)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package influx
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/corego/vgo/mecury/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// InfluxParser parses metrics in the InfluxDB line protocol.
+type InfluxParser struct {
+}
+
+// Parse returns the metrics of the lines in buf. If any line fails to parse,
+// a non-nil error is returned in addition to the metrics that parsed
+// successfully.
+func (p *InfluxParser) Parse(buf []byte) ([]*service.MetricData, error) {
+	// parse even if the buffer begins with a newline
+	buf = bytes.TrimPrefix(buf, []byte("\n"))
+	points, err := misc.ParsePoints(buf)
+
+	metrics := make([]*service.MetricData, 0, len(points))
+	for _, pt := range points {
+		metrics = append(metrics, &service.MetricData{
+			Name:   pt.Name(),
+			Tags:   pt.Tags(),
+			Fields: pt.Fields(),
+			Time:   pt.Time(),
+		})
+	}
+	return metrics, err
+}
+
+func (p *InfluxParser) ParseLine(line string) (*service.MetricData, error) {
+	metrics, err := p.Parse([]byte(line + "\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(metrics) < 1 {
+		return nil, fmt.Errorf("can not parse the line: %s, for data format: influx", line)
+	}
+	return metrics[0], nil
+}
+
+func init() {
+	service.AddParser("influx", func() service.Parser {
+		return &InfluxParser{}
+	})
+}
@@ -0,0 +1,164 @@
+package json
+
+import (
+	"bytes"
+	ejson "encoding/json"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+const (
+	// flattenDepth is the nesting level the flattened values are dropped past
+	flattenDepth = 5
+	// warnSample logs one collision out of warnSample
+	warnSample = 100
+)
+
+// JSONParser parses the metrics written by the json serializer, either
+// single metric objects (one or more, like newline delimited JSON) or
+// batches of metrics:
+//
+//	{"name":"cpu","tags":{},"fields":{},"timestamp":1480000000}
+//	{"metrics":[{"name":"cpu","tags":{},"fields":{},"timestamp":1480000000}]}
+//
+// The timestamps are in TimestampUnits, seconds by default. The numbers are
+// float64: an integer field comes back as a float. The object and array
+// fields are dropped, kept or flattened as set by Nested.
+type JSONParser struct {
+	TimestampUnits time.Duration
+	Nested         string
+
+	// collisions is the number of fields replaced by a flattened one,
+	// accessed atomically
+	collisions uint64
+}
+
+type object struct {
+	Name      string                 `json:"name"`
+	Tags      map[string]string      `json:"tags"`
+	Fields    map[string]interface{} `json:"fields"`
+	Timestamp int64                  `json:"timestamp"`
+
+	Metrics []*object `json:"metrics"`
+}
+
+func (p *JSONParser) metric(o *object) (*service.MetricData, error) {
+	if o.Name == "" {
+		return nil, fmt.Errorf("json metric without name")
+	}
+	if o.Tags == nil {
+		o.Tags = make(map[string]string)
+	}
+	if o.Fields == nil {
+		o.Fields = make(map[string]interface{})
+	}
+
+	if p.Nested == "flatten" {
+		if n := service.FlattenFields(o.Fields, ".", flattenDepth); n > 0 {
+			p.collide(o.Name, n)
+		}
+	}
+
+	// the fields keep their string and bool values, the null values and
+	// unless kept the array and object values have no line protocol type
+	// and are dropped
+	for k, v := range o.Fields {
+		switch v.(type) {
+		case string, bool, float64:
+		case map[string]interface{}, []interface{}:
+			if p.Nested != "keep" {
+				delete(o.Fields, k)
+			}
+		default:
+			delete(o.Fields, k)
+		}
+	}
+
+	t := time.Now()
+	if o.Timestamp != 0 {
+		t = time.Unix(0, o.Timestamp*int64(p.TimestampUnits))
+	}
+	return &service.MetricData{
+		Name:   o.Name,
+		Tags:   o.Tags,
+		Fields: o.Fields,
+		Time:   t,
+	}, nil
+}
+
+// collide counts the fields replaced by a flattened one, and logs a sample
+// of them.
+func (p *JSONParser) collide(name string, n int) {
+	total := atomic.AddUint64(&p.collisions, uint64(n))
+	// the first ones, then once every warnSample
+	if prev := total - uint64(n); prev > 0 && prev/warnSample == total/warnSample {
+		return
+	}
+	service.VLogger.Warn("json parser, fields replaced by a flattened one",
+		zap.String("metric", name),
+		zap.Int("count", n),
+		zap.Int64("collisions", int64(total)),
+	)
+}
+
+// SetNested sets what's done with the object and array fields.
+func (p *JSONParser) SetNested(mode string) {
+	p.Nested = mode
+}
+
+// SetTimestampUnits sets the unit of the timestamps.
+func (p *JSONParser) SetTimestampUnits(units time.Duration) {
+	p.TimestampUnits = units
+}
+
+func (p *JSONParser) Parse(buf []byte) ([]*service.MetricData, error) {
+	var metrics []*service.MetricData
+
+	dec := ejson.NewDecoder(bytes.NewReader(buf))
+	for {
+		o := &object{}
+		err := dec.Decode(o)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return metrics, fmt.Errorf("unable to parse out as JSON, %s", err)
+		}
+
+		objects := o.Metrics
+		if objects == nil {
+			objects = []*object{o}
+		}
+		for _, obj := range objects {
+			m, err := p.metric(obj)
+			if err != nil {
+				return metrics, err
+			}
+			metrics = append(metrics, m)
+		}
+	}
+	return metrics, nil
+}
+
+func (p *JSONParser) ParseLine(line string) (*service.MetricData, error) {
+	metrics, err := p.Parse([]byte(line))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(metrics) < 1 {
+		return nil, fmt.Errorf("can not parse the line: %s, for data format: json", line)
+	}
+	return metrics[0], nil
+}
+
+func init() {
+	service.AddParser("json", func() service.Parser {
+		return &JSONParser{TimestampUnits: time.Second, Nested: "drop"}
+	})
+}
@@ -0,0 +1,111 @@
+package json
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+func TestParse(t *testing.T) {
+	p := &JSONParser{TimestampUnits: time.Second}
+	metrics, err := p.Parse([]byte(`{"name":"cpu","tags":{"host":"a"},"fields":{"idle":1.5,"list":[1],"none":null},"timestamp":1500000000}
+{"metrics":[{"name":"mem","fields":{"used":2},"timestamp":1500000001},{"name":"disk","fields":{"free":3}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 3 {
+		t.Fatalf("got %d metrics, want 3", len(metrics))
+	}
+
+	cpu := metrics[0]
+	if cpu.Name != "cpu" || cpu.Tags["host"] != "a" || !cpu.Time.Equal(time.Unix(1500000000, 0)) {
+		t.Errorf("bad metric %+v", cpu)
+	}
+	if len(cpu.Fields) != 1 || cpu.Fields["idle"] != 1.5 {
+		t.Errorf("the array and null fields aren't dropped, %v", cpu.Fields)
+	}
+	if mem := metrics[1]; mem.Name != "mem" || mem.Tags == nil || mem.Fields["used"] != 2.0 {
+		t.Errorf("bad metric %+v", mem)
+	}
+	if disk := metrics[2]; disk.Time.IsZero() {
+		t.Error("metric without timestamp not stamped")
+	}
+}
+
+func TestParseNested(t *testing.T) {
+	line := `{"name":"host","fields":{"idle":1.5,"disk":{"used":10,"io":{"read":2}},"load":[0.5,0.7],"disk.used":1,"none":null}}`
+	for _, tt := range []struct {
+		nested string
+		want   map[string]interface{}
+	}{
+		{"drop", map[string]interface{}{"idle": 1.5, "disk.used": 1.0}},
+		{"keep", map[string]interface{}{
+			"idle":      1.5,
+			"disk":      map[string]interface{}{"used": 10.0, "io": map[string]interface{}{"read": 2.0}},
+			"load":      []interface{}{0.5, 0.7},
+			"disk.used": 1.0,
+		}},
+		// the flattened field replaces the one of the same name
+		{"flatten", map[string]interface{}{
+			"idle":         1.5,
+			"disk.used":    10.0,
+			"disk.io.read": 2.0,
+			"load.0":       0.5,
+			"load.1":       0.7,
+		}},
+	} {
+		p := &JSONParser{TimestampUnits: time.Second}
+		p.SetNested(tt.nested)
+		m, err := p.ParseLine(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m.Fields, tt.want) {
+			t.Errorf("%s, got fields %v, want %v", tt.nested, m.Fields, tt.want)
+		}
+		if tt.nested == "flatten" && p.collisions != 1 {
+			t.Errorf("got %d collisions, want 1", p.collisions)
+		}
+	}
+}
+
+func TestParseTimestampUnits(t *testing.T) {
+	for _, tt := range []struct {
+		units time.Duration
+		ts    string
+	}{
+		{time.Second, "1500000000"},
+		{time.Millisecond, "1500000000123"},
+		{time.Microsecond, "1500000000123456"},
+		{time.Nanosecond, "1500000000123456789"},
+	} {
+		p := &JSONParser{}
+		p.SetTimestampUnits(tt.units)
+		m, err := p.ParseLine(`{"name":"cpu","fields":{"idle":1},"timestamp":` + tt.ts + `}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := time.Unix(1500000000, 123456789).Truncate(tt.units)
+		if !m.Time.Equal(want) {
+			t.Errorf("units %s, got %s, want %s", tt.units, m.Time, want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	p := &JSONParser{TimestampUnits: time.Second}
+	if _, err := p.Parse([]byte(`{"fields":{"idle":1}}`)); err == nil {
+		t.Error("metric without name parsed")
+	}
+	if _, err := p.Parse([]byte(`{"name":`)); err == nil {
+		t.Error("invalid JSON parsed")
+	}
+}
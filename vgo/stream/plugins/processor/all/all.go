@@ -0,0 +1,24 @@
+package all
+
+import (
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/anonymize"
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/cardinality"
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/dedup"
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/enrich"
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/expression"
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/extract"
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/flatten"
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/histogram"
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/join"
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/normalize"
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/predicate"
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/ranges"
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/rename"
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/required_tags"
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/reshape"
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/sample"
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/split"
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/truncate"
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/ttl"
+	_ "github.com/corego/vgo/vgo/stream/plugins/processor/units"
+)
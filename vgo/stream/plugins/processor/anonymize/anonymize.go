@@ -0,0 +1,138 @@
+package anonymize
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// Anonymize replaces the values of sensitive tags by their salted hash, an
+// HMAC keyed by the salt. A value always has the same hash, so the metrics
+// are still grouped by the tag, while the value can't be found back from
+// the hash without the salt.
+type Anonymize struct {
+	// Metrics are the names of the metrics anonymized, globs are
+	// supported, empty anonymizes all of them
+	Metrics []string
+	// Tags are the keys of the tags whose values are hashed
+	Tags []string
+	// Algorithm is "sha256", "sha512", "sha1" or "md5"
+	Algorithm string
+	// SaltFile holds the salt, its surrounding whitespace is ignored
+	SaltFile string
+	// Length is the number of hex characters of the hash kept, all of
+	// them when 0
+	Length int
+	// Passthrough are the values left as they are, like "unknown"
+	Passthrough []string
+
+	filter      service.Filter
+	hash        func() hash.Hash
+	salt        []byte
+	tags        map[string]bool
+	passthrough map[string]bool
+}
+
+var sampleConfig = `
+  ## Metrics anonymized, globs are supported, all of them when empty
+  # metrics = []
+  ## Tags whose values are replaced by their salted hash
+  tags = ["user_id", "email"]
+  ## "sha256", "sha512", "sha1" or "md5"
+  # algorithm = "sha256"
+  ## File holding the salt, keep it secret: the hashes of the known values
+  ## can be computed with it
+  salt_file = "/etc/vgo/anonymize.salt"
+  ## Hex characters of the hash kept, all of them when 0
+  # length = 0
+  ## Values left as they are
+  # passthrough = ["unknown", "anonymous"]
+`
+
+var algorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+func (a *Anonymize) Init() error {
+	if len(a.Tags) == 0 {
+		return errors.New("tags is required")
+	}
+	a.hash = algorithms[a.Algorithm]
+	if a.hash == nil {
+		return fmt.Errorf("invalid algorithm %s, can be: \"sha256\", \"sha512\", \"sha1\", \"md5\"", a.Algorithm)
+	}
+	if a.Length < 0 {
+		return errors.New("length can't be negative")
+	}
+
+	if a.SaltFile == "" {
+		return errors.New("salt_file is required")
+	}
+	salt, err := ioutil.ReadFile(a.SaltFile)
+	if err != nil {
+		return err
+	}
+	a.salt = bytes.TrimSpace(salt)
+	if len(a.salt) == 0 {
+		return fmt.Errorf("salt file %s is empty", a.SaltFile)
+	}
+
+	a.tags = make(map[string]bool, len(a.Tags))
+	for _, tag := range a.Tags {
+		a.tags[tag] = true
+	}
+	a.passthrough = make(map[string]bool, len(a.Passthrough))
+	for _, value := range a.Passthrough {
+		a.passthrough[value] = true
+	}
+
+	a.filter, err = service.CompileFilter(a.Metrics)
+	return err
+}
+
+func (a *Anonymize) Apply(metrics []*service.MetricData) []*service.MetricData {
+	for _, metric := range metrics {
+		if a.filter != nil && !a.filter.Match(metric.Name) {
+			continue
+		}
+		for k, v := range metric.Tags {
+			if !a.tags[k] || a.passthrough[v] {
+				continue
+			}
+			metric.Tags[k] = a.sum(v)
+		}
+	}
+	return metrics
+}
+
+// sum returns the hex HMAC of the value, truncated to Length.
+func (a *Anonymize) sum(value string) string {
+	mac := hmac.New(a.hash, a.salt)
+	mac.Write([]byte(value))
+	sum := hex.EncodeToString(mac.Sum(nil))
+	if a.Length > 0 && a.Length < len(sum) {
+		return sum[:a.Length]
+	}
+	return sum
+}
+
+func init() {
+	service.AddProcessor("anonymize", func() service.Processor {
+		return &Anonymize{
+			Algorithm: "sha256",
+		}
+	})
+}
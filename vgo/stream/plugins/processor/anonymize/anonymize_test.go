@@ -0,0 +1,145 @@
+package anonymize
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// saltFile writes the salt to a temporary file, the returned func removes
+// it.
+func saltFile(t *testing.T, salt string) (string, func()) {
+	dir, err := ioutil.TempDir("", "vgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "salt")
+	if err := ioutil.WriteFile(path, []byte(salt), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func newAnonymize(t *testing.T, salt string, a *Anonymize) *Anonymize {
+	path, clean := saltFile(t, salt)
+	defer clean()
+	a.SaltFile = path
+	if a.Algorithm == "" {
+		a.Algorithm = "sha256"
+	}
+	if err := a.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func login(user string) *service.MetricData {
+	return &service.MetricData{
+		Name:   "login",
+		Tags:   map[string]string{"user_id": user, "host": "web01"},
+		Fields: map[string]interface{}{"count": int64(1)},
+	}
+}
+
+func TestSameHash(t *testing.T) {
+	a := newAnonymize(t, "pepper\n", &Anonymize{Tags: []string{"user_id"}})
+	got := a.Apply([]*service.MetricData{login("alice"), login("bob"), login("alice")})
+
+	// the HMAC of the value keyed by the salt, its whitespace trimmed
+	mac := hmac.New(sha256.New, []byte("pepper"))
+	mac.Write([]byte("alice"))
+	if want := hex.EncodeToString(mac.Sum(nil)); got[0].Tags["user_id"] != want {
+		t.Errorf("got hash %s, want %s", got[0].Tags["user_id"], want)
+	}
+	// the cardinality is kept
+	if got[0].Tags["user_id"] != got[2].Tags["user_id"] {
+		t.Error("same value hashed differently")
+	}
+	if got[0].Tags["user_id"] == got[1].Tags["user_id"] {
+		t.Error("different values hashed the same")
+	}
+	if got[0].Tags["host"] != "web01" {
+		t.Errorf("got host %s, want the other tags unchanged", got[0].Tags["host"])
+	}
+}
+
+func TestDifferentSalts(t *testing.T) {
+	a := newAnonymize(t, "pepper", &Anonymize{Tags: []string{"user_id"}})
+	b := newAnonymize(t, "paprika", &Anonymize{Tags: []string{"user_id"}})
+	x := a.Apply([]*service.MetricData{login("alice")})[0].Tags["user_id"]
+	y := b.Apply([]*service.MetricData{login("alice")})[0].Tags["user_id"]
+	if x == y {
+		t.Error("different salts give the same hash")
+	}
+}
+
+func TestAlgorithmsAndLength(t *testing.T) {
+	for _, tt := range []struct {
+		algorithm string
+		length    int
+		want      int
+	}{
+		{"md5", 0, 32},
+		{"sha1", 0, 40},
+		{"sha256", 0, 64},
+		{"sha512", 0, 128},
+		{"sha256", 16, 16},
+		// longer than the hash
+		{"md5", 100, 32},
+	} {
+		a := newAnonymize(t, "pepper", &Anonymize{Tags: []string{"user_id"}, Algorithm: tt.algorithm, Length: tt.length})
+		full := newAnonymize(t, "pepper", &Anonymize{Tags: []string{"user_id"}, Algorithm: tt.algorithm})
+		got := a.Apply([]*service.MetricData{login("alice")})[0].Tags["user_id"]
+		sum := full.Apply([]*service.MetricData{login("alice")})[0].Tags["user_id"]
+		if len(got) != tt.want || got != sum[:tt.want] {
+			t.Errorf("%s length %d, got %s, want the %d first characters of %s", tt.algorithm, tt.length, got, tt.want, sum)
+		}
+	}
+}
+
+func TestPassthroughAndFilter(t *testing.T) {
+	a := newAnonymize(t, "pepper", &Anonymize{
+		Metrics:     []string{"log*"},
+		Tags:        []string{"user_id"},
+		Passthrough: []string{"anonymous"},
+	})
+	other := login("alice")
+	other.Name = "http"
+	got := a.Apply([]*service.MetricData{login("anonymous"), other, login("alice")})
+	if got[0].Tags["user_id"] != "anonymous" {
+		t.Errorf("got %s, want the passthrough value kept", got[0].Tags["user_id"])
+	}
+	if got[1].Tags["user_id"] != "alice" {
+		t.Errorf("got %s, want the metric not matching kept", got[1].Tags["user_id"])
+	}
+	if got[2].Tags["user_id"] == "alice" {
+		t.Error("value not hashed")
+	}
+}
+
+func TestAnonymizeInvalid(t *testing.T) {
+	salt, clean := saltFile(t, "pepper")
+	defer clean()
+	empty, cleanEmpty := saltFile(t, " \n")
+	defer cleanEmpty()
+
+	for _, a := range []*Anonymize{
+		{Algorithm: "sha256", SaltFile: salt},
+		{Tags: []string{"user_id"}, Algorithm: "crc32", SaltFile: salt},
+		{Tags: []string{"user_id"}, Algorithm: "sha256", SaltFile: salt, Length: -1},
+		{Tags: []string{"user_id"}, Algorithm: "sha256"},
+		{Tags: []string{"user_id"}, Algorithm: "sha256", SaltFile: salt + ".missing"},
+		{Tags: []string{"user_id"}, Algorithm: "sha256", SaltFile: empty},
+		{Tags: []string{"user_id"}, Algorithm: "sha256", SaltFile: salt, Metrics: []string{"[log"}},
+	} {
+		if err := a.Init(); err == nil {
+			t.Errorf("invalid config %+v accepted", a)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package cardinality
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+// warnSample logs one drop out of warnSample
+const warnSample = 1000
+
+// Cardinality limits the number of series, the tag sets, of every metric
+// name within a window. Over MaxCardinality the new series of the name are
+// dropped while the ones already seen keep flowing. The series seen in a
+// window are carried over to the next one: a series is forgotten once it
+// isn't seen for a whole window. Until then it keeps its room, the new
+// series only take the room left by the series of the previous window.
+//
+// The memory is bounded: at most MaxCardinality series hashes are kept per
+// name and per window, and at most MaxNames names, the metrics of the names
+// over it are dropped too.
+type Cardinality struct {
+	MaxCardinality int
+	MaxNames       int
+	Window         misc.Duration
+
+	// dropped is the number of dropped metrics, accessed atomically
+	dropped uint64
+
+	sync.Mutex
+	series      map[string]*generations
+	windowStart time.Time
+}
+
+// generations are the series of a name seen in the current window and in
+// the previous one.
+type generations struct {
+	current  map[uint64]struct{}
+	previous map[uint64]struct{}
+	// carried is the number of series of the previous window seen again
+	carried int
+}
+
+var sampleConfig = `
+  ## Series, tag sets, allowed per metric name within the window
+  max_cardinality = 1000
+  ## Metric names tracked within the window
+  # max_names = 10000
+  ## A series is forgotten once it isn't seen for a whole window
+  # window = "1h"
+`
+
+func (c *Cardinality) Init() error {
+	if c.MaxCardinality <= 0 {
+		return errors.New("max_cardinality must be positive")
+	}
+	if c.MaxNames <= 0 {
+		return errors.New("max_names must be positive")
+	}
+	if c.Window.Duration <= 0 {
+		return errors.New("window must be positive")
+	}
+	c.reset(time.Now())
+	return nil
+}
+
+func (c *Cardinality) Apply(metrics []*service.MetricData) []*service.MetricData {
+	c.Lock()
+	defer c.Unlock()
+
+	if now := time.Now(); now.Sub(c.windowStart) >= c.Window.Duration {
+		c.rotate(now)
+	}
+
+	out := metrics[:0]
+	for _, metric := range metrics {
+		if c.admit(metric) {
+			out = append(out, metric)
+			continue
+		}
+		c.drop(metric)
+	}
+	return out
+}
+
+// admit reports whether the series of the metric is already seen in this
+// window or the previous one, or can still be added.
+func (c *Cardinality) admit(metric *service.MetricData) bool {
+	g, ok := c.series[metric.Name]
+	if !ok {
+		if len(c.series) >= c.MaxNames {
+			return false
+		}
+		g = &generations{current: make(map[uint64]struct{})}
+		c.series[metric.Name] = g
+	}
+
+	h := metric.SeriesHash()
+	if _, ok := g.current[h]; ok {
+		return true
+	}
+	if _, ok := g.previous[h]; ok {
+		g.current[h] = struct{}{}
+		g.carried++
+		return true
+	}
+	// the series of the previous window not seen yet keep their room
+	if len(g.current)+len(g.previous)-g.carried >= c.MaxCardinality {
+		return false
+	}
+	g.current[h] = struct{}{}
+	return true
+}
+
+// drop counts the dropped metric and logs a sample of them.
+func (c *Cardinality) drop(metric *service.MetricData) {
+	n := atomic.AddUint64(&c.dropped, 1)
+	if n%warnSample != 1 {
+		return
+	}
+	service.VLogger.Warn("cardinality limit exceeded, new series dropped",
+		zap.String("metric", metric.Name),
+		zap.Int("max_cardinality", c.MaxCardinality),
+		zap.Int64("dropped", int64(n)),
+	)
+}
+
+// Dropped returns the number of metrics dropped.
+func (c *Cardinality) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+func (c *Cardinality) reset(now time.Time) {
+	c.series = make(map[string]*generations)
+	c.windowStart = now
+}
+
+// rotate starts a new window, the series of the window become the previous
+// ones. After a whole window without metrics every series is forgotten.
+func (c *Cardinality) rotate(now time.Time) {
+	if now.Sub(c.windowStart) >= 2*c.Window.Duration {
+		c.reset(now)
+		return
+	}
+	for name, g := range c.series {
+		if len(g.current) == 0 {
+			delete(c.series, name)
+			continue
+		}
+		g.previous, g.current, g.carried = g.current, make(map[uint64]struct{}), 0
+	}
+	c.windowStart = now
+}
+
+func init() {
+	service.AddProcessor("cardinality", func() service.Processor {
+		return &Cardinality{
+			MaxNames: 10000,
+			Window:   misc.Duration{Duration: time.Hour},
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package cardinality
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+func newCardinality(t *testing.T, max, names int, window time.Duration) *Cardinality {
+	c := &Cardinality{MaxCardinality: max, MaxNames: names, Window: misc.Duration{Duration: window}}
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// series returns a metric of each of the series from to to of the name.
+func series(name string, from, to int) []*service.MetricData {
+	var metrics []*service.MetricData
+	for i := from; i < to; i++ {
+		metrics = append(metrics, &service.MetricData{
+			Name:   name,
+			Tags:   map[string]string{"request_id": fmt.Sprint(i)},
+			Fields: map[string]interface{}{"value": 1.0},
+		})
+	}
+	return metrics
+}
+
+func TestCardinalityLimit(t *testing.T) {
+	c := newCardinality(t, 10, 100, time.Hour)
+
+	if n := len(c.Apply(series("requests", 0, 8))); n != 8 {
+		t.Fatalf("%d of 8 series kept under the limit", n)
+	}
+	// 2 more series fit, the next ones are dropped
+	if n := len(c.Apply(series("requests", 8, 20))); n != 2 {
+		t.Errorf("%d of 12 new series kept, want 2", n)
+	}
+	if n := c.Dropped(); n != 10 {
+		t.Errorf("%d metrics dropped, want 10", n)
+	}
+
+	// the established series keep flowing, the new ones are still dropped
+	if n := len(c.Apply(series("requests", 0, 10))); n != 10 {
+		t.Errorf("%d of the 10 established series kept", n)
+	}
+	if n := len(c.Apply(series("requests", 15, 16))); n != 0 {
+		t.Error("new series kept over the limit")
+	}
+
+	// the limit is per name
+	if n := len(c.Apply(series("errors", 0, 10))); n != 10 {
+		t.Errorf("%d of 10 series of another name kept", n)
+	}
+}
+
+func TestCardinalityMaxNames(t *testing.T) {
+	c := newCardinality(t, 10, 2, time.Hour)
+	for _, name := range []string{"a", "b", "c"} {
+		kept := len(c.Apply(series(name, 0, 1)))
+		if want := map[string]int{"a": 1, "b": 1, "c": 0}[name]; kept != want {
+			t.Errorf("name %s, %d metrics kept, want %d", name, kept, want)
+		}
+	}
+}
+
+func TestCardinalityWindow(t *testing.T) {
+	c := newCardinality(t, 5, 100, 50*time.Millisecond)
+	c.Apply(series("requests", 0, 5))
+	if n := len(c.Apply(series("requests", 5, 10))); n != 0 {
+		t.Fatalf("%d new series kept over the limit", n)
+	}
+
+	// the series of the previous window keep their room in the new one
+	time.Sleep(60 * time.Millisecond)
+	if n := len(c.Apply(series("requests", 5, 10))); n != 0 {
+		t.Errorf("%d new series kept over the carried series", n)
+	}
+	if n := len(c.Apply(series("requests", 0, 3))); n != 3 {
+		t.Errorf("%d of 3 carried series kept", n)
+	}
+
+	// the series not seen for a whole window leave room for new ones
+	time.Sleep(60 * time.Millisecond)
+	if n := len(c.Apply(series("requests", 5, 10))); n != 2 {
+		t.Errorf("%d of 5 new series kept, want 2", n)
+	}
+	if n := len(c.Apply(series("requests", 0, 3))); n != 3 {
+		t.Errorf("%d of 3 carried series kept", n)
+	}
+
+	// every series is forgotten after a whole window without metrics
+	time.Sleep(110 * time.Millisecond)
+	if n := len(c.Apply(series("requests", 10, 15))); n != 5 {
+		t.Errorf("%d of 5 series kept after an idle window", n)
+	}
+}
+
+func TestCardinalityInvalid(t *testing.T) {
+	for _, c := range []*Cardinality{
+		{MaxNames: 1, Window: misc.Duration{Duration: time.Hour}},
+		{MaxCardinality: 1, Window: misc.Duration{Duration: time.Hour}},
+		{MaxCardinality: 1, MaxNames: 1},
+	} {
+		if err := c.Init(); err == nil {
+			t.Errorf("config %+v accepted", c)
+		}
+	}
+}
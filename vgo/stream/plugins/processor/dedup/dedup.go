@@ -0,0 +1,119 @@
+package dedup
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// Dedup drops the metrics whose fields are all equal to the ones of the
+// last metric emitted for their series, the name and tags. A series is
+// still emitted at least once per MaxSuppressInterval so the graphs don't
+// show gaps. The series not seen within SeriesTTL are forgotten, which
+// bounds the memory.
+type Dedup struct {
+	MaxSuppressInterval misc.Duration
+	SeriesTTL           misc.Duration `toml:"series_ttl"`
+
+	sync.Mutex
+	series    map[uint64]*series
+	lastSweep time.Time
+}
+
+// series is the last metric emitted of a series
+type series struct {
+	fields map[string]interface{}
+	// emitted is the time of the last emitted metric
+	emitted time.Time
+	// seen is when the series was last seen, for the eviction
+	seen time.Time
+}
+
+var sampleConfig = `
+  ## A series is emitted at least once per interval, even unchanged
+  max_suppress_interval = "10m"
+  ## Series not seen within the ttl are forgotten
+  # series_ttl = "1h"
+`
+
+func (d *Dedup) Init() error {
+	if d.MaxSuppressInterval.Duration <= 0 {
+		return errors.New("max_suppress_interval must be positive")
+	}
+	if d.SeriesTTL.Duration <= 0 {
+		return errors.New("series_ttl must be positive")
+	}
+	d.series = make(map[uint64]*series)
+	d.lastSweep = time.Now()
+	return nil
+}
+
+func (d *Dedup) Apply(metrics []*service.MetricData) []*service.MetricData {
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+	if now.Sub(d.lastSweep) >= d.SeriesTTL.Duration {
+		d.sweep(now)
+	}
+
+	out := metrics[:0]
+	for _, metric := range metrics {
+		if d.emit(metric, now) {
+			out = append(out, metric)
+		}
+	}
+	return out
+}
+
+// emit reports whether the metric changed or its series has been
+// suppressed for MaxSuppressInterval, and records it then.
+func (d *Dedup) emit(metric *service.MetricData, now time.Time) bool {
+	t := metric.Time
+	if t.IsZero() {
+		t = now
+	}
+
+	h := metric.SeriesHash()
+	s, ok := d.series[h]
+	if ok {
+		s.seen = now
+		if reflect.DeepEqual(s.fields, metric.Fields) && t.Sub(s.emitted) < d.MaxSuppressInterval.Duration {
+			return false
+		}
+	} else {
+		s = &series{seen: now}
+		d.series[h] = s
+	}
+
+	// the metrics are shared by the outputs, the fields are copied
+	s.fields = make(map[string]interface{}, len(metric.Fields))
+	for k, v := range metric.Fields {
+		s.fields[k] = v
+	}
+	s.emitted = t
+	return true
+}
+
+// sweep forgets the series not seen within SeriesTTL.
+func (d *Dedup) sweep(now time.Time) {
+	for h, s := range d.series {
+		if now.Sub(s.seen) >= d.SeriesTTL.Duration {
+			delete(d.series, h)
+		}
+	}
+	d.lastSweep = now
+}
+
+func init() {
+	service.AddProcessor("dedup", func() service.Processor {
+		return &Dedup{
+			MaxSuppressInterval: misc.Duration{Duration: 10 * time.Minute},
+			SeriesTTL:           misc.Duration{Duration: time.Hour},
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package dedup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+func newDedup(t *testing.T, interval, ttl time.Duration) *Dedup {
+	d := &Dedup{MaxSuppressInterval: misc.Duration{Duration: interval}, SeriesTTL: misc.Duration{Duration: ttl}}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+var start = time.Unix(1500000000, 0)
+
+func metric(host string, offset time.Duration, value float64) *service.MetricData {
+	return &service.MetricData{
+		Name:   "temperature",
+		Tags:   map[string]string{"host": host},
+		Fields: map[string]interface{}{"value": value, "unit": "C"},
+		Time:   start.Add(offset),
+	}
+}
+
+// emitted applies the metric and reports whether it's kept.
+func emitted(d *Dedup, m *service.MetricData) bool {
+	return len(d.Apply([]*service.MetricData{m})) == 1
+}
+
+func TestSuppress(t *testing.T) {
+	d := newDedup(t, 10*time.Minute, time.Hour)
+
+	if !emitted(d, metric("a", 0, 20)) {
+		t.Fatal("first point suppressed")
+	}
+	for n := 1; n < 5; n++ {
+		if emitted(d, metric("a", time.Duration(n)*time.Minute, 20)) {
+			t.Errorf("unchanged point %d emitted", n)
+		}
+	}
+	// another series
+	if !emitted(d, metric("b", time.Minute, 20)) {
+		t.Error("point of another series suppressed")
+	}
+
+	// in a batch, the unchanged points are removed in place
+	out := d.Apply([]*service.MetricData{
+		metric("a", 5*time.Minute, 20),
+		metric("b", 5*time.Minute, 21),
+		metric("a", 6*time.Minute, 20),
+	})
+	if len(out) != 1 || out[0].Tags["host"] != "b" {
+		t.Errorf("got batch %v, want the changed point of b", out)
+	}
+}
+
+func TestChangeEmits(t *testing.T) {
+	d := newDedup(t, 10*time.Minute, time.Hour)
+
+	for _, p := range []struct {
+		offset time.Duration
+		value  float64
+		emit   bool
+	}{
+		{0, 20, true},
+		{time.Minute, 20, false},
+		{2 * time.Minute, 21, true},
+		// the state is reset to the changed value
+		{3 * time.Minute, 21, false},
+		{4 * time.Minute, 20, true},
+		{5 * time.Minute, 20, false},
+	} {
+		if got := emitted(d, metric("a", p.offset, p.value)); got != p.emit {
+			t.Errorf("%s value %v, emitted %v, want %v", p.offset, p.value, got, p.emit)
+		}
+	}
+
+	// a new field is a change
+	m := metric("a", 6*time.Minute, 20)
+	m.Fields["humidity"] = 40.0
+	if !emitted(d, m) {
+		t.Error("point with a new field suppressed")
+	}
+}
+
+func TestForcedEmit(t *testing.T) {
+	d := newDedup(t, 10*time.Minute, time.Hour)
+
+	var got []time.Duration
+	for n := 0; n <= 25; n++ {
+		offset := time.Duration(n) * time.Minute
+		if emitted(d, metric("a", offset, 20)) {
+			got = append(got, offset)
+		}
+	}
+	// emitted once per interval, the interval counts from the last emit
+	want := []time.Duration{0, 10 * time.Minute, 20 * time.Minute}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("emitted at %v, want %v", got, want)
+	}
+
+	// a change restarts the interval
+	d = newDedup(t, 10*time.Minute, time.Hour)
+	emitted(d, metric("a", 0, 20))
+	emitted(d, metric("a", 5*time.Minute, 21))
+	if emitted(d, metric("a", 10*time.Minute, 21)) {
+		t.Error("point emitted 5m after the change")
+	}
+	if !emitted(d, metric("a", 15*time.Minute, 21)) {
+		t.Error("point not emitted 10m after the change")
+	}
+}
+
+func TestSeriesEvicted(t *testing.T) {
+	d := newDedup(t, 10*time.Minute, time.Hour)
+	emitted(d, metric("a", 0, 20))
+	emitted(d, metric("b", 0, 20))
+
+	// a was seen recently, b wasn't
+	d.Lock()
+	now := time.Now()
+	d.series[metric("b", 0, 0).SeriesHash()].seen = now.Add(-2 * time.Hour)
+	d.lastSweep = now.Add(-2 * time.Hour)
+	d.Unlock()
+
+	if emitted(d, metric("a", time.Minute, 20)) {
+		t.Error("unchanged point of a emitted")
+	}
+	if n := len(d.series); n != 1 {
+		t.Errorf("%d series kept, want 1", n)
+	}
+	// forgotten, b is emitted again
+	if !emitted(d, metric("b", time.Minute, 20)) {
+		t.Error("point of the evicted series suppressed")
+	}
+}
+
+func TestDedupInvalid(t *testing.T) {
+	for _, d := range []*Dedup{
+		{SeriesTTL: misc.Duration{Duration: time.Hour}},
+		{MaxSuppressInterval: misc.Duration{Duration: time.Minute}},
+	} {
+		if err := d.Init(); err == nil {
+			t.Errorf("invalid config %+v accepted", d)
+		}
+	}
+}
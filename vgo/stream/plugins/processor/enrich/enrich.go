@@ -0,0 +1,197 @@
+package enrich
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+// Enrich adds the tags of a lookup file row to the metrics, the row is found
+// by the value of the Key tag. The file is reloaded when it changes.
+type Enrich struct {
+	// File is a CSV file, whose first column is the key and the header the
+	// tag names, or a JSON object of key to object of tags
+	File string
+	// Format is "csv" or "json", by default the extension of the file
+	Format string
+	// Key is the tag looked up in the file
+	Key string
+	// Default are the tags of the metrics whose key isn't in the file,
+	// without default these metrics are left as is
+	Default map[string]string
+	// Override replaces the tags the metrics already have
+	Override bool
+	// CheckInterval is how often the modification time of the file is checked
+	CheckInterval misc.Duration
+
+	sync.RWMutex
+	rows      map[string]map[string]string
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+var sampleConfig = `
+  ## CSV file with a header, the first column is the key, or JSON object:
+  ## {"web1": {"team": "web", "service": "front"}}
+  file = "/etc/vgo/hosts.csv"
+  ## "csv" or "json", by default the extension of the file
+  # format = "csv"
+  ## Tag looked up in the file
+  key = "host"
+  ## Replace the tags the metrics already have
+  # override = false
+  ## How often the file is checked for changes
+  # check_interval = "30s"
+
+  ## Tags of the metrics whose key isn't in the file
+  # [processors.enrich.default]
+  #   team = "unknown"
+`
+
+func (e *Enrich) Init() error {
+	if e.File == "" {
+		return errors.New("file is required")
+	}
+	if e.Key == "" {
+		return errors.New("key is required")
+	}
+	if e.Format == "" {
+		e.Format = strings.TrimPrefix(filepath.Ext(e.File), ".")
+	}
+	if e.Format != "csv" && e.Format != "json" {
+		return fmt.Errorf("invalid format %s", e.Format)
+	}
+	return e.load()
+}
+
+func (e *Enrich) Apply(metrics []*service.MetricData) []*service.MetricData {
+	e.reload()
+
+	e.RLock()
+	defer e.RUnlock()
+	for _, metric := range metrics {
+		tags, ok := e.rows[metric.Tags[e.Key]]
+		if !ok {
+			tags = e.Default
+		}
+		e.merge(metric, tags)
+	}
+	return metrics
+}
+
+func (e *Enrich) merge(metric *service.MetricData, tags map[string]string) {
+	if len(tags) == 0 {
+		return
+	}
+	if metric.Tags == nil {
+		metric.Tags = make(map[string]string, len(tags))
+	}
+	for k, v := range tags {
+		if _, ok := metric.Tags[k]; ok && !e.Override {
+			continue
+		}
+		metric.Tags[k] = v
+	}
+}
+
+// reload loads the file again when its modification time changed, it's
+// checked at most once per CheckInterval. On failure the previous rows
+// are kept.
+func (e *Enrich) reload() {
+	e.Lock()
+	if time.Since(e.lastCheck) < e.CheckInterval.Duration {
+		e.Unlock()
+		return
+	}
+	e.lastCheck = time.Now()
+	modTime := e.modTime
+	e.Unlock()
+
+	info, err := os.Stat(e.File)
+	if err != nil {
+		service.VLogger.Error("enrich stat lookup file", zap.String("file", e.File), zap.Error(err))
+		return
+	}
+	if info.ModTime().Equal(modTime) {
+		return
+	}
+
+	if err := e.load(); err != nil {
+		service.VLogger.Error("enrich reload lookup file", zap.String("file", e.File), zap.Error(err))
+		return
+	}
+	service.VLogger.Info("enrich lookup file reloaded", zap.String("file", e.File))
+}
+
+func (e *Enrich) load() error {
+	f, err := os.Open(e.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var rows map[string]map[string]string
+	if e.Format == "json" {
+		err = json.NewDecoder(f).Decode(&rows)
+	} else {
+		rows, err = readCSV(f)
+	}
+	if err != nil {
+		return fmt.Errorf("%s, %s", e.File, err)
+	}
+
+	e.Lock()
+	e.rows = rows
+	e.modTime = info.ModTime()
+	e.Unlock()
+	return nil
+}
+
+// readCSV reads the rows keyed by their first column, the header gives the
+// tag names of the other columns. The empty cells are skipped.
+func readCSV(f *os.File) (map[string]map[string]string, error) {
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("missing header")
+	}
+
+	header := records[0]
+	rows := make(map[string]map[string]string, len(records)-1)
+	for _, record := range records[1:] {
+		tags := make(map[string]string, len(record)-1)
+		for i := 1; i < len(record); i++ {
+			if record[i] != "" {
+				tags[header[i]] = record[i]
+			}
+		}
+		rows[record[0]] = tags
+	}
+	return rows, nil
+}
+
+func init() {
+	service.AddProcessor("enrich", func() service.Processor {
+		return &Enrich{
+			Key:           "host",
+			CheckInterval: misc.Duration{Duration: 30 * time.Second},
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package enrich
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+// writeFile writes the lookup file with a modification time of mod.
+func writeFile(t *testing.T, path, content string, mod time.Time) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tagsOf returns the tags of a metric of the host once enriched.
+func tagsOf(e *Enrich, host string, tags map[string]string) map[string]string {
+	metric := &service.MetricData{Name: "cpu", Tags: map[string]string{"host": host}}
+	for k, v := range tags {
+		metric.Tags[k] = v
+	}
+	e.Apply([]*service.MetricData{metric})
+	return metric.Tags
+}
+
+func TestEnrich(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enrich")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tt := range []struct {
+		file, content string
+	}{
+		{"hosts.csv", "host,team,service\nweb01,web,front\ndb01,data,\n"},
+		{"hosts.json", `{"web01": {"team": "web", "service": "front"}, "db01": {"team": "data"}}`},
+	} {
+		path := filepath.Join(dir, tt.file)
+		writeFile(t, path, tt.content, time.Now())
+		e := &Enrich{File: path, Key: "host"}
+		if err := e.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range []struct {
+			host string
+			tags map[string]string
+			want map[string]string
+		}{
+			{"web01", nil, map[string]string{"host": "web01", "team": "web", "service": "front"}},
+			// the empty cell is skipped
+			{"db01", nil, map[string]string{"host": "db01", "team": "data"}},
+			// no match
+			{"cache01", nil, map[string]string{"host": "cache01"}},
+			// the tags of the metric are kept
+			{"web01", map[string]string{"team": "ops"}, map[string]string{"host": "web01", "team": "ops", "service": "front"}},
+		} {
+			if got := tagsOf(e, c.host, c.tags); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("%s %s, got tags %v, want %v", tt.file, c.host, got, c.want)
+			}
+		}
+	}
+}
+
+func TestEnrichDefaultAndOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enrich")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts.csv")
+	writeFile(t, path, "host,team\nweb01,web\n", time.Now())
+
+	e := &Enrich{File: path, Key: "host", Default: map[string]string{"team": "unknown"}, Override: true}
+	if err := e.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if got := tagsOf(e, "cache01", nil); got["team"] != "unknown" {
+		t.Errorf("got tags %v without match, want the default", got)
+	}
+	if got := tagsOf(e, "web01", map[string]string{"team": "ops"}); got["team"] != "web" {
+		t.Errorf("got tags %v, want the team overridden", got)
+	}
+}
+
+func TestEnrichReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enrich")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts.csv")
+	mod := time.Now().Add(-time.Hour)
+	writeFile(t, path, "host,team\nweb01,web\n", mod)
+
+	e := &Enrich{File: path, Key: "host"}
+	if err := e.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if got := tagsOf(e, "web01", nil); got["team"] != "web" {
+		t.Fatalf("got tags %v", got)
+	}
+
+	writeFile(t, path, "host,team\nweb01,front\n", mod.Add(time.Minute))
+	if got := tagsOf(e, "web01", nil); got["team"] != "front" {
+		t.Errorf("got tags %v after the change, want the new team", got)
+	}
+
+	// an invalid file keeps the previous rows
+	writeFile(t, path, "host,team\nweb01,\"broken\n", mod.Add(2*time.Minute))
+	if got := tagsOf(e, "web01", nil); got["team"] != "front" {
+		t.Errorf("got tags %v after an invalid change, want the previous team", got)
+	}
+
+	// checked at most once per interval
+	e.CheckInterval.Duration = time.Hour
+	writeFile(t, path, "host,team\nweb01,back\n", mod.Add(3*time.Minute))
+	if got := tagsOf(e, "web01", nil); got["team"] != "front" {
+		t.Errorf("got tags %v, file checked before the interval", got)
+	}
+	e.lastCheck = e.lastCheck.Add(-time.Hour)
+	if got := tagsOf(e, "web01", nil); got["team"] != "back" {
+		t.Errorf("got tags %v once the interval elapsed, want the new team", got)
+	}
+}
@@ -0,0 +1,131 @@
+package expression
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+// warnSample logs one skipped evaluation of a rule out of warnSample
+const warnSample = 100
+
+// Expression adds fields computed from the numeric fields of the metrics,
+// like free_percent = free / total * 100. The rules run in order, so a rule
+// can use the field computed by a previous one.
+type Expression struct {
+	Rules []*Rule
+}
+
+type Rule struct {
+	// skipped is the number of evaluations skipped, accessed atomically
+	skipped uint64
+
+	// Metrics are the names of the metrics the rule applies to, globs are
+	// supported, empty applies to all of them
+	Metrics []string
+	// Field is the name of the computed field
+	Field string
+	// Expression is the arithmetic expression of the numeric fields, with
+	// the operators + - * / %, the parentheses and the functions abs, min
+	// and max
+	Expression string
+
+	filter service.Filter
+	expr   node
+}
+
+var sampleConfig = `
+  ## The rules run in order, a rule can use the field of a previous one.
+  ## The expressions support + - * / %, parentheses, abs(x), min(x, ...)
+  ## and max(x, ...). A rule referencing a missing or non numeric field is
+  ## skipped for the metric, like a result which isn't a number.
+  [[processors.expression.rules]]
+    metrics = ["mem"]
+    field = "free_percent"
+    expression = "free / total * 100"
+`
+
+func (e *Expression) Init() error {
+	for _, rule := range e.Rules {
+		if rule.Field == "" {
+			return errors.New("rule without field")
+		}
+		if rule.Expression == "" {
+			return fmt.Errorf("rule %s without expression", rule.Field)
+		}
+
+		expr, err := parse(rule.Expression)
+		if err != nil {
+			return fmt.Errorf("rule %s invalid expression %s, %s", rule.Field, rule.Expression, err)
+		}
+		rule.expr = expr
+
+		if rule.filter, err = service.CompileFilter(rule.Metrics); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Expression) Apply(metrics []*service.MetricData) []*service.MetricData {
+	for _, metric := range metrics {
+		var fields map[string]float64
+		for _, rule := range e.Rules {
+			if rule.filter != nil && !rule.filter.Match(metric.Name) {
+				continue
+			}
+			if fields == nil {
+				fields = numericFields(metric)
+			}
+
+			v, missing := rule.expr.eval(fields)
+			if missing != "" {
+				rule.skip(metric, "missing field", missing)
+				continue
+			}
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				rule.skip(metric, "result not a number", "")
+				continue
+			}
+			metric.Fields[rule.Field] = v
+			fields[rule.Field] = v
+		}
+	}
+	return metrics
+}
+
+// skip counts the skipped evaluation and logs a sample of them.
+func (rule *Rule) skip(metric *service.MetricData, reason, field string) {
+	n := atomic.AddUint64(&rule.skipped, 1)
+	if n%warnSample != 1 {
+		return
+	}
+	service.VLogger.Warn("expression skipped",
+		zap.String("metric", metric.Name),
+		zap.String("field", rule.Field),
+		zap.String("reason", reason),
+		zap.String("missing", field),
+		zap.Int64("skipped", int64(n)),
+	)
+}
+
+// numericFields returns the numeric fields of the metric as floats.
+func numericFields(metric *service.MetricData) map[string]float64 {
+	fields := make(map[string]float64, len(metric.Fields))
+	for k, v := range metric.Fields {
+		if f, ok := service.ToFloat(v); ok {
+			fields[k] = f
+		}
+	}
+	return fields
+}
+
+func init() {
+	service.AddProcessor("expression", func() service.Processor {
+		return &Expression{}
+	})
+}
@@ -0,0 +1,118 @@
+package expression
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+func newExpression(t *testing.T, rules ...*Rule) *Expression {
+	e := &Expression{Rules: rules}
+	if err := e.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func mem(fields map[string]interface{}) *service.MetricData {
+	return &service.MetricData{Name: "mem", Fields: fields}
+}
+
+func TestApply(t *testing.T) {
+	e := newExpression(t,
+		&Rule{Metrics: []string{"mem"}, Field: "free_percent", Expression: "free / total * 100"},
+		// uses the field of the previous rule
+		&Rule{Metrics: []string{"mem"}, Field: "used_percent", Expression: "100 - free_percent"},
+		&Rule{Metrics: []string{"disk*"}, Field: "io", Expression: "reads + writes"},
+	)
+
+	m := mem(map[string]interface{}{"free": int64(256), "total": uint64(1024), "host": "a"})
+	d := &service.MetricData{Name: "diskio", Fields: map[string]interface{}{"reads": 3, "writes": float32(4), "free": 1.0, "total": 2.0}}
+	e.Apply([]*service.MetricData{m, d})
+
+	if m.Fields["free_percent"] != 25.0 || m.Fields["used_percent"] != 75.0 {
+		t.Errorf("got mem fields %v, want free_percent 25 and used_percent 75", m.Fields)
+	}
+	if _, ok := m.Fields["io"]; ok {
+		t.Error("rule of the disk metrics applied to mem")
+	}
+	if d.Fields["io"] != 7.0 {
+		t.Errorf("got diskio fields %v, want io 7", d.Fields)
+	}
+	if _, ok := d.Fields["free_percent"]; ok {
+		t.Error("rule of mem applied to diskio")
+	}
+
+	// a rule without metrics applies to all of them
+	e = newExpression(t, &Rule{Field: "double", Expression: "value * 2"})
+	m = &service.MetricData{Name: "any", Fields: map[string]interface{}{"value": 21.0}}
+	e.Apply([]*service.MetricData{m})
+	if m.Fields["double"] != 42.0 {
+		t.Errorf("got fields %v, want double 42", m.Fields)
+	}
+}
+
+func TestMissingField(t *testing.T) {
+	rule := &Rule{Field: "free_percent", Expression: "free / total * 100"}
+	e := newExpression(t, rule, &Rule{Field: "half", Expression: "free / 2"})
+
+	for _, fields := range []map[string]interface{}{
+		{"free": 256.0},
+		// a non numeric field is missing too
+		{"free": 256.0, "total": "1024"},
+		{"free": 256.0, "total": true},
+	} {
+		m := mem(fields)
+		e.Apply([]*service.MetricData{m})
+		if _, ok := m.Fields["free_percent"]; ok {
+			t.Errorf("fields %v, free_percent computed without a numeric total", fields)
+		}
+		// the other rules still apply
+		if m.Fields["half"] != 128.0 {
+			t.Errorf("fields %v, got half %v, want 128", fields, m.Fields["half"])
+		}
+	}
+	if rule.skipped != 3 {
+		t.Errorf("%d evaluations skipped, want 3", rule.skipped)
+	}
+}
+
+func TestNotANumber(t *testing.T) {
+	rule := &Rule{Field: "ratio", Expression: "a / b"}
+	e := newExpression(t, rule)
+
+	for _, fields := range []map[string]interface{}{
+		{"a": 1.0, "b": 0.0},
+		{"a": 0.0, "b": 0.0},
+		{"a": 1.0, "b": 0, "c": 1},
+	} {
+		m := mem(fields)
+		e.Apply([]*service.MetricData{m})
+		if v, ok := m.Fields["ratio"]; ok {
+			t.Errorf("fields %v, got ratio %v, want it skipped", fields, v)
+		}
+	}
+	if rule.skipped != 3 {
+		t.Errorf("%d evaluations skipped, want 3", rule.skipped)
+	}
+}
+
+func TestExpressionInvalid(t *testing.T) {
+	for _, rule := range []*Rule{
+		{Expression: "a + b"},
+		{Field: "c"},
+		{Field: "c", Expression: "a +"},
+		{Field: "c", Expression: "a + b", Metrics: []string{"[mem"}},
+	} {
+		e := &Expression{Rules: []*Rule{rule}}
+		if err := e.Init(); err == nil {
+			t.Errorf("invalid rule %+v accepted", rule)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package expression
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// node is a node of a compiled expression.
+type node interface {
+	// eval returns the value of the node, or the name of the first missing
+	// field
+	eval(fields map[string]float64) (float64, string)
+}
+
+type number float64
+
+func (n number) eval(fields map[string]float64) (float64, string) {
+	return float64(n), ""
+}
+
+// field references a numeric field of the metric.
+type field string
+
+func (f field) eval(fields map[string]float64) (float64, string) {
+	v, ok := fields[string(f)]
+	if !ok {
+		return 0, string(f)
+	}
+	return v, ""
+}
+
+type unary struct {
+	x node
+}
+
+func (u *unary) eval(fields map[string]float64) (float64, string) {
+	x, missing := u.x.eval(fields)
+	return -x, missing
+}
+
+type binary struct {
+	op   byte
+	x, y node
+}
+
+func (b *binary) eval(fields map[string]float64) (float64, string) {
+	x, missing := b.x.eval(fields)
+	if missing != "" {
+		return 0, missing
+	}
+	y, missing := b.y.eval(fields)
+	if missing != "" {
+		return 0, missing
+	}
+
+	switch b.op {
+	case '+':
+		return x + y, ""
+	case '-':
+		return x - y, ""
+	case '*':
+		return x * y, ""
+	case '/':
+		return x / y, ""
+	default:
+		return math.Mod(x, y), ""
+	}
+}
+
+type call struct {
+	fn   string
+	args []node
+}
+
+func (c *call) eval(fields map[string]float64) (float64, string) {
+	values := make([]float64, len(c.args))
+	for n, arg := range c.args {
+		v, missing := arg.eval(fields)
+		if missing != "" {
+			return 0, missing
+		}
+		values[n] = v
+	}
+
+	switch c.fn {
+	case "abs":
+		return math.Abs(values[0]), ""
+	case "min":
+		v := values[0]
+		for _, x := range values[1:] {
+			v = math.Min(v, x)
+		}
+		return v, ""
+	default:
+		v := values[0]
+		for _, x := range values[1:] {
+			v = math.Max(v, x)
+		}
+		return v, ""
+	}
+}
+
+// Expr is a compiled expression, for the processors computing fields with
+// the expressions of the expression processor.
+type Expr struct {
+	root node
+}
+
+// Compile compiles the expression.
+func Compile(s string) (*Expr, error) {
+	n, err := parse(s)
+	if err != nil {
+		return nil, err
+	}
+	return &Expr{root: n}, nil
+}
+
+// Eval returns the value of the expression, or the name of the first
+// missing field.
+func (e *Expr) Eval(fields map[string]float64) (float64, string) {
+	return e.root.eval(fields)
+}
+
+// Fields returns the names of the fields the expression references.
+func (e *Expr) Fields() []string {
+	var names []string
+	var walk func(n node)
+	walk = func(n node) {
+		switch t := n.(type) {
+		case field:
+			names = append(names, string(t))
+		case *unary:
+			walk(t.x)
+		case *binary:
+			walk(t.x)
+			walk(t.y)
+		case *call:
+			for _, arg := range t.args {
+				walk(arg)
+			}
+		}
+	}
+	walk(e.root)
+	return names
+}
+
+// parser compiles the expressions with the grammar:
+//
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/" | "%") unary }
+//	unary   = "-" unary | primary
+//	primary = number | field | func "(" expr { "," expr } ")" | "(" expr ")"
+//
+// The fields are identifiers of letters, digits, '_' and '.', the functions
+// are abs, min and max.
+type parser struct {
+	s   string
+	pos int
+}
+
+// parse compiles the expression.
+func parse(s string) (node, error) {
+	p := &parser{s: s}
+	n, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.s) {
+		return nil, p.errorf("unexpected %q", p.s[p.pos])
+	}
+	return n, nil
+}
+
+func (p *parser) expr() (node, error) {
+	x, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return x, nil
+		}
+		p.pos++
+		y, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		x = &binary{op: op, x: x, y: y}
+	}
+}
+
+func (p *parser) term() (node, error) {
+	x, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return x, nil
+		}
+		p.pos++
+		y, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		x = &binary{op: op, x: x, y: y}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	if p.peek() == '-' {
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{x: x}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (node, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("missing )")
+		}
+		p.pos++
+		return x, nil
+	case isDigit(c) || c == '.':
+		return p.number()
+	case isIdent(c):
+		name := p.ident()
+		if p.peek() != '(' {
+			return field(name), nil
+		}
+		return p.call(name)
+	case c == 0:
+		return nil, p.errorf("unexpected end")
+	default:
+		return nil, p.errorf("unexpected %q", c)
+	}
+}
+
+func (p *parser) number() (node, error) {
+	start := p.pos
+	for p.pos < len(p.s) && (isDigit(p.s[p.pos]) || p.s[p.pos] == '.') {
+		p.pos++
+	}
+	// exponent, like 1e6 or 2.5E-3
+	if p.pos < len(p.s) && (p.s[p.pos] == 'e' || p.s[p.pos] == 'E') {
+		p.pos++
+		if p.pos < len(p.s) && (p.s[p.pos] == '+' || p.s[p.pos] == '-') {
+			p.pos++
+		}
+		for p.pos < len(p.s) && isDigit(p.s[p.pos]) {
+			p.pos++
+		}
+	}
+
+	v, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number %s", p.s[start:p.pos])
+	}
+	return number(v), nil
+}
+
+func (p *parser) ident() string {
+	start := p.pos
+	for p.pos < len(p.s) && (isIdent(p.s[p.pos]) || isDigit(p.s[p.pos]) || p.s[p.pos] == '.') {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+func (p *parser) call(fn string) (node, error) {
+	if fn != "abs" && fn != "min" && fn != "max" {
+		return nil, fmt.Errorf("unknown function %s", fn)
+	}
+
+	// skip the (
+	p.pos++
+	c := &call{fn: fn}
+	for {
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		c.args = append(c.args, arg)
+
+		next := p.peek()
+		p.pos++
+		if next == ')' {
+			break
+		}
+		if next != ',' {
+			return nil, p.errorf("missing ) of %s", fn)
+		}
+	}
+
+	if fn == "abs" && len(c.args) != 1 {
+		return nil, fmt.Errorf("abs takes 1 argument, got %d", len(c.args))
+	}
+	return c, nil
+}
+
+// peek returns the next non space character, 0 at the end.
+func (p *parser) peek() byte {
+	p.skipSpaces()
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *parser) skipSpaces() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at %d, %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdent(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,121 @@
+package expression
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	fields := map[string]float64{"free": 25, "total": 200, "used": 175, "delta": -3, "disk.io": 4}
+	for _, tt := range []struct {
+		expr string
+		want float64
+	}{
+		{"42", 42},
+		{"1.5e3", 1500},
+		{"2.5E-1", 0.25},
+		{".5", 0.5},
+		{"free / total * 100", 12.5},
+		{"used+free", 200},
+		// precedence and associativity
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"100 / 10 / 5", 2},
+		{"17 % 5", 2},
+		{"2 * 7 % 4", 2},
+		// unary minus
+		{"-free", -25},
+		{"- -free", 25},
+		{"total - -free", 225},
+		{"-(used - total)", 25},
+		// functions
+		{"abs(delta)", 3},
+		{"abs(free - total)", 175},
+		{"min(free, used, total)", 25},
+		{"max(free, used, total)", 200},
+		{"max(delta)", -3},
+		{"min(free / total * 100, 10)", 10},
+		{"max(abs(delta), min(4, 5)) * 2", 8},
+		// the field names may have dots
+		{"disk.io * 2", 8},
+		{"\tfree\t+ 1 ", 26},
+	} {
+		n, err := parse(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		got, missing := n.eval(fields)
+		if missing != "" {
+			t.Errorf("%q: missing field %s", tt.expr, missing)
+			continue
+		}
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%q = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestEvalMissing(t *testing.T) {
+	fields := map[string]float64{"free": 25}
+	for _, tt := range []struct {
+		expr    string
+		missing string
+	}{
+		{"total", "total"},
+		{"free / total", "total"},
+		{"-total", "total"},
+		{"max(free, total, used)", "total"},
+		// the first missing one
+		{"used + total", "used"},
+	} {
+		n, err := parse(tt.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.expr, err)
+		}
+		if _, missing := n.eval(fields); missing != tt.missing {
+			t.Errorf("%q: got missing field %q, want %q", tt.expr, missing, tt.missing)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"free +",
+		"* free",
+		"(free + 1",
+		"free + 1)",
+		"free total",
+		"1.2.3",
+		"1e",
+		"sqrt(free)",
+		"abs(free, total)",
+		"abs()",
+		"min(free,",
+		"min(free total)",
+		"free $ total",
+		"os.Exit(1)",
+	} {
+		if _, err := parse(expr); err == nil {
+			t.Errorf("invalid expression %q parsed", expr)
+		}
+	}
+}
+
+func TestExprFields(t *testing.T) {
+	e, err := Compile("max(free, -used) / total * 100 + abs(delta)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"free", "used", "total", "delta"}
+	if got := e.Fields(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got fields %v, want %v", got, want)
+	}
+	v, missing := e.Eval(map[string]float64{"free": 50, "used": 150, "total": 200, "delta": -1})
+	if missing != "" || v != 26 {
+		t.Errorf("got %v missing %q, want 26", v, missing)
+	}
+}
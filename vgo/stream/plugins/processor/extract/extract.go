@@ -0,0 +1,170 @@
+package extract
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+// Extract parses a string field with the named groups of a regular
+// expression, like the message of the metrics derived from logs. The groups
+// become tags or fields of the metric. The metrics whose field doesn't
+// match are left as they are.
+type Extract struct {
+	Rules []*Rule
+}
+
+type Rule struct {
+	// Metrics are the names of the metrics the rule applies to, globs are
+	// supported, empty applies to all of them
+	Metrics []string
+	// Field is the string field parsed
+	Field string
+	// Pattern is a regular expression with named groups: (?P<status>\d+)
+	Pattern string
+	// Groups are the types of the groups: "tag", or the "string", "int" and
+	// "float" fields. The groups not listed are string fields
+	Groups map[string]string
+	// DropOriginal removes the parsed field once it matched
+	DropOriginal bool
+
+	filter service.Filter
+	re     *regexp.Regexp
+	// names are the names of the groups
+	names map[string]bool
+}
+
+var sampleConfig = `
+  ## The rules run in order, a rule can parse the field of a previous one.
+  [[processors.extract.rules]]
+    metrics = ["nginx_log"]
+    field = "message"
+    pattern = '^(?P<method>[A-Z]+) (?P<path>\S+) (?P<status>\d+) (?P<duration>[\d.]+)$'
+    ## Remove the parsed field once it matched
+    # drop_original = false
+    ## "tag", or "string", "int" and "float" fields, string fields by default.
+    ## A capture which can't be converted is skipped
+    [processors.extract.rules.groups]
+      method = "tag"
+      status = "int"
+      duration = "float"
+`
+
+func (e *Extract) Init() error {
+	for _, rule := range e.Rules {
+		if rule.Field == "" {
+			return errors.New("rule without field")
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("rule %s invalid pattern %s, %s", rule.Field, rule.Pattern, err)
+		}
+		rule.re = re
+
+		rule.names = make(map[string]bool)
+		for _, name := range re.SubexpNames() {
+			if name != "" {
+				rule.names[name] = true
+			}
+		}
+		if len(rule.names) == 0 {
+			return fmt.Errorf("rule %s pattern %s without named groups", rule.Field, rule.Pattern)
+		}
+		for name, typ := range rule.Groups {
+			if !rule.names[name] {
+				return fmt.Errorf("rule %s group %s not in the pattern", rule.Field, name)
+			}
+			switch typ {
+			case "tag", "string", "int", "float":
+			default:
+				return fmt.Errorf("rule %s group %s invalid type %s, can be: \"tag\", \"string\", \"int\", \"float\"", rule.Field, name, typ)
+			}
+		}
+
+		if rule.filter, err = service.CompileFilter(rule.Metrics); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Extract) Apply(metrics []*service.MetricData) []*service.MetricData {
+	for _, metric := range metrics {
+		for _, rule := range e.Rules {
+			if rule.filter != nil && !rule.filter.Match(metric.Name) {
+				continue
+			}
+			rule.apply(metric)
+		}
+	}
+	return metrics
+}
+
+func (rule *Rule) apply(metric *service.MetricData) {
+	s, ok := metric.Fields[rule.Field].(string)
+	if !ok {
+		return
+	}
+	match := rule.re.FindStringSubmatch(s)
+	if match == nil {
+		service.VLogger.Debug("extract no match",
+			zap.String("metric", metric.Name),
+			zap.String("field", rule.Field),
+		)
+		return
+	}
+
+	for i, name := range rule.re.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		v := match[i]
+		switch rule.Groups[name] {
+		case "tag":
+			if metric.Tags == nil {
+				metric.Tags = make(map[string]string)
+			}
+			metric.Tags[name] = v
+		case "int":
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				rule.skip(metric, name, v)
+				continue
+			}
+			metric.Fields[name] = n
+		case "float":
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				rule.skip(metric, name, v)
+				continue
+			}
+			metric.Fields[name] = f
+		default:
+			metric.Fields[name] = v
+		}
+	}
+
+	// a group may be named like the parsed field and replace it
+	if rule.DropOriginal && !rule.names[rule.Field] {
+		delete(metric.Fields, rule.Field)
+	}
+}
+
+func (rule *Rule) skip(metric *service.MetricData, group, value string) {
+	service.VLogger.Debug("extract conversion failed",
+		zap.String("metric", metric.Name),
+		zap.String("group", group),
+		zap.String("type", rule.Groups[group]),
+		zap.String("value", value),
+	)
+}
+
+func init() {
+	service.AddProcessor("extract", func() service.Processor {
+		return &Extract{}
+	})
+}
@@ -0,0 +1,155 @@
+package extract
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+const pattern = `^(?P<method>[A-Z]+) (?P<path>\S+) (?P<status>\d+) (?P<duration>\S+)$`
+
+func newExtract(t *testing.T, rules ...*Rule) *Extract {
+	e := &Extract{Rules: rules}
+	if err := e.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func logMetric(message string) *service.MetricData {
+	return &service.MetricData{
+		Name:   "nginx_log",
+		Tags:   map[string]string{"host": "web01"},
+		Fields: map[string]interface{}{"message": message},
+	}
+}
+
+func TestCaptures(t *testing.T) {
+	e := newExtract(t, &Rule{
+		Field:   "message",
+		Pattern: pattern,
+		Groups:  map[string]string{"method": "tag", "status": "int", "duration": "float", "path": "string"},
+	})
+	m := e.Apply([]*service.MetricData{logMetric("GET /index.html 200 0.125")})[0]
+
+	if want := map[string]string{"host": "web01", "method": "GET"}; !reflect.DeepEqual(m.Tags, want) {
+		t.Errorf("got tags %v, want %v", m.Tags, want)
+	}
+	want := map[string]interface{}{
+		"message":  "GET /index.html 200 0.125",
+		"path":     "/index.html",
+		"status":   int64(200),
+		"duration": 0.125,
+	}
+	if !reflect.DeepEqual(m.Fields, want) {
+		t.Errorf("got fields %v, want %v", m.Fields, want)
+	}
+}
+
+func TestConversion(t *testing.T) {
+	e := newExtract(t, &Rule{
+		Field:   "message",
+		Pattern: pattern,
+		// path isn't listed, a string field
+		Groups: map[string]string{"status": "int", "duration": "float"},
+	})
+	// a capture which can't be converted is skipped, the others are kept
+	m := e.Apply([]*service.MetricData{logMetric("POST /login 401 slow")})[0]
+	want := map[string]interface{}{
+		"message": "POST /login 401 slow",
+		"method":  "POST",
+		"path":    "/login",
+		"status":  int64(401),
+	}
+	if !reflect.DeepEqual(m.Fields, want) {
+		t.Errorf("got fields %v, want %v", m.Fields, want)
+	}
+
+	// int doesn't take floats
+	e = newExtract(t, &Rule{Field: "message", Pattern: pattern, Groups: map[string]string{"duration": "int"}})
+	m = e.Apply([]*service.MetricData{logMetric("GET / 200 0.5")})[0]
+	if _, ok := m.Fields["duration"]; ok {
+		t.Errorf("got duration %v converted to an int", m.Fields["duration"])
+	}
+}
+
+func TestNoMatch(t *testing.T) {
+	e := newExtract(t, &Rule{Field: "message", Pattern: pattern, DropOriginal: true})
+	metrics := []*service.MetricData{
+		logMetric("connection reset by peer"),
+		// not a string
+		{Name: "nginx_log", Fields: map[string]interface{}{"message": int64(1)}},
+		// without the field
+		{Name: "nginx_log", Fields: map[string]interface{}{"bytes": int64(1)}},
+	}
+	got := e.Apply(metrics)
+	if len(got) != 3 {
+		t.Fatalf("got %d metrics, want the 3 kept", len(got))
+	}
+	for i, want := range []map[string]interface{}{
+		{"message": "connection reset by peer"},
+		{"message": int64(1)},
+		{"bytes": int64(1)},
+	} {
+		if !reflect.DeepEqual(got[i].Fields, want) {
+			t.Errorf("metric %d, got fields %v, want them unchanged", i, got[i].Fields)
+		}
+	}
+	if len(got[0].Tags) != 1 {
+		t.Errorf("got tags %v, want them unchanged", got[0].Tags)
+	}
+}
+
+func TestDropOriginal(t *testing.T) {
+	e := newExtract(t, &Rule{Field: "message", Pattern: pattern, DropOriginal: true})
+	m := e.Apply([]*service.MetricData{logMetric("GET / 200 0.5")})[0]
+	if _, ok := m.Fields["message"]; ok || len(m.Fields) != 4 {
+		t.Errorf("got fields %v, want the captures without the message", m.Fields)
+	}
+
+	// a group named like the field replaces it
+	e = newExtract(t, &Rule{Field: "message", Pattern: `^\S+ (?P<message>.*)$`, DropOriginal: true})
+	m = e.Apply([]*service.MetricData{logMetric("ERROR disk full")})[0]
+	if m.Fields["message"] != "disk full" {
+		t.Errorf("got message %v, want the capture", m.Fields["message"])
+	}
+}
+
+func TestRulesChained(t *testing.T) {
+	e := newExtract(t,
+		&Rule{Metrics: []string{"nginx_*"}, Field: "message", Pattern: pattern},
+		// the path captured by the first rule
+		&Rule{Field: "path", Pattern: `^/(?P<section>[^/]+)/`, Groups: map[string]string{"section": "tag"}},
+		&Rule{Metrics: []string{"apache_log"}, Field: "message", Pattern: `(?P<apache>.*)`},
+	)
+	m := e.Apply([]*service.MetricData{logMetric("GET /api/users 200 0.5")})[0]
+	if m.Tags["section"] != "api" {
+		t.Errorf("got tags %v, want the section of the path", m.Tags)
+	}
+	if _, ok := m.Fields["apache"]; ok {
+		t.Error("rule of another metric applied")
+	}
+}
+
+func TestExtractInvalid(t *testing.T) {
+	for _, rule := range []*Rule{
+		{Pattern: pattern},
+		{Field: "message", Pattern: `(?P<a>`},
+		{Field: "message", Pattern: `^(\d+)$`},
+		{Field: "message", Pattern: pattern, Groups: map[string]string{"size": "int"}},
+		{Field: "message", Pattern: pattern, Groups: map[string]string{"status": "bool"}},
+		{Field: "message", Pattern: pattern, Metrics: []string{"[nginx"}},
+	} {
+		e := &Extract{Rules: []*Rule{rule}}
+		if err := e.Init(); err == nil {
+			t.Errorf("invalid rule %+v accepted", rule)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package flatten
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+// warnSample logs one collision out of warnSample
+const warnSample = 100
+
+// Flatten replaces the map and slice fields by scalar fields named after
+// their path: {"disk": {"used": 1}} gives disk.used, {"load": [1, 2]} gives
+// load.0 and load.1. The values nested deeper than MaxDepth are dropped. A
+// flattened field replaces a field of the same name, the collisions are
+// counted. The nested fields come from the json parser with json_nested =
+// "keep".
+type Flatten struct {
+	Separator string
+	MaxDepth  int
+
+	// collisions is the number of fields replaced, accessed atomically
+	collisions uint64
+}
+
+var sampleConfig = `
+  ## Separator of the names of the flattened fields
+  # separator = "."
+  ## Values nested deeper are dropped
+  # max_depth = 5
+`
+
+func (f *Flatten) Init() error {
+	if f.MaxDepth <= 0 {
+		return errors.New("max_depth must be positive")
+	}
+	return nil
+}
+
+func (f *Flatten) Apply(metrics []*service.MetricData) []*service.MetricData {
+	for _, metric := range metrics {
+		if n := service.FlattenFields(metric.Fields, f.Separator, f.MaxDepth); n > 0 {
+			f.collide(metric, n)
+		}
+	}
+	return metrics
+}
+
+// collide counts the flattened fields which replaced a field of the same
+// name, and logs a sample of them.
+func (f *Flatten) collide(metric *service.MetricData, n int) {
+	total := atomic.AddUint64(&f.collisions, uint64(n))
+	// the first ones, then once every warnSample
+	if prev := total - uint64(n); prev > 0 && prev/warnSample == total/warnSample {
+		return
+	}
+	service.VLogger.Warn("flatten, fields replaced by a flattened one",
+		zap.String("metric", metric.Name),
+		zap.Int("count", n),
+		zap.Int64("collisions", int64(total)),
+	)
+}
+
+func init() {
+	service.AddProcessor("flatten", func() service.Processor {
+		return &Flatten{
+			Separator: ".",
+			MaxDepth:  5,
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package flatten
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+func TestFlatten(t *testing.T) {
+	for _, tt := range []struct {
+		separator string
+		maxDepth  int
+		want      map[string]interface{}
+	}{
+		{".", 5, map[string]interface{}{
+			"idle":             1.5,
+			"disk.used":        int64(10),
+			"disk.mount":       "/",
+			"disk.io.read":     2.0,
+			"load.0":           0.5,
+			"load.1":           0.7,
+			"cpus.0.user":      3.0,
+			"cpus.1.user":      4.0,
+			"deep.a.b.c.d":     "max",
+			"disks.0.labels.0": "ssd",
+		}},
+		{"_", 5, map[string]interface{}{
+			"idle":             1.5,
+			"disk_used":        int64(10),
+			"disk_mount":       "/",
+			"disk_io_read":     2.0,
+			"load_0":           0.5,
+			"load_1":           0.7,
+			"cpus_0_user":      3.0,
+			"cpus_1_user":      4.0,
+			"deep_a_b_c_d":     "max",
+			"disks_0_labels_0": "ssd",
+		}},
+		// the values in containers nested deeper than 2 are dropped
+		{".", 2, map[string]interface{}{
+			"idle":         1.5,
+			"disk.used":    int64(10),
+			"disk.mount":   "/",
+			"disk.io.read": 2.0,
+			"load.0":       0.5,
+			"load.1":       0.7,
+			"cpus.0.user":  3.0,
+			"cpus.1.user":  4.0,
+		}},
+	} {
+		f := &Flatten{Separator: tt.separator, MaxDepth: tt.maxDepth}
+		if err := f.Init(); err != nil {
+			t.Fatal(err)
+		}
+		metric := &service.MetricData{Name: "host", Fields: map[string]interface{}{
+			"idle": 1.5,
+			"disk": map[string]interface{}{
+				"used":  int64(10),
+				"mount": "/",
+				"io":    map[string]interface{}{"read": 2.0},
+				"none":  nil,
+			},
+			"load": []interface{}{0.5, 0.7},
+			"cpus": []interface{}{
+				map[string]interface{}{"user": 3.0},
+				map[string]interface{}{"user": 4.0},
+			},
+			"deep": map[string]interface{}{"a": map[string]interface{}{"b": map[string]interface{}{"c": map[string]interface{}{"d": "max"}}}},
+			"disks": []interface{}{
+				map[string]interface{}{"labels": []interface{}{"ssd"}},
+			},
+		}}
+		f.Apply([]*service.MetricData{metric})
+		if !reflect.DeepEqual(metric.Fields, tt.want) {
+			t.Errorf("separator %q, max depth %d, got fields %v, want %v", tt.separator, tt.maxDepth, metric.Fields, tt.want)
+		}
+	}
+}
+
+func TestFlattenCollisions(t *testing.T) {
+	f := &Flatten{Separator: ".", MaxDepth: 5}
+	metric := &service.MetricData{Name: "host", Fields: map[string]interface{}{
+		"disk.used": 1.0,
+		"disk":      map[string]interface{}{"used": 2.0, "free": 3.0},
+	}}
+	f.Apply([]*service.MetricData{metric})
+	if metric.Fields["disk.used"] != 2.0 || f.collisions != 1 {
+		t.Errorf("got fields %v and %d collisions, want the flattened field and 1", metric.Fields, f.collisions)
+	}
+}
+
+func TestFlattenInvalid(t *testing.T) {
+	if err := (&Flatten{Separator: "."}).Init(); err == nil {
+		t.Error("max depth of 0 accepted")
+	}
+}
@@ -0,0 +1,245 @@
+package histogram
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// Histogram counts the values of fields into cumulative buckets over a
+// period, like the Prometheus histograms. When the period ends, every
+// series gets a metric per bucket with the le tag and the <field>_bucket
+// field, plus a metric with the <field>_sum and <field>_count fields, and
+// the counts restart from zero. Like dedup, the time is only checked when
+// metrics arrive: the histograms of a period are emitted with the first
+// batch after its end.
+type Histogram struct {
+	Period misc.Duration
+	// DropOriginal drops the metrics counted in a histogram
+	DropOriginal bool
+	Rules        []*Rule
+
+	sync.Mutex
+	start  time.Time
+	series map[string]*series
+	// order is the order the series were first seen in the period
+	order []string
+}
+
+type Rule struct {
+	// Metrics are the names of the metrics the rule applies to, globs are
+	// supported, empty applies to all of them
+	Metrics []string
+	// Fields are the names of the numeric fields counted, globs are supported
+	Fields []string
+	// Buckets are the upper bounds of the buckets, the values above the
+	// last one only count in the +Inf bucket
+	Buckets []float64
+
+	metricFilter service.Filter
+	fieldFilter  service.Filter
+}
+
+// series is the histogram of a field of a series, the name and tags
+type series struct {
+	name    string
+	tags    map[string]string
+	field   string
+	buckets []float64
+	// counts are the counts of every bucket alone, the last one is +Inf
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+var sampleConfig = `
+  ## The counts restart every period, the histograms are emitted with the
+  ## first metrics after the period ends
+  period = "1m"
+  ## Drop the metrics counted in a histogram
+  # drop_original = false
+
+  ## A field is counted by the first rule matching it. The buckets are
+  ## floats: write 1.0, not 1.
+  [[processors.histogram.rules]]
+    metrics = ["http_request"]
+    fields = ["latency_ms"]
+    buckets = [5.0, 10.0, 25.0, 50.0, 100.0, 250.0, 500.0, 1000.0]
+`
+
+func (h *Histogram) Init() error {
+	if h.Period.Duration <= 0 {
+		return errors.New("period must be positive")
+	}
+	if len(h.Rules) == 0 {
+		return errors.New("no rules")
+	}
+
+	for _, rule := range h.Rules {
+		if len(rule.Fields) == 0 {
+			return errors.New("rule without fields")
+		}
+		if len(rule.Buckets) == 0 {
+			return fmt.Errorf("rule %v without buckets", rule.Fields)
+		}
+		if !sort.Float64sAreSorted(rule.Buckets) {
+			return fmt.Errorf("rule %v buckets not in increasing order", rule.Fields)
+		}
+
+		var err error
+		if rule.metricFilter, err = service.CompileFilter(rule.Metrics); err != nil {
+			return err
+		}
+		if rule.fieldFilter, err = service.CompileFilter(rule.Fields); err != nil {
+			return err
+		}
+	}
+
+	h.start = time.Now()
+	h.series = make(map[string]*series)
+	return nil
+}
+
+func (h *Histogram) Apply(metrics []*service.MetricData) []*service.MetricData {
+	h.Lock()
+	defer h.Unlock()
+
+	var histograms []*service.MetricData
+	now := time.Now()
+	if now.Sub(h.start) >= h.Period.Duration {
+		histograms = h.emit(now)
+		h.start = now
+	}
+
+	out := metrics[:0]
+	for _, metric := range metrics {
+		if !h.observe(metric) || !h.DropOriginal {
+			out = append(out, metric)
+		}
+	}
+	return append(out, histograms...)
+}
+
+// observe counts the fields of the metric, it returns whether a field was
+// counted.
+func (h *Histogram) observe(metric *service.MetricData) bool {
+	var observed bool
+	for k, v := range metric.Fields {
+		rule := h.rule(metric.Name, k)
+		if rule == nil {
+			continue
+		}
+		f, ok := service.ToFloat(v)
+		if !ok || math.IsNaN(f) {
+			continue
+		}
+
+		key := metric.SeriesKey() + "\x00" + k
+		s, ok := h.series[key]
+		if !ok {
+			s = &series{
+				name:    metric.Name,
+				tags:    copyTags(metric.Tags),
+				field:   k,
+				buckets: rule.Buckets,
+				counts:  make([]uint64, len(rule.Buckets)+1),
+			}
+			h.series[key] = s
+			h.order = append(h.order, key)
+		}
+		s.observe(f)
+		observed = true
+	}
+	return observed
+}
+
+// rule returns the first rule matching the metric and the field, nil if
+// none does.
+func (h *Histogram) rule(name, field string) *Rule {
+	for _, rule := range h.Rules {
+		if rule.metricFilter != nil && !rule.metricFilter.Match(name) {
+			continue
+		}
+		if rule.fieldFilter.Match(field) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// emit returns the histograms of the period and restarts the counts.
+func (h *Histogram) emit(now time.Time) []*service.MetricData {
+	var out []*service.MetricData
+	for _, key := range h.order {
+		out = append(out, h.series[key].metrics(now)...)
+	}
+	h.series = make(map[string]*series)
+	h.order = nil
+	return out
+}
+
+func (s *series) observe(v float64) {
+	// the first bucket whose bound is at least v, or +Inf
+	i := sort.SearchFloat64s(s.buckets, v)
+	s.counts[i]++
+	s.sum += v
+	s.count++
+}
+
+// metrics returns a metric per cumulative bucket, then the sum and count.
+func (s *series) metrics(now time.Time) []*service.MetricData {
+	out := make([]*service.MetricData, 0, len(s.counts)+1)
+	var cumulative uint64
+	for i, n := range s.counts {
+		cumulative += n
+		le := "+Inf"
+		if i < len(s.buckets) {
+			le = strconv.FormatFloat(s.buckets[i], 'f', -1, 64)
+		}
+
+		tags := copyTags(s.tags)
+		tags["le"] = le
+		out = append(out, &service.MetricData{
+			Name:   s.name,
+			Tags:   tags,
+			Fields: map[string]interface{}{s.field + "_bucket": int64(cumulative)},
+			Time:   now,
+		})
+	}
+
+	out = append(out, &service.MetricData{
+		Name: s.name,
+		Tags: copyTags(s.tags),
+		Fields: map[string]interface{}{
+			s.field + "_sum":   s.sum,
+			s.field + "_count": int64(s.count),
+		},
+		Time: now,
+	})
+	return out
+}
+
+// copyTags copies the tags, the next processors may change the ones of the
+// metrics in place.
+func copyTags(tags map[string]string) map[string]string {
+	c := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		c[k] = v
+	}
+	return c
+}
+
+func init() {
+	service.AddProcessor("histogram", func() service.Processor {
+		return &Histogram{
+			Period: misc.Duration{Duration: time.Minute},
+		}
+	})
+}
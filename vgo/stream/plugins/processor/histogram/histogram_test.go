@@ -0,0 +1,156 @@
+package histogram
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+func newHistogram(t *testing.T, rules ...*Rule) *Histogram {
+	h := &Histogram{Period: misc.Duration{Duration: time.Hour}, Rules: rules}
+	if err := h.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func latency(host string, values ...interface{}) []*service.MetricData {
+	var metrics []*service.MetricData
+	for _, v := range values {
+		metrics = append(metrics, &service.MetricData{
+			Name:   "http_request",
+			Tags:   map[string]string{"host": host},
+			Fields: map[string]interface{}{"latency_ms": v, "status": "ok"},
+			Time:   time.Unix(1500000000, 0),
+		})
+	}
+	return metrics
+}
+
+// flush ends the period, the histograms are emitted with the next batch.
+func flush(h *Histogram) []*service.MetricData {
+	h.start = h.start.Add(-h.Period.Duration)
+	return h.Apply(nil)
+}
+
+// buckets returns the cumulative counts by le of the field, and the sum
+// and count metric.
+func buckets(t *testing.T, metrics []*service.MetricData, host, field string) (map[string]int64, *service.MetricData) {
+	counts := make(map[string]int64)
+	var total *service.MetricData
+	for _, m := range metrics {
+		if m.Tags["host"] != host {
+			continue
+		}
+		if le, ok := m.Tags["le"]; ok {
+			counts[le] = m.Fields[field+"_bucket"].(int64)
+		} else if _, ok := m.Fields[field+"_count"]; ok {
+			total = m
+		}
+	}
+	if total == nil {
+		t.Fatalf("no %s_sum and %s_count metric for %s", field, field, host)
+	}
+	return counts, total
+}
+
+func TestBucketCounts(t *testing.T) {
+	h := newHistogram(t, &Rule{Fields: []string{"latency_ms"}, Buckets: []float64{10, 50, 100}})
+
+	// two values per bucket, the bounds included in their bucket
+	in := latency("server01", 5.0, int64(10), 20.0, uint64(50), 75.0, 100.0, 200.0, 1000.0)
+	if out := h.Apply(in); len(out) != 8 {
+		t.Fatalf("got %d metrics, want the 8 metrics kept until the period ends", len(out))
+	}
+
+	out := flush(h)
+	if len(out) != 5 {
+		t.Fatalf("got %d metrics, want the 4 buckets and the sum and count", len(out))
+	}
+	counts, total := buckets(t, out, "server01", "latency_ms")
+	if want := map[string]int64{"10": 2, "50": 4, "100": 6, "+Inf": 8}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("got buckets %v, want %v", counts, want)
+	}
+	if total.Fields["latency_ms_sum"] != 1460.0 || total.Fields["latency_ms_count"] != int64(8) {
+		t.Errorf("got %v, want the sum 1460 and the count 8", total.Fields)
+	}
+	// the tags of the series are kept, the other fields aren't counted
+	for _, m := range out {
+		if m.Name != "http_request" || m.Tags["host"] != "server01" || len(m.Fields) > 2 || m.Fields["status_count"] != nil {
+			t.Errorf("got histogram metric %s %v %v", m.Name, m.Tags, m.Fields)
+		}
+	}
+}
+
+func TestSeriesAndReset(t *testing.T) {
+	h := newHistogram(t, &Rule{Metrics: []string{"http_*"}, Fields: []string{"latency_*"}, Buckets: []float64{0.5, 1.5}})
+
+	h.Apply(latency("server01", 0.25, 1.0))
+	h.Apply(latency("server02", 2.0))
+	out := flush(h)
+	if len(out) != 8 {
+		t.Fatalf("got %d metrics, want 4 per series", len(out))
+	}
+	// in the order the series were seen
+	if out[0].Tags["host"] != "server01" || out[4].Tags["host"] != "server02" {
+		t.Errorf("got the series of %s first, want server01", out[0].Tags["host"])
+	}
+	if counts, _ := buckets(t, out, "server01", "latency_ms"); !reflect.DeepEqual(counts, map[string]int64{"0.5": 1, "1.5": 2, "+Inf": 2}) {
+		t.Errorf("server01, got buckets %v", counts)
+	}
+	if counts, _ := buckets(t, out, "server02", "latency_ms"); !reflect.DeepEqual(counts, map[string]int64{"0.5": 0, "1.5": 0, "+Inf": 1}) {
+		t.Errorf("server02, got buckets %v", counts)
+	}
+
+	// the counts restart with the period
+	h.Apply(latency("server01", 1.0))
+	out = flush(h)
+	if len(out) != 4 {
+		t.Fatalf("got %d metrics, want the series seen in the period alone", len(out))
+	}
+	counts, total := buckets(t, out, "server01", "latency_ms")
+	if !reflect.DeepEqual(counts, map[string]int64{"0.5": 0, "1.5": 1, "+Inf": 1}) || total.Fields["latency_ms_count"] != int64(1) {
+		t.Errorf("got buckets %v and %v, want the counts restarted", counts, total.Fields)
+	}
+
+	// nothing seen, nothing emitted
+	if out := flush(h); len(out) != 0 {
+		t.Errorf("got %d metrics for an empty period", len(out))
+	}
+}
+
+func TestDropOriginal(t *testing.T) {
+	h := newHistogram(t, &Rule{Metrics: []string{"http_request"}, Fields: []string{"latency_ms"}, Buckets: []float64{10}})
+	h.DropOriginal = true
+
+	cpu := &service.MetricData{Name: "cpu", Tags: map[string]string{}, Fields: map[string]interface{}{"latency_ms": 1.0}}
+	// a value not numeric isn't counted, the metric is kept
+	text := latency("server01", "slow")[0]
+	out := h.Apply(append(latency("server01", 1.0, 20.0), cpu, text))
+	if len(out) != 2 || out[0] != cpu || out[1] != text {
+		t.Errorf("got %d metrics, want the cpu and the not numeric ones kept", len(out))
+	}
+	counts, _ := buckets(t, flush(h), "server01", "latency_ms")
+	if !reflect.DeepEqual(counts, map[string]int64{"10": 1, "+Inf": 2}) {
+		t.Errorf("got buckets %v", counts)
+	}
+}
+
+func TestHistogramInvalid(t *testing.T) {
+	period := misc.Duration{Duration: time.Minute}
+	for _, h := range []*Histogram{
+		{Rules: []*Rule{{Fields: []string{"a"}, Buckets: []float64{1}}}},
+		{Period: period},
+		{Period: period, Rules: []*Rule{{Buckets: []float64{1}}}},
+		{Period: period, Rules: []*Rule{{Fields: []string{"a"}}}},
+		{Period: period, Rules: []*Rule{{Fields: []string{"a"}, Buckets: []float64{10, 1}}}},
+		{Period: period, Rules: []*Rule{{Fields: []string{"[a"}, Buckets: []float64{1}}}},
+	} {
+		if err := h.Init(); err == nil {
+			t.Errorf("invalid config %+v accepted", h)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package join
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/plugins/processor/expression"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+// warnSample logs one skipped field out of warnSample
+const warnSample = 100
+
+// Join adds metrics computed from the fields of two measurements with the
+// same values of the On tags, like the error ratio of the requests and
+// errors measurements. A metric of a side waits up to an interval for the
+// metric of the other side, the later one of a side replaces the earlier
+// one. Once both arrived the joined metric is emitted with the On tags and
+// the time of the later one. The metrics of the sides pass on unchanged.
+//
+// Like histogram, the time is only checked when metrics arrive: the
+// metrics unmatched for an interval are evicted with the first batch after
+// it, and with the "zero" policy joined with zeros for the other side.
+type Join struct {
+	// skipped is the number of joined fields skipped, accessed atomically,
+	// first for the 64-bit alignment on 32-bit platforms
+	skipped uint64
+
+	// Left and Right are the names of the joined measurements
+	Left  string
+	Right string
+	// On are the tags the two sides must share
+	On []string
+	// Measurement is the name of the joined metrics, <left>_<right> by
+	// default
+	Measurement string
+	// Fields are the expressions of the joined fields, by field name. The
+	// fields of the sides are left.<field> and right.<field>
+	Fields map[string]string
+	// Interval is how long a side waits for the other one
+	Interval misc.Duration
+	// Unmatched is "skip" to drop the metrics the other side never joined,
+	// or "zero" to join them with zeros for the fields of the other side
+	Unmatched string
+
+	exprs map[string]*expression.Expr
+	// refs are the fields of the sides the expressions reference
+	refs []string
+
+	sync.Mutex
+	pending map[string]*pair
+}
+
+// pair are the metrics of the two sides with the same On tags
+type pair struct {
+	tags        map[string]string
+	left, right *service.MetricData
+	// arrived is the arrival of the first metric of the pair
+	arrived time.Time
+}
+
+var sampleConfig = `
+  ## Measurements joined, on the tags they share
+  left = "http_requests"
+  right = "http_errors"
+  on = ["service", "host"]
+  ## Name of the joined metrics, by default <left>_<right>
+  # measurement = "http"
+  ## How long a side waits for the other one
+  # interval = "1m"
+  ## The sides never joined within the interval are dropped ("skip") or
+  ## joined with zeros for the fields of the other side ("zero")
+  # unmatched = "skip"
+
+  ## The expressions of the expression processor, the fields of the sides
+  ## are left.<field> and right.<field>
+  [processors.join.fields]
+    error_ratio = "right.count / left.count"
+`
+
+func (j *Join) Init() error {
+	if j.Left == "" || j.Right == "" {
+		return errors.New("left and right are required")
+	}
+	if j.Left == j.Right {
+		return errors.New("left and right must be different measurements")
+	}
+	if len(j.On) == 0 {
+		return errors.New("on is required")
+	}
+	if len(j.Fields) == 0 {
+		return errors.New("fields is required")
+	}
+	if j.Interval.Duration <= 0 {
+		return errors.New("interval must be positive")
+	}
+	switch j.Unmatched {
+	case "skip", "zero":
+	default:
+		return fmt.Errorf("invalid unmatched %s, can be: \"skip\", \"zero\"", j.Unmatched)
+	}
+	if j.Measurement == "" {
+		j.Measurement = j.Left + "_" + j.Right
+	}
+
+	j.exprs = make(map[string]*expression.Expr, len(j.Fields))
+	seen := make(map[string]bool)
+	for name, s := range j.Fields {
+		expr, err := expression.Compile(s)
+		if err != nil {
+			return fmt.Errorf("field %s invalid expression %s, %s", name, s, err)
+		}
+		for _, ref := range expr.Fields() {
+			if !strings.HasPrefix(ref, "left.") && !strings.HasPrefix(ref, "right.") {
+				return fmt.Errorf("field %s, %s must be left.<field> or right.<field>", name, ref)
+			}
+			if !seen[ref] {
+				seen[ref] = true
+				j.refs = append(j.refs, ref)
+			}
+		}
+		j.exprs[name] = expr
+	}
+
+	j.pending = make(map[string]*pair)
+	return nil
+}
+
+func (j *Join) Apply(metrics []*service.MetricData) []*service.MetricData {
+	j.Lock()
+	defer j.Unlock()
+
+	now := time.Now()
+	joined := j.evict(now)
+
+	for _, metric := range metrics {
+		if metric.Name != j.Left && metric.Name != j.Right {
+			continue
+		}
+		key, ok := j.key(metric)
+		if !ok {
+			continue
+		}
+
+		p, ok := j.pending[key]
+		if !ok {
+			p = &pair{tags: j.tags(metric), arrived: now}
+			j.pending[key] = p
+		}
+		if metric.Name == j.Left {
+			p.left = metric
+		} else {
+			p.right = metric
+		}
+		if p.left == nil || p.right == nil {
+			continue
+		}
+
+		delete(j.pending, key)
+		if m := j.join(p); m != nil {
+			joined = append(joined, m)
+		}
+	}
+	return append(metrics, joined...)
+}
+
+// evict removes the pairs waiting for an interval, with the "zero" policy
+// it returns them joined.
+func (j *Join) evict(now time.Time) []*service.MetricData {
+	var expired []string
+	for key, p := range j.pending {
+		if now.Sub(p.arrived) >= j.Interval.Duration {
+			expired = append(expired, key)
+		}
+	}
+	// the joined metrics in the same order from one run to the next
+	sort.Strings(expired)
+
+	var joined []*service.MetricData
+	for _, key := range expired {
+		p := j.pending[key]
+		delete(j.pending, key)
+		if j.Unmatched != "zero" {
+			continue
+		}
+		if m := j.join(p); m != nil {
+			joined = append(joined, m)
+		}
+	}
+	return joined
+}
+
+// join computes the fields of the pair, a missing side has zeros for the
+// fields it's referenced by. It returns nil when no field is computed.
+func (j *Join) join(p *pair) *service.MetricData {
+	fields := make(map[string]float64)
+	var t time.Time
+	for _, side := range []struct {
+		prefix string
+		metric *service.MetricData
+	}{{"left.", p.left}, {"right.", p.right}} {
+		if side.metric == nil {
+			for _, ref := range j.refs {
+				if strings.HasPrefix(ref, side.prefix) {
+					fields[ref] = 0
+				}
+			}
+			continue
+		}
+		for k, v := range side.metric.Fields {
+			if f, ok := service.ToFloat(v); ok {
+				fields[side.prefix+k] = f
+			}
+		}
+		if side.metric.Time.After(t) {
+			t = side.metric.Time
+		}
+	}
+
+	m := &service.MetricData{
+		Name:   j.Measurement,
+		Tags:   make(map[string]string, len(p.tags)),
+		Fields: make(map[string]interface{}, len(j.exprs)),
+		Time:   t,
+	}
+	for k, v := range p.tags {
+		m.Tags[k] = v
+	}
+	for name, expr := range j.exprs {
+		v, missing := expr.Eval(fields)
+		if missing != "" {
+			j.skip(name, "missing field", missing)
+			continue
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			j.skip(name, "result not a number", "")
+			continue
+		}
+		m.Fields[name] = v
+	}
+	if len(m.Fields) == 0 {
+		return nil
+	}
+	return m
+}
+
+// key returns the values of the On tags of the metric, false when it
+// misses one of them.
+func (j *Join) key(metric *service.MetricData) (string, bool) {
+	values := make([]string, len(j.On))
+	for i, k := range j.On {
+		v, ok := metric.Tags[k]
+		if !ok {
+			return "", false
+		}
+		values[i] = v
+	}
+	return strings.Join(values, "\x00"), true
+}
+
+func (j *Join) tags(metric *service.MetricData) map[string]string {
+	tags := make(map[string]string, len(j.On))
+	for _, k := range j.On {
+		tags[k] = metric.Tags[k]
+	}
+	return tags
+}
+
+// skip counts the skipped field and logs a sample of them.
+func (j *Join) skip(field, reason, missing string) {
+	n := atomic.AddUint64(&j.skipped, 1)
+	if n%warnSample != 1 {
+		return
+	}
+	service.VLogger.Warn("join field skipped",
+		zap.String("measurement", j.Measurement),
+		zap.String("field", field),
+		zap.String("reason", reason),
+		zap.String("missing", missing),
+		zap.Int64("skipped", int64(n)),
+	)
+}
+
+func init() {
+	service.AddProcessor("join", func() service.Processor {
+		return &Join{
+			Interval:  misc.Duration{Duration: time.Minute},
+			Unmatched: "skip",
+		}
+	})
+}
@@ -0,0 +1,218 @@
+package join
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+func newJoin(t *testing.T, j *Join) *Join {
+	j.Left, j.Right = "http_requests", "http_errors"
+	j.On = []string{"service", "host"}
+	if j.Fields == nil {
+		j.Fields = map[string]string{"error_ratio": "right.count / left.count"}
+	}
+	j.Interval = misc.Duration{Duration: time.Minute}
+	if j.Unmatched == "" {
+		j.Unmatched = "skip"
+	}
+	if err := j.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func metric(name, host string, count interface{}, sec int64) *service.MetricData {
+	return &service.MetricData{
+		Name:   name,
+		Tags:   map[string]string{"service": "api", "host": host, "status": "5xx"},
+		Fields: map[string]interface{}{"count": count},
+		Time:   time.Unix(sec, 0),
+	}
+}
+
+// expire ends the interval of the pending metrics, they're evicted with the
+// next batch.
+func expire(j *Join) []*service.MetricData {
+	j.Lock()
+	for _, p := range j.pending {
+		p.arrived = p.arrived.Add(-j.Interval.Duration)
+	}
+	j.Unlock()
+	return j.Apply(nil)
+}
+
+func TestJoinMatched(t *testing.T) {
+	j := newJoin(t, &Join{})
+	got := j.Apply([]*service.MetricData{
+		metric("http_requests", "a", int64(200), 10),
+		metric("cpu", "a", 1.0, 10),
+	})
+	if len(got) != 2 {
+		t.Fatalf("got %d metrics, want the left side waiting", len(got))
+	}
+
+	// the other side in a later batch
+	got = j.Apply([]*service.MetricData{metric("http_errors", "a", int64(5), 12)})
+	if len(got) != 2 {
+		t.Fatalf("got %d metrics, want the side and the joined metric", len(got))
+	}
+	want := &service.MetricData{
+		Name:   "http_requests_http_errors",
+		Tags:   map[string]string{"service": "api", "host": "a"},
+		Fields: map[string]interface{}{"error_ratio": 0.025},
+		Time:   time.Unix(12, 0),
+	}
+	if !reflect.DeepEqual(got[1], want) {
+		t.Errorf("got joined metric %+v, want %+v", got[1], want)
+	}
+	// the sides pass on unchanged
+	if got[0].Name != "http_errors" || len(got[0].Fields) != 1 {
+		t.Errorf("got side %+v", got[0])
+	}
+	if len(j.pending) != 0 {
+		t.Errorf("got %d metrics pending after the join", len(j.pending))
+	}
+}
+
+func TestJoinOnTags(t *testing.T) {
+	j := newJoin(t, &Join{Measurement: "http"})
+	noHost := metric("http_errors", "a", int64(1), 10)
+	delete(noHost.Tags, "host")
+	got := j.Apply([]*service.MetricData{
+		metric("http_requests", "a", int64(100), 10),
+		// another host, a metric without the tag
+		metric("http_errors", "b", int64(1), 10),
+		noHost,
+		// the later metric of a side replaces the earlier one
+		metric("http_requests", "a", int64(50), 11),
+		metric("http_errors", "a", int64(10), 10),
+	})
+	if len(got) != 6 {
+		t.Fatalf("got %d metrics, want one joined", len(got)-5)
+	}
+	if m := got[5]; m.Name != "http" || m.Fields["error_ratio"] != 0.2 || !m.Time.Equal(time.Unix(11, 0)) {
+		t.Errorf("got joined metric %+v", m)
+	}
+	// host b still waits
+	if len(j.pending) != 1 {
+		t.Errorf("got %d metrics pending, want 1", len(j.pending))
+	}
+}
+
+func TestUnmatchedSkip(t *testing.T) {
+	j := newJoin(t, &Join{})
+	j.Apply([]*service.MetricData{metric("http_requests", "a", int64(100), 10)})
+	if got := expire(j); len(got) != 0 {
+		t.Errorf("got metrics %v, want the unmatched side dropped", got)
+	}
+	if len(j.pending) != 0 {
+		t.Errorf("got %d metrics pending after the interval", len(j.pending))
+	}
+
+	// the side evicted, a late other side waits for a new match
+	got := j.Apply([]*service.MetricData{metric("http_errors", "a", int64(5), 20)})
+	if len(got) != 1 || len(j.pending) != 1 {
+		t.Errorf("got %d metrics and %d pending, want the late side waiting", len(got), len(j.pending))
+	}
+}
+
+func TestUnmatchedZero(t *testing.T) {
+	j := newJoin(t, &Join{
+		Unmatched: "zero",
+		Fields: map[string]string{
+			"error_ratio": "right.count / left.count",
+			"ok":          "left.count - right.count",
+		},
+	})
+	j.Apply([]*service.MetricData{
+		metric("http_requests", "a", int64(100), 10),
+		metric("http_errors", "b", int64(5), 10),
+	})
+	got := expire(j)
+	if len(got) != 2 {
+		t.Fatalf("got %d metrics, want both sides joined with zeros", len(got))
+	}
+	// in the order of their tags, the ratio with no request isn't a number
+	want := []map[string]interface{}{
+		{"error_ratio": 0.0, "ok": 100.0},
+		{"ok": -5.0},
+	}
+	for i, m := range got {
+		if !reflect.DeepEqual(m.Fields, want[i]) {
+			t.Errorf("got fields %v, want %v", m.Fields, want[i])
+		}
+	}
+	if j.skipped != 1 {
+		t.Errorf("got %d fields skipped, want 1", j.skipped)
+	}
+}
+
+func TestRatio(t *testing.T) {
+	j := newJoin(t, &Join{Fields: map[string]string{
+		"error_ratio": "right.count / left.count",
+		"latency":     "left.latency_ms * 2",
+	}})
+	got := j.Apply([]*service.MetricData{
+		// the fields of any numeric type, strings aren't fields
+		metric("http_requests", "a", uint64(400), 10),
+		metric("http_errors", "a", int32(100), 10),
+		metric("http_requests", "b", "many", 10),
+		metric("http_errors", "b", 1.0, 10),
+		metric("http_requests", "c", 0.0, 10),
+		metric("http_errors", "c", 0.0, 10),
+	})
+	// the field missing a side field is skipped, the metric without field
+	// isn't emitted
+	if len(got) != 7 {
+		t.Fatalf("got %d joined metrics, want 1", len(got)-6)
+	}
+	if !reflect.DeepEqual(got[6].Fields, map[string]interface{}{"error_ratio": 0.25}) {
+		t.Errorf("got fields %v, want the ratio only", got[6].Fields)
+	}
+	// latency missing three times, the ratio of b missing and the 0/0 of c
+	if j.skipped != 5 {
+		t.Errorf("got %d fields skipped, want 5", j.skipped)
+	}
+}
+
+func TestJoinInvalid(t *testing.T) {
+	valid := func() *Join {
+		return &Join{
+			Left:      "http_requests",
+			Right:     "http_errors",
+			On:        []string{"service"},
+			Fields:    map[string]string{"error_ratio": "right.count / left.count"},
+			Interval:  misc.Duration{Duration: time.Minute},
+			Unmatched: "skip",
+		}
+	}
+	if err := valid().Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range []func(j *Join){
+		func(j *Join) { j.Left = "" },
+		func(j *Join) { j.Right = j.Left },
+		func(j *Join) { j.On = nil },
+		func(j *Join) { j.Fields = nil },
+		func(j *Join) { j.Interval.Duration = 0 },
+		func(j *Join) { j.Unmatched = "null" },
+		func(j *Join) { j.Fields = map[string]string{"error_ratio": "right.count /"} },
+		func(j *Join) { j.Fields = map[string]string{"error_ratio": "errors / left.count"} },
+	} {
+		j := valid()
+		change(j)
+		if err := j.Init(); err == nil {
+			t.Errorf("invalid config %+v accepted", j)
+		}
+	}
+}
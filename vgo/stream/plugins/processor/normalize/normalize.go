@@ -0,0 +1,168 @@
+package normalize
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+const (
+	// keepOriginal leaves the colliding tags untouched
+	keepOriginal = "keep_original"
+	// preferNormalized keeps the tag whose key is already normalized, else
+	// the first one of the colliding keys in sorted order
+	preferNormalized = "prefer_normalized"
+)
+
+// Normalize makes the tags consistent so the same series isn't split by
+// "Host1" and "host1 ": the keys and values are trimmed and lowercased as
+// configured, and the empty tags removed. Two tags normalized to the same
+// key are resolved by the CollisionPolicy.
+type Normalize struct {
+	// Tags are the keys of the normalized tags, globs are supported, empty
+	// normalizes all of them
+	Tags []string
+	// LowercaseKeys lowercases the keys
+	LowercaseKeys bool
+	// LowercaseValues are the keys of the tags whose values are lowercased,
+	// original or normalized, globs are supported
+	LowercaseValues []string
+	// TrimSpace trims the spaces around the keys and values
+	TrimSpace bool
+	// DropEmpty removes the tags whose value is empty once normalized
+	DropEmpty bool
+	// CollisionPolicy is "keep_original" or "prefer_normalized"
+	CollisionPolicy string
+
+	tags            service.Filter
+	lowercaseValues service.Filter
+}
+
+var sampleConfig = `
+  ## Normalized tags, globs are supported, all of them when empty
+  # tags = []
+  lowercase_keys = false
+  ## Tags whose values are lowercased
+  lowercase_values = ["host"]
+  trim_space = true
+  drop_empty = true
+  ## Tags normalized to the same key: "keep_original" leaves them untouched,
+  ## "prefer_normalized" keeps the one whose key is already normalized
+  # collision_policy = "keep_original"
+`
+
+func (n *Normalize) Init() error {
+	switch n.CollisionPolicy {
+	case keepOriginal, preferNormalized:
+	default:
+		return fmt.Errorf("invalid collision_policy %s, can be: \"%s\", \"%s\"", n.CollisionPolicy, keepOriginal, preferNormalized)
+	}
+
+	var err error
+	if n.tags, err = service.CompileFilter(n.Tags); err != nil {
+		return err
+	}
+	n.lowercaseValues, err = service.CompileFilter(n.LowercaseValues)
+	return err
+}
+
+func (n *Normalize) Apply(metrics []*service.MetricData) []*service.MetricData {
+	for _, metric := range metrics {
+		if len(metric.Tags) > 0 {
+			metric.Tags = n.normalize(metric.Tags)
+		}
+	}
+	return metrics
+}
+
+// normalize returns the normalized tags.
+func (n *Normalize) normalize(tags map[string]string) map[string]string {
+	// the original keys of every normalized key, sorted so the result
+	// doesn't depend on the map order
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := make(map[string]string, len(tags))
+	sources := make(map[string][]string, len(tags))
+	var order []string
+	for _, k := range keys {
+		if n.tags != nil && !n.tags.Match(k) {
+			// an untouched tag may still collide with a normalized one
+			sources[k] = append(sources[k], k)
+			if len(sources[k]) == 1 {
+				order = append(order, k)
+			}
+			continue
+		}
+		nk := n.key(k)
+		sources[nk] = append(sources[nk], k)
+		if len(sources[nk]) == 1 {
+			order = append(order, nk)
+		}
+	}
+
+	for _, nk := range order {
+		src := sources[nk]
+		if len(src) == 1 {
+			n.set(out, src[0], nk, tags[src[0]])
+			continue
+		}
+
+		if n.CollisionPolicy == keepOriginal {
+			for _, k := range src {
+				out[k] = tags[k]
+			}
+			continue
+		}
+		winner := src[0]
+		for _, k := range src {
+			if k == nk {
+				winner = k
+				break
+			}
+		}
+		n.set(out, winner, nk, tags[winner])
+	}
+	return out
+}
+
+// set adds the tag of key k normalized as nk.
+func (n *Normalize) set(out map[string]string, k, nk, v string) {
+	if n.tags != nil && !n.tags.Match(k) {
+		out[k] = v
+		return
+	}
+	if n.TrimSpace {
+		v = strings.TrimSpace(v)
+	}
+	if n.lowercaseValues != nil && (n.lowercaseValues.Match(k) || n.lowercaseValues.Match(nk)) {
+		v = strings.ToLower(v)
+	}
+	if v == "" && n.DropEmpty {
+		return
+	}
+	out[nk] = v
+}
+
+func (n *Normalize) key(k string) string {
+	if n.TrimSpace {
+		k = strings.TrimSpace(k)
+	}
+	if n.LowercaseKeys {
+		k = strings.ToLower(k)
+	}
+	return k
+}
+
+func init() {
+	service.AddProcessor("normalize", func() service.Processor {
+		return &Normalize{
+			CollisionPolicy: keepOriginal,
+		}
+	})
+}
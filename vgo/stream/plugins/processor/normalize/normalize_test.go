@@ -0,0 +1,139 @@
+package normalize
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+func newNormalize(t *testing.T, n *Normalize) *Normalize {
+	if n.CollisionPolicy == "" {
+		n.CollisionPolicy = keepOriginal
+	}
+	if err := n.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func normalized(n *Normalize, tags map[string]string) map[string]string {
+	m := &service.MetricData{Name: "cpu", Tags: tags, Fields: map[string]interface{}{"usage": 1.0}}
+	return n.Apply([]*service.MetricData{m})[0].Tags
+}
+
+func TestTrimSpace(t *testing.T) {
+	n := newNormalize(t, &Normalize{TrimSpace: true})
+	got := normalized(n, map[string]string{" host ": "host1 ", "dc": "\tpar1"})
+	want := map[string]string{"host": "host1", "dc": "par1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got tags %v, want %v", got, want)
+	}
+}
+
+func TestLowercaseKeys(t *testing.T) {
+	n := newNormalize(t, &Normalize{LowercaseKeys: true})
+	got := normalized(n, map[string]string{"Host": "Host1", "DC": "PAR1"})
+	// the values are left as they are
+	want := map[string]string{"host": "Host1", "dc": "PAR1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got tags %v, want %v", got, want)
+	}
+}
+
+func TestLowercaseValues(t *testing.T) {
+	n := newNormalize(t, &Normalize{LowercaseValues: []string{"host", "region*"}})
+	got := normalized(n, map[string]string{"host": "Host1", "region_name": "EU-West", "dc": "PAR1"})
+	want := map[string]string{"host": "host1", "region_name": "eu-west", "dc": "PAR1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got tags %v, want %v", got, want)
+	}
+
+	// matched by the normalized key
+	n = newNormalize(t, &Normalize{LowercaseKeys: true, TrimSpace: true, LowercaseValues: []string{"host"}})
+	got = normalized(n, map[string]string{" Host": "Host1"})
+	want = map[string]string{"host": "host1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got tags %v, want %v", got, want)
+	}
+}
+
+func TestDropEmpty(t *testing.T) {
+	tags := func() map[string]string {
+		return map[string]string{"host": "host1", "rack": "", "dc": "  "}
+	}
+
+	n := newNormalize(t, &Normalize{TrimSpace: true, DropEmpty: true})
+	want := map[string]string{"host": "host1"}
+	if got := normalized(n, tags()); !reflect.DeepEqual(got, want) {
+		t.Errorf("got tags %v, want %v", got, want)
+	}
+
+	n = newNormalize(t, &Normalize{TrimSpace: true})
+	want = map[string]string{"host": "host1", "rack": "", "dc": ""}
+	if got := normalized(n, tags()); !reflect.DeepEqual(got, want) {
+		t.Errorf("got tags %v, want the empty tags kept %v", got, want)
+	}
+}
+
+func TestTagsFilter(t *testing.T) {
+	n := newNormalize(t, &Normalize{
+		Tags:            []string{"host*"},
+		LowercaseKeys:   true,
+		TrimSpace:       true,
+		DropEmpty:       true,
+		LowercaseValues: []string{"*"},
+	})
+	got := normalized(n, map[string]string{"hostname": " Host1 ", "DC": " PAR1 ", "rack": ""})
+	// only the matching tags are normalized
+	want := map[string]string{"hostname": "host1", "DC": " PAR1 ", "rack": ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got tags %v, want %v", got, want)
+	}
+}
+
+func TestCollision(t *testing.T) {
+	tags := func() map[string]string {
+		return map[string]string{"Host": "Host1", "host": "host2", "host ": "host3"}
+	}
+
+	// left untouched
+	n := newNormalize(t, &Normalize{LowercaseKeys: true, TrimSpace: true, CollisionPolicy: keepOriginal})
+	if got := normalized(n, tags()); !reflect.DeepEqual(got, tags()) {
+		t.Errorf("got tags %v, want the colliding tags untouched %v", got, tags())
+	}
+
+	// the tag already normalized wins
+	n = newNormalize(t, &Normalize{LowercaseKeys: true, TrimSpace: true, CollisionPolicy: preferNormalized})
+	want := map[string]string{"host": "host2"}
+	if got := normalized(n, tags()); !reflect.DeepEqual(got, want) {
+		t.Errorf("got tags %v, want %v", got, want)
+	}
+
+	// none is, the first key in sorted order wins whatever the map order
+	for i := 0; i < 20; i++ {
+		got := normalized(n, map[string]string{"HOST": "a", "Host": "b", "hOST": "c"})
+		if want := map[string]string{"host": "a"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got tags %v, want %v", got, want)
+		}
+	}
+
+	// a tag left out of the filter collides too
+	n = newNormalize(t, &Normalize{Tags: []string{"Host"}, LowercaseKeys: true, CollisionPolicy: keepOriginal})
+	want = map[string]string{"Host": "a", "host": "b"}
+	if got := normalized(n, map[string]string{"Host": "a", "host": "b"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got tags %v, want %v", got, want)
+	}
+}
+
+func TestNormalizeInvalid(t *testing.T) {
+	for _, n := range []*Normalize{
+		{CollisionPolicy: "last"},
+		{CollisionPolicy: keepOriginal, Tags: []string{"[host"}},
+		{CollisionPolicy: keepOriginal, LowercaseValues: []string{"[host"}},
+	} {
+		if err := n.Init(); err == nil {
+			t.Errorf("invalid config %+v accepted", n)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package predicate
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// Predicate keeps the metrics whose fields match the conditions and drops
+// the others, or the opposite with Invert. The metrics whose name doesn't
+// match Metrics always pass.
+type Predicate struct {
+	// Metrics are the names of the metrics checked, globs are supported,
+	// empty checks all of them
+	Metrics []string
+	// Mode is "and", all the conditions must match, or "or", one of them
+	Mode string
+	// Invert drops the matching metrics instead of keeping them
+	Invert     bool
+	Conditions []*Condition
+
+	filter service.Filter
+}
+
+// Condition compares a field to a value. The value is a string compared by
+// the type of the field: as a number to the numeric fields, as a boolean to
+// the boolean fields. A missing field, or a field whose type can't be
+// compared to the value, doesn't match.
+type Condition struct {
+	Field string
+	// Op is "eq", "ne", "gt", "lt", "contains" or "regex". gt and lt compare
+	// numbers, contains and regex strings
+	Op    string
+	Value string
+
+	number float64
+	re     *regexp.Regexp
+}
+
+var sampleConfig = `
+  ## Metrics checked, globs are supported, all of them when empty
+  # metrics = []
+  ## "and": all the conditions must match, "or": one of them
+  # mode = "and"
+  ## Drop the matching metrics instead of keeping them
+  # invert = false
+
+  ## The value is compared by the type of the field, a missing field or a
+  ## field of another type doesn't match. "gt" and "lt" compare numbers,
+  ## "contains" and "regex" strings
+  [[processors.predicate.conditions]]
+    field = "status"
+    ## "eq", "ne", "gt", "lt", "contains" or "regex"
+    op = "eq"
+    value = "error"
+`
+
+func (p *Predicate) Init() error {
+	switch p.Mode {
+	case "and", "or":
+	default:
+		return fmt.Errorf("invalid mode %s, can be: \"and\", \"or\"", p.Mode)
+	}
+	if len(p.Conditions) == 0 {
+		return errors.New("no conditions")
+	}
+
+	for _, c := range p.Conditions {
+		if c.Field == "" {
+			return errors.New("condition without field")
+		}
+		switch c.Op {
+		case "eq", "ne", "contains":
+		case "gt", "lt":
+			n, err := strconv.ParseFloat(c.Value, 64)
+			if err != nil {
+				return fmt.Errorf("condition %s %s value %s not a number", c.Field, c.Op, c.Value)
+			}
+			c.number = n
+		case "regex":
+			re, err := regexp.Compile(c.Value)
+			if err != nil {
+				return fmt.Errorf("condition %s invalid regex %s, %s", c.Field, c.Value, err)
+			}
+			c.re = re
+		default:
+			return fmt.Errorf("condition %s invalid op %s", c.Field, c.Op)
+		}
+	}
+
+	var err error
+	p.filter, err = service.CompileFilter(p.Metrics)
+	return err
+}
+
+func (p *Predicate) Apply(metrics []*service.MetricData) []*service.MetricData {
+	out := metrics[:0]
+	for _, metric := range metrics {
+		if p.filter != nil && !p.filter.Match(metric.Name) {
+			out = append(out, metric)
+			continue
+		}
+		if p.match(metric) != p.Invert {
+			out = append(out, metric)
+		}
+	}
+	return out
+}
+
+func (p *Predicate) match(metric *service.MetricData) bool {
+	for _, c := range p.Conditions {
+		m := c.match(metric.Fields[c.Field])
+		if p.Mode == "or" && m {
+			return true
+		}
+		if p.Mode == "and" && !m {
+			return false
+		}
+	}
+	return p.Mode == "and"
+}
+
+func (c *Condition) match(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+
+	switch c.Op {
+	case "eq", "ne":
+		eq, ok := c.equal(v)
+		return ok && eq == (c.Op == "eq")
+	case "gt", "lt":
+		f, ok := service.ToFloat(v)
+		if !ok {
+			return false
+		}
+		if c.Op == "gt" {
+			return f > c.number
+		}
+		return f < c.number
+	case "contains":
+		s, ok := v.(string)
+		return ok && strings.Contains(s, c.Value)
+	case "regex":
+		s, ok := v.(string)
+		return ok && c.re.MatchString(s)
+	}
+	return false
+}
+
+// equal compares the field to the value by the type of the field, ok is
+// false when the value can't be converted to it.
+func (c *Condition) equal(v interface{}) (eq bool, ok bool) {
+	switch t := v.(type) {
+	case string:
+		return t == c.Value, true
+	case bool:
+		b, err := strconv.ParseBool(c.Value)
+		if err != nil {
+			return false, false
+		}
+		return t == b, true
+	}
+
+	f, ok := service.ToFloat(v)
+	if !ok {
+		return false, false
+	}
+	n, err := strconv.ParseFloat(c.Value, 64)
+	if err != nil {
+		return false, false
+	}
+	return f == n, true
+}
+
+func init() {
+	service.AddProcessor("predicate", func() service.Processor {
+		return &Predicate{
+			Mode: "and",
+		}
+	})
+}
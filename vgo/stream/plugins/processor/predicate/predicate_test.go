@@ -0,0 +1,127 @@
+package predicate
+
+import (
+	"testing"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+func TestCondition(t *testing.T) {
+	for _, tt := range []struct {
+		op    string
+		value string
+		field interface{}
+		match bool
+	}{
+		// strings
+		{"eq", "error", "error", true},
+		{"eq", "error", "ok", false},
+		{"ne", "error", "ok", true},
+		{"ne", "error", "error", false},
+		// numbers of every type compare as numbers
+		{"eq", "500", int64(500), true},
+		{"eq", "500", 500.0, true},
+		{"eq", "500", uint64(501), false},
+		{"eq", "5e2", int64(500), true},
+		{"ne", "500", int64(404), true},
+		{"eq", "error", int64(500), false},
+		{"ne", "error", int64(500), false},
+		{"gt", "100", 100.5, true},
+		{"gt", "100", int64(100), false},
+		{"gt", "100", "200", false},
+		{"lt", "0.5", float32(0.25), true},
+		{"lt", "0.5", int64(1), false},
+		// booleans
+		{"eq", "true", true, true},
+		{"eq", "1", true, true},
+		{"eq", "false", true, false},
+		{"ne", "false", true, true},
+		{"eq", "yes", true, false},
+		// strings only
+		{"contains", "time", "timeout reached", true},
+		{"contains", "time", "refused", false},
+		{"contains", "5", int64(500), false},
+		{"regex", "^5\\d\\d$", "503", true},
+		{"regex", "^5\\d\\d$", "404", false},
+		{"regex", "5", int64(500), false},
+		// missing field
+		{"eq", "error", nil, false},
+		{"ne", "error", nil, false},
+	} {
+		p := &Predicate{Mode: "and", Conditions: []*Condition{{Field: "status", Op: tt.op, Value: tt.value}}}
+		if err := p.Init(); err != nil {
+			t.Fatal(err)
+		}
+		fields := map[string]interface{}{"value": 1.0}
+		if tt.field != nil {
+			fields["status"] = tt.field
+		}
+		if got := p.match(&service.MetricData{Name: "http", Fields: fields}); got != tt.match {
+			t.Errorf("%#v %s %s, got match %v, want %v", tt.field, tt.op, tt.value, got, tt.match)
+		}
+	}
+}
+
+func metrics() []*service.MetricData {
+	return []*service.MetricData{
+		{Name: "http", Fields: map[string]interface{}{"status": "error", "code": int64(500)}},
+		{Name: "http", Fields: map[string]interface{}{"status": "ok", "code": int64(200)}},
+		{Name: "http", Fields: map[string]interface{}{"status": "error", "code": int64(404)}},
+		{Name: "cpu", Fields: map[string]interface{}{"idle": 98.5}},
+	}
+}
+
+func apply(t *testing.T, p *Predicate) []*service.MetricData {
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return p.Apply(metrics())
+}
+
+func TestAndOr(t *testing.T) {
+	conditions := func() []*Condition {
+		return []*Condition{
+			{Field: "status", Op: "eq", Value: "error"},
+			{Field: "code", Op: "gt", Value: "499"},
+		}
+	}
+	// cpu has none of the fields
+	if got := apply(t, &Predicate{Mode: "and", Conditions: conditions()}); len(got) != 1 || got[0].Fields["code"] != int64(500) {
+		t.Errorf("and, got %v, want the error 500", got)
+	}
+	if got := apply(t, &Predicate{Mode: "or", Conditions: conditions()}); len(got) != 2 || got[1].Fields["code"] != int64(404) {
+		t.Errorf("or, got %v, want the two errors", got)
+	}
+}
+
+func TestInvert(t *testing.T) {
+	p := &Predicate{Mode: "and", Invert: true, Conditions: []*Condition{{Field: "status", Op: "eq", Value: "error"}}}
+	got := apply(t, p)
+	// the metrics without the field don't match, they're kept
+	if len(got) != 2 || got[0].Fields["status"] != "ok" || got[1].Name != "cpu" {
+		t.Errorf("got %v, want the ok and the cpu metrics", got)
+	}
+}
+
+func TestMetricsFilter(t *testing.T) {
+	p := &Predicate{Mode: "and", Metrics: []string{"ht*"}, Conditions: []*Condition{{Field: "status", Op: "eq", Value: "error"}}}
+	got := apply(t, p)
+	if len(got) != 3 || got[2].Name != "cpu" {
+		t.Errorf("got %v, want the errors and cpu unchecked", got)
+	}
+}
+
+func TestPredicateInvalid(t *testing.T) {
+	for _, p := range []*Predicate{
+		{Mode: "xor", Conditions: []*Condition{{Field: "a", Op: "eq"}}},
+		{Mode: "and"},
+		{Mode: "and", Conditions: []*Condition{{Op: "eq"}}},
+		{Mode: "and", Conditions: []*Condition{{Field: "a", Op: "ge", Value: "1"}}},
+		{Mode: "and", Conditions: []*Condition{{Field: "a", Op: "gt", Value: "high"}}},
+		{Mode: "and", Conditions: []*Condition{{Field: "a", Op: "regex", Value: "(5"}}},
+	} {
+		if err := p.Init(); err == nil {
+			t.Errorf("invalid config %+v accepted", p)
+		}
+	}
+}
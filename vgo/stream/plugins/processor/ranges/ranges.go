@@ -0,0 +1,191 @@
+package ranges
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+const (
+	// dropField removes the out of range field from the metric
+	dropField = "drop_field"
+	// dropMetric removes the whole metric
+	dropMetric = "drop_metric"
+	// clamp replaces the value by the bound it crossed
+	clamp = "clamp"
+
+	// warnSample logs one violation of a rule out of warnSample
+	warnSample = 100
+)
+
+// Ranges checks the numeric fields against the bounds of the first rule
+// matching their name, the non numeric fields are never checked.
+type Ranges struct {
+	Rules []*Rule
+}
+
+type Rule struct {
+	// violations is the number of out of range values, accessed atomically
+	violations uint64
+
+	// Fields are the field names the rule applies to, globs are supported
+	Fields []string
+	// Min and Max are the bounds, a missing bound isn't checked
+	Min *float64
+	Max *float64
+	// Policy can be "drop_field", "drop_metric" or "clamp"
+	Policy string
+
+	filter service.Filter
+}
+
+var sampleConfig = `
+  ## The rules are checked in order, a field is checked by the first rule
+  ## matching its name. The bounds are floats: write -50.0, not -50.
+  [[processors.ranges.rules]]
+    fields = ["temp*"]
+    min = -50.0
+    max = 150.0
+    ## What to do with an out of range value: "drop_field", "drop_metric", "clamp"
+    policy = "drop_field"
+`
+
+func (r *Ranges) Init() error {
+	for _, rule := range r.Rules {
+		if len(rule.Fields) == 0 {
+			return errors.New("rule without fields")
+		}
+		if rule.Min == nil && rule.Max == nil {
+			return fmt.Errorf("rule %v without min nor max", rule.Fields)
+		}
+		if rule.Min != nil && rule.Max != nil && *rule.Min > *rule.Max {
+			return fmt.Errorf("rule %v min %v greater than max %v", rule.Fields, *rule.Min, *rule.Max)
+		}
+
+		switch rule.Policy {
+		case "":
+			rule.Policy = dropField
+		case dropField, dropMetric, clamp:
+		default:
+			return fmt.Errorf("rule %v invalid policy %s", rule.Fields, rule.Policy)
+		}
+
+		filter, err := service.CompileFilter(rule.Fields)
+		if err != nil {
+			return err
+		}
+		rule.filter = filter
+	}
+	return nil
+}
+
+func (r *Ranges) Apply(metrics []*service.MetricData) []*service.MetricData {
+	out := metrics[:0]
+	for _, metric := range metrics {
+		if r.check(metric) {
+			out = append(out, metric)
+		}
+	}
+	return out
+}
+
+// check applies the rules to the fields of the metric, it returns false when
+// the metric must be dropped.
+func (r *Ranges) check(metric *service.MetricData) bool {
+	for k, v := range metric.Fields {
+		rule := r.rule(k)
+		if rule == nil {
+			continue
+		}
+
+		value, ok := service.ToFloat(v)
+		if !ok {
+			continue
+		}
+
+		bound, ok := rule.bound(value)
+		if ok {
+			continue
+		}
+		rule.violation(metric, k, value)
+
+		switch rule.Policy {
+		case dropMetric:
+			return false
+		case clamp:
+			metric.Fields[k] = clampValue(v, bound)
+		default:
+			delete(metric.Fields, k)
+		}
+	}
+
+	// a metric without fields can't be written
+	return len(metric.Fields) > 0
+}
+
+func (r *Ranges) rule(field string) *Rule {
+	for _, rule := range r.Rules {
+		if rule.filter.Match(field) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// bound returns the bound the value crossed and false when it's out of range.
+func (rule *Rule) bound(value float64) (float64, bool) {
+	if rule.Min != nil && value < *rule.Min {
+		return *rule.Min, false
+	}
+	if rule.Max != nil && value > *rule.Max {
+		return *rule.Max, false
+	}
+	return 0, true
+}
+
+// violation counts the violation and logs a sample of them.
+func (rule *Rule) violation(metric *service.MetricData, field string, value float64) {
+	n := atomic.AddUint64(&rule.violations, 1)
+	if n%warnSample != 1 {
+		return
+	}
+	service.VLogger.Warn("value out of range",
+		zap.String("metric", metric.Name),
+		zap.String("field", field),
+		zap.Float64("value", value),
+		zap.String("policy", rule.Policy),
+		zap.Int64("violations", int64(n)),
+	)
+}
+
+// Violations returns the number of out of range values seen by the rule.
+func (rule *Rule) Violations() uint64 {
+	return atomic.LoadUint64(&rule.violations)
+}
+
+// clampValue returns the bound with the type of the original value.
+func clampValue(v interface{}, bound float64) interface{} {
+	switch v.(type) {
+	case int:
+		return int(bound)
+	case int32:
+		return int32(bound)
+	case int64:
+		return int64(bound)
+	case uint64:
+		return uint64(bound)
+	case float32:
+		return float32(bound)
+	default:
+		return bound
+	}
+}
+
+func init() {
+	service.AddProcessor("ranges", func() service.Processor {
+		return &Ranges{}
+	})
+}
@@ -0,0 +1,116 @@
+package ranges
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+func newRanges(t *testing.T, policy string) *Ranges {
+	min, max := -50.0, 150.0
+	r := &Ranges{Rules: []*Rule{{Fields: []string{"temp*"}, Min: &min, Max: &max, Policy: policy}}}
+	if err := r.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRanges(t *testing.T) {
+	for _, tt := range []struct {
+		policy string
+		value  interface{}
+		// want are the fields of the metric, nil when it's dropped
+		want map[string]interface{}
+	}{
+		{dropField, 20.5, map[string]interface{}{"temp": 20.5, "humidity": 40.0}},
+		{dropField, -9999.0, map[string]interface{}{"humidity": 40.0}},
+		{dropField, int64(200), map[string]interface{}{"humidity": 40.0}},
+
+		{dropMetric, 20.5, map[string]interface{}{"temp": 20.5, "humidity": 40.0}},
+		{dropMetric, -9999.0, nil},
+		{dropMetric, int64(200), nil},
+
+		{clamp, 20.5, map[string]interface{}{"temp": 20.5, "humidity": 40.0}},
+		{clamp, -9999.0, map[string]interface{}{"temp": -50.0, "humidity": 40.0}},
+		{clamp, int64(200), map[string]interface{}{"temp": int64(150), "humidity": 40.0}},
+
+		// the bounds are inclusive
+		{dropMetric, 150.0, map[string]interface{}{"temp": 150.0, "humidity": 40.0}},
+		{dropMetric, -50.0, map[string]interface{}{"temp": -50.0, "humidity": 40.0}},
+		// the non numeric fields aren't checked
+		{dropMetric, "hot", map[string]interface{}{"temp": "hot", "humidity": 40.0}},
+	} {
+		r := newRanges(t, tt.policy)
+		metric := &service.MetricData{
+			Name:   "sensor",
+			Fields: map[string]interface{}{"temp": tt.value, "humidity": 40.0},
+		}
+		out := r.Apply([]*service.MetricData{metric})
+
+		if tt.want == nil {
+			if len(out) != 0 {
+				t.Errorf("%s %v, metric not dropped", tt.policy, tt.value)
+			}
+			continue
+		}
+		if len(out) != 1 {
+			t.Errorf("%s %v, metric dropped", tt.policy, tt.value)
+			continue
+		}
+		if !reflect.DeepEqual(out[0].Fields, tt.want) {
+			t.Errorf("%s %v, got fields %v, want %v", tt.policy, tt.value, out[0].Fields, tt.want)
+		}
+	}
+}
+
+func TestRangesViolations(t *testing.T) {
+	r := newRanges(t, dropField)
+	var metrics []*service.MetricData
+	for _, v := range []float64{-100, 0, 100, 200} {
+		metrics = append(metrics, &service.MetricData{Name: "sensor", Fields: map[string]interface{}{"temp": v}})
+	}
+	// the metrics left without fields are dropped
+	if out := r.Apply(metrics); len(out) != 2 {
+		t.Errorf("got %d metrics, want 2", len(out))
+	}
+	if n := r.Rules[0].Violations(); n != 2 {
+		t.Errorf("%d violations counted, want 2", n)
+	}
+}
+
+func TestRangesFirstRule(t *testing.T) {
+	zero, ten, hundred := 0.0, 10.0, 100.0
+	r := &Ranges{Rules: []*Rule{
+		{Fields: []string{"temp_room"}, Max: &ten, Policy: clamp},
+		{Fields: []string{"temp*"}, Min: &zero, Max: &hundred},
+	}}
+	if err := r.Init(); err != nil {
+		t.Fatal(err)
+	}
+	out := r.Apply([]*service.MetricData{{Name: "sensor", Fields: map[string]interface{}{"temp_room": 50.0, "temp_oven": 50.0}}})
+	want := map[string]interface{}{"temp_room": 10.0, "temp_oven": 50.0}
+	if len(out) != 1 || !reflect.DeepEqual(out[0].Fields, want) {
+		t.Errorf("got %v, want %v", out, want)
+	}
+}
+
+func TestRangesInit(t *testing.T) {
+	one, two := 1.0, 2.0
+	for _, rule := range []*Rule{
+		{Min: &one},
+		{Fields: []string{"temp"}},
+		{Fields: []string{"temp"}, Min: &two, Max: &one},
+		{Fields: []string{"temp"}, Min: &one, Policy: "ignore"},
+	} {
+		if err := (&Ranges{Rules: []*Rule{rule}}).Init(); err == nil {
+			t.Errorf("invalid rule %+v accepted", rule)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package rename
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// Rename rewrites the metric names: the Replace rules run first, in order,
+// on the original name, then Prefix and Suffix are added.
+type Rename struct {
+	Prefix  string
+	Suffix  string
+	Replace []*Replace
+}
+
+type Replace struct {
+	// Pattern is a regular expression, Replacement can refer to its groups: ${1}
+	Pattern     string
+	Replacement string
+
+	re *regexp.Regexp
+}
+
+var sampleConfig = `
+  ## Added to the names after the replacements
+  prefix = "prod."
+  # suffix = ""
+
+  ## Regular expressions replaced in order, before the prefix and suffix
+  [[processors.rename.replace]]
+    pattern = "^cpu_"
+    replacement = "cpu."
+`
+
+// Init compiles the patterns, so an invalid one fails the config loading.
+func (r *Rename) Init() error {
+	for _, rp := range r.Replace {
+		re, err := regexp.Compile(rp.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %s, %s", rp.Pattern, err)
+		}
+		rp.re = re
+	}
+	return nil
+}
+
+func (r *Rename) Apply(metrics []*service.MetricData) []*service.MetricData {
+	for _, metric := range metrics {
+		metric.Name = r.rename(metric.Name)
+	}
+	return metrics
+}
+
+func (r *Rename) rename(name string) string {
+	for _, rp := range r.Replace {
+		name = rp.re.ReplaceAllString(name, rp.Replacement)
+	}
+	return r.Prefix + name + r.Suffix
+}
+
+func init() {
+	service.AddProcessor("rename", func() service.Processor {
+		return &Rename{}
+	})
+}
@@ -0,0 +1,51 @@
+package rename
+
+import (
+	"testing"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+func TestRename(t *testing.T) {
+	for _, tt := range []struct {
+		r    *Rename
+		name string
+		want string
+	}{
+		{&Rename{}, "cpu", "cpu"},
+		{&Rename{Prefix: "prod.", Suffix: ".v2"}, "cpu", "prod.cpu.v2"},
+		{&Rename{Replace: []*Replace{{Pattern: "^cpu_", Replacement: "cpu."}}}, "cpu_idle", "cpu.idle"},
+		{&Rename{Replace: []*Replace{{Pattern: `^(\w+)_(\w+)$`, Replacement: "${2}.${1}"}}}, "cpu_idle", "idle.cpu"},
+		// the replacements run in order, on the name without the prefix
+		{&Rename{
+			Prefix: "cpu_",
+			Replace: []*Replace{
+				{Pattern: "^cpu_", Replacement: "cpu."},
+				{Pattern: `\.`, Replacement: "/"},
+			},
+		}, "cpu_idle", "cpu_cpu/idle"},
+		{&Rename{
+			Replace: []*Replace{
+				{Pattern: `\.`, Replacement: "/"},
+				{Pattern: "^cpu_", Replacement: "cpu."},
+			},
+		}, "cpu_idle", "cpu.idle"},
+		// the prefix isn't replaced
+		{&Rename{Prefix: "prod_", Replace: []*Replace{{Pattern: "prod_", Replacement: ""}}}, "prod_cpu", "prod_cpu"},
+	} {
+		if err := tt.r.Init(); err != nil {
+			t.Fatal(err)
+		}
+		metrics := tt.r.Apply([]*service.MetricData{{Name: tt.name}})
+		if got := metrics[0].Name; got != tt.want {
+			t.Errorf("%s renamed %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRenameInvalidPattern(t *testing.T) {
+	r := &Rename{Replace: []*Replace{{Pattern: "cpu_("}}}
+	if err := r.Init(); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+}
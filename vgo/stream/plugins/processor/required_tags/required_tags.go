@@ -0,0 +1,156 @@
+package required_tags
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+// warnSample logs one rejected metric out of warnSample
+const warnSample = 1000
+
+// RequiredTags drops the metrics missing one of the required tags, or
+// writes them to the QuarantineFile. A tag with an empty value is missing.
+// The overrides replace the required tags of some metric names, an override
+// without tags exempts its metrics.
+type RequiredTags struct {
+	Tags []string
+	// Overrides replace Tags for the metrics of their names, a metric gets
+	// the first override matching its name
+	Overrides []*Override
+	// QuarantineFile receives the rejected metrics in line protocol, rotated
+	// over QuarantineMaxSize, 0 never rotates it
+	QuarantineFile    string
+	QuarantineMaxSize int64
+
+	quarantine *service.DeadLetter
+	// rejected is the number of rejected metrics, accessed atomically
+	rejected uint64
+}
+
+// Override are the tags required by the metrics matching Metrics
+type Override struct {
+	// Metrics are the names of the metrics, globs are supported
+	Metrics []string
+	// Tags are the tags required by the metrics, none when empty
+	Tags []string
+
+	filter service.Filter
+}
+
+var sampleConfig = `
+  ## The metrics missing one of these tags, or with it empty, are dropped
+  tags = ["service", "env"]
+  ## Write the rejected metrics to this file instead of dropping them
+  # quarantine_file = "./required_tags.quarantine"
+  # quarantine_max_size = 104857600
+
+  ## The metrics get the required tags of the first override matching their
+  ## name, an override without tags exempts them
+  [[processors.required_tags.overrides]]
+    metrics = ["vgo", "internal_*"]
+    tags = []
+`
+
+func (r *RequiredTags) Init() error {
+	if len(r.Tags) == 0 && len(r.Overrides) == 0 {
+		return errors.New("tags or overrides is required")
+	}
+	if r.QuarantineMaxSize < 0 {
+		return errors.New("quarantine_max_size can't be negative")
+	}
+
+	for i, o := range r.Overrides {
+		if len(o.Metrics) == 0 {
+			return fmt.Errorf("override %d, metrics is required", i)
+		}
+		var err error
+		if o.filter, err = service.CompileFilter(o.Metrics); err != nil {
+			return fmt.Errorf("override %d, %s", i, err)
+		}
+	}
+
+	if r.QuarantineFile != "" {
+		r.quarantine = service.NewDeadLetter(r.QuarantineFile, r.QuarantineMaxSize)
+	}
+	return nil
+}
+
+func (r *RequiredTags) Apply(metrics []*service.MetricData) []*service.MetricData {
+	// the rejected metrics by reason, for the quarantine file
+	var rejected map[string][]*service.MetricData
+
+	out := metrics[:0]
+	for _, metric := range metrics {
+		missing := r.missing(metric)
+		if len(missing) == 0 {
+			out = append(out, metric)
+			continue
+		}
+		r.reject(metric, missing)
+
+		if r.quarantine != nil {
+			if rejected == nil {
+				rejected = make(map[string][]*service.MetricData)
+			}
+			reason := "missing tags " + strings.Join(missing, ", ")
+			rejected[reason] = append(rejected[reason], metric)
+		}
+	}
+
+	for reason, m := range rejected {
+		if err := r.quarantine.Write(errors.New(reason), m); err != nil {
+			service.VLogger.Error("required_tags quarantine", zap.String("file", r.QuarantineFile), zap.Error(err))
+		}
+	}
+	return out
+}
+
+// missing returns the required tags the metric doesn't have, sorted.
+func (r *RequiredTags) missing(metric *service.MetricData) []string {
+	required := r.Tags
+	for _, o := range r.Overrides {
+		if o.filter.Match(metric.Name) {
+			required = o.Tags
+			break
+		}
+	}
+
+	var missing []string
+	for _, k := range required {
+		if metric.Tags[k] == "" {
+			missing = append(missing, k)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// reject counts the rejected metric and logs a sample of them.
+func (r *RequiredTags) reject(metric *service.MetricData, missing []string) {
+	n := atomic.AddUint64(&r.rejected, 1)
+	if n%warnSample != 1 {
+		return
+	}
+	service.VLogger.Warn("metric missing required tags rejected",
+		zap.String("metric", metric.Name),
+		zap.String("missing", strings.Join(missing, ",")),
+		zap.Int64("rejected", int64(n)),
+	)
+}
+
+// Rejected returns the number of metrics dropped or quarantined.
+func (r *RequiredTags) Rejected() uint64 {
+	return atomic.LoadUint64(&r.rejected)
+}
+
+func init() {
+	service.AddProcessor("required_tags", func() service.Processor {
+		return &RequiredTags{}
+	})
+}
@@ -0,0 +1,144 @@
+package required_tags
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+func newRequiredTags(t *testing.T, r *RequiredTags) *RequiredTags {
+	if err := r.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func metric(name string, tags ...string) *service.MetricData {
+	m := &service.MetricData{
+		Name:   name,
+		Tags:   make(map[string]string),
+		Fields: map[string]interface{}{"value": 1.0},
+	}
+	for i := 0; i+1 < len(tags); i += 2 {
+		m.Tags[tags[i]] = tags[i+1]
+	}
+	return m
+}
+
+// names returns the names of the metrics.
+func names(metrics []*service.MetricData) string {
+	var l []string
+	for _, m := range metrics {
+		l = append(l, m.Name)
+	}
+	return strings.Join(l, ",")
+}
+
+func TestPassAndDrop(t *testing.T) {
+	r := newRequiredTags(t, &RequiredTags{Tags: []string{"service", "env"}})
+	got := r.Apply([]*service.MetricData{
+		metric("ok", "service", "api", "env", "prod", "host", "a"),
+		metric("no_env", "service", "api"),
+		metric("none"),
+		// an empty tag is missing
+		metric("empty_env", "service", "api", "env", ""),
+		metric("ok2", "env", "dev", "service", "web"),
+	})
+	if names := names(got); names != "ok,ok2" {
+		t.Errorf("got metrics %s, want ok,ok2", names)
+	}
+	if n := r.Rejected(); n != 3 {
+		t.Errorf("got %d rejected, want 3", n)
+	}
+	if missing := r.missing(metric("none")); strings.Join(missing, ",") != "env,service" {
+		t.Errorf("got missing %v, want env and service sorted", missing)
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	r := newRequiredTags(t, &RequiredTags{
+		Tags: []string{"service", "env"},
+		Overrides: []*Override{
+			// exempted
+			{Metrics: []string{"vgo", "internal_*"}},
+			{Metrics: []string{"internal_http", "db_*"}, Tags: []string{"cluster"}},
+		},
+	})
+	got := r.Apply([]*service.MetricData{
+		metric("vgo"),
+		// the first override matching the name
+		metric("internal_http"),
+		metric("db_queries", "cluster", "main"),
+		metric("db_locks", "service", "api", "env", "prod"),
+		metric("cpu"),
+	})
+	if names := names(got); names != "vgo,internal_http,db_queries" {
+		t.Errorf("got metrics %s, want vgo,internal_http,db_queries", names)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "quarantine")
+
+	r := newRequiredTags(t, &RequiredTags{Tags: []string{"service"}, QuarantineFile: path})
+	got := r.Apply([]*service.MetricData{metric("cpu", "service", "api"), metric("mem"), metric("disk")})
+	if names := names(got); names != "cpu" {
+		t.Errorf("got metrics %s, want cpu", names)
+	}
+
+	// the rejected metrics are kept in the quarantine file
+	o := &replayOutput{}
+	if err := service.ReplayDeadLetter(path, o); err != nil {
+		t.Fatal(err)
+	}
+	if names := names(o.metrics); names != "mem,disk" {
+		t.Errorf("got quarantined metrics %s, want mem,disk", names)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "missing tags service") {
+		t.Errorf("got quarantine file %s, want the reason", b)
+	}
+}
+
+// replayOutput records the metrics replayed from the quarantine file.
+type replayOutput struct {
+	metrics []*service.MetricData
+}
+
+func (o *replayOutput) Init(chan bool) {}
+func (o *replayOutput) Start()         {}
+
+func (o *replayOutput) Compute(m service.Metrics) error {
+	o.metrics = append(o.metrics, m.Data...)
+	return nil
+}
+
+func TestRequiredTagsInvalid(t *testing.T) {
+	for _, r := range []*RequiredTags{
+		{},
+		{Tags: []string{"service"}, QuarantineMaxSize: -1},
+		{Tags: []string{"service"}, Overrides: []*Override{{Tags: []string{"env"}}}},
+		{Tags: []string{"service"}, Overrides: []*Override{{Metrics: []string{"[cpu"}}}},
+	} {
+		if err := r.Init(); err == nil {
+			t.Errorf("invalid config %+v accepted", r)
+		}
+	}
+}
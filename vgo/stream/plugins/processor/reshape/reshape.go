@@ -0,0 +1,136 @@
+package reshape
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// Reshape converts the metrics between the wide format, many fields per
+// metric, and the long format, one metric per field carrying the field name
+// in the FieldTag tag and its value in the ValueField field.
+type Reshape struct {
+	// Metrics are the names of the metrics converted, globs are supported,
+	// empty converts all of them
+	Metrics []string
+	// Direction is "to_long", a metric per field, or "to_wide", the long
+	// metrics of a batch sharing their name, tags and time merged in one
+	Direction  string
+	FieldTag   string
+	ValueField string
+
+	filter service.Filter
+}
+
+var sampleConfig = `
+  ## Metrics converted, globs are supported, all of them when empty
+  # metrics = []
+  ## "to_long": a metric per field, with the field name in field_tag and
+  ## its value in value_field. "to_wide": the long metrics of a batch with
+  ## the same name, tags and time merged back in one metric
+  direction = "to_long"
+  # field_tag = "field"
+  # value_field = "value"
+`
+
+func (r *Reshape) Init() error {
+	switch r.Direction {
+	case "to_long", "to_wide":
+	default:
+		return fmt.Errorf("invalid direction %s, can be: \"to_long\", \"to_wide\"", r.Direction)
+	}
+	if r.FieldTag == "" || r.ValueField == "" {
+		return fmt.Errorf("field_tag and value_field are required")
+	}
+
+	var err error
+	r.filter, err = service.CompileFilter(r.Metrics)
+	return err
+}
+
+func (r *Reshape) Apply(metrics []*service.MetricData) []*service.MetricData {
+	if r.Direction == "to_long" {
+		return r.toLong(metrics)
+	}
+	return r.toWide(metrics)
+}
+
+func (r *Reshape) match(metric *service.MetricData) bool {
+	return r.filter == nil || r.filter.Match(metric.Name)
+}
+
+// toLong replaces every metric by a metric per field, in the order of the
+// field names.
+func (r *Reshape) toLong(metrics []*service.MetricData) []*service.MetricData {
+	out := make([]*service.MetricData, 0, len(metrics))
+	for _, metric := range metrics {
+		if !r.match(metric) {
+			out = append(out, metric)
+			continue
+		}
+
+		keys := make([]string, 0, len(metric.Fields))
+		for k := range metric.Fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			tags := make(map[string]string, len(metric.Tags)+1)
+			for tk, tv := range metric.Tags {
+				tags[tk] = tv
+			}
+			tags[r.FieldTag] = k
+
+			out = append(out, &service.MetricData{
+				Name:   metric.Name,
+				Tags:   tags,
+				Fields: map[string]interface{}{r.ValueField: metric.Fields[k]},
+				Time:   metric.Time,
+			})
+		}
+	}
+	return out
+}
+
+// toWide merges the long metrics sharing their name, tags and time, in
+// place of the first one. The metrics without the FieldTag tag, or with
+// other fields than ValueField, pass as they are.
+func (r *Reshape) toWide(metrics []*service.MetricData) []*service.MetricData {
+	out := metrics[:0]
+	wide := make(map[string]*service.MetricData)
+	for _, metric := range metrics {
+		field, ok := metric.Tags[r.FieldTag]
+		value, hasValue := metric.Fields[r.ValueField]
+		if !r.match(metric) || !ok || !hasValue || len(metric.Fields) != 1 {
+			out = append(out, metric)
+			continue
+		}
+
+		delete(metric.Tags, r.FieldTag)
+		key := metric.PointKey(metric.Time)
+		w, ok := wide[key]
+		if !ok {
+			w = &service.MetricData{
+				Name:   metric.Name,
+				Tags:   metric.Tags,
+				Fields: make(map[string]interface{}),
+				Time:   metric.Time,
+			}
+			wide[key] = w
+			out = append(out, w)
+		}
+		w.Fields[field] = value
+	}
+	return out
+}
+
+func init() {
+	service.AddProcessor("reshape", func() service.Processor {
+		return &Reshape{
+			FieldTag:   "field",
+			ValueField: "value",
+		}
+	})
+}
@@ -0,0 +1,124 @@
+package reshape
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+func newReshape(t *testing.T, direction string) *Reshape {
+	r := &Reshape{Direction: direction, FieldTag: "field", ValueField: "value"}
+	if err := r.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func wide() *service.MetricData {
+	return &service.MetricData{
+		Name:   "cpu",
+		Tags:   map[string]string{"host": "server01"},
+		Fields: map[string]interface{}{"idle": 98.5, "user": 1.5, "count": int64(2)},
+		Time:   time.Unix(1500000000, 0),
+	}
+}
+
+func long(host, field string, value interface{}, sec int64) *service.MetricData {
+	return &service.MetricData{
+		Name:   "cpu",
+		Tags:   map[string]string{"host": host, "field": field},
+		Fields: map[string]interface{}{"value": value},
+		Time:   time.Unix(sec, 0),
+	}
+}
+
+func equal(t *testing.T, got, want []*service.MetricData) {
+	if len(got) != len(want) {
+		t.Fatalf("got %d metrics, want %d", len(got), len(want))
+	}
+	for n := range want {
+		g, w := got[n], want[n]
+		if g.Name != w.Name || !g.Time.Equal(w.Time) || !reflect.DeepEqual(g.Tags, w.Tags) || !reflect.DeepEqual(g.Fields, w.Fields) {
+			t.Errorf("metric %d, got %s %v %v %s, want %s %v %v %s", n, g.Name, g.Tags, g.Fields, g.Time, w.Name, w.Tags, w.Fields, w.Time)
+		}
+	}
+}
+
+func TestToLong(t *testing.T) {
+	r := newReshape(t, "to_long")
+	got := r.Apply([]*service.MetricData{wide()})
+	// in the order of the field names
+	equal(t, got, []*service.MetricData{
+		long("server01", "count", int64(2), 1500000000),
+		long("server01", "idle", 98.5, 1500000000),
+		long("server01", "user", 1.5, 1500000000),
+	})
+	// the tags are copies
+	got[0].Tags["host"] = "server02"
+	if got[1].Tags["host"] != "server01" {
+		t.Error("tags shared by the long metrics")
+	}
+}
+
+func TestToWide(t *testing.T) {
+	r := newReshape(t, "to_wide")
+	other := &service.MetricData{Name: "mem", Tags: map[string]string{}, Fields: map[string]interface{}{"used": 1.0}, Time: time.Unix(1500000000, 0)}
+	got := r.Apply([]*service.MetricData{
+		long("server01", "idle", 98.5, 1500000000),
+		long("server02", "idle", 97.5, 1500000000),
+		other,
+		long("server01", "user", 1.5, 1500000000),
+		// another time, another metric
+		long("server01", "idle", 99.5, 1500000010),
+	})
+	equal(t, got, []*service.MetricData{
+		{Name: "cpu", Tags: map[string]string{"host": "server01"}, Fields: map[string]interface{}{"idle": 98.5, "user": 1.5}, Time: time.Unix(1500000000, 0)},
+		{Name: "cpu", Tags: map[string]string{"host": "server02"}, Fields: map[string]interface{}{"idle": 97.5}, Time: time.Unix(1500000000, 0)},
+		// not a long metric, it passes
+		other,
+		{Name: "cpu", Tags: map[string]string{"host": "server01"}, Fields: map[string]interface{}{"idle": 99.5}, Time: time.Unix(1500000010, 0)},
+	})
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, names := range [][2]string{{"field", "value"}, {"metric_field", "v"}} {
+		toLong := &Reshape{Direction: "to_long", FieldTag: names[0], ValueField: names[1]}
+		toWide := &Reshape{Direction: "to_wide", FieldTag: names[0], ValueField: names[1]}
+		for _, r := range []*Reshape{toLong, toWide} {
+			if err := r.Init(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		metrics := toLong.Apply([]*service.MetricData{wide()})
+		for _, m := range metrics {
+			if _, ok := m.Tags[names[0]]; !ok || len(m.Fields) != 1 || m.Fields[names[1]] == nil {
+				t.Errorf("got long metric %v %v, want the %s tag and the %s field", m.Tags, m.Fields, names[0], names[1])
+			}
+		}
+		equal(t, toWide.Apply(metrics), []*service.MetricData{wide()})
+	}
+}
+
+func TestMetricsFilter(t *testing.T) {
+	r := &Reshape{Direction: "to_long", FieldTag: "field", ValueField: "value", Metrics: []string{"mem"}}
+	if err := r.Init(); err != nil {
+		t.Fatal(err)
+	}
+	equal(t, r.Apply([]*service.MetricData{wide()}), []*service.MetricData{wide()})
+}
+
+func TestReshapeInvalid(t *testing.T) {
+	for _, r := range []*Reshape{
+		{Direction: "to_tall", FieldTag: "field", ValueField: "value"},
+		{Direction: "to_long", ValueField: "value"},
+		{Direction: "to_long", FieldTag: "field"},
+		{Direction: "to_long", FieldTag: "field", ValueField: "value", Metrics: []string{"[cpu"}},
+	} {
+		if err := r.Init(); err == nil {
+			t.Errorf("invalid config %+v accepted", r)
+		}
+	}
+}
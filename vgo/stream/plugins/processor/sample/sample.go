@@ -0,0 +1,102 @@
+package sample
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// Sample keeps a fraction of the metrics whose name matches a rule, the
+// metrics matching no rule always pass.
+type Sample struct {
+	Rules []*Rule
+}
+
+type Rule struct {
+	// Names are the metric names the rule applies to, globs are supported
+	Names []string
+	// SampleRate is the fraction of the metrics kept, from 0.0 to 1.0
+	SampleRate float64
+	// Consistent samples by series: a series, the name and the tags, is
+	// either always kept or always dropped
+	Consistent bool
+
+	filter service.Filter
+}
+
+var sampleConfig = `
+  ## A metric is sampled by the first rule matching its name.
+  ## The rate is a float: write 1.0, not 1.
+  [[processors.sample.rules]]
+    names = ["debug_*"]
+    ## Fraction of the metrics kept
+    sample_rate = 0.1
+    ## Keep or drop whole series instead of random metrics
+    # consistent = false
+`
+
+func (s *Sample) Init() error {
+	for _, rule := range s.Rules {
+		if len(rule.Names) == 0 {
+			return errors.New("rule without names")
+		}
+		if rule.SampleRate < 0 || rule.SampleRate > 1 {
+			return fmt.Errorf("rule %v sample_rate %v not between 0.0 and 1.0", rule.Names, rule.SampleRate)
+		}
+
+		filter, err := service.CompileFilter(rule.Names)
+		if err != nil {
+			return err
+		}
+		rule.filter = filter
+	}
+	return nil
+}
+
+func (s *Sample) Apply(metrics []*service.MetricData) []*service.MetricData {
+	out := metrics[:0]
+	for _, metric := range metrics {
+		rule := s.rule(metric.Name)
+		if rule == nil || rule.keep(metric) {
+			out = append(out, metric)
+		}
+	}
+	return out
+}
+
+// rule returns the first rule matching the metric name, nil if none does.
+func (s *Sample) rule(name string) *Rule {
+	for _, rule := range s.Rules {
+		if rule.filter.Match(name) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (r *Rule) keep(metric *service.MetricData) bool {
+	if r.Consistent {
+		return float64(mix(metric.SeriesHash()))/math.MaxUint64 < r.SampleRate
+	}
+	return rand.Float64() < r.SampleRate
+}
+
+// mix spreads the bits of the series hash, the high bits of FNV barely
+// change between series keys differing only by their last bytes.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+func init() {
+	service.AddProcessor("sample", func() service.Processor {
+		return &Sample{}
+	})
+}
@@ -0,0 +1,83 @@
+package sample
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+func newSample(t *testing.T, rate float64, consistent bool) *Sample {
+	s := &Sample{Rules: []*Rule{{Names: []string{"debug_*"}, SampleRate: rate, Consistent: consistent}}}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// series returns a metric of each of n series of the measurement.
+func series(name string, n int) []*service.MetricData {
+	metrics := make([]*service.MetricData, n)
+	for i := range metrics {
+		metrics[i] = &service.MetricData{
+			Name:   name,
+			Tags:   map[string]string{"id": fmt.Sprint(i)},
+			Fields: map[string]interface{}{"value": 1.0},
+		}
+	}
+	return metrics
+}
+
+func TestSampleRate(t *testing.T) {
+	const n = 20000
+	for _, consistent := range []bool{false, true} {
+		for _, rate := range []float64{0, 0.1, 0.5, 1} {
+			s := newSample(t, rate, consistent)
+			kept := len(s.Apply(series("debug_requests", n)))
+			if got := float64(kept) / n; math.Abs(got-rate) > 0.02 {
+				t.Errorf("consistent %v, rate %v, kept %v of the metrics", consistent, rate, got)
+			}
+		}
+	}
+}
+
+func TestSampleUnmatched(t *testing.T) {
+	s := newSample(t, 0, false)
+	if kept := len(s.Apply(series("requests", 100))); kept != 100 {
+		t.Errorf("kept %d of the 100 metrics matching no rule", kept)
+	}
+}
+
+func TestSampleConsistent(t *testing.T) {
+	s := newSample(t, 0.5, true)
+	kept := make(map[string]bool)
+	for _, metric := range s.Apply(series("debug_requests", 1000)) {
+		kept[metric.Tags["id"]] = true
+	}
+	// the same series are kept at every interval
+	for i := 0; i < 10; i++ {
+		out := s.Apply(series("debug_requests", 1000))
+		if len(out) != len(kept) {
+			t.Fatalf("kept %d series, then %d", len(kept), len(out))
+		}
+		for _, metric := range out {
+			if !kept[metric.Tags["id"]] {
+				t.Fatalf("series %s dropped, then kept", metric.Tags["id"])
+			}
+		}
+	}
+}
+
+func TestSampleInvalid(t *testing.T) {
+	for _, rule := range []*Rule{
+		{SampleRate: 0.5},
+		{Names: []string{"debug_*"}, SampleRate: 1.5},
+		{Names: []string{"debug_*"}, SampleRate: -0.1},
+	} {
+		s := &Sample{Rules: []*Rule{rule}}
+		if err := s.Init(); err == nil {
+			t.Errorf("rule %+v accepted", rule)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package split
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// Split makes separate metrics of the fields of a metric, for the sources
+// bundling unrelated measurements in one metric. The new metrics keep the
+// tags and the time of the original one, and go through the next
+// processors and the outputs like the others.
+type Split struct {
+	// Metrics are the names of the metrics split, globs are supported,
+	// empty splits all of them
+	Metrics []string
+	// Fields maps the field names to the measurement they move to, the
+	// fields mapped to the same measurement make one metric. The fields not
+	// mapped stay on the original metric
+	Fields map[string]string
+	// PerField moves every field not in Fields to its own measurement,
+	// named <metric><Separator><field>
+	PerField bool
+	// Separator joins the metric and the field names of PerField
+	Separator string
+
+	filter service.Filter
+}
+
+var sampleConfig = `
+  ## Metrics split, globs are supported, all of them when empty
+  metrics = ["system"]
+  ## Every field not mapped below becomes its own measurement, named
+  ## <metric><separator><field>, like system_load1
+  # per_field = false
+  # separator = "_"
+
+  ## Fields moved to another measurement, the fields mapped to the same
+  ## measurement make one metric. The other fields stay on the metric,
+  ## which is dropped once it has none left
+  [processors.split.fields]
+    load1 = "load"
+    load5 = "load"
+    uptime = "uptime"
+`
+
+func (s *Split) Init() error {
+	if len(s.Fields) == 0 && !s.PerField {
+		return errors.New("fields or per_field is required")
+	}
+	for field, name := range s.Fields {
+		if name == "" {
+			return errors.New("field " + field + " mapped to an empty measurement")
+		}
+	}
+
+	var err error
+	s.filter, err = service.CompileFilter(s.Metrics)
+	return err
+}
+
+func (s *Split) Apply(metrics []*service.MetricData) []*service.MetricData {
+	out := metrics[:0]
+	var split []*service.MetricData
+	for _, metric := range metrics {
+		if s.filter != nil && !s.filter.Match(metric.Name) {
+			out = append(out, metric)
+			continue
+		}
+
+		split = append(split, s.split(metric)...)
+		if len(metric.Fields) > 0 {
+			out = append(out, metric)
+		}
+	}
+	return append(out, split...)
+}
+
+// split moves the fields of the metric to the new metrics it returns, in
+// the order of the field names.
+func (s *Split) split(metric *service.MetricData) []*service.MetricData {
+	keys := make([]string, 0, len(metric.Fields))
+	for k := range metric.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var split []*service.MetricData
+	byName := make(map[string]*service.MetricData)
+	for _, k := range keys {
+		name, ok := s.Fields[k]
+		if !ok {
+			if !s.PerField {
+				continue
+			}
+			name = metric.Name + s.Separator + k
+		}
+
+		m, ok := byName[name]
+		if !ok {
+			m = &service.MetricData{
+				Name:   name,
+				Tags:   copyTags(metric.Tags),
+				Fields: make(map[string]interface{}),
+				Time:   metric.Time,
+			}
+			byName[name] = m
+			split = append(split, m)
+		}
+		m.Fields[k] = metric.Fields[k]
+		delete(metric.Fields, k)
+	}
+	return split
+}
+
+// copyTags copies the tags, so the processors can change the tags of a
+// split metric without changing the others.
+func copyTags(tags map[string]string) map[string]string {
+	if tags == nil {
+		return nil
+	}
+	c := make(map[string]string, len(tags))
+	for k, v := range tags {
+		c[k] = v
+	}
+	return c
+}
+
+func init() {
+	service.AddProcessor("split", func() service.Processor {
+		return &Split{
+			Separator: "_",
+		}
+	})
+}
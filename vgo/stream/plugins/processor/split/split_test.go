@@ -0,0 +1,118 @@
+package split
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+func system() *service.MetricData {
+	return &service.MetricData{
+		Name:   "system",
+		Tags:   map[string]string{"host": "server01"},
+		Fields: map[string]interface{}{"load1": 0.5, "load5": 0.25, "uptime": int64(3600)},
+		Time:   time.Unix(1500000000, 0),
+	}
+}
+
+// names returns the fields of the metrics by name.
+func names(metrics []*service.MetricData) map[string]map[string]interface{} {
+	got := make(map[string]map[string]interface{})
+	for _, m := range metrics {
+		got[m.Name] = m.Fields
+	}
+	return got
+}
+
+func TestPerField(t *testing.T) {
+	s := &Split{PerField: true, Separator: "_"}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	metrics := s.Apply([]*service.MetricData{system()})
+
+	if len(metrics) != 3 {
+		t.Fatalf("got %d metrics, want 3", len(metrics))
+	}
+	for n, want := range []string{"system_load1", "system_load5", "system_uptime"} {
+		m := metrics[n]
+		if m.Name != want || len(m.Fields) != 1 {
+			t.Errorf("got metric %s %v, want %s with one field", m.Name, m.Fields, want)
+		}
+		if !m.Time.Equal(time.Unix(1500000000, 0)) || !reflect.DeepEqual(m.Tags, map[string]string{"host": "server01"}) {
+			t.Errorf("%s got tags %v and time %s, want the original ones", m.Name, m.Tags, m.Time)
+		}
+	}
+	// the tags are copies
+	metrics[0].Tags["host"] = "server02"
+	if metrics[1].Tags["host"] != "server01" {
+		t.Error("tags shared by the split metrics")
+	}
+}
+
+func TestFieldMapping(t *testing.T) {
+	s := &Split{Fields: map[string]string{"load1": "load", "load5": "load"}}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	got := names(s.Apply([]*service.MetricData{system()}))
+	want := map[string]map[string]interface{}{
+		// the fields not mapped stay on the metric
+		"system": {"uptime": int64(3600)},
+		"load":   {"load1": 0.5, "load5": 0.25},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMetricsFilter(t *testing.T) {
+	s := &Split{Metrics: []string{"sys*"}, PerField: true, Separator: "."}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	cpu := &service.MetricData{Name: "cpu", Fields: map[string]interface{}{"idle": 98.5, "user": 1.5}}
+	metrics := s.Apply([]*service.MetricData{cpu, system()})
+
+	if len(metrics) != 4 || metrics[0] != cpu || len(cpu.Fields) != 2 {
+		t.Errorf("got metrics %v, want cpu untouched and system split", names(metrics))
+	}
+	if _, ok := names(metrics)["system.uptime"]; !ok {
+		t.Errorf("got metrics %v, want system.uptime", names(metrics))
+	}
+}
+
+func TestDownstreamFilter(t *testing.T) {
+	// the split metrics go through the next processors, which match their
+	// new names
+	first := &Split{PerField: true, Separator: "_"}
+	next := &Split{Metrics: []string{"system_uptime"}, Fields: map[string]string{"uptime": "host_uptime"}}
+	for _, s := range []*Split{first, next} {
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := names(next.Apply(first.Apply([]*service.MetricData{system()})))
+	want := map[string]map[string]interface{}{
+		"system_load1": {"load1": 0.5},
+		"system_load5": {"load5": 0.25},
+		"host_uptime":  {"uptime": int64(3600)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	for _, s := range []*Split{
+		{},
+		{Fields: map[string]string{"load1": ""}},
+		{PerField: true, Metrics: []string{"[sys"}},
+	} {
+		if err := s.Init(); err == nil {
+			t.Errorf("invalid config %+v accepted", s)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package truncate
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+const (
+	// suffixLen is the length of the "_<hash>" suffix of a truncated name
+	suffixLen = 9
+
+	// warnSample logs one truncation of a kind out of warnSample
+	warnSample = 100
+)
+
+// Truncate shortens the measurement names, tag keys and field keys longer
+// than their limit. A truncated name ends with "_" and the fnv hash of the
+// whole name, so two long names sharing their prefix stay distinct and a
+// name is always truncated the same. A limit of 0 is off.
+type Truncate struct {
+	// the truncations of each kind, accessed atomically
+	measurements uint64
+	tagKeys      uint64
+	fieldKeys    uint64
+
+	MaxMeasurementLen int
+	MaxTagKeyLen      int
+	MaxFieldKeyLen    int
+}
+
+var sampleConfig = `
+  ## Longest names in bytes, the longer ones keep their start and end with
+  ## "_" and 8 hex digits of their hash. 0 is off, else at least 10.
+  # max_measurement_len = 0
+  # max_tag_key_len = 0
+  # max_field_key_len = 0
+`
+
+func (t *Truncate) Init() error {
+	limits := map[string]int{
+		"max_measurement_len": t.MaxMeasurementLen,
+		"max_tag_key_len":     t.MaxTagKeyLen,
+		"max_field_key_len":   t.MaxFieldKeyLen,
+	}
+	for name, limit := range limits {
+		if limit != 0 && limit <= suffixLen {
+			return fmt.Errorf("invalid %s %d, must be 0 or more than %d", name, limit, suffixLen)
+		}
+	}
+	return nil
+}
+
+func (t *Truncate) Apply(metrics []*service.MetricData) []*service.MetricData {
+	for _, metric := range metrics {
+		if t.MaxMeasurementLen > 0 && len(metric.Name) > t.MaxMeasurementLen {
+			name := truncate(metric.Name, t.MaxMeasurementLen)
+			t.truncated(&t.measurements, "measurement", metric.Name, name)
+			metric.Name = name
+		}
+
+		if t.MaxTagKeyLen > 0 {
+			for k, v := range metric.Tags {
+				if len(k) <= t.MaxTagKeyLen {
+					continue
+				}
+				key := truncate(k, t.MaxTagKeyLen)
+				t.truncated(&t.tagKeys, "tag key", k, key)
+				delete(metric.Tags, k)
+				metric.Tags[key] = v
+			}
+		}
+
+		if t.MaxFieldKeyLen > 0 {
+			for k, v := range metric.Fields {
+				if len(k) <= t.MaxFieldKeyLen {
+					continue
+				}
+				key := truncate(k, t.MaxFieldKeyLen)
+				t.truncated(&t.fieldKeys, "field key", k, key)
+				delete(metric.Fields, k)
+				metric.Fields[key] = v
+			}
+		}
+	}
+	return metrics
+}
+
+// truncate returns the name cut to max bytes with the hash suffix, the cut
+// never splits a UTF-8 character.
+func truncate(name string, max int) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+
+	n := max - suffixLen
+	for n > 0 && !utf8.RuneStart(name[n]) {
+		n--
+	}
+	return fmt.Sprintf("%s_%08x", name[:n], h.Sum32())
+}
+
+// truncated counts the truncation and logs a sample of them.
+func (t *Truncate) truncated(counter *uint64, kind, name, truncated string) {
+	n := atomic.AddUint64(counter, 1)
+	if n%warnSample != 1 {
+		return
+	}
+	service.VLogger.Warn("name truncated",
+		zap.String("kind", kind),
+		zap.String("name", name),
+		zap.String("truncated", truncated),
+		zap.Int64("count", int64(n)),
+	)
+}
+
+// Truncated returns the number of measurement names, tag keys and field
+// keys truncated so far.
+func (t *Truncate) Truncated() (measurements, tagKeys, fieldKeys uint64) {
+	return atomic.LoadUint64(&t.measurements), atomic.LoadUint64(&t.tagKeys), atomic.LoadUint64(&t.fieldKeys)
+}
+
+func init() {
+	service.AddProcessor("truncate", func() service.Processor {
+		return &Truncate{}
+	})
+}
@@ -0,0 +1,129 @@
+package truncate
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+func newMetric(name, tagKey, fieldKey string) *service.MetricData {
+	return &service.MetricData{
+		Name:   name,
+		Tags:   map[string]string{tagKey: "a", "host": "server01"},
+		Fields: map[string]interface{}{fieldKey: 1.0, "value": 2.0},
+	}
+}
+
+func TestTruncateLength(t *testing.T) {
+	tr := &Truncate{MaxMeasurementLen: 20, MaxTagKeyLen: 16, MaxFieldKeyLen: 12}
+	if err := tr.Init(); err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("a", 40)
+	m := tr.Apply([]*service.MetricData{newMetric(long, long, long)})[0]
+
+	if len(m.Name) != 20 || !strings.HasPrefix(m.Name, "aaaaaaaaaaa_") {
+		t.Errorf("got measurement %q, want 20 bytes", m.Name)
+	}
+	for k := range m.Tags {
+		if k != "host" && len(k) != 16 {
+			t.Errorf("got tag key %q, want 16 bytes", k)
+		}
+	}
+	for k := range m.Fields {
+		if k != "value" && len(k) != 12 {
+			t.Errorf("got field key %q, want 12 bytes", k)
+		}
+	}
+	// the short names and the values are kept
+	if len(m.Tags) != 2 || m.Tags["host"] != "server01" || len(m.Fields) != 2 || m.Fields["value"] != 2.0 {
+		t.Errorf("got tags %v and fields %v", m.Tags, m.Fields)
+	}
+	if ms, tags, fields := tr.Truncated(); ms != 1 || tags != 1 || fields != 1 {
+		t.Errorf("got truncations %d %d %d, want one of each", ms, tags, fields)
+	}
+
+	// at the limit, kept as is
+	name := strings.Repeat("b", 20)
+	if m := tr.Apply([]*service.MetricData{newMetric(name, "k", "f")})[0]; m.Name != name {
+		t.Errorf("got measurement %q, want it kept", m.Name)
+	}
+}
+
+func TestSuffixStable(t *testing.T) {
+	name := "kubernetes_pod_container_status_waiting_reason_crashloopbackoff"
+	want := truncate(name, 32)
+	for n := 0; n < 3; n++ {
+		if got := truncate(name, 32); got != want {
+			t.Errorf("got %q, then %q", want, got)
+		}
+	}
+	// the fnv hash of the whole name
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	if suffix := fmt.Sprintf("_%08x", h.Sum32()); want != "kubernetes_pod_containe"+suffix {
+		t.Errorf("got %q, want the first 23 bytes and %s", want, suffix)
+	}
+}
+
+func TestNoCollision(t *testing.T) {
+	tr := &Truncate{MaxMeasurementLen: 24}
+	prefix := strings.Repeat("x", 30)
+	metrics := tr.Apply([]*service.MetricData{
+		newMetric(prefix+"_read", "k", "f"),
+		newMetric(prefix+"_write", "k", "f"),
+	})
+	a, b := metrics[0].Name, metrics[1].Name
+	if a == b {
+		t.Errorf("two long names sharing their prefix truncated to %q", a)
+	}
+	if a[:15] != b[:15] {
+		t.Errorf("got %q and %q, want them to keep the prefix", a, b)
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	// 3 bytes per character, 16-9 bytes don't end on a character
+	name := strings.Repeat("日", 10)
+	got := truncate(name, 16)
+	if !utf8.ValidString(got) || len(got) > 16 {
+		t.Errorf("got %q, want valid UTF-8 of 16 bytes at most", got)
+	}
+	if !strings.HasPrefix(got, "日日_") {
+		t.Errorf("got %q, want the whole characters before the limit", got)
+	}
+}
+
+func TestTruncateOff(t *testing.T) {
+	tr := &Truncate{}
+	if err := tr.Init(); err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("a", 1000)
+	m := tr.Apply([]*service.MetricData{newMetric(long, long, long)})[0]
+	if m.Name != long || m.Tags[long] != "a" || m.Fields[long] != 1.0 {
+		t.Error("names truncated with the limits off")
+	}
+}
+
+func TestTruncateInvalid(t *testing.T) {
+	for _, tr := range []*Truncate{
+		{MaxMeasurementLen: 9},
+		{MaxTagKeyLen: 1},
+		{MaxFieldKeyLen: -1},
+	} {
+		if err := tr.Init(); err == nil {
+			t.Errorf("invalid limits %+v accepted", tr)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package ttl
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// TTL sets how long the outputs expiring the data per metric keep the
+// metrics, like the expiration of the AMQP messages. The outputs without
+// expiry write the metrics as usual.
+type TTL struct {
+	// Rules set the TTL of the metrics, a metric gets the TTL of the first
+	// rule matching its name
+	Rules []*Rule
+	// Default is the TTL of the metrics no rule matches, they never expire
+	// when 0
+	Default misc.Duration
+}
+
+// Rule is the TTL of the metrics matching Metrics
+type Rule struct {
+	// Metrics are the names of the metrics, globs are supported
+	Metrics []string
+	TTL     misc.Duration `toml:"ttl"`
+
+	filter service.Filter
+}
+
+var sampleConfig = `
+  ## TTL of the metrics no rule matches, they never expire when 0
+  # default = "0s"
+
+  ## A metric gets the TTL of the first rule matching its name
+  [[processors.ttl.rules]]
+    metrics = ["debug_*"]
+    ttl = "1h"
+  [[processors.ttl.rules]]
+    metrics = ["system_*"]
+    ttl = "720h"
+`
+
+func (t *TTL) Init() error {
+	if len(t.Rules) == 0 && t.Default.Duration == 0 {
+		return errors.New("rules or default is required")
+	}
+	if t.Default.Duration < 0 {
+		return errors.New("default can't be negative")
+	}
+
+	for i, rule := range t.Rules {
+		if len(rule.Metrics) == 0 {
+			return fmt.Errorf("rule %d, metrics is required", i)
+		}
+		if rule.TTL.Duration <= 0 {
+			return fmt.Errorf("rule %d, ttl must be positive", i)
+		}
+		var err error
+		if rule.filter, err = service.CompileFilter(rule.Metrics); err != nil {
+			return fmt.Errorf("rule %d, %s", i, err)
+		}
+	}
+	return nil
+}
+
+func (t *TTL) Apply(metrics []*service.MetricData) []*service.MetricData {
+	for _, metric := range metrics {
+		metric.TTL = t.ttlOf(metric.Name)
+	}
+	return metrics
+}
+
+// ttlOf returns the TTL of the first rule matching the name, or the
+// default.
+func (t *TTL) ttlOf(name string) time.Duration {
+	for _, rule := range t.Rules {
+		if rule.filter.Match(name) {
+			return rule.TTL.Duration
+		}
+	}
+	return t.Default.Duration
+}
+
+func init() {
+	service.AddProcessor("ttl", func() service.Processor {
+		return &TTL{}
+	})
+}
@@ -0,0 +1,126 @@
+package ttl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/naoina/toml"
+)
+
+func newTTL(t *testing.T, conf string) *TTL {
+	ttl := &TTL{}
+	if err := toml.Unmarshal([]byte(conf), ttl); err != nil {
+		t.Fatal(err)
+	}
+	if err := ttl.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return ttl
+}
+
+func named(names ...string) []*service.MetricData {
+	var metrics []*service.MetricData
+	for _, name := range names {
+		metrics = append(metrics, &service.MetricData{
+			Name:   name,
+			Fields: map[string]interface{}{"value": 1.0},
+			Time:   time.Unix(1500000000, 0),
+		})
+	}
+	return metrics
+}
+
+func TestTTLRules(t *testing.T) {
+	ttl := newTTL(t, `
+default = "10m"
+[[rules]]
+  metrics = ["debug_*"]
+  ttl = "1h"
+[[rules]]
+  metrics = ["debug_http", "system_*"]
+  ttl = "720h"
+`)
+	metrics := named("debug_http", "system_cpu", "cpu")
+	// the TTL set upstream is replaced
+	metrics[2].TTL = time.Second
+	got := ttl.Apply(metrics)
+	for i, want := range []time.Duration{time.Hour, 720 * time.Hour, 10 * time.Minute} {
+		if got[i].TTL != want {
+			t.Errorf("%s, got TTL %s, want %s", got[i].Name, got[i].TTL, want)
+		}
+	}
+}
+
+func TestTTLNoDefault(t *testing.T) {
+	ttl := newTTL(t, "[[rules]]\n  metrics = [\"debug_*\"]\n  ttl = \"1h\"\n")
+	got := ttl.Apply(named("debug_http", "cpu"))
+	if got[0].TTL != time.Hour || got[1].TTL != 0 {
+		t.Errorf("got TTLs %s and %s, want 1h and none", got[0].TTL, got[1].TTL)
+	}
+}
+
+// expiringOutput keeps the metrics until their TTL is over, like the
+// outputs expiring the data per metric.
+type expiringOutput struct {
+	metrics []*service.MetricData
+}
+
+func (o *expiringOutput) Write(metrics []*service.MetricData) {
+	o.metrics = append(o.metrics, metrics...)
+}
+
+// live returns the names of the metrics not expired at now.
+func (o *expiringOutput) live(now time.Time) []string {
+	var names []string
+	for _, m := range o.metrics {
+		if m.TTL == 0 || now.Before(m.Time.Add(m.TTL)) {
+			names = append(names, m.Name)
+		}
+	}
+	return names
+}
+
+func TestTTLConsumed(t *testing.T) {
+	ttl := newTTL(t, `
+[[rules]]
+  metrics = ["debug_*"]
+  ttl = "1h"
+[[rules]]
+  metrics = ["system_*"]
+  ttl = "720h"
+`)
+	o := &expiringOutput{}
+	o.Write(ttl.Apply(named("debug_http", "system_cpu", "cpu")))
+
+	start := time.Unix(1500000000, 0)
+	for _, tt := range []struct {
+		after time.Duration
+		live  int
+	}{
+		{time.Minute, 3},
+		{2 * time.Hour, 2},
+		{1000 * time.Hour, 1},
+	} {
+		if live := o.live(start.Add(tt.after)); len(live) != tt.live {
+			t.Errorf("after %s, got metrics %v, want %d", tt.after, live, tt.live)
+		}
+	}
+}
+
+func TestTTLInvalid(t *testing.T) {
+	hour := misc.Duration{Duration: time.Hour}
+	for _, ttl := range []*TTL{
+		{},
+		{Default: misc.Duration{Duration: -time.Hour}},
+		{Rules: []*Rule{{TTL: hour}}},
+		{Rules: []*Rule{{Metrics: []string{"cpu"}}}},
+		{Rules: []*Rule{{Metrics: []string{"cpu"}, TTL: misc.Duration{Duration: -time.Hour}}}},
+		{Rules: []*Rule{{Metrics: []string{"[cpu"}, TTL: hour}}},
+	} {
+		if err := ttl.Init(); err == nil {
+			t.Errorf("invalid config %+v accepted", ttl)
+		}
+	}
+}
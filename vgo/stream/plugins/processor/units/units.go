@@ -0,0 +1,135 @@
+package units
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// conversions are the named conversions
+var conversions = map[string]func(float64) float64{
+	"c_to_f":        func(v float64) float64 { return v*9/5 + 32 },
+	"f_to_c":        func(v float64) float64 { return (v - 32) * 5 / 9 },
+	"bytes_to_kb":   func(v float64) float64 { return v / 1024 },
+	"bytes_to_mb":   func(v float64) float64 { return v / (1024 * 1024) },
+	"bytes_to_gb":   func(v float64) float64 { return v / (1024 * 1024 * 1024) },
+	"bits_to_bytes": func(v float64) float64 { return v / 8 },
+	"ms_to_s":       func(v float64) float64 { return v / 1000 },
+	"s_to_ms":       func(v float64) float64 { return v * 1000 },
+}
+
+// Units converts the numeric fields with the first rule matching their
+// name. The converted values are floats, the non numeric fields are left
+// untouched.
+type Units struct {
+	Rules []*Rule
+}
+
+type Rule struct {
+	// Fields are the field names the rule applies to, globs are supported
+	Fields []string
+	// Operation can be "multiply", "divide" or a named conversion like "c_to_f"
+	Operation string
+	// Factor is the constant of multiply and divide
+	Factor float64
+	// Suffix is appended to the name of the converted fields: "_mb"
+	Suffix string
+
+	filter  service.Filter
+	convert func(float64) float64
+}
+
+var sampleConfig = `
+  ## A field is converted by the first rule matching its name.
+  ## The factor is a float: write 1024.0, not 1024.
+  [[processors.units.rules]]
+    fields = ["*_bytes"]
+    ## "multiply", "divide" or a named conversion: "c_to_f", "f_to_c",
+    ## "bytes_to_kb", "bytes_to_mb", "bytes_to_gb", "bits_to_bytes",
+    ## "ms_to_s", "s_to_ms"
+    operation = "divide"
+    factor = 1048576.0
+    ## Appended to the converted field names
+    # suffix = "_mb"
+`
+
+func (u *Units) Init() error {
+	for _, rule := range u.Rules {
+		if len(rule.Fields) == 0 {
+			return errors.New("rule without fields")
+		}
+
+		switch rule.Operation {
+		case "multiply":
+			factor := rule.Factor
+			rule.convert = func(v float64) float64 { return v * factor }
+		case "divide":
+			if rule.Factor == 0 {
+				return fmt.Errorf("rule %v divide without factor", rule.Fields)
+			}
+			factor := rule.Factor
+			rule.convert = func(v float64) float64 { return v / factor }
+		default:
+			convert, ok := conversions[rule.Operation]
+			if !ok {
+				return fmt.Errorf("rule %v invalid operation %s", rule.Fields, rule.Operation)
+			}
+			rule.convert = convert
+		}
+
+		filter, err := service.CompileFilter(rule.Fields)
+		if err != nil {
+			return err
+		}
+		rule.filter = filter
+	}
+	return nil
+}
+
+func (u *Units) Apply(metrics []*service.MetricData) []*service.MetricData {
+	for _, metric := range metrics {
+		u.convert(metric)
+	}
+	return metrics
+}
+
+func (u *Units) convert(metric *service.MetricData) {
+	// the renamed fields are collected first, so they're never converted twice
+	converted := make(map[string]interface{})
+	for k, v := range metric.Fields {
+		rule := u.rule(k)
+		if rule == nil {
+			continue
+		}
+		value, ok := service.ToFloat(v)
+		if !ok {
+			continue
+		}
+
+		if rule.Suffix != "" {
+			delete(metric.Fields, k)
+		}
+		converted[k+rule.Suffix] = rule.convert(value)
+	}
+
+	for k, v := range converted {
+		metric.Fields[k] = v
+	}
+}
+
+// rule returns the first rule matching the field name, nil if none does.
+func (u *Units) rule(field string) *Rule {
+	for _, rule := range u.Rules {
+		if rule.filter.Match(field) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func init() {
+	service.AddProcessor("units", func() service.Processor {
+		return &Units{}
+	})
+}
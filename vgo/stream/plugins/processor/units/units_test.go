@@ -0,0 +1,86 @@
+package units
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+func TestUnits(t *testing.T) {
+	u := &Units{Rules: []*Rule{
+		{Fields: []string{"*_bytes"}, Operation: "divide", Factor: 1024 * 1024, Suffix: "_mb"},
+		{Fields: []string{"temp"}, Operation: "c_to_f"},
+		{Fields: []string{"ratio"}, Operation: "multiply", Factor: 100},
+		// never reached, the first matching rule converts the field
+		{Fields: []string{"used_bytes"}, Operation: "multiply", Factor: 2},
+	}}
+	if err := u.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	metric := &service.MetricData{
+		Name: "host",
+		Fields: map[string]interface{}{
+			// the integers are promoted, 1.5MB isn't truncated to 1
+			"used_bytes": int64(1572864),
+			"free_bytes": uint64(524288),
+			"temp":       int(100),
+			"ratio":      float32(0.25),
+			"state":      "ok",
+			"count":      int64(3),
+		},
+	}
+	u.Apply([]*service.MetricData{metric})
+
+	want := map[string]interface{}{
+		"used_bytes_mb": 1.5,
+		"free_bytes_mb": 0.5,
+		"temp":          212.0,
+		"ratio":         25.0,
+		"state":         "ok",
+		"count":         int64(3),
+	}
+	if !reflect.DeepEqual(metric.Fields, want) {
+		t.Errorf("got fields %v, want %v", metric.Fields, want)
+	}
+}
+
+func TestNamedConversions(t *testing.T) {
+	for _, tt := range []struct {
+		op   string
+		in   interface{}
+		want float64
+	}{
+		{"c_to_f", -40.0, -40},
+		{"f_to_c", int64(212), 100},
+		{"bytes_to_kb", int64(1536), 1.5},
+		{"bytes_to_gb", int64(1 << 30), 1},
+		{"bits_to_bytes", int32(12), 1.5},
+		{"ms_to_s", int64(1500), 1.5},
+		{"s_to_ms", 0.25, 250},
+	} {
+		u := &Units{Rules: []*Rule{{Fields: []string{"v"}, Operation: tt.op}}}
+		if err := u.Init(); err != nil {
+			t.Fatal(err)
+		}
+		metric := &service.MetricData{Fields: map[string]interface{}{"v": tt.in}}
+		u.Apply([]*service.MetricData{metric})
+		if got := metric.Fields["v"]; got != tt.want {
+			t.Errorf("%s %v, got %v (%T), want %v", tt.op, tt.in, got, got, tt.want)
+		}
+	}
+}
+
+func TestUnitsInvalid(t *testing.T) {
+	for _, rule := range []*Rule{
+		{Operation: "c_to_f"},
+		{Fields: []string{"v"}, Operation: "divide"},
+		{Fields: []string{"v"}, Operation: "k_to_c"},
+	} {
+		u := &Units{Rules: []*Rule{rule}}
+		if err := u.Init(); err == nil {
+			t.Errorf("rule %+v accepted", rule)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+package all
+
+import (
+	_ "github.com/corego/vgo/vgo/stream/plugins/serializer/influx"
+	_ "github.com/corego/vgo/vgo/stream/plugins/serializer/json"
+	_ "github.com/corego/vgo/vgo/stream/plugins/serializer/ndjson"
+)
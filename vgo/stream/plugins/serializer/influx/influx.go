@@ -0,0 +1,39 @@
+package influx
+
+import (
+	"bytes"
+
+	"github.com/corego/vgo/mecury/misc"
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// InfluxSerializer serializes metrics in the InfluxDB line protocol, one
+// line per metric.
+type InfluxSerializer struct {
+}
+
+func (s *InfluxSerializer) Serialize(m *service.MetricData) ([]byte, error) {
+	pt, err := misc.NewPoint(m.Name, m.Tags, m.Fields, m.Time)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(pt.String() + "\n"), nil
+}
+
+func (s *InfluxSerializer) SerializeBatch(metrics service.Metrics) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, m := range metrics.Data {
+		b, err := s.Serialize(m)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+	}
+	return buf.Bytes(), nil
+}
+
+func init() {
+	service.AddSerializer("influx", func() service.Serializer {
+		return &InfluxSerializer{}
+	})
+}
@@ -0,0 +1,47 @@
+package influx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+func TestSerialize(t *testing.T) {
+	s := &InfluxSerializer{}
+	b, err := s.Serialize(&service.MetricData{
+		Name:   "cpu",
+		Tags:   map[string]string{"host": "server01", "region": "us west"},
+		Fields: map[string]interface{}{"idle": 98.5, "count": int64(3), "state": "ok", "up": true},
+		Time:   time.Unix(1500000000, 123),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "cpu,host=server01,region=us\\ west count=3i,idle=98.5,state=\"ok\",up=true 1500000000000000123\n"
+	if string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+}
+
+func TestSerializeBatch(t *testing.T) {
+	s := &InfluxSerializer{}
+	b, err := s.SerializeBatch(service.Metrics{Data: []*service.MetricData{
+		{Name: "cpu", Fields: map[string]interface{}{"idle": 1.0}, Time: time.Unix(1, 0)},
+		{Name: "mem", Tags: map[string]string{"host": "a"}, Fields: map[string]interface{}{"used": int64(2)}, Time: time.Unix(2, 0)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "cpu idle=1 1000000000\nmem,host=a used=2i 2000000000\n"
+	if string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+}
+
+func TestSerializeNoFields(t *testing.T) {
+	s := &InfluxSerializer{}
+	if _, err := s.Serialize(&service.MetricData{Name: "cpu", Time: time.Unix(1, 0)}); err == nil {
+		t.Error("metric without fields serialized")
+	}
+}
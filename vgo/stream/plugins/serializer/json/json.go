@@ -0,0 +1,102 @@
+package json
+
+import (
+	ejson "encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+// warnSample logs one skipped metric out of warnSample
+const warnSample = 100
+
+// JSONSerializer serializes a metric as a JSON object, and a batch as an
+// object holding the array of metrics:
+//
+//   {"metrics":[{"name":"cpu","tags":{},"fields":{},"timestamp":1480000000}]}
+//
+// The timestamps are in TimestampUnits, seconds by default. A metric which
+// fails to serialize, such as one with a NaN field, is left out of its batch.
+type JSONSerializer struct {
+	TimestampUnits time.Duration
+
+	// skipped counts the metrics left out of the batches
+	skipped uint64
+}
+
+type metric struct {
+	Name      string                 `json:"name"`
+	Tags      map[string]string      `json:"tags"`
+	Fields    map[string]interface{} `json:"fields"`
+	Timestamp int64                  `json:"timestamp"`
+}
+
+type batch struct {
+	Metrics []ejson.RawMessage `json:"metrics"`
+}
+
+// SetTimestampUnits sets the unit of the timestamps.
+func (s *JSONSerializer) SetTimestampUnits(units time.Duration) {
+	s.TimestampUnits = units
+}
+
+func (s *JSONSerializer) newMetric(m *service.MetricData) *metric {
+	return &metric{
+		Name:      m.Name,
+		Tags:      m.Tags,
+		Fields:    m.Fields,
+		Timestamp: m.Time.UnixNano() / int64(s.TimestampUnits),
+	}
+}
+
+func (s *JSONSerializer) Serialize(m *service.MetricData) ([]byte, error) {
+	b, err := ejson.Marshal(s.newMetric(m))
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// SerializeBatch serializes the metrics one by one, the ones failing are
+// skipped and counted instead of failing the batch.
+func (s *JSONSerializer) SerializeBatch(metrics service.Metrics) ([]byte, error) {
+	b := &batch{
+		Metrics: make([]ejson.RawMessage, 0, len(metrics.Data)),
+	}
+	for _, m := range metrics.Data {
+		raw, err := ejson.Marshal(s.newMetric(m))
+		if err != nil {
+			s.skip(m, err)
+			continue
+		}
+		b.Metrics = append(b.Metrics, raw)
+	}
+	return ejson.Marshal(b)
+}
+
+// skip counts the metric which failed to serialize and logs a sample of
+// them.
+func (s *JSONSerializer) skip(m *service.MetricData, err error) {
+	n := atomic.AddUint64(&s.skipped, 1)
+	if n%warnSample != 1 {
+		return
+	}
+	service.VLogger.Warn("JSON serialize failed, metric skipped",
+		zap.String("metric", m.Name),
+		zap.Error(err),
+		zap.Int64("skipped", int64(n)),
+	)
+}
+
+// Skipped returns the number of metrics skipped by SerializeBatch.
+func (s *JSONSerializer) Skipped() uint64 {
+	return atomic.LoadUint64(&s.skipped)
+}
+
+func init() {
+	service.AddSerializer("json", func() service.Serializer {
+		return &JSONSerializer{TimestampUnits: time.Second}
+	})
+}
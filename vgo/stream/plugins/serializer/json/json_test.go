@@ -0,0 +1,92 @@
+package json
+
+import (
+	"io/ioutil"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+var testMetric = &service.MetricData{
+	Name:   "cpu",
+	Tags:   map[string]string{"host": "server01"},
+	Fields: map[string]interface{}{"idle": 98.5, "state": "ok"},
+	Time:   time.Unix(1500000000, 123456789),
+}
+
+func TestSerialize(t *testing.T) {
+	s := &JSONSerializer{TimestampUnits: time.Second}
+	b, err := s.Serialize(testMetric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"name":"cpu","tags":{"host":"server01"},"fields":{"idle":98.5,"state":"ok"},"timestamp":1500000000}` + "\n"
+	if string(b) != want {
+		t.Errorf("got %s, want %s", b, want)
+	}
+}
+
+func TestSerializeBatch(t *testing.T) {
+	s := &JSONSerializer{TimestampUnits: time.Second}
+	b, err := s.SerializeBatch(service.Metrics{Data: []*service.MetricData{
+		testMetric,
+		{Name: "mem", Tags: map[string]string{}, Fields: map[string]interface{}{"used": int64(2)}, Time: time.Unix(2, 0)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"metrics":[` +
+		`{"name":"cpu","tags":{"host":"server01"},"fields":{"idle":98.5,"state":"ok"},"timestamp":1500000000},` +
+		`{"name":"mem","tags":{},"fields":{"used":2},"timestamp":2}]}`
+	if string(b) != want {
+		t.Errorf("got %s, want %s", b, want)
+	}
+}
+
+func TestSerializeTimestampUnits(t *testing.T) {
+	for _, tt := range []struct {
+		units time.Duration
+		want  string
+	}{
+		{time.Second, "1500000000"},
+		{time.Millisecond, "1500000000123"},
+		{time.Microsecond, "1500000000123456"},
+		{time.Nanosecond, "1500000000123456789"},
+	} {
+		s := &JSONSerializer{}
+		s.SetTimestampUnits(tt.units)
+		b, err := s.Serialize(testMetric)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `{"name":"cpu","tags":{"host":"server01"},"fields":{"idle":98.5,"state":"ok"},"timestamp":` + tt.want + "}\n"
+		if string(b) != want {
+			t.Errorf("units %s, got %s, want %s", tt.units, b, want)
+		}
+	}
+}
+
+func TestSerializeBatchSkips(t *testing.T) {
+	s := &JSONSerializer{TimestampUnits: time.Second}
+	b, err := s.SerializeBatch(service.Metrics{Data: []*service.MetricData{
+		{Name: "bad", Tags: map[string]string{}, Fields: map[string]interface{}{"nan": math.NaN()}, Time: time.Unix(1, 0)},
+		{Name: "mem", Tags: map[string]string{}, Fields: map[string]interface{}{"used": int64(2)}, Time: time.Unix(2, 0)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"metrics":[{"name":"mem","tags":{},"fields":{"used":2},"timestamp":2}]}`
+	if string(b) != want {
+		t.Errorf("got %s, want %s", b, want)
+	}
+	if n := s.Skipped(); n != 1 {
+		t.Errorf("got %d skipped, want 1", n)
+	}
+}
@@ -0,0 +1,135 @@
+package ndjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+// warnSample logs one skipped metric out of warnSample
+const warnSample = 100
+
+// NDJSONSerializer serializes the metrics as newline delimited JSON, one
+// object per line, for the bulk endpoints of the HTTP sinks:
+//
+//   {"name":"cpu","tags":{},"fields":{},"timestamp":1480000000}
+//
+// The keys and values are escaped by encoding/json, the NaN and infinite
+// floats which JSON can't represent are dropped. The timestamps are in
+// TimestampUnits, seconds by default. A metric which still fails to
+// serialize is left out of its batch.
+type NDJSONSerializer struct {
+	TimestampUnits time.Duration
+
+	// skipped counts the metrics left out of the batches
+	skipped uint64
+}
+
+type metric struct {
+	Name      string                 `json:"name"`
+	Tags      map[string]string      `json:"tags"`
+	Fields    map[string]interface{} `json:"fields"`
+	Timestamp int64                  `json:"timestamp"`
+}
+
+// SetTimestampUnits sets the unit of the timestamps.
+func (s *NDJSONSerializer) SetTimestampUnits(units time.Duration) {
+	s.TimestampUnits = units
+}
+
+func (s *NDJSONSerializer) newMetric(m *service.MetricData) *metric {
+	return &metric{
+		Name:      m.Name,
+		Tags:      m.Tags,
+		Fields:    finiteFields(m.Fields),
+		Timestamp: m.Time.UnixNano() / int64(s.TimestampUnits),
+	}
+}
+
+// finiteFields returns the fields without the NaN and infinite floats, the
+// fields are only copied when one of them is dropped.
+func finiteFields(fields map[string]interface{}) map[string]interface{} {
+	var out map[string]interface{}
+	for k, v := range fields {
+		if finite(v) {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]interface{}, len(fields))
+			for k, v := range fields {
+				out[k] = v
+			}
+		}
+		delete(out, k)
+	}
+	if out == nil {
+		return fields
+	}
+	return out
+}
+
+func finite(v interface{}) bool {
+	switch f := v.(type) {
+	case float64:
+		return !math.IsNaN(f) && !math.IsInf(f, 0)
+	case float32:
+		return !math.IsNaN(float64(f)) && !math.IsInf(float64(f), 0)
+	default:
+		return true
+	}
+}
+
+func (s *NDJSONSerializer) Serialize(m *service.MetricData) ([]byte, error) {
+	b, err := json.Marshal(s.newMetric(m))
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// SerializeBatch encodes the whole batch in a single buffer, one line per
+// metric. The metrics failing are skipped and counted instead of failing
+// the batch.
+func (s *NDJSONSerializer) SerializeBatch(metrics service.Metrics) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, m := range metrics.Data {
+		b, err := json.Marshal(s.newMetric(m))
+		if err != nil {
+			s.skip(m, err)
+			continue
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// skip counts the metric which failed to serialize and logs a sample of
+// them.
+func (s *NDJSONSerializer) skip(m *service.MetricData, err error) {
+	n := atomic.AddUint64(&s.skipped, 1)
+	if n%warnSample != 1 {
+		return
+	}
+	service.VLogger.Warn("NDJSON serialize failed, metric skipped",
+		zap.String("metric", m.Name),
+		zap.Error(err),
+		zap.Int64("skipped", int64(n)),
+	)
+}
+
+// Skipped returns the number of metrics skipped by SerializeBatch.
+func (s *NDJSONSerializer) Skipped() uint64 {
+	return atomic.LoadUint64(&s.skipped)
+}
+
+func init() {
+	service.AddSerializer("ndjson", func() service.Serializer {
+		return &NDJSONSerializer{TimestampUnits: time.Second}
+	})
+}
@@ -0,0 +1,177 @@
+package ndjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	jsonparser "github.com/corego/vgo/vgo/stream/plugins/parser/json"
+	"github.com/corego/vgo/vgo/stream/service"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	service.VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+}
+
+var testBatch = service.Metrics{Data: []*service.MetricData{
+	{
+		Name:   "cpu",
+		Tags:   map[string]string{"host": "server01"},
+		Fields: map[string]interface{}{"idle": 98.5, "count": int64(3), "state": "ok", "up": true},
+		Time:   time.Unix(1500000000, 0),
+	},
+	{
+		// the keys and values needing an escape
+		Name: "app \"web\"",
+		Tags: map[string]string{
+			"path\\key":    "C:\\temp\\",
+			"line\nbreak":  "tab\there",
+			"html<&>":      "<script>&</script>",
+			"unicode é 日本": "naïve ☃",
+		},
+		Fields: map[string]interface{}{
+			"message \"quoted\"": "multi\nline \"text\"",
+			"ctrl\x01":           "\x00\x1f",
+			"latency":            1.5e-9,
+		},
+		Time: time.Unix(1500000001, 0),
+	},
+	{
+		Name:   "mem",
+		Tags:   map[string]string{},
+		Fields: map[string]interface{}{"used": uint64(1) << 40},
+		Time:   time.Unix(1500000002, 0),
+	},
+}}
+
+func TestSerialize(t *testing.T) {
+	s := &NDJSONSerializer{TimestampUnits: time.Second}
+	b, err := s.Serialize(testBatch.Data[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"name":"cpu","tags":{"host":"server01"},"fields":{"count":3,"idle":98.5,"state":"ok","up":true},"timestamp":1500000000}` + "\n"
+	if string(b) != want {
+		t.Errorf("got %s, want %s", b, want)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	s := &NDJSONSerializer{TimestampUnits: time.Second}
+	b, err := s.SerializeBatch(testBatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one valid object per line, the newlines of the values are escaped
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(lines) != len(testBatch.Data) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(testBatch.Data), b)
+	}
+	for _, line := range lines {
+		var o map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &o); err != nil {
+			t.Errorf("invalid JSON line %s, %v", line, err)
+		}
+	}
+
+	p := &jsonparser.JSONParser{TimestampUnits: time.Second}
+	got, err := p.Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(testBatch.Data) {
+		t.Fatalf("parsed %d metrics, want %d", len(got), len(testBatch.Data))
+	}
+	for n, want := range testBatch.Data {
+		m := got[n]
+		if m.Name != want.Name || !m.Time.Equal(want.Time) || !reflect.DeepEqual(m.Tags, want.Tags) {
+			t.Errorf("got metric %s %v %s, want %s %v %s", m.Name, m.Tags, m.Time, want.Name, want.Tags, want.Time)
+		}
+		// the numbers come back as floats
+		for k, v := range want.Fields {
+			switch x := v.(type) {
+			case int64:
+				v = float64(x)
+			case uint64:
+				v = float64(x)
+			}
+			if m.Fields[k] != v {
+				t.Errorf("%s field %q, got %#v, want %#v", want.Name, k, m.Fields[k], v)
+			}
+		}
+		if len(m.Fields) != len(want.Fields) {
+			t.Errorf("%s got fields %v, want %v", want.Name, m.Fields, want.Fields)
+		}
+	}
+}
+
+func TestSerializeBatchSameLines(t *testing.T) {
+	s := &NDJSONSerializer{TimestampUnits: time.Millisecond}
+	batch, err := s.SerializeBatch(testBatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var single bytes.Buffer
+	for _, m := range testBatch.Data {
+		b, err := s.Serialize(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		single.Write(b)
+	}
+	if !bytes.Equal(batch, single.Bytes()) {
+		t.Errorf("batch\n%s\ndiffers from the single metrics\n%s", batch, single.Bytes())
+	}
+
+	if b, err := s.SerializeBatch(service.Metrics{}); err != nil || len(b) != 0 {
+		t.Errorf("empty batch, got %q and error %v", b, err)
+	}
+}
+
+func TestNonFinite(t *testing.T) {
+	m := &service.MetricData{
+		Name:   "ratio",
+		Tags:   map[string]string{},
+		Fields: map[string]interface{}{"nan": math.NaN(), "inf": math.Inf(-1), "inf32": float32(math.Inf(1)), "value": 0.5},
+		Time:   time.Unix(1, 0),
+	}
+	s := &NDJSONSerializer{TimestampUnits: time.Second}
+	b, err := s.SerializeBatch(service.Metrics{Data: []*service.MetricData{m}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"name":"ratio","tags":{},"fields":{"value":0.5},"timestamp":1}` + "\n"
+	if string(b) != want {
+		t.Errorf("got %s, want %s", b, want)
+	}
+	// the metric keeps its fields for the other outputs
+	if len(m.Fields) != 4 {
+		t.Errorf("got fields %v, want the metric untouched", m.Fields)
+	}
+}
+
+func TestSerializeBatchSkips(t *testing.T) {
+	s := &NDJSONSerializer{TimestampUnits: time.Second}
+	b, err := s.SerializeBatch(service.Metrics{Data: []*service.MetricData{
+		{Name: "bad", Tags: map[string]string{}, Fields: map[string]interface{}{"complex": complex(1, 2)}, Time: time.Unix(1, 0)},
+		{Name: "mem", Tags: map[string]string{}, Fields: map[string]interface{}{"used": int64(2)}, Time: time.Unix(2, 0)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"name":"mem","tags":{},"fields":{"used":2},"timestamp":2}` + "\n"
+	if string(b) != want {
+		t.Errorf("got %s, want %s", b, want)
+	}
+	if n := s.Skipped(); n != 1 {
+		t.Errorf("got %d skipped, want 1", n)
+	}
+}
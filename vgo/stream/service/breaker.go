@@ -0,0 +1,105 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a Breaker
+type BreakerState int32
+
+const (
+	// BreakerClosed lets the writes through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects the writes until the cooldown is over
+	BreakerOpen
+	// BreakerHalfOpen lets one write through to test the recovery
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Breaker is a circuit breaker: it opens after threshold consecutive
+// failures, rejects the writes for the cooldown, then half-opens and lets a
+// single trial write decide whether it closes or opens again. It's safe for
+// concurrent use.
+type Breaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	// trial is true while the half-open trial write runs
+	trial bool
+}
+
+// NewBreaker returns a closed Breaker.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow reports whether a write can be attempted. Once the cooldown is over
+// the first caller gets the trial write, the others are still rejected.
+func (b *Breaker) Allow() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.trial = true
+		return true
+	case BreakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Record records the result of an allowed write and returns the new state.
+func (b *Breaker) Record(ok bool) BreakerState {
+	b.Lock()
+	defer b.Unlock()
+
+	b.trial = false
+	if ok {
+		b.failures = 0
+		b.state = BreakerClosed
+		return b.state
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+	return b.state
+}
+
+// State returns the current state.
+func (b *Breaker) State() BreakerState {
+	b.Lock()
+	defer b.Unlock()
+	return b.state
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	b := NewBreaker(2, 50*time.Millisecond)
+
+	// closed, a success resets the failure count
+	for _, ok := range []bool{false, true, false} {
+		if !b.Allow() {
+			t.Fatal("closed breaker rejected a write")
+		}
+		if state := b.Record(ok); state != BreakerClosed {
+			t.Fatalf("breaker %s before the threshold", state)
+		}
+	}
+
+	// open at the threshold, until the cooldown is over
+	if state := b.Record(false); state != BreakerOpen {
+		t.Fatalf("breaker %s at the threshold, want open", state)
+	}
+	if b.Allow() {
+		t.Fatal("open breaker allowed a write")
+	}
+
+	// half-open, a single trial write, a failure opens it again
+	time.Sleep(60 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("trial write rejected after the cooldown")
+	}
+	if b.State() != BreakerHalfOpen {
+		t.Fatalf("breaker %s during the trial, want half-open", b.State())
+	}
+	if b.Allow() {
+		t.Fatal("second write allowed during the trial")
+	}
+	if state := b.Record(false); state != BreakerOpen {
+		t.Fatalf("breaker %s after a failed trial, want open", state)
+	}
+	if b.Allow() {
+		t.Fatal("breaker allowed a write after a failed trial")
+	}
+
+	// a successful trial closes it
+	time.Sleep(60 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("trial write rejected after the cooldown")
+	}
+	if state := b.Record(true); state != BreakerClosed {
+		t.Fatalf("breaker %s after a successful trial, want closed", state)
+	}
+	if !b.Allow() {
+		t.Fatal("closed breaker rejected a write")
+	}
+}
+
+func TestOutputBreaker(t *testing.T) {
+	mo := &mockOutput{}
+	mo.fail = true
+	mc := &MetricOutputConfig{Name: "breaker_output", MetricOutput: mo, BreakerThreshold: 2, BreakerCooldown: 50 * time.Millisecond}
+	defer startOutput(mc)()
+
+	state := func() interface{} { return statsOf(t, "metric_output", "breaker_output")["breaker_state"] }
+
+	mc.dispatch(Metrics{Data: testMetrics(1)})
+	mc.dispatch(Metrics{Data: testMetrics(1)})
+	if s := state(); s != int64(BreakerOpen) {
+		t.Fatalf("breaker_state %v after 2 failures, want open", s)
+	}
+
+	// not attempted while open, the metrics are kept
+	mo.setFail(false)
+	mc.dispatch(Metrics{Data: testMetrics(1)})
+	if mo.writes != 2 {
+		t.Errorf("%d writes attempted, want 2, none while the breaker is open", mo.writes)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	mc.dispatch(Metrics{Data: testMetrics(1)})
+	if s := state(); s != int64(BreakerClosed) {
+		t.Errorf("breaker_state %v after the successful trial, want closed", s)
+	}
+	if n := mo.written(); n != 4 {
+		t.Errorf("%d metrics written after the recovery, want the 3 kept and the new one", n)
+	}
+}
+
+func TestOutputBreakerDrop(t *testing.T) {
+	mo := &mockOutput{}
+	mo.fail = true
+	mc := &MetricOutputConfig{MetricOutput: mo, BreakerThreshold: 1, BreakerCooldown: time.Hour, BreakerDrop: true}
+	defer startOutput(mc)()
+
+	// the failed write opens the breaker, its metric is kept for a retry
+	mc.dispatch(Metrics{Data: testMetrics(1)})
+	mc.retry.Batch(mc.retry.Len())
+	mc.dispatch(Metrics{Data: testMetrics(3)})
+	if !mc.retry.IsEmpty() {
+		t.Errorf("%d metrics kept by the open breaker, want them dropped", mc.retry.Len())
+	}
+}
@@ -0,0 +1,106 @@
+package service
+
+import "sync"
+
+// MetricBuffer keeps the metrics waiting to be written, the oldest ones are
+// dropped past its size.
+type MetricBuffer interface {
+	IsEmpty() bool
+	Len() int
+	// Add adds the metrics, it returns the oldest metrics dropped to make
+	// room for the new ones
+	Add(metrics ...*MetricData) []*MetricData
+	// Batch removes and returns up to batchSize of the oldest metrics
+	Batch(batchSize int) []*MetricData
+}
+
+// Buffer is an object for storing metrics in a circular buffer.
+type Buffer struct {
+	sync.Mutex
+	buf chan *MetricData
+	// total dropped metrics
+	drops int
+	// total metrics added
+	total int
+}
+
+// NewBuffer returns a Buffer
+//   size is the maximum number of metrics that Buffer will cache. If Add is
+//   called when the buffer is full, then the oldest metric(s) will be dropped.
+func NewBuffer(size int) *Buffer {
+	return &Buffer{
+		buf: make(chan *MetricData, size),
+	}
+}
+
+// IsEmpty returns true if Buffer is empty.
+func (b *Buffer) IsEmpty() bool {
+	return len(b.buf) == 0
+}
+
+// Len returns the current length of the buffer.
+func (b *Buffer) Len() int {
+	return len(b.buf)
+}
+
+// Cap returns the maximum number of metrics of the buffer.
+func (b *Buffer) Cap() int {
+	return cap(b.buf)
+}
+
+// Drops returns the total number of dropped metrics that have occured in this
+// buffer since instantiation.
+func (b *Buffer) Drops() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.drops
+}
+
+// Total returns the total number of metrics that have been added to this buffer.
+func (b *Buffer) Total() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.total
+}
+
+// Add adds metrics to the buffer, it returns the oldest metrics dropped to
+// make room for the new ones.
+func (b *Buffer) Add(metrics ...*MetricData) []*MetricData {
+	b.Lock()
+	defer b.Unlock()
+
+	var dropped []*MetricData
+	for i := range metrics {
+		b.total++
+		select {
+		case b.buf <- metrics[i]:
+		default:
+			b.drops++
+			dropped = append(dropped, <-b.buf)
+			b.buf <- metrics[i]
+		}
+	}
+	return dropped
+}
+
+// Batch returns a batch of metrics of size batchSize.
+// the batch will be of maximum length batchSize. It can be less than batchSize,
+// if the length of Buffer is less than batchSize.
+func (b *Buffer) Batch(batchSize int) []*MetricData {
+	b.Lock()
+	defer b.Unlock()
+
+	n := min(len(b.buf), batchSize)
+	out := make([]*MetricData, n)
+	for i := 0; i < n; i++ {
+		out[i] = <-b.buf
+	}
+	return out
+}
+
+func min(a, b int) int {
+	if b < a {
+		return b
+	}
+	return a
+}
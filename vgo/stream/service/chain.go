@@ -2,6 +2,7 @@ package service
 
 import (
 	"log"
+	"sync"
 	"time"
 
 	"github.com/corego/vgo/mecury/misc"
@@ -18,6 +19,13 @@ type ChainConfig struct {
 	Chain Chainer
 
 	Interval time.Duration
+
+	// signature identifies the config of the chain
+	signature string
+
+	// stop is handed to the chain, closed when the chain stops
+	stop     chan bool
+	stopOnce sync.Once
 }
 
 var Chains = map[string]Chainer{}
@@ -35,10 +43,26 @@ func (cc *ChainConfig) Start(stopC chan bool) {
 		}
 	}()
 
-	cc.Chain.Init(stopC)
+	cc.stop = make(chan bool)
+	go func() {
+		select {
+		case <-stopC:
+			cc.Stop()
+		case <-cc.stop:
+		}
+	}()
+
+	cc.Chain.Init(cc.stop)
 	go cc.Chain.Start()
 }
 
+// Stop stops the chain alone.
+func (cc *ChainConfig) Stop() {
+	cc.stopOnce.Do(func() {
+		close(cc.stop)
+	})
+}
+
 // Show show struct message
 func (cc *ChainConfig) Show() {
 	log.Println("Name is ", cc.Name)
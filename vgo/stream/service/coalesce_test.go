@@ -0,0 +1,118 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/naoina/toml"
+)
+
+func TestCoalesceCycles(t *testing.T) {
+	mo := &mockOutput{}
+	mc := &MetricOutputConfig{MetricOutput: mo, CoalesceCycles: 3, CoalesceMaxLatency: time.Hour}
+	defer startOutput(mc)()
+
+	// the batches of the first cycles are kept
+	mc.Compute(Metrics{Data: testMetrics(2)})
+	mc.Compute(Metrics{Data: testMetrics(2)})
+	time.Sleep(50 * time.Millisecond)
+	if n := mo.written(); n != 0 {
+		t.Fatalf("wrote %d metrics before the last cycle", n)
+	}
+
+	// written together on the last one
+	mc.Compute(Metrics{Data: testMetrics(2)})
+	waitFor(t, time.Second, func() bool { return mo.written() == 6 })
+	if n := mo.writeCount(); n != 1 {
+		t.Errorf("got %d writes, want the cycles coalesced in 1", n)
+	}
+
+	// the count starts again after the flush
+	mc.Compute(Metrics{Data: testMetrics(1)})
+	mc.Compute(Metrics{Data: testMetrics(1)})
+	time.Sleep(50 * time.Millisecond)
+	if n := mo.written(); n != 6 {
+		t.Fatalf("wrote %d metrics, want the 2 new cycles kept", n-6)
+	}
+	mc.Compute(Metrics{Data: testMetrics(1)})
+	waitFor(t, time.Second, func() bool { return mo.written() == 9 })
+	if n := mo.writeCount(); n != 2 {
+		t.Errorf("got %d writes, want 2", n)
+	}
+}
+
+func TestCoalesceBatchSize(t *testing.T) {
+	mo := &mockOutput{}
+	mc := &MetricOutputConfig{MetricOutput: mo, CoalesceCycles: 100, CoalesceMaxLatency: time.Hour, MetricBatchSize: 10}
+	defer startOutput(mc)()
+
+	// flushed once the batch size is reached, before the cycles, by
+	// batches of the batch size
+	mc.Compute(Metrics{Data: testMetrics(6)})
+	mc.Compute(Metrics{Data: testMetrics(6)})
+	waitFor(t, time.Second, func() bool { return mo.written() == 12 })
+	if n := mo.writeCount(); n != 2 {
+		t.Errorf("got %d writes, want 2", n)
+	}
+}
+
+func TestCoalesceMaxLatency(t *testing.T) {
+	mo := &mockOutput{}
+	latency := 50 * time.Millisecond
+	mc := &MetricOutputConfig{MetricOutput: mo, CoalesceCycles: 100, CoalesceMaxLatency: latency}
+	defer startOutput(mc)()
+
+	// the latency runs from the first batch, not the last one
+	start := time.Now()
+	mc.Compute(Metrics{Data: testMetrics(1)})
+	time.Sleep(latency / 2)
+	mc.Compute(Metrics{Data: testMetrics(1)})
+	waitFor(t, time.Second, func() bool { return mo.written() == 2 })
+	if elapsed := time.Since(start); elapsed < latency || elapsed > latency+latency/2+100*time.Millisecond {
+		t.Errorf("flushed after %s, want %s", elapsed, latency)
+	}
+	if n := mo.writeCount(); n != 1 {
+		t.Errorf("got %d writes, want 1", n)
+	}
+
+	// the timer starts again on the next batch
+	mc.Compute(Metrics{Data: testMetrics(1)})
+	waitFor(t, time.Second, func() bool { return mo.written() == 3 })
+}
+
+func TestCoalesceShutdown(t *testing.T) {
+	mo := &closingOutput{}
+	mc := &MetricOutputConfig{MetricOutput: mo, CoalesceCycles: 10, CoalesceMaxLatency: time.Hour}
+	defer startOutput(mc)()
+
+	mc.Compute(Metrics{Data: testMetrics(3)})
+	mc.Compute(Metrics{Data: testMetrics(3)})
+	if err := mc.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if mo.writtenAtClose != 6 {
+		t.Errorf("%d metrics written before Close, want the 6 coalesced", mo.writtenAtClose)
+	}
+}
+
+func TestCoalesceConfig(t *testing.T) {
+	for _, tt := range []struct {
+		conf string
+		err  bool
+	}{
+		{"coalesce_cycles = 5", false},
+		{"coalesce_cycles = 5\ncoalesce_max_latency = \"1m\"", false},
+		{"coalesce_cycles = -1", true},
+		{"coalesce_cycles = 5\nflush_interval = \"10s\"", true},
+		{"coalesce_max_latency = \"0s\"", true},
+	} {
+		tbl, err := toml.Parse([]byte(tt.conf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = buildMetricOutput("test", tbl)
+		if (err != nil) != tt.err {
+			t.Errorf("%q, got error %v", tt.conf, err)
+		}
+	}
+}
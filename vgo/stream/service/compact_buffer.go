@@ -0,0 +1,187 @@
+package service
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// CompactBuffer is a MetricBuffer taking less memory than Buffer for the
+// metrics of the same series, at the cost of building a series key on Add:
+// the name and the tags of a series are kept once, shared by its metrics,
+// and the times are kept as offsets from the first time of the series. The
+// metrics are rebuilt by Batch, each one with its own tags, the times in
+// the time zone of the first metric of the series with a time.
+type CompactBuffer struct {
+	sync.Mutex
+	size int
+	// entries are the metrics from the oldest, the ones before head are
+	// already removed
+	entries []compactEntry
+	head    int
+	series  map[string]*compactSeries
+	key     bytes.Buffer
+}
+
+// compactSeries is the name and tags shared by the metrics of a series
+type compactSeries struct {
+	key  string
+	name string
+	tags map[string]string
+	// base is the time of the first metric of the series with a time, in
+	// nanoseconds, timed is false until there's one
+	base  int64
+	loc   *time.Location
+	timed bool
+	// refs is the number of metrics of the series in the buffer
+	refs int
+}
+
+type compactEntry struct {
+	series *compactSeries
+	fields map[string]interface{}
+	// delta is the offset of the time from the base of the series
+	delta int64
+	// zero is a metric without time
+	zero bool
+	ttl  time.Duration
+}
+
+// NewCompactBuffer returns a CompactBuffer of size metrics, the oldest ones
+// are dropped past it.
+func NewCompactBuffer(size int) *CompactBuffer {
+	return &CompactBuffer{
+		size:   size,
+		series: make(map[string]*compactSeries),
+	}
+}
+
+// IsEmpty returns true if the CompactBuffer is empty.
+func (b *CompactBuffer) IsEmpty() bool {
+	return b.Len() == 0
+}
+
+// Len returns the number of metrics of the CompactBuffer.
+func (b *CompactBuffer) Len() int {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.entries) - b.head
+}
+
+// Add adds the metrics, it returns the oldest metrics dropped to make room
+// for the new ones.
+func (b *CompactBuffer) Add(metrics ...*MetricData) []*MetricData {
+	b.Lock()
+	defer b.Unlock()
+
+	var dropped []*MetricData
+	for _, m := range metrics {
+		if b.size <= 0 {
+			dropped = append(dropped, m)
+			continue
+		}
+		if len(b.entries)-b.head >= b.size {
+			dropped = append(dropped, b.pop())
+		}
+
+		s := b.intern(m)
+		e := compactEntry{
+			series: s,
+			fields: m.Fields,
+			ttl:    m.TTL,
+		}
+		if m.Time.IsZero() {
+			e.zero = true
+		} else {
+			e.delta = m.Time.UnixNano() - s.base
+		}
+		b.entries = append(b.entries, e)
+	}
+	return dropped
+}
+
+// Batch removes and returns the batchSize oldest metrics, or all of them
+// when there are less.
+func (b *CompactBuffer) Batch(batchSize int) []*MetricData {
+	b.Lock()
+	defer b.Unlock()
+
+	n := min(len(b.entries)-b.head, batchSize)
+	out := make([]*MetricData, n)
+	for i := 0; i < n; i++ {
+		out[i] = b.pop()
+	}
+	return out
+}
+
+// intern returns the series of the metric, created on its first metric.
+func (b *CompactBuffer) intern(m *MetricData) *compactSeries {
+	b.key.Reset()
+	m.WriteSeriesKey(&b.key)
+
+	// the conversion in the index doesn't allocate
+	s, ok := b.series[string(b.key.Bytes())]
+	if !ok {
+		s = &compactSeries{
+			key:  b.key.String(),
+			name: m.Name,
+			tags: copyTags(m.Tags),
+		}
+		b.series[s.key] = s
+	}
+	if !s.timed && !m.Time.IsZero() {
+		s.base = m.Time.UnixNano()
+		s.loc = m.Time.Location()
+		s.timed = true
+	}
+	s.refs++
+	return s
+}
+
+// pop removes and rebuilds the oldest metric, the series without metrics
+// left are forgotten.
+func (b *CompactBuffer) pop() *MetricData {
+	e := b.entries[b.head]
+	b.entries[b.head] = compactEntry{}
+	b.head++
+
+	// move the entries to the front once half of the slice is free, so the
+	// removed ones don't pin the memory
+	if b.head >= len(b.entries)/2 {
+		n := copy(b.entries, b.entries[b.head:])
+		for i := n; i < len(b.entries); i++ {
+			b.entries[i] = compactEntry{}
+		}
+		b.entries = b.entries[:n]
+		b.head = 0
+	}
+
+	s := e.series
+	s.refs--
+	if s.refs == 0 {
+		delete(b.series, s.key)
+	}
+
+	m := &MetricData{
+		Name:   s.name,
+		Tags:   copyTags(s.tags),
+		Fields: e.fields,
+		TTL:    e.ttl,
+	}
+	if !e.zero {
+		m.Time = time.Unix(0, s.base+e.delta).In(s.loc)
+	}
+	return m
+}
+
+// copyTags copies the tags, nil stays nil.
+func copyTags(tags map[string]string) map[string]string {
+	if tags == nil {
+		return nil
+	}
+	c := make(map[string]string, len(tags))
+	for k, v := range tags {
+		c[k] = v
+	}
+	return c
+}
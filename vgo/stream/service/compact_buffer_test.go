@@ -0,0 +1,178 @@
+package service
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// compactMetrics returns metrics of a few series, out of order times
+// included.
+func compactMetrics() []*MetricData {
+	paris, _ := time.LoadLocation("Europe/Paris")
+	base := time.Unix(1500000000, 123456789).In(paris)
+	return []*MetricData{
+		{Name: "cpu", Tags: map[string]string{"host": "server01"}, Fields: map[string]interface{}{"idle": 98.5}, Time: base},
+		{Name: "cpu", Tags: map[string]string{"host": "server02"}, Fields: map[string]interface{}{"idle": 97.5}, Time: base},
+		// before the first time of the series
+		{Name: "cpu", Tags: map[string]string{"host": "server01"}, Fields: map[string]interface{}{"idle": 96.5}, Time: base.Add(-time.Hour)},
+		{Name: "cpu", Tags: map[string]string{"host": "server01"}, Fields: map[string]interface{}{"idle": 95.5, "state": "ok"}, Time: base.Add(time.Nanosecond)},
+		// without tags nor time
+		{Name: "mem", Fields: map[string]interface{}{"used": int64(1)}},
+		{Name: "mem", Fields: map[string]interface{}{"used": int64(2)}, Time: base, TTL: time.Hour},
+	}
+}
+
+// sameCompact reports whether the metric came back unchanged, the time
+// zone and the TTL included.
+func sameCompact(a, b *MetricData) bool {
+	return sameMetric(a, b) && a.Time.Location().String() == b.Time.Location().String() && a.TTL == b.TTL
+}
+
+func TestCompactBufferRoundTrip(t *testing.T) {
+	b := NewCompactBuffer(100)
+	metrics := compactMetrics()
+	if dropped := b.Add(metrics...); len(dropped) != 0 {
+		t.Fatalf("%d metrics dropped", len(dropped))
+	}
+	if n := len(b.series); n != 3 {
+		t.Errorf("got %d series, want 3", n)
+	}
+
+	got := b.Batch(100)
+	if len(got) != len(metrics) {
+		t.Fatalf("got %d metrics, want %d", len(got), len(metrics))
+	}
+	for i, m := range metrics {
+		if !sameCompact(got[i], m) {
+			t.Errorf("metric %d came back as %+v, want %+v", i, got[i], m)
+		}
+	}
+	if !b.IsEmpty() || len(b.series) != 0 {
+		t.Errorf("got %d metrics and %d series left", b.Len(), len(b.series))
+	}
+
+	// each metric has its own tags
+	got[0].Tags["host"] = "server03"
+	if got[2].Tags["host"] != "server01" || metrics[0].Tags["host"] != "server01" {
+		t.Error("tags shared by the metrics of a series")
+	}
+}
+
+// TestCompactBufferLikeBuffer runs the same adds and batches on both
+// buffers, they return the same metrics. The series mix time zones, the
+// compact buffer returns the times in the zone of the first metric of the
+// series.
+func TestCompactBufferLikeBuffer(t *testing.T) {
+	for _, size := range []int{1, 4, 100} {
+		naive, compact := NewBuffer(size), NewCompactBuffer(size)
+		for round, batch := range []int{2, 0, 3, 1, 100} {
+			add := append(compactMetrics(), testMetrics(round*3)...)
+			a, b := naive.Add(add...), compact.Add(add...)
+			if len(a) != len(b) {
+				t.Fatalf("size %d round %d, got %d metrics dropped, want %d", size, round, len(b), len(a))
+			}
+			for i := range a {
+				if !sameMetric(a[i], b[i]) || a[i].TTL != b[i].TTL {
+					t.Errorf("size %d round %d, dropped %+v, want %+v", size, round, b[i], a[i])
+				}
+			}
+			if naive.Len() != compact.Len() {
+				t.Fatalf("size %d round %d, got length %d, want %d", size, round, compact.Len(), naive.Len())
+			}
+
+			a, b = naive.Batch(batch), compact.Batch(batch)
+			if len(a) != len(b) {
+				t.Fatalf("size %d round %d, got a batch of %d metrics, want %d", size, round, len(b), len(a))
+			}
+			for i := range a {
+				if !sameMetric(a[i], b[i]) || a[i].TTL != b[i].TTL {
+					t.Errorf("size %d round %d, got %+v, want %+v", size, round, b[i], a[i])
+				}
+			}
+		}
+	}
+}
+
+func TestCompactBufferOutput(t *testing.T) {
+	mo := &mockOutput{}
+	mc := &MetricOutputConfig{MetricOutput: mo, FlushInterval: time.Hour, CompactBuffer: true}
+	defer startOutput(mc)()
+	if _, ok := mc.pending.(*CompactBuffer); !ok {
+		t.Fatalf("got pending buffer %T, want a CompactBuffer", mc.pending)
+	}
+
+	metrics := compactMetrics()
+	mc.Compute(Metrics{Data: metrics})
+	mc.flush()
+	if len(mo.metrics) != len(metrics) {
+		t.Fatalf("wrote %d metrics, want %d", len(mo.metrics), len(metrics))
+	}
+	for i, m := range metrics {
+		if !sameMetric(mo.metrics[i], m) {
+			t.Errorf("wrote %+v, want %+v", mo.metrics[i], m)
+		}
+	}
+}
+
+// bufferWorkload is 10000 metrics of 100 series of three tags, like the
+// cpu metrics of 100 hosts every 10s.
+func bufferWorkload() []*MetricData {
+	start := time.Unix(1500000000, 0)
+	metrics := make([]*MetricData, 0, 10000)
+	for i := 0; i < 100; i++ {
+		for host := 0; host < 100; host++ {
+			metrics = append(metrics, &MetricData{
+				Name: "cpu",
+				Tags: map[string]string{
+					"host":   fmt.Sprintf("server%02d", host),
+					"region": "eu-west-1",
+					"cpu":    "cpu-total",
+				},
+				Fields: map[string]interface{}{"usage_idle": 98.5},
+				Time:   start.Add(time.Duration(i) * 10 * time.Second),
+			})
+		}
+	}
+	return metrics
+}
+
+// benchmarkBufferMemory logs the heap taken by the workload once in the
+// buffer, the metrics added aren't referenced anymore but by the buffer.
+func benchmarkBufferMemory(b *testing.B, newBuffer func(int) MetricBuffer) {
+	b.ReportAllocs()
+	var before, after runtime.MemStats
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		buf := newBuffer(10000)
+		buf.Add(bufferWorkload()...)
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		runtime.KeepAlive(buf)
+	}
+	b.Logf("%d bytes per metric", (int64(after.HeapAlloc)-int64(before.HeapAlloc))/10000)
+}
+
+func BenchmarkBufferMemory(b *testing.B) {
+	benchmarkBufferMemory(b, func(size int) MetricBuffer { return NewBuffer(size) })
+}
+
+func BenchmarkCompactBufferMemory(b *testing.B) {
+	benchmarkBufferMemory(b, func(size int) MetricBuffer { return NewCompactBuffer(size) })
+}
+
+func TestCompactBufferZeroValues(t *testing.T) {
+	// the zero time and nil tags survive the round trip
+	b := NewCompactBuffer(1)
+	b.Add(&MetricData{Name: "mem"})
+	got := b.Batch(1)
+	if len(got) != 1 || !got[0].Time.IsZero() || got[0].Tags != nil {
+		t.Errorf("got %+v, want the zero time and nil tags", got)
+	}
+	if !reflect.DeepEqual(b.Batch(1), []*MetricData{}) {
+		t.Error("empty buffer returned metrics")
+	}
+}
@@ -1,12 +1,19 @@
 package service
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/corego/vgo/common/vlog"
+	"github.com/corego/vgo/mecury/misc"
 	"github.com/naoina/toml"
 	"github.com/naoina/toml/ast"
+	"github.com/uber-go/zap"
 )
 
 type CommonConfig struct {
@@ -14,177 +21,384 @@ type CommonConfig struct {
 	IsDebug  bool
 	LogLevel string
 	LogPath  string
+	// LogEncoding can be "json" or "console"
+	LogEncoding string
+	// LogOutputs are "stdout", "stderr" or file paths, by default stdout
+	// when debugging and LogPath otherwise
+	LogOutputs []string
+	// LogLevels override LogLevel for the plugins, by their registered name
+	LogLevels map[string]string
 }
 
 // Config ...
 type Config struct {
 	Common *CommonConfig
 	Stream *StreamConfig
+	// Facts is nil without facts table
+	Facts *FactsConfig
 
 	// global filter
 	Filter        *GlobalFilter
 	Outputs       map[string]*Output
 	Inputs        []*InputConfig
 	Chains        []*ChainConfig
+	Processors    []*ProcessorConfig
 	MetricOutputs []*MetricOutputConfig
 }
 
 // Conf ...
 var Conf = &Config{}
 
+// confMu serializes the switch of Conf by Reload with the pipeline: consume
+// holds it for reading while a batch goes through the plugins, so Reload
+// switches between two batches and stops the old plugins once no batch
+// uses them anymore
+var confMu sync.RWMutex
+
+// liveConf is Conf for the readers outside the pipeline, which can't hold
+// confMu: the alarm and event writes may run within consume
+var liveConf atomic.Value
+
+// setConf switches the pipeline to c, once the batches being consumed are
+// done.
+func setConf(c *Config) {
+	confMu.Lock()
+	Conf = c
+	liveConf.Store(c)
+	confMu.Unlock()
+}
+
+// currentConf returns Conf, it's safe during a reload.
+func currentConf() *Config {
+	if c, ok := liveConf.Load().(*Config); ok {
+		return c
+	}
+	return Conf
+}
+
 func LoadConfig() {
 	// init the new config params
 	initConf()
 
-	contents, err := ioutil.ReadFile("stream.toml")
-	if err != nil {
-		log.Fatal("[FATAL] load stream.toml: ", err)
-	}
-	tbl, err := toml.Parse(contents)
+	tbl, err := readConfig()
 	if err != nil {
-		log.Fatal("[FATAL] parse stream.toml: ", err)
+		log.Fatal("[FATAL] ", err)
 	}
 	// parse common config
-	parseCommon(tbl)
+	Conf.parseCommon(tbl)
 
 	// parse stream config
-	parseStream(tbl)
+	Conf.parseStream(tbl)
 	Conf.Stream.Show()
+
+	// parse host facts config
+	Conf.parseFacts(tbl)
+	if Conf.Facts != nil {
+		Conf.Facts.Show()
+	}
 	// init logger
 	initLogger()
 
+	if err := Conf.parsePlugins(tbl); err != nil {
+		log.Fatal("[FATAL] ", err)
+	}
+	liveConf.Store(Conf)
+	Conf.Show()
+}
+
+// readConfig reads and parses stream.toml
+func readConfig() (*ast.Table, error) {
+	contents, err := ioutil.ReadFile("stream.toml")
+	if err != nil {
+		return nil, fmt.Errorf("load stream.toml: %s", err)
+	}
+	tbl, err := toml.Parse(contents)
+	if err != nil {
+		return nil, fmt.Errorf("parse stream.toml: %s", err)
+	}
+	return tbl, nil
+}
+
+// parsePlugins parses the filters and all the plugins, it stops at the
+// first invalid one.
+func (c *Config) parsePlugins(tbl *ast.Table) error {
 	// parse global filters
-	parseFilters(tbl)
+	if err := c.parseFilters(tbl); err != nil {
+		return err
+	}
 
 	// init Inputers
-	parseInputs(tbl)
+	if err := c.parseInputs(tbl); err != nil {
+		return err
+	}
 
 	// init Outputs
-	parseOutputs(tbl)
+	if err := c.parseOutputs(tbl); err != nil {
+		return err
+	}
 
 	// init Chains
-	parseChains(tbl)
+	if err := c.parseChains(tbl); err != nil {
+		return err
+	}
+
+	// init Processors
+	if err := c.parseProcessors(tbl); err != nil {
+		return err
+	}
 
 	// init MetricOutputs
-	parseMetricOutputs(tbl)
+	return c.parseMetricOutputs(tbl)
+}
 
+// Show show the plugins
+func (c *Config) Show() {
 	log.Println("All inputs ------------------------")
-	for _, in := range Conf.Inputs {
+	for _, in := range c.Inputs {
 		log.Println(in.Name)
 	}
 
 	log.Println("All outpus ------------------------")
-	for _, out := range Conf.Outputs {
+	for _, out := range c.Outputs {
 		log.Println(out.Name)
 	}
 
 	log.Println("All chains ------------------------")
-	for _, out := range Conf.Chains {
+	for _, out := range c.Chains {
 		log.Println(out.Name)
 	}
 
+	log.Println("All processors ------------------------")
+	for _, p := range c.Processors {
+		log.Println(p.Name)
+	}
+
 	log.Println("All metric_outputs ------------------------")
-	for _, out := range Conf.MetricOutputs {
+	for _, out := range c.MetricOutputs {
 		log.Println(out.Name)
 	}
 }
 
 // initLogger init logger
 func initLogger() {
-	vlog.Init(Conf.Common.LogPath, Conf.Common.LogLevel, Conf.Common.IsDebug)
+	outputs := Conf.Common.LogOutputs
+	if len(outputs) == 0 {
+		outputs = []string{Conf.Common.LogPath}
+		if Conf.Common.IsDebug {
+			outputs = []string{"stdout"}
+		}
+	}
+
+	err := vlog.InitWithOptions(vlog.Options{
+		Level:    Conf.Common.LogLevel,
+		Encoding: Conf.Common.LogEncoding,
+		Outputs:  outputs,
+	})
+	if err != nil {
+		log.Fatalln("[FATAL] init logger: ", err)
+	}
 	VLogger = vlog.Logger
+
+	pluginLoggers = make(map[string]zap.Logger, len(Conf.Common.LogLevels))
+	for name, level := range Conf.Common.LogLevels {
+		logger, err := vlog.Named(name, level)
+		if err != nil {
+			log.Fatalln("[FATAL] init logger of ", name, ": ", err)
+		}
+		pluginLoggers[name] = logger
+	}
 	log.SetFlags(log.Lmicroseconds | log.Lshortfile | log.LstdFlags)
 }
 
+// pluginLoggers are the loggers of the plugins with their own log level,
+// set up with VLogger
+var pluginLoggers map[string]zap.Logger
+
+// PluginLogger returns the logger of the plugin registered as name, at its
+// level of the log_levels, or VLogger when it has none.
+func PluginLogger(name string) zap.Logger {
+	if logger, ok := pluginLoggers[name]; ok {
+		return logger
+	}
+	return VLogger
+}
+
 func initConf() {
-	Conf = &Config{
-		Common:  &CommonConfig{},
-		Stream:  &StreamConfig{},
+	Conf = newConfig()
+}
+
+func newConfig() *Config {
+	return &Config{
+		Common: &CommonConfig{},
+		Stream: &StreamConfig{
+			ShutdownTimeout: misc.Duration{Duration: 10 * time.Second},
+			StampZeroTimes:  true,
+		},
 		Outputs: make(map[string]*Output),
 		Inputs:  make([]*InputConfig, 0),
 		Chains:  make([]*ChainConfig, 0),
 	}
 }
 
-func (c *Config) AddInput(name string, iTbl *ast.Table) {
-	input, ok := Inputs[name]
+func (c *Config) AddInput(name string, iTbl *ast.Table) error {
+	registered, ok := Inputs[name]
 	if !ok {
-		log.Fatalf("[FATAL] no plugin %v available\n", name)
+		return fmt.Errorf("no plugin %v available", name)
+	}
+	input := newPlugin(registered).(Inputer)
+	signature := tableSignature(name, iTbl)
+
+	if pi, ok := input.(ParserInput); ok {
+		parser, err := buildParser(iTbl)
+		if err != nil {
+			return fmt.Errorf("build parser of input %s, %s", name, err)
+		}
+		pi.SetParser(parser)
 	}
 
 	inC, err := buildInput(name, iTbl)
 	if err != nil {
-		log.Fatalln("[FATAL] build input : ", err)
+		return fmt.Errorf("build input %s, %s", name, err)
 	}
 
 	err = toml.UnmarshalTable(iTbl, input)
 	if err != nil {
-		log.Fatalln("[FATAL] unmarshal input: ", err)
+		return fmt.Errorf("unmarshal input %s, %s", name, err)
 	}
 	inC.Input = input
+	inC.signature = signature
 
 	c.Inputs = append(c.Inputs, inC)
 	inC.Show()
+	return nil
 }
 
-func (c *Config) AddOutput(name string, iTbl *ast.Table) {
-	output, ok := Outputs[name]
+func (c *Config) AddOutput(name string, iTbl *ast.Table) error {
+	registered, ok := Outputs[name]
 	if !ok {
-		log.Fatalf("[FATAL] no output plugin %v available\n", name)
+		return fmt.Errorf("no output plugin %v available", name)
 	}
+	output := newPlugin(registered).(Outputer)
+	signature := tableSignature(name, iTbl)
 
 	outC, err := buildOutput(name, iTbl)
 	if err != nil {
-		log.Fatalln("[FATAL] build output : ", err)
+		return fmt.Errorf("build output %s, %s", name, err)
 	}
 
 	err = toml.UnmarshalTable(iTbl, output)
 	if err != nil {
-		log.Fatalln("[FATAL] unmarshal output: ", err)
+		return fmt.Errorf("unmarshal output %s, %s", name, err)
 	}
 	outC.Output = output
+	outC.signature = signature
 
 	c.Outputs[name] = outC
+	return nil
 }
 
-func (c *Config) AddChain(name string, iTbl *ast.Table) {
-	chain, ok := Chains[name]
+func (c *Config) AddChain(name string, iTbl *ast.Table) error {
+	registered, ok := Chains[name]
 	if !ok {
-		log.Fatalf("[FATAL] no plugin %v available\n", name)
+		return fmt.Errorf("no plugin %v available", name)
 	}
+	chain := newPlugin(registered).(Chainer)
+	signature := tableSignature(name, iTbl)
 
 	ccC, err := buildChain(name, iTbl)
 	if err != nil {
-		log.Fatalln("[FATAL] build chain : ", err)
+		return fmt.Errorf("build chain %s, %s", name, err)
 	}
 
 	err = toml.UnmarshalTable(iTbl, chain)
 	if err != nil {
-		log.Fatalln("[FATAL] unmarshal chain: ", err)
+		return fmt.Errorf("unmarshal chain %s, %s", name, err)
 	}
 	ccC.Chain = chain
+	ccC.signature = signature
 
 	c.Chains = append(c.Chains, ccC)
-
+	return nil
 }
 
-func (c *Config) AddMetricOutput(name string, iTbl *ast.Table) {
-	mo, ok := MetricOutputs[name]
-	if !ok {
-		log.Fatalf("[FATAL] no plugin %v available\n", name)
-	}
+func (c *Config) AddMetricOutput(name string, iTbl *ast.Table) error {
+	signature := tableSignature(name, iTbl)
 
 	mcC, err := buildMetricOutput(name, iTbl)
 	if err != nil {
-		log.Fatalln("[FATAL] build MetricOutputs : ", err)
+		return fmt.Errorf("build metric output %s, %s", name, err)
 	}
 
-	err = toml.UnmarshalTable(iTbl, mo)
+	mcC.failovers, err = buildFailovers(iTbl, mcC)
 	if err != nil {
-		log.Fatalln("[FATAL] unmarshal MetricOutputs: ", err)
+		return fmt.Errorf("build metric output %s, %s", name, err)
+	}
+
+	mo, err := newMetricOutput(name, iTbl, mcC)
+	if err != nil {
+		return fmt.Errorf("metric output %s, %s", name, err)
 	}
 	mcC.MetricOutput = mo
+	mcC.signature = signature
+	mcC.instance = c.outputInstance(mcC)
 
 	c.MetricOutputs = append(c.MetricOutputs, mcC)
+	return nil
+}
 
+// outputInstance names the metric output in the internal stats: its alias,
+// else the plugin name, followed by the rank of the output among the
+// instances of the plugin from the second one.
+func (c *Config) outputInstance(mc *MetricOutputConfig) string {
+	if mc.Alias != "" {
+		return mc.Alias
+	}
+	n := 1
+	for _, other := range c.MetricOutputs {
+		if other.Name == mc.Name && other.Alias == "" {
+			n++
+		}
+	}
+	if n == 1 {
+		return mc.Name
+	}
+	return fmt.Sprintf("%s_%d", mc.Name, n)
+}
+
+func (c *Config) AddProcessor(name string, iTbl *ast.Table) error {
+	creator, ok := Processors[name]
+	if !ok {
+		return fmt.Errorf("no processor %v available", name)
+	}
+	processor := creator()
+
+	pcC, err := buildProcessor(name, iTbl)
+	if err != nil {
+		return fmt.Errorf("build processor %s, %s", name, err)
+	}
+
+	err = toml.UnmarshalTable(iTbl, processor)
+	if err != nil {
+		return fmt.Errorf("unmarshal processor %s, %s", name, err)
+	}
+
+	if err := processor.Init(); err != nil {
+		return fmt.Errorf("init processor %s, %s", name, err)
+	}
+	pcC.Processor = processor
+
+	c.Processors = append(c.Processors, pcC)
+	return nil
+}
+
+// newPlugin returns a copy of the registered plugin, so every table of the
+// config gets its own instance, starting from the registered defaults.
+func newPlugin(registered interface{}) interface{} {
+	v := reflect.ValueOf(registered)
+	if v.Kind() != reflect.Ptr {
+		return registered
+	}
+	p := reflect.New(v.Elem().Type())
+	p.Elem().Set(v.Elem())
+	return p.Interface()
 }
@@ -1,62 +1,70 @@
 package service
 
 import (
+	"fmt"
 	"log"
+	"sort"
+	"time"
 
 	"github.com/naoina/toml"
 	"github.com/naoina/toml/ast"
 	"github.com/uber-go/zap"
 )
 
-func parseOutputs(tbl *ast.Table) {
+func (c *Config) parseOutputs(tbl *ast.Table) error {
 	if val, ok := tbl.Fields["outputs"]; ok {
 		subTbl, _ := val.(*ast.Table)
 		for pn, pt := range subTbl.Fields {
 			switch iTbl := pt.(type) {
 			case *ast.Table:
-				Conf.AddOutput(pn, iTbl)
+				if err := c.AddOutput(pn, iTbl); err != nil {
+					return err
+				}
 			case []*ast.Table:
 				for _, t := range iTbl {
-					Conf.AddOutput(pn, t)
+					if err := c.AddOutput(pn, t); err != nil {
+						return err
+					}
 				}
 			default:
-				log.Fatalln("[FATAL] inputs parse error: ", iTbl)
+				return fmt.Errorf("outputs parse error: %v", iTbl)
 			}
 		}
 	}
+	return nil
 }
 
-func parseCommon(tbl *ast.Table) {
+func (c *Config) parseCommon(tbl *ast.Table) {
 	if val, ok := tbl.Fields["common"]; ok {
 		subTbl, ok := val.(*ast.Table)
 		if !ok {
 			log.Fatalln("[FATAL] : ", subTbl)
 		}
 
-		err := toml.UnmarshalTable(subTbl, Conf.Common)
+		err := toml.UnmarshalTable(subTbl, c.Common)
 		if err != nil {
 			log.Fatalln("[FATAL] parseCommon: ", err, subTbl)
 		}
 	}
 }
 
-func parseStream(tbl *ast.Table) {
+func (c *Config) parseStream(tbl *ast.Table) {
 	if val, ok := tbl.Fields["stream"]; ok {
 		subTbl, ok := val.(*ast.Table)
 		if !ok {
 			log.Fatalln("[FATAL] : ", subTbl)
 		}
 
-		err := toml.UnmarshalTable(subTbl, Conf.Stream)
+		err := toml.UnmarshalTable(subTbl, c.Stream)
 		if err != nil {
 			log.Fatalln("[FATAL] parseStream: ", err, subTbl)
 		}
 	}
 }
 
-func parseFilters(tbl *ast.Table) {
+func (c *Config) parseFilters(tbl *ast.Table) error {
 	// parse input plugin drop
-	Conf.Filter = &GlobalFilter{}
+	c.Filter = &GlobalFilter{}
 	if val, ok := tbl.Fields["global_filters"]; ok {
 		if subTbl, ok := val.(*ast.Table); ok {
 			if node, ok := subTbl.Fields["inputdrop"]; ok {
@@ -64,7 +72,7 @@ func parseFilters(tbl *ast.Table) {
 					if ary, ok := kv.Value.(*ast.Array); ok {
 						for _, elem := range ary.Value {
 							if str, ok := elem.(*ast.String); ok {
-								Conf.Filter.InputDrop = append(Conf.Filter.InputDrop, str.Value)
+								c.Filter.InputDrop = append(c.Filter.InputDrop, str.Value)
 							}
 						}
 					}
@@ -73,12 +81,12 @@ func parseFilters(tbl *ast.Table) {
 		}
 	}
 
-	inputDrop, err := CompileFilter(Conf.Filter.InputDrop)
+	inputDrop, err := CompileFilter(c.Filter.InputDrop)
 	if err != nil {
-		log.Fatalf("Error compiling 'inputdrop', %s\n", err)
+		return fmt.Errorf("compiling 'inputdrop', %s", err)
 	}
 
-	Conf.Filter.inputDrop = inputDrop
+	c.Filter.inputDrop = inputDrop
 
 	// parse output plugin drop
 	if val, ok := tbl.Fields["global_filters"]; ok {
@@ -88,7 +96,7 @@ func parseFilters(tbl *ast.Table) {
 					if ary, ok := kv.Value.(*ast.Array); ok {
 						for _, elem := range ary.Value {
 							if str, ok := elem.(*ast.String); ok {
-								Conf.Filter.AlarmDrop = append(Conf.Filter.AlarmDrop, str.Value)
+								c.Filter.AlarmDrop = append(c.Filter.AlarmDrop, str.Value)
 							}
 						}
 					}
@@ -97,12 +105,12 @@ func parseFilters(tbl *ast.Table) {
 		}
 	}
 
-	alarmDrop, err := CompileFilter(Conf.Filter.AlarmDrop)
+	alarmDrop, err := CompileFilter(c.Filter.AlarmDrop)
 	if err != nil {
-		log.Fatalf("Error compiling 'alarmdrop', %s\n", err)
+		return fmt.Errorf("compiling 'alarmdrop', %s", err)
 	}
 
-	Conf.Filter.alarmDrop = alarmDrop
+	c.Filter.alarmDrop = alarmDrop
 
 	// parse output plugin drop
 	if val, ok := tbl.Fields["global_filters"]; ok {
@@ -112,7 +120,7 @@ func parseFilters(tbl *ast.Table) {
 					if ary, ok := kv.Value.(*ast.Array); ok {
 						for _, elem := range ary.Value {
 							if str, ok := elem.(*ast.String); ok {
-								Conf.Filter.Metric_OutputDrop = append(Conf.Filter.Metric_OutputDrop, str.Value)
+								c.Filter.Metric_OutputDrop = append(c.Filter.Metric_OutputDrop, str.Value)
 							}
 						}
 					}
@@ -121,12 +129,12 @@ func parseFilters(tbl *ast.Table) {
 		}
 	}
 
-	metric_OutputDrop, err := CompileFilter(Conf.Filter.Metric_OutputDrop)
+	metric_OutputDrop, err := CompileFilter(c.Filter.Metric_OutputDrop)
 	if err != nil {
-		log.Fatalf("Error compiling 'metric_outputdrop', %s\n", err)
+		return fmt.Errorf("compiling 'metric_outputdrop', %s", err)
 	}
 
-	Conf.Filter.metric_OutputDrop = metric_OutputDrop
+	c.Filter.metric_OutputDrop = metric_OutputDrop
 
 	// parse output plugin drop
 	if val, ok := tbl.Fields["global_filters"]; ok {
@@ -136,7 +144,7 @@ func parseFilters(tbl *ast.Table) {
 					if ary, ok := kv.Value.(*ast.Array); ok {
 						for _, elem := range ary.Value {
 							if str, ok := elem.(*ast.String); ok {
-								Conf.Filter.ChainDrop = append(Conf.Filter.ChainDrop, str.Value)
+								c.Filter.ChainDrop = append(c.Filter.ChainDrop, str.Value)
 							}
 						}
 					}
@@ -145,38 +153,44 @@ func parseFilters(tbl *ast.Table) {
 		}
 	}
 
-	chainDrop, err := CompileFilter(Conf.Filter.ChainDrop)
+	chainDrop, err := CompileFilter(c.Filter.ChainDrop)
 	if err != nil {
-		log.Fatalf("Error compiling 'chainDrop', %s\n", err)
+		return fmt.Errorf("compiling 'chainDrop', %s", err)
 	}
 
-	Conf.Filter.chainDrop = chainDrop
+	c.Filter.chainDrop = chainDrop
+	return nil
 }
 
-func parseInputs(tbl *ast.Table) {
+func (c *Config) parseInputs(tbl *ast.Table) error {
 	if val, ok := tbl.Fields["inputs"]; ok {
 		subTbl, _ := val.(*ast.Table)
 		for pn, pt := range subTbl.Fields {
 			// filter the inputs,drop the ones in global_filters
-			if !Conf.Filter.ShouldInputPass(pn) {
+			if !c.Filter.ShouldInputPass(pn) {
 				continue
 			}
 
 			switch iTbl := pt.(type) {
 			case *ast.Table:
-				Conf.AddInput(pn, iTbl)
+				if err := c.AddInput(pn, iTbl); err != nil {
+					return err
+				}
 				VLogger.Info("config", zap.String("inputer", pn))
 			case []*ast.Table:
 				for _, t := range iTbl {
-					Conf.AddInput(pn, t)
+					if err := c.AddInput(pn, t); err != nil {
+						return err
+					}
 					VLogger.Info("config", zap.String("inputer", t.Name))
 				}
 
 			default:
-				log.Fatalln("[FATAL] inputs parse error: ", iTbl)
+				return fmt.Errorf("inputs parse error: %v", iTbl)
 			}
 		}
 	}
+	return nil
 }
 
 // func parseAlarms(tbl *ast.Table) {
@@ -205,54 +219,154 @@ func parseInputs(tbl *ast.Table) {
 // 	}
 // }
 
-func parseChains(tbl *ast.Table) {
+func (c *Config) parseChains(tbl *ast.Table) error {
 	if val, ok := tbl.Fields["chains"]; ok {
 		subTbl, _ := val.(*ast.Table)
 		for pn, pt := range subTbl.Fields {
 			// filter the chains,drop the ones in global_filters
-			if !Conf.Filter.ShouldChainDropPass(pn) {
+			if !c.Filter.ShouldChainDropPass(pn) {
 				continue
 			}
 
 			switch iTbl := pt.(type) {
 			case *ast.Table:
-				Conf.AddChain(pn, iTbl)
+				if err := c.AddChain(pn, iTbl); err != nil {
+					return err
+				}
 				VLogger.Info("config", zap.String("chainser", pn))
 			case []*ast.Table:
 				for _, t := range iTbl {
-					Conf.AddChain(pn, t)
+					if err := c.AddChain(pn, t); err != nil {
+						return err
+					}
 					VLogger.Info("config", zap.String("chainser", t.Name))
 				}
 
 			default:
-				log.Fatalln("[FATAL] chains parse error: ", iTbl)
+				return fmt.Errorf("chains parse error: %v", iTbl)
 			}
 		}
 	}
+	return nil
 }
 
-func parseMetricOutputs(tbl *ast.Table) {
+func (c *Config) parseProcessors(tbl *ast.Table) error {
+	if val, ok := tbl.Fields["processors"]; ok {
+		subTbl, _ := val.(*ast.Table)
+		for pn, pt := range subTbl.Fields {
+			switch iTbl := pt.(type) {
+			case *ast.Table:
+				if err := c.AddProcessor(pn, iTbl); err != nil {
+					return err
+				}
+				VLogger.Info("config", zap.String("processor", pn))
+			case []*ast.Table:
+				for _, t := range iTbl {
+					if err := c.AddProcessor(pn, t); err != nil {
+						return err
+					}
+					VLogger.Info("config", zap.String("processor", t.Name))
+				}
+
+			default:
+				return fmt.Errorf("processors parse error: %v", iTbl)
+			}
+		}
+		// the tables are in a map, restore the order of the config file
+		sort.Sort(byLine(c.Processors))
+	}
+	return c.parsePipeline(tbl)
+}
+
+func (c *Config) parseMetricOutputs(tbl *ast.Table) error {
 	if val, ok := tbl.Fields["metric_outputs"]; ok {
 		subTbl, _ := val.(*ast.Table)
 		for pn, pt := range subTbl.Fields {
 			// filter the metric_outputs,drop the ones in global_filters
-			if !Conf.Filter.ShouldMetric_OutputDropPass(pn) {
+			if !c.Filter.ShouldMetric_OutputDropPass(pn) {
 				continue
 			}
 
 			switch iTbl := pt.(type) {
 			case *ast.Table:
-				Conf.AddMetricOutput(pn, iTbl)
+				if err := c.AddMetricOutput(pn, iTbl); err != nil {
+					return err
+				}
 				VLogger.Info("config", zap.String("metric_outputer", pn))
 			case []*ast.Table:
 				for _, t := range iTbl {
-					Conf.AddMetricOutput(pn, t)
+					if err := c.AddMetricOutput(pn, t); err != nil {
+						return err
+					}
 					VLogger.Info("config", zap.String("metric_outputer", t.Name))
 				}
 
 			default:
-				log.Fatalln("[FATAL] metric_outputs parse error: ", iTbl)
+				return fmt.Errorf("metric_outputs parse error: %v", iTbl)
 			}
 		}
 	}
+	return nil
+}
+
+// tableInt reads and removes an integer option from the plugin table, so
+// that it isn't unmarshaled into the plugin.
+func tableInt(tbl *ast.Table, key string) (int64, bool, error) {
+	node, ok := tbl.Fields[key]
+	if !ok {
+		return 0, false, nil
+	}
+	delete(tbl.Fields, key)
+
+	if kv, ok := node.(*ast.KeyValue); ok {
+		if integer, ok := kv.Value.(*ast.Integer); ok {
+			i, err := integer.Int()
+			return i, err == nil, err
+		}
+	}
+	return 0, false, fmt.Errorf("%s must be an integer", key)
+}
+
+// tableString reads and removes a string option from the plugin table.
+func tableString(tbl *ast.Table, key string) (string, bool, error) {
+	node, ok := tbl.Fields[key]
+	if !ok {
+		return "", false, nil
+	}
+	delete(tbl.Fields, key)
+
+	if kv, ok := node.(*ast.KeyValue); ok {
+		if str, ok := kv.Value.(*ast.String); ok {
+			return str.Value, true, nil
+		}
+	}
+	return "", false, fmt.Errorf("%s must be a string", key)
+}
+
+// tableBool reads and removes a boolean option from the plugin table.
+func tableBool(tbl *ast.Table, key string) (bool, bool, error) {
+	node, ok := tbl.Fields[key]
+	if !ok {
+		return false, false, nil
+	}
+	delete(tbl.Fields, key)
+
+	if kv, ok := node.(*ast.KeyValue); ok {
+		if b, ok := kv.Value.(*ast.Boolean); ok {
+			v, err := b.Boolean()
+			return v, err == nil, err
+		}
+	}
+	return false, false, fmt.Errorf("%s must be a boolean", key)
+}
+
+// tableDuration reads and removes a duration option like "10s" from the
+// plugin table.
+func tableDuration(tbl *ast.Table, key string) (time.Duration, bool, error) {
+	s, ok, err := tableString(tbl, key)
+	if !ok {
+		return 0, false, err
+	}
+	d, err := time.ParseDuration(s)
+	return d, err == nil, err
 }
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPluginLogger(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "vgo.log")
+
+	old, logger := currentConf(), VLogger
+	defer func() {
+		setConf(old)
+		VLogger = logger
+		pluginLoggers = nil
+	}()
+	c := newConfig()
+	c.Common = &CommonConfig{
+		LogLevel:   "info",
+		LogOutputs: []string{path},
+		LogLevels:  map[string]string{"kafka": "debug", "influxdb": "error"},
+	}
+	setConf(c)
+	initLogger()
+
+	// each plugin at its own level, the others at the common one
+	PluginLogger("kafka").Debug("kafka debug")
+	PluginLogger("influxdb").Warn("influxdb warn")
+	PluginLogger("influxdb").Error("influxdb error")
+	PluginLogger("amqp").Debug("amqp debug")
+	PluginLogger("amqp").Info("amqp info")
+	VLogger.Debug("vgo debug")
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := strings.Split(strings.TrimSpace(string(b)), "\n")
+	want := []string{"kafka debug", "influxdb error", "amqp info"}
+	if len(logged) != len(want) {
+		t.Fatalf("got lines %v, want %v", logged, want)
+	}
+	for i, msg := range want {
+		if !strings.Contains(logged[i], msg) {
+			t.Errorf("got line %s, want %s", logged[i], msg)
+		}
+	}
+	if !strings.Contains(logged[0], `"plugin":"kafka"`) || strings.Contains(logged[2], `"plugin"`) {
+		t.Errorf("got lines %v, want the plugin named by its logger only", logged)
+	}
+	if PluginLogger("amqp") != VLogger {
+		t.Error("plugin without log level doesn't log with VLogger")
+	}
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// hungOutput is a metric output whose writes hang until their context is
+// done
+type hungOutput struct {
+	mockOutput
+	started chan struct{}
+}
+
+func (o *hungOutput) ComputeContext(ctx context.Context, m Metrics) error {
+	o.started <- struct{}{}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestWriteTimeout(t *testing.T) {
+	mo := &hungOutput{started: make(chan struct{}, 1)}
+	mc := &MetricOutputConfig{MetricOutput: mo, WriteTimeout: 50 * time.Millisecond}
+	defer startOutput(mc)()
+
+	start := time.Now()
+	mc.Compute(Metrics{Data: testMetrics(10)})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("write aborted after %s, the timeout is 50ms", elapsed)
+	}
+	// kept for a retry
+	if n := mc.retry.Len(); n != 10 {
+		t.Errorf("%d metrics kept for a retry, want 10", n)
+	}
+	if mc.Healthy() {
+		t.Error("output healthy after a write timeout")
+	}
+}
+
+func TestAbort(t *testing.T) {
+	mo := &hungOutput{started: make(chan struct{}, 1)}
+	mc := &MetricOutputConfig{MetricOutput: mo}
+	defer startOutput(mc)()
+
+	done := make(chan struct{})
+	go func() {
+		mc.Compute(Metrics{Data: testMetrics(10)})
+		close(done)
+	}()
+	<-mo.started
+	mc.Abort()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("write not aborted")
+	}
+}
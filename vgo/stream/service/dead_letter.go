@@ -0,0 +1,164 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corego/vgo/mecury/misc"
+	"github.com/uber-go/zap"
+)
+
+// replayBatchSize is the number of metrics computed at once by ReplayDeadLetter
+const replayBatchSize = 1000
+
+// DeadLetter appends the metrics an output failed to deliver to a local file,
+// in line protocol. Every group of metrics is preceded by a header line:
+//
+//   # 2016-12-01T10:00:00Z <failure reason>
+//
+// When the file grows over maxSize it is rotated to <path>.1
+type DeadLetter struct {
+	sync.Mutex
+	path    string
+	maxSize int64
+
+	file *os.File
+	size int64
+}
+
+// NewDeadLetter returns a DeadLetter writing to path, maxSize 0 disables the rotation.
+func NewDeadLetter(path string, maxSize int64) *DeadLetter {
+	return &DeadLetter{
+		path:    path,
+		maxSize: maxSize,
+	}
+}
+
+// Write appends the metrics with a header recording the reason and the time.
+func (d *DeadLetter) Write(reason error, metrics []*MetricData) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if err := d.open(); err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(d.file)
+	n, _ := fmt.Fprintf(w, "# %s %s\n", time.Now().UTC().Format(time.RFC3339),
+		strings.Replace(fmt.Sprint(reason), "\n", " ", -1))
+	d.size += int64(n)
+
+	for _, m := range metrics {
+		pt, err := misc.NewPoint(m.Name, m.Tags, m.Fields, m.Time)
+		if err != nil {
+			VLogger.Error("dead letter", zap.String("metric", m.Name), zap.Error(err))
+			continue
+		}
+		n, _ := w.WriteString(pt.String() + "\n")
+		d.size += int64(n)
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if d.maxSize > 0 && d.size >= d.maxSize {
+		return d.rotate()
+	}
+	return nil
+}
+
+func (d *DeadLetter) open() error {
+	if d.file != nil {
+		return nil
+	}
+
+	f, err := os.OpenFile(d.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	d.file = f
+	d.size = fi.Size()
+	return nil
+}
+
+func (d *DeadLetter) rotate() error {
+	d.file.Close()
+	d.file = nil
+	return os.Rename(d.path, d.path+".1")
+}
+
+// Close closes the dead letter file.
+func (d *DeadLetter) Close() error {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
+
+// ReplayDeadLetter reads back a dead letter file and computes its metrics
+// with the given output.
+func ReplayDeadLetter(path string, mo MetricOutputer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	batch := Metrics{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		points, err := misc.ParsePointsString(line)
+		if err != nil {
+			VLogger.Error("dead letter replay", zap.String("line", line), zap.Error(err))
+			continue
+		}
+		for _, pt := range points {
+			batch.Data = append(batch.Data, &MetricData{
+				Name:   pt.Name(),
+				Tags:   pt.Tags(),
+				Fields: pt.Fields(),
+				Time:   pt.Time(),
+			})
+		}
+
+		if len(batch.Data) >= replayBatchSize {
+			if err := mo.Compute(batch); err != nil {
+				return err
+			}
+			batch = Metrics{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if len(batch.Data) > 0 {
+		return mo.Compute(batch)
+	}
+	return nil
+}
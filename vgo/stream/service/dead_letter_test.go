@@ -0,0 +1,171 @@
+package service
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/naoina/toml"
+)
+
+// sameMetric reports whether the metrics have the same name, tags, fields
+// and time.
+func sameMetric(a, b *MetricData) bool {
+	return a.Name == b.Name &&
+		reflect.DeepEqual(a.Tags, b.Tags) &&
+		reflect.DeepEqual(a.Fields, b.Fields) &&
+		a.Time.Equal(b.Time)
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "vgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestDeadLetterRoundTrip(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "dead_letter")
+
+	metrics := []*MetricData{
+		{
+			Name:   "cpu",
+			Tags:   map[string]string{"host": "server01", "region": "us west"},
+			Fields: map[string]interface{}{"idle": 98.5, "count": int64(3), "state": "ok", "up": true},
+			Time:   time.Unix(1500000000, 123456789),
+		},
+		{
+			Name:   "mem",
+			Tags:   map[string]string{"host": "server02"},
+			Fields: map[string]interface{}{"used": 1.5},
+			Time:   time.Unix(1500000001, 0),
+		},
+	}
+
+	d := NewDeadLetter(path, 0)
+	if err := d.Write(errors.New("connection refused\nretry later"), metrics); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want a header and 2 metrics:\n%s", len(lines), b)
+	}
+	if !strings.HasPrefix(lines[0], "# ") || !strings.HasSuffix(lines[0], " connection refused retry later") {
+		t.Errorf("bad header %q", lines[0])
+	}
+
+	mo := &mockOutput{}
+	if err := ReplayDeadLetter(path, mo); err != nil {
+		t.Fatal(err)
+	}
+	if len(mo.metrics) != len(metrics) {
+		t.Fatalf("replayed %d metrics, want %d", len(mo.metrics), len(metrics))
+	}
+	for i, m := range metrics {
+		if !sameMetric(mo.metrics[i], m) {
+			t.Errorf("metric %d replayed as %+v, want %+v", i, mo.metrics[i], m)
+		}
+	}
+}
+
+func TestDeadLetterRotate(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "dead_letter")
+
+	d := NewDeadLetter(path, 100)
+	defer d.Close()
+	if err := d.Write(errors.New("first"), testMetrics(5)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Fatalf("file not rotated past its max size, %s", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("file still there after the rotation, %v", err)
+	}
+
+	if err := d.Write(errors.New("second"), testMetrics(1)); err != nil {
+		t.Fatal(err)
+	}
+	mo := &mockOutput{}
+	if err := ReplayDeadLetter(path, mo); err != nil {
+		t.Fatal(err)
+	}
+	if len(mo.metrics) != 1 {
+		t.Errorf("replayed %d metrics after the rotation, want 1", len(mo.metrics))
+	}
+}
+
+func TestMetricOutputDeadLetter(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "dead_letter")
+
+	mo := &mockOutput{fail: true}
+	mc := &MetricOutputConfig{
+		MetricOutput:      mo,
+		MetricBufferLimit: 2,
+		DeadLetterFile:    path,
+	}
+	defer startOutput(mc)()
+
+	metrics := testMetrics(5)
+	mc.Compute(Metrics{Data: metrics})
+	if n := mc.retry.Len(); n != 2 {
+		t.Fatalf("retry buffer holds %d metrics, want 2", n)
+	}
+	if err := mc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the oldest metrics overflowed the retry buffer
+	replayed := &mockOutput{}
+	if err := ReplayDeadLetter(path, replayed); err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed.metrics) != 3 {
+		t.Fatalf("replayed %d metrics, want 3", len(replayed.metrics))
+	}
+	for i, m := range metrics[:3] {
+		if !sameMetric(replayed.metrics[i], m) {
+			t.Errorf("metric %d replayed as %+v, want %+v", i, replayed.metrics[i], m)
+		}
+	}
+}
+
+func TestMetricBufferLimit(t *testing.T) {
+	for _, tt := range []struct {
+		conf string
+		err  bool
+	}{
+		{"metric_buffer_limit = 1", false},
+		{"metric_buffer_limit = 0", true},
+		{"metric_buffer_limit = -5", true},
+	} {
+		tbl, err := toml.Parse([]byte(tt.conf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = buildMetricOutput("test", tbl)
+		if (err != nil) != tt.err {
+			t.Errorf("%s, got error %v", tt.conf, err)
+		}
+	}
+}
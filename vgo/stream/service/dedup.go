@@ -0,0 +1,24 @@
+package service
+
+// dedupPoints returns the metrics with a single metric for the points of the
+// same name, tags and time, the first one or with last the last one, in the
+// place of the first one. The InfluxDB like backends overwrite such points
+// anyway, the duplicates only cost bandwidth. The metrics are shared by the
+// outputs, the deduplicated ones are a new slice.
+func dedupPoints(metrics []*MetricData, last bool) []*MetricData {
+	out := make([]*MetricData, 0, len(metrics))
+	seen := make(map[string]int, len(metrics))
+
+	for _, m := range metrics {
+		key := m.PointKey(m.Time)
+		if i, ok := seen[key]; ok {
+			if last {
+				out[i] = m
+			}
+			continue
+		}
+		seen[key] = len(out)
+		out = append(out, m)
+	}
+	return out
+}
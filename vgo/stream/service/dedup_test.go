@@ -0,0 +1,105 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/naoina/toml"
+)
+
+// point returns a cpu metric of the host at the second, its value tells the
+// duplicates apart.
+func point(host string, sec int64, value float64) *MetricData {
+	return &MetricData{
+		Name:   "cpu",
+		Tags:   map[string]string{"host": host, "region": "eu"},
+		Fields: map[string]interface{}{"value": value},
+		Time:   time.Unix(sec, 0),
+	}
+}
+
+func points(metrics []*MetricData) string {
+	var l []string
+	for _, m := range metrics {
+		l = append(l, fmt.Sprintf("%s@%d=%v", m.Tags["host"], m.Time.Unix(), m.Fields["value"]))
+	}
+	return strings.Join(l, " ")
+}
+
+func TestDedupPoints(t *testing.T) {
+	batch := []*MetricData{
+		point("a", 1, 1),
+		point("b", 1, 2),
+		point("a", 1, 3),
+		point("a", 2, 4),
+		point("a", 1, 5),
+		point("b", 1, 6),
+	}
+	// another measurement, other tags
+	mem := point("a", 1, 7)
+	mem.Name = "mem"
+	other := point("a", 1, 8)
+	other.Tags = map[string]string{"host": "a"}
+	batch = append(batch, mem, other)
+
+	// the survivor takes the place of the first duplicate
+	if got := points(dedupPoints(batch, false)); got != "a@1=1 b@1=2 a@2=4 a@1=7 a@1=8" {
+		t.Errorf("first, got %s", got)
+	}
+	if got := points(dedupPoints(batch, true)); got != "a@1=5 b@1=6 a@2=4 a@1=7 a@1=8" {
+		t.Errorf("last, got %s", got)
+	}
+	// the batch is shared by the outputs
+	if got := points(batch[:3]); got != "a@1=1 b@1=2 a@1=3" {
+		t.Errorf("got batch %s, want it unchanged", got)
+	}
+}
+
+func TestDedupOutput(t *testing.T) {
+	resetStats()
+	for _, tt := range []struct {
+		dedup string
+		want  string
+	}{
+		{"", "a@1=1 a@1=2 b@1=3 a@1=4"},
+		{"first", "a@1=1 b@1=3"},
+		{"last", "a@1=4 b@1=3"},
+	} {
+		mo := &mockOutput{}
+		mc := &MetricOutputConfig{MetricOutput: mo, DedupPoints: tt.dedup, Name: "dedup_" + tt.dedup}
+		stop := startOutput(mc)
+		mc.dispatch(Metrics{Data: []*MetricData{point("a", 1, 1), point("a", 1, 2), point("b", 1, 3), point("a", 1, 4)}})
+		stop()
+
+		if got := points(mo.metrics); got != tt.want {
+			t.Errorf("dedup_points %q, got %s, want %s", tt.dedup, got, tt.want)
+		}
+		// the count of written metrics is reduced
+		if written := mc.stats.fields()["metrics_written"]; written != int64(strings.Count(tt.want, "@")) {
+			t.Errorf("dedup_points %q, got %v metrics written", tt.dedup, written)
+		}
+	}
+}
+
+func TestDedupConfig(t *testing.T) {
+	for _, tt := range []struct {
+		conf string
+		err  bool
+	}{
+		{`dedup_points = "first"`, false},
+		{`dedup_points = "last"`, false},
+		{`dedup_points = ""`, false},
+		{`dedup_points = "any"`, true},
+	} {
+		tbl, err := toml.Parse([]byte(tt.conf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = buildMetricOutput("test", tbl)
+		if (err != nil) != tt.err {
+			t.Errorf("%s, got error %v", tt.conf, err)
+		}
+	}
+}
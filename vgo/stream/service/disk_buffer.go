@@ -0,0 +1,268 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"sync"
+	"time"
+
+	"github.com/uber-go/zap"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DiskBuffer is a MetricBuffer kept in a bucket of a bolt database, so the
+// metrics survive a restart and are written with the first write after it.
+// Like Buffer, the oldest metrics are dropped past its size. The metrics of
+// a batch stay in the database until they're acknowledged, so a crash
+// during their write doesn't lose them.
+type DiskBuffer struct {
+	sync.Mutex
+	db     *bolt.DB
+	bucket []byte
+	size   int
+	// len is the number of metrics stored, but the ones of the batches
+	len int
+	// inflight are the keys of the metrics of the batches, until they're
+	// acknowledged
+	inflight map[*MetricData][]byte
+	taken    map[string]bool
+}
+
+// OpenBufferDB opens the bolt database of the disk buffers of an output.
+func OpenBufferDB(path string) (*bolt.DB, error) {
+	return bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+}
+
+// NewDiskBuffer returns the DiskBuffer of the bucket, holding the metrics
+// kept before the restart. When size is smaller than before, the oldest
+// metrics are dropped.
+func NewDiskBuffer(db *bolt.DB, bucket string, size int) (*DiskBuffer, error) {
+	b := &DiskBuffer{
+		db:       db,
+		bucket:   []byte(bucket),
+		size:     size,
+		inflight: make(map[*MetricData][]byte),
+		taken:    make(map[string]bool),
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists(b.bucket)
+		if err != nil {
+			return err
+		}
+		b.len = bk.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if b.len > size {
+		dropped := b.drop(b.len - size)
+		VLogger.Warn("disk buffer larger than its size, oldest metrics dropped", zap.String("bucket", bucket), zap.Int("count", len(dropped)))
+	}
+	return b, nil
+}
+
+// IsEmpty returns true if the DiskBuffer is empty.
+func (b *DiskBuffer) IsEmpty() bool {
+	return b.Len() == 0
+}
+
+// Len returns the number of metrics of the DiskBuffer.
+func (b *DiskBuffer) Len() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.len
+}
+
+// Add stores the metrics, it returns the oldest metrics dropped to make room
+// for the new ones. When the database can't be written all the metrics are
+// returned as dropped.
+func (b *DiskBuffer) Add(metrics ...*MetricData) []*MetricData {
+	b.Lock()
+	defer b.Unlock()
+
+	var dropped []*MetricData
+	n := b.len
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(b.bucket)
+		for _, m := range metrics {
+			v, err := encodeMetric(m)
+			if err != nil {
+				VLogger.Error("disk buffer encode", zap.String("name", m.Name), zap.Error(err))
+				dropped = append(dropped, m)
+				continue
+			}
+			seq, err := bk.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err := bk.Put(bufferKey(seq), v); err != nil {
+				return err
+			}
+			n++
+		}
+
+		if n <= b.size {
+			return nil
+		}
+		oldest, keys, bad, err := b.oldest(bk, n-b.size)
+		if err != nil {
+			return err
+		}
+		if err := deleteKeys(bk, keys); err != nil {
+			return err
+		}
+		n -= len(keys) + bad
+		dropped = append(dropped, oldest...)
+		return nil
+	})
+	if err != nil {
+		VLogger.Error("disk buffer write", zap.String("bucket", string(b.bucket)), zap.Error(err))
+		return metrics
+	}
+
+	b.len = n
+	return dropped
+}
+
+// Batch returns the batchSize oldest metrics, or all of them when there are
+// less. They're removed from the buffer but stay in the database until Ack.
+func (b *DiskBuffer) Batch(batchSize int) []*MetricData {
+	b.Lock()
+	defer b.Unlock()
+
+	var out []*MetricData
+	var keys [][]byte
+	var bad int
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		out, keys, bad, err = b.oldest(tx.Bucket(b.bucket), batchSize)
+		return err
+	})
+	if err != nil {
+		VLogger.Error("disk buffer read", zap.String("bucket", string(b.bucket)), zap.Error(err))
+		return nil
+	}
+
+	for i, m := range out {
+		b.inflight[m] = keys[i]
+		b.taken[string(keys[i])] = true
+	}
+	b.len -= len(out) + bad
+	if b.len < 0 {
+		b.len = 0
+	}
+	return out
+}
+
+// Ack removes from the database the metrics of the batches, once they're
+// written or kept elsewhere. The other metrics are ignored.
+func (b *DiskBuffer) Ack(metrics []*MetricData) {
+	b.Lock()
+	defer b.Unlock()
+
+	var keys [][]byte
+	for _, m := range metrics {
+		if k, ok := b.inflight[m]; ok {
+			keys = append(keys, k)
+			delete(b.inflight, m)
+			delete(b.taken, string(k))
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return deleteKeys(tx.Bucket(b.bucket), keys)
+	})
+	if err != nil {
+		VLogger.Error("disk buffer ack", zap.String("bucket", string(b.bucket)), zap.Error(err))
+	}
+}
+
+// drop removes the n oldest metrics at once, it returns them.
+func (b *DiskBuffer) drop(n int) []*MetricData {
+	var out []*MetricData
+	var removed int
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(b.bucket)
+		var keys [][]byte
+		var bad int
+		var err error
+		if out, keys, bad, err = b.oldest(bk, n); err != nil {
+			return err
+		}
+		removed = len(keys) + bad
+		return deleteKeys(bk, keys)
+	})
+	if err != nil {
+		VLogger.Error("disk buffer drop", zap.String("bucket", string(b.bucket)), zap.Error(err))
+		return nil
+	}
+	b.len -= removed
+	return out
+}
+
+// oldest returns the n oldest metrics of the bucket which aren't in a batch,
+// and their keys. The ones which can't be decoded are removed, it returns
+// their number.
+func (b *DiskBuffer) oldest(bk *bolt.Bucket, n int) ([]*MetricData, [][]byte, int, error) {
+	var keys, bad [][]byte
+	var out []*MetricData
+	c := bk.Cursor()
+	for k, v := c.First(); k != nil && len(out) < n; k, v = c.Next() {
+		if b.taken[string(k)] {
+			continue
+		}
+		// the key is only valid during the transaction
+		k = append([]byte(nil), k...)
+		m, err := decodeMetric(v)
+		if err != nil {
+			VLogger.Error("disk buffer decode, metric dropped", zap.Error(err))
+			bad = append(bad, k)
+			continue
+		}
+		keys = append(keys, k)
+		out = append(out, m)
+	}
+
+	// deleting with the cursor while iterating skips keys
+	if err := deleteKeys(bk, bad); err != nil {
+		return nil, nil, 0, err
+	}
+	return out, keys, len(bad), nil
+}
+
+func deleteKeys(bk *bolt.Bucket, keys [][]byte) error {
+	for _, k := range keys {
+		if err := bk.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bufferKey is the big endian sequence, so the keys sort in insertion order.
+func bufferKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// encodeMetric encodes the metric with gob, which keeps the types of the
+// fields unlike JSON.
+func encodeMetric(m *MetricData) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeMetric(b []byte) (*MetricData, error) {
+	m := &MetricData{}
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(m)
+	return m, err
+}
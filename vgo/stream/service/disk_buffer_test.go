@@ -0,0 +1,153 @@
+package service
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// openDiskBuffer opens the bucket of the bolt file, the returned func closes
+// the file.
+func openDiskBuffer(t *testing.T, path string, size int) (*DiskBuffer, func()) {
+	db, err := OpenBufferDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewDiskBuffer(db, "retry", size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, func() { db.Close() }
+}
+
+func TestDiskBufferReplay(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "buffer")
+
+	metrics := []*MetricData{
+		{
+			Name:   "cpu",
+			Tags:   map[string]string{"host": "server01"},
+			Fields: map[string]interface{}{"idle": 98.5, "count": int64(3), "state": "ok", "up": true, "bytes": uint64(1) << 40},
+			Time:   time.Unix(1500000000, 123).UTC(),
+		},
+		{
+			Name:   "mem",
+			Tags:   map[string]string{},
+			Fields: map[string]interface{}{"used": int64(2)},
+			Time:   time.Unix(1500000001, 0).UTC(),
+		},
+	}
+	b, closeDB := openDiskBuffer(t, path, 10)
+	if dropped := b.Add(metrics...); len(dropped) != 0 {
+		t.Fatalf("got %d metrics dropped", len(dropped))
+	}
+	closeDB()
+
+	// restarted, the metrics are back in order with their field types
+	b, closeDB = openDiskBuffer(t, path, 10)
+	defer closeDB()
+	if n := b.Len(); n != 2 {
+		t.Fatalf("got %d metrics after the restart, want 2", n)
+	}
+	got := b.Batch(10)
+	if len(got) != 2 {
+		t.Fatalf("got %d metrics replayed, want 2", len(got))
+	}
+	for n, want := range metrics {
+		m := got[n]
+		if m.Name != want.Name || !m.Time.Equal(want.Time) || !reflect.DeepEqual(m.Fields, want.Fields) || len(m.Tags) != len(want.Tags) || m.Tags["host"] != want.Tags["host"] {
+			t.Errorf("got metric %+v, want %+v", m, want)
+		}
+	}
+	if !b.IsEmpty() {
+		t.Errorf("%d metrics left after the batch", b.Len())
+	}
+}
+
+func TestDiskBufferSize(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "buffer")
+
+	b, closeDB := openDiskBuffer(t, path, 3)
+	metrics := testMetrics(5)
+	b.Add(metrics[:2]...)
+	dropped := b.Add(metrics[2:]...)
+	// the oldest ones make room
+	if len(dropped) != 2 || !dropped[0].Time.Equal(metrics[0].Time) || !dropped[1].Time.Equal(metrics[1].Time) {
+		t.Errorf("got dropped %v, want the 2 oldest", dropped)
+	}
+	if n := b.Len(); n != 3 {
+		t.Errorf("got %d metrics, want 3", n)
+	}
+	closeDB()
+
+	// restarted with a smaller size, the oldest are dropped
+	b, closeDB = openDiskBuffer(t, path, 2)
+	defer closeDB()
+	got := b.Batch(10)
+	if len(got) != 2 || !got[0].Time.Equal(metrics[3].Time) || !got[1].Time.Equal(metrics[4].Time) {
+		t.Errorf("got %v after the restart, want the 2 latest", got)
+	}
+}
+
+func TestOutputBufferFile(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "buffer")
+
+	mo := &mockOutput{}
+	mo.setFail(true)
+	mc := &MetricOutputConfig{Name: "buffer_file_output", MetricOutput: mo, BufferFile: path}
+	defer startOutput(mc)()
+	mc.Compute(Metrics{Data: testMetrics(3)})
+	mc.updateBufferSize()
+	if n := mc.stats.fields()["buffer_size"]; n != int64(3) {
+		t.Errorf("got buffer size %v, want 3", n)
+	}
+	// kept in the file rather than dropped at shutdown
+	if err := mc.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next start writes them with its first write
+	next := &mockOutput{}
+	mc = &MetricOutputConfig{MetricOutput: next, BufferFile: path}
+	defer startOutput(mc)()
+	mc.Compute(Metrics{Data: testMetrics(1)})
+	if n := next.written(); n != 4 {
+		t.Errorf("%d metrics written after the restart, want the 3 buffered and the new one", n)
+	}
+	mc.Stop()
+}
+
+func TestDiskBufferCrashDuringWrite(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "buffer")
+
+	b, closeDB := openDiskBuffer(t, path, 10)
+	metrics := testMetrics(3)
+	b.Add(metrics...)
+	batch := b.Batch(2)
+	if len(batch) != 2 || b.Len() != 1 {
+		t.Fatalf("got a batch of %d and %d left, want 2 and 1", len(batch), b.Len())
+	}
+	// the metrics of the batch aren't returned twice
+	if rest := b.Batch(10); len(rest) != 1 || !rest[0].Time.Equal(metrics[2].Time) {
+		t.Fatalf("got %v, want the metric left", rest)
+	}
+	b.Ack(batch[:1])
+	// crashed during the write of the others
+	closeDB()
+
+	b, closeDB = openDiskBuffer(t, path, 10)
+	defer closeDB()
+	got := b.Batch(10)
+	if len(got) != 2 || !got[0].Time.Equal(metrics[1].Time) || !got[1].Time.Equal(metrics[2].Time) {
+		t.Errorf("got %v after the restart, want the 2 metrics not acknowledged", got)
+	}
+}
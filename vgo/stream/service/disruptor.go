@@ -1,9 +1,18 @@
 package service
 
-import disruptor "github.com/smartystreets/go-disruptor"
+import (
+	"sync"
+	"time"
+
+	disruptor "github.com/smartystreets/go-disruptor"
+)
 
 var controller *Controller
 
+// publishMu serializes Publish, the ring has a single writer while the
+// inputs publish from their own goroutines
+var publishMu sync.Mutex
+
 type Controller struct {
 	controller   disruptor.Disruptor
 	ring         []Metrics
@@ -34,7 +43,16 @@ func (c *Controller) Close() error {
 	return nil
 }
 
+// Publish sends the metrics to the ring, it's safe for concurrent use.
 func Publish(m Metrics) {
+	// one time for the whole batch, so its metrics share the same stamp
+	if currentConf().Stream.StampZeroTimes {
+		stampZeroTimes(m.Data, time.Now())
+	}
+
+	publishMu.Lock()
+	defer publishMu.Unlock()
+
 	sequence := disruptor.InitialSequenceValue
 	writer := controller.controller.Writer()
 
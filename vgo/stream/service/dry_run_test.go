@@ -0,0 +1,60 @@
+package service
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+// checkOutput is a mock output checking its destination
+type checkOutput struct {
+	mockOutput
+	dryRun bool
+	checks int32
+	err    error
+}
+
+func (o *checkOutput) SetDryRun(dryRun bool) { o.dryRun = dryRun }
+
+func (o *checkOutput) CheckDestination() error {
+	atomic.AddInt32(&o.checks, 1)
+	return o.err
+}
+
+func TestDryRun(t *testing.T) {
+	mo := &checkOutput{}
+	mc := &MetricOutputConfig{MetricOutput: mo, DryRun: true}
+	defer startOutput(mc)()
+
+	mc.Compute(Metrics{Data: testMetrics(10)})
+	mc.Compute(Metrics{Data: testMetrics(10)})
+	if mo.writes != 0 || mo.written() != 0 {
+		t.Errorf("%d writes of %d metrics in dry run", mo.writes, mo.written())
+	}
+	if n := atomic.LoadInt32(&mo.checks); n != 2 {
+		t.Errorf("destination checked %d times, want 2", n)
+	}
+	if !mc.Healthy() {
+		t.Error("output unhealthy after a successful check")
+	}
+
+	mo.err = errors.New("database not found")
+	mc.Compute(Metrics{Data: testMetrics(10)})
+	if mc.Healthy() {
+		t.Error("output healthy after a failed check")
+	}
+	if mo.writes != 0 {
+		t.Errorf("%d writes in dry run", mo.writes)
+	}
+}
+
+func TestDryRunUnchecked(t *testing.T) {
+	mo := &mockOutput{}
+	mc := &MetricOutputConfig{MetricOutput: mo, DryRun: true}
+	defer startOutput(mc)()
+
+	mc.Compute(Metrics{Data: testMetrics(10)})
+	if mo.writes != 0 {
+		t.Errorf("%d writes in dry run", mo.writes)
+	}
+}
@@ -0,0 +1,34 @@
+package service
+
+import (
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+// Event is a one off event such as a deploy or a fired alarm, written by
+// the metric outputs supporting it as an annotation of the metrics.
+type Event struct {
+	Title string
+	Text  string
+	Tags  map[string]string
+	Time  time.Time
+}
+
+// EventWriter is implemented by the metric outputs which can write events.
+type EventWriter interface {
+	WriteEvent(e *Event) error
+}
+
+// WriteEvent writes the event to every metric output supporting events.
+func WriteEvent(e *Event) {
+	for _, mc := range currentConf().MetricOutputs {
+		ew, ok := mc.MetricOutput.(EventWriter)
+		if !ok || mc.DryRun {
+			continue
+		}
+		if err := ew.WriteEvent(e); err != nil {
+			VLogger.Error("metric output write event", zap.String("name", mc.Name), zap.Error(err))
+		}
+	}
+}
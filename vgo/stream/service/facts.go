@@ -0,0 +1,200 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/naoina/toml"
+	"github.com/naoina/toml/ast"
+	"github.com/uber-go/zap"
+)
+
+// FactsConfig are the facts of the host added as tags to every metric,
+// gathered at startup: the values of environment variables, the contents
+// of files like /etc/machine-id and the answers of urls like the cloud
+// metadata endpoints. The url facts are gathered again every
+// RefreshInterval, an unreachable url keeps its last value.
+type FactsConfig struct {
+	// Env maps the tags to environment variables
+	Env map[string]string
+	// Files maps the tags to files, their surrounding whitespace is ignored
+	Files map[string]string
+	// URLs maps the tags to urls answering the value in the body
+	URLs map[string]string `toml:"urls"`
+	// Headers are sent with the requests of the urls, like
+	// Metadata-Flavor: Google for the GCE metadata server
+	Headers map[string]string
+
+	RefreshInterval misc.Duration
+	Timeout         misc.Duration
+	// Override replaces the tags the metrics already have
+	Override bool
+}
+
+// Facts holds the gathered facts
+type Facts struct {
+	conf   *FactsConfig
+	client *http.Client
+
+	sync.RWMutex
+	tags map[string]string
+}
+
+// facts are the facts of the host, nil without facts config
+var facts *Facts
+
+// parseFacts parses the facts table, like the stream section it isn't
+// reloaded.
+func (c *Config) parseFacts(tbl *ast.Table) {
+	val, ok := tbl.Fields["facts"]
+	if !ok {
+		return
+	}
+	subTbl, ok := val.(*ast.Table)
+	if !ok {
+		log.Fatalln("[FATAL] facts parse error: ", val)
+	}
+
+	fc := &FactsConfig{
+		RefreshInterval: misc.Duration{Duration: time.Hour},
+		Timeout:         misc.Duration{Duration: 2 * time.Second},
+	}
+	if err := toml.UnmarshalTable(subTbl, fc); err != nil {
+		log.Fatalln("[FATAL] parseFacts: ", err)
+	}
+	c.Facts = fc
+}
+
+// Show show struct message
+func (fc *FactsConfig) Show() {
+	log.Println("Env is ", fc.Env)
+	log.Println("Files is ", fc.Files)
+	log.Println("URLs is ", fc.URLs)
+	log.Println("RefreshInterval is ", fc.RefreshInterval.Duration)
+	log.Println("Timeout is ", fc.Timeout.Duration)
+	log.Println("Override is ", fc.Override)
+}
+
+// NewFacts gathers the facts, the facts which can't be gathered are
+// logged and left out.
+func NewFacts(conf *FactsConfig) *Facts {
+	f := &Facts{
+		conf:   conf,
+		client: &http.Client{Timeout: conf.Timeout.Duration},
+		tags:   make(map[string]string),
+	}
+
+	for tag, name := range conf.Env {
+		if v := os.Getenv(name); v != "" {
+			f.tags[tag] = v
+		} else {
+			VLogger.Warn("fact environment variable not set", zap.String("tag", tag), zap.String("env", name))
+		}
+	}
+	for tag, path := range conf.Files {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			VLogger.Warn("fact file", zap.String("tag", tag), zap.Error(err))
+			continue
+		}
+		if v := string(bytes.TrimSpace(b)); v != "" {
+			f.tags[tag] = v
+		}
+	}
+	f.refresh()
+	return f
+}
+
+// Start gathers the url facts again every RefreshInterval until stop is
+// closed.
+func (f *Facts) Start(stopC chan bool) {
+	if len(f.conf.URLs) == 0 || f.conf.RefreshInterval.Duration <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(f.conf.RefreshInterval.Duration)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				f.refresh()
+			case <-stopC:
+				return
+			}
+		}
+	}()
+}
+
+// refresh gathers the url facts, the ones failing keep their last value.
+func (f *Facts) refresh() {
+	for tag, url := range f.conf.URLs {
+		v, err := f.get(url)
+		if err != nil {
+			VLogger.Warn("fact url unreachable", zap.String("tag", tag), zap.String("url", url), zap.Error(err))
+			continue
+		}
+		f.Lock()
+		f.tags[tag] = v
+		f.Unlock()
+	}
+}
+
+func (f *Facts) get(url string) (string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range f.conf.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// a fact is a short value, don't read a whole page answered by mistake
+	body, err := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 4096})
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	v := string(bytes.TrimSpace(body))
+	if v == "" {
+		return "", errors.New("empty answer")
+	}
+	return v, nil
+}
+
+// apply adds the facts to the tags of the metrics.
+func (f *Facts) apply(metrics []*MetricData) {
+	f.RLock()
+	defer f.RUnlock()
+	if len(f.tags) == 0 {
+		return
+	}
+
+	for _, m := range metrics {
+		if m.Tags == nil {
+			m.Tags = make(map[string]string, len(f.tags))
+		}
+		for k, v := range f.tags {
+			if _, ok := m.Tags[k]; ok && !f.conf.Override {
+				continue
+			}
+			m.Tags[k] = v
+		}
+	}
+}
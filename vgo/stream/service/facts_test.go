@@ -0,0 +1,218 @@
+package service
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/misc"
+	"github.com/naoina/toml"
+	"github.com/naoina/toml/ast"
+)
+
+// mockMetadata is a cloud metadata server answering the values of its
+// paths, the requests without the Metadata-Flavor header are refused.
+type mockMetadata struct {
+	*httptest.Server
+
+	sync.Mutex
+	values   map[string]string
+	requests int
+}
+
+func newMockMetadata(values map[string]string) *mockMetadata {
+	m := &mockMetadata{values: values}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		m.requests++
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		v, ok := m.values[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(v + "\n"))
+	}))
+	return m
+}
+
+func (m *mockMetadata) set(path, value string) {
+	m.Lock()
+	m.values[path] = value
+	m.Unlock()
+}
+
+func factsConfig() *FactsConfig {
+	return &FactsConfig{
+		Headers:         map[string]string{"Metadata-Flavor": "Google"},
+		RefreshInterval: misc.Duration{Duration: time.Hour},
+		Timeout:         misc.Duration{Duration: time.Second},
+	}
+}
+
+// fact returns the gathered fact of the tag.
+func fact(f *Facts, tag string) string {
+	f.RLock()
+	defer f.RUnlock()
+	return f.tags[tag]
+}
+
+func TestFactsEnvAndFiles(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	machineID := filepath.Join(dir, "machine-id")
+	if err := ioutil.WriteFile(machineID, []byte("4c4c4544\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("VGO_TEST_DC", "eu-west")
+	defer os.Unsetenv("VGO_TEST_DC")
+	os.Unsetenv("VGO_TEST_UNSET")
+
+	conf := factsConfig()
+	conf.Env = map[string]string{"dc": "VGO_TEST_DC", "team": "VGO_TEST_UNSET"}
+	conf.Files = map[string]string{"machine_id": machineID, "kernel": filepath.Join(dir, "missing")}
+	f := NewFacts(conf)
+
+	// the facts not found are left out
+	want := map[string]string{"dc": "eu-west", "machine_id": "4c4c4544"}
+	if !reflect.DeepEqual(f.tags, want) {
+		t.Errorf("got facts %v, want %v", f.tags, want)
+	}
+}
+
+func TestFactsMetadata(t *testing.T) {
+	m := newMockMetadata(map[string]string{
+		"/instance/id":   "i-1234",
+		"/instance/zone": "europe-west1-b",
+	})
+	defer m.Close()
+
+	conf := factsConfig()
+	conf.URLs = map[string]string{
+		"instance_id": m.URL + "/instance/id",
+		"zone":        m.URL + "/instance/zone",
+		"rack":        m.URL + "/instance/rack",
+	}
+	f := NewFacts(conf)
+	want := map[string]string{"instance_id": "i-1234", "zone": "europe-west1-b"}
+	if !reflect.DeepEqual(f.tags, want) {
+		t.Errorf("got facts %v, want %v", f.tags, want)
+	}
+
+	// without the header the server refuses the requests
+	conf.Headers = nil
+	if f := NewFacts(conf); len(f.tags) != 0 {
+		t.Errorf("got facts %v, want none", f.tags)
+	}
+}
+
+func TestFactsRefresh(t *testing.T) {
+	m := newMockMetadata(map[string]string{"/instance/zone": "europe-west1-b"})
+	defer m.Close()
+
+	conf := factsConfig()
+	conf.URLs = map[string]string{"zone": m.URL + "/instance/zone"}
+	conf.RefreshInterval = misc.Duration{Duration: 5 * time.Millisecond}
+	f := NewFacts(conf)
+	stopC := make(chan bool)
+	f.Start(stopC)
+	defer close(stopC)
+
+	m.set("/instance/zone", "europe-west1-c")
+	waitFor(t, 5*time.Second, func() bool { return fact(f, "zone") == "europe-west1-c" })
+
+	// the server gone, the last value is kept
+	m.Close()
+	m.Lock()
+	requests := m.requests
+	m.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	if zone := fact(f, "zone"); zone != "europe-west1-c" {
+		t.Errorf("got zone %q, want the last value kept", zone)
+	}
+	if requests == 0 {
+		t.Error("metadata server never requested")
+	}
+}
+
+func TestFactsUnreachable(t *testing.T) {
+	m := newMockMetadata(map[string]string{})
+	addr := m.URL
+	m.Close()
+
+	conf := factsConfig()
+	conf.URLs = map[string]string{"zone": addr + "/instance/zone", "invalid": "://"}
+	conf.Env = map[string]string{"home": "HOME"}
+	f := NewFacts(conf)
+	if len(f.tags) != 1 || f.tags["home"] == "" {
+		t.Errorf("got facts %v, want the unreachable urls left out", f.tags)
+	}
+}
+
+func TestFactsApply(t *testing.T) {
+	for _, tt := range []struct {
+		override bool
+		zone     string
+	}{
+		{false, "local"},
+		{true, "europe-west1-b"},
+	} {
+		conf := factsConfig()
+		conf.Override = tt.override
+		f := &Facts{conf: conf, tags: map[string]string{"zone": "europe-west1-b", "instance_id": "i-1234"}}
+
+		metrics := []*MetricData{
+			{Name: "cpu"},
+			{Name: "mem", Tags: map[string]string{"zone": "local", "host": "a"}},
+		}
+		f.apply(metrics)
+		if metrics[0].Tags["zone"] != "europe-west1-b" || metrics[0].Tags["instance_id"] != "i-1234" {
+			t.Errorf("got tags %v, want the facts", metrics[0].Tags)
+		}
+		if metrics[1].Tags["zone"] != tt.zone || metrics[1].Tags["host"] != "a" || metrics[1].Tags["instance_id"] != "i-1234" {
+			t.Errorf("override %v, got tags %v, want zone %s", tt.override, metrics[1].Tags, tt.zone)
+		}
+	}
+}
+
+func TestParseFacts(t *testing.T) {
+	tbl, err := toml.Parse([]byte(`
+[facts]
+  timeout = "5s"
+  [facts.env]
+    dc = "DATACENTER"
+  [facts.urls]
+    zone = "http://169.254.169.254/latest/meta-data/placement/availability-zone"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newConfig()
+	c.parseFacts(tbl)
+	if c.Facts == nil {
+		t.Fatal("facts not parsed")
+	}
+	if c.Facts.Env["dc"] != "DATACENTER" || len(c.Facts.URLs) != 1 {
+		t.Errorf("got facts %+v", c.Facts)
+	}
+	// the refresh interval defaults to an hour
+	if c.Facts.Timeout.Duration != 5*time.Second || c.Facts.RefreshInterval.Duration != time.Hour {
+		t.Errorf("got timeout %s and refresh interval %s", c.Facts.Timeout.Duration, c.Facts.RefreshInterval.Duration)
+	}
+
+	c = newConfig()
+	c.parseFacts(&ast.Table{})
+	if c.Facts != nil {
+		t.Error("got facts without facts table")
+	}
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/naoina/toml"
+	"github.com/naoina/toml/ast"
+	"github.com/uber-go/zap"
+)
+
+// failover is an output written only when the primary output and the
+// failovers before it fail, such as a local file during an outage.
+type failover struct {
+	Name         string
+	MetricOutput MetricOutputer
+	// line is the line of the failover table in the config file
+	line int
+}
+
+// buildFailovers builds the failover outputs of the tables under the
+// failover key of the output, in the order of the config file:
+//
+//   [[metric_outputs.influxdb]]
+//     urls = ["http://localhost:8086"]
+//     [[metric_outputs.influxdb.failover.console]]
+//
+// They share the precision and the dry run of the output.
+func buildFailovers(tbl *ast.Table, mc *MetricOutputConfig) ([]*failover, error) {
+	node, ok := tbl.Fields["failover"]
+	if !ok {
+		return nil, nil
+	}
+	delete(tbl.Fields, "failover")
+
+	ftbl, ok := node.(*ast.Table)
+	if !ok {
+		return nil, errors.New("failover must be a table of outputs")
+	}
+
+	var failovers []*failover
+	add := func(name string, t *ast.Table) error {
+		mo, err := newMetricOutput(name, t, mc)
+		if err != nil {
+			return fmt.Errorf("failover %s, %s", name, err)
+		}
+		failovers = append(failovers, &failover{Name: name, MetricOutput: mo, line: t.Line})
+		return nil
+	}
+	for name, v := range ftbl.Fields {
+		switch t := v.(type) {
+		case *ast.Table:
+			if err := add(name, t); err != nil {
+				return nil, err
+			}
+		case []*ast.Table:
+			for _, st := range t {
+				if err := add(name, st); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, fmt.Errorf("failover %s must be a table", name)
+		}
+	}
+
+	sort.Slice(failovers, func(i, j int) bool {
+		return failovers[i].line < failovers[j].line
+	})
+	return failovers, nil
+}
+
+// newMetricOutput returns the output plugin of the table, configured with
+// the precision and the dry run of the output.
+func newMetricOutput(name string, tbl *ast.Table, mc *MetricOutputConfig) (MetricOutputer, error) {
+	registered, ok := MetricOutputs[name]
+	if !ok {
+		return nil, fmt.Errorf("no plugin %v available", name)
+	}
+	mo := newPlugin(registered).(MetricOutputer)
+
+	if so, ok := mo.(SerializerOutput); ok {
+		serializer, err := buildSerializer(tbl)
+		if err != nil {
+			return nil, fmt.Errorf("build serializer, %s", err)
+		}
+		so.SetSerializer(serializer)
+	}
+
+	if err := toml.UnmarshalTable(tbl, mo); err != nil {
+		return nil, fmt.Errorf("unmarshal, %s", err)
+	}
+	if po, ok := mo.(PrecisionOutput); ok {
+		po.SetPrecision(mc.Precision)
+	}
+	if do, ok := mo.(DryRunOutput); ok {
+		do.SetDryRun(mc.DryRun)
+	}
+	return mo, nil
+}
+
+// writeFailovers writes the metrics the primary output failed to write to
+// the failover outputs in turn, it returns whether one of them wrote them.
+func (mc *MetricOutputConfig) writeFailovers(m Metrics) bool {
+	for i, f := range mc.failovers {
+		if err := f.MetricOutput.Compute(m); err != nil {
+			VLogger.Error("metric output failover compute", zap.String("name", mc.Name), zap.String("failover", f.Name), zap.Error(err))
+			continue
+		}
+		mc.setActive(i + 1)
+		mc.stats.Written(len(m.Data))
+		return true
+	}
+	return false
+}
+
+// setActive records the output which wrote the last metrics: 0 for the
+// primary output, i for the i-th failover.
+func (mc *MetricOutputConfig) setActive(i int) {
+	prev := atomic.SwapInt32(&mc.active, int32(i))
+	if int(prev) == i {
+		return
+	}
+	mc.stats.SetActiveOutput(i)
+	if i == 0 {
+		VLogger.Warn("metric output primary recovered, failover stopped", zap.String("name", mc.Name))
+		return
+	}
+	VLogger.Warn("metric output failover active", zap.String("name", mc.Name), zap.String("failover", mc.failovers[i-1].Name))
+}
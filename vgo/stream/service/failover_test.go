@@ -0,0 +1,116 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/naoina/toml"
+)
+
+func init() {
+	AddMetricOutput("file_failover", &reloadOutput{})
+}
+
+func TestFailover(t *testing.T) {
+	primary := &mockOutput{fail: true}
+	first, second := &mockOutput{fail: true}, &mockOutput{}
+	mc := &MetricOutputConfig{
+		Name:         "failover",
+		MetricOutput: primary,
+		failovers: []*failover{
+			{Name: "first", MetricOutput: first},
+			{Name: "second", MetricOutput: second},
+		},
+	}
+	defer startOutput(mc)()
+
+	// the primary fails, the first failover which writes is active
+	if err := mc.compute(primary, Metrics{Data: testMetrics(3)}); err != nil {
+		t.Fatal(err)
+	}
+	if first.written() != 0 || second.written() != 3 {
+		t.Errorf("failovers wrote %d and %d metrics, want the second one the 3", first.written(), second.written())
+	}
+	if !mc.retry.IsEmpty() {
+		t.Errorf("%d metrics kept for a retry, want them written by the failover", mc.retry.Len())
+	}
+	if n := mc.stats.fields()["active_output"]; n != int64(2) {
+		t.Errorf("got active output %v, want the second failover", n)
+	}
+
+	// the primary recovers, the failovers aren't written anymore
+	primary.setFail(false)
+	if err := mc.compute(primary, Metrics{Data: testMetrics(2)}); err != nil {
+		t.Fatal(err)
+	}
+	if primary.written() != 2 || second.written() != 3 {
+		t.Errorf("primary wrote %d and the failover %d metrics, want 2 and 3", primary.written(), second.written())
+	}
+	if n := mc.stats.fields()["active_output"]; n != int64(0) {
+		t.Errorf("got active output %v, want the primary", n)
+	}
+}
+
+func TestFailoverAllFail(t *testing.T) {
+	primary, file := &mockOutput{fail: true}, &mockOutput{fail: true}
+	mc := &MetricOutputConfig{
+		MetricOutput: primary,
+		failovers:    []*failover{{Name: "file", MetricOutput: file}},
+	}
+	defer startOutput(mc)()
+
+	if err := mc.compute(primary, Metrics{Data: testMetrics(3)}); err == nil {
+		t.Error("write succeeded with all the outputs failing")
+	}
+	if n := mc.retry.Len(); n != 3 {
+		t.Errorf("%d metrics kept for a retry, want 3", n)
+	}
+	if primary.writeCount() != 1 || file.writeCount() != 1 {
+		t.Errorf("got %d and %d writes, want every output tried once", primary.writeCount(), file.writeCount())
+	}
+}
+
+func TestBuildFailovers(t *testing.T) {
+	tbl, err := toml.Parse([]byte(`
+option = "primary"
+[failover.reload_output]
+  option = "first"
+[failover.file_failover]
+  option = "second"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newConfig()
+	if err := c.AddMetricOutput("reload_output", tbl); err != nil {
+		t.Fatal(err)
+	}
+	mc := c.MetricOutputs[0]
+	if o := mc.MetricOutput.(*reloadOutput); o.Option != "primary" {
+		t.Errorf("got primary option %q", o.Option)
+	}
+	// in the order of the config file
+	if len(mc.failovers) != 2 {
+		t.Fatalf("got %d failovers, want 2", len(mc.failovers))
+	}
+	for i, want := range []string{"reload_output", "file_failover"} {
+		f := mc.failovers[i]
+		if f.Name != want || f.MetricOutput.(*reloadOutput).Option != []string{"first", "second"}[i] {
+			t.Errorf("failover %d is %s %+v, want %s", i, f.Name, f.MetricOutput, want)
+		}
+	}
+
+	for _, conf := range []string{
+		"failover = 1",
+		"[failover]\n  reload_output = 1",
+		"[failover.missing_output]",
+		"[failover.reload_output]\n  unknown = 1",
+	} {
+		tbl, err := toml.Parse([]byte(conf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := newConfig().AddMetricOutput("reload_output", tbl); err == nil {
+			t.Errorf("%q accepted", conf)
+		}
+	}
+}
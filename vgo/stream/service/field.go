@@ -0,0 +1,36 @@
+package service
+
+// ToFloat returns the value of a numeric field as a float64, false for the
+// other fields. The integers are promoted, not truncated.
+func ToFloat(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case int:
+		return float64(t), true
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case uint32:
+		return float64(t), true
+	case uint64:
+		return float64(t), true
+	case float32:
+		return float64(t), true
+	case float64:
+		return t, true
+	default:
+		return 0, false
+	}
+}
+
+// ValueToFloat is ToFloat with the booleans as 1 and 0, for the outputs
+// whose destination only takes numbers.
+func ValueToFloat(v interface{}) (float64, bool) {
+	if b, ok := v.(bool); ok {
+		if b {
+			return 1, true
+		}
+		return 0, true
+	}
+	return ToFloat(v)
+}
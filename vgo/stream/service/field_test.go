@@ -0,0 +1,31 @@
+package service
+
+import "testing"
+
+func TestToFloat(t *testing.T) {
+	for _, tt := range []struct {
+		v     interface{}
+		f     float64
+		ok    bool
+		value bool
+	}{
+		{int(-2), -2, true, true},
+		{int32(3), 3, true, true},
+		{int64(1) << 53, 1 << 53, true, true},
+		{uint32(4), 4, true, true},
+		{uint64(5), 5, true, true},
+		{float32(0.5), 0.5, true, true},
+		{1.25, 1.25, true, true},
+		{true, 1, false, true},
+		{false, 0, false, true},
+		{"1", 0, false, false},
+		{nil, 0, false, false},
+	} {
+		if f, ok := ToFloat(tt.v); ok != tt.ok || (ok && f != tt.f) {
+			t.Errorf("ToFloat(%#v) = %v, %v", tt.v, f, ok)
+		}
+		if f, ok := ValueToFloat(tt.v); ok != tt.value || f != tt.f {
+			t.Errorf("ValueToFloat(%#v) = %v, %v", tt.v, f, ok)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package service
+
+import "strconv"
+
+// FlattenFields replaces the map and slice fields by scalar fields named
+// after their path joined by separator: {"disk": {"used": 1}} gives
+// disk.used, {"load": [1, 2]} gives load.0 and load.1. The values nested
+// deeper than maxDepth and the null values are dropped. It returns the
+// number of fields which replaced a field of the same name.
+func FlattenFields(fields map[string]interface{}, separator string, maxDepth int) int {
+	var flat map[string]interface{}
+	collisions := 0
+	for k, v := range fields {
+		if !nested(v) {
+			continue
+		}
+		if flat == nil {
+			flat = make(map[string]interface{})
+		}
+		delete(fields, k)
+		collisions += flatten(flat, k, v, separator, maxDepth, 1)
+	}
+
+	for k, v := range flat {
+		if _, ok := fields[k]; ok {
+			collisions++
+		}
+		fields[k] = v
+	}
+	return collisions
+}
+
+// flatten adds the scalar values of v to flat, depth is the nesting level
+// of v. It returns the number of values which replaced another one.
+func flatten(flat map[string]interface{}, name string, v interface{}, separator string, maxDepth, depth int) int {
+	collisions := 0
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if depth > maxDepth {
+			return 0
+		}
+		for k, sub := range t {
+			collisions += flatten(flat, name+separator+k, sub, separator, maxDepth, depth+1)
+		}
+	case []interface{}:
+		if depth > maxDepth {
+			return 0
+		}
+		for i, sub := range t {
+			collisions += flatten(flat, name+separator+strconv.Itoa(i), sub, separator, maxDepth, depth+1)
+		}
+	case nil:
+	default:
+		if _, ok := flat[name]; ok {
+			collisions++
+		}
+		flat[name] = v
+	}
+	return collisions
+}
+
+func nested(v interface{}) bool {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/uber-go/zap"
+)
+
+// Health serves the liveness and readiness probes:
+//   /healthz answers 200 as long as the process is up
+//   /ready answers 200 when the last write of every metric output
+//   succeeded, 503 with the failing outputs otherwise
+//   /metrics answers the internal stats in the prometheus text format
+type Health struct {
+	addr     string
+	listener net.Listener
+}
+
+// NewHealth returns a Health listening on addr.
+func NewHealth(addr string) *Health {
+	return &Health{addr: addr}
+}
+
+// Start listens and serves the probes in the background.
+func (h *Health) Start() error {
+	l, err := net.Listen("tcp", h.addr)
+	if err != nil {
+		return err
+	}
+	h.listener = l
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.HandleFunc("/ready", h.ready)
+	mux.HandleFunc("/metrics", h.metrics)
+
+	go func() {
+		// Serve returns when the listener is closed
+		if err := http.Serve(l, mux); err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+			VLogger.Error("health server", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+func (h *Health) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func (h *Health) ready(w http.ResponseWriter, r *http.Request) {
+	var failing []string
+	for _, mc := range currentConf().MetricOutputs {
+		if !mc.Healthy() {
+			failing = append(failing, mc.Name)
+		}
+	}
+
+	if len(failing) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "failing metric outputs:", strings.Join(failing, ", "))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (h *Health) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	internalStats.writePrometheus(w)
+}
+
+// Close stops serving the probes.
+func (h *Health) Close() error {
+	if h.listener == nil {
+		return nil
+	}
+	return h.listener.Close()
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func get(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestHealth(t *testing.T) {
+	influxdb := &MetricOutputConfig{Name: "influxdb"}
+	kafka := &MetricOutputConfig{Name: "kafka"}
+	c := newConfig()
+	c.MetricOutputs = []*MetricOutputConfig{influxdb, kafka}
+	setConf(c)
+	defer setConf(newConfig())
+
+	h := NewHealth("127.0.0.1:0")
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	url := "http://" + h.listener.Addr().String()
+
+	// healthy
+	if code, body := get(t, url+"/healthz"); code != http.StatusOK || body != "ok\n" {
+		t.Errorf("/healthz answered %d %q", code, body)
+	}
+	if code, body := get(t, url+"/ready"); code != http.StatusOK || body != "ok\n" {
+		t.Errorf("/ready answered %d %q", code, body)
+	}
+
+	// degraded, the process is still alive but not ready
+	kafka.failing = 1
+	if code, body := get(t, url+"/healthz"); code != http.StatusOK || body != "ok\n" {
+		t.Errorf("degraded /healthz answered %d %q", code, body)
+	}
+	code, body := get(t, url+"/ready")
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "kafka") || strings.Contains(body, "influxdb") {
+		t.Errorf("degraded /ready answered %d %q", code, body)
+	}
+
+	// recovered
+	kafka.failing = 0
+	if code, _ := get(t, url+"/ready"); code != http.StatusOK {
+		t.Errorf("recovered /ready answered %d", code)
+	}
+}
+
+func TestHealthClose(t *testing.T) {
+	h := NewHealth("127.0.0.1:0")
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + h.listener.Addr().String()
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get(url + "/healthz"); err == nil {
+		t.Error("probes served after Close")
+	}
+}
@@ -18,6 +18,9 @@ type InputConfig struct {
 	Input Inputer
 
 	Interval time.Duration
+
+	// signature identifies the config of the input
+	signature string
 }
 
 // Start init and start Inputer service
@@ -33,6 +36,13 @@ func (ic *InputConfig) Start(stopC chan bool, writeC chan Metrics) {
 	go ic.Input.Start()
 }
 
+// Stop stops the input reading, when it supports it.
+func (ic *InputConfig) Stop() {
+	if stopper, ok := ic.Input.(InputStopper); ok {
+		stopper.Stop()
+	}
+}
+
 // Show show struct message
 func (ic *InputConfig) Show() {
 	log.Println("Name is ", ic.Name)
@@ -53,6 +63,12 @@ type Inputer interface {
 	Start()
 }
 
+// InputStopper is implemented by the inputs which can stop reading, so no
+// metric comes in while the pipeline shuts down.
+type InputStopper interface {
+	Stop()
+}
+
 // buildInput parses input specific items from the ast.Table,
 func buildInput(name string, tbl *ast.Table) (*InputConfig, error) {
 	cp := &InputConfig{Name: name}
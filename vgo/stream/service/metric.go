@@ -7,6 +7,9 @@ import "time"
 type Metrics struct {
 	Data     []*MetricData `json:"d"`
 	Interval int           `json:"i"`
+	// Verbatim metrics skip the facts and the processors, they reach the
+	// alarmer, the chains and the metric outputs as they were published
+	Verbatim bool `json:"-"`
 }
 
 type MetricData struct {
@@ -14,4 +17,8 @@ type MetricData struct {
 	Tags   map[string]string      `json:"ts"`
 	Fields map[string]interface{} `json:"f"`
 	Time   time.Time              `json:"t"`
+	// TTL is how long the outputs expiring the data per metric keep the
+	// metric, set by the ttl processor. Zero never expires, the outputs
+	// without expiry ignore it
+	TTL time.Duration `json:"-"`
 }
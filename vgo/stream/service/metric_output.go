@@ -1,26 +1,172 @@
 package service
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/corego/vgo/mecury/misc"
 	"github.com/naoina/toml/ast"
 	"github.com/uber-go/zap"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// errRateLimited is the reason of the metrics kept by the rate limit
+	errRateLimited = errors.New("rate limit exceeded")
+	// errBreakerOpen is the reason of the metrics kept by the open breaker
+	errBreakerOpen = errors.New("circuit breaker open")
+	// errNotInSchema is the reason of the metrics quarantined by the schema
+	errNotInSchema = errors.New("not in schema")
+	// errStopped is the reason of the metrics dispatched to a stopped output
+	errStopped = errors.New("metric output stopped")
 )
 
 // MetricOutputConfig alarmconfig
 type MetricOutputConfig struct {
-	Name   string
+	Name string
+	// Alias tells apart the instances of the plugin in the internal stats
+	Alias  string
 	Prefix string
 	Suffix string
 
 	MetricOutput MetricOutputer
 
 	Interval time.Duration
+
+	// Workers is the number of goroutines computing metrics for this output
+	Workers int
+
+	// FlushInterval buffers the metrics and writes them at every interval,
+	// when zero the metrics are written as soon as they arrive
+	FlushInterval time.Duration
+	// MetricBatchSize flushes the buffer as soon as it holds that many
+	// metrics, without waiting for the interval, and splits the flushes in
+	// writes of at most that many metrics. Zero flushes on the interval
+	// only, all the metrics at once
+	MetricBatchSize int
+
+	// CoalesceCycles keeps the batches of the gather cycles and writes them
+	// together once that many batches arrived, or MetricBatchSize metrics,
+	// or once the first one waited CoalesceMaxLatency, for the low volume
+	// outputs writing many small batches. Exclusive with FlushInterval
+	CoalesceCycles     int
+	CoalesceMaxLatency time.Duration
+
+	// WriteTimeout bounds the whole write of a flush, all its chunks and
+	// retries included, by default the flush interval. Past it the context
+	// of the write is cancelled and the metrics are kept for a retry. Only
+	// the outputs implementing ContextOutput can be cancelled
+	WriteTimeout time.Duration
+
+	// MetricBufferLimit is the number of failed metrics kept for a retry
+	MetricBufferLimit int
+	// DeadLetterFile receives the metrics dropped from the retry buffer
+	DeadLetterFile string
+	// DeadLetterMaxSize is the size in bytes the dead letter file is rotated at
+	DeadLetterMaxSize int64
+	// BufferFile keeps the metrics waiting for a flush or a retry in a bolt
+	// database instead of memory, so they survive a restart
+	BufferFile string
+	// CompactBuffer keeps the buffered metrics of a series with a single
+	// copy of its name and tags, for the outputs buffering many metrics of
+	// the same series. Ignored with BufferFile
+	CompactBuffer bool
+
+	// MetricsPerSecond caps the write rate of the output, shared by its
+	// workers. Zero means no limit
+	MetricsPerSecond int
+	// RateLimitWait is the longest a write waits for the rate limit, past
+	// it the metrics are kept for the next write
+	RateLimitWait time.Duration
+
+	// BreakerThreshold is the number of consecutive failed writes opening
+	// the circuit breaker. Zero disables it
+	BreakerThreshold int
+	// BreakerCooldown is how long the breaker stays open before a trial write
+	BreakerCooldown time.Duration
+	// BreakerDrop drops the metrics while the breaker is open instead of
+	// keeping them in the retry buffer
+	BreakerDrop bool
+
+	// SortByTime writes the metrics in time order, the metrics of the same
+	// time keep their arrival order
+	SortByTime bool
+
+	// DedupPoints keeps a single metric of the points of the same name,
+	// tags and time of a write, "first" or "last". Empty keeps them all
+	DedupPoints string
+
+	// DryRun logs the metrics instead of writing them, the outputs
+	// implementing DryRunOutput check their destination without modifying it
+	DryRun bool
+
+	// Precision truncates the times of the metrics, the metrics collapsing
+	// to the same point are merged. A nanosecond leaves them unchanged
+	Precision time.Duration
+
+	// SchemaFile is the allowlist of the metric names and their tag keys,
+	// the other metrics are dropped, or written to the QuarantineFile
+	SchemaFile string
+	// SchemaLearn adds the metrics seen to the schema file instead of
+	// dropping the ones not in it
+	SchemaLearn bool
+	// QuarantineFile receives the metrics rejected by the schema, rotated
+	// at DeadLetterMaxSize
+	QuarantineFile string
+
+	// signature identifies the config of the output
+	signature string
+	// instance names the output in the internal stats: its alias, or its
+	// name and its rank among the instances of the plugin
+	instance string
+
+	// failing is 1 when the last write failed, accessed atomically
+	failing int32
+	// active is the output of the last write: 0 for the output, i for the
+	// i-th failover, accessed atomically
+	active int32
+
+	stats   *PluginStats
+	limiter *RateLimiter
+	breaker *Breaker
+	// outputs are the output and its clones, closed on shutdown
+	outputs []MetricOutputer
+
+	// ctx is cancelled by Abort, it aborts the writes in flight
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// stop is handed to the outputs, which can send on it to stop
+	stop chan bool
+	// done is closed once the output is stopped
+	done     chan bool
+	doneOnce sync.Once
+
+	// coalesceC starts the latency timer on the first batch coalesced
+	coalesceC chan struct{}
+	// cycles is the number of batches coalesced, accessed atomically
+	cycles int32
+
+	queue      chan Metrics
+	flushC     chan struct{}
+	pending    MetricBuffer
+	retry      MetricBuffer
+	bufferDB   *bolt.DB
+	failovers  []*failover
+	deadLetter *DeadLetter
+	schema     *Schema
+	quarantine *DeadLetter
 }
 
-// Start init and start MetricOutputer service
+// Start init and start MetricOutputer service, it runs until stopC is
+// closed, Stop is called or the output sends on its stop channel.
 func (mc *MetricOutputConfig) Start(stopC chan bool) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -29,8 +175,618 @@ func (mc *MetricOutputConfig) Start(stopC chan bool) {
 		}
 	}()
 
-	mc.MetricOutput.Init(stopC)
+	instance := mc.instance
+	if instance == "" {
+		instance = mc.Name
+	}
+	mc.stats = OutputStats(mc.Name, instance)
+	if mc.MetricsPerSecond > 0 {
+		mc.limiter = NewRateLimiter(mc.MetricsPerSecond)
+	}
+	if mc.BreakerThreshold > 0 {
+		mc.breaker = NewBreaker(mc.BreakerThreshold, mc.BreakerCooldown)
+	}
+	if mc.BufferFile != "" {
+		db, err := OpenBufferDB(mc.BufferFile)
+		if err != nil {
+			VLogger.Fatal("metric output buffer file", zap.String("name", mc.Name), zap.Error(err))
+		}
+		mc.bufferDB = db
+	}
+	mc.retry = mc.newBuffer("retry")
+	if mc.DeadLetterFile != "" {
+		mc.deadLetter = NewDeadLetter(mc.DeadLetterFile, mc.DeadLetterMaxSize)
+	}
+	if mc.SchemaFile != "" {
+		schema, err := NewSchema(mc.SchemaFile, mc.SchemaLearn)
+		if err != nil {
+			VLogger.Fatal("metric output schema file", zap.String("name", mc.Name), zap.Error(err))
+		}
+		mc.schema = schema
+	}
+	if mc.QuarantineFile != "" {
+		mc.quarantine = NewDeadLetter(mc.QuarantineFile, mc.DeadLetterMaxSize)
+	}
+
+	mc.ctx, mc.cancel = context.WithCancel(context.Background())
+	mc.stop = make(chan bool, 1)
+	mc.done = make(chan bool)
+	go mc.watch(stopC)
+
+	setStats(mc.MetricOutput, mc.stats)
+	mc.MetricOutput.Init(mc.stop)
 	go mc.MetricOutput.Start()
+	mc.outputs = []MetricOutputer{mc.MetricOutput}
+	for _, f := range mc.failovers {
+		setStats(f.MetricOutput, mc.stats)
+		f.MetricOutput.Init(mc.stop)
+		go f.MetricOutput.Start()
+		mc.outputs = append(mc.outputs, f.MetricOutput)
+	}
+
+	if _, ok := mc.MetricOutput.(ContextOutput); !ok && mc.WriteTimeout > 0 {
+		VLogger.Warn("metric output can't be cancelled, write_timeout ignored", zap.String("name", mc.Name))
+	}
+
+	if mc.FlushInterval > 0 || mc.CoalesceCycles > 0 {
+		mc.pending = mc.newBuffer("pending")
+		mc.flushC = make(chan struct{}, 1)
+		if mc.CoalesceCycles > 0 {
+			mc.coalesceC = make(chan struct{}, 1)
+		}
+		go mc.flushLoop()
+	}
+
+	if mc.Workers <= 1 {
+		return
+	}
+
+	// workers drain a shared queue, each one with its own output when the
+	// output isn't safe for concurrent Compute calls
+	mc.queue = make(chan Metrics, mc.Workers)
+	for i := 0; i < mc.Workers; i++ {
+		mo := mc.MetricOutput
+		if cloner, ok := mo.(MetricOutputCloner); ok && i > 0 {
+			mo = cloner.Clone()
+			mo.Init(mc.stop)
+			go mo.Start()
+			mc.outputs = append(mc.outputs, mo)
+		}
+		go mc.work(mo)
+	}
+}
+
+// newBuffer returns a buffer of MetricBufferLimit metrics, kept in the bucket
+// of the buffer file when there is one.
+func (mc *MetricOutputConfig) newBuffer(bucket string) MetricBuffer {
+	if mc.bufferDB == nil {
+		if mc.CompactBuffer {
+			return NewCompactBuffer(mc.MetricBufferLimit)
+		}
+		return NewBuffer(mc.MetricBufferLimit)
+	}
+
+	b, err := NewDiskBuffer(mc.bufferDB, bucket, mc.MetricBufferLimit)
+	if err != nil {
+		VLogger.Fatal("metric output buffer file", zap.String("name", mc.Name), zap.Error(err))
+	}
+	if !b.IsEmpty() {
+		log.Printf("metric output %s restored %d %s metrics\n", mc.Name, b.Len(), bucket)
+	}
+	return b
+}
+
+// watch stops the output when the stream stops or the output asks for it.
+func (mc *MetricOutputConfig) watch(stopC chan bool) {
+	select {
+	case <-stopC:
+	case <-mc.stop:
+		VLogger.Warn("metric output stopped itself", zap.String("name", mc.Name))
+	case <-mc.done:
+	}
+	mc.halt()
+}
+
+// halt stops the workers and the flush loop.
+func (mc *MetricOutputConfig) halt() {
+	mc.doneOnce.Do(func() {
+		close(mc.done)
+	})
+}
+
+func (mc *MetricOutputConfig) stopped() bool {
+	select {
+	case <-mc.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (mc *MetricOutputConfig) work(mo MetricOutputer) {
+	for {
+		select {
+		case m := <-mc.queue:
+			mc.write(mo, m)
+		case <-mc.done:
+			return
+		}
+	}
+}
+
+// flushLoop flushes at every interval, or when the coalesced batches
+// waited CoalesceMaxLatency, and when Compute fills a batch, whichever
+// comes first.
+func (mc *MetricOutputConfig) flushLoop() {
+	var tick <-chan time.Time
+	if mc.FlushInterval > 0 {
+		ticker := FlushTicker(mc.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	// the latency timer runs from the first batch coalesced to the flush
+	latency := time.NewTimer(mc.CoalesceMaxLatency)
+	latency.Stop()
+	defer latency.Stop()
+
+	for {
+		select {
+		case <-tick:
+			mc.flush()
+		case <-mc.flushC:
+			// a latency fired meanwhile would flush the next batches early
+			if !latency.Stop() {
+				select {
+				case <-latency.C:
+				default:
+				}
+			}
+			mc.flush()
+		case <-mc.coalesceC:
+			latency.Reset(mc.CoalesceMaxLatency)
+		case <-latency.C:
+			mc.flush()
+		case <-mc.done:
+			return
+		}
+	}
+}
+
+// flush dispatches the metrics pending when it's called, by batches of
+// MetricBatchSize, or all at once without batch size.
+func (mc *MetricOutputConfig) flush() {
+	atomic.StoreInt32(&mc.cycles, 0)
+	n := mc.pending.Len()
+	for n > 0 {
+		size := n
+		if mc.MetricBatchSize > 0 && size > mc.MetricBatchSize {
+			size = mc.MetricBatchSize
+		}
+		batch := mc.pending.Batch(size)
+		if len(batch) == 0 {
+			return
+		}
+		n -= len(batch)
+		mc.dispatch(Metrics{Data: batch})
+	}
+}
+
+// Compute hands the metrics to the output, or keeps them until the next
+// flush when the output has a flush interval or coalesces the batches.
+func (mc *MetricOutputConfig) Compute(m Metrics) {
+	if mc.stopped() {
+		mc.stats.Dropped(len(m.Data))
+		return
+	}
+
+	if mc.schema != nil {
+		m = mc.applySchema(m)
+		if len(m.Data) == 0 {
+			return
+		}
+	}
+
+	if mc.pending != nil {
+		if dropped := mc.pending.Add(m.Data...); len(dropped) > 0 {
+			mc.stats.Dropped(len(dropped))
+			VLogger.Warn("metric output buffer full, metrics dropped", zap.String("name", mc.Name), zap.Int("count", len(dropped)))
+		}
+		if mc.CoalesceCycles > 0 {
+			mc.coalesce()
+		}
+		if mc.MetricBatchSize > 0 && mc.pending.Len() >= mc.MetricBatchSize {
+			mc.signal(mc.flushC)
+		}
+		return
+	}
+
+	mc.dispatch(m)
+}
+
+// coalesce counts the batch coalesced, it requests the flush on the
+// CoalesceCycles-th one and starts the latency timer on the first one.
+func (mc *MetricOutputConfig) coalesce() {
+	n := atomic.AddInt32(&mc.cycles, 1)
+	if int(n) >= mc.CoalesceCycles {
+		mc.signal(mc.flushC)
+	} else if n == 1 {
+		mc.signal(mc.coalesceC)
+	}
+}
+
+// signal sends on the channel unless a signal is already waiting.
+func (mc *MetricOutputConfig) signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// applySchema removes the metrics rejected by the schema, they're dropped or
+// quarantined. The metrics are shared by the outputs, so the allowed ones
+// are a new slice.
+func (mc *MetricOutputConfig) applySchema(m Metrics) Metrics {
+	allowed, rejected := mc.schema.Filter(m.Data)
+	m.Data = allowed
+	if len(rejected) == 0 {
+		return m
+	}
+
+	if mc.quarantine == nil {
+		mc.stats.Dropped(len(rejected))
+		return m
+	}
+	if err := mc.quarantine.Write(errNotInSchema, rejected); err != nil {
+		mc.stats.Dropped(len(rejected))
+		VLogger.Error("metric output quarantine", zap.String("name", mc.Name), zap.Error(err))
+	}
+	return m
+}
+
+// dispatch writes the metrics, through the workers queue when the output
+// has several workers.
+func (mc *MetricOutputConfig) dispatch(m Metrics) {
+	if mc.queue != nil {
+		// the workers are gone once the output is stopped, the metrics are
+		// kept for Drain
+		select {
+		case mc.queue <- m:
+		case <-mc.done:
+			mc.keep(errStopped, m.Data)
+			mc.ack(m.Data)
+		}
+		return
+	}
+
+	mc.write(mc.MetricOutput, m)
+}
+
+// write computes the metrics along with the ones of the previous failed
+// writes. On failure the metrics are kept for a retry, and the ones which
+// don't fit in the retry buffer anymore go to the dead letter file.
+func (mc *MetricOutputConfig) write(mo MetricOutputer, m Metrics) {
+	// the metrics taken from the buffer file stay in it until they're
+	// written, or kept again for a retry
+	defer func() { mc.ack(m.Data) }()
+
+	if mc.DryRun {
+		mc.dryRun(mo, m)
+		return
+	}
+
+	if !mc.retry.IsEmpty() {
+		m.Data = append(mc.retry.Batch(mc.retry.Len()), m.Data...)
+	}
+
+	defer mc.updateBufferSize()
+
+	if mc.breaker != nil && !mc.breaker.Allow() {
+		mc.reject(m.Data)
+		return
+	}
+
+	if mc.limiter == nil {
+		mc.compute(mo, m)
+		return
+	}
+
+	// with a rate limit the metrics are written by batches of at most one
+	// second of metrics, the ones over the limit are kept for the next write
+	data := m.Data
+	for len(data) > 0 {
+		n := min(len(data), mc.MetricsPerSecond)
+		if !mc.limiter.Wait(n, mc.RateLimitWait) {
+			VLogger.Debug("metric output rate limited", zap.String("name", mc.Name), zap.Int("count", len(data)))
+			mc.keep(errRateLimited, data)
+			return
+		}
+		if err := mc.compute(mo, Metrics{Data: data[:n], Interval: m.Interval}); err != nil {
+			mc.keep(err, data[n:])
+			return
+		}
+		data = data[n:]
+	}
+}
+
+// compute writes the metrics with the output, on failure the metrics are
+// kept for a retry and the error is returned.
+func (mc *MetricOutputConfig) compute(mo MetricOutputer, m Metrics) error {
+	if mc.DedupPoints != "" {
+		n := len(m.Data)
+		m.Data = dedupPoints(m.Data, mc.DedupPoints == "last")
+		if n > len(m.Data) {
+			VLogger.Debug("metric output duplicate points removed", zap.String("name", mc.Name), zap.Int("count", n-len(m.Data)))
+		}
+	}
+	if mc.SortByTime {
+		m.Data = sortByTime(m.Data)
+	}
+	if mc.Precision > time.Nanosecond {
+		m.Data = truncateTimes(m.Data, mc.Precision)
+	}
+
+	ctx, cancel := mc.writeContext()
+	defer cancel()
+
+	start := time.Now()
+	var err error
+	if co, ok := mo.(ContextOutput); ok {
+		err = co.ComputeContext(ctx, m)
+	} else {
+		err = mo.Compute(m)
+	}
+	mc.stats.SetFlushDuration(time.Since(start))
+	pe, partial := err.(*PartialWriteError)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("write timeout after %s, %s", time.Since(start), err)
+	}
+	mc.recordBreaker(err)
+
+	if err == nil {
+		atomic.StoreInt32(&mc.failing, 0)
+		mc.stats.Written(len(m.Data))
+		if mc.failovers != nil {
+			mc.setActive(0)
+		}
+		return nil
+	}
+	atomic.StoreInt32(&mc.failing, 1)
+	mc.stats.WriteError()
+	VLogger.Error("metric output compute", zap.String("name", mc.Name), zap.Error(err))
+
+	// the written metrics of a partial write aren't retried
+	if partial {
+		mc.stats.Written(len(m.Data) - len(pe.Metrics))
+		m.Data = pe.Metrics
+	}
+
+	if mc.writeFailovers(m) {
+		return nil
+	}
+	mc.keep(err, m.Data)
+	return err
+}
+
+// writeContext returns the context of a write, cancelled by Abort. The write
+// must end within WriteTimeout, or else with a flush interval before the
+// next flush.
+func (mc *MetricOutputConfig) writeContext() (context.Context, context.CancelFunc) {
+	if mc.WriteTimeout > 0 {
+		return context.WithTimeout(mc.ctx, mc.WriteTimeout)
+	}
+	if mc.FlushInterval > 0 {
+		return context.WithTimeout(mc.ctx, mc.FlushInterval)
+	}
+	return context.WithCancel(mc.ctx)
+}
+
+// Abort cancels the writes in flight, the outputs implementing
+// ContextOutput return at once. It's called when the final flush of the
+// shutdown times out.
+func (mc *MetricOutputConfig) Abort() {
+	if mc.cancel != nil {
+		mc.cancel()
+	}
+}
+
+// dryRunSample is the number of metrics logged by a dry run write
+const dryRunSample = 3
+
+// dryRun logs the metrics which would be written and checks the
+// destination of the output, if it can.
+func (mc *MetricOutputConfig) dryRun(mo MetricOutputer, m Metrics) {
+	sample := m.Data
+	if len(sample) > dryRunSample {
+		sample = sample[:dryRunSample]
+	}
+	fields := []zap.Field{zap.String("name", mc.Name), zap.Int("count", len(m.Data))}
+	for i, metric := range sample {
+		fields = append(fields, zap.Object(fmt.Sprintf("sample_%d", i), metric))
+	}
+	VLogger.Info("metric output dry run, metrics not written", fields...)
+
+	do, ok := mo.(DryRunOutput)
+	if !ok {
+		return
+	}
+	if err := do.CheckDestination(); err != nil {
+		atomic.StoreInt32(&mc.failing, 1)
+		VLogger.Error("metric output dry run, destination check failed", zap.String("name", mc.Name), zap.Error(err))
+		return
+	}
+	atomic.StoreInt32(&mc.failing, 0)
+}
+
+// sortByTime returns the metrics stable sorted by time. The metrics are
+// shared by the outputs, they're sorted in a copy.
+func sortByTime(metrics []*MetricData) []*MetricData {
+	sorted := make([]*MetricData, len(metrics))
+	copy(sorted, metrics)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Time.Before(sorted[j].Time)
+	})
+	return sorted
+}
+
+// recordBreaker records the write result in the breaker, if any.
+func (mc *MetricOutputConfig) recordBreaker(err error) {
+	if mc.breaker == nil {
+		return
+	}
+	prev := mc.breaker.State()
+	state := mc.breaker.Record(err == nil)
+	mc.stats.SetBreakerState(state)
+	if state != prev {
+		VLogger.Warn("metric output circuit breaker", zap.String("name", mc.Name), zap.String("state", state.String()))
+	}
+}
+
+// reject handles the metrics of a write refused by the open breaker: they go
+// to the failovers, else they're kept for a retry, or dropped with
+// BreakerDrop.
+func (mc *MetricOutputConfig) reject(metrics []*MetricData) {
+	if mc.writeFailovers(Metrics{Data: metrics}) {
+		return
+	}
+	if mc.BreakerDrop {
+		mc.stats.Dropped(len(metrics))
+		return
+	}
+	mc.keep(errBreakerOpen, metrics)
+}
+
+// keep adds the unwritten metrics to the retry buffer, the ones which don't
+// fit anymore go to the dead letter file.
+func (mc *MetricOutputConfig) keep(err error, metrics []*MetricData) {
+	if len(metrics) == 0 {
+		return
+	}
+	dropped := mc.retry.Add(metrics...)
+	if len(dropped) == 0 {
+		return
+	}
+	if mc.deadLetter == nil {
+		mc.stats.Dropped(len(dropped))
+		VLogger.Warn("metric output buffer full, metrics dropped", zap.String("name", mc.Name), zap.Int("count", len(dropped)))
+		return
+	}
+	if err := mc.deadLetter.Write(err, dropped); err != nil {
+		VLogger.Error("metric output dead letter", zap.String("name", mc.Name), zap.Error(err))
+	}
+}
+
+// ack removes the metrics from the buffer file, if any.
+func (mc *MetricOutputConfig) ack(metrics []*MetricData) {
+	if mc.bufferDB == nil {
+		return
+	}
+	for _, b := range []MetricBuffer{mc.pending, mc.retry} {
+		if db, ok := b.(*DiskBuffer); ok {
+			db.Ack(metrics)
+		}
+	}
+}
+
+// updateBufferSize records the number of metrics waiting to be written.
+func (mc *MetricOutputConfig) updateBufferSize() {
+	n := mc.retry.Len()
+	if mc.pending != nil {
+		n += mc.pending.Len()
+	}
+	mc.stats.SetBufferSize(n)
+}
+
+// Healthy reports whether the last write of the output succeeded.
+func (mc *MetricOutputConfig) Healthy() bool {
+	return atomic.LoadInt32(&mc.failing) == 0
+}
+
+// Stop stops the output alone, it writes what the output buffers and closes
+// it.
+func (mc *MetricOutputConfig) Stop() error {
+	mc.halt()
+	mc.Drain()
+	return mc.Close()
+}
+
+// Drain writes at once the metrics still queued, waiting for the next flush
+// or for a retry. It's called on shutdown, once the workers and the flush
+// loop are stopped. The metrics which still fail go to the dead letter file,
+// or stay in the buffer file for the next start.
+func (mc *MetricOutputConfig) Drain() {
+	m := Metrics{}
+	if mc.queue != nil {
+	queue:
+		for {
+			select {
+			case q := <-mc.queue:
+				m.Data = append(m.Data, q.Data...)
+			default:
+				break queue
+			}
+		}
+	}
+	if mc.pending != nil {
+		m.Data = append(m.Data, mc.pending.Batch(mc.pending.Len())...)
+	}
+
+	if len(m.Data) == 0 && mc.retry.IsEmpty() {
+		return
+	}
+	mc.write(mc.MetricOutput, m)
+
+	if mc.retry.IsEmpty() || mc.bufferDB != nil {
+		return
+	}
+	lost := mc.retry.Batch(mc.retry.Len())
+	if mc.deadLetter == nil {
+		mc.stats.Dropped(len(lost))
+		VLogger.Warn("metric output shutdown, metrics dropped", zap.String("name", mc.Name), zap.Int("count", len(lost)))
+		return
+	}
+	if err := mc.deadLetter.Write(errors.New("shutdown"), lost); err != nil {
+		VLogger.Error("metric output dead letter", zap.String("name", mc.Name), zap.Error(err))
+	}
+}
+
+// Close closes the output, its clones and the resources of the output
+// wrapper, the writes still in flight are aborted. The outputs implementing
+// io.Closer are closed.
+func (mc *MetricOutputConfig) Close() error {
+	mc.Abort()
+
+	var errS string
+	for _, mo := range mc.outputs {
+		if c, ok := mo.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				errS += err.Error() + " "
+			}
+		}
+	}
+
+	if mc.deadLetter != nil {
+		if err := mc.deadLetter.Close(); err != nil {
+			errS += err.Error() + " "
+		}
+	}
+
+	if mc.quarantine != nil {
+		if err := mc.quarantine.Close(); err != nil {
+			errS += err.Error() + " "
+		}
+	}
+
+	if mc.bufferDB != nil {
+		if err := mc.bufferDB.Close(); err != nil {
+			errS += err.Error()
+		}
+	}
+
+	if errS != "" {
+		return fmt.Errorf("metric output %s close failed: %s", mc.Name, errS)
+	}
+	return nil
 }
 
 // Show show struct message
@@ -39,6 +795,27 @@ func (mc *MetricOutputConfig) Show() {
 	log.Println("Prefix is ", mc.Prefix)
 	log.Println("Suffix is ", mc.Suffix)
 	log.Println("Interval is ", mc.Interval)
+	log.Println("Workers is ", mc.Workers)
+	log.Println("FlushInterval is ", mc.FlushInterval)
+	log.Println("WriteTimeout is ", mc.WriteTimeout)
+	log.Println("MetricBufferLimit is ", mc.MetricBufferLimit)
+	log.Println("DeadLetterFile is ", mc.DeadLetterFile)
+	log.Println("MetricBatchSize is ", mc.MetricBatchSize)
+	log.Println("CoalesceCycles is ", mc.CoalesceCycles)
+	log.Println("CoalesceMaxLatency is ", mc.CoalesceMaxLatency)
+	log.Println("BufferFile is ", mc.BufferFile)
+	log.Println("CompactBuffer is ", mc.CompactBuffer)
+	log.Println("SchemaFile is ", mc.SchemaFile)
+	log.Println("SchemaLearn is ", mc.SchemaLearn)
+	log.Println("QuarantineFile is ", mc.QuarantineFile)
+	for _, f := range mc.failovers {
+		log.Println("Failover is ", f.Name)
+	}
+	log.Println("MetricsPerSecond is ", mc.MetricsPerSecond)
+	log.Println("BreakerThreshold is ", mc.BreakerThreshold)
+	log.Println("Precision is ", mc.Precision)
+	log.Println("DedupPoints is ", mc.DedupPoints)
+	log.Println("DryRun is ", mc.DryRun)
 	log.Printf("Inputer is %v\n", mc.MetricOutput)
 }
 
@@ -54,9 +831,241 @@ type MetricOutputer interface {
 	Compute(Metrics) error
 }
 
+// ContextOutput is implemented by the metric outputs whose writes can be
+// cancelled. The context is done when the write exceeds the write timeout,
+// by default the flush interval, or when the shutdown aborts it.
+type ContextOutput interface {
+	ComputeContext(ctx context.Context, metrics Metrics) error
+}
+
+// PartialWriteError is returned by the metric outputs which wrote some of
+// the metrics of a write, only its Metrics weren't written and are retried.
+type PartialWriteError struct {
+	Err     error
+	Metrics []*MetricData
+}
+
+func (e *PartialWriteError) Error() string {
+	return e.Err.Error()
+}
+
+// DryRunOutput is implemented by the metric outputs which can check their
+// destination is reachable and ready without writing to it.
+type DryRunOutput interface {
+	// SetDryRun is called before Init, a dry run output mustn't modify its
+	// destination, not even at startup
+	SetDryRun(dryRun bool)
+	// CheckDestination checks the destination without modifying it
+	CheckDestination() error
+}
+
+// StatsSetter is implemented by the outputs which drop metrics themselves,
+// they count them in the stats of their instance.
+type StatsSetter interface {
+	SetStats(stats *PluginStats)
+}
+
+func setStats(mo MetricOutputer, stats *PluginStats) {
+	if s, ok := mo.(StatsSetter); ok {
+		s.SetStats(stats)
+	}
+}
+
+// MetricOutputCloner is implemented by the outputs which can't be shared by
+// concurrent workers, every extra worker gets its own clone.
+type MetricOutputCloner interface {
+	Clone() MetricOutputer
+}
+
 // buildMetricOutput parses MetricOutput specific items from the ast.Table,
 func buildMetricOutput(name string, tbl *ast.Table) (*MetricOutputConfig, error) {
-	ac := &MetricOutputConfig{Name: name}
+	ac := &MetricOutputConfig{
+		Name:              name,
+		MetricBufferLimit: 10000,
+		RateLimitWait:     time.Second,
+		BreakerCooldown:   30 * time.Second,
+		Precision:         time.Nanosecond,
+
+		CoalesceMaxLatency: 10 * time.Second,
+	}
+
+	if s, ok, err := tableString(tbl, "alias"); err != nil {
+		return nil, err
+	} else if ok {
+		ac.Alias = s
+	}
+
+	if i, ok, err := tableInt(tbl, "workers"); err != nil {
+		return nil, err
+	} else if ok {
+		ac.Workers = int(i)
+	}
+
+	if i, ok, err := tableInt(tbl, "metrics_per_second"); err != nil {
+		return nil, err
+	} else if ok {
+		ac.MetricsPerSecond = int(i)
+	}
+
+	if d, ok, err := tableDuration(tbl, "rate_limit_wait"); err != nil {
+		return nil, err
+	} else if ok {
+		ac.RateLimitWait = d
+	}
+
+	if b, ok, err := tableBool(tbl, "sort_by_time"); err != nil {
+		return nil, err
+	} else if ok {
+		ac.SortByTime = b
+	}
+
+	if s, ok, err := tableString(tbl, "dedup_points"); err != nil {
+		return nil, err
+	} else if ok {
+		switch s {
+		case "", "first", "last":
+			ac.DedupPoints = s
+		default:
+			return nil, fmt.Errorf("invalid dedup_points %s, can be: \"first\", \"last\"", s)
+		}
+	}
+
+	if b, ok, err := tableBool(tbl, "dry_run"); err != nil {
+		return nil, err
+	} else if ok {
+		ac.DryRun = b
+	}
+
+	if s, ok, err := tableString(tbl, "precision"); err != nil {
+		return nil, err
+	} else if ok {
+		d, err := ParsePrecision(s)
+		if err != nil {
+			return nil, err
+		}
+		ac.Precision = d
+	}
+
+	if i, ok, err := tableInt(tbl, "breaker_threshold"); err != nil {
+		return nil, err
+	} else if ok {
+		ac.BreakerThreshold = int(i)
+	}
+
+	if d, ok, err := tableDuration(tbl, "breaker_cooldown"); err != nil {
+		return nil, err
+	} else if ok {
+		ac.BreakerCooldown = d
+	}
+
+	if s, ok, err := tableString(tbl, "breaker_policy"); err != nil {
+		return nil, err
+	} else if ok {
+		switch s {
+		case "buffer":
+		case "drop":
+			ac.BreakerDrop = true
+		default:
+			return nil, fmt.Errorf("invalid breaker_policy %s, can be: \"buffer\", \"drop\"", s)
+		}
+	}
+
+	if d, ok, err := tableDuration(tbl, "flush_interval"); err != nil {
+		return nil, err
+	} else if ok {
+		ac.FlushInterval = d
+	}
+
+	if i, ok, err := tableInt(tbl, "metric_batch_size"); err != nil {
+		return nil, err
+	} else if ok {
+		if i < 0 {
+			return nil, fmt.Errorf("invalid metric_batch_size %d", i)
+		}
+		ac.MetricBatchSize = int(i)
+	}
+
+	if i, ok, err := tableInt(tbl, "coalesce_cycles"); err != nil {
+		return nil, err
+	} else if ok {
+		if i < 0 {
+			return nil, fmt.Errorf("invalid coalesce_cycles %d", i)
+		}
+		if i > 0 && ac.FlushInterval > 0 {
+			return nil, errors.New("coalesce_cycles and flush_interval are exclusive")
+		}
+		ac.CoalesceCycles = int(i)
+	}
+
+	if d, ok, err := tableDuration(tbl, "coalesce_max_latency"); err != nil {
+		return nil, err
+	} else if ok {
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid coalesce_max_latency %s", d)
+		}
+		ac.CoalesceMaxLatency = d
+	}
+
+	if d, ok, err := tableDuration(tbl, "write_timeout"); err != nil {
+		return nil, err
+	} else if ok {
+		if d < 0 {
+			return nil, fmt.Errorf("invalid write_timeout %s", d)
+		}
+		ac.WriteTimeout = d
+	}
+
+	if i, ok, err := tableInt(tbl, "metric_buffer_limit"); err != nil {
+		return nil, err
+	} else if ok {
+		// the buffer is a chan, unbuffered it would block the first Add
+		if i < 1 {
+			return nil, fmt.Errorf("invalid metric_buffer_limit %d, must be at least 1", i)
+		}
+		ac.MetricBufferLimit = int(i)
+	}
+
+	if s, ok, err := tableString(tbl, "buffer_file"); err != nil {
+		return nil, err
+	} else if ok {
+		ac.BufferFile = s
+	}
+
+	if b, ok, err := tableBool(tbl, "compact_buffer"); err != nil {
+		return nil, err
+	} else if ok {
+		ac.CompactBuffer = b
+	}
+
+	if s, ok, err := tableString(tbl, "schema_file"); err != nil {
+		return nil, err
+	} else if ok {
+		ac.SchemaFile = s
+	}
+
+	if b, ok, err := tableBool(tbl, "schema_learn"); err != nil {
+		return nil, err
+	} else if ok {
+		ac.SchemaLearn = b
+	}
+
+	if s, ok, err := tableString(tbl, "quarantine_file"); err != nil {
+		return nil, err
+	} else if ok {
+		ac.QuarantineFile = s
+	}
+
+	if s, ok, err := tableString(tbl, "dead_letter_file"); err != nil {
+		return nil, err
+	} else if ok {
+		ac.DeadLetterFile = s
+	}
+
+	if i, ok, err := tableInt(tbl, "dead_letter_max_size"); err != nil {
+		return nil, err
+	} else if ok {
+		ac.DeadLetterMaxSize = i
+	}
 
 	return ac, nil
 }
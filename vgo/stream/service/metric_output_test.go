@@ -0,0 +1,397 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/naoina/toml"
+	"github.com/uber-go/zap"
+)
+
+func init() {
+	VLogger = zap.New(zap.NewJSONEncoder(), zap.Output(zap.AddSync(ioutil.Discard)))
+	setConf(newConfig())
+}
+
+// mockOutput records the metrics it writes, it fails while fail is set and
+// takes delay to write.
+type mockOutput struct {
+	delay time.Duration
+
+	sync.Mutex
+	fail    bool
+	writes  int
+	metrics []*MetricData
+}
+
+func (o *mockOutput) Init(chan bool) {}
+func (o *mockOutput) Start()         {}
+
+func (o *mockOutput) Compute(m Metrics) error {
+	if o.delay > 0 {
+		time.Sleep(o.delay)
+	}
+	o.Lock()
+	defer o.Unlock()
+	o.writes++
+	if o.fail {
+		return errors.New("mock output failure")
+	}
+	o.metrics = append(o.metrics, m.Data...)
+	return nil
+}
+
+func (o *mockOutput) setFail(fail bool) {
+	o.Lock()
+	o.fail = fail
+	o.Unlock()
+}
+
+// written returns the number of metrics written.
+func (o *mockOutput) written() int {
+	o.Lock()
+	defer o.Unlock()
+	return len(o.metrics)
+}
+
+// testMetrics returns n metrics of the cpu measurement, a second apart.
+func testMetrics(n int) []*MetricData {
+	start := time.Unix(1500000000, 0)
+	metrics := make([]*MetricData, n)
+	for i := range metrics {
+		metrics[i] = &MetricData{
+			Name:   "cpu",
+			Tags:   map[string]string{"host": fmt.Sprintf("server%02d", i%10)},
+			Fields: map[string]interface{}{"value": float64(i)},
+			Time:   start.Add(time.Duration(i) * time.Second),
+		}
+	}
+	return metrics
+}
+
+// startOutput starts the output config with the defaults of the config
+// file, the returned func stops it.
+func startOutput(mc *MetricOutputConfig) func() {
+	if mc.Name == "" {
+		mc.Name = "test"
+	}
+	if mc.MetricBufferLimit == 0 {
+		mc.MetricBufferLimit = 10000
+	}
+	if mc.Precision == 0 {
+		mc.Precision = time.Nanosecond
+	}
+	stopC := make(chan bool)
+	mc.Start(stopC)
+	return func() {
+		close(stopC)
+		mc.halt()
+	}
+}
+
+// waitFor polls cond until it's true or the timeout elapsed.
+func waitFor(t testing.TB, timeout time.Duration, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met within %s", timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func benchmarkWorkers(b *testing.B, workers int) {
+	mo := &mockOutput{delay: time.Millisecond}
+	mc := &MetricOutputConfig{MetricOutput: mo, Workers: workers}
+	defer startOutput(mc)()
+
+	batch := testMetrics(100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mc.Compute(Metrics{Data: batch})
+	}
+	waitFor(b, 10*time.Second, func() bool { return mo.written() == b.N*len(batch) })
+}
+
+// the writes of the mock output take a millisecond, like the round trip of
+// a network write, the workers overlap them
+func BenchmarkWorkers1(b *testing.B) { benchmarkWorkers(b, 1) }
+func BenchmarkWorkers4(b *testing.B) { benchmarkWorkers(b, 4) }
+func BenchmarkWorkers8(b *testing.B) { benchmarkWorkers(b, 8) }
+
+// closingOutput records the metrics written when it's closed.
+type closingOutput struct {
+	mockOutput
+	closed         bool
+	writtenAtClose int
+}
+
+func (o *closingOutput) Close() error {
+	o.Lock()
+	defer o.Unlock()
+	o.closed = true
+	o.writtenAtClose = len(o.metrics)
+	return nil
+}
+
+func TestStopFlushesBeforeClose(t *testing.T) {
+	mo := &closingOutput{}
+	mc := &MetricOutputConfig{MetricOutput: mo, FlushInterval: time.Hour}
+	defer startOutput(mc)()
+
+	// buffered until the next flush, an hour from now
+	mc.Compute(Metrics{Data: testMetrics(5)})
+	if mo.written() != 0 {
+		t.Fatal("metrics written before the flush")
+	}
+
+	if err := mc.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if !mo.closed {
+		t.Fatal("output not closed")
+	}
+	if mo.writtenAtClose != 5 {
+		t.Errorf("%d metrics written before Close, want 5", mo.writtenAtClose)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	mo := &closingOutput{}
+	mc := &MetricOutputConfig{MetricOutput: mo, FlushInterval: time.Hour}
+	defer startOutput(mc)()
+
+	// a failed write is kept for a retry
+	mo.setFail(true)
+	mc.dispatch(Metrics{Data: testMetrics(2)})
+	mo.setFail(false)
+	mc.Compute(Metrics{Data: testMetrics(3)})
+
+	// the shutdown stops the flush loop, then drains the buffers
+	mc.halt()
+	mc.Drain()
+	if err := mc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if mo.writtenAtClose != 5 {
+		t.Errorf("%d metrics written before Close, want the 2 retried and the 3 pending", mo.writtenAtClose)
+	}
+	if !mc.retry.IsEmpty() || mc.pending.Len() != 0 {
+		t.Error("metrics left in the buffers")
+	}
+}
+
+func TestDrainFailure(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "dead_letter")
+
+	mo := &closingOutput{}
+	mo.fail = true
+	mc := &MetricOutputConfig{MetricOutput: mo, FlushInterval: time.Hour, DeadLetterFile: path}
+	defer startOutput(mc)()
+
+	mc.Compute(Metrics{Data: testMetrics(3)})
+	if err := mc.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the metrics the output still fails to write are kept in the dead
+	// letter file
+	replayed := &mockOutput{}
+	if err := ReplayDeadLetter(path, replayed); err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed.metrics) != 3 {
+		t.Errorf("%d metrics in the dead letter file, want 3", len(replayed.metrics))
+	}
+}
+
+func TestSortByTime(t *testing.T) {
+	at := func(sec int64, host string) *MetricData {
+		return &MetricData{Name: "cpu", Tags: map[string]string{"host": host}, Time: time.Unix(sec, 0)}
+	}
+	metrics := []*MetricData{at(3, "a"), at(1, "b"), at(2, "c"), at(1, "d"), at(3, "e"), at(1, "f")}
+
+	mo := &mockOutput{}
+	mc := &MetricOutputConfig{MetricOutput: mo, SortByTime: true}
+	defer startOutput(mc)()
+	mc.dispatch(Metrics{Data: metrics})
+
+	// the equal timestamps keep their order
+	var got []string
+	for _, m := range mo.metrics {
+		got = append(got, fmt.Sprintf("%d%s", m.Time.Unix(), m.Tags["host"]))
+	}
+	if want := "[1b 1d 1f 2c 3a 3e]"; fmt.Sprint(got) != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+	if metrics[0].Tags["host"] != "a" {
+		t.Error("batch shared with the other outputs sorted in place")
+	}
+}
+
+// writeCount returns the number of writes.
+func (o *mockOutput) writeCount() int {
+	o.Lock()
+	defer o.Unlock()
+	return o.writes
+}
+
+func TestBatchSizeFlush(t *testing.T) {
+	mo := &mockOutput{}
+	mc := &MetricOutputConfig{MetricOutput: mo, FlushInterval: time.Hour, MetricBatchSize: 10}
+	defer startOutput(mc)()
+
+	// below the batch size, kept until the interval
+	mc.Compute(Metrics{Data: testMetrics(5)})
+	time.Sleep(50 * time.Millisecond)
+	if n := mo.written(); n != 0 {
+		t.Fatalf("wrote %d metrics below the batch size", n)
+	}
+
+	// the batch is full, flushed without waiting for the interval
+	mc.Compute(Metrics{Data: testMetrics(5)})
+	waitFor(t, time.Second, func() bool { return mo.written() == 10 })
+	if n := mo.writeCount(); n != 1 {
+		t.Errorf("got %d writes, want 1", n)
+	}
+
+	// a burst is written by batches of the batch size
+	mc.Compute(Metrics{Data: testMetrics(25)})
+	waitFor(t, time.Second, func() bool { return mo.written() == 35 })
+	if n := mo.writeCount(); n != 4 {
+		t.Errorf("got %d writes, want the burst in 3", n-1)
+	}
+}
+
+func TestBatchSizeInterval(t *testing.T) {
+	mo := &mockOutput{}
+	mc := &MetricOutputConfig{MetricOutput: mo, FlushInterval: 20 * time.Millisecond, MetricBatchSize: 100}
+	defer startOutput(mc)()
+
+	// never filling a batch, flushed on the interval
+	mc.Compute(Metrics{Data: testMetrics(5)})
+	waitFor(t, time.Second, func() bool { return mo.written() == 5 })
+}
+
+func TestBatchSizeConfig(t *testing.T) {
+	for _, tt := range []struct {
+		conf string
+		err  bool
+	}{
+		{"metric_batch_size = 1000", false},
+		{"metric_batch_size = 0", false},
+		{"metric_batch_size = -1", true},
+	} {
+		tbl, err := toml.Parse([]byte(tt.conf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = buildMetricOutput("test", tbl)
+		if (err != nil) != tt.err {
+			t.Errorf("%s, got error %v", tt.conf, err)
+		}
+	}
+}
+
+func TestOptionTypes(t *testing.T) {
+	for _, conf := range []string{
+		`workers = "4"`,
+		`sort_by_time = "true"`,
+		`rate_limit_wait = 1`,
+		`precision = 1`,
+		`data_format = 1`,
+	} {
+		tbl, err := toml.Parse([]byte(conf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := buildMetricOutput("test", tbl); err == nil {
+			if _, err := buildSerializer(tbl); err == nil {
+				t.Errorf("%s accepted", conf)
+			}
+		}
+	}
+}
+
+// partialOutput writes the metrics of even index only, the first time
+type partialOutput struct {
+	mockOutput
+}
+
+func (o *partialOutput) Compute(m Metrics) error {
+	o.Lock()
+	defer o.Unlock()
+	o.writes++
+	if o.writes > 1 {
+		o.metrics = append(o.metrics, m.Data...)
+		return nil
+	}
+	var failed []*MetricData
+	for i, metric := range m.Data {
+		if i%2 == 0 {
+			o.metrics = append(o.metrics, metric)
+		} else {
+			failed = append(failed, metric)
+		}
+	}
+	return &PartialWriteError{Err: errors.New("mock partial write"), Metrics: failed}
+}
+
+func TestPartialWriteRetried(t *testing.T) {
+	mo := &partialOutput{}
+	mc := &MetricOutputConfig{MetricOutput: mo}
+	defer startOutput(mc)()
+
+	batch := testMetrics(6)
+	mc.Compute(Metrics{Data: batch})
+	if n := mc.retry.Len(); n != 3 {
+		t.Fatalf("got %d metrics kept, want the 3 failed", n)
+	}
+
+	// the written ones aren't written twice
+	mc.Compute(Metrics{})
+	if mo.written() != 6 {
+		t.Errorf("got %d metrics written, want 6", mo.written())
+	}
+	seen := make(map[*MetricData]bool)
+	for _, m := range mo.metrics {
+		if seen[m] {
+			t.Errorf("metric %v written twice", m)
+		}
+		seen[m] = true
+	}
+}
+
+func TestDispatchAfterStop(t *testing.T) {
+	mo := &mockOutput{}
+	mc := &MetricOutputConfig{MetricOutput: mo, Workers: 2}
+	defer startOutput(mc)()
+	mc.halt()
+
+	// the workers are gone, the queue fills up
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 5; i++ {
+			mc.dispatch(Metrics{Data: testMetrics(1)})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dispatch blocked on the stopped output")
+	}
+
+	// the queued and the kept metrics are written by Drain
+	mc.Drain()
+	if n := mo.written(); n != 5 {
+		t.Errorf("got %d metrics written, want 5", n)
+	}
+}
@@ -16,6 +16,9 @@ type Output struct {
 	Name string
 
 	Output Outputer
+
+	// signature identifies the config of the output
+	signature string
 }
 
 type Alarm struct {
@@ -27,6 +30,29 @@ func (o *Output) Write(alarm *Alarm) {
 	o.Output.Write(alarm)
 }
 
+// WriteAlarm writes the alarm to the named alarm outputs, to all of them
+// when names is empty. It returns the names not configured.
+func WriteAlarm(names []string, alarm *Alarm) []string {
+	outputs := currentConf().Outputs
+	if len(names) == 0 {
+		for _, o := range outputs {
+			o.Write(alarm)
+		}
+		return nil
+	}
+
+	var missing []string
+	for _, name := range names {
+		o, ok := outputs[name]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		o.Write(alarm)
+	}
+	return missing
+}
+
 var Outputs = map[string]Outputer{}
 
 func AddOutput(n string, op Outputer) {
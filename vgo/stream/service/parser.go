@@ -0,0 +1,92 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/naoina/toml/ast"
+)
+
+// Parser turns the bytes received by the inputs into metrics.
+type Parser interface {
+	// Parse takes a byte buffer holding one or several metrics
+	// and parses it into metrics
+	Parse(buf []byte) ([]*MetricData, error)
+
+	// ParseLine takes a single string metric and parses it into a metric
+	ParseLine(line string) (*MetricData, error)
+}
+
+// ParserCreator returns a new Parser.
+type ParserCreator func() Parser
+
+var Parsers = map[string]ParserCreator{}
+
+func AddParser(name string, creator ParserCreator) {
+	Parsers[name] = creator
+}
+
+// NewParser returns a new Parser of the given data format.
+func NewParser(name string) (Parser, error) {
+	creator, ok := Parsers[name]
+	if !ok {
+		return nil, fmt.Errorf("no parser %v available", name)
+	}
+	return creator(), nil
+}
+
+// ParserInput is an interface for inputs that are able to parse
+// arbitrary data formats.
+type ParserInput interface {
+	// SetParser sets the parser function for the interface
+	SetParser(parser Parser)
+}
+
+// NestedSetter is implemented by the parsers of the formats with nested
+// values, such as json: "drop" drops the nested values, "keep" keeps them
+// for the processors and "flatten" flattens them like FlattenFields.
+type NestedSetter interface {
+	SetNested(mode string)
+}
+
+// buildParser creates the parser of the data_format option of the table,
+// "influx" by default.
+func buildParser(tbl *ast.Table) (Parser, error) {
+	name, ok, err := tableString(tbl, "data_format")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		name = "influx"
+	}
+	parser, err := NewParser(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := setTimestampUnits(tbl, name, parser); err != nil {
+		return nil, err
+	}
+	if err := setNested(tbl, name, parser); err != nil {
+		return nil, err
+	}
+	return parser, nil
+}
+
+// setNested sets the json_nested option of the table to the parser p.
+func setNested(tbl *ast.Table, name string, p Parser) error {
+	mode, ok, err := tableString(tbl, "json_nested")
+	if !ok {
+		return err
+	}
+	switch mode {
+	case "drop", "keep", "flatten":
+	default:
+		return fmt.Errorf("invalid json_nested %s, can be: drop, keep, flatten", mode)
+	}
+
+	s, ok := p.(NestedSetter)
+	if !ok {
+		return fmt.Errorf("json_nested isn't supported by the %s data format", name)
+	}
+	s.SetNested(mode)
+	return nil
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/naoina/toml"
+)
+
+type nestedParser struct {
+	nested string
+}
+
+func (p *nestedParser) Parse([]byte) ([]*MetricData, error)   { return nil, nil }
+func (p *nestedParser) ParseLine(string) (*MetricData, error) { return nil, nil }
+func (p *nestedParser) SetNested(mode string)                 { p.nested = mode }
+
+type plainParser struct{}
+
+func (p *plainParser) Parse([]byte) ([]*MetricData, error)   { return nil, nil }
+func (p *plainParser) ParseLine(string) (*MetricData, error) { return nil, nil }
+
+func TestBuildParser(t *testing.T) {
+	AddParser("test_nested", func() Parser { return &nestedParser{nested: "drop"} })
+	AddParser("test_plain", func() Parser { return &plainParser{} })
+
+	for _, tt := range []struct {
+		conf   string
+		nested string
+		err    bool
+	}{
+		{`data_format = "test_nested"`, "drop", false},
+		{`data_format = "test_nested"` + "\n" + `json_nested = "keep"`, "keep", false},
+		{`data_format = "test_nested"` + "\n" + `json_nested = "flatten"`, "flatten", false},
+		{`data_format = "test_nested"` + "\n" + `json_nested = "merge"`, "", true},
+		{`data_format = "test_plain"` + "\n" + `json_nested = "keep"`, "", true},
+		{`data_format = "test_plain"`, "", false},
+	} {
+		tbl, err := toml.Parse([]byte(tt.conf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := buildParser(tbl)
+		if (err != nil) != tt.err {
+			t.Errorf("%q, got error %v", tt.conf, err)
+			continue
+		}
+		if np, ok := p.(*nestedParser); ok && np.nested != tt.nested {
+			t.Errorf("%q, got nested %s, want %s", tt.conf, np.nested, tt.nested)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/naoina/toml"
+	"github.com/naoina/toml/ast"
+)
+
+// PipelineConfig lists the processors in the order they run, by their id:
+// the id option of the processor table, or else the processor name. Without
+// a pipeline the processors run in the order of the config file.
+type PipelineConfig struct {
+	Processors []string
+}
+
+// parsePipeline orders the processors by the pipeline table, it fails the
+// config loading when the pipeline doesn't list every processor exactly
+// once.
+func (c *Config) parsePipeline(tbl *ast.Table) error {
+	val, ok := tbl.Fields["pipeline"]
+	if !ok {
+		return nil
+	}
+	subTbl, ok := val.(*ast.Table)
+	if !ok {
+		return fmt.Errorf("pipeline parse error: %v", val)
+	}
+
+	pipeline := &PipelineConfig{}
+	if err := toml.UnmarshalTable(subTbl, pipeline); err != nil {
+		return fmt.Errorf("parse pipeline, %s", err)
+	}
+
+	processors, err := orderProcessors(c.Processors, pipeline.Processors)
+	if err != nil {
+		return fmt.Errorf("pipeline, %s", err)
+	}
+	c.Processors = processors
+	return nil
+}
+
+// orderProcessors returns the processors in the order of the ids.
+func orderProcessors(processors []*ProcessorConfig, ids []string) ([]*ProcessorConfig, error) {
+	byID := make(map[string]*ProcessorConfig, len(processors))
+	for _, pc := range processors {
+		if _, ok := byID[pc.ID]; ok {
+			return nil, fmt.Errorf("several processors have the id %s, set a distinct id to each of them", pc.ID)
+		}
+		byID[pc.ID] = pc
+	}
+
+	ordered := make([]*ProcessorConfig, 0, len(ids))
+	for _, id := range ids {
+		pc, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("no processor %s, or listed twice", id)
+		}
+		delete(byID, id)
+		ordered = append(ordered, pc)
+	}
+
+	// a processor left out would silently not run, like an anonymize
+	// letting the sensitive tags through
+	for _, pc := range processors {
+		if _, ok := byID[pc.ID]; ok {
+			return nil, fmt.Errorf("processor %s isn't in the pipeline", pc.ID)
+		}
+	}
+	return ordered, nil
+}
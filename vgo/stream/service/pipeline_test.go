@@ -0,0 +1,134 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/naoina/toml"
+)
+
+// suffixProcessor appends its suffix to the metric names
+type suffixProcessor struct {
+	Suffix string
+}
+
+func (p *suffixProcessor) Init() error { return nil }
+
+func (p *suffixProcessor) Apply(metrics []*MetricData) []*MetricData {
+	for _, m := range metrics {
+		m.Name += p.Suffix
+	}
+	return metrics
+}
+
+// onlyProcessor keeps the metrics of its names
+type onlyProcessor struct {
+	Names []string
+}
+
+func (p *onlyProcessor) Init() error { return nil }
+
+func (p *onlyProcessor) Apply(metrics []*MetricData) []*MetricData {
+	out := metrics[:0]
+	for _, m := range metrics {
+		for _, name := range p.Names {
+			if m.Name == name {
+				out = append(out, m)
+				break
+			}
+		}
+	}
+	return out
+}
+
+func init() {
+	AddProcessor("test_suffix", func() Processor { return &suffixProcessor{} })
+	AddProcessor("test_only", func() Processor { return &onlyProcessor{} })
+}
+
+// pipelineConfig parses the plugins of the config.
+func pipelineConfig(conf string) (*Config, error) {
+	tbl, err := toml.Parse([]byte(conf))
+	if err != nil {
+		return nil, err
+	}
+	c := newConfig()
+	if err := c.parsePlugins(tbl); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// runPipeline applies the processors of the config to cpu and mem metrics,
+// it returns the names of the metrics left.
+func runPipeline(t *testing.T, conf string) string {
+	c, err := pipelineConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConf(c)
+	defer setConf(newConfig())
+
+	m := applyProcessors(Metrics{Data: []*MetricData{{Name: "cpu"}, {Name: "mem"}}})
+	var names []string
+	for _, metric := range m.Data {
+		names = append(names, metric.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestPipelineOrder(t *testing.T) {
+	processors := `
+[[processors.test_suffix]]
+  id = "a"
+  suffix = "_a"
+[processors.test_only]
+  names = ["cpu", "cpu_a"]
+[[processors.test_suffix]]
+  id = "b"
+  suffix = "_b"
+`
+	for _, tt := range []struct {
+		pipeline string
+		names    string
+	}{
+		// without pipeline, the order of the config file
+		{"", "cpu_a_b"},
+		{`processors = ["a", "test_only", "b"]`, "cpu_a_b"},
+		{`processors = ["b", "a", "test_only"]`, ""},
+		{`processors = ["test_only", "b", "a"]`, "cpu_b_a"},
+		{`processors = ["b", "test_only", "a"]`, ""},
+	} {
+		conf := processors
+		if tt.pipeline != "" {
+			conf += "[pipeline]\n  " + tt.pipeline + "\n"
+		}
+		if names := runPipeline(t, conf); names != tt.names {
+			t.Errorf("pipeline %q, got metrics %q, want %q", tt.pipeline, names, tt.names)
+		}
+	}
+}
+
+func TestPipelineInvalid(t *testing.T) {
+	for _, conf := range []string{
+		// not listed
+		"[processors.test_suffix]\n[pipeline]\n  processors = []",
+		// unknown
+		"[processors.test_suffix]\n[pipeline]\n  processors = [\"test_suffix\", \"test_only\"]",
+		// listed twice
+		"[processors.test_suffix]\n[pipeline]\n  processors = [\"test_suffix\", \"test_suffix\"]",
+		// the same id twice
+		"[[processors.test_suffix]]\n[[processors.test_suffix]]\n[pipeline]\n  processors = [\"test_suffix\"]",
+		"pipeline = [\"test_suffix\"]\n[processors.test_suffix]",
+		"[processors.test_suffix]\n[pipeline]\n  order = [\"test_suffix\"]",
+	} {
+		if _, err := pipelineConfig(conf); err == nil {
+			t.Errorf("%q accepted", conf)
+		}
+	}
+
+	// the same processor twice without pipeline
+	if names := runPipeline(t, "[[processors.test_suffix]]\n  suffix = \"_a\"\n[[processors.test_suffix]]\n  suffix = \"_a\"\n"); names != "cpu_a_a,mem_a_a" {
+		t.Errorf("got metrics %q, want both processors run", names)
+	}
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"fmt"
+	"time"
+)
+
+// precisions are the values of the precision option
+var precisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// ParsePrecision returns the duration of the precision, "" is the
+// nanosecond.
+func ParsePrecision(s string) (time.Duration, error) {
+	if s == "" {
+		return time.Nanosecond, nil
+	}
+	d, ok := precisions[s]
+	if !ok {
+		return 0, fmt.Errorf("invalid precision %q, can be: \"ns\", \"us\", \"ms\", \"s\", \"m\", \"h\"", s)
+	}
+	return d, nil
+}
+
+// PrecisionOutput is implemented by the metric outputs which write the
+// times with the precision of the output, such as the InfluxDB one.
+type PrecisionOutput interface {
+	// SetPrecision sets the precision of the written times
+	SetPrecision(precision time.Duration)
+}
+
+// truncateTimes returns the metrics with their times truncated to the
+// precision. The metrics of the same name and tags collapsing to the same
+// time are merged, the fields of the later metrics overwriting the earlier
+// ones, so the last write wins whatever the backend does with duplicates.
+// The metrics are shared by the outputs, the changed ones are copies.
+func truncateTimes(metrics []*MetricData, precision time.Duration) []*MetricData {
+	out := make([]*MetricData, 0, len(metrics))
+	seen := make(map[string]int, len(metrics))
+	merged := make(map[int]bool)
+
+	for _, m := range metrics {
+		t := m.Time.Truncate(precision)
+		key := m.PointKey(t)
+		if i, ok := seen[key]; ok {
+			if !merged[i] {
+				out[i] = copyMetric(out[i])
+				merged[i] = true
+			}
+			for k, v := range m.Fields {
+				out[i].Fields[k] = v
+			}
+			continue
+		}
+
+		seen[key] = len(out)
+		if !t.Equal(m.Time) {
+			c := *m
+			c.Time = t
+			m = &c
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// copyMetric returns a copy of the metric with its own fields.
+func copyMetric(m *MetricData) *MetricData {
+	c := *m
+	c.Fields = make(map[string]interface{}, len(m.Fields))
+	for k, v := range m.Fields {
+		c.Fields[k] = v
+	}
+	return &c
+}
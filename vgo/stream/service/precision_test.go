@@ -0,0 +1,61 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParsePrecision(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"":   time.Nanosecond,
+		"ns": time.Nanosecond,
+		"us": time.Microsecond,
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+	} {
+		if got, err := ParsePrecision(s); err != nil || got != want {
+			t.Errorf("%q, got %s %v, want %s", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"u", "sec", "1s", "S"} {
+		if _, err := ParsePrecision(s); err == nil {
+			t.Errorf("invalid precision %q accepted", s)
+		}
+	}
+}
+
+func TestTruncateTimes(t *testing.T) {
+	at := time.Unix(1500000000, 0)
+	metric := func(host string, offset time.Duration, fields map[string]interface{}) *MetricData {
+		return &MetricData{Name: "cpu", Tags: map[string]string{"host": host}, Fields: fields, Time: at.Add(offset)}
+	}
+	metrics := []*MetricData{
+		metric("a", 100*time.Millisecond, map[string]interface{}{"user": 1.0, "idle": 9.0}),
+		metric("b", 200*time.Millisecond, map[string]interface{}{"user": 2.0}),
+		// the same point as the first one, its fields win
+		metric("a", 900*time.Millisecond, map[string]interface{}{"user": 3.0}),
+		metric("a", time.Second, map[string]interface{}{"user": 4.0}),
+	}
+	shared := metrics[0].Fields
+
+	got := truncateTimes(metrics, time.Second)
+	want := []*MetricData{
+		metric("a", 0, map[string]interface{}{"user": 3.0, "idle": 9.0}),
+		metric("b", 0, map[string]interface{}{"user": 2.0}),
+		metric("a", time.Second, map[string]interface{}{"user": 4.0}),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// the metrics are shared by the outputs
+	if !metrics[0].Time.Equal(at.Add(100*time.Millisecond)) || !reflect.DeepEqual(shared, map[string]interface{}{"user": 1.0, "idle": 9.0}) {
+		t.Errorf("shared metric modified, %v", metrics[0])
+	}
+	if got[2] != metrics[3] {
+		t.Error("metric already at the precision copied")
+	}
+}
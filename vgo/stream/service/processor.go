@@ -0,0 +1,87 @@
+package service
+
+import (
+	"log"
+
+	"github.com/naoina/toml/ast"
+)
+
+// Processor transforms the metrics before they reach the alarmer, the chains
+// and the metric outputs.
+type Processor interface {
+	// Init validates the config and prepares the processor, it fails the
+	// config loading when it returns an error
+	Init() error
+
+	// Apply processes the metrics and returns the ones to pass on, the
+	// metrics can be modified in place
+	Apply(metrics []*MetricData) []*MetricData
+}
+
+// ProcessorCreator returns a new Processor, every processor table of the
+// config gets its own.
+type ProcessorCreator func() Processor
+
+var Processors = map[string]ProcessorCreator{}
+
+func AddProcessor(name string, creator ProcessorCreator) {
+	Processors[name] = creator
+}
+
+// ProcessorConfig processorconfig
+type ProcessorConfig struct {
+	Name string
+	// ID names the processor in the pipeline, by default its name
+	ID string
+
+	Processor Processor
+
+	// line is the line of the processor table in the config file
+	line int
+}
+
+// Apply runs the processor on the metrics.
+func (pc *ProcessorConfig) Apply(m Metrics) Metrics {
+	m.Data = pc.Processor.Apply(m.Data)
+	return m
+}
+
+// Show show struct message
+func (pc *ProcessorConfig) Show() {
+	log.Println("Name is ", pc.Name)
+	log.Println("ID is ", pc.ID)
+	log.Printf("Processor is %v\n", pc.Processor)
+}
+
+// applyProcessors runs the processors in the order of the pipeline, or of
+// the config file without pipeline.
+func applyProcessors(m Metrics) Metrics {
+	for _, pc := range Conf.Processors {
+		m = pc.Apply(m)
+	}
+	return m
+}
+
+// buildProcessor parses processor specific items from the ast.Table,
+func buildProcessor(name string, tbl *ast.Table) (*ProcessorConfig, error) {
+	pc := &ProcessorConfig{
+		Name: name,
+		ID:   name,
+		line: tbl.Line,
+	}
+
+	if id, ok, err := tableString(tbl, "id"); err != nil {
+		return nil, err
+	} else if ok {
+		pc.ID = id
+	}
+
+	return pc, nil
+}
+
+// byLine sorts the processors in the order of the config file
+type byLine []*ProcessorConfig
+
+func (b byLine) Len() int           { return len(b) }
+func (b byLine) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byLine) Less(i, j int) bool { return b[i].line < b[j].line }
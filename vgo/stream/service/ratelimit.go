@@ -0,0 +1,50 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket refilled at rate tokens per second, holding
+// up to one second of tokens. It's safe for concurrent use.
+type RateLimiter struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a full RateLimiter of rate tokens per second.
+func NewRateLimiter(rate int) *RateLimiter {
+	return &RateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Wait takes n tokens, sleeping until they're available. When they aren't
+// available within max it returns false at once, without taking any.
+func (r *RateLimiter) Wait(n int, max time.Duration) bool {
+	r.Lock()
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+
+	// the tokens can go negative, the next callers wait for them to refill
+	wait := time.Duration((float64(n) - r.tokens) / r.rate * float64(time.Second))
+	if wait > max {
+		r.Unlock()
+		return false
+	}
+	r.tokens -= float64(n)
+	r.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// timedOutput records when the metrics are written.
+type timedOutput struct {
+	mockOutput
+
+	sync.Mutex
+	times  []time.Time
+	counts []int
+}
+
+func (o *timedOutput) Compute(m Metrics) error {
+	o.mockOutput.Compute(m)
+	o.Lock()
+	o.times = append(o.times, time.Now())
+	o.counts = append(o.counts, len(m.Data))
+	o.Unlock()
+	return nil
+}
+
+func TestRateLimit(t *testing.T) {
+	const rate = 500
+	mo := &timedOutput{}
+	mc := &MetricOutputConfig{MetricOutput: mo, Workers: 4, MetricsPerSecond: rate, RateLimitWait: 10 * time.Second}
+	defer startOutput(mc)()
+
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		mc.Compute(Metrics{Data: testMetrics(50)})
+	}
+	waitFor(t, 10*time.Second, func() bool { return mo.written() == 1000 })
+
+	// the bucket starts full with a second of metrics, then the writes of
+	// the workers share the rate
+	mo.Lock()
+	defer mo.Unlock()
+	written := 0
+	for i, at := range mo.times {
+		written += mo.counts[i]
+		allowed := rate + int(at.Sub(start).Seconds()*rate)
+		if written > allowed {
+			t.Fatalf("%d metrics written after %s, over the cap of %d", written, at.Sub(start), allowed)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("1000 metrics written in %s at %d per second", elapsed, rate)
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	r := NewRateLimiter(100)
+	if !r.Wait(100, 0) {
+		t.Fatal("full bucket didn't allow a second of tokens")
+	}
+	// the bucket is empty, 50 tokens take half a second
+	if r.Wait(50, 100*time.Millisecond) {
+		t.Error("tokens taken past the longest wait")
+	}
+	start := time.Now()
+	if !r.Wait(50, time.Second) {
+		t.Fatal("tokens not taken within the longest wait")
+	}
+	if waited := time.Since(start); waited < 400*time.Millisecond {
+		t.Errorf("waited %s for half a second of tokens", waited)
+	}
+}
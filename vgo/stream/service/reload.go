@@ -0,0 +1,235 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/naoina/toml/ast"
+	"github.com/uber-go/zap"
+)
+
+// tableSignature returns a canonical text of the plugin table, so two tables
+// with the same options have the same signature whatever their key order.
+func tableSignature(name string, tbl *ast.Table) string {
+	var b bytes.Buffer
+	b.WriteString(name)
+	writeTable(&b, tbl)
+	return b.String()
+}
+
+func writeTable(b *bytes.Buffer, tbl *ast.Table) {
+	keys := make([]string, 0, len(tbl.Fields))
+	for k := range tbl.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b.WriteByte('{')
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		switch v := tbl.Fields[k].(type) {
+		case *ast.KeyValue:
+			b.WriteString(v.Value.Source())
+		case *ast.Table:
+			writeTable(b, v)
+		case []*ast.Table:
+			b.WriteByte('[')
+			for _, t := range v {
+				writeTable(b, t)
+			}
+			b.WriteByte(']')
+		}
+		b.WriteByte(';')
+	}
+	b.WriteByte('}')
+}
+
+// Reload re-reads stream.toml and applies the changes of the plugins: the
+// plugins whose config didn't change keep running with their connections
+// and buffers, the removed ones are stopped, the new ones are started and
+// the modified ones are restarted. The processors are always replaced.
+// The common, stream and facts sections aren't reloaded. An invalid plugin
+// config is rejected, the current plugins keep running.
+//
+// The old instance of a modified plugin is stopped before its replacement
+// starts, as they may share a listen address or a buffer file.
+func (s *Stream) Reload() error {
+	tbl, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	old := Conf
+	c := newConfig()
+	c.Common = old.Common
+	c.Stream = old.Stream
+	c.Facts = old.Facts
+	if err := c.parsePlugins(tbl); err != nil {
+		return fmt.Errorf("reload rejected, %s", err)
+	}
+
+	inputs := s.reloadInputs(old, c)
+
+	// the pipeline waits while the other plugins are replaced: the old ones
+	// are stopped once no batch uses them, the new ones run before the next
+	// batch
+	confMu.Lock()
+	outputs := s.reloadOutputs(old, c)
+	chains := s.reloadChains(old, c)
+	metricOutputs := s.reloadMetricOutputs(old, c)
+	Conf = c
+	liveConf.Store(c)
+	confMu.Unlock()
+
+	VLogger.Info("config reloaded",
+		zap.Int("inputs_stopped", inputs),
+		zap.Int("outputs_stopped", outputs),
+		zap.Int("chains_stopped", chains),
+		zap.Int("metric_outputs_stopped", metricOutputs),
+	)
+	c.Show()
+	return nil
+}
+
+// reloadInputs keeps the unchanged inputs in the new config, stops the
+// others and starts the new ones. It returns the number of inputs stopped,
+// the inputs which can't be stopped keep running.
+func (s *Stream) reloadInputs(old, c *Config) int {
+	running := make(map[string][]*InputConfig)
+	for _, ic := range old.Inputs {
+		running[ic.signature] = append(running[ic.signature], ic)
+	}
+
+	var start []*InputConfig
+	for i, ic := range c.Inputs {
+		if same := running[ic.signature]; len(same) > 0 {
+			c.Inputs[i] = same[0]
+			running[ic.signature] = same[1:]
+			continue
+		}
+		start = append(start, ic)
+	}
+
+	stopped := 0
+	for _, left := range running {
+		for _, ic := range left {
+			if _, ok := ic.Input.(InputStopper); !ok {
+				VLogger.Warn("reload, input can't be stopped, kept running", zap.String("name", ic.Name))
+				c.Inputs = append(c.Inputs, ic)
+				continue
+			}
+			VLogger.Info("reload, input stopped", zap.String("name", ic.Name))
+			ic.Stop()
+			stopped++
+		}
+	}
+
+	for _, ic := range start {
+		VLogger.Info("reload, input started", zap.String("name", ic.Name))
+		ic.Start(s.stopPluginsChan, s.metricChan)
+	}
+	return stopped
+}
+
+// reloadOutputs keeps the unchanged alarm outputs in the new config, closes
+// the others and starts the new ones. It returns the number of outputs
+// closed.
+func (s *Stream) reloadOutputs(old, c *Config) int {
+	stopped := 0
+	for name, oc := range old.Outputs {
+		if nc, ok := c.Outputs[name]; ok && nc.signature == oc.signature {
+			c.Outputs[name] = oc
+			continue
+		}
+		VLogger.Info("reload, output stopped", zap.String("name", name))
+		if err := oc.Output.Close(); err != nil {
+			log.Println("Output ", oc.Name, " Close failed, err message is", err)
+		}
+		stopped++
+	}
+
+	for name, oc := range c.Outputs {
+		if prev, ok := old.Outputs[name]; ok && prev == oc {
+			continue
+		}
+		VLogger.Info("reload, output started", zap.String("name", name))
+		if err := oc.Output.Start(); err != nil {
+			log.Fatal("Output ", name, " Start failed, err message is", err)
+		}
+	}
+	return stopped
+}
+
+// reloadChains keeps the unchanged chains in the new config, stops the
+// others and starts the new ones. It returns the number of chains stopped.
+func (s *Stream) reloadChains(old, c *Config) int {
+	running := make(map[string][]*ChainConfig)
+	for _, cc := range old.Chains {
+		running[cc.signature] = append(running[cc.signature], cc)
+	}
+
+	var start []*ChainConfig
+	for i, cc := range c.Chains {
+		if same := running[cc.signature]; len(same) > 0 {
+			c.Chains[i] = same[0]
+			running[cc.signature] = same[1:]
+			continue
+		}
+		start = append(start, cc)
+	}
+
+	stopped := 0
+	for _, left := range running {
+		for _, cc := range left {
+			VLogger.Info("reload, chain stopped", zap.String("name", cc.Name))
+			cc.Stop()
+			stopped++
+		}
+	}
+
+	for _, cc := range start {
+		VLogger.Info("reload, chain started", zap.String("name", cc.Name))
+		cc.Start(s.stopPluginsChan)
+	}
+	return stopped
+}
+
+// reloadMetricOutputs keeps the unchanged metric outputs in the new config,
+// stops the others once they wrote what they buffer and starts the new
+// ones. It returns the number of metric outputs stopped.
+func (s *Stream) reloadMetricOutputs(old, c *Config) int {
+	running := make(map[string][]*MetricOutputConfig)
+	for _, mc := range old.MetricOutputs {
+		running[mc.signature] = append(running[mc.signature], mc)
+	}
+
+	var start []*MetricOutputConfig
+	for i, mc := range c.MetricOutputs {
+		if same := running[mc.signature]; len(same) > 0 {
+			c.MetricOutputs[i] = same[0]
+			running[mc.signature] = same[1:]
+			continue
+		}
+		start = append(start, mc)
+	}
+
+	stopped := 0
+	for _, left := range running {
+		for _, mc := range left {
+			VLogger.Info("reload, metric output stopped", zap.String("name", mc.Name))
+			if err := mc.Stop(); err != nil {
+				log.Println("MetricOutput ", mc.Name, " Close failed, err message is", err)
+			}
+			stopped++
+		}
+	}
+
+	for _, mc := range start {
+		VLogger.Info("reload, metric output started", zap.String("name", mc.Name))
+		mc.Start(s.stopPluginsChan)
+	}
+	return stopped
+}
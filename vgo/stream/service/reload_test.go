@@ -0,0 +1,283 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// reloadOutput is a metric output recording its lifecycle
+type reloadOutput struct {
+	Option string
+
+	inited int32
+	closed int32
+}
+
+func (o *reloadOutput) Init(chan bool)          { atomic.StoreInt32(&o.inited, 1) }
+func (o *reloadOutput) Start()                  {}
+func (o *reloadOutput) Compute(m Metrics) error { return nil }
+func (o *reloadOutput) Close() error {
+	atomic.StoreInt32(&o.closed, 1)
+	return nil
+}
+
+// reloadInput is an input recording its lifecycle
+type reloadInput struct {
+	Option string
+
+	inited  int32
+	stopped int32
+}
+
+func (i *reloadInput) Init(chan bool, chan Metrics) { atomic.StoreInt32(&i.inited, 1) }
+func (i *reloadInput) Start()                       {}
+func (i *reloadInput) Stop()                        { atomic.StoreInt32(&i.stopped, 1) }
+
+// listenInput is an input listening on its address until it's stopped
+type listenInput struct {
+	Address string
+	Option  string
+
+	listening chan error
+	closed    chan bool
+	stop      chan bool
+}
+
+func (i *listenInput) Init(chan bool, chan Metrics) {
+	i.listening = make(chan error, 1)
+	i.closed = make(chan bool)
+	i.stop = make(chan bool)
+}
+
+func (i *listenInput) Start() {
+	defer close(i.closed)
+	l, err := net.Listen("tcp", i.Address)
+	i.listening <- err
+	if err != nil {
+		return
+	}
+	<-i.stop
+	l.Close()
+}
+
+func (i *listenInput) Stop() {
+	close(i.stop)
+	<-i.closed
+}
+
+func init() {
+	AddMetricOutput("reload_output", &reloadOutput{})
+	AddInput("reload_input", &reloadInput{})
+	AddInput("listen_input", &listenInput{})
+}
+
+// metricOutputs returns the metric outputs of the config by option.
+func metricOutputs(c *Config) map[string]*reloadOutput {
+	outputs := make(map[string]*reloadOutput)
+	for _, mc := range c.MetricOutputs {
+		o := mc.MetricOutput.(*reloadOutput)
+		outputs[o.Option] = o
+	}
+	return outputs
+}
+
+func TestReload(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	setConf(newConfig())
+	defer setConf(newConfig())
+	s := &Stream{stopPluginsChan: make(chan bool), metricChan: make(chan Metrics, 1)}
+	defer close(s.stopPluginsChan)
+
+	reload := func(conf string) error {
+		if err := ioutil.WriteFile("stream.toml", []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return s.Reload()
+	}
+
+	// add
+	err = reload(`
+[inputs.reload_input]
+  option = "in"
+
+[[metric_outputs.reload_output]]
+  option = "kept"
+[[metric_outputs.reload_output]]
+  option = "modified"
+  metric_buffer_limit = 10
+[[metric_outputs.reload_output]]
+  option = "removed"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := metricOutputs(Conf)
+	if len(v1) != 3 {
+		t.Fatalf("got metric outputs %v", v1)
+	}
+	for name, o := range v1 {
+		if atomic.LoadInt32(&o.inited) != 1 {
+			t.Errorf("metric output %s not started", name)
+		}
+	}
+	in := Conf.Inputs[0].Input.(*reloadInput)
+	if atomic.LoadInt32(&in.inited) != 1 {
+		t.Error("input not started")
+	}
+
+	// the kept output has the same options in another order, the modified
+	// output has a new wrapper option, the removed one is gone and the
+	// input is modified
+	err = reload(`
+[inputs.reload_input]
+  option = "in2"
+
+[[metric_outputs.reload_output]]
+  option = "added"
+[[metric_outputs.reload_output]]
+  metric_buffer_limit = 20
+  option = "modified"
+[[metric_outputs.reload_output]]
+  option = "kept"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2 := metricOutputs(Conf)
+	if len(v2) != 3 || v2["removed"] != nil {
+		t.Fatalf("got metric outputs %v", v2)
+	}
+	if v2["kept"] != v1["kept"] || atomic.LoadInt32(&v1["kept"].closed) != 0 {
+		t.Error("unchanged metric output restarted")
+	}
+	if v2["modified"] == v1["modified"] || atomic.LoadInt32(&v1["modified"].closed) != 1 || atomic.LoadInt32(&v2["modified"].inited) != 1 {
+		t.Error("modified metric output not restarted")
+	}
+	for _, mc := range Conf.MetricOutputs {
+		if mc.MetricOutput == v2["modified"] && mc.MetricBufferLimit != 20 {
+			t.Errorf("modified metric output buffer limit %d", mc.MetricBufferLimit)
+		}
+	}
+	if atomic.LoadInt32(&v1["removed"].closed) != 1 {
+		t.Error("removed metric output not stopped")
+	}
+	if atomic.LoadInt32(&v2["added"].inited) != 1 {
+		t.Error("added metric output not started")
+	}
+	if atomic.LoadInt32(&in.stopped) != 1 {
+		t.Error("modified input not stopped")
+	}
+	in2 := Conf.Inputs[0].Input.(*reloadInput)
+	if in2.Option != "in2" || atomic.LoadInt32(&in2.inited) != 1 {
+		t.Error("modified input not started")
+	}
+
+	// remove, an invalid config is rejected and the plugins keep running
+	current := Conf
+	if err := reload(`
+[[metric_outputs.reload_output]]
+  option = "kept"
+  metric_buffer_limit = 0
+`); err == nil {
+		t.Fatal("invalid config reloaded")
+	}
+	if Conf != current || currentConf() != current {
+		t.Fatal("config replaced by the rejected one")
+	}
+	for name, o := range v2 {
+		if atomic.LoadInt32(&o.closed) != 0 {
+			t.Errorf("metric output %s stopped by the rejected reload", name)
+		}
+	}
+
+	if err := reload(""); err != nil {
+		t.Fatal(err)
+	}
+	if len(Conf.MetricOutputs) != 0 || len(Conf.Inputs) != 0 {
+		t.Errorf("plugins left after their removal")
+	}
+	for name, o := range v2 {
+		if atomic.LoadInt32(&o.closed) != 1 {
+			t.Errorf("metric output %s not stopped", name)
+		}
+	}
+	if atomic.LoadInt32(&in2.stopped) != 1 {
+		t.Error("removed input not stopped")
+	}
+}
+
+func TestReloadListenerAndBufferFile(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	// a free address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	setConf(newConfig())
+	defer setConf(newConfig())
+	s := &Stream{stopPluginsChan: make(chan bool), metricChan: make(chan Metrics, 1)}
+	defer close(s.stopPluginsChan)
+
+	// the listener and the output are modified, they keep their address
+	// and buffer file
+	for _, option := range []string{"v1", "v2", "v3"} {
+		conf := fmt.Sprintf(`
+[inputs.listen_input]
+  address = %q
+  option = %q
+
+[[metric_outputs.reload_output]]
+  option = %q
+  buffer_file = %q
+`, addr, option, option, filepath.Join(dir, "buffer.db"))
+		if err := ioutil.WriteFile("stream.toml", []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		if err := s.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		// the buffer file is opened with a timeout, it doesn't wait for the
+		// old output to release it
+		if d := time.Since(start); d >= time.Second {
+			t.Errorf("%s, reload took %s", option, d)
+		}
+		in := Conf.Inputs[0].Input.(*listenInput)
+		if err := <-in.listening; err != nil {
+			t.Errorf("%s, listen failed, %s", option, err)
+		}
+		if mc := Conf.MetricOutputs[0]; mc.bufferDB == nil || mc.MetricOutput.(*reloadOutput).Option != option {
+			t.Errorf("%s, got metric output %+v", option, mc)
+		}
+	}
+}
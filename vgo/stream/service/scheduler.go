@@ -0,0 +1,113 @@
+package service
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// jitter is the random source of the tickers, seeded from the hostname so
+// every stream instance gets its own offsets, stable across restarts.
+var jitter = newJitterSource()
+
+type jitterSource struct {
+	sync.Mutex
+	rand *rand.Rand
+}
+
+func newJitterSource() *jitterSource {
+	hostname, _ := os.Hostname()
+	h := fnv.New64a()
+	h.Write([]byte(hostname))
+	return &jitterSource{
+		rand: rand.New(rand.NewSource(int64(h.Sum64()))),
+	}
+}
+
+// offset returns a random duration in [0, max]
+func (j *jitterSource) offset(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	j.Lock()
+	defer j.Unlock()
+	return time.Duration(j.rand.Int63n(int64(max) + 1))
+}
+
+// JitterInterval returns interval plus a random offset up to jitter.
+func JitterInterval(interval, max time.Duration) time.Duration {
+	return interval + jitter.offset(max)
+}
+
+// JitterTicker is like time.Ticker, but its ticks are delayed by a random
+// offset up to the jitter, drawn once: the ticks keep a stable phase,
+// interval apart, and the instances don't tick at the same time.
+type JitterTicker struct {
+	C <-chan time.Time
+
+	c        chan time.Time
+	interval time.Duration
+	jitter   time.Duration
+	stop     chan struct{}
+}
+
+// NewJitterTicker returns a started JitterTicker.
+func NewJitterTicker(interval, jitter time.Duration) *JitterTicker {
+	c := make(chan time.Time, 1)
+	t := &JitterTicker{
+		C:        c,
+		c:        c,
+		interval: interval,
+		jitter:   jitter,
+		stop:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// CollectionTicker returns the ticker polling inputs gather on.
+func CollectionTicker(interval time.Duration) *JitterTicker {
+	return NewJitterTicker(interval, currentConf().Stream.CollectionJitter.Duration)
+}
+
+// FlushTicker returns the ticker metric outputs flush on.
+func FlushTicker(interval time.Duration) *JitterTicker {
+	return NewJitterTicker(interval, currentConf().Stream.FlushJitter.Duration)
+}
+
+func (t *JitterTicker) run() {
+	timer := time.NewTimer(JitterInterval(t.interval, t.jitter))
+	select {
+	case now := <-timer.C:
+		t.tick(now)
+	case <-t.stop:
+		timer.Stop()
+		return
+	}
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			t.tick(now)
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+func (t *JitterTicker) tick(now time.Time) {
+	select {
+	case t.c <- now:
+	default:
+		// the receiver is late, drop the tick like time.Ticker does
+	}
+}
+
+// Stop turns off the ticker.
+func (t *JitterTicker) Stop() {
+	close(t.stop)
+}
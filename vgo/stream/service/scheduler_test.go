@@ -0,0 +1,43 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJitterInterval(t *testing.T) {
+	interval, max := 10*time.Second, 3*time.Second
+	for i := 0; i < 10000; i++ {
+		d := JitterInterval(interval, max)
+		if d < interval || d > interval+max {
+			t.Fatalf("jittered interval %s not within [%s, %s]", d, interval, interval+max)
+		}
+	}
+
+	if d := JitterInterval(interval, 0); d != interval {
+		t.Errorf("interval without jitter %s, want %s", d, interval)
+	}
+}
+
+func TestJitterTicker(t *testing.T) {
+	interval, max := 50*time.Millisecond, 40*time.Millisecond
+	// the room left for the scheduling of the timers
+	slack := 15 * time.Millisecond
+
+	start := time.Now()
+	ticker := NewJitterTicker(interval, max)
+	defer ticker.Stop()
+
+	first := <-ticker.C
+	if d := first.Sub(start); d < interval {
+		t.Errorf("first tick after %s, want at least %s", d, interval)
+	}
+	// the offset is drawn once, the ticks stay on the phase of the first
+	for i := 0; i < 6; i++ {
+		d := (<-ticker.C).Sub(first)
+		n := (d + interval/2) / interval
+		if off := d - n*interval; n == 0 || off < -slack || off > slack {
+			t.Errorf("tick %d after %s, %s off the phase", i, d, off)
+		}
+	}
+}
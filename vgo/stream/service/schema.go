@@ -0,0 +1,220 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uber-go/zap"
+)
+
+const (
+	// schemaCheckInterval is how often the schema file is checked for changes
+	schemaCheckInterval = 10 * time.Second
+	// schemaWarnSample logs one rejected metric out of schemaWarnSample
+	schemaWarnSample = 100
+)
+
+// Schema is the allowlist of the metrics of an output: the metric names and
+// the tag keys permitted for each of them, loaded from a JSON file:
+//
+//   {"cpu": ["cpu", "host"], "mem": ["host"]}
+//
+// A metric whose name isn't in the schema, or which has a tag not permitted,
+// is rejected. The file is reloaded when it changes. In learn mode nothing is
+// rejected: the names and tag keys seen are added to the schema and the file
+// is rewritten, to be reviewed before enforcing it.
+type Schema struct {
+	// rejected is the number of metrics rejected, accessed atomically
+	rejected uint64
+
+	sync.Mutex
+	path      string
+	learn     bool
+	names     map[string]map[string]bool
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// NewSchema loads the schema file, in learn mode a missing file is an empty
+// schema.
+func NewSchema(path string, learn bool) (*Schema, error) {
+	s := &Schema{
+		path:      path,
+		learn:     learn,
+		names:     make(map[string]map[string]bool),
+		lastCheck: time.Now(),
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		if learn && os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if s.names, err = readSchema(path); err != nil {
+		return nil, err
+	}
+	s.modTime = fi.ModTime()
+	return s, nil
+}
+
+// Filter returns the metrics the schema allows and the ones it rejects.
+func (s *Schema) Filter(metrics []*MetricData) (allowed, rejected []*MetricData) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.learn {
+		if s.learnAll(metrics) {
+			if err := s.save(); err != nil {
+				VLogger.Error("schema file write", zap.String("path", s.path), zap.Error(err))
+			}
+		}
+		return metrics, nil
+	}
+
+	s.reload()
+	allowed = make([]*MetricData, 0, len(metrics))
+	for _, m := range metrics {
+		if reason := s.check(m); reason != "" {
+			rejected = append(rejected, m)
+			s.warn(m, reason)
+			continue
+		}
+		allowed = append(allowed, m)
+	}
+	return allowed, rejected
+}
+
+// Rejected returns the number of metrics rejected.
+func (s *Schema) Rejected() uint64 {
+	return atomic.LoadUint64(&s.rejected)
+}
+
+// check returns why the schema rejects the metric, empty when it allows it.
+func (s *Schema) check(m *MetricData) string {
+	keys, ok := s.names[m.Name]
+	if !ok {
+		return "name not in schema"
+	}
+	for k := range m.Tags {
+		if !keys[k] {
+			return "tag " + k + " not in schema"
+		}
+	}
+	return ""
+}
+
+// warn counts the rejected metric and logs a sample of them.
+func (s *Schema) warn(m *MetricData, reason string) {
+	n := atomic.AddUint64(&s.rejected, 1)
+	if n%schemaWarnSample != 1 {
+		return
+	}
+	VLogger.Warn("metric rejected by schema",
+		zap.String("path", s.path),
+		zap.String("metric", m.Name),
+		zap.String("reason", reason),
+		zap.Int64("rejected", int64(n)),
+	)
+}
+
+// learnAll adds the names and tag keys of the metrics, it returns whether
+// the schema changed.
+func (s *Schema) learnAll(metrics []*MetricData) bool {
+	var changed bool
+	for _, m := range metrics {
+		keys, ok := s.names[m.Name]
+		if !ok {
+			keys = make(map[string]bool, len(m.Tags))
+			s.names[m.Name] = keys
+			changed = true
+		}
+		for k := range m.Tags {
+			if !keys[k] {
+				keys[k] = true
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// reload reads the file again when it changed, at most every
+// schemaCheckInterval. An invalid file keeps the current schema.
+func (s *Schema) reload() {
+	if time.Since(s.lastCheck) < schemaCheckInterval {
+		return
+	}
+	s.lastCheck = time.Now()
+
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		VLogger.Error("schema file", zap.String("path", s.path), zap.Error(err))
+		return
+	}
+	if fi.ModTime().Equal(s.modTime) {
+		return
+	}
+
+	names, err := readSchema(s.path)
+	if err != nil {
+		VLogger.Error("schema file reload, previous schema kept", zap.String("path", s.path), zap.Error(err))
+		return
+	}
+	s.names = names
+	s.modTime = fi.ModTime()
+	VLogger.Info("schema file reloaded", zap.String("path", s.path), zap.Int("names", len(names)))
+}
+
+// save writes the schema, with the names and tag keys sorted so the
+// reviews show the changes, to a temporary file renamed over the schema.
+func (s *Schema) save() error {
+	out := make(map[string][]string, len(s.names))
+	for name, keys := range s.names {
+		l := make([]string, 0, len(keys))
+		for k := range keys {
+			l = append(l, k)
+		}
+		sort.Strings(l)
+		out[name] = l
+	}
+
+	// json sorts the keys of the maps
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func readSchema(path string) (map[string]map[string]bool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var in map[string][]string
+	if err := json.Unmarshal(b, &in); err != nil {
+		return nil, fmt.Errorf("invalid schema %s, %s", path, err)
+	}
+
+	names := make(map[string]map[string]bool, len(in))
+	for name, l := range in {
+		keys := make(map[string]bool, len(l))
+		for _, k := range l {
+			keys[k] = true
+		}
+		names[name] = keys
+	}
+	return names, nil
+}
@@ -0,0 +1,194 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func writeSchema(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func schemaMetrics() []*MetricData {
+	metrics := []*MetricData{
+		{Name: "cpu", Tags: map[string]string{"host": "server01", "cpu": "cpu0"}, Fields: map[string]interface{}{"idle": 98.5}},
+		// fewer tags than permitted
+		{Name: "cpu", Tags: map[string]string{"host": "server01"}, Fields: map[string]interface{}{"idle": 97.5}},
+		// a tag not permitted
+		{Name: "cpu", Tags: map[string]string{"host": "server01", "request_id": "4f2a"}, Fields: map[string]interface{}{"idle": 96.5}},
+		// a name not in the schema
+		{Name: "http", Tags: map[string]string{"host": "server01"}, Fields: map[string]interface{}{"latency": 1.5}},
+		{Name: "mem", Tags: map[string]string{}, Fields: map[string]interface{}{"used": 1.0}},
+	}
+	for _, m := range metrics {
+		m.Time = time.Unix(1500000000, 0)
+	}
+	return metrics
+}
+
+func TestSchemaAllowDeny(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "schema.json")
+	writeSchema(t, path, `{"cpu": ["cpu", "host"], "mem": []}`)
+
+	s, err := NewSchema(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := schemaMetrics()
+	allowed, rejected := s.Filter(metrics)
+	if len(allowed) != 3 || allowed[0] != metrics[0] || allowed[1] != metrics[1] || allowed[2] != metrics[4] {
+		t.Errorf("got %d metrics allowed, want the cpu ones with the permitted tags and mem", len(allowed))
+	}
+	if len(rejected) != 2 || rejected[0] != metrics[2] || rejected[1] != metrics[3] {
+		t.Errorf("got %d metrics rejected, want the request_id tag and the http name", len(rejected))
+	}
+	if n := s.Rejected(); n != 2 {
+		t.Errorf("got %d rejected, want 2", n)
+	}
+
+	if _, err := NewSchema(filepath.Join(dir, "missing.json"), false); err == nil {
+		t.Error("missing schema file accepted")
+	}
+	writeSchema(t, path, `{"cpu": "host"}`)
+	if _, err := NewSchema(path, false); err == nil {
+		t.Error("invalid schema file accepted")
+	}
+}
+
+func TestSchemaReload(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "schema.json")
+	writeSchema(t, path, `{"mem": []}`)
+
+	s, err := NewSchema(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// changed files are checked every schemaCheckInterval
+	change := func(content string, mtime time.Time) {
+		writeSchema(t, path, content)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		s.lastCheck = s.lastCheck.Add(-schemaCheckInterval)
+	}
+
+	change(`{"http": ["host"]}`, time.Now().Add(time.Minute))
+	if allowed, _ := s.Filter(schemaMetrics()); len(allowed) != 1 || allowed[0].Name != "http" {
+		t.Errorf("got %d metrics allowed, want the http one of the reloaded schema", len(allowed))
+	}
+
+	// an invalid file keeps the schema
+	change(`{"http":`, time.Now().Add(2*time.Minute))
+	if allowed, _ := s.Filter(schemaMetrics()); len(allowed) != 1 || allowed[0].Name != "http" {
+		t.Errorf("got %d metrics allowed, want the previous schema kept", len(allowed))
+	}
+}
+
+func TestSchemaLearn(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "schema.json")
+
+	// in learn mode the file is created
+	s, err := NewSchema(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := schemaMetrics()
+	if allowed, rejected := s.Filter(metrics); len(allowed) != len(metrics) || len(rejected) != 0 {
+		t.Errorf("got %d allowed and %d rejected, want all the metrics allowed", len(allowed), len(rejected))
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "cpu": [
+    "cpu",
+    "host",
+    "request_id"
+  ],
+  "http": [
+    "host"
+  ],
+  "mem": []
+}
+`
+	if string(b) != want {
+		t.Errorf("got schema file\n%s\nwant\n%s", b, want)
+	}
+
+	// nothing new, the file isn't written again
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	s.Filter(metrics)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("schema file written without change")
+	}
+	s.Filter([]*MetricData{{Name: "disk", Tags: map[string]string{"path": "/"}}})
+
+	// the learned schema is enforced once reviewed
+	s, err = NewSchema(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed, _ := s.Filter(metrics); len(allowed) != len(metrics) {
+		t.Errorf("got %d metrics allowed, want the metrics learned", len(allowed))
+	}
+	if allowed, _ := s.Filter([]*MetricData{{Name: "disk", Tags: map[string]string{"path": "/", "device": "sda"}}}); len(allowed) != 0 {
+		t.Error("metric with a tag not learned allowed")
+	}
+}
+
+func TestMetricOutputSchema(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	path := filepath.Join(dir, "schema.json")
+	quarantine := filepath.Join(dir, "quarantine")
+	writeSchema(t, path, `{"cpu": ["cpu", "host"], "mem": []}`)
+
+	// the rejected metrics are dropped, counted in the stats of the name
+	mo := &mockOutput{}
+	mc := &MetricOutputConfig{Name: "schema", MetricOutput: mo, SchemaFile: path}
+	stop := startOutput(mc)
+	before := atomic.LoadInt64(&mc.stats.dropped)
+	mc.Compute(Metrics{Data: schemaMetrics()})
+	if n := mo.written(); n != 3 {
+		t.Errorf("wrote %d metrics, want 3", n)
+	}
+	if n := atomic.LoadInt64(&mc.stats.dropped) - before; n != 2 {
+		t.Errorf("got %d metrics dropped, want 2", n)
+	}
+	stop()
+
+	// or quarantined
+	mo = &mockOutput{}
+	mc = &MetricOutputConfig{MetricOutput: mo, SchemaFile: path, QuarantineFile: quarantine}
+	defer startOutput(mc)()
+	metrics := schemaMetrics()
+	mc.Compute(Metrics{Data: metrics})
+	if err := mc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := mo.written(); n != 3 {
+		t.Errorf("wrote %d metrics, want 3", n)
+	}
+	quarantined := &mockOutput{}
+	if err := ReplayDeadLetter(quarantine, quarantined); err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined.metrics) != 2 || !sameMetric(quarantined.metrics[0], metrics[2]) || !sameMetric(quarantined.metrics[1], metrics[3]) {
+		t.Errorf("got %d metrics quarantined, want the rejected ones", len(quarantined.metrics))
+	}
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/naoina/toml/ast"
+)
+
+// Serializer turns metrics into bytes for the outputs which send them
+// over the wire.
+type Serializer interface {
+	// Serialize takes a single metric and serializes it
+	Serialize(*MetricData) ([]byte, error)
+
+	// SerializeBatch takes a group of metrics and serializes them at once
+	SerializeBatch(Metrics) ([]byte, error)
+}
+
+// SerializerCreator returns a new Serializer.
+type SerializerCreator func() Serializer
+
+var Serializers = map[string]SerializerCreator{}
+
+func AddSerializer(name string, creator SerializerCreator) {
+	Serializers[name] = creator
+}
+
+// NewSerializer returns a new Serializer of the given data format.
+func NewSerializer(name string) (Serializer, error) {
+	creator, ok := Serializers[name]
+	if !ok {
+		return nil, fmt.Errorf("no serializer %v available", name)
+	}
+	return creator(), nil
+}
+
+// SerializerOutput is an interface for metric outputs that are able to
+// serialize metrics in arbitrary data formats.
+type SerializerOutput interface {
+	// SetSerializer sets the serializer function for the interface
+	SetSerializer(serializer Serializer)
+}
+
+// TimestampUnitsSetter is implemented by the serializers and parsers whose
+// timestamps are numbers of a configurable unit, such as the json ones.
+type TimestampUnitsSetter interface {
+	SetTimestampUnits(units time.Duration)
+}
+
+// buildSerializer creates the serializer of the data_format option of the
+// table, "influx" by default.
+func buildSerializer(tbl *ast.Table) (Serializer, error) {
+	name, ok, err := tableString(tbl, "data_format")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		name = "influx"
+	}
+	serializer, err := NewSerializer(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := setTimestampUnits(tbl, name, serializer); err != nil {
+		return nil, err
+	}
+	return serializer, nil
+}
+
+// setTimestampUnits sets the json_timestamp_units option of the table to
+// the serializer or parser p: "1s", "1ms", "1us" or "1ns".
+func setTimestampUnits(tbl *ast.Table, name string, p interface{}) error {
+	units, ok, err := tableDuration(tbl, "json_timestamp_units")
+	if err != nil {
+		return fmt.Errorf("invalid json_timestamp_units, %s", err)
+	}
+	if !ok {
+		return nil
+	}
+	switch units {
+	case time.Second, time.Millisecond, time.Microsecond, time.Nanosecond:
+	default:
+		return fmt.Errorf("invalid json_timestamp_units %s, can be: 1s, 1ms, 1us, 1ns", units)
+	}
+
+	s, ok := p.(TimestampUnitsSetter)
+	if !ok {
+		return fmt.Errorf("json_timestamp_units isn't supported by the %s data format", name)
+	}
+	s.SetTimestampUnits(units)
+	return nil
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/naoina/toml"
+)
+
+type unitsSerializer struct {
+	units time.Duration
+}
+
+func (s *unitsSerializer) Serialize(*MetricData) ([]byte, error)  { return nil, nil }
+func (s *unitsSerializer) SerializeBatch(Metrics) ([]byte, error) { return nil, nil }
+func (s *unitsSerializer) SetTimestampUnits(units time.Duration)  { s.units = units }
+
+type plainSerializer struct{}
+
+func (s *plainSerializer) Serialize(*MetricData) ([]byte, error)  { return nil, nil }
+func (s *plainSerializer) SerializeBatch(Metrics) ([]byte, error) { return nil, nil }
+
+func TestBuildSerializer(t *testing.T) {
+	AddSerializer("test_units", func() Serializer { return &unitsSerializer{units: time.Second} })
+	AddSerializer("test_plain", func() Serializer { return &plainSerializer{} })
+
+	for _, tt := range []struct {
+		conf  string
+		units time.Duration
+		err   bool
+	}{
+		{`data_format = "test_units"`, time.Second, false},
+		{`data_format = "test_units"` + "\n" + `json_timestamp_units = "1ms"`, time.Millisecond, false},
+		{`data_format = "test_units"` + "\n" + `json_timestamp_units = "1ns"`, time.Nanosecond, false},
+		{`data_format = "test_units"` + "\n" + `json_timestamp_units = "10ms"`, 0, true},
+		{`data_format = "test_plain"` + "\n" + `json_timestamp_units = "1ms"`, 0, true},
+		{`data_format = "test_plain"`, 0, false},
+		{`data_format = "missing"`, 0, true},
+	} {
+		tbl, err := toml.Parse([]byte(tt.conf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := buildSerializer(tbl)
+		if (err != nil) != tt.err {
+			t.Errorf("%q, got error %v", tt.conf, err)
+			continue
+		}
+		if us, ok := s.(*unitsSerializer); ok && us.units != tt.units {
+			t.Errorf("%q, got units %s, want %s", tt.conf, us.units, tt.units)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"bytes"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// SeriesKey identifies the series of the metric, its name and tags: the
+// metrics of the same series have the same key whatever the order of their
+// tags.
+func (m *MetricData) SeriesKey() string {
+	var b bytes.Buffer
+	m.WriteSeriesKey(&b)
+	return b.String()
+}
+
+// WriteSeriesKey writes the series key of the metric to b, for the callers
+// reusing their buffer.
+func (m *MetricData) WriteSeriesKey(b *bytes.Buffer) {
+	keys := make([]string, 0, len(m.Tags))
+	for k := range m.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// the names and values can hold any separator but a NUL
+	b.WriteString(m.Name)
+	for _, k := range keys {
+		b.WriteByte(0)
+		b.WriteString(k)
+		b.WriteByte(0)
+		b.WriteString(m.Tags[k])
+	}
+}
+
+// SeriesHash hashes the series key of the metric, the same series always
+// has the same hash.
+func (m *MetricData) SeriesHash() uint64 {
+	var b bytes.Buffer
+	m.WriteSeriesKey(&b)
+	h := fnv.New64a()
+	h.Write(b.Bytes())
+	return h.Sum64()
+}
+
+// PointKey identifies the point of the metric at the time t, its series
+// key and t.
+func (m *MetricData) PointKey(t time.Time) string {
+	var b bytes.Buffer
+	m.WriteSeriesKey(&b)
+	b.WriteByte(0)
+	b.WriteString(strconv.FormatInt(t.UnixNano(), 10))
+	return b.String()
+}
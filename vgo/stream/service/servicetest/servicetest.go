@@ -0,0 +1,86 @@
+// Package servicetest runs the pipeline of the service for the tests of the
+// plugins publishing metrics.
+package servicetest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/corego/vgo/vgo/stream/service"
+)
+
+// Recorder is a metric output recording the metrics reaching it.
+type Recorder struct {
+	sync.Mutex
+	metrics []*service.MetricData
+}
+
+func (r *Recorder) Init(chan bool) {}
+func (r *Recorder) Start()         {}
+
+func (r *Recorder) Compute(m service.Metrics) error {
+	r.Lock()
+	defer r.Unlock()
+	r.metrics = append(r.metrics, m.Data...)
+	return nil
+}
+
+// Received returns the metrics recorded.
+func (r *Recorder) Received() []*service.MetricData {
+	r.Lock()
+	defer r.Unlock()
+	return append([]*service.MetricData(nil), r.metrics...)
+}
+
+// Take returns the metrics recorded since the last call.
+func (r *Recorder) Take() []*service.MetricData {
+	r.Lock()
+	defer r.Unlock()
+	metrics := r.metrics
+	r.metrics = nil
+	return metrics
+}
+
+// Wait waits up to a second for the recorder to have n metrics, it returns
+// the metrics recorded.
+func (r *Recorder) Wait(n int) []*service.MetricData {
+	deadline := time.Now().Add(time.Second)
+	for len(r.Received()) < n && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return r.Received()
+}
+
+// StartPipeline starts the ring the published metrics go through to the
+// outputs, the returned function stops it and restores the config.
+func StartPipeline(outputs ...service.MetricOutputer) func() {
+	conf := service.Conf
+	service.Conf = &service.Config{Stream: &service.StreamConfig{
+		DisruptorBuffersize:   64,
+		DisruptorBuffermask:   63,
+		DisruptorReservations: 1,
+	}}
+	s := service.New()
+	s.Init()
+	c := service.NewController()
+	c.Init(64, 63, 1)
+	c.Start()
+
+	stop := make(chan bool)
+	for _, mo := range outputs {
+		mc := &service.MetricOutputConfig{
+			Name:              "test",
+			MetricOutput:      mo,
+			MetricBufferLimit: 1000,
+			Precision:         time.Nanosecond,
+		}
+		mc.Start(stop)
+		service.Conf.MetricOutputs = append(service.Conf.MetricOutputs, mc)
+	}
+
+	return func() {
+		c.Close()
+		close(stop)
+		service.Conf = conf
+	}
+}
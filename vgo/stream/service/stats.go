@@ -0,0 +1,207 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statsMeasurement is the measurement of the internal metrics injected in
+// the pipeline
+const statsMeasurement = "vgo"
+
+// PluginStats are the internal counters of a plugin, safe for concurrent use.
+type PluginStats struct {
+	gathered      int64
+	written       int64
+	dropped       int64
+	writeErrors   int64
+	bufferSize    int64
+	flushDuration int64
+	breakerState  int64
+	activeOutput  int64
+
+	kind string
+	name string
+	// instance tells apart the instances of a plugin
+	instance string
+}
+
+// Gathered counts metrics read by an input.
+func (ps *PluginStats) Gathered(n int) {
+	atomic.AddInt64(&ps.gathered, int64(n))
+}
+
+// Written counts metrics written by an output.
+func (ps *PluginStats) Written(n int) {
+	atomic.AddInt64(&ps.written, int64(n))
+}
+
+// Dropped counts metrics lost by a plugin.
+func (ps *PluginStats) Dropped(n int) {
+	atomic.AddInt64(&ps.dropped, int64(n))
+}
+
+// WriteError counts a failed write.
+func (ps *PluginStats) WriteError() {
+	atomic.AddInt64(&ps.writeErrors, 1)
+}
+
+// SetBufferSize records the number of metrics waiting in the plugin buffers.
+func (ps *PluginStats) SetBufferSize(n int) {
+	atomic.StoreInt64(&ps.bufferSize, int64(n))
+}
+
+// SetFlushDuration records the duration of the last write.
+func (ps *PluginStats) SetFlushDuration(d time.Duration) {
+	atomic.StoreInt64(&ps.flushDuration, int64(d))
+}
+
+// SetBreakerState records the state of the output circuit breaker.
+func (ps *PluginStats) SetBreakerState(state BreakerState) {
+	atomic.StoreInt64(&ps.breakerState, int64(state))
+}
+
+// SetActiveOutput records the output of the last write, 0 for the output
+// itself and i for its i-th failover.
+func (ps *PluginStats) SetActiveOutput(i int) {
+	atomic.StoreInt64(&ps.activeOutput, int64(i))
+}
+
+// fields returns a snapshot of the counters.
+func (ps *PluginStats) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"metrics_gathered":  atomic.LoadInt64(&ps.gathered),
+		"metrics_written":   atomic.LoadInt64(&ps.written),
+		"metrics_dropped":   atomic.LoadInt64(&ps.dropped),
+		"write_errors":      atomic.LoadInt64(&ps.writeErrors),
+		"buffer_size":       atomic.LoadInt64(&ps.bufferSize),
+		"flush_duration_ns": atomic.LoadInt64(&ps.flushDuration),
+		"breaker_state":     atomic.LoadInt64(&ps.breakerState),
+		"active_output":     atomic.LoadInt64(&ps.activeOutput),
+	}
+}
+
+type stats struct {
+	sync.RWMutex
+	plugins map[string]*PluginStats
+}
+
+var internalStats = &stats{
+	plugins: make(map[string]*PluginStats),
+}
+
+// InputStats returns the counters of the input plugin.
+func InputStats(name string) *PluginStats {
+	return internalStats.get("input", name, name)
+}
+
+// OutputStats returns the counters of an instance of the metric output
+// plugin.
+func OutputStats(name, instance string) *PluginStats {
+	return internalStats.get("metric_output", name, instance)
+}
+
+func (s *stats) get(kind, name, instance string) *PluginStats {
+	key := kind + "." + instance
+
+	s.RLock()
+	ps, ok := s.plugins[key]
+	s.RUnlock()
+	if ok {
+		return ps
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if ps, ok := s.plugins[key]; ok {
+		return ps
+	}
+	ps = &PluginStats{kind: kind, name: name, instance: instance}
+	s.plugins[key] = ps
+	return ps
+}
+
+// list returns the plugins stats sorted by kind and instance.
+func (s *stats) list() []*PluginStats {
+	s.RLock()
+	keys := make([]string, 0, len(s.plugins))
+	for k := range s.plugins {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	list := make([]*PluginStats, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, s.plugins[k])
+	}
+	s.RUnlock()
+	return list
+}
+
+// metrics returns the stats as metrics of the vgo measurement.
+func (s *stats) metrics() Metrics {
+	hostname, _ := os.Hostname()
+	now := time.Now()
+
+	m := Metrics{}
+	for _, ps := range s.list() {
+		m.Data = append(m.Data, &MetricData{
+			Name: statsMeasurement,
+			Tags: map[string]string{
+				"host":     hostname,
+				"kind":     ps.kind,
+				"plugin":   ps.name,
+				"instance": ps.instance,
+			},
+			Fields: ps.fields(),
+			Time:   now,
+		})
+	}
+	return m
+}
+
+// writePrometheus writes the stats in the prometheus text format.
+func (s *stats) writePrometheus(w io.Writer) {
+	list := s.list()
+
+	fields := []string{}
+	for f := range (&PluginStats{}).fields() {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+
+	for _, f := range fields {
+		name := statsMeasurement + "_" + f
+		typ := "counter"
+		if f == "buffer_size" || f == "flush_duration_ns" || f == "breaker_state" || f == "active_output" {
+			typ = "gauge"
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+		for _, ps := range list {
+			fmt.Fprintf(w, "%s{kind=%q,plugin=%q,instance=%q} %v\n", name, ps.kind, ps.name, ps.instance, ps.fields()[f])
+		}
+	}
+}
+
+// injectStats publishes the stats at every interval, they go down the
+// pipeline like the metrics of the inputs.
+func injectStats(interval time.Duration, stopC chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if m := internalStats.metrics(); len(m.Data) > 0 {
+				Publish(m)
+			}
+		case <-stopC:
+			return
+		}
+	}
+}
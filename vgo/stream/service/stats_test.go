@@ -0,0 +1,112 @@
+package service
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// resetStats forgets the stats of the previous runs of the tests.
+func resetStats() {
+	internalStats.Lock()
+	internalStats.plugins = make(map[string]*PluginStats)
+	internalStats.Unlock()
+}
+
+// statsOf returns the fields of the stats of the plugin instance in the
+// internal metrics.
+func statsOf(t *testing.T, kind, instance string) map[string]interface{} {
+	for _, m := range internalStats.metrics().Data {
+		if m.Tags["kind"] == kind && m.Tags["instance"] == instance {
+			if m.Name != statsMeasurement {
+				t.Errorf("stats measurement %s", m.Name)
+			}
+			return m.Fields
+		}
+	}
+	t.Fatalf("no stats of %s %s", kind, instance)
+	return nil
+}
+
+func TestInputStats(t *testing.T) {
+	resetStats()
+	InputStats("stats_gather").Gathered(3)
+	InputStats("stats_gather").Gathered(2)
+	if n := statsOf(t, "input", "stats_gather")["metrics_gathered"]; n != int64(5) {
+		t.Errorf("metrics_gathered %v, want 5", n)
+	}
+}
+
+func TestOutputStats(t *testing.T) {
+	resetStats()
+	mo := &mockOutput{}
+	mc := &MetricOutputConfig{Name: "stats_output", MetricOutput: mo, MetricBufferLimit: 2}
+	defer startOutput(mc)()
+
+	mc.Compute(Metrics{Data: testMetrics(3)})
+	fields := statsOf(t, "metric_output", "stats_output")
+	if fields["metrics_written"] != int64(3) || fields["write_errors"] != int64(0) || fields["metrics_dropped"] != int64(0) {
+		t.Errorf("after a write, got stats %v", fields)
+	}
+
+	// the failed metrics are kept up to the buffer limit, the others dropped
+	mo.setFail(true)
+	mc.Compute(Metrics{Data: testMetrics(3)})
+	fields = statsOf(t, "metric_output", "stats_output")
+	if fields["metrics_written"] != int64(3) || fields["write_errors"] != int64(1) || fields["metrics_dropped"] != int64(1) || fields["buffer_size"] != int64(2) {
+		t.Errorf("after a failed write, got stats %v", fields)
+	}
+
+	mo.setFail(false)
+	mc.Compute(Metrics{Data: testMetrics(1)})
+	fields = statsOf(t, "metric_output", "stats_output")
+	if fields["metrics_written"] != int64(6) || fields["buffer_size"] != int64(0) {
+		t.Errorf("after the retry, got stats %v", fields)
+	}
+
+	// the metrics reaching a stopped output are dropped
+	mc.halt()
+	mc.Compute(Metrics{Data: testMetrics(4)})
+	if n := statsOf(t, "metric_output", "stats_output")["metrics_dropped"]; n != int64(5) {
+		t.Errorf("after the stop, metrics_dropped %v, want 5", n)
+	}
+}
+
+func TestOutputInstanceStats(t *testing.T) {
+	resetStats()
+	c := &Config{}
+	for _, alias := range []string{"", "", "backup"} {
+		mc := &MetricOutputConfig{Name: "stats_instance", Alias: alias, MetricOutput: &mockOutput{}}
+		mc.instance = c.outputInstance(mc)
+		c.MetricOutputs = append(c.MetricOutputs, mc)
+	}
+
+	for i, mc := range c.MetricOutputs {
+		defer startOutput(mc)()
+		mc.Compute(Metrics{Data: testMetrics(i + 1)})
+	}
+	for i, instance := range []string{"stats_instance", "stats_instance_2", "backup"} {
+		fields := statsOf(t, "metric_output", instance)
+		if fields["metrics_written"] != int64(i+1) {
+			t.Errorf("%s metrics_written %v, want %d", instance, fields["metrics_written"], i+1)
+		}
+	}
+}
+
+func TestStatsPrometheus(t *testing.T) {
+	resetStats()
+	OutputStats("stats_prometheus", "stats_prometheus").Written(7)
+
+	var b bytes.Buffer
+	internalStats.writePrometheus(&b)
+	out := b.String()
+	for _, want := range []string{
+		"# TYPE vgo_metrics_written counter\n",
+		"# TYPE vgo_buffer_size gauge\n",
+		`vgo_metrics_written{kind="metric_output",plugin="stats_prometheus",instance="stats_prometheus"} 7` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("%q missing from\n%s", want, out)
+		}
+	}
+}
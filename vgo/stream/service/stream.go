@@ -1,8 +1,11 @@
 package service
 
 import (
+	"fmt"
 	"log"
+	"time"
 
+	"github.com/corego/vgo/mecury/misc"
 	"github.com/uber-go/zap"
 )
 
@@ -16,6 +19,28 @@ type StreamConfig struct {
 	DisruptorReservations int64
 	StrategyDbname        string
 	StrategyBucketname    string
+
+	// FlushJitter delays the output flushes by a random amount up to it,
+	// drawn once per output
+	FlushJitter misc.Duration
+	// CollectionJitter delays the input gathers by a random amount up to
+	// it, drawn once per input
+	CollectionJitter misc.Duration
+
+	// HealthAddr is the listen address of the /healthz and /ready probes,
+	// they are disabled when empty
+	HealthAddr string
+
+	// StatsInterval is the interval the internal stats are sent down the
+	// pipeline at, as the vgo measurement. They aren't sent when zero
+	StatsInterval misc.Duration
+
+	// ShutdownTimeout bounds the final flush of the metric outputs on stop
+	ShutdownTimeout misc.Duration
+
+	// StampZeroTimes gives the published metrics without a time the time
+	// of their batch, on by default
+	StampZeroTimes bool
 }
 
 func (sc *StreamConfig) Show() {
@@ -26,6 +51,12 @@ func (sc *StreamConfig) Show() {
 	log.Println("DisruptorReservations", sc.DisruptorReservations)
 	log.Println("StrategyDbName", sc.StrategyDbname)
 	log.Println("StrategyBucketName", sc.StrategyBucketname)
+	log.Println("FlushJitter", sc.FlushJitter.Duration)
+	log.Println("CollectionJitter", sc.CollectionJitter.Duration)
+	log.Println("HealthAddr", sc.HealthAddr)
+	log.Println("StatsInterval", sc.StatsInterval.Duration)
+	log.Println("ShutdownTimeout", sc.ShutdownTimeout.Duration)
+	log.Println("StampZeroTimes", sc.StampZeroTimes)
 }
 
 // Stream struct
@@ -35,6 +66,7 @@ type Stream struct {
 	writer          *Writer
 	controller      *Controller
 	alarmer         *Alarmer
+	health          *Health
 	// strategyes      *strategy.Strategy
 	// hosts           *strategy.Hosts
 }
@@ -147,6 +179,12 @@ func (s *Stream) Start(shutdown chan struct{}) {
 
 	s.alarmer.Start()
 
+	// the facts are gathered before the first metrics
+	if Conf.Facts != nil {
+		facts = NewFacts(Conf.Facts)
+		facts.Start(s.stopPluginsChan)
+	}
+
 	// start plugins service
 	for _, c := range Conf.Inputs {
 		c.Start(s.stopPluginsChan, s.metricChan)
@@ -165,16 +203,66 @@ func (s *Stream) Start(shutdown chan struct{}) {
 	for _, c := range Conf.MetricOutputs {
 		c.Start(s.stopPluginsChan)
 	}
+
+	if Conf.Stream.StatsInterval.Duration > 0 {
+		go injectStats(Conf.Stream.StatsInterval.Duration, s.stopPluginsChan)
+	}
+
+	if Conf.Stream.HealthAddr != "" {
+		s.health = NewHealth(Conf.Stream.HealthAddr)
+		if err := s.health.Start(); err != nil {
+			log.Fatal("Health Start failed, err message is ", err)
+		}
+	}
 }
 
-// Close close stream server
+// Close close stream server: the inputs are stopped first, then the metrics
+// already in the pipeline are consumed and the metric outputs write what they
+// still buffer, within ShutdownTimeout. The outputs are closed last.
 func (s *Stream) Close() error {
 	log.Println("Stream close!")
-	close(s.stopPluginsChan)
-	close(s.metricChan)
+	if s.health != nil {
+		s.health.Close()
+	}
+
+	for _, c := range Conf.Inputs {
+		c.Stop()
+	}
 
 	// s.writer.Close()
 	s.controller.Close()
+
+	// stops the workers and the flush loops
+	close(s.stopPluginsChan)
+	close(s.metricChan)
+
+	done := make(chan struct{})
+	go func() {
+		for _, c := range Conf.MetricOutputs {
+			c.Drain()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(Conf.Stream.ShutdownTimeout.Duration):
+		log.Println("Stream final flush timed out after", Conf.Stream.ShutdownTimeout.Duration)
+		for _, c := range Conf.MetricOutputs {
+			c.Abort()
+		}
+	}
+
 	s.alarmer.Close()
+
+	var errS string
+	for _, c := range Conf.MetricOutputs {
+		if err := c.Close(); err != nil {
+			log.Println("MetricOutput ", c.Name, " Close failed, err message is", err)
+			errS += err.Error() + "\n"
+		}
+	}
+	if errS != "" {
+		return fmt.Errorf("stream close failed: %s", errS)
+	}
 	return nil
 }
@@ -0,0 +1,14 @@
+package service
+
+import "time"
+
+// stampZeroTimes gives the metrics without a time the collection time of
+// the batch, so a batch doesn't mix times set by the outputs or the
+// servers with the times of the inputs. The metrics having a time keep it.
+func stampZeroTimes(metrics []*MetricData, now time.Time) {
+	for _, m := range metrics {
+		if m.Time.IsZero() {
+			m.Time = now
+		}
+	}
+}
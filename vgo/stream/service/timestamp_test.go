@@ -0,0 +1,76 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStampZeroTimes(t *testing.T) {
+	set := time.Unix(1500000000, 0)
+	metrics := []*MetricData{{Name: "a"}, {Name: "b", Time: set}, {Name: "c"}}
+	now := time.Unix(1600000000, 0)
+	stampZeroTimes(metrics, now)
+
+	for _, m := range []*MetricData{metrics[0], metrics[2]} {
+		if !m.Time.Equal(now) {
+			t.Errorf("metric %s without a time, got %s, want the stamp %s", m.Name, m.Time, now)
+		}
+	}
+	if !metrics[1].Time.Equal(set) {
+		t.Errorf("metric b got %s, want its time %s", metrics[1].Time, set)
+	}
+}
+
+func TestPublishStampsZeroTimes(t *testing.T) {
+	mo := &mockOutput{}
+	mc := &MetricOutputConfig{Name: "stamp_output", MetricOutput: mo}
+	defer startOutput(mc)()
+
+	c := newConfig()
+	c.MetricOutputs = []*MetricOutputConfig{mc}
+	setConf(c)
+	defer setConf(newConfig())
+	if streamer == nil {
+		streamer = &Stream{alarmer: NewAlarm()}
+		defer func() { streamer = nil }()
+	}
+	ctl := NewController()
+	ctl.Init(64, 63, 1)
+	ctl.Start()
+	defer ctl.Close()
+
+	if !c.Stream.StampZeroTimes {
+		t.Fatal("zero times not stamped by default")
+	}
+
+	set := time.Unix(1500000000, 0)
+	batch := testMetrics(4)
+	batch[0].Time = time.Time{}
+	batch[1].Time = set
+	batch[2].Time = time.Time{}
+	before := time.Now()
+	Publish(Metrics{Data: batch})
+	after := time.Now()
+
+	waitFor(t, time.Second, func() bool { return mo.written() == 4 })
+	// the zero ones share one stamp of the publish
+	if !batch[0].Time.Equal(batch[2].Time) {
+		t.Errorf("zero times stamped %s and %s, want one stamp for the batch", batch[0].Time, batch[2].Time)
+	}
+	if batch[0].Time.Before(before) || batch[0].Time.After(after) {
+		t.Errorf("got stamp %s, want the publish time", batch[0].Time)
+	}
+	if !batch[1].Time.Equal(set) || !batch[3].Time.Equal(time.Unix(1500000003, 0)) {
+		t.Errorf("set times changed to %s and %s", batch[1].Time, batch[3].Time)
+	}
+
+	// disabled, the zero times are left to the outputs
+	c.Stream.StampZeroTimes = false
+	unset := testMetrics(2)
+	unset[0].Time = time.Time{}
+	Publish(Metrics{Data: unset})
+	waitFor(t, time.Second, func() bool { return mo.written() == 6 })
+	if !unset[0].Time.IsZero() {
+		t.Errorf("got time %s with the stamp disabled, want zero", unset[0].Time)
+	}
+}
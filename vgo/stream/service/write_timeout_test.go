@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/naoina/toml"
+)
+
+// chunkedOutput writes the metrics by chunks taking pause each, it stops
+// between two chunks when the context is done.
+type chunkedOutput struct {
+	mockOutput
+	chunk int
+
+	mu    sync.Mutex
+	pause time.Duration
+}
+
+func (o *chunkedOutput) setPause(d time.Duration) {
+	o.mu.Lock()
+	o.pause = d
+	o.mu.Unlock()
+}
+
+func (o *chunkedOutput) ComputeContext(ctx context.Context, m Metrics) error {
+	o.mu.Lock()
+	pause := o.pause
+	o.mu.Unlock()
+
+	for n := 0; n < len(m.Data); n += o.chunk {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pause):
+		}
+	}
+	return o.mockOutput.Compute(m)
+}
+
+func TestSlowWriteTimeout(t *testing.T) {
+	// 10 chunks of 30ms, the write takes 300ms
+	mo := &chunkedOutput{chunk: 10, pause: 30 * time.Millisecond}
+	mc := &MetricOutputConfig{MetricOutput: mo, WriteTimeout: 100 * time.Millisecond}
+	defer startOutput(mc)()
+
+	start := time.Now()
+	err := mc.compute(mo, Metrics{Data: testMetrics(100)})
+	elapsed := time.Since(start)
+	if err == nil || !strings.Contains(err.Error(), "write timeout") {
+		t.Fatalf("got error %v, want a write timeout", err)
+	}
+	if elapsed < 100*time.Millisecond || elapsed > 250*time.Millisecond {
+		t.Errorf("write aborted after %s, the timeout is 100ms", elapsed)
+	}
+	// buffered for the next write
+	if n := mc.retry.Len(); n != 100 {
+		t.Errorf("%d metrics kept for a retry, want 100", n)
+	}
+	if mc.Healthy() {
+		t.Error("output healthy after a write timeout")
+	}
+
+	// the next write is fast enough, it writes the buffered metrics too
+	mo.setPause(time.Millisecond)
+	mc.Compute(Metrics{Data: testMetrics(10)})
+	if n := mo.written(); n != 110 {
+		t.Errorf("%d metrics written, want 110", n)
+	}
+	if !mc.Healthy() {
+		t.Error("output unhealthy after a write")
+	}
+}
+
+func TestWriteContextDeadline(t *testing.T) {
+	for _, tt := range []struct {
+		flushInterval time.Duration
+		writeTimeout  time.Duration
+		want          time.Duration
+	}{
+		{0, 0, 0},
+		// the write ends before the next flush
+		{10 * time.Second, 0, 10 * time.Second},
+		{0, 3 * time.Second, 3 * time.Second},
+		{10 * time.Second, 3 * time.Second, 3 * time.Second},
+		{10 * time.Second, 30 * time.Second, 30 * time.Second},
+	} {
+		mc := &MetricOutputConfig{FlushInterval: tt.flushInterval, WriteTimeout: tt.writeTimeout, ctx: context.Background()}
+		ctx, cancel := mc.writeContext()
+		deadline, ok := ctx.Deadline()
+		cancel()
+
+		if tt.want == 0 {
+			if ok {
+				t.Errorf("flush interval %s write timeout %s, got a deadline", tt.flushInterval, tt.writeTimeout)
+			}
+			continue
+		}
+		if left := deadline.Sub(time.Now()); !ok || left > tt.want || left < tt.want-time.Second {
+			t.Errorf("flush interval %s write timeout %s, got deadline in %s, want %s", tt.flushInterval, tt.writeTimeout, left, tt.want)
+		}
+	}
+}
+
+func TestWriteTimeoutConfig(t *testing.T) {
+	for _, tt := range []struct {
+		conf string
+		want time.Duration
+		err  bool
+	}{
+		{`write_timeout = "5s"`, 5 * time.Second, false},
+		{`write_timeout = "0s"`, 0, false},
+		{`write_timeout = "-1s"`, 0, true},
+		{`write_timeout = "soon"`, 0, true},
+	} {
+		tbl, err := toml.Parse([]byte(tt.conf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mc, err := buildMetricOutput("test", tbl)
+		if (err != nil) != tt.err {
+			t.Errorf("%s, got error %v", tt.conf, err)
+			continue
+		}
+		if err == nil && mc.WriteTimeout != tt.want {
+			t.Errorf("%s, got write timeout %s, want %s", tt.conf, mc.WriteTimeout, tt.want)
+		}
+	}
+}
@@ -8,17 +8,51 @@ func (this Writer) Consume(lower, upper int64) {
 	for lower <= upper {
 		m = controller.ring[lower&controller.bufferMask]
 		// 消费
+		consume(m)
 
-		streamer.alarmer.Compute(m)
+		lower++
+	}
+}
+
+// consume tags the metrics with the host facts and runs them through the
+// processors, the alarmer, the chains and the metric outputs. A reload
+// waits for the batch to go through.
+func consume(m Metrics) {
+	confMu.RLock()
+	defer confMu.RUnlock()
 
-		for _, c := range Conf.Chains {
-			c.Chain.Compute(m)
+	if !m.Verbatim {
+		if facts != nil {
+			facts.apply(m.Data)
 		}
+		m = applyProcessors(m)
+	}
+	m = dropEmpty(m)
+
+	streamer.alarmer.Compute(m)
 
-		for _, c := range Conf.MetricOutputs {
-			c.MetricOutput.Compute(m)
+	for _, c := range Conf.Chains {
+		c.Chain.Compute(m)
+	}
+
+	for _, c := range Conf.MetricOutputs {
+		c.Compute(m)
+	}
+}
+
+// dropEmpty removes the metrics without fields, left by the inputs or the
+// processors, the outputs can't write them.
+func dropEmpty(m Metrics) Metrics {
+	data := m.Data[:0]
+	for _, metric := range m.Data {
+		if len(metric.Fields) > 0 {
+			data = append(data, metric)
 		}
+	}
 
-		lower++
+	if dropped := len(m.Data) - len(data); dropped > 0 {
+		internalStats.get("pipeline", "empty_metrics", "empty_metrics").Dropped(dropped)
 	}
+	m.Data = data
+	return m
 }
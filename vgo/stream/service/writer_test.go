@@ -0,0 +1,41 @@
+package service
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConsumeDropsEmptyMetrics(t *testing.T) {
+	mo := &mockOutput{}
+	mc := &MetricOutputConfig{Name: "consume_output", MetricOutput: mo}
+	defer startOutput(mc)()
+
+	c := newConfig()
+	c.MetricOutputs = []*MetricOutputConfig{mc}
+	setConf(c)
+	defer setConf(newConfig())
+	if streamer == nil {
+		streamer = &Stream{alarmer: NewAlarm()}
+		defer func() { streamer = nil }()
+	}
+
+	ps := internalStats.get("pipeline", "empty_metrics", "empty_metrics")
+	before := atomic.LoadInt64(&ps.dropped)
+
+	// the fields of the middle metric were all removed by the processors
+	good := testMetrics(2)
+	consume(Metrics{Data: []*MetricData{good[0], {Name: "cpu", Fields: map[string]interface{}{}}, good[1]}})
+
+	waitFor(t, time.Second, func() bool { return mo.written() == 2 })
+	mo.Lock()
+	defer mo.Unlock()
+	for _, m := range mo.metrics {
+		if len(m.Fields) == 0 {
+			t.Error("metric without fields written")
+		}
+	}
+	if n := atomic.LoadInt64(&ps.dropped) - before; n != 1 {
+		t.Errorf("%d metrics counted as dropped, want 1", n)
+	}
+}